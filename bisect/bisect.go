@@ -0,0 +1,437 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package bisect finds the kernel commit that introduced (or fixed) a crash.
+// Commits are selected with git bisect, each commit is built and the crash
+// reproducer is run on VMs created according to the manager config.
+package bisect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/config"
+	"github.com/google/syzkaller/csource"
+	"github.com/google/syzkaller/fileutil"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+type Config struct {
+	Manager      *config.Config // VM and execution params, kernel and vmlinux are taken from KernelSrc
+	KernelSrc    string         // kernel git checkout used for building
+	KernelConfig []byte         // kernel .config used for all builds
+	KernelImage  string         // kernel image relative to KernelSrc (e.g. arch/x86/boot/bzImage)
+	Fix          bool           // bisect the fixing commit rather than the commit that introduced the crash
+	Good         string         // commit where the crash does not happen
+	Bad          string         // commit where the crash happens
+	Repro        []byte         // reproducer in repro.prog format (options comment followed by the program)
+	Title        string         // crash title
+	Duration     time.Duration  // how long to run the reproducer on each commit
+	StateFile    string         // progress is saved to this file (optional)
+}
+
+// State describes progress and result of a bisection.
+// It is persisted as JSON, so that the manager can show it in the web UI.
+type State struct {
+	Kind        string // "cause" or "fix"
+	Title       string // crash title
+	Status      string // StatusRunning, StatusDone or StatusFailed
+	Started     time.Time
+	Updated     time.Time
+	Steps       []*Step
+	Commit      string // result commit hash
+	CommitTitle string
+	Error       string
+}
+
+// Step describes testing of a single commit.
+type Step struct {
+	Commit      string
+	CommitTitle string
+	Time        time.Time
+	Result      string // ResultBuilding/ResultTesting while in progress, then ResultCrash/ResultOK/ResultSkip
+	Crash       string // crash title if crashed
+	Error       string // build or boot error if skipped
+}
+
+const (
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+
+	ResultBuilding = "building"
+	ResultTesting  = "testing"
+	ResultCrash    = "crash"
+	ResultOK       = "ok"
+	ResultSkip     = "skip"
+)
+
+type env struct {
+	cfg   *Config
+	mgr   *config.Config
+	state *State
+}
+
+// Run bisects the crash. The returned state has either StatusDone or StatusFailed.
+func Run(cfg *Config) *State {
+	kind := "cause"
+	if cfg.Fix {
+		kind = "fix"
+	}
+	now := time.Now()
+	e := &env{
+		cfg: cfg,
+		state: &State{
+			Kind:    kind,
+			Title:   cfg.Title,
+			Status:  StatusRunning,
+			Started: now,
+			Updated: now,
+		},
+	}
+	if err := e.bisect(); err != nil {
+		e.state.Status = StatusFailed
+		e.state.Error = err.Error()
+		Logf(0, "bisect: failed: %v", err)
+	} else {
+		e.state.Status = StatusDone
+		Logf(0, "bisect: the first %v commit is %v %v", kind, e.state.Commit, e.state.CommitTitle)
+	}
+	e.save()
+	return e.state
+}
+
+func (e *env) bisect() error {
+	if e.cfg.Good == "" || e.cfg.Bad == "" {
+		return fmt.Errorf("both good and bad commits must be specified")
+	}
+	if err := e.init(); err != nil {
+		return err
+	}
+
+	// Bisection terms: new commits are the ones we are looking for the first of.
+	// These are crashing commits when bisecting the cause and not crashing when bisecting the fix.
+	oldCommit, newCommit := e.cfg.Good, e.cfg.Bad
+	if e.cfg.Fix {
+		oldCommit, newCommit = e.cfg.Bad, e.cfg.Good
+	}
+	for _, commit := range []string{e.cfg.Bad, e.cfg.Good} {
+		if _, err := e.git("checkout", "-q", commit); err != nil {
+			return err
+		}
+		res, err := e.test()
+		if err != nil {
+			return err
+		}
+		if res == ResultSkip {
+			return fmt.Errorf("failed to build or boot kernel at %v", commit)
+		}
+		if commit == e.cfg.Bad && res != ResultCrash {
+			return fmt.Errorf("the crash does not happen at the bad commit %v", commit)
+		}
+		if commit == e.cfg.Good && res == ResultCrash {
+			return fmt.Errorf("the crash happens at the good commit %v", commit)
+		}
+	}
+
+	out, err := e.git("bisect", "start", "--term-old=old", "--term-new=new", newCommit, oldCommit)
+	if err != nil {
+		return err
+	}
+	defer e.git("bisect", "reset")
+	for {
+		commit, done, err := parseBisectOutput(out)
+		if err != nil {
+			return err
+		}
+		if done {
+			e.state.Commit = commit
+			e.state.CommitTitle, _ = e.git("log", "-1", "--format=%s", commit)
+			e.state.CommitTitle = strings.TrimSpace(e.state.CommitTitle)
+			return nil
+		}
+		res, err := e.test()
+		if err != nil {
+			return err
+		}
+		term := "skip"
+		if res != ResultSkip {
+			term = "old"
+			if (res == ResultCrash) != e.cfg.Fix {
+				term = "new"
+			}
+		}
+		if out, err = e.git("bisect", term); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *env) init() error {
+	if _, err := os.Stat(filepath.Join(e.cfg.KernelSrc, ".git")); err != nil {
+		return fmt.Errorf("%v is not a git checkout", e.cfg.KernelSrc)
+	}
+	if len(e.cfg.KernelConfig) == 0 {
+		return fmt.Errorf("kernel config is empty")
+	}
+	if _, _, err := csource.ParseRepro(e.cfg.Repro); err != nil {
+		return err
+	}
+	mgr := *e.cfg.Manager
+	mgr.Kernel = filepath.Join(e.cfg.KernelSrc, e.cfg.KernelImage)
+	mgr.Vmlinux = filepath.Join(e.cfg.KernelSrc, "vmlinux")
+	e.mgr = &mgr
+	return nil
+}
+
+var (
+	bisectFirstRe   = regexp.MustCompile(`(?m)^([0-9a-f]{40}) is the first new commit`)
+	bisectCurrentRe = regexp.MustCompile(`(?m)^\[([0-9a-f]{40})\]`)
+)
+
+// parseBisectOutput parses output of git bisect start/old/new/skip.
+// It returns either the commit to test next, or the result commit with done set.
+func parseBisectOutput(out string) (commit string, done bool, err error) {
+	if m := bisectFirstRe.FindStringSubmatch(out); m != nil {
+		return m[1], true, nil
+	}
+	if strings.Contains(out, "only 'skip'ped commits left") {
+		return "", false, fmt.Errorf("failed to bisect, remaining commits can't be tested:\n%v", out)
+	}
+	if m := bisectCurrentRe.FindStringSubmatch(out); m != nil {
+		return m[1], false, nil
+	}
+	return "", false, fmt.Errorf("failed to parse git bisect output:\n%v", out)
+}
+
+// test builds the current commit and runs the reproducer.
+// Returns one of ResultCrash, ResultOK or ResultSkip (if the kernel can't be built or booted).
+func (e *env) test() (string, error) {
+	out, err := e.git("log", "-1", "--format=%H %s")
+	if err != nil {
+		return "", err
+	}
+	out = strings.TrimSpace(out)
+	step := &Step{
+		Commit: out,
+		Time:   time.Now(),
+		Result: ResultBuilding,
+	}
+	if space := strings.IndexByte(out, ' '); space != -1 {
+		step.Commit, step.CommitTitle = out[:space], out[space+1:]
+	}
+	e.state.Steps = append(e.state.Steps, step)
+	e.save()
+	Logf(0, "bisect: testing commit %v %v", step.Commit, step.CommitTitle)
+
+	if err := BuildKernel(e.cfg.KernelSrc, e.cfg.KernelImage, e.cfg.KernelConfig); err != nil {
+		Logf(0, "bisect: %v", err)
+		step.Result = ResultSkip
+		step.Error = err.Error()
+		e.save()
+		return step.Result, nil
+	}
+	step.Result = ResultTesting
+	e.save()
+	crash, err := TestRepro(e.mgr, e.cfg.Repro, e.cfg.Duration)
+	switch {
+	case err != nil:
+		Logf(0, "bisect: %v", err)
+		step.Result = ResultSkip
+		step.Error = err.Error()
+	case crash != "":
+		Logf(0, "bisect: crashed: %v", crash)
+		step.Result = ResultCrash
+		step.Crash = crash
+	default:
+		Logf(0, "bisect: did not crash")
+		step.Result = ResultOK
+	}
+	e.save()
+	return step.Result, nil
+}
+
+// BuildKernel builds kernel image (e.g. arch/x86/boot/bzImage) and vmlinux in src with the given .config.
+func BuildKernel(src, image string, kernelConfig []byte) error {
+	if err := ioutil.WriteFile(filepath.Join(src, ".config"), kernelConfig, 0640); err != nil {
+		return fmt.Errorf("failed to write kernel config: %v", err)
+	}
+	if _, err := runCmd(src, "make", "olddefconfig"); err != nil {
+		return fmt.Errorf("kernel build failed: %v", err)
+	}
+	target := filepath.Base(image)
+	if _, err := runCmd(src, "make", fmt.Sprintf("-j%v", runtime.NumCPU()), target); err != nil {
+		return fmt.Errorf("kernel build failed: %v", err)
+	}
+	return nil
+}
+
+// TestRepro runs reproducer in repro.prog format on all VMs in parallel for duration
+// and returns crash title if any of them crashed.
+// Returns an error only if none of the VMs managed to run the reproducer.
+func TestRepro(cfg *config.Config, repro []byte, duration time.Duration) (string, error) {
+	opts, p, err := csource.ParseRepro(repro)
+	if err != nil {
+		return "", err
+	}
+	progFile, err := fileutil.WriteTempFile(p)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(progFile)
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		crash   string
+		lastErr error
+		ran     int
+	)
+	for i := 0; i < cfg.Count; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			desc, err := testReproInstance(cfg, index, opts, progFile, duration)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			ran++
+			if desc != "" && crash == "" {
+				crash = desc
+			}
+		}(i)
+	}
+	wg.Wait()
+	if ran == 0 {
+		return "", lastErr
+	}
+	return crash, nil
+}
+
+// TestReproInstance runs reproducer in repro.prog format on the VM with the index for duration
+// and returns crash title if the VM crashed.
+func TestReproInstance(cfg *config.Config, index int, repro []byte, duration time.Duration) (string, error) {
+	opts, p, err := csource.ParseRepro(repro)
+	if err != nil {
+		return "", err
+	}
+	progFile, err := fileutil.WriteTempFile(p)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(progFile)
+	return testReproInstance(cfg, index, opts, progFile, duration)
+}
+
+func testReproInstance(cfg *config.Config, index int, opts csource.Options, progFile string, duration time.Duration) (string, error) {
+	vmCfg, err := config.CreateVMConfig(cfg, index)
+	if err != nil {
+		return "", fmt.Errorf("failed to create VM config: %v", err)
+	}
+	inst, err := vm.Create(cfg.Type, vmCfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to create VM: %v", err)
+	}
+	defer inst.Close()
+	execprogBin, err := inst.Copy(config.TargetBin(cfg, "syz-execprog"))
+	if err != nil {
+		return "", fmt.Errorf("failed to copy to VM: %v", err)
+	}
+	executorBin, err := inst.Copy(config.TargetBin(cfg, "syz-executor"))
+	if err != nil {
+		return "", fmt.Errorf("failed to copy to VM: %v", err)
+	}
+	vmProgFile, err := inst.Copy(progFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy to VM: %v", err)
+	}
+	repeat := "1"
+	if opts.Repeat {
+		repeat = "0"
+	}
+	faultCall := -1
+	if opts.Fault {
+		faultCall = opts.FaultCall
+	}
+	cmd := fmt.Sprintf("%v -executor %v -cover=0 -procs=%v -repeat=%v -sandbox %v -threaded=%v -collide=%v -fault_call=%v -fault_nth=%v -pin_cpus=%v -low_priority=%v %v",
+		execprogBin, executorBin, opts.Procs, repeat, opts.Sandbox, opts.Threaded, opts.Collide,
+		faultCall, opts.FaultNth, cfg.Pin_Cpus, cfg.Low_Priority, vmProgFile)
+	outc, errc, err := inst.Run(duration, nil, cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to run reproducer: %v", err)
+	}
+	desc, _, _, crashed, _ := vm.MonitorExecution(inst, outc, errc, false, false, cfg.ParsedIgnores)
+	if !crashed {
+		return "", nil
+	}
+	return desc, nil
+}
+
+func (e *env) git(args ...string) (string, error) {
+	return Git(e.cfg.KernelSrc, args...)
+}
+
+// Git runs git with args in dir and returns its output.
+func Git(dir string, args ...string) (string, error) {
+	return runCmd(dir, "git", args...)
+}
+
+func runCmd(dir, bin string, args ...string) (string, error) {
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		// Kernel build output is long, the error is usually at the end.
+		if len(out) > 4<<10 {
+			out = out[len(out)-4<<10:]
+		}
+		return string(out), fmt.Errorf("%v %v failed: %v\n%s", bin, strings.Join(args, " "), err, out)
+	}
+	return string(out), nil
+}
+
+func (e *env) save() {
+	e.state.Updated = time.Now()
+	if e.cfg.StateFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(e.state, "", "\t")
+	if err != nil {
+		Logf(0, "bisect: failed to serialize state: %v", err)
+		return
+	}
+	// Write to a temp file first, so that readers never see a partially written state.
+	tmp := e.cfg.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		Logf(0, "bisect: failed to write state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, e.cfg.StateFile); err != nil {
+		Logf(0, "bisect: failed to write state: %v", err)
+	}
+}
+
+// LoadState loads bisection state saved in file.
+func LoadState(file string) (*State, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	st := new(State)
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("failed to parse bisection state %v: %v", file, err)
+	}
+	return st, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package bisect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBisectOutput(t *testing.T) {
+	tests := []struct {
+		out    string
+		commit string
+		done   bool
+		err    bool
+	}{
+		{
+			out: `Bisecting: 675 revisions left to test after this (roughly 10 steps)
+[8a6e6b8ea9cf8ad7fe4d1ab9e2a24cb4cf4b9e1b] net: fix something
+`,
+			commit: "8a6e6b8ea9cf8ad7fe4d1ab9e2a24cb4cf4b9e1b",
+		},
+		{
+			out: `8a6e6b8ea9cf8ad7fe4d1ab9e2a24cb4cf4b9e1b is the first new commit
+commit 8a6e6b8ea9cf8ad7fe4d1ab9e2a24cb4cf4b9e1b
+Author: Foo Bar <foo@bar.com>
+`,
+			commit: "8a6e6b8ea9cf8ad7fe4d1ab9e2a24cb4cf4b9e1b",
+			done:   true,
+		},
+		{
+			out: `There are only 'skip'ped commits left to test.
+The first new commit could be any of:
+8a6e6b8ea9cf8ad7fe4d1ab9e2a24cb4cf4b9e1b
+`,
+			err: true,
+		},
+		{
+			out: "fatal: bad revision",
+			err: true,
+		},
+	}
+	for i, test := range tests {
+		commit, done, err := parseBisectOutput(test.out)
+		if test.err {
+			if err == nil {
+				t.Errorf("#%v: no error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: got error %v", i, err)
+			continue
+		}
+		if commit != test.commit || done != test.done {
+			t.Errorf("#%v: got commit %v done %v, want %v %v", i, commit, done, test.commit, test.done)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-bisect-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "bisect.cause")
+	e := &env{
+		cfg: &Config{StateFile: file},
+		state: &State{
+			Kind:   "cause",
+			Title:  "KASAN: use-after-free Read in foo",
+			Status: StatusRunning,
+			Steps: []*Step{
+				{Commit: "8a6e6b8ea9cf8ad7fe4d1ab9e2a24cb4cf4b9e1b", Result: ResultCrash, Crash: "KASAN: use-after-free Read in foo"},
+			},
+		},
+	}
+	e.save()
+	st, err := LoadState(file)
+	if err != nil {
+		t.Fatalf("failed to load state: %v", err)
+	}
+	if st.Kind != e.state.Kind || st.Title != e.state.Title || st.Status != e.state.Status ||
+		len(st.Steps) != 1 || *st.Steps[0] != *e.state.Steps[0] {
+		t.Fatalf("state changed after save/load: %+v", st)
+	}
+}
@@ -4,15 +4,20 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/report"
 	"github.com/google/syzkaller/sys"
 	"github.com/google/syzkaller/vm"
 )
@@ -31,39 +36,195 @@ type Config struct {
 	Cpu      int    // number of VM CPUs
 	Mem      int    // amount of VM memory in MBs
 	Sshkey   string // root ssh key for the image
-	Bin      string // qemu/lkvm binary name
-	Bin_Args string // additional command line arguments for qemu/lkvm binary
+	Bin      string // qemu/lkvm binary name, proxy plugin binary
+	Bin_Args string // additional command line arguments for qemu/lkvm/proxy binary
 	Debug    bool   // dump all VM output to console
 	Output   string // one of stdout/dmesg/file (useful only for local VM)
 
+	// Host resource limits of a single VM, VMs exceeding them are destroyed and recreated (0 - no limit).
+	Host_Mem_Limit int // MBs of memory used by host processes of the VM (qemu, kvm, Linux hosts only)
+	Host_Cpu_Limit int // percent of a host CPU used by host processes of the VM (qemu, kvm, Linux hosts only)
+	Disk_Limit     int // MBs of disk used by the VM workdir
+
+	Target_Os   string // OS of the tested kernel used to parse crash reports: linux (default), freebsd, netbsd, openbsd, fuchsia, windows or gvisor
+	Target_Arch string // arch of the tested kernel: amd64, arm64, ppc64le, riscv64 or i386 (default: arch of the manager), syz-fuzzer and syz-executor must be built for it
+
+	// Cross-compilation of target binaries with tools/syz-make (not used by syz-manager).
+	Target_Cc      string // C++ compiler of syz-executor (default: g++ of the GNU cross toolchain of target_arch)
+	Target_Sysroot string // sysroot of the target for syz-executor (optional)
+
+	Kernel_Src string // kernel source tree for coverage report (optional, by default source paths from vmlinux debug info are used)
+
+	Get_Maintainers bool // attach get_maintainer.pl output for the guilty file to crashes (requires kernel_src)
+
+	Tls_Cert   string // PEM certificate file, if set rpc and http are served over TLS (optional, requires tls_key)
+	Tls_Key    string // PEM private key file of tls_cert
+	Auth_Token string // shared token fuzzers and http clients must present (optional)
+
+	// Rpc traffic between fuzzers and manager, matters for managers with lots of VMs.
+	Rpc_Compression     bool // compress rpc messages with deflate
+	Rpc_Batch           int  // fuzzers send new inputs in batches of this size (default: 10)
+	Rpc_Poll_Inputs     int  // max number of inputs of other fuzzers sent to a fuzzer in one poll reply (default: 100)
+	Rpc_Poll_Candidates int  // max number of candidates sent to a fuzzer in one poll reply (default: 10)
+	Candidate_Rate      int  // max number of candidates sent to all fuzzers per second (default: unlimited)
+
 	Hub_Addr string
 	Hub_Key  string
 
+	Dashboard_Type   string // dashboard client type (default: "http")
+	Dashboard_Addr   string // dashboard address (e.g. "https://dashboard.example.com"), crashes and stats are uploaded there (optional)
+	Dashboard_Client string // name of this manager in the dashboard
+	Dashboard_Key    string // key of this manager in the dashboard
+
 	Syzkaller string   // path to syzkaller checkout (syz-manager will look for binaries in bin subdir)
 	Type      string   // VM type (qemu, kvm, local)
 	Count     int      // number of VMs (don't secify for adb, instead specify devices)
 	Devices   []string // device IDs for adb
 	Procs     int      // number of parallel processes inside of every VM
 
+	Targets    []string // [user@]host[:port] of pre-provisioned machines for isolated (instead of count)
+	Target_Dir string   // dir for syzkaller binaries on isolated machines (default: /tmp/syzkaller)
+	Reboot_Cmd string   // shell command that power-cycles an isolated machine $SYZ_TARGET if it does not reboot over ssh (optional)
+
+	Bhyve_Dataset string // ZFS volume with the disk image for bhyve, VMs boot clones of its snapshots
+	Bhyve_Bridge  string // bridge interface for bhyve VM taps, a DHCP server must serve it
+
+	Hyperv_Switch string // Hyper-V virtual switch for hyperv VMs (default: "Default Switch")
+
+	Consoles        []string // adb: console devices of devices (optional, detected by default), isolated: shell commands that print console of targets (optional, dmesg by default), in the same order as devices/targets
+	Adb_Min_Battery int      // pause fuzzing on adb devices while battery level is below this percent (default: 20)
+	Adb_Max_Temp    int      // pause fuzzing on adb devices while battery temperature is above this (Celsius, default: 45)
+
 	Sandbox string // type of sandbox to use during fuzzing:
 	// "none": don't do anything special (has false positives, e.g. due to killing init)
 	// "setuid": impersonate into user nobody (65534), default
 	// "namespace": create a new namespace for fuzzer using CLONE_NEWNS/CLONE_NEWNET/CLONE_NEWPID/etc,
 	//	requires building kernel with CONFIG_NAMESPACES, CONFIG_UTS_NS, CONFIG_USER_NS, CONFIG_PID_NS and CONFIG_NET_NS.
+	// "android_untrusted_app": emulate an app on Android (uid, groups, SELinux domain and seccomp filter of untrusted_app).
+
+	Seccomp bool // deny test processes all syscalls except the enabled ones with a seccomp filter (requires CONFIG_SECCOMP_FILTER)
 
 	Machine_Type string // GCE machine type (e.g. "n1-highcpu-2")
 
 	Cover bool // use kcov coverage (default: true)
 	Leak  bool // do memory leak checking
 
+	Leak_Period int // min period between memory leak scans in seconds (0 - scan after every batch of programs)
+
+	Fault_Corpus bool // systematically inject faults into calls of corpus programs
+
+	Recheck_Corpus bool // periodically re-execute corpus programs and down-weight (or quarantine) flaky ones
+
+	Provenance bool // annotate calls of mutated programs with args changed since the seed and save that with crashes
+
+	Signal string // comma-separated feedback sources for triage of new inputs: pc, edge, comps (default: "pc")
+
+	// Programs are rewritten by these post-processors right before execution (see syz-fuzzer/postproc.go):
+	// "plugin:file.so" (Go plugin built with -buildmode=plugin) or "cmd:binary" (subprocess), files are copied to VMs.
+	Postprocessors []string
+
+	Dedup_Window int // number of recently executed programs fuzzers remember to skip exact duplicates (default: 10000, 0 - don't skip)
+
+	Repro_Percent int // max percent of VMs used to reproduce new crashes (default: 100, 0 - don't reproduce)
+
+	Rotate_Period int // period of rotation of per-proc random subsets of enabled syscalls in seconds (0 - no rotation)
+
+	Console_Log_Size  int // save full output of every VM in workdir/console, a new file is started after this many MB (0 - don't save)
+	Console_Log_Files int // number of console log files kept per VM (default: 10)
+
+	Trace bool // log executed calls with decoded arguments and results to console (fuzzing and reproduction)
+
+	Pin_Cpus     bool // pin each executor proc to a dedicated CPU (fuzzing and reproduction)
+	Low_Priority bool // run executor procs with the lowest scheduling priority, so that they don't starve console/ssh
+
+	Cover_Filter *CoverFilter // focus fuzzing on particular parts of the kernel (optional)
+
+	Notify *Notify // send notifications about new crashes and reproducers (optional)
+
+	Focus_Areas []*FocusArea // split VMs between parts of the kernel proportionally to weights (optional)
+
+	Compare *Compare // A/B mode: run half of VMs on another kernel build and compare results (optional)
+
+	Snapshot bool // restore VMs from a snapshot taken after boot instead of rebooting them (qemu only)
+
+	Shared_Dir string // share a host dir with VMs to copy files instead of scp (qemu only):
+	// "": don't share, default
+	// "9p": virtio-9p
+	// "virtiofs": virtio-fs, requires virtiofsd
+
+	Crash_State bool // capture machine state after kernel crashes (last programs of all procs, and for linux dmesg tail, slabinfo and modules)
+
+	Crash_Assets string // archive kernel build artifacts along with crashes:
+	// "": don't archive, default
+	// "hash": record hashes of vmlinux, kernel, initrd, image and kernel .config with each crash
+	// "copy": additionally store copies of the artifacts in workdir/assets
+
 	Enable_Syscalls  []string
 	Disable_Syscalls []string
-	Suppressions     []string // don't save reports matching these regexps, but reboot VM after them
+	Suppressions     []string // save reports matching these regexps, but don't reproduce nor report them
 	Ignores          []string // completely ignore reports matching these regexps (don't save nor reboot)
 
+	Report_Rules *report.Rules // additional report formats and title normalization rules (optional)
+
 	// Implementation details beyond this point.
-	ParsedSuppressions []*regexp.Regexp `json:"-"`
-	ParsedIgnores      []*regexp.Regexp `json:"-"`
+	ParsedSuppressions         []*regexp.Regexp `json:"-"`
+	ParsedInternalSuppressions []*regexp.Regexp `json:"-"` // builtin, for failures of syzkaller itself
+	ParsedIgnores              []*regexp.Regexp `json:"-"`
+}
+
+// CoverFilter selects parts of the kernel that fuzzing should focus on.
+// Entries are resolved to PC ranges using vmlinux.
+type CoverFilter struct {
+	// Source files relative to kernel source root (e.g. "net/ipv4/tcp.c"),
+	// or directories with a trailing slash (e.g. "fs/ext4/").
+	Files []string
+	// Function names, a trailing '*' matches any suffix (e.g. "tcp_*").
+	Functions []string
+	// Names of kernel modules built into vmlinux (listed in modules.builtin next to vmlinux).
+	Modules []string
+	// 0 (default): coverage outside of the selected code is ignored.
+	// N > 0: coverage outside is still used, but programs that cover the selected code
+	// are chosen for mutation N times more often than the rest.
+	Weight int
+}
+
+// FocusArea is a named part of the kernel that gets a share of VMs.
+// VMs assigned to an area fuzz only its syscalls and coverage.
+type FocusArea struct {
+	Name string
+	// Syscalls of the area in enable_syscalls format (default: all enabled syscalls).
+	Syscalls []string
+	// Coverage the area focuses on (optional), see CoverFilter.
+	Cover_Filter *CoverFilter
+	// The area gets Weight/(sum of all weights) of VMs (default: 1).
+	Weight int
+
+	ParsedSyscalls map[int]bool `json:"-"`
+}
+
+// Compare describes the second (B) kernel build of A/B comparison mode.
+// VMs with odd indexes boot the B build, the rest boot the main kernel (A).
+// Both builds fuzz a shared corpus and all candidates are triaged on both of them.
+type Compare struct {
+	Tag     string // name of the B build saved with its crashes (default: "B")
+	Vmlinux string
+	Kernel  string
+	Initrd  string // (optional, default: initrd of the A build)
+	Image   string // (optional, default: image of the A build)
+}
+
+// Notify configures notifications about new crashes and found reproducers.
+type Notify struct {
+	// Email addresses to send notifications to.
+	Email []string
+	// SMTP server used to send emails (host:port), must accept mail without authentication.
+	Smtp string
+	// Sender address of emails (default: syzkaller@<hostname>).
+	From string
+	// URL that receives notifications as JSON in POST requests.
+	Webhook string
+	// Min period between notifications about the same crash in seconds (default: 3600).
+	Period int
 }
 
 func Parse(filename string) (*Config, map[int]bool, error) {
@@ -77,6 +238,29 @@ func Parse(filename string) (*Config, map[int]bool, error) {
 	return parse(data)
 }
 
+// ParseTarget parses only target OS/arch and cross-compilation params of the config,
+// unlike Parse it does not require target binaries to be built (see tools/syz-make).
+func ParseTarget(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	if cfg.Target_Os == "" {
+		cfg.Target_Os = "linux"
+	}
+	if _, ok := targetArches[cfg.Target_Os]; !ok {
+		return nil, fmt.Errorf("config param target_os must contain one of linux/freebsd/netbsd/openbsd/fuchsia/windows/gvisor")
+	}
+	if err := checkTargetArch(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
 func parse(data []byte) (*Config, map[int]bool, error) {
 	unknown, err := checkUnknownFields(data)
 	if err != nil {
@@ -88,15 +272,11 @@ func parse(data []byte) (*Config, map[int]bool, error) {
 	cfg := new(Config)
 	cfg.Cover = true
 	cfg.Sandbox = "setuid"
+	cfg.Repro_Percent = 100
+	cfg.Dedup_Window = 10000
 	if err := json.Unmarshal(data, cfg); err != nil {
 		return nil, nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
-	if _, err := os.Stat(filepath.Join(cfg.Syzkaller, "bin/syz-fuzzer")); err != nil {
-		return nil, nil, fmt.Errorf("bad config syzkaller param: can't find bin/syz-fuzzer")
-	}
-	if _, err := os.Stat(filepath.Join(cfg.Syzkaller, "bin/syz-executor")); err != nil {
-		return nil, nil, fmt.Errorf("bad config syzkaller param: can't find bin/syz-executor")
-	}
 	if cfg.Http == "" {
 		return nil, nil, fmt.Errorf("config param http is empty")
 	}
@@ -106,6 +286,11 @@ func parse(data []byte) (*Config, map[int]bool, error) {
 	if cfg.Vmlinux == "" {
 		return nil, nil, fmt.Errorf("config param vmlinux is empty")
 	}
+	if cfg.Kernel_Src != "" {
+		if fi, err := os.Stat(cfg.Kernel_Src); err != nil || !fi.IsDir() {
+			return nil, nil, fmt.Errorf("bad config kernel_src param: %v is not a directory", cfg.Kernel_Src)
+		}
+	}
 	if cfg.Type == "" {
 		return nil, nil, fmt.Errorf("config param type is empty")
 	}
@@ -128,6 +313,30 @@ func parse(data []byte) (*Config, map[int]bool, error) {
 			return nil, nil, fmt.Errorf("specify at least 1 adb device")
 		}
 		cfg.Count = len(cfg.Devices)
+		if err := checkAdb(cfg); err != nil {
+			return nil, nil, err
+		}
+	case "isolated":
+		if cfg.Count != 0 {
+			return nil, nil, fmt.Errorf("don't specify count for isolated, instead specify targets")
+		}
+		if len(cfg.Targets) == 0 {
+			return nil, nil, fmt.Errorf("specify at least 1 isolated target")
+		}
+		cfg.Count = len(cfg.Targets)
+		if err := checkIsolated(cfg); err != nil {
+			return nil, nil, err
+		}
+	case "proxy":
+		if cfg.Bin == "" {
+			return nil, nil, fmt.Errorf("config param bin is empty (required for proxy, path to the plugin binary)")
+		}
+		if cfg.Count <= 0 || cfg.Count > 1000 {
+			return nil, nil, fmt.Errorf("invalid config param count: %v, want (1, 1000]", cfg.Count)
+		}
+		if len(cfg.Devices) != 0 {
+			return nil, nil, fmt.Errorf("type %v does not support devices param", cfg.Type)
+		}
 	case "gce":
 		if cfg.Machine_Type == "" {
 			return nil, nil, fmt.Errorf("machine_type parameter is empty (required for gce)")
@@ -141,6 +350,22 @@ func parse(data []byte) (*Config, map[int]bool, error) {
 			return nil, nil, fmt.Errorf("type %v does not support devices param", cfg.Type)
 		}
 	}
+	if cfg.Type != "adb" && cfg.Type != "isolated" && len(cfg.Consoles) != 0 {
+		return nil, nil, fmt.Errorf("type %v does not support consoles param", cfg.Type)
+	}
+	if cfg.Type != "isolated" && len(cfg.Targets) != 0 {
+		return nil, nil, fmt.Errorf("type %v does not support targets param", cfg.Type)
+	}
+	if cfg.Type == "bhyve" {
+		if err := checkBhyve(cfg); err != nil {
+			return nil, nil, err
+		}
+	} else if cfg.Bhyve_Dataset != "" || cfg.Bhyve_Bridge != "" {
+		return nil, nil, fmt.Errorf("type %v does not support bhyve_dataset/bhyve_bridge params", cfg.Type)
+	}
+	if cfg.Type != "hyperv" && cfg.Hyperv_Switch != "" {
+		return nil, nil, fmt.Errorf("type %v does not support hyperv_switch param", cfg.Type)
+	}
 	if cfg.Rpc == "" {
 		cfg.Rpc = "localhost:0"
 	}
@@ -163,9 +388,9 @@ func parse(data []byte) (*Config, map[int]bool, error) {
 		return nil, nil, fmt.Errorf("config param output must contain one of none/stdout/dmesg/file")
 	}
 	switch cfg.Sandbox {
-	case "none", "setuid", "namespace":
+	case "none", "setuid", "namespace", "android_untrusted_app":
 	default:
-		return nil, nil, fmt.Errorf("config param sandbox must contain one of none/setuid/namespace")
+		return nil, nil, fmt.Errorf("config param sandbox must contain one of none/setuid/namespace/android_untrusted_app")
 	}
 
 	syscalls, err := parseSyscalls(cfg)
@@ -177,50 +402,165 @@ func parse(data []byte) (*Config, map[int]bool, error) {
 		return nil, nil, err
 	}
 
+	if err := checkTargetOs(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkTargetArch(cfg); err != nil {
+		return nil, nil, err
+	}
+	for _, bin := range []string{"syz-fuzzer", "syz-executor"} {
+		if _, err := os.Stat(TargetBin(cfg, bin)); err != nil {
+			return nil, nil, fmt.Errorf("bad config syzkaller param: can't find %v for %v (run 'bin/syz-make -config=manager.cfg')",
+				bin, TargetDir(cfg))
+		}
+	}
+	if err := parseReportRules(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Leak_Period < 0 {
+		return nil, nil, fmt.Errorf("config param leak_period is negative: %v", cfg.Leak_Period)
+	}
+	if cfg.Dedup_Window < 0 {
+		return nil, nil, fmt.Errorf("config param dedup_window is negative: %v", cfg.Dedup_Window)
+	}
+	if cfg.Repro_Percent < 0 || cfg.Repro_Percent > 100 {
+		return nil, nil, fmt.Errorf("config param repro_percent must be in [0, 100]: %v", cfg.Repro_Percent)
+	}
+	if cfg.Rotate_Period < 0 {
+		return nil, nil, fmt.Errorf("config param rotate_period is negative: %v", cfg.Rotate_Period)
+	}
+	if err := checkSignal(cfg); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Host_Mem_Limit < 0 || cfg.Host_Cpu_Limit < 0 || cfg.Disk_Limit < 0 {
+		return nil, nil, fmt.Errorf("config params host_mem_limit, host_cpu_limit and disk_limit must not be negative")
+	}
+	if cfg.Console_Log_Size < 0 {
+		return nil, nil, fmt.Errorf("config param console_log_size is negative: %v", cfg.Console_Log_Size)
+	}
+	if cfg.Console_Log_Files < 0 {
+		return nil, nil, fmt.Errorf("config param console_log_files is negative: %v", cfg.Console_Log_Files)
+	}
+	if cfg.Console_Log_Files == 0 {
+		cfg.Console_Log_Files = 10
+	}
+	if cfg.Rpc_Batch < 0 || cfg.Rpc_Poll_Inputs < 0 || cfg.Rpc_Poll_Candidates < 0 {
+		return nil, nil, fmt.Errorf("config params rpc_batch, rpc_poll_inputs and rpc_poll_candidates must not be negative")
+	}
+	if cfg.Candidate_Rate < 0 {
+		return nil, nil, fmt.Errorf("config param candidate_rate must not be negative")
+	}
+	if cfg.Rpc_Batch == 0 {
+		cfg.Rpc_Batch = 10
+	}
+	if cfg.Rpc_Poll_Inputs == 0 {
+		cfg.Rpc_Poll_Inputs = 100
+	}
+	if cfg.Rpc_Poll_Candidates == 0 {
+		cfg.Rpc_Poll_Candidates = 10
+	}
+
+	if err := checkCoverFilter(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := parseFocusAreas(cfg, syscalls); err != nil {
+		return nil, nil, err
+	}
+	if err := checkAuth(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkCompare(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkNotify(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkSnapshot(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkSharedDir(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkPostprocessors(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkGetMaintainers(cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkDashboard(cfg); err != nil {
+		return nil, nil, err
+	}
+	switch cfg.Crash_Assets {
+	case "", "hash", "copy":
+	default:
+		return nil, nil, fmt.Errorf("config param crash_assets must contain one of hash/copy")
+	}
+
 	return cfg, syscalls, nil
 }
 
-func parseSyscalls(cfg *Config) (map[int]bool, error) {
-	match := func(call *sys.Call, str string) bool {
-		if str == call.CallName || str == call.Name {
-			return true
+// applySyscalls calls f for all syscalls matching patterns.
+// Patterns are either call names (open, open$dir), which also match
+// all variants of the call (open matches open$dir), or glob patterns
+// matched against full call names (ioctl$KVM_*, *$inet6).
+func applySyscalls(patterns []string, what string, f func(call *sys.Call)) error {
+	for _, c := range patterns {
+		n := 0
+		for _, call := range sys.Calls {
+			ok := c == call.CallName || c == call.Name
+			if !ok {
+				var err error
+				if ok, err = path.Match(c, call.Name); err != nil {
+					return fmt.Errorf("bad %v syscall pattern %v: %v", what, c, err)
+				}
+			}
+			if ok {
+				f(call)
+				n++
+			}
 		}
-		if len(str) > 1 && str[len(str)-1] == '*' && strings.HasPrefix(call.Name, str[:len(str)-1]) {
-			return true
+		if n == 0 {
+			return fmt.Errorf("unknown %v syscall: %v", what, c)
 		}
-		return false
 	}
+	return nil
+}
+
+// MatchSyscalls returns all syscalls matching patterns (in the enable_syscalls format).
+func MatchSyscalls(patterns []string) (map[*sys.Call]bool, error) {
+	calls := make(map[*sys.Call]bool)
+	err := applySyscalls(patterns, "enabled", func(call *sys.Call) {
+		calls[call] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return calls, nil
+}
 
+func parseSyscalls(cfg *Config) (map[int]bool, error) {
 	syscalls := make(map[int]bool)
 	if len(cfg.Enable_Syscalls) != 0 {
-		for _, c := range cfg.Enable_Syscalls {
-			n := 0
-			for _, call := range sys.Calls {
-				if match(call, c) {
-					syscalls[call.ID] = true
-					n++
-				}
-			}
-			if n == 0 {
-				return nil, fmt.Errorf("unknown enabled syscall: %v", c)
-			}
+		err := applySyscalls(cfg.Enable_Syscalls, "enabled", func(call *sys.Call) {
+			syscalls[call.ID] = true
+		})
+		if err != nil {
+			return nil, err
 		}
 	} else {
 		for _, call := range sys.Calls {
 			syscalls[call.ID] = true
 		}
 	}
-	for _, c := range cfg.Disable_Syscalls {
-		n := 0
-		for _, call := range sys.Calls {
-			if match(call, c) {
-				delete(syscalls, call.ID)
-				n++
-			}
-		}
-		if n == 0 {
-			return nil, fmt.Errorf("unknown disabled syscall: %v", c)
-		}
+	err := applySyscalls(cfg.Disable_Syscalls, "disabled", func(call *sys.Call) {
+		delete(syscalls, call.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(syscalls) == 0 {
+		return nil, fmt.Errorf("all syscalls are disabled by enable_syscalls/disable_syscalls")
 	}
 	// mmap is used to allocate memory.
 	syscalls[sys.CallMap["mmap"].ID] = true
@@ -229,8 +569,16 @@ func parseSyscalls(cfg *Config) (map[int]bool, error) {
 }
 
 func parseSuppressions(cfg *Config) error {
-	// Add some builtin suppressions.
-	supp := append(cfg.Suppressions, []string{
+	for _, s := range cfg.Suppressions {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("failed to compile suppression '%v': %v", s, err)
+		}
+		cfg.ParsedSuppressions = append(cfg.ParsedSuppressions, re)
+	}
+	// Failures of syzkaller itself and OOMs of the fuzzer are not kernel bugs,
+	// these are not saved at all.
+	internal := []string{
 		"panic: failed to start executor binary",
 		"panic: executor failed: pthread_create failed",
 		"panic: failed to create temp dir",
@@ -240,13 +588,9 @@ func parseSuppressions(cfg *Config) error {
 		"Out of memory: Kill process .* \\(syz-fuzzer\\)",
 		"lowmemorykiller: Killing 'syz-fuzzer'",
 		//"INFO: lockdep is turned off", // printed by some sysrq that dumps scheduler state, but also on all lockdep reports
-	}...)
-	for _, s := range supp {
-		re, err := regexp.Compile(s)
-		if err != nil {
-			return fmt.Errorf("failed to compile suppression '%v': %v", s, err)
-		}
-		cfg.ParsedSuppressions = append(cfg.ParsedSuppressions, re)
+	}
+	for _, s := range internal {
+		cfg.ParsedInternalSuppressions = append(cfg.ParsedInternalSuppressions, regexp.MustCompile(s))
 	}
 	for _, ignore := range cfg.Ignores {
 		re, err := regexp.Compile(ignore)
@@ -258,6 +602,403 @@ func parseSuppressions(cfg *Config) error {
 	return nil
 }
 
+// checkTargetOs selects report parsing rules of the target OS.
+func checkTargetOs(cfg *Config) error {
+	if cfg.Target_Os == "" {
+		cfg.Target_Os = "linux"
+	}
+	if err := report.SetOS(cfg.Target_Os); err != nil {
+		return fmt.Errorf("config param target_os must contain one of linux/freebsd/netbsd/openbsd/fuchsia/windows/gvisor")
+	}
+	if cfg.Target_Os == "fuchsia" || cfg.Target_Os == "windows" {
+		// Zircon and NT have no coverage and the executor can't fork on Fuchsia and Windows.
+		if cfg.Cover {
+			return fmt.Errorf("config param cover must be false for %v", cfg.Target_Os)
+		}
+		if cfg.Sandbox != "none" {
+			return fmt.Errorf("config param sandbox must be none for %v", cfg.Target_Os)
+		}
+	}
+	if cfg.Seccomp && cfg.Target_Os != "linux" && cfg.Target_Os != "gvisor" {
+		return fmt.Errorf("config param seccomp is not supported for %v", cfg.Target_Os)
+	}
+	return nil
+}
+
+// targetArches lists arches with descriptions for every target OS (see targets in sysgen).
+// 32-bit arches (e.g. arm) are not supported, descriptions assume 64-bit pointers.
+var targetArches = map[string][]string{
+	"linux":   {"amd64", "arm64", "ppc64le", "riscv64", "i386"},
+	"freebsd": {"amd64"},
+	"netbsd":  {"amd64"},
+	"openbsd": {"amd64"},
+	"fuchsia": {"amd64", "arm64"},
+	"windows": {"amd64"},
+	"gvisor":  {"amd64"},
+}
+
+// checkTargetArch checks that the target OS has descriptions for the target arch.
+// checkTargetOs must be called before.
+func checkTargetArch(cfg *Config) error {
+	if cfg.Target_Arch == "" {
+		cfg.Target_Arch = runtime.GOARCH
+	}
+	archs := targetArches[cfg.Target_Os]
+	for _, arch := range archs {
+		if cfg.Target_Arch == arch {
+			return nil
+		}
+	}
+	return fmt.Errorf("config param target_arch must contain one of %v for %v",
+		strings.Join(archs, "/"), cfg.Target_Os)
+}
+
+// TargetDir returns name of the subdir of bin with binaries cross-compiled
+// for the target OS/arch (e.g. linux_arm64), gVisor runs linux binaries.
+func TargetDir(cfg *Config) string {
+	targetOS := cfg.Target_Os
+	if targetOS == "gvisor" {
+		targetOS = "linux"
+	}
+	return targetOS + "_" + cfg.Target_Arch
+}
+
+// TargetBin returns path to a binary that runs on the target (syz-fuzzer, syz-executor, syz-execprog).
+// Cross-compiled binaries are in bin/TargetDir, binaries built for the host target are in bin.
+func TargetBin(cfg *Config, name string) string {
+	bin := filepath.Join(cfg.Syzkaller, "bin", TargetDir(cfg), name)
+	if _, err := os.Stat(bin); err == nil {
+		return bin
+	}
+	return filepath.Join(cfg.Syzkaller, "bin", name)
+}
+
+// checkSignal checks feedback sources of fuzzers, edge signal is more precise,
+// but triages more inputs, comps signal requires comparison tracing in kcov.
+func checkSignal(cfg *Config) error {
+	if cfg.Signal == "" {
+		cfg.Signal = "pc"
+	}
+	pcs := false
+	for _, src := range strings.Split(cfg.Signal, ",") {
+		switch src {
+		case "pc", "edge":
+			pcs = true
+		case "comps":
+		default:
+			return fmt.Errorf("config param signal contains unknown source %q, must be a list of pc/edge/comps", src)
+		}
+	}
+	if !pcs {
+		return fmt.Errorf("config param signal must contain pc or edge")
+	}
+	return nil
+}
+
+// parseReportRules adds user rules to the builtin report parsing rules.
+func parseReportRules(cfg *Config) error {
+	if err := report.AddRules(cfg.Report_Rules); err != nil {
+		return fmt.Errorf("config param report_rules is invalid: %v", err)
+	}
+	return nil
+}
+
+func checkCoverFilter(cfg *Config) error {
+	return checkCoverFilterParam(cfg, cfg.Cover_Filter, "cover_filter")
+}
+
+func checkCoverFilterParam(cfg *Config, f *CoverFilter, name string) error {
+	if f == nil {
+		return nil
+	}
+	if !cfg.Cover {
+		return fmt.Errorf("config param %v requires cover", name)
+	}
+	if len(f.Files) == 0 && len(f.Functions) == 0 && len(f.Modules) == 0 {
+		return fmt.Errorf("config param %v does not select any code", name)
+	}
+	if f.Weight < 0 {
+		return fmt.Errorf("config param %v.weight is negative: %v", name, f.Weight)
+	}
+	return nil
+}
+
+func parseFocusAreas(cfg *Config, enabled map[int]bool) error {
+	names := make(map[string]bool)
+	for i, area := range cfg.Focus_Areas {
+		if area == nil || area.Name == "" {
+			return fmt.Errorf("config param focus_areas[%v] does not have a name", i)
+		}
+		if names[area.Name] {
+			return fmt.Errorf("config param focus_areas contains duplicate area %v", area.Name)
+		}
+		names[area.Name] = true
+		if area.Weight < 0 {
+			return fmt.Errorf("focus area %v: weight is negative: %v", area.Name, area.Weight)
+		}
+		if area.Weight == 0 {
+			area.Weight = 1
+		}
+		if err := checkCoverFilterParam(cfg, area.Cover_Filter, "focus area "+area.Name+" cover_filter"); err != nil {
+			return err
+		}
+		area.ParsedSyscalls = make(map[int]bool)
+		if len(area.Syscalls) == 0 {
+			for id := range enabled {
+				area.ParsedSyscalls[id] = true
+			}
+			continue
+		}
+		err := applySyscalls(area.Syscalls, "focus area "+area.Name, func(call *sys.Call) {
+			if enabled[call.ID] {
+				area.ParsedSyscalls[call.ID] = true
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if len(area.ParsedSyscalls) == 0 {
+			return fmt.Errorf("focus area %v: all syscalls are disabled", area.Name)
+		}
+		// mmap is used to allocate memory.
+		area.ParsedSyscalls[sys.CallMap["mmap"].ID] = true
+	}
+	return nil
+}
+
+func checkAdb(cfg *Config) error {
+	if len(cfg.Consoles) != 0 && len(cfg.Consoles) != len(cfg.Devices) {
+		return fmt.Errorf("config param consoles must contain a console for each of %v devices", len(cfg.Devices))
+	}
+	if cfg.Adb_Min_Battery < 0 || cfg.Adb_Min_Battery > 90 {
+		return fmt.Errorf("config param adb_min_battery must be in [0, 90]: %v", cfg.Adb_Min_Battery)
+	}
+	if cfg.Adb_Min_Battery == 0 {
+		cfg.Adb_Min_Battery = 20
+	}
+	if cfg.Adb_Max_Temp < 0 {
+		return fmt.Errorf("config param adb_max_temp is negative: %v", cfg.Adb_Max_Temp)
+	}
+	if cfg.Adb_Max_Temp == 0 {
+		cfg.Adb_Max_Temp = 45
+	}
+	return nil
+}
+
+func checkSnapshot(cfg *Config) error {
+	if !cfg.Snapshot {
+		return nil
+	}
+	if cfg.Type != "qemu" {
+		return fmt.Errorf("config param snapshot is supported only for qemu VMs")
+	}
+	// Snapshots are stored in the image overlay, 9p root does not have one.
+	if cfg.Image == "9p" || cfg.Compare != nil && cfg.Compare.Image == "9p" {
+		return fmt.Errorf("config param snapshot requires a disk image, 9p is not supported")
+	}
+	return nil
+}
+
+func checkSharedDir(cfg *Config) error {
+	switch cfg.Shared_Dir {
+	case "":
+		return nil
+	case "9p", "virtiofs":
+	default:
+		return fmt.Errorf("config param shared_dir must contain one of 9p/virtiofs")
+	}
+	if cfg.Type != "qemu" {
+		return fmt.Errorf("config param shared_dir is supported only for qemu VMs")
+	}
+	// qemu refuses to save state of VMs with a mounted shared dir.
+	if cfg.Snapshot {
+		return fmt.Errorf("config params shared_dir and snapshot can't be used together")
+	}
+	return nil
+}
+
+func checkPostprocessors(cfg *Config) error {
+	for _, pp := range cfg.Postprocessors {
+		colon := strings.IndexByte(pp, ':')
+		if colon == -1 || pp[:colon] != "plugin" && pp[:colon] != "cmd" {
+			return fmt.Errorf("config param postprocessors contains %q, must be plugin:file or cmd:file", pp)
+		}
+		file := pp[colon+1:]
+		if strings.Contains(file, ",") {
+			return fmt.Errorf("config param postprocessors contains %q, file names must not contain commas", pp)
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("config param postprocessors contains %q: %v", pp, err)
+		}
+	}
+	return nil
+}
+
+func checkGetMaintainers(cfg *Config) error {
+	if !cfg.Get_Maintainers {
+		return nil
+	}
+	if cfg.Kernel_Src == "" {
+		return fmt.Errorf("config param get_maintainers requires kernel_src")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Kernel_Src, "scripts", "get_maintainer.pl")); err != nil {
+		return fmt.Errorf("config param get_maintainers requires scripts/get_maintainer.pl in kernel_src: %v", err)
+	}
+	return nil
+}
+
+func checkIsolated(cfg *Config) error {
+	seen := make(map[string]bool)
+	for _, target := range cfg.Targets {
+		if target == "" || strings.ContainsAny(target, " \t'\"") {
+			return fmt.Errorf("bad isolated target %q", target)
+		}
+		if seen[target] {
+			return fmt.Errorf("duplicate isolated target %v", target)
+		}
+		seen[target] = true
+	}
+	if len(cfg.Consoles) != 0 && len(cfg.Consoles) != len(cfg.Targets) {
+		return fmt.Errorf("config param consoles must contain a console for each of %v targets", len(cfg.Targets))
+	}
+	if cfg.Target_Dir == "" {
+		cfg.Target_Dir = "/tmp/syzkaller"
+	}
+	// The dir is removed on the machine before every run.
+	if !filepath.IsAbs(cfg.Target_Dir) || filepath.Clean(cfg.Target_Dir) == "/" ||
+		strings.ContainsAny(cfg.Target_Dir, " \t'\";&|$`") {
+		return fmt.Errorf("bad config param target_dir: %q", cfg.Target_Dir)
+	}
+	return nil
+}
+
+func checkBhyve(cfg *Config) error {
+	if cfg.Bhyve_Dataset == "" {
+		return fmt.Errorf("config param bhyve_dataset is empty (required for bhyve)")
+	}
+	if cfg.Bhyve_Bridge == "" {
+		return fmt.Errorf("config param bhyve_bridge is empty (required for bhyve)")
+	}
+	if strings.HasPrefix(cfg.Bhyve_Dataset, "/") || strings.Contains(cfg.Bhyve_Dataset, "@") {
+		return fmt.Errorf("bad config param bhyve_dataset: %q, want pool/volume", cfg.Bhyve_Dataset)
+	}
+	return nil
+}
+
+func checkAuth(cfg *Config) error {
+	if (cfg.Tls_Cert == "") != (cfg.Tls_Key == "") {
+		return fmt.Errorf("config params tls_cert and tls_key must be specified together")
+	}
+	if cfg.Tls_Cert != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.Tls_Cert, cfg.Tls_Key); err != nil {
+			return fmt.Errorf("bad config tls_cert/tls_key params: %v", err)
+		}
+	}
+	if strings.ContainsAny(cfg.Auth_Token, " \t\r\n'\"") {
+		return fmt.Errorf("config param auth_token must not contain spaces and quotes")
+	}
+	return nil
+}
+
+func checkCompare(cfg *Config) error {
+	c := cfg.Compare
+	if c == nil {
+		return nil
+	}
+	switch cfg.Type {
+	case "none", "adb", "local", "isolated", "bhyve":
+		return fmt.Errorf("config param compare is not supported for type %v", cfg.Type)
+	}
+	if cfg.Count < 2 {
+		return fmt.Errorf("config param compare requires at least 2 VMs, count is %v", cfg.Count)
+	}
+	if c.Vmlinux == "" || c.Kernel == "" {
+		return fmt.Errorf("config params compare.vmlinux and compare.kernel are required")
+	}
+	if c.Tag == "" {
+		c.Tag = "B"
+	}
+	if c.Tag == cfg.Tag {
+		return fmt.Errorf("config param compare.tag must differ from tag: %v", c.Tag)
+	}
+	return nil
+}
+
+// ComparedKernel returns 1 if VM with the index boots the compared kernel in A/B mode and 0 otherwise.
+func ComparedKernel(cfg *Config, index int) int {
+	if cfg.Compare == nil {
+		return 0
+	}
+	return index % 2
+}
+
+// CompareConfig returns a copy of cfg where the main kernel is replaced by the compared one,
+// all VMs created with the copy boot the compared kernel.
+func CompareConfig(cfg *Config) *Config {
+	c := cfg.Compare
+	cfg1 := *cfg
+	cfg1.Compare = nil
+	cfg1.Tag = c.Tag
+	cfg1.Vmlinux = c.Vmlinux
+	cfg1.Kernel = c.Kernel
+	if c.Initrd != "" {
+		cfg1.Initrd = c.Initrd
+	}
+	if c.Image != "" {
+		cfg1.Image = c.Image
+	}
+	return &cfg1
+}
+
+func checkDashboard(cfg *Config) error {
+	if cfg.Dashboard_Addr == "" {
+		if cfg.Dashboard_Type != "" || cfg.Dashboard_Client != "" || cfg.Dashboard_Key != "" {
+			return fmt.Errorf("config param dashboard_addr is empty, but other dashboard params are set")
+		}
+		return nil
+	}
+	if cfg.Dashboard_Client == "" || cfg.Dashboard_Key == "" {
+		return fmt.Errorf("config params dashboard_client and dashboard_key are required with dashboard_addr")
+	}
+	if cfg.Dashboard_Type == "" {
+		cfg.Dashboard_Type = "http"
+	}
+	return nil
+}
+
+func checkNotify(cfg *Config) error {
+	n := cfg.Notify
+	if n == nil {
+		return nil
+	}
+	if len(n.Email) == 0 && n.Webhook == "" {
+		return fmt.Errorf("config param notify specifies neither email nor webhook")
+	}
+	if len(n.Email) != 0 && n.Smtp == "" {
+		return fmt.Errorf("config param notify.email requires notify.smtp")
+	}
+	if n.Webhook != "" {
+		u, err := url.Parse(n.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("config param notify.webhook is not a http(s) URL: %v", n.Webhook)
+		}
+	}
+	if n.Period < 0 {
+		return fmt.Errorf("config param notify.period is negative: %v", n.Period)
+	}
+	if n.Period == 0 {
+		n.Period = 3600
+	}
+	if n.From == "" {
+		host, _ := os.Hostname()
+		if host == "" {
+			host = "localhost"
+		}
+		n.From = "syzkaller@" + host
+	}
+	return nil
+}
+
 func CreateVMConfig(cfg *Config, index int) (*vm.Config, error) {
 	if index < 0 || index >= cfg.Count {
 		return nil, fmt.Errorf("invalid VM index %v (count %v)", index, cfg.Count)
@@ -270,6 +1011,8 @@ func CreateVMConfig(cfg *Config, index int) (*vm.Config, error) {
 		Name:        fmt.Sprintf("%v-%v-%v", cfg.Type, cfg.Name, index),
 		Index:       index,
 		Workdir:     workdir,
+		OS:          cfg.Target_Os,
+		Arch:        cfg.Target_Arch,
 		Bin:         cfg.Bin,
 		BinArgs:     cfg.Bin_Args,
 		Kernel:      cfg.Kernel,
@@ -277,15 +1020,40 @@ func CreateVMConfig(cfg *Config, index int) (*vm.Config, error) {
 		Image:       cfg.Image,
 		Initrd:      cfg.Initrd,
 		Sshkey:      cfg.Sshkey,
-		Executor:    filepath.Join(cfg.Syzkaller, "bin", "syz-executor"),
+		Executor:    TargetBin(cfg, "syz-executor"),
 		Cpu:         cfg.Cpu,
 		Mem:         cfg.Mem,
 		Debug:       cfg.Debug,
 		MachineType: cfg.Machine_Type,
+		Snapshot:    cfg.Snapshot,
+		SharedDir:   cfg.Shared_Dir,
+
+		HostMemLimit: cfg.Host_Mem_Limit,
+		HostCpuLimit: cfg.Host_Cpu_Limit,
+		DiskLimit:    cfg.Disk_Limit,
 	}
 	if len(cfg.Devices) != 0 {
 		vmCfg.Device = cfg.Devices[index]
 	}
+	if len(cfg.Consoles) != 0 {
+		vmCfg.Console = cfg.Consoles[index]
+	}
+	if len(cfg.Targets) != 0 {
+		vmCfg.Target = cfg.Targets[index]
+	}
+	vmCfg.Dataset = cfg.Bhyve_Dataset
+	vmCfg.Bridge = cfg.Bhyve_Bridge
+	vmCfg.Switch = cfg.Hyperv_Switch
+	vmCfg.TargetDir = cfg.Target_Dir
+	vmCfg.RebootCmd = cfg.Reboot_Cmd
+	vmCfg.MinBattery = cfg.Adb_Min_Battery
+	vmCfg.MaxTemp = cfg.Adb_Max_Temp
+	if ComparedKernel(cfg, index) == 1 {
+		cfgB := CompareConfig(cfg)
+		vmCfg.Kernel = cfgB.Kernel
+		vmCfg.Initrd = cfgB.Initrd
+		vmCfg.Image = cfgB.Image
+	}
 	return vmCfg, nil
 }
 
@@ -298,6 +1066,15 @@ func checkUnknownFields(data []byte) (string, error) {
 		"Rpc",
 		"Workdir",
 		"Vmlinux",
+		"Kernel_Src",
+		"Target_Os",
+		"Target_Arch",
+		"Target_Cc",
+		"Target_Sysroot",
+		"Get_Maintainers",
+		"Tls_Cert",
+		"Tls_Key",
+		"Auth_Token",
 		"Kernel",
 		"Tag",
 		"Cmdline",
@@ -309,20 +1086,65 @@ func checkUnknownFields(data []byte) (string, error) {
 		"Bin_Args",
 		"Debug",
 		"Output",
+		"Host_Mem_Limit",
+		"Host_Cpu_Limit",
+		"Disk_Limit",
+		"Rpc_Compression",
+		"Rpc_Batch",
+		"Rpc_Poll_Inputs",
+		"Rpc_Poll_Candidates",
+		"Candidate_Rate",
 		"Hub_Addr",
 		"Hub_Key",
+		"Dashboard_Type",
+		"Dashboard_Addr",
+		"Dashboard_Client",
+		"Dashboard_Key",
 		"Syzkaller",
 		"Type",
 		"Count",
 		"Devices",
+		"Consoles",
+		"Bhyve_Dataset",
+		"Bhyve_Bridge",
+		"Hyperv_Switch",
+		"Targets",
+		"Target_Dir",
+		"Reboot_Cmd",
+		"Adb_Min_Battery",
+		"Adb_Max_Temp",
 		"Procs",
 		"Cover",
+		"Cover_Filter",
+		"Notify",
+		"Focus_Areas",
+		"Compare",
+		"Crash_State",
+		"Crash_Assets",
+		"Snapshot",
+		"Shared_Dir",
 		"Sandbox",
+		"Seccomp",
 		"Leak",
+		"Leak_Period",
+		"Rotate_Period",
+		"Console_Log_Size",
+		"Console_Log_Files",
+		"Trace",
+		"Pin_Cpus",
+		"Low_Priority",
+		"Fault_Corpus",
+		"Recheck_Corpus",
+		"Provenance",
+		"Signal",
+		"Dedup_Window",
+		"Postprocessors",
+		"Repro_Percent",
 		"Enable_Syscalls",
 		"Disable_Syscalls",
 		"Suppressions",
 		"Ignores",
+		"Report_Rules",
 		"Initrd",
 		"Machine_Type",
 	}
@@ -4,7 +4,14 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/google/syzkaller/sys"
 )
 
 func TestUnknown(t *testing.T) {
@@ -14,3 +21,449 @@ func TestUnknown(t *testing.T) {
 		t.Fatalf("unknown field is not detected (%v)", err)
 	}
 }
+
+func TestCoverFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    string
+	}{
+		{`{}`, "config param cover_filter does not select any code"},
+		{`{"functions": ["tcp_*"], "weight": -1}`, "config param cover_filter.weight is negative: -1"},
+	}
+	for i, test := range tests {
+		cfg := &Config{Cover: true}
+		if err := json.Unmarshal([]byte(`{"cover_filter": `+test.filter+`}`), cfg); err != nil {
+			t.Fatalf("#%v: failed to parse: %v", i, err)
+		}
+		err := checkCoverFilter(cfg)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("#%v: got error %v, want %v", i, err, test.err)
+		}
+	}
+	cfg := &Config{Cover_Filter: &CoverFilter{Files: []string{"fs/ext4/"}}}
+	if err := checkCoverFilter(cfg); err == nil {
+		t.Errorf("cover filter without cover is accepted")
+	}
+}
+
+func TestSyscalls(t *testing.T) {
+	tests := []struct {
+		enable  []string
+		disable []string
+		err     string
+		want    []string
+	}{
+		{
+			enable: []string{"ioctl$KVM_*"},
+			want:   []string{"ioctl$KVM_CREATE_VM", "ioctl$KVM_RUN", "mmap"},
+		},
+		{
+			enable:  []string{"open", "*$sctp6"},
+			disable: []string{"open$dir"},
+			want:    []string{"open", "socket$sctp6"},
+		},
+		{
+			enable: []string{"foo*"},
+			err:    "unknown enabled syscall: foo*",
+		},
+		{
+			disable: []string{"open$[dir"},
+			err:     "bad disabled syscall pattern open$[dir: syntax error in pattern",
+		},
+		{
+			disable: []string{"*"},
+			err:     "all syscalls are disabled by enable_syscalls/disable_syscalls",
+		},
+	}
+	for i, test := range tests {
+		cfg := &Config{
+			Enable_Syscalls:  test.enable,
+			Disable_Syscalls: test.disable,
+		}
+		syscalls, err := parseSyscalls(cfg)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("#%v: got error %v, want %v", i, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: failed to parse: %v", i, err)
+			continue
+		}
+		for _, name := range test.want {
+			if !syscalls[sys.CallMap[name].ID] {
+				t.Errorf("#%v: %v is not enabled", i, name)
+			}
+		}
+		if syscalls[sys.CallMap["open$dir"].ID] {
+			t.Errorf("#%v: open$dir is enabled", i)
+		}
+	}
+}
+
+// checkTest is a config (JSON) and the error a config check must return for it,
+// "" if the config is valid.
+type checkTest struct {
+	cfg string
+	err string
+}
+
+// runCheckTests runs check on every test config. If valid is not nil, it's called
+// for valid configs after the check to verify that defaults are set.
+func runCheckTests(t *testing.T, tests []checkTest, check func(cfg *Config) error, valid func(cfg *Config) error) {
+	for i, test := range tests {
+		cfg := new(Config)
+		if err := json.Unmarshal([]byte(test.cfg), cfg); err != nil {
+			t.Fatalf("#%v: failed to parse: %v", i, err)
+		}
+		err := check(cfg)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("#%v: got error %v, want %v", i, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: got error %v", i, err)
+			continue
+		}
+		if valid != nil {
+			if err := valid(cfg); err != nil {
+				t.Errorf("#%v: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	tests := []checkTest{
+		{`{"notify": {}}`, "config param notify specifies neither email nor webhook"},
+		{`{"notify": {"email": ["foo@bar.com"]}}`, "config param notify.email requires notify.smtp"},
+		{`{"notify": {"webhook": "foo.com/bar"}}`, "config param notify.webhook is not a http(s) URL: foo.com/bar"},
+		{`{"notify": {"webhook": "http://foo.com/bar", "period": -1}}`, "config param notify.period is negative: -1"},
+		{`{"notify": {"email": ["foo@bar.com"], "smtp": "localhost:25"}}`, ""},
+	}
+	runCheckTests(t, tests, checkNotify, func(cfg *Config) error {
+		if cfg.Notify.Period != 3600 || cfg.Notify.From == "" {
+			return fmt.Errorf("defaults are not set: %+v", cfg.Notify)
+		}
+		return nil
+	})
+}
+
+func TestDashboard(t *testing.T) {
+	tests := []checkTest{
+		{`{}`, ""},
+		{`{"dashboard_key": "foo"}`, "config param dashboard_addr is empty, but other dashboard params are set"},
+		{`{"dashboard_addr": "http://foo.com"}`, "config params dashboard_client and dashboard_key are required with dashboard_addr"},
+		{`{"dashboard_addr": "http://foo.com", "dashboard_client": "ci", "dashboard_key": "foo"}`, ""},
+	}
+	runCheckTests(t, tests, checkDashboard, func(cfg *Config) error {
+		if cfg.Dashboard_Addr != "" && cfg.Dashboard_Type != "http" {
+			return fmt.Errorf("default dashboard type is not set: %q", cfg.Dashboard_Type)
+		}
+		return nil
+	})
+}
+
+func TestAdb(t *testing.T) {
+	tests := []checkTest{
+		{`{"devices": ["A1"]}`, ""},
+		{`{"devices": ["A1", "B2"], "consoles": ["/dev/ttyUSB0"]}`, "config param consoles must contain a console for each of 2 devices"},
+		{`{"devices": ["A1"], "adb_min_battery": 95}`, "config param adb_min_battery must be in [0, 90]: 95"},
+		{`{"devices": ["A1"], "adb_max_temp": -1}`, "config param adb_max_temp is negative: -1"},
+		{`{"devices": ["A1", "B2"], "consoles": ["/dev/ttyUSB0", "/dev/ttyUSB1"], "adb_min_battery": 50}`, ""},
+	}
+	runCheckTests(t, tests, checkAdb, func(cfg *Config) error {
+		if cfg.Adb_Min_Battery == 0 || cfg.Adb_Max_Temp != 45 {
+			return fmt.Errorf("defaults are not set: %+v", cfg)
+		}
+		return nil
+	})
+}
+
+func TestIsolated(t *testing.T) {
+	tests := []checkTest{
+		{`{"targets": ["10.0.0.1", "root@10.0.0.2:2222"]}`, ""},
+		{`{"targets": ["10.0.0.1"], "consoles": ["ssh console-server cat /dev/ttyS3"], "target_dir": "/syz"}`, ""},
+		{`{"targets": ["10.0.0.1", "10.0.0.1"]}`, "duplicate isolated target 10.0.0.1"},
+		{`{"targets": ["10.0.0.1 -oProxyCommand=foo"]}`, "bad isolated target \"10.0.0.1 -oProxyCommand=foo\""},
+		{`{"targets": ["10.0.0.1", "10.0.0.2"], "consoles": ["cat /dev/ttyUSB0"]}`, "config param consoles must contain a console for each of 2 targets"},
+		{`{"targets": ["10.0.0.1"], "target_dir": "/"}`, "bad config param target_dir: \"/\""},
+		{`{"targets": ["10.0.0.1"], "target_dir": "tmp"}`, "bad config param target_dir: \"tmp\""},
+	}
+	runCheckTests(t, tests, checkIsolated, func(cfg *Config) error {
+		if cfg.Target_Dir == "" {
+			return fmt.Errorf("target_dir default is not set")
+		}
+		return nil
+	})
+}
+
+func TestBhyve(t *testing.T) {
+	tests := []checkTest{
+		{`{"bhyve_dataset": "zroot/syzkaller", "bhyve_bridge": "bridge0"}`, ""},
+		{`{"bhyve_bridge": "bridge0"}`, "config param bhyve_dataset is empty (required for bhyve)"},
+		{`{"bhyve_dataset": "zroot/syzkaller"}`, "config param bhyve_bridge is empty (required for bhyve)"},
+		{`{"bhyve_dataset": "/dev/zvol/zroot/syzkaller", "bhyve_bridge": "bridge0"}`, "bad config param bhyve_dataset: \"/dev/zvol/zroot/syzkaller\", want pool/volume"},
+		{`{"bhyve_dataset": "zroot/syzkaller@snap", "bhyve_bridge": "bridge0"}`, "bad config param bhyve_dataset: \"zroot/syzkaller@snap\", want pool/volume"},
+	}
+	runCheckTests(t, tests, checkBhyve, nil)
+}
+
+func TestAuth(t *testing.T) {
+	tests := []checkTest{
+		{`{}`, ""},
+		{`{"auth_token": "secret"}`, ""},
+		{`{"tls_cert": "cert.pem"}`, "config params tls_cert and tls_key must be specified together"},
+		{`{"auth_token": "my secret"}`, "config param auth_token must not contain spaces and quotes"},
+	}
+	runCheckTests(t, tests, checkAuth, nil)
+}
+
+func TestSnapshot(t *testing.T) {
+	tests := []checkTest{
+		{`{"type": "kvm", "image": "9p"}`, ""},
+		{`{"type": "qemu", "image": "wheezy.img", "snapshot": true}`, ""},
+		{`{"type": "kvm", "snapshot": true}`, "config param snapshot is supported only for qemu VMs"},
+		{`{"type": "qemu", "image": "9p", "snapshot": true}`, "config param snapshot requires a disk image, 9p is not supported"},
+		{`{"type": "qemu", "image": "wheezy.img", "snapshot": true, "compare": {"image": "9p"}}`, "config param snapshot requires a disk image, 9p is not supported"},
+	}
+	runCheckTests(t, tests, checkSnapshot, nil)
+}
+
+func TestSharedDir(t *testing.T) {
+	tests := []checkTest{
+		{`{"type": "kvm"}`, ""},
+		{`{"type": "qemu", "shared_dir": "9p"}`, ""},
+		{`{"type": "qemu", "shared_dir": "virtiofs"}`, ""},
+		{`{"type": "qemu", "shared_dir": "nfs"}`, "config param shared_dir must contain one of 9p/virtiofs"},
+		{`{"type": "kvm", "shared_dir": "9p"}`, "config param shared_dir is supported only for qemu VMs"},
+		{`{"type": "qemu", "shared_dir": "9p", "snapshot": true}`, "config params shared_dir and snapshot can't be used together"},
+	}
+	runCheckTests(t, tests, checkSharedDir, nil)
+}
+
+func TestGetMaintainers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "linux", "scripts"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "linux", "scripts", "get_maintainer.pl"), nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tests := []checkTest{
+		{`{}`, ""},
+		{`{"get_maintainers": true}`, "config param get_maintainers requires kernel_src"},
+		{fmt.Sprintf(`{"get_maintainers": true, "kernel_src": %q}`, filepath.Join(dir, "linux")), ""},
+	}
+	runCheckTests(t, tests, checkGetMaintainers, nil)
+	if err := checkGetMaintainers(&Config{Get_Maintainers: true, Kernel_Src: dir}); err == nil {
+		t.Errorf("no error for kernel_src without get_maintainer.pl")
+	}
+}
+
+func TestTargetOs(t *testing.T) {
+	tests := []checkTest{
+		{`{}`, ""},
+		{`{"target_os": "freebsd"}`, ""},
+		{`{"target_os": "openbsd"}`, ""},
+		{`{"target_os": "plan9"}`, "config param target_os must contain one of linux/freebsd/netbsd/openbsd/fuchsia/windows/gvisor"},
+		{`{"target_os": "fuchsia", "sandbox": "none"}`, ""},
+		{`{"target_os": "fuchsia", "sandbox": "none", "cover": true}`, "config param cover must be false for fuchsia"},
+		{`{"target_os": "fuchsia", "sandbox": "setuid"}`, "config param sandbox must be none for fuchsia"},
+		{`{"target_os": "windows", "sandbox": "none"}`, ""},
+		{`{"target_os": "windows", "sandbox": "none", "cover": true}`, "config param cover must be false for windows"},
+		{`{"target_os": "windows", "sandbox": "setuid"}`, "config param sandbox must be none for windows"},
+		{`{"target_os": "gvisor", "cover": true, "sandbox": "namespace"}`, ""},
+		{`{"target_os": "linux"}`, ""},
+		{`{"target_os": "linux", "seccomp": true}`, ""},
+		{`{"target_os": "gvisor", "seccomp": true}`, ""},
+		{`{"target_os": "freebsd", "seccomp": true}`, "config param seccomp is not supported for freebsd"},
+	}
+	runCheckTests(t, tests, checkTargetOs, nil)
+}
+
+func TestTargetArch(t *testing.T) {
+	tests := []checkTest{
+		{`{"target_os": "linux", "target_arch": "amd64"}`, ""},
+		{`{"target_os": "linux", "target_arch": "arm64"}`, ""},
+		{`{"target_os": "linux", "target_arch": "ppc64le"}`, ""},
+		{`{"target_os": "linux", "target_arch": "riscv64"}`, ""},
+		{`{"target_os": "linux", "target_arch": "i386"}`, ""},
+		{`{"target_os": "linux", "target_arch": "arm"}`, "config param target_arch must contain one of amd64/arm64/ppc64le/riscv64/i386 for linux"},
+		{`{"target_os": "fuchsia", "target_arch": "arm64"}`, ""},
+		{`{"target_os": "freebsd", "target_arch": "arm64"}`, "config param target_arch must contain one of amd64 for freebsd"},
+	}
+	runCheckTests(t, tests, checkTargetArch, nil)
+}
+
+func TestSignal(t *testing.T) {
+	tests := []checkTest{
+		{`{}`, ""},
+		{`{"signal": "pc"}`, ""},
+		{`{"signal": "pc,edge,comps"}`, ""},
+		{`{"signal": "edge"}`, ""},
+		{`{"signal": "comps"}`, "config param signal must contain pc or edge"},
+		{`{"signal": "pc,func"}`, `config param signal contains unknown source "func", must be a list of pc/edge/comps`},
+	}
+	runCheckTests(t, tests, checkSignal, func(cfg *Config) error {
+		if cfg.Signal == "" {
+			return fmt.Errorf("signal is not set")
+		}
+		return nil
+	})
+}
+
+func TestReportRules(t *testing.T) {
+	tests := []checkTest{
+		{`{}`, ""},
+		{`{"report_rules": {"oopses": [{"header": "BUG: VSAN:", "formats": [{"regexp": "BUG: VSAN: ([a-z]+) in {{FUNC}}", "title": "VSAN: %[1]v in %[2]v"}]}]}}`, ""},
+		{`{"report_rules": {"oopses": [{"formats": []}]}}`, "config param report_rules is invalid: oops rule without header"},
+		{`{"report_rules": {"oopses": [{"header": "BUG: VSAN:", "formats": [{"regexp": "VSAN: ([a-z]+", "title": "VSAN"}]}]}}`,
+			"config param report_rules is invalid: bad format regexp \"VSAN: ([a-z]+\": error parsing regexp: missing closing ): `VSAN: ([a-z]+`"},
+		{`{"report_rules": {"oopses": [{"header": "BUG: VSAN:", "formats": [{"regexp": "VSAN: ([a-z]+)", "title": "VSAN: %[2]v"}]}]}}`,
+			"config param report_rules is invalid: bad title \"VSAN: %[2]v\" for format regexp \"VSAN: ([a-z]+)\" with 1 submatches"},
+		{`{"report_rules": {"titles": [{"regexp": "drv[0-9+"}]}}`,
+			"config param report_rules is invalid: bad title regexp \"drv[0-9+\": error parsing regexp: missing closing ]: `[0-9+`"},
+	}
+	runCheckTests(t, tests, parseReportRules, nil)
+}
+
+func TestCompare(t *testing.T) {
+	tests := []checkTest{
+		{`{"type": "qemu", "count": 1}`, ""},
+		{`{"type": "local", "count": 2, "compare": {}}`, "config param compare is not supported for type local"},
+		{`{"type": "qemu", "count": 1, "compare": {}}`, "config param compare requires at least 2 VMs, count is 1"},
+		{`{"type": "qemu", "count": 2, "compare": {"kernel": "bzImage"}}`, "config params compare.vmlinux and compare.kernel are required"},
+		{`{"type": "qemu", "count": 2, "tag": "B", "compare": {"kernel": "bzImage", "vmlinux": "vmlinux"}}`, "config param compare.tag must differ from tag: B"},
+		{`{"type": "qemu", "count": 2, "compare": {"kernel": "bzImage", "vmlinux": "vmlinux"}}`, ""},
+	}
+	runCheckTests(t, tests, checkCompare, nil)
+
+	workdir, err := ioutil.TempDir("", "syz-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	cfg := &Config{
+		Type:    "qemu",
+		Count:   4,
+		Kernel:  "bzImage.a",
+		Image:   "image",
+		Compare: &Compare{Kernel: "bzImage.b", Vmlinux: "vmlinux.b"},
+		Workdir: workdir,
+	}
+	if err := checkCompare(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < cfg.Count; index++ {
+		vmCfg, err := CreateVMConfig(cfg, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "bzImage.a"
+		if index%2 == 1 {
+			want = "bzImage.b"
+		}
+		if vmCfg.Kernel != want || vmCfg.Image != "image" {
+			t.Errorf("VM %v: got kernel %v image %v, want kernel %v", index, vmCfg.Kernel, vmCfg.Image, want)
+		}
+	}
+	if cfgB := CompareConfig(cfg); cfgB.Vmlinux != "vmlinux.b" || cfgB.Tag != "B" || cfgB.Compare != nil {
+		t.Errorf("bad compared config: %+v", cfgB)
+	}
+}
+
+func TestFocusAreas(t *testing.T) {
+	enabled := make(map[int]bool)
+	for _, call := range sys.Calls {
+		if call.CallName != "open" {
+			enabled[call.ID] = true
+		}
+	}
+	tests := []checkTest{
+		{`{"cover": true, "focus_areas": [{"syscalls": ["socket"]}]}`, "config param focus_areas[0] does not have a name"},
+		{`{"cover": true, "focus_areas": [{"name": "net"}, {"name": "net"}]}`, "config param focus_areas contains duplicate area net"},
+		{`{"cover": true, "focus_areas": [{"name": "net", "weight": -1}]}`, "focus area net: weight is negative: -1"},
+		{`{"cover": true, "focus_areas": [{"name": "fs", "syscalls": ["foo"]}]}`, "unknown focus area fs syscall: foo"},
+		{`{"cover": true, "focus_areas": [{"name": "fs", "syscalls": ["open"]}]}`, "focus area fs: all syscalls are disabled"},
+		{`{"cover": true, "focus_areas": [{"name": "net", "cover_filter": {}}]}`, "config param focus area net cover_filter does not select any code"},
+		{`{"cover": true, "focus_areas": [{"name": "net", "syscalls": ["socket", "open"]}, {"name": "all", "weight": 3}]}`, ""},
+	}
+	check := func(cfg *Config) error {
+		return parseFocusAreas(cfg, enabled)
+	}
+	runCheckTests(t, tests, check, func(cfg *Config) error {
+		net, all := cfg.Focus_Areas[0], cfg.Focus_Areas[1]
+		if net.Weight != 1 || all.Weight != 3 {
+			return fmt.Errorf("bad weights %v/%v", net.Weight, all.Weight)
+		}
+		for id := range net.ParsedSyscalls {
+			if call := sys.Calls[id]; call.CallName != "socket" && call.Name != "mmap" {
+				return fmt.Errorf("area net contains %v", call.Name)
+			}
+		}
+		if len(all.ParsedSyscalls) != len(enabled) {
+			return fmt.Errorf("area all contains %v syscalls, want %v", len(all.ParsedSyscalls), len(enabled))
+		}
+		return nil
+	})
+}
+
+func TestTargetBin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &Config{Syzkaller: dir, Target_Os: "gvisor", Target_Arch: "amd64"}
+	if got := TargetDir(cfg); got != "linux_amd64" {
+		t.Fatalf("bad target dir %v", got)
+	}
+	host := filepath.Join(dir, "bin", "syz-fuzzer")
+	if got := TargetBin(cfg, "syz-fuzzer"); got != host {
+		t.Fatalf("got %v, want %v", got, host)
+	}
+	// Cross-compiled binaries take precedence.
+	cross := filepath.Join(dir, "bin", "linux_amd64", "syz-fuzzer")
+	if err := os.MkdirAll(filepath.Dir(cross), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cross, nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if got := TargetBin(cfg, "syz-fuzzer"); got != cross {
+		t.Fatalf("got %v, want %v", got, cross)
+	}
+	if got := TargetBin(cfg, "syz-executor"); got != filepath.Join(dir, "bin", "syz-executor") {
+		t.Fatalf("bad executor path %v", got)
+	}
+}
+
+func TestPostprocessors(t *testing.T) {
+	file, err := ioutil.TempFile("", "syz-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	name := file.Name()
+	_, statErr := os.Stat(name + ".nonexistent")
+	tests := []checkTest{
+		{`{}`, ""},
+		{fmt.Sprintf(`{"postprocessors": [%q, %q]}`, "plugin:"+name, "cmd:"+name), ""},
+		{fmt.Sprintf(`{"postprocessors": [%q]}`, name),
+			fmt.Sprintf("config param postprocessors contains %q, must be plugin:file or cmd:file", name)},
+		{fmt.Sprintf(`{"postprocessors": [%q]}`, "exec:"+name),
+			fmt.Sprintf("config param postprocessors contains %q, must be plugin:file or cmd:file", "exec:"+name)},
+		{fmt.Sprintf(`{"postprocessors": [%q]}`, "cmd:"+name+".nonexistent"),
+			fmt.Sprintf("config param postprocessors contains %q: %v", "cmd:"+name+".nonexistent", statErr)},
+	}
+	runCheckTests(t, tests, checkPostprocessors, nil)
+}
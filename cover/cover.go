@@ -5,6 +5,9 @@
 package cover
 
 import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
 	"sort"
 )
 
@@ -39,6 +42,40 @@ func Canonicalize(cov []uint32) Cover {
 	return Cover(cov[:i])
 }
 
+// Serialize encodes canonical cov in a compact form:
+// differences between consecutive PCs encoded as uvarints.
+func Serialize(cov Cover) []byte {
+	data := make([]byte, 0, len(cov)*2)
+	var buf [binary.MaxVarintLen32]byte
+	prev := uint32(0)
+	for _, pc := range cov {
+		n := binary.PutUvarint(buf[:], uint64(pc-prev))
+		data = append(data, buf[:n]...)
+		prev = pc
+	}
+	return data
+}
+
+// Deserialize decodes cover encoded with Serialize.
+func Deserialize(data []byte) (Cover, error) {
+	var cov Cover
+	prev := uint32(0)
+	for len(data) != 0 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("bad serialized cover: truncated varint")
+		}
+		data = data[n:]
+		pc := prev + uint32(v)
+		if (v == 0 && len(cov) != 0) || v >= uint64(sent-prev) {
+			return nil, fmt.Errorf("bad serialized cover: PCs are not canonical")
+		}
+		cov = append(cov, pc)
+		prev = pc
+	}
+	return cov, nil
+}
+
 func Difference(cov0, cov1 Cover) Cover {
 	return foreach(cov0, cov1, func(v0, v1 uint32) uint32 {
 		if v0 < v1 {
@@ -130,6 +167,69 @@ func Minimize(corpus []Cover) []int {
 	return min
 }
 
+// MinimizeGreedy returns a minimal set of inputs that give the same coverage as the full corpus,
+// computed as greedy set cover: inputs that cover the most not yet covered PCs are taken first.
+// It is slower than Minimize, but produces smaller sets (Minimize takes any input that adds
+// at least one PC, even if the PC is later covered by another taken input).
+func MinimizeGreedy(corpus []Cover) []int {
+	// Gains of inputs only decrease as more PCs are covered, so stale gains in the heap
+	// are upper bounds: an input whose recomputed gain is still the largest can be taken.
+	h := make(gainHeap, 0, len(corpus))
+	for i, cov := range corpus {
+		if len(cov) != 0 {
+			h = append(h, gainInput{i, len(cov)})
+		}
+	}
+	heap.Init(&h)
+	var min []int
+	covered := make(map[uint32]struct{})
+	for len(h) != 0 {
+		inp := &h[0]
+		gain := 0
+		for _, pc := range corpus[inp.idx] {
+			if _, ok := covered[pc]; !ok {
+				gain++
+			}
+		}
+		if gain == 0 {
+			heap.Pop(&h)
+			continue
+		}
+		if gain < inp.gain {
+			inp.gain = gain
+			heap.Fix(&h, 0)
+			continue
+		}
+		for _, pc := range corpus[inp.idx] {
+			covered[pc] = struct{}{}
+		}
+		min = append(min, inp.idx)
+		heap.Pop(&h)
+	}
+	return min
+}
+
+type gainInput struct {
+	idx  int
+	gain int // upper bound of the number of PCs the input adds to the covered set
+}
+
+type gainHeap []gainInput
+
+// Inputs with larger gain come first, ties are broken by index for determinism.
+func (h gainHeap) Len() int { return len(h) }
+func (h gainHeap) Less(i, j int) bool {
+	return h[i].gain > h[j].gain || h[i].gain == h[j].gain && h[i].idx < h[j].idx
+}
+func (h gainHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *gainHeap) Push(x interface{}) { *h = append(*h, x.(gainInput)) }
+func (h *gainHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
 type minInput struct {
 	idx int
 	cov Cover
@@ -203,3 +203,126 @@ func TestMinimizeRandom(t *testing.T) {
 		}
 	}
 }
+
+func TestMinimizeGreedy(t *testing.T) {
+	tests := []struct {
+		inp []Cover
+		out []int
+	}{
+		// Take all.
+		{
+			[]Cover{
+				{1, 2, 3},
+				{4, 5, 6},
+				{7, 8, 9},
+			},
+			[]int{0, 1, 2},
+		},
+		// Take one.
+		{
+			[]Cover{
+				{1, 2, 3, 4, 5, 6, 7, 8, 9},
+				{1},
+				{2, 3, 4, 5},
+				{6, 7, 8},
+			},
+			[]int{0},
+		},
+		// Skip an input that adds a single PC that another input also covers
+		// (Minimize takes all three inputs here).
+		{
+			[]Cover{
+				{1, 2, 3, 4, 5},
+				{1, 2, 3, 10},
+				{10, 11, 12},
+			},
+			[]int{0, 2},
+		},
+		// Empty inputs are never taken.
+		{
+			[]Cover{
+				{},
+				{1},
+			},
+			[]int{1},
+		},
+	}
+	for _, test := range tests {
+		res := MinimizeGreedy(test.inp)
+		if !reflect.DeepEqual(res, test.out) {
+			t.Logf("corpus:")
+			for _, in := range test.inp {
+				t.Logf("  %+v", in)
+			}
+			t.Fatalf("expect: %+v, got: %+v", test.out, res)
+		}
+	}
+}
+
+func TestMinimizeGreedyRandom(t *testing.T) {
+	rnd, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		n := rnd.Intn(20)
+		cov := make([]Cover, n)
+		for i := range cov {
+			tmp := make(Cover, rnd.Intn(10))
+			for j := range tmp {
+				tmp[j] = uint32(rnd.Intn(100))
+			}
+			cov[i] = Canonicalize(tmp)
+		}
+		var total Cover
+		for _, c := range cov {
+			total = Union(total, c)
+		}
+		mini := MinimizeGreedy(cov)
+		var minimized Cover
+		seen := make(map[int]bool)
+		for _, idx := range mini {
+			if seen[idx] {
+				t.Fatalf("input %v is taken twice: %+v", idx, mini)
+			}
+			seen[idx] = true
+			minimized = Union(minimized, cov[idx])
+		}
+		if (len(total) != 0 || len(minimized) != 0) && !reflect.DeepEqual(total, minimized) {
+			t.Logf("corpus:")
+			for _, in := range cov {
+				t.Logf("  %+v", in)
+			}
+			t.Fatalf("minimized cover %+v differs from total %+v", minimized, total)
+		}
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	rnd, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		var cov []uint32
+		for n := rnd.Intn(100); n > 0; n-- {
+			if rnd.Intn(2) == 0 {
+				cov = append(cov, uint32(rnd.Intn(1000)))
+			} else {
+				cov = append(cov, rnd.Uint32()%sent)
+			}
+		}
+		cov1 := Canonicalize(cov)
+		data := Serialize(cov1)
+		cov2, err := Deserialize(data)
+		if err != nil {
+			t.Fatalf("failed to deserialize %+v: %v", cov1, err)
+		}
+		if (len(cov1) != 0 || len(cov2) != 0) && !reflect.DeepEqual(cov1, cov2) {
+			t.Fatalf("deserialized cover differs:\n%+v\n%+v", cov1, cov2)
+		}
+	}
+	for _, data := range [][]byte{
+		{0x80},                         // truncated varint
+		{0x1, 0x0},                     // duplicate PC
+		{0xff, 0xff, 0xff, 0xff, 0x0f}, // sentinel PC
+	} {
+		if _, err := Deserialize(data); err == nil {
+			t.Fatalf("deserialized bad data %x", data)
+		}
+	}
+}
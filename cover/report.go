@@ -1,7 +1,7 @@
 // Copyright 2015 syzkaller project authors. All rights reserved.
 // Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
 
-package main
+package cover
 
 import (
 	"bufio"
@@ -10,12 +10,13 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/google/syzkaller/cover"
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/symbolizer"
 )
@@ -54,7 +55,9 @@ var (
 	allCoverReady = make(chan bool)
 )
 
-func initAllCover(vmlinux string) {
+// InitReport starts collection of all PCs with coverage callbacks in vmlinux
+// that GenerateHTML uses to show uncovered lines.
+func InitReport(vmlinux string) {
 	// Running objdump on vmlinux takes 20-30 seconds, so we do it asynchronously on start.
 	go func() {
 		pcs, err := coveredPCs(vmlinux)
@@ -68,7 +71,9 @@ func initAllCover(vmlinux string) {
 	}()
 }
 
-func generateCoverHtml(w io.Writer, vmlinux string, cov []uint32) error {
+// GenerateHTML writes an HTML report with kernel sources annotated with coverage cov.
+// InitReport must be called before.
+func GenerateHTML(w io.Writer, vmlinux, kernelSrc string, cov []uint32) error {
 	if len(cov) == 0 {
 		return fmt.Errorf("No coverage data available")
 	}
@@ -79,7 +84,7 @@ func generateCoverHtml(w io.Writer, vmlinux string, cov []uint32) error {
 	}
 	pcs := make([]uint64, len(cov))
 	for i, pc := range cov {
-		pcs[i] = cover.RestorePC(pc, base) - 1
+		pcs[i] = RestorePC(pc, base) - 1
 	}
 	allPcs, err := allPcsInFuncs(vmlinux, pcs)
 	if err != nil {
@@ -98,50 +103,107 @@ func generateCoverHtml(w io.Writer, vmlinux string, cov []uint32) error {
 	if err != nil {
 		return err
 	}
+	// Strip only whole path components, so that directory summaries make sense.
+	prefix = prefix[:strings.LastIndexByte(prefix, '/')+1]
 
 	var d templateData
+	dirs := make(map[string]*templateDir)
 	for f, covered := range fileSet(frames, allFrames) {
+		name := f
+		if len(name) > len(prefix) {
+			name = name[len(prefix):]
+		}
+		file := &templateFile{
+			Name:  name,
+			Lines: len(covered),
+		}
+		for _, c := range covered {
+			if c.covered {
+				file.Covered++
+			}
+		}
+		if kernelSrc != "" {
+			if rel := sourceFile(kernelSrc, f); rel != "" {
+				file.Name = rel
+				f = filepath.Join(kernelSrc, rel)
+			}
+		}
 		lines, err := parseFile(f)
 		if err != nil {
-			return err
+			file.Body = template.HTML(template.HTMLEscapeString(
+				fmt.Sprintf("source is not available: %v\n", err)))
+		} else {
+			file.Body = annotateFile(lines, covered)
 		}
-		coverage := 0
-		var buf bytes.Buffer
-		for i, ln := range lines {
-			if len(covered) > 0 && covered[0].line == i+1 {
-				if covered[0].covered {
-					buf.Write([]byte("<span id='covered'>"))
-					buf.Write(ln)
-					buf.Write([]byte("</span> /*covered*/\n"))
-					coverage++
-				} else {
-					buf.Write([]byte("<span id='uncovered'>"))
-					buf.Write(ln)
-					buf.Write([]byte("</span>\n"))
-				}
-				covered = covered[1:]
-			} else {
-				buf.Write(ln)
-				buf.Write([]byte{'\n'})
+		d.Files = append(d.Files, file)
+		for dir := filepath.Dir(file.Name); ; dir = filepath.Dir(dir) {
+			sum := dirs[dir]
+			if sum == nil {
+				sum = &templateDir{Name: dir}
+				dirs[dir] = sum
+			}
+			sum.Files++
+			sum.Lines += file.Lines
+			sum.Covered += file.Covered
+			if dir == "." || dir == "/" {
+				break
 			}
 		}
-		if len(f) > len(prefix) {
-			f = f[len(prefix):]
-		}
-		d.Files = append(d.Files, &templateFile{
-			Name:     f,
-			Body:     template.HTML(buf.String()),
-			Coverage: coverage,
-		})
+	}
+	for _, dir := range dirs {
+		d.Dirs = append(d.Dirs, dir)
 	}
 
 	sort.Sort(templateFileArray(d.Files))
+	sort.Sort(templateDirArray(d.Dirs))
 	if err := coverTemplate.Execute(w, d); err != nil {
 		return err
 	}
 	return nil
 }
 
+// annotateFile highlights covered and uncovered lines of a source file.
+// covered must be sorted by line number.
+func annotateFile(lines [][]byte, covered []coverage) template.HTML {
+	var buf bytes.Buffer
+	for i, ln := range lines {
+		if len(covered) > 0 && covered[0].line == i+1 {
+			if covered[0].covered {
+				buf.Write([]byte("<span id='covered'>"))
+				buf.Write(ln)
+				buf.Write([]byte("</span> /*covered*/\n"))
+			} else {
+				buf.Write([]byte("<span id='uncovered'>"))
+				buf.Write(ln)
+				buf.Write([]byte("</span>\n"))
+			}
+			covered = covered[1:]
+		} else {
+			buf.Write(ln)
+			buf.Write([]byte{'\n'})
+		}
+	}
+	return template.HTML(buf.String())
+}
+
+// sourceFile returns path of source file f from vmlinux debug info relative to kernelSrc.
+// The kernel could be built in a different place, so leading path components of f
+// are stripped until the file is found in kernelSrc. Returns "" if the file is not found.
+func sourceFile(kernelSrc, f string) string {
+	for rel := filepath.Clean(f); rel != ""; {
+		rel = strings.TrimLeft(rel, "/")
+		if _, err := os.Stat(filepath.Join(kernelSrc, rel)); err == nil {
+			return rel
+		}
+		slash := strings.IndexByte(rel, '/')
+		if slash == -1 {
+			break
+		}
+		rel = rel[slash+1:]
+	}
+	return ""
+}
+
 func fileSet(frames, allFrames []symbolizer.Frame) map[string][]coverage {
 	files := make(map[string]map[int]bool)
 	funcs := make(map[string]bool)
@@ -286,13 +348,19 @@ func coveredPCs(bin string) ([]uint64, error) {
 	var pcs []uint64
 	s := bufio.NewScanner(stdout)
 	// A line looks as: "ffffffff8100206a:       callq  ffffffff815cc1d0 <__sanitizer_cov_trace_pc>"
-	callInsn := []byte("callq ")
+	// on amd64 and as "ffff200008081234:       bl      ffff200008356c30 <__sanitizer_cov_trace_pc>"
+	// on arm64 and ppc64le, riscv64 uses jal.
+	callInsns := [][]byte{[]byte("callq "), []byte("\tbl\t"), []byte(" bl "), []byte("\tjal\t")}
 	traceFunc := []byte(" <__sanitizer_cov_trace_pc>")
 	for s.Scan() {
 		ln := s.Bytes()
-		if pos := bytes.Index(ln, callInsn); pos == -1 {
-			continue
-		} else if bytes.Index(ln[pos:], traceFunc) == -1 {
+		pos := -1
+		for _, insn := range callInsns {
+			if pos = bytes.Index(ln, insn); pos != -1 {
+				break
+			}
+		}
+		if pos == -1 || bytes.Index(ln[pos:], traceFunc) == -1 {
 			continue
 		}
 		colon := bytes.IndexByte(ln, ':')
@@ -342,12 +410,36 @@ func symbolize(vmlinux string, pcs []uint64) ([]symbolizer.Frame, string, error)
 
 type templateData struct {
 	Files []*templateFile
+	Dirs  []*templateDir
 }
 
 type templateFile struct {
-	Name     string
-	Body     template.HTML
-	Coverage int
+	Name    string
+	Body    template.HTML
+	Lines   int // number of lines with coverage callbacks
+	Covered int // number of covered lines
+}
+
+func (f *templateFile) Percent() int {
+	return percent(f.Covered, f.Lines)
+}
+
+type templateDir struct {
+	Name    string
+	Files   int // number of files with coverage in the directory and its subdirectories
+	Lines   int
+	Covered int
+}
+
+func (d *templateDir) Percent() int {
+	return percent(d.Covered, d.Lines)
+}
+
+func percent(covered, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return covered * 100 / total
 }
 
 type templateFileArray []*templateFile
@@ -369,6 +461,12 @@ func (a templateFileArray) Less(i, j int) bool {
 }
 func (a templateFileArray) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 
+type templateDirArray []*templateDir
+
+func (a templateDirArray) Len() int           { return len(a) }
+func (a templateDirArray) Less(i, j int) bool { return a[i].Name < a[j].Name }
+func (a templateDirArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
 var coverTemplate = template.Must(template.New("").Parse(
 	`
 <!DOCTYPE html>
@@ -404,28 +502,53 @@ var coverTemplate = template.Must(template.New("").Parse(
 				color: rgb(255, 0, 0);
 				font-weight: bold;
 			}
+			#summary td {
+				padding: 0 10px;
+			}
+			#summary td.num {
+				text-align: right;
+			}
 		</style>
 	</head>
 	<body>
 		<div id="topbar">
 			<div id="nav">
 				<select id="files">
+				<option value="summary">directory summary</option>
 				{{range $i, $f := .Files}}
-				<option value="file{{$i}}">{{$f.Name}} ({{$f.Coverage}})</option>
+				<option value="file{{$i}}">{{$f.Name}} ({{$f.Covered}}/{{$f.Lines}}, {{$f.Percent}}%)</option>
 				{{end}}
 				</select>
 			</div>
 		</div>
 		<div id="content">
+		<table id="summary">
+			<tr>
+				<th>directory</th>
+				<th>files</th>
+				<th>covered lines</th>
+				<th>total lines</th>
+				<th>coverage</th>
+			</tr>
+			{{range $d := .Dirs}}
+			<tr>
+				<td>{{$d.Name}}</td>
+				<td class="num">{{$d.Files}}</td>
+				<td class="num">{{$d.Covered}}</td>
+				<td class="num">{{$d.Lines}}</td>
+				<td class="num">{{$d.Percent}}%</td>
+			</tr>
+			{{end}}
+		</table>
 		{{range $i, $f := .Files}}
-		<pre class="file" id="file{{$i}}" {{if $i}}style="display: none"{{end}}>{{$f.Body}}</pre>
+		<pre class="file" id="file{{$i}}" style="display: none">{{$f.Body}}</pre>
 		{{end}}
 		</div>
 	</body>
 	<script>
 	(function() {
 		var files = document.getElementById('files');
-		var visible = document.getElementById('file0');
+		var visible = document.getElementById('summary');
 		files.addEventListener('change', onChange, false);
 		function onChange() {
 			visible.style.display = 'none';
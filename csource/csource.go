@@ -2,17 +2,19 @@
 // Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
 
 // I heard you like shell...
-//go:generate bash -c "echo -e '// AUTOGENERATED FROM executor/common.h\npackage csource\nvar commonHeader = `' > common.go; cat ../executor/common.h | sed -e '/#include \"common_kvm.h\"/ {' -e 'r ../executor/common_kvm.h' -e 'd' -e '}' - | sed -e '/#include \"kvm.h\"/ {' -e 'r ../executor/kvm.h' -e 'd' -e '}' - | sed -e '/#include \"kvm.S.h\"/ {' -e 'r ../executor/kvm.S.h' -e 'd' -e '}' - | egrep -v '^[   ]*//' | sed '/^[ 	]*\\/\\/.*/d' | sed 's#[ 	]*//.*##g' >> common.go; echo '`' >> common.go"
+//go:generate bash -c "echo -e '// AUTOGENERATED FROM executor/common.h\npackage csource\nvar commonHeader = `' > common.go; cat ../executor/common.h | sed -e '/#include \"common_kvm.h\"/ {' -e 'r ../executor/common_kvm.h' -e 'd' -e '}' - | sed -e '/#include \"common_glob.h\"/ {' -e 'r ../executor/common_glob.h' -e 'd' -e '}' - | sed -e '/#include \"kvm.h\"/ {' -e 'r ../executor/kvm.h' -e 'd' -e '}' - | sed -e '/#include \"kvm.S.h\"/ {' -e 'r ../executor/kvm.S.h' -e 'd' -e '}' - | egrep -v '^[   ]*//' | sed '/^[ 	]*\\/\\/.*/d' | sed 's#[ 	]*//.*##g' >> common.go; echo '`' >> common.go"
 
 package csource
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"unsafe"
 
@@ -26,7 +28,145 @@ type Options struct {
 	Repeat   bool
 	Procs    int
 	Sandbox  string
-	Repro    bool // generate code for use with repro package
+	// Inject a fault into FaultNth (0-based) fault site of call FaultCall,
+	// takes precedence over FailNth attributes of calls.
+	Fault     bool
+	FaultCall int
+	FaultNth  int
+	Repro     bool // generate code for use with repro package
+}
+
+// ParseOptions parses options serialized with %+v format verb
+// (e.g. "{Threaded:true Collide:true Repeat:true Procs:4 Sandbox:none Fault:false FaultCall:0 FaultNth:0 Repro:false}"),
+// this is how options are saved in reproducers. Options that are missing are left zero,
+// so that reproducers saved before the options were added can be parsed.
+func ParseOptions(data string) (Options, error) {
+	var opts Options
+	data = strings.TrimSpace(data)
+	if len(data) < 2 || data[0] != '{' || data[len(data)-1] != '}' {
+		return opts, fmt.Errorf("bad options format: %q", data)
+	}
+	for _, field := range strings.Fields(data[1 : len(data)-1]) {
+		colon := strings.IndexByte(field, ':')
+		if colon == -1 {
+			return opts, fmt.Errorf("bad option %q", field)
+		}
+		name, val := field[:colon], field[colon+1:]
+		var err error
+		switch name {
+		case "Threaded":
+			opts.Threaded, err = strconv.ParseBool(val)
+		case "Collide":
+			opts.Collide, err = strconv.ParseBool(val)
+		case "Repeat":
+			opts.Repeat, err = strconv.ParseBool(val)
+		case "Procs":
+			opts.Procs, err = strconv.Atoi(val)
+		case "Sandbox":
+			opts.Sandbox = val
+		case "Fault":
+			opts.Fault, err = strconv.ParseBool(val)
+		case "FaultCall":
+			opts.FaultCall, err = strconv.Atoi(val)
+		case "FaultNth":
+			opts.FaultNth, err = strconv.Atoi(val)
+		case "Repro":
+			opts.Repro, err = strconv.ParseBool(val)
+		default:
+			return opts, fmt.Errorf("unknown option %q", name)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("bad option %q: %v", field, err)
+		}
+	}
+	return opts, nil
+}
+
+// SerializeRepro serializes reproducer in repro.prog format:
+// options in the first line (a comment for prog.Deserialize) followed by the program.
+func SerializeRepro(p *prog.Prog, opts Options) []byte {
+	return append([]byte(fmt.Sprintf("# %+v\n", opts)), p.Serialize()...)
+}
+
+// ParseRepro splits reproducer in repro.prog format into options and program.
+func ParseRepro(data []byte) (Options, []byte, error) {
+	var opts Options
+	if !bytes.HasPrefix(data, []byte("# ")) {
+		return opts, nil, fmt.Errorf("reproducer does not start with options")
+	}
+	nl := bytes.IndexByte(data, '\n')
+	if nl == -1 {
+		return opts, nil, fmt.Errorf("reproducer does not contain a program")
+	}
+	opts, err := ParseOptions(string(data[2:nl]))
+	if err != nil {
+		return opts, nil, fmt.Errorf("failed to parse reproducer options: %v", err)
+	}
+	return opts, data[nl+1:], nil
+}
+
+// FaultOptions returns options with the fault of p (FailNth attribute of a call) made explicit.
+func FaultOptions(p *prog.Prog, opts Options) Options {
+	opts.Fault, opts.FaultCall, opts.FaultNth = false, 0, 0
+	for i, c := range p.Calls {
+		if c.FailNth != 0 {
+			opts.Fault, opts.FaultCall, opts.FaultNth = true, i, c.FailNth-1
+		}
+	}
+	return opts
+}
+
+// ApplyRepro sets flags of a tool executing or converting reproducers (threaded, collide,
+// procs, sandbox, repeat, fault_call, fault_nth) according to opts, which are usually parsed
+// from a reproducer with ParseRepro. Flags given on the command line and flags that the tool
+// does not define are left as is. repeat may be a bool flag or a number of repetitions (0 for infinite).
+func (opts Options) ApplyRepro(flags *flag.FlagSet) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	repeat := fmt.Sprint(opts.Repeat)
+	if f := flags.Lookup("repeat"); f != nil {
+		if b, ok := f.Value.(interface {
+			IsBoolFlag() bool
+		}); !ok || !b.IsBoolFlag() {
+			repeat = "1"
+			if opts.Repeat {
+				repeat = "0"
+			}
+		}
+	}
+	vals := map[string]string{
+		"threaded": fmt.Sprint(opts.Threaded),
+		"collide":  fmt.Sprint(opts.Collide),
+		"procs":    fmt.Sprint(opts.Procs),
+		"sandbox":  opts.Sandbox,
+		"repeat":   repeat,
+	}
+	// Don't override defaults with values that are missing in the header.
+	if opts.Procs < 1 {
+		delete(vals, "procs")
+	}
+	if opts.Sandbox == "" {
+		delete(vals, "sandbox")
+	}
+	// The fault is given by both flags, so either of them given on the command line disables it.
+	if !given["fault_call"] && !given["fault_nth"] {
+		vals["fault_call"] = "-1"
+		if opts.Fault {
+			vals["fault_call"] = fmt.Sprint(opts.FaultCall)
+			vals["fault_nth"] = fmt.Sprint(opts.FaultNth)
+		}
+	}
+	for name, val := range vals {
+		if given[name] || flags.Lookup(name) == nil {
+			continue
+		}
+		if err := flags.Set(name, val); err != nil {
+			return fmt.Errorf("bad reproducer option %v=%v: %v", name, val, err)
+		}
+	}
+	return nil
 }
 
 func Write(p *prog.Prog, opts Options) ([]byte, error) {
@@ -39,6 +179,13 @@ func Write(p *prog.Prog, opts Options) ([]byte, error) {
 	for _, c := range p.Calls {
 		handled[c.Meta.CallName] = c.Meta.NR
 	}
+	// Generated programs map the data region with mmap calls, hand-written programs
+	// may not, in such case the program maps the whole data region before running.
+	_, hasMmap := handled["mmap"]
+	mmapData := !hasMmap
+	if mmapData {
+		handled["mmap"] = sys.CallMap["mmap"].NR
+	}
 	for name, nr := range handled {
 		fmt.Fprintf(w, "#ifndef __NR_%v\n", name)
 		fmt.Fprintf(w, "#define __NR_%v %v\n", name, nr)
@@ -50,22 +197,49 @@ func Write(p *prog.Prog, opts Options) ([]byte, error) {
 	if _, ok := handled["syz_emit_ethernet"]; ok {
 		enableTun = "true"
 	}
+	enableWifi := "false"
+	if _, ok := handled["syz_80211_inject_frame"]; ok {
+		enableWifi = "true"
+	}
+	// Cgroups are accessed with normal syscalls, so look at description names.
+	enableCgroups := false
+	for _, c := range p.Calls {
+		if strings.Contains(c.Meta.Name, "$cgroup") {
+			enableCgroups = true
+		}
+	}
 
-	hdr, err := preprocessCommonHeader(opts, handled)
+	faultCall, faultNth := -1, 0
+	for i, c := range p.Calls {
+		if c.FailNth != 0 {
+			faultCall, faultNth = i, c.FailNth-1
+		}
+	}
+	if opts.Fault {
+		if opts.FaultCall < 0 || opts.FaultCall >= len(p.Calls) {
+			return nil, fmt.Errorf("fault call %v is out of range, the program has %v calls", opts.FaultCall, len(p.Calls))
+		}
+		faultCall, faultNth = opts.FaultCall, opts.FaultNth
+	}
+
+	calls, nvar, useGlob := generateCalls(exec, faultCall, faultNth)
+
+	hdr, err := preprocessCommonHeader(opts, handled, useGlob, faultCall >= 0, enableCgroups)
 	if err != nil {
 		return nil, err
 	}
 	fmt.Fprint(w, hdr)
 	fmt.Fprint(w, "\n")
 
-	calls, nvar := generateCalls(exec)
 	fmt.Fprintf(w, "long r[%v];\n", nvar)
 
 	if !opts.Repeat {
 		generateTestFunc(w, opts, calls, "loop")
 
 		fmt.Fprint(w, "int main()\n{\n")
-		fmt.Fprintf(w, "\tsetup_main_process(0, %v);\n", enableTun)
+		generateSetupMmap(w, "\t", mmapData)
+		generateSetupFault(w, "\t", faultCall >= 0)
+		fmt.Fprintf(w, "\tsetup_main_process(0, %v, %v, %v);\n", enableTun, enableWifi, enableCgroups)
 		fmt.Fprintf(w, "\tint pid = do_sandbox_%v();\n", opts.Sandbox)
 		fmt.Fprint(w, "\tint status = 0;\n")
 		fmt.Fprint(w, "\twhile (waitpid(pid, &status, __WALL) != pid) {}\n")
@@ -74,7 +248,9 @@ func Write(p *prog.Prog, opts Options) ([]byte, error) {
 		generateTestFunc(w, opts, calls, "test")
 		if opts.Procs <= 1 {
 			fmt.Fprint(w, "int main()\n{\n")
-			fmt.Fprintf(w, "\tsetup_main_process(0, %v);\n", enableTun)
+			generateSetupMmap(w, "\t", mmapData)
+			generateSetupFault(w, "\t", faultCall >= 0)
+			fmt.Fprintf(w, "\tsetup_main_process(0, %v, %v, %v);\n", enableTun, enableWifi, enableCgroups)
 			fmt.Fprintf(w, "\tint pid = do_sandbox_%v();\n", opts.Sandbox)
 			fmt.Fprint(w, "\tint status = 0;\n")
 			fmt.Fprint(w, "\twhile (waitpid(pid, &status, __WALL) != pid) {}\n")
@@ -84,7 +260,9 @@ func Write(p *prog.Prog, opts Options) ([]byte, error) {
 			fmt.Fprint(w, "\tint i;")
 			fmt.Fprintf(w, "\tfor (i = 0; i < %v; i++) {\n", opts.Procs)
 			fmt.Fprint(w, "\t\tif (fork() == 0) {\n")
-			fmt.Fprintf(w, "\t\t\tsetup_main_process(i, %v);\n", enableTun)
+			generateSetupMmap(w, "\t\t\t", mmapData)
+			generateSetupFault(w, "\t\t\t", faultCall >= 0)
+			fmt.Fprintf(w, "\t\t\tsetup_main_process(i, %v, %v, %v);\n", enableTun, enableWifi, enableCgroups)
 			fmt.Fprintf(w, "\t\t\tdo_sandbox_%v();\n", opts.Sandbox)
 			fmt.Fprint(w, "\t\t\treturn 0;\n")
 			fmt.Fprint(w, "\t\t}\n")
@@ -105,6 +283,25 @@ func Write(p *prog.Prog, opts Options) ([]byte, error) {
 	return out, nil
 }
 
+func generateSetupMmap(w io.Writer, indent string, mmapData bool) {
+	if mmapData {
+		// See execute_syscall in common.h, old mmap on i386 takes args in a struct.
+		mmap := "__NR_mmap"
+		if sys.Arch == "i386" {
+			mmap = "__NR_mmap2"
+		}
+		fmt.Fprintf(w, "%vsyscall(%v, 0x%xul, 0x%xul, 0x%xul, 0x%xul, -1, 0);\n", indent, mmap,
+			sys.DataOffset, sys.NumPages*sys.PageSize, sys.PROT_READ|sys.PROT_WRITE,
+			sys.MAP_ANONYMOUS|sys.MAP_PRIVATE|sys.MAP_FIXED)
+	}
+}
+
+func generateSetupFault(w io.Writer, indent string, fault bool) {
+	if fault {
+		fmt.Fprintf(w, "%vsetup_fault();\n", indent)
+	}
+}
+
 func generateTestFunc(w io.Writer, opts Options, calls []string, name string) {
 	if !opts.Threaded && !opts.Collide {
 		fmt.Fprintf(w, "void %v()\n{\n", name)
@@ -152,7 +349,9 @@ func generateTestFunc(w io.Writer, opts Options, calls []string, name string) {
 	}
 }
 
-func generateCalls(exec []byte) ([]string, int) {
+// generateCalls generates C code for calls of the exec program.
+// If faultCall is not -1, a fault is injected into faultNth fault site of the call with that index.
+func generateCalls(exec []byte, faultCall, faultNth int) ([]string, int, bool) {
 	read := func() uintptr {
 		if len(exec) < 8 {
 			panic("exec program overflow")
@@ -174,6 +373,7 @@ func generateCalls(exec []byte) ([]string, int) {
 	}
 	lastCall := 0
 	seenCall := false
+	useGlob := false
 	var calls []string
 	w := new(bytes.Buffer)
 	newCall := func() {
@@ -183,7 +383,14 @@ func generateCalls(exec []byte) ([]string, int) {
 			w = new(bytes.Buffer)
 		}
 	}
+	// The C program does not need the header, but check that it is what we expect.
+	if magic, version := read(), read(); magic != prog.ExecMagic || version != prog.ExecVersion {
+		panic(fmt.Sprintf("bad exec program header: magic=0x%x version=%v", magic, version))
+	}
+	read() // flags
+	read() // arch
 	n := 0
+	callIndex := 0
 loop:
 	for ; ; n++ {
 		switch instr := read(); instr {
@@ -200,7 +407,7 @@ loop:
 				fmt.Fprintf(w, "\tNONFAILING(*(uint%v_t*)0x%x = (uint%v_t)0x%x);\n", size*8, addr, size*8, arg)
 			case prog.ExecArgResult:
 				fmt.Fprintf(w, "\tNONFAILING(*(uint%v_t*)0x%x = %v);\n", size*8, addr, resultRef())
-			case prog.ExecArgData:
+			case prog.ExecArgData, prog.ExecArgGlob:
 				data := exec[:size]
 				exec = exec[(size+7)/8*8:]
 				var esc []byte
@@ -214,6 +421,10 @@ loop:
 					esc = append(esc, '\\', 'x', hex(v>>4), hex(v<<4>>4))
 				}
 				fmt.Fprintf(w, "\tNONFAILING(memcpy((void*)0x%x, \"%s\", %v));\n", addr, esc, size)
+				if typ == prog.ExecArgGlob {
+					fmt.Fprintf(w, "\texpand_glob((char*)0x%x, %v);\n", addr, size)
+					useGlob = true
+				}
 			default:
 				panic("bad argument type")
 			}
@@ -222,11 +433,20 @@ loop:
 			size := read()
 			fmt.Fprintf(w, "\tif (r[%v] != -1)\n", lastCall)
 			fmt.Fprintf(w, "\t\tNONFAILING(r[%v] = *(uint%v_t*)0x%x);\n", n, size*8, addr)
+		case prog.ExecInstrTimeout:
+			// C programs don't limit execution time of individual calls.
+			read()
+		case prog.ExecInstrAsync:
+			// In threaded mode C programs don't wait for completion of any calls.
+		case prog.ExecInstrDelay:
+			newCall()
+			fmt.Fprintf(w, "\tusleep(%v);\n", read())
 		default:
 			// Normal syscall.
 			newCall()
 			meta := sys.Calls[instr]
-			fmt.Fprintf(w, "\tr[%v] = execute_syscall(__NR_%v", n, meta.CallName)
+			call := new(bytes.Buffer)
+			fmt.Fprintf(call, "r[%v] = execute_syscall(__NR_%v", n, meta.CallName)
 			nargs := read()
 			for i := uintptr(0); i < nargs; i++ {
 				typ := read()
@@ -234,26 +454,37 @@ loop:
 				_ = size
 				switch typ {
 				case prog.ExecArgConst:
-					fmt.Fprintf(w, ", 0x%xul", read())
+					fmt.Fprintf(call, ", 0x%xul", read())
 				case prog.ExecArgResult:
-					fmt.Fprintf(w, ", %v", resultRef())
+					fmt.Fprintf(call, ", %v", resultRef())
 				default:
 					panic("unknown arg type")
 				}
 			}
 			for i := nargs; i < 9; i++ {
-				fmt.Fprintf(w, ", 0")
+				fmt.Fprintf(call, ", 0")
+			}
+			if callIndex == faultCall {
+				// Close fail-nth after the call as executor does,
+				// otherwise repeated programs leak an fd per iteration.
+				fmt.Fprintf(w, "\t{\n")
+				fmt.Fprintf(w, "\tint fail_fd = inject_fault(%v);\n", faultNth)
+				fmt.Fprintf(w, "\t%s);\n", call.Bytes())
+				fmt.Fprintf(w, "\tclose(fail_fd);\n")
+				fmt.Fprintf(w, "\t}\n")
+			} else {
+				fmt.Fprintf(w, "\t%s);\n", call.Bytes())
 			}
-			fmt.Fprintf(w, ");\n")
+			callIndex++
 			lastCall = n
 			seenCall = true
 		}
 	}
 	newCall()
-	return calls, n
+	return calls, n, useGlob
 }
 
-func preprocessCommonHeader(opts Options, handled map[string]int) (string, error) {
+func preprocessCommonHeader(opts Options, handled map[string]int, useGlob, fault, cgroups bool) (string, error) {
 	var defines []string
 	switch opts.Sandbox {
 	case "none":
@@ -262,6 +493,8 @@ func preprocessCommonHeader(opts Options, handled map[string]int) (string, error
 		defines = append(defines, "SYZ_SANDBOX_SETUID")
 	case "namespace":
 		defines = append(defines, "SYZ_SANDBOX_NAMESPACE")
+	case "android_untrusted_app":
+		defines = append(defines, "SYZ_SANDBOX_ANDROID_UNTRUSTED_APP")
 	default:
 		return "", fmt.Errorf("unknown sandbox mode: %v", opts.Sandbox)
 	}
@@ -271,6 +504,28 @@ func preprocessCommonHeader(opts Options, handled map[string]int) (string, error
 	for name, _ := range handled {
 		defines = append(defines, "__NR_"+name)
 	}
+	if useGlob {
+		defines = append(defines, "SYZ_USE_GLOB")
+	}
+	if fault {
+		defines = append(defines, "SYZ_FAULT_INJECTION")
+	}
+	if cgroups {
+		defines = append(defines, "SYZ_ENABLE_CGROUPS")
+	}
+	// cpp runs with -undef, but common.h selects arch-specific code with the arch macros.
+	switch sys.Arch {
+	case "amd64":
+		defines = append(defines, "__x86_64__")
+	case "arm64":
+		defines = append(defines, "__aarch64__")
+	case "ppc64le":
+		defines = append(defines, "__powerpc64__")
+	case "riscv64":
+		defines = append(defines, "__riscv")
+	case "i386":
+		defines = append(defines, "__i386__")
+	}
 
 	cmd := exec.Command("cpp", "-nostdinc", "-undef", "-fdirectives-only", "-dDI", "-E", "-P", "-")
 	for _, def := range defines {
@@ -306,10 +561,14 @@ func Build(lang, src string) (string, error) {
 		return "", fmt.Errorf("failed to create temp file: %v", err)
 	}
 	bin.Close()
-	out, err := exec.Command("gcc", "-x", lang, "-Wall", "-Werror", src, "-o", bin.Name(), "-pthread", "-static", "-O1", "-g").CombinedOutput()
+	flags := []string{"-x", lang, "-Wall", "-Werror", src, "-o", bin.Name(), "-pthread", "-O1", "-g"}
+	if sys.Arch == "i386" {
+		flags = append(flags, "-m32")
+	}
+	out, err := exec.Command("gcc", append(flags, "-static")...).CombinedOutput()
 	if err != nil {
 		// Some distributions don't have static libraries.
-		out, err = exec.Command("gcc", "-x", lang, "-Wall", "-Werror", src, "-o", bin.Name(), "-pthread", "-O1", "-g").CombinedOutput()
+		out, err = exec.Command("gcc", flags...).CombinedOutput()
 	}
 	if err != nil {
 		os.Remove(bin.Name())
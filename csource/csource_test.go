@@ -4,6 +4,8 @@
 package csource
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
@@ -33,7 +35,7 @@ func allOptionsPermutations() []Options {
 			for _, opt.Repeat = range []bool{false, true} {
 				for _, opt.Repro = range []bool{false, true} {
 					for _, opt.Procs = range []int{1, 4} {
-						for _, opt.Sandbox = range []string{"none", "setuid", "namespace"} {
+						for _, opt.Sandbox = range []string{"none", "setuid", "namespace", "android_untrusted_app"} {
 							if opt.Collide && !opt.Threaded {
 								continue
 							}
@@ -85,3 +87,139 @@ func testOne(t *testing.T, p *prog.Prog, opts Options) {
 	}
 	defer os.Remove(bin)
 }
+
+func TestParseOptions(t *testing.T) {
+	for _, opts := range allOptionsPermutations() {
+		data := fmt.Sprintf("%+v", opts)
+		opts1, err := ParseOptions(data)
+		if err != nil {
+			t.Fatalf("failed to parse %v: %v", data, err)
+		}
+		if opts1 != opts {
+			t.Fatalf("options changed after parsing: %v -> %+v", data, opts1)
+		}
+	}
+	fault := Options{Threaded: true, Procs: 1, Sandbox: "none", Fault: true, FaultCall: 2, FaultNth: 5}
+	if opts, err := ParseOptions(fmt.Sprintf("%+v", fault)); err != nil || opts != fault {
+		t.Fatalf("failed to parse fault options: %+v, %v", opts, err)
+	}
+	for _, data := range []string{"", "{", "Threaded:true", "{Threaded:foo}", "{Foo:true}", "{FaultCall:x}"} {
+		if _, err := ParseOptions(data); err == nil {
+			t.Errorf("parsed bad options %q", data)
+		}
+	}
+}
+
+func TestParseRepro(t *testing.T) {
+	const prog = "mmap(&(0x7f0000000000/0x1000)=nil, 0x1000, 0x3, 0x32, 0xffffffffffffffff, 0x0)\n"
+	tests := []struct {
+		hdr  string
+		opts Options
+	}{
+		{
+			// Reproducers saved before fault options were added.
+			"# {Threaded:true Collide:false Repeat:true Procs:4 Sandbox:namespace Repro:false}\n",
+			Options{Threaded: true, Repeat: true, Procs: 4, Sandbox: "namespace"},
+		},
+		{
+			"# {Threaded:false Collide:false Repeat:false Procs:1 Sandbox:none Fault:true FaultCall:0 FaultNth:3 Repro:false}\n",
+			Options{Procs: 1, Sandbox: "none", Fault: true, FaultNth: 3},
+		},
+	}
+	for i, test := range tests {
+		opts, p, err := ParseRepro([]byte(test.hdr + prog))
+		if err != nil {
+			t.Fatalf("#%v: failed to parse: %v", i, err)
+		}
+		if opts != test.opts {
+			t.Fatalf("#%v: got options %+v, want %+v", i, opts, test.opts)
+		}
+		if string(p) != prog {
+			t.Fatalf("#%v: got bad program: %s", i, p)
+		}
+	}
+	if _, _, err := ParseRepro([]byte(prog)); err == nil {
+		t.Fatalf("parsed reproducer without options")
+	}
+}
+
+func TestSerializeRepro(t *testing.T) {
+	p, err := prog.Deserialize([]byte("getpid()\ngetpid() (fail_nth: 4)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := FaultOptions(p, Options{Threaded: true, Procs: 1, Sandbox: "setuid"})
+	want := Options{Threaded: true, Procs: 1, Sandbox: "setuid", Fault: true, FaultCall: 1, FaultNth: 3}
+	if opts != want {
+		t.Fatalf("got fault options %+v, want %+v", opts, want)
+	}
+	opts1, data, err := ParseRepro(SerializeRepro(p, opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts1 != opts {
+		t.Fatalf("options changed after parsing: %+v -> %+v", opts, opts1)
+	}
+	if _, err := prog.Deserialize(data); err != nil {
+		t.Fatalf("failed to deserialize the program: %v", err)
+	}
+}
+
+func TestApplyRepro(t *testing.T) {
+	opts := Options{Threaded: true, Repeat: true, Procs: 4, Fault: true, FaultCall: 2, FaultNth: 5}
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	threaded := flags.Bool("threaded", false, "")
+	repeat := flags.Int("repeat", 1, "")
+	procs := flags.Int("procs", 1, "")
+	sandbox := flags.String("sandbox", "none", "")
+	faultCall := flags.Int("fault_call", -1, "")
+	faultNth := flags.Int("fault_nth", 0, "")
+	if err := flags.Parse([]string{"-procs=8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.ApplyRepro(flags); err != nil {
+		t.Fatal(err)
+	}
+	if !*threaded || *repeat != 0 || *procs != 8 || *sandbox != "none" || *faultCall != 2 || *faultNth != 5 {
+		t.Fatalf("bad flags: threaded=%v repeat=%v procs=%v sandbox=%v fault_call=%v fault_nth=%v",
+			*threaded, *repeat, *procs, *sandbox, *faultCall, *faultNth)
+	}
+
+	flags = flag.NewFlagSet("", flag.ContinueOnError)
+	repeatBool := flags.Bool("repeat", false, "")
+	faultCall = flags.Int("fault_call", -1, "")
+	faultNth = flags.Int("fault_nth", 0, "")
+	if err := flags.Parse([]string{"-fault_nth=1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.ApplyRepro(flags); err != nil {
+		t.Fatal(err)
+	}
+	if !*repeatBool || *faultCall != -1 || *faultNth != 1 {
+		t.Fatalf("bad flags: repeat=%v fault_call=%v fault_nth=%v", *repeatBool, *faultCall, *faultNth)
+	}
+}
+
+func TestMmapData(t *testing.T) {
+	tests := []struct {
+		prog string
+		mmap bool
+	}{
+		{"getpid()\n", true},
+		{"mmap(&(0x7f0000000000/0x1000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0)\ngetpid()\n", false},
+	}
+	for i, test := range tests {
+		p, err := prog.Deserialize([]byte(test.prog))
+		if err != nil {
+			t.Fatalf("#%v: failed to deserialize program: %v", i, err)
+		}
+		src, err := Write(p, Options{Procs: 1, Sandbox: "none"})
+		if err != nil {
+			t.Fatalf("#%v: %v", i, err)
+		}
+		mmap := bytes.Contains(src, []byte("\tsyscall(__NR_mmap, "))
+		if mmap != test.mmap {
+			t.Errorf("#%v: data region mmap is generated: %v, want %v", i, mmap, test.mmap)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package dashapi defines API used by syz-manager to upload crashes, reproducers,
+// corpus and stats to an external dashboard.
+// The default "http" client sends requests as JSON to a dashboard over HTTP,
+// private dashboards can provide own clients with Register.
+package dashapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client is a dashboard connection.
+type Client interface {
+	ReportCrash(crash *Crash) error
+	ReportRepro(repro *Repro) error
+	UploadCorpus(corpus *Corpus) error
+	UploadStats(stats *Stats) error
+}
+
+// Crash is a new crash (or a new occurrence of a known crash).
+type Crash struct {
+	Manager   string // manager name
+	Title     string
+	Tag       string // manager config tag (e.g. kernel branch/commit)
+	Log       []byte // console output
+	Report    []byte // symbolized crash report
+	RawReport []byte // crash report before symbolization (empty if symbolization failed)
+	Assets    []byte // kernel build artifacts (see crash_assets config param)
+	State     []byte // machine state captured after the crash (see crash_state config param)
+
+	GuiltyFile  string   // source file most likely responsible for the crash (if known)
+	Maintainers []string // suggested CC list for the guilty file (if get_maintainers is enabled)
+	Corrupted   bool     // the report looks corrupted (truncated or interleaved with other output)
+}
+
+// Repro is a reproducer found for a crash.
+type Repro struct {
+	Manager string
+	Title   string
+	Tag     string
+	Opts    string // reproducer options
+	Prog    []byte // syzkaller program
+	CProg   []byte // C reproducer (optional)
+	Report  []byte // crash report from the reproducer run
+}
+
+// Corpus contains new corpus programs since the previous upload.
+type Corpus struct {
+	Manager string
+	Progs   [][]byte
+}
+
+// Stats is a snapshot of manager stats.
+type Stats struct {
+	Manager string
+	Time    time.Time
+	Stats   map[string]uint64
+}
+
+type ctorFunc func(client, addr, key string) (Client, error)
+
+var ctors = map[string]ctorFunc{
+	"http": newHTTP,
+}
+
+// Register registers a client type that can be used with New.
+func Register(typ string, ctor ctorFunc) {
+	ctors[typ] = ctor
+}
+
+// New creates a client of the given type.
+// client and key identify and authenticate the manager, addr is the dashboard address.
+func New(typ, client, addr, key string) (Client, error) {
+	ctor := ctors[typ]
+	if ctor == nil {
+		return nil, fmt.Errorf("unknown dashboard type '%v'", typ)
+	}
+	return ctor(client, addr, key)
+}
+
+// HTTP is the default client. Each call is a POST request to addr/api
+// with client, key and method form values and JSON-encoded payload.
+type HTTP struct {
+	Client string
+	Addr   string
+	Key    string
+	http   *http.Client
+}
+
+func newHTTP(client, addr, key string) (Client, error) {
+	return &HTTP{
+		Client: client,
+		Addr:   strings.TrimSuffix(addr, "/"),
+		Key:    key,
+		http:   &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+func (dash *HTTP) ReportCrash(crash *Crash) error {
+	return dash.query("report_crash", crash)
+}
+
+func (dash *HTTP) ReportRepro(repro *Repro) error {
+	return dash.query("report_repro", repro)
+}
+
+func (dash *HTTP) UploadCorpus(corpus *Corpus) error {
+	return dash.query("upload_corpus", corpus)
+}
+
+func (dash *HTTP) UploadStats(stats *Stats) error {
+	return dash.query("upload_stats", stats)
+}
+
+func (dash *HTTP) query(method string, req interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+	values := make(url.Values)
+	values.Add("client", dash.Client)
+	values.Add("key", dash.Key)
+	values.Add("method", method)
+	values.Add("payload", string(payload))
+	resp, err := dash.http.Post(dash.Addr+"/api", "application/x-www-form-urlencoded",
+		bytes.NewReader([]byte(values.Encode())))
+	if err != nil {
+		return fmt.Errorf("dashboard %v failed: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("dashboard %v failed: %v: %s", method, resp.Status, body)
+	}
+	return nil
+}
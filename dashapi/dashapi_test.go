@@ -0,0 +1,126 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dashapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHTTP(t *testing.T) {
+	var got *Crash
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api" || r.FormValue("client") != "ci" ||
+			r.FormValue("key") != "secret" || r.FormValue("method") != "report_crash" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		got = new(Crash)
+		if err := json.Unmarshal([]byte(r.FormValue("payload")), got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	dash, err := New("http", "ci", srv.URL+"/", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash := &Crash{Manager: "mgr", Title: "KASAN: use-after-free in foo", Log: []byte("log")}
+	if err := dash.ReportCrash(crash); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Title != crash.Title || string(got.Log) != "log" {
+		t.Fatalf("dashboard got %+v", got)
+	}
+	if err := dash.ReportRepro(&Repro{}); err == nil {
+		t.Fatalf("unexpected success")
+	}
+	if _, err := New("foo", "ci", srv.URL, "secret"); err == nil {
+		t.Fatalf("unknown dashboard type succeeded")
+	}
+}
+
+type testClient struct {
+	fail    bool
+	crashes []string
+	repros  []string
+}
+
+func (c *testClient) ReportCrash(crash *Crash) error {
+	if c.fail {
+		return fmt.Errorf("unreachable")
+	}
+	c.crashes = append(c.crashes, crash.Title)
+	return nil
+}
+
+func (c *testClient) ReportRepro(repro *Repro) error {
+	if c.fail {
+		return fmt.Errorf("unreachable")
+	}
+	c.repros = append(c.repros, repro.Title)
+	return nil
+}
+
+func (c *testClient) UploadCorpus(corpus *Corpus) error {
+	return nil
+}
+
+func (c *testClient) UploadStats(stats *Stats) error {
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-dashapi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &testClient{fail: true}
+	q, err := NewQueue(client, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.ReportCrash(&Crash{Title: "crash1"})
+	q.ReportRepro(&Repro{Title: "crash1"})
+	q.senders.Wait()
+	if q.Pending() != 2 {
+		t.Fatalf("want 2 pending requests, got %v", q.Pending())
+	}
+	if err := q.Flush(); err == nil {
+		t.Fatalf("flush succeeded with unreachable dashboard")
+	}
+
+	// Pending requests survive restarts.
+	client.fail = false
+	q, err = NewQueue(client, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Pending() != 2 {
+		t.Fatalf("want 2 pending requests after restart, got %v", q.Pending())
+	}
+	// New requests are sent in background behind the pending ones.
+	q.ReportCrash(&Crash{Title: "crash2"})
+	q.senders.Wait()
+	if q.Pending() != 0 || len(client.crashes) != 2 || client.crashes[0] != "crash1" ||
+		client.crashes[1] != "crash2" || len(client.repros) != 1 {
+		t.Fatalf("bad send: pending %v, crashes %v, repros %v", q.Pending(), client.crashes, client.repros)
+	}
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	q.ReportCrash(&Crash{Title: "crash3"})
+	q.senders.Wait()
+	if q.Pending() != 0 || len(client.crashes) != 3 {
+		t.Fatalf("request was not sent in background")
+	}
+}
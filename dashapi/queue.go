@@ -0,0 +1,205 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dashapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/syzkaller/fileutil"
+)
+
+// maxPending limits the number of queued requests, the oldest ones are dropped first.
+const maxPending = 1000
+
+// Queue wraps a Client and persists crashes, reproducers and corpus uploads in dir
+// before sending them, so that they are not lost if the dashboard is unreachable.
+// Requests are sent in order in background, requests that fail are resent by Flush.
+// Stats are not queued, a failed stats upload is superseded by the next one.
+type Queue struct {
+	client  Client
+	dir     string
+	mu      sync.Mutex
+	pending []string // file names in dir, oldest first
+	seq     uint64
+	sending bool           // background sender is running
+	senders sync.WaitGroup // for tests
+	flushMu sync.Mutex     // serializes sending of requests
+}
+
+func NewQueue(client Client, dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create dashboard queue dir: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		client: client,
+		dir:    dir,
+	}
+	for _, f := range files {
+		seq, _, err := parsePendingName(f.Name())
+		if err != nil || strings.Contains(f.Name(), fileutil.TempSuffix) {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		q.pending = append(q.pending, f.Name())
+		if q.seq <= seq {
+			q.seq = seq + 1
+		}
+	}
+	sort.Slice(q.pending, func(i, j int) bool {
+		seqi, _, _ := parsePendingName(q.pending[i])
+		seqj, _, _ := parsePendingName(q.pending[j])
+		return seqi < seqj
+	})
+	return q, nil
+}
+
+// Pending returns the number of queued requests.
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *Queue) ReportCrash(crash *Crash) error {
+	return q.send("report_crash", crash)
+}
+
+func (q *Queue) ReportRepro(repro *Repro) error {
+	return q.send("report_repro", repro)
+}
+
+func (q *Queue) UploadCorpus(corpus *Corpus) error {
+	return q.send("upload_corpus", corpus)
+}
+
+func (q *Queue) UploadStats(stats *Stats) error {
+	return q.client.UploadStats(stats)
+}
+
+// send queues the request and starts the background sender if it's not running,
+// so that callers are not blocked by the dashboard. Returns an error only if the request can't be queued.
+func (q *Queue) send(method string, req interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	name := fmt.Sprintf("%v.%v", q.seq, method)
+	q.seq++
+	if err := fileutil.WriteFileAtomic(filepath.Join(q.dir, name), data, 0600); err != nil {
+		return fmt.Errorf("failed to queue dashboard request: %v", err)
+	}
+	q.pending = append(q.pending, name)
+	for len(q.pending) > maxPending {
+		os.Remove(filepath.Join(q.dir, q.pending[0]))
+		q.pending = q.pending[1:]
+	}
+	if !q.sending {
+		q.sending = true
+		q.senders.Add(1)
+		go q.sendPending()
+	}
+	return nil
+}
+
+// sendPending sends queued requests until the queue is empty or sending fails,
+// failed requests are resent by the next Flush.
+func (q *Queue) sendPending() {
+	defer q.senders.Done()
+	for {
+		err := q.Flush()
+		q.mu.Lock()
+		if err != nil || len(q.pending) == 0 {
+			q.sending = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+	}
+}
+
+// Flush sends queued requests in order and stops on the first failure.
+// Requests are sent without holding q.mu, so that new requests can be queued meanwhile.
+func (q *Queue) Flush() error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return nil
+		}
+		name := q.pending[0]
+		q.mu.Unlock()
+		file := filepath.Join(q.dir, name)
+		_, method, _ := parsePendingName(name)
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			// Broken requests are dropped, they won't succeed on retry.
+			if err := call(q.client, method, data); err != nil && err != errBadRequest {
+				return err
+			}
+		}
+		q.mu.Lock()
+		// The request could be dropped by send while it was being sent.
+		if len(q.pending) != 0 && q.pending[0] == name {
+			os.Remove(file)
+			q.pending = q.pending[1:]
+		}
+		q.mu.Unlock()
+	}
+}
+
+var errBadRequest = errors.New("bad queued dashboard request")
+
+func call(client Client, method string, data []byte) error {
+	switch method {
+	case "report_crash":
+		req := new(Crash)
+		if err := json.Unmarshal(data, req); err != nil {
+			return errBadRequest
+		}
+		return client.ReportCrash(req)
+	case "report_repro":
+		req := new(Repro)
+		if err := json.Unmarshal(data, req); err != nil {
+			return errBadRequest
+		}
+		return client.ReportRepro(req)
+	case "upload_corpus":
+		req := new(Corpus)
+		if err := json.Unmarshal(data, req); err != nil {
+			return errBadRequest
+		}
+		return client.UploadCorpus(req)
+	default:
+		return errBadRequest
+	}
+}
+
+func parsePendingName(name string) (uint64, string, error) {
+	dot := strings.IndexByte(name, '.')
+	if dot == -1 {
+		return 0, "", fmt.Errorf("bad pending request name %v", name)
+	}
+	seq, err := strconv.ParseUint(name[:dot], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("bad pending request name %v", name)
+	}
+	return seq, name[dot+1:], nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package db implements a packed corpus database: a single file that contains
+// a set of programs, used to transfer corpus between machines.
+// The file is gzip-compressed, starts with a magic string and then contains
+// records consisting of a little-endian uint32 length followed by the program.
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/syzkaller/hash"
+)
+
+const (
+	magic        = "syzkaller corpus db v1\n"
+	maxRecordLen = 16 << 20
+)
+
+// Write writes programs to w, duplicate programs are written once.
+func Write(w io.Writer, progs [][]byte) error {
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write([]byte(magic)); err != nil {
+		return err
+	}
+	seen := make(map[hash.Sig]bool)
+	var buf [4]byte
+	for _, data := range progs {
+		sig := hash.Hash(data)
+		if seen[sig] {
+			continue
+		}
+		seen[sig] = true
+		binary.LittleEndian.PutUint32(buf[:], uint32(len(data)))
+		if _, err := gz.Write(buf[:]); err != nil {
+			return err
+		}
+		if _, err := gz.Write(data); err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// Read reads all programs from r.
+func Read(r io.Reader) ([][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("corpus db is not gzip-compressed: %v", err)
+	}
+	defer gz.Close()
+	br := bufio.NewReader(gz)
+	hdr := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, hdr); err != nil || string(hdr) != magic {
+		return nil, fmt.Errorf("bad corpus db header")
+	}
+	var progs [][]byte
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			if err == io.EOF {
+				return progs, nil
+			}
+			return nil, fmt.Errorf("corpus db is truncated: %v", err)
+		}
+		n := binary.LittleEndian.Uint32(buf[:])
+		if n > maxRecordLen {
+			return nil, fmt.Errorf("corpus db record is too large: %v", n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("corpus db is truncated: %v", err)
+		}
+		progs = append(progs, data)
+	}
+}
+
+// ReadFile reads all programs from file.
+func ReadFile(file string) ([][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// WriteFile atomically writes programs to file.
+func WriteFile(file string, progs [][]byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "corpus.db.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := Write(f, progs); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-db-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "corpus.db")
+	progs := [][]byte{
+		[]byte("mmap(&(0x7f0000000000/0x1000)=nil, 0x1000, 0x3, 0x32, 0xffffffffffffffff, 0x0)\n"),
+		[]byte("getpid()\n"),
+		[]byte("getpid()\n"),
+		[]byte{},
+	}
+	if err := WriteFile(file, progs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{progs[0], progs[1], progs[3]}
+	if len(got) != len(want) {
+		t.Fatalf("got %v programs, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("program #%v: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReadBroken(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := Write(buf, [][]byte{[]byte("getpid()\n")}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if _, err := Read(bytes.NewReader(data[:len(data)-10])); err == nil {
+		t.Fatalf("truncated db was read successfully")
+	}
+	if _, err := Read(bytes.NewReader([]byte("getpid()\n"))); err == nil {
+		t.Fatalf("not a db was read successfully")
+	}
+}
@@ -15,6 +15,7 @@
 #include <sys/socket.h>
 #include <sys/stat.h>
 #include <sys/syscall.h>
+#include <sys/statfs.h>
 #include <sys/time.h>
 #include <sys/types.h>
 #include <sys/wait.h>
@@ -23,6 +24,7 @@
 #include <linux/if.h>
 #include <linux/if_tun.h>
 #include <linux/kvm.h>
+#include <linux/magic.h>
 #include <linux/sched.h>
 #include <net/if_arp.h>
 
@@ -158,6 +160,11 @@ static void install_segv_handler()
 		__atomic_fetch_sub(&skip_segv, 1, __ATOMIC_SEQ_CST); \
 	}
 
+#if defined(__NR_syz_emit_ethernet) || defined(__NR_syz_80211_inject_frame)
+// sysgen knowns about this constant (maxPids)
+#define MAX_PIDS 32
+#endif
+
 #ifdef __NR_syz_emit_ethernet
 static void vsnprintf_check(char* str, size_t size, const char* format, va_list args)
 {
@@ -197,8 +204,6 @@ static void execute_command(const char* format, ...)
 
 int tunfd = -1;
 
-// sysgen knowns about this constant (maxPids)
-#define MAX_PIDS 32
 #define ADDR_MAX_LEN 32
 
 #define LOCAL_MAC "aa:aa:aa:aa:aa:%02hx"
@@ -210,6 +215,37 @@ int tunfd = -1;
 #define LOCAL_IPV6 "fd00::%02hxaa"
 #define REMOTE_IPV6 "fd00::%02hxbb"
 
+static char tun_iface[IFNAMSIZ];
+static int tun_id;
+
+static void configure_tun()
+{
+	const char* iface = tun_iface;
+	int id = tun_id;
+
+	char local_mac[ADDR_MAX_LEN];
+	snprintf_check(local_mac, sizeof(local_mac), LOCAL_MAC, id);
+	char remote_mac[ADDR_MAX_LEN];
+	snprintf_check(remote_mac, sizeof(remote_mac), REMOTE_MAC, id);
+
+	char local_ipv4[ADDR_MAX_LEN];
+	snprintf_check(local_ipv4, sizeof(local_ipv4), LOCAL_IPV4, id);
+	char remote_ipv4[ADDR_MAX_LEN];
+	snprintf_check(remote_ipv4, sizeof(remote_ipv4), REMOTE_IPV4, id);
+
+	char local_ipv6[ADDR_MAX_LEN];
+	snprintf_check(local_ipv6, sizeof(local_ipv6), LOCAL_IPV6, id);
+	char remote_ipv6[ADDR_MAX_LEN];
+	snprintf_check(remote_ipv6, sizeof(remote_ipv6), REMOTE_IPV6, id);
+
+	execute_command("ip link set dev %s address %s", iface, local_mac);
+	execute_command("ip addr add %s/24 dev %s", local_ipv4, iface);
+	execute_command("ip -6 addr add %s/120 dev %s", local_ipv6, iface);
+	execute_command("ip neigh add %s lladdr %s dev %s nud permanent", remote_ipv4, remote_mac, iface);
+	execute_command("ip -6 neigh add %s lladdr %s dev %s nud permanent", remote_ipv6, remote_mac, iface);
+	execute_command("ip link set %s up", iface);
+}
+
 static void initialize_tun(uint64_t pid)
 {
 	if (getuid() != 0)
@@ -235,27 +271,37 @@ static void initialize_tun(uint64_t pid)
 	if (ioctl(tunfd, TUNSETIFF, (void*)&ifr) < 0)
 		fail("tun: ioctl(TUNSETIFF) failed");
 
-	char local_mac[ADDR_MAX_LEN];
-	snprintf_check(local_mac, sizeof(local_mac), LOCAL_MAC, id);
-	char remote_mac[ADDR_MAX_LEN];
-	snprintf_check(remote_mac, sizeof(remote_mac), REMOTE_MAC, id);
+	tun_id = id;
+	strncpy(tun_iface, iface, IFNAMSIZ);
+	configure_tun();
+}
 
-	char local_ipv4[ADDR_MAX_LEN];
-	snprintf_check(local_ipv4, sizeof(local_ipv4), LOCAL_IPV4, id);
-	char remote_ipv4[ADDR_MAX_LEN];
-	snprintf_check(remote_ipv4, sizeof(remote_ipv4), REMOTE_IPV4, id);
+static bool tun_enabled;
+static uint64_t tun_pid;
 
-	char local_ipv6[ADDR_MAX_LEN];
-	snprintf_check(local_ipv6, sizeof(local_ipv6), LOCAL_IPV6, id);
-	char remote_ipv6[ADDR_MAX_LEN];
-	snprintf_check(remote_ipv6, sizeof(remote_ipv6), REMOTE_IPV6, id);
+static void setup_tun()
+{
+	if (tun_enabled)
+		initialize_tun(tun_pid);
+}
 
-	execute_command("ip link set dev %s address %s", iface, local_mac);
-	execute_command("ip addr add %s/24 dev %s", local_ipv4, iface);
-	execute_command("ip -6 addr add %s/120 dev %s", local_ipv6, iface);
-	execute_command("ip neigh add %s lladdr %s dev %s nud permanent", remote_ipv4, remote_mac, iface);
-	execute_command("ip -6 neigh add %s lladdr %s dev %s nud permanent", remote_ipv6, remote_mac, iface);
-	execute_command("ip link set %s up", iface);
+// A test can bring the device down, which also drops its addresses and neighbours,
+// subsequent tests would not be able to inject packets then.
+static void reset_tun()
+{
+	if (tunfd < 0)
+		return;
+	int sock = socket(AF_INET, SOCK_DGRAM, 0);
+	if (sock == -1)
+		return;
+	struct ifreq ifr;
+	memset(&ifr, 0, sizeof(ifr));
+	strncpy(ifr.ifr_name, tun_iface, IFNAMSIZ);
+	if (ioctl(sock, SIOCGIFFLAGS, &ifr) == 0 && !(ifr.ifr_flags & IFF_UP)) {
+		debug("tun: %s is down, reconfiguring\n", tun_iface);
+		configure_tun();
+	}
+	close(sock);
 }
 
 static uintptr_t syz_emit_ethernet(uintptr_t a0, uintptr_t a1)
@@ -269,6 +315,271 @@ static uintptr_t syz_emit_ethernet(uintptr_t a0, uintptr_t a1)
 }
 #endif // __NR_syz_emit_ethernet
 
+#ifdef __NR_syz_80211_inject_frame
+#include <linux/genetlink.h>
+#include <linux/netlink.h>
+#include <linux/nl80211.h>
+
+// Definitions from drivers/net/wireless/mac80211_hwsim.h, which is not exported to user space.
+enum {
+	HWSIM_CMD_REGISTER = 1,
+	HWSIM_CMD_FRAME = 2,
+	HWSIM_CMD_NEW_RADIO = 4,
+};
+
+enum {
+	HWSIM_ATTR_ADDR_RECEIVER = 1,
+	HWSIM_ATTR_FRAME = 3,
+	HWSIM_ATTR_RX_RATE = 5,
+	HWSIM_ATTR_SIGNAL = 6,
+	HWSIM_ATTR_FREQ = 19,
+	HWSIM_ATTR_PERM_ADDR = 22,
+};
+
+// sys/ieee80211.txt knows about these: each process has WIFI_RADIOS radios
+// with addresses 08:02:11:00:ID:RADIO, where ID is executor process number.
+#define WIFI_RADIOS 2
+#define WIFI_MAC_PREFIX 0x08, 0x02, 0x11, 0x00
+#define WIFI_FREQ 2412 // channel 1
+#define WIFI_IBSS_SSID "syz"
+#define WIFI_IBSS_BSSID 0x50, 0x50, 0x50, 0x50, 0x50, 0x50
+#define WIFI_MAX_FRAME 2352
+
+struct nlmsg {
+	char* pos;
+	char buf[4096];
+};
+
+static void netlink_init(struct nlmsg* nlmsg, int typ, int cmd)
+{
+	memset(nlmsg, 0, sizeof(*nlmsg));
+	struct nlmsghdr* hdr = (struct nlmsghdr*)nlmsg->buf;
+	hdr->nlmsg_type = typ;
+	hdr->nlmsg_flags = NLM_F_REQUEST | NLM_F_ACK;
+	struct genlmsghdr* genl = (struct genlmsghdr*)NLMSG_DATA(hdr);
+	genl->cmd = cmd;
+	nlmsg->pos = (char*)(genl + 1);
+}
+
+static void netlink_attr(struct nlmsg* nlmsg, int typ, const void* data, int size)
+{
+	if (nlmsg->pos + NLA_HDRLEN + NLA_ALIGN(size) > nlmsg->buf + sizeof(nlmsg->buf))
+		fail("netlink message is too large");
+	struct nlattr* attr = (struct nlattr*)nlmsg->pos;
+	attr->nla_len = NLA_HDRLEN + size;
+	attr->nla_type = typ;
+	if (size)
+		memcpy(attr + 1, data, size);
+	nlmsg->pos += NLA_ALIGN(attr->nla_len);
+}
+
+// Sends the request and waits for the acknowledgement, returns 0 on success
+// and -1 with errno set on failure. Reply to a get request is left in nlmsg.
+static int netlink_send(struct nlmsg* nlmsg, int sock)
+{
+	struct nlmsghdr* hdr = (struct nlmsghdr*)nlmsg->buf;
+	hdr->nlmsg_len = nlmsg->pos - nlmsg->buf;
+	struct sockaddr_nl addr;
+	memset(&addr, 0, sizeof(addr));
+	addr.nl_family = AF_NETLINK;
+	if (sendto(sock, nlmsg->buf, hdr->nlmsg_len, 0, (struct sockaddr*)&addr, sizeof(addr)) != (ssize_t)hdr->nlmsg_len)
+		return -1;
+	int n = recv(sock, nlmsg->buf, sizeof(nlmsg->buf), 0);
+	if (n < 0)
+		return -1;
+	if (n < (int)sizeof(struct nlmsghdr) || n < (int)hdr->nlmsg_len) {
+		errno = EINVAL;
+		return -1;
+	}
+	if (hdr->nlmsg_type != NLMSG_ERROR) {
+		// The acknowledgement follows the reply.
+		char ack[256];
+		if (recv(sock, ack, sizeof(ack), 0) < 0)
+			return -1;
+		return 0;
+	}
+	if (n < (int)(NLMSG_HDRLEN + sizeof(struct nlmsgerr))) {
+		errno = EINVAL;
+		return -1;
+	}
+	// Some commands (e.g. HWSIM_CMD_NEW_RADIO) return positive values on success.
+	int err = ((struct nlmsgerr*)NLMSG_DATA(hdr))->error;
+	if (err < 0) {
+		errno = -err;
+		return -1;
+	}
+	return 0;
+}
+
+static int netlink_query_family_id(struct nlmsg* nlmsg, int sock, const char* family)
+{
+	netlink_init(nlmsg, GENL_ID_CTRL, CTRL_CMD_GETFAMILY);
+	netlink_attr(nlmsg, CTRL_ATTR_FAMILY_NAME, family, strlen(family) + 1);
+	if (netlink_send(nlmsg, sock))
+		return -1;
+	struct nlmsghdr* hdr = (struct nlmsghdr*)nlmsg->buf;
+	char* end = nlmsg->buf + hdr->nlmsg_len;
+	char* pos = (char*)NLMSG_DATA(hdr) + GENL_HDRLEN;
+	while (pos + NLA_HDRLEN <= end) {
+		struct nlattr* attr = (struct nlattr*)pos;
+		if (attr->nla_len < NLA_HDRLEN || pos + attr->nla_len > end)
+			break;
+		if (attr->nla_type == CTRL_ATTR_FAMILY_ID && attr->nla_len >= NLA_HDRLEN + sizeof(uint16_t))
+			return *(uint16_t*)(attr + 1);
+		pos += NLA_ALIGN(attr->nla_len);
+	}
+	errno = EINVAL;
+	return -1;
+}
+
+// Switches the interface to ad-hoc mode, brings it up and joins the common IBSS.
+// A radio that is not associated with anything is idle and drops all received frames.
+static void wifi_join_ibss(struct nlmsg* nlmsg, int sock, int nl80211, int dgram, struct ifreq* ifr)
+{
+	if (ioctl(dgram, SIOCGIFINDEX, ifr)) {
+		debug("wifi: SIOCGIFINDEX(%s) failed: %d\n", ifr->ifr_name, errno);
+		return;
+	}
+	uint32_t ifindex = ifr->ifr_ifindex;
+	uint32_t iftype = NL80211_IFTYPE_ADHOC;
+	netlink_init(nlmsg, nl80211, NL80211_CMD_SET_INTERFACE);
+	netlink_attr(nlmsg, NL80211_ATTR_IFINDEX, &ifindex, sizeof(ifindex));
+	netlink_attr(nlmsg, NL80211_ATTR_IFTYPE, &iftype, sizeof(iftype));
+	if (netlink_send(nlmsg, sock)) {
+		debug("wifi: failed to set ad-hoc mode on %s: %d\n", ifr->ifr_name, errno);
+		return;
+	}
+	if (ioctl(dgram, SIOCGIFFLAGS, ifr) == 0) {
+		ifr->ifr_flags |= IFF_UP;
+		if (ioctl(dgram, SIOCSIFFLAGS, ifr))
+			debug("wifi: failed to bring %s up: %d\n", ifr->ifr_name, errno);
+	}
+	uint32_t freq = WIFI_FREQ;
+	uint8_t bssid[ETH_ALEN] = {WIFI_IBSS_BSSID};
+	netlink_init(nlmsg, nl80211, NL80211_CMD_JOIN_IBSS);
+	netlink_attr(nlmsg, NL80211_ATTR_IFINDEX, &ifindex, sizeof(ifindex));
+	netlink_attr(nlmsg, NL80211_ATTR_SSID, WIFI_IBSS_SSID, strlen(WIFI_IBSS_SSID));
+	netlink_attr(nlmsg, NL80211_ATTR_WIPHY_FREQ, &freq, sizeof(freq));
+	netlink_attr(nlmsg, NL80211_ATTR_MAC, bssid, sizeof(bssid));
+	netlink_attr(nlmsg, NL80211_ATTR_FREQ_FIXED, NULL, 0);
+	if (netlink_send(nlmsg, sock))
+		debug("wifi: failed to join IBSS on %s: %d\n", ifr->ifr_name, errno);
+}
+
+static void initialize_wifi(uint64_t pid)
+{
+	if (pid >= MAX_PIDS)
+		fail("wifi: no more than %d executors", MAX_PIDS);
+	// Failures are not fatal: the kernel may lack mac80211_hwsim,
+	// then syz_80211_inject_frame just fails.
+	int sock = socket(AF_NETLINK, SOCK_RAW, NETLINK_GENERIC);
+	if (sock == -1) {
+		debug("wifi: netlink socket failed: %d\n", errno);
+		return;
+	}
+	struct nlmsg nlmsg;
+	int hwsim = netlink_query_family_id(&nlmsg, sock, "MAC80211_HWSIM");
+	int nl80211 = netlink_query_family_id(&nlmsg, sock, "nl80211");
+	if (hwsim == -1 || nl80211 == -1) {
+		debug("wifi: mac80211_hwsim/nl80211 are not available: %d\n", errno);
+		close(sock);
+		return;
+	}
+	for (int radio = 0; radio < WIFI_RADIOS; radio++) {
+		uint8_t mac[ETH_ALEN] = {WIFI_MAC_PREFIX, (uint8_t)pid, (uint8_t)radio};
+		netlink_init(&nlmsg, hwsim, HWSIM_CMD_NEW_RADIO);
+		netlink_attr(&nlmsg, HWSIM_ATTR_PERM_ADDR, mac, sizeof(mac));
+		if (netlink_send(&nlmsg, sock))
+			debug("wifi: failed to create radio %d: %d\n", radio, errno);
+	}
+	// Interfaces of the new radios get names assigned by the kernel (wlanN),
+	// so find them by address among interfaces in the current network namespace.
+	int dgram = socket(AF_INET, SOCK_DGRAM, 0);
+	FILE* f = fopen("/proc/net/dev", "r");
+	if (dgram == -1 || f == NULL) {
+		debug("wifi: failed to enumerate interfaces: %d\n", errno);
+	} else {
+		char line[256];
+		while (fgets(line, sizeof(line), f)) {
+			char name[IFNAMSIZ + 1];
+			if (sscanf(line, " %16[^: ]:", name) != 1 || strncmp(name, "wlan", 4) != 0)
+				continue;
+			struct ifreq ifr;
+			memset(&ifr, 0, sizeof(ifr));
+			strncpy(ifr.ifr_name, name, IFNAMSIZ - 1);
+			if (ioctl(dgram, SIOCGIFHWADDR, &ifr))
+				continue;
+			uint8_t prefix[] = {WIFI_MAC_PREFIX, (uint8_t)pid};
+			if (memcmp(ifr.ifr_hwaddr.sa_data, prefix, sizeof(prefix)) != 0)
+				continue;
+			wifi_join_ibss(&nlmsg, sock, nl80211, dgram, &ifr);
+		}
+	}
+	if (f)
+		fclose(f);
+	if (dgram != -1)
+		close(dgram);
+	close(sock);
+}
+
+static bool wifi_enabled;
+static uint64_t wifi_pid;
+
+static void setup_wifi()
+{
+	if (wifi_enabled)
+		initialize_wifi(wifi_pid);
+}
+
+static uintptr_t syz_80211_inject_frame(uintptr_t a0, uintptr_t a1, uintptr_t a2)
+{
+	// syz_80211_inject_frame(radio int32[0:1], frame ptr[in, ieee80211_frame], len len[frame])
+	uint64_t radio = a0;
+	char* frame = (char*)a1;
+	uint64_t len = a2;
+
+	if (radio >= WIFI_RADIOS || len > WIFI_MAX_FRAME) {
+		errno = EINVAL;
+		return -1;
+	}
+	char buf[WIFI_MAX_FRAME];
+	NONFAILING(memcpy(buf, frame, len));
+	int sock = socket(AF_NETLINK, SOCK_RAW, NETLINK_GENERIC);
+	if (sock == -1)
+		return -1;
+	struct nlmsg nlmsg;
+	int res = -1;
+	int hwsim = netlink_query_family_id(&nlmsg, sock, "MAC80211_HWSIM");
+	if (hwsim != -1) {
+		// hwsim accepts frames only from the registered wireless medium,
+		// the registration is dropped when the socket is closed.
+		netlink_init(&nlmsg, hwsim, HWSIM_CMD_REGISTER);
+		res = netlink_send(&nlmsg, sock);
+	}
+	if (res == 0) {
+		uint8_t mac[ETH_ALEN] = {WIFI_MAC_PREFIX, (uint8_t)wifi_pid, (uint8_t)radio};
+		uint32_t rate = 1;
+		uint32_t signal = -50;
+		uint32_t freq = WIFI_FREQ;
+		netlink_init(&nlmsg, hwsim, HWSIM_CMD_FRAME);
+		netlink_attr(&nlmsg, HWSIM_ATTR_ADDR_RECEIVER, mac, sizeof(mac));
+		netlink_attr(&nlmsg, HWSIM_ATTR_FRAME, buf, len);
+		netlink_attr(&nlmsg, HWSIM_ATTR_RX_RATE, &rate, sizeof(rate));
+		netlink_attr(&nlmsg, HWSIM_ATTR_SIGNAL, &signal, sizeof(signal));
+		netlink_attr(&nlmsg, HWSIM_ATTR_FREQ, &freq, sizeof(freq));
+		res = netlink_send(&nlmsg, sock);
+	}
+	int err = errno;
+	close(sock);
+	errno = err;
+	return res;
+}
+#endif // __NR_syz_80211_inject_frame
+
+#if defined(SYZ_EXECUTOR) || defined(SYZ_USE_GLOB)
+#include "common_glob.h"
+#endif
+
 #ifdef __NR_syz_open_dev
 static uintptr_t syz_open_dev(uintptr_t a0, uintptr_t a1, uintptr_t a2)
 {
@@ -368,47 +679,588 @@ static uintptr_t syz_fuseblk_mount(uintptr_t a0, uintptr_t a1, uintptr_t a2, uin
 }
 #endif
 
+#ifdef __NR_syz_mount_image
+#include <linux/loop.h>
+
+struct fs_image_segment {
+	void* data;
+	uintptr_t size;
+	uintptr_t offset;
+};
+
+#define IMAGE_MAX_SEGMENTS 4096
+#define IMAGE_MAX_SIZE (129 << 20)
+
+static uintptr_t syz_mount_image(uintptr_t a0, uintptr_t a1, uintptr_t a2, uintptr_t a3, uintptr_t a4, uintptr_t a5, uintptr_t a6)
+{
+	// syz_mount_image(fs ptr[in, string[disk_filesystems]], dir filename, size intptr, nsegs len[segments], segments ptr[in, array[fs_image_segment]], flags flags[mount_flags], opts ptr[in, fsopts[mount_options]])
+	char* fs = (char*)a0;
+	char* dir = (char*)a1;
+	uintptr_t size = a2;
+	uintptr_t nsegs = a3;
+	struct fs_image_segment* segs = (struct fs_image_segment*)a4;
+	uintptr_t flags = a5;
+	char* opts = (char*)a6;
+
+	if (nsegs > IMAGE_MAX_SEGMENTS)
+		nsegs = IMAGE_MAX_SEGMENTS;
+	if (size > IMAGE_MAX_SIZE)
+		size = IMAGE_MAX_SIZE;
+	// Materialize the image in a sparse file in the current (per-test) dir.
+	int imgfd = open("./syz-image", O_RDWR | O_CREAT | O_TRUNC, 0600);
+	if (imgfd == -1)
+		return -1;
+	uintptr_t res = -1;
+	int loopfd = -1;
+	int err = 0;
+	char loopname[64];
+	if (ftruncate(imgfd, size))
+		goto error;
+	for (uintptr_t i = 0; i < nsegs; i++) {
+		void* data = 0;
+		uintptr_t data_size = 0, offset = 0;
+		NONFAILING(data = segs[i].data);
+		NONFAILING(data_size = segs[i].size);
+		NONFAILING(offset = segs[i].offset);
+		if (offset >= size)
+			continue;
+		if (data_size > size - offset)
+			data_size = size - offset;
+		// pwrite reads from program memory itself, so bad pointers result in EFAULT.
+		pwrite(imgfd, data, data_size, offset);
+	}
+	// Other processes can race for the same free loop device, so retry few times.
+	for (int i = 0; i < 10; i++) {
+		int ctlfd = open("/dev/loop-control", O_RDWR);
+		if (ctlfd == -1)
+			goto error;
+		int loopno = ioctl(ctlfd, LOOP_CTL_GET_FREE);
+		// close can clobber errno of the failed call, which is the result of the pseudo-syscall.
+		err = errno;
+		close(ctlfd);
+		errno = err;
+		if (loopno < 0)
+			goto error;
+		sprintf(loopname, "/dev/loop%d", loopno);
+		loopfd = open(loopname, O_RDWR);
+		if (loopfd == -1)
+			goto error;
+		if (ioctl(loopfd, LOOP_SET_FD, imgfd) == 0)
+			break;
+		err = errno;
+		close(loopfd);
+		errno = err;
+		loopfd = -1;
+		if (err != EBUSY)
+			goto error;
+	}
+	if (loopfd == -1)
+		goto error;
+	mkdir(dir, 0777);
+	res = mount(loopname, dir, fs, flags, opts);
+	err = errno;
+	// Detach the file from the device, the device is released on unmount.
+	ioctl(loopfd, LOOP_CLR_FD, 0);
+	errno = err;
+error:
+	err = errno;
+	if (loopfd != -1)
+		close(loopfd);
+	close(imgfd);
+	errno = err;
+	return res;
+}
+#endif
+
 #ifdef __NR_syz_kvm_setup_cpu
+#if defined(__x86_64__)
 #include "common_kvm.h"
+#else
+// Only x86 guests are set up, on other arches the call is a no-op.
+static uintptr_t syz_kvm_setup_cpu(uintptr_t a0, uintptr_t a1, uintptr_t a2, uintptr_t a3, uintptr_t a4, uintptr_t a5, uintptr_t a6, uintptr_t a7)
+{
+	return 0;
+}
+#endif
 #endif // #ifdef __NR_syz_kvm_setup_cpu
 
-static uintptr_t execute_syscall(int nr, uintptr_t a0, uintptr_t a1, uintptr_t a2, uintptr_t a3, uintptr_t a4, uintptr_t a5, uintptr_t a6, uintptr_t a7, uintptr_t a8)
+#if defined(__NR_syz_usb_connect) || defined(__NR_syz_usb_control_io)
+#include <linux/usb/ch9.h>
+
+// Definitions from linux/usb/raw_gadget.h, which is not present in older kernel headers.
+#define UDC_NAME_LENGTH_MAX 128
+
+struct usb_raw_init {
+	__u8 driver_name[UDC_NAME_LENGTH_MAX];
+	__u8 device_name[UDC_NAME_LENGTH_MAX];
+	__u8 speed;
+};
+
+enum usb_raw_event_type {
+	USB_RAW_EVENT_INVALID = 0,
+	USB_RAW_EVENT_CONNECT = 1,
+	USB_RAW_EVENT_CONTROL = 2,
+};
+
+struct usb_raw_event {
+	__u32 type;
+	__u32 length;
+	__u8 data[0];
+};
+
+struct usb_raw_ep_io {
+	__u16 ep;
+	__u16 flags;
+	__u32 length;
+	__u8 data[0];
+};
+
+#define USB_RAW_IOCTL_INIT _IOW('U', 0, struct usb_raw_init)
+#define USB_RAW_IOCTL_RUN _IO('U', 1)
+#define USB_RAW_IOCTL_EVENT_FETCH _IOR('U', 2, struct usb_raw_event)
+#define USB_RAW_IOCTL_EP0_WRITE _IOW('U', 3, struct usb_raw_ep_io)
+#define USB_RAW_IOCTL_EP0_READ _IOWR('U', 4, struct usb_raw_ep_io)
+#define USB_RAW_IOCTL_EP_ENABLE _IOW('U', 5, struct usb_endpoint_descriptor)
+#define USB_RAW_IOCTL_CONFIGURE _IO('U', 9)
+#define USB_RAW_IOCTL_VBUS_DRAW _IOW('U', 10, __u32)
+
+#define USB_MAX_DESCS_SIZE 4096
+#define USB_MAX_CONNECT_EVENTS 64
+
+struct usb_raw_control_event {
+	struct usb_raw_event inner;
+	struct usb_ctrlrequest ctrl;
+};
+
+struct usb_raw_ep0_io {
+	struct usb_raw_ep_io inner;
+	char data[USB_MAX_DESCS_SIZE];
+};
+
+// Index of the dummy_hcd UDC used by this executor (see setup_main_process).
+static uint64_t usb_procid;
+
+static int usb_raw_fetch_control(int fd, struct usb_ctrlrequest* ctrl)
 {
-	switch (nr) {
-	default:
-		return syscall(nr, a0, a1, a2, a3, a4, a5);
-#ifdef __NR_syz_test
-	case __NR_syz_test:
+	// Blocks until the host sends the next control request, connect events are skipped.
+	for (;;) {
+		struct usb_raw_control_event event;
+		memset(&event, 0, sizeof(event));
+		event.inner.length = sizeof(event.ctrl);
+		if (ioctl(fd, USB_RAW_IOCTL_EVENT_FETCH, &event))
+			return -1;
+		if (event.inner.type != USB_RAW_EVENT_CONTROL)
+			continue;
+		memcpy(ctrl, &event.ctrl, sizeof(*ctrl));
 		return 0;
+	}
+}
+
+// Answers the data stage of an IN control request with data,
+// or receives the data stage of an OUT request (which also acknowledges it).
+static int usb_raw_ep0_respond(int fd, struct usb_ctrlrequest* ctrl, const char* data, uint64_t len)
+{
+	struct usb_raw_ep0_io io;
+	memset(&io.inner, 0, sizeof(io.inner));
+	if (!(ctrl->bRequestType & USB_DIR_IN)) {
+		io.inner.length = ctrl->wLength < sizeof(io.data) ? ctrl->wLength : sizeof(io.data);
+		return ioctl(fd, USB_RAW_IOCTL_EP0_READ, &io);
+	}
+	if (len > ctrl->wLength)
+		len = ctrl->wLength;
+	if (len > sizeof(io.data))
+		len = sizeof(io.data);
+	if (len)
+		memcpy(io.data, data, len);
+	io.inner.length = len;
+	return ioctl(fd, USB_RAW_IOCTL_EP0_WRITE, &io);
+}
+
+static int usb_raw_configure(int fd, const char* config, uint64_t config_len)
+{
+	// Enable all endpoints of the configuration, descriptors of other types are skipped.
+	for (uint64_t pos = 0; pos + 2 <= config_len;) {
+		uint8_t desc_len = config[pos];
+		if (desc_len < 2 || pos + desc_len > config_len)
+			break;
+		if (config[pos + 1] == USB_DT_ENDPOINT && desc_len >= USB_DT_ENDPOINT_SIZE) {
+			struct usb_endpoint_descriptor ep;
+			memset(&ep, 0, sizeof(ep));
+			memcpy(&ep, config + pos, desc_len < sizeof(ep) ? desc_len : sizeof(ep));
+			if (ioctl(fd, USB_RAW_IOCTL_EP_ENABLE, &ep) < 0)
+				debug("syz_usb_connect: failed to enable endpoint 0x%x: %d\n", ep.bEndpointAddress, errno);
+		}
+		pos += desc_len;
+	}
+	uint32_t power = config_len > 8 ? (uint8_t)config[8] : 0;
+	ioctl(fd, USB_RAW_IOCTL_VBUS_DRAW, power);
+	return ioctl(fd, USB_RAW_IOCTL_CONFIGURE, 0);
+}
+#endif
+
+#ifdef __NR_syz_usb_connect
+static uintptr_t syz_usb_connect(uintptr_t a0, uintptr_t a1, uintptr_t a2)
+{
+	// syz_usb_connect(speed flags[usb_device_speed], dev_len len[dev], dev ptr[in, usb_device]) fd_usb
+	uint64_t speed = a0;
+	uint64_t dev_len = a1;
+	char* dev = (char*)a2;
+
+	// The program passes device descriptor followed by configuration descriptor.
+	if (dev_len < USB_DT_DEVICE_SIZE || dev_len > USB_MAX_DESCS_SIZE) {
+		errno = EINVAL;
+		return -1;
+	}
+	char descs[USB_MAX_DESCS_SIZE];
+	memset(descs, 0, sizeof(descs));
+	NONFAILING(memcpy(descs, dev, dev_len));
+	const char* config = descs + USB_DT_DEVICE_SIZE;
+	uint64_t config_len = dev_len - USB_DT_DEVICE_SIZE;
+
+	int fd = open("/dev/raw-gadget", O_RDWR);
+	if (fd == -1)
+		return -1;
+	struct usb_raw_init init;
+	memset(&init, 0, sizeof(init));
+	strcpy((char*)init.driver_name, "dummy_udc");
+	sprintf((char*)init.device_name, "dummy_udc.%llu", (unsigned long long)usb_procid);
+	init.speed = speed;
+	if (ioctl(fd, USB_RAW_IOCTL_INIT, &init) || ioctl(fd, USB_RAW_IOCTL_RUN, 0)) {
+		int err = errno;
+		close(fd);
+		errno = err;
+		return -1;
+	}
+
+	// Handle enumeration: the host reads device and configuration descriptors
+	// and then selects the configuration, which makes it probe drivers for the interfaces.
+	// Other requests (e.g. strings) are answered with empty data here,
+	// the program answers requests that drivers send later with syz_usb_control_io.
+	errno = ETIMEDOUT;
+	for (int i = 0; i < USB_MAX_CONNECT_EVENTS; i++) {
+		struct usb_ctrlrequest ctrl;
+		if (usb_raw_fetch_control(fd, &ctrl))
+			break;
+		debug("syz_usb_connect: control request 0x%x/0x%x value 0x%x len %d\n",
+		      ctrl.bRequestType, ctrl.bRequest, ctrl.wValue, ctrl.wLength);
+		const char* data = NULL;
+		uint64_t len = 0;
+		if ((ctrl.bRequestType & USB_TYPE_MASK) == USB_TYPE_STANDARD) {
+			if (ctrl.bRequest == USB_REQ_GET_DESCRIPTOR) {
+				switch (ctrl.wValue >> 8) {
+				case USB_DT_DEVICE:
+					data = descs;
+					len = USB_DT_DEVICE_SIZE;
+					break;
+				case USB_DT_CONFIG:
+					data = config;
+					len = config_len;
+					break;
+				}
+			}
+			if (ctrl.bRequest == USB_REQ_SET_CONFIGURATION) {
+				if (usb_raw_configure(fd, config, config_len) || usb_raw_ep0_respond(fd, &ctrl, NULL, 0) < 0)
+					break;
+				return fd;
+			}
+		}
+		if (usb_raw_ep0_respond(fd, &ctrl, data, len) < 0)
+			break;
+	}
+	int err = errno;
+	close(fd);
+	errno = err;
+	return -1;
+}
+#endif
+
+#ifdef __NR_syz_usb_control_io
+static uintptr_t syz_usb_control_io(uintptr_t a0, uintptr_t a1, uintptr_t a2)
+{
+	// syz_usb_control_io(fd fd_usb, resp_len len[resp], resp ptr[in, usb_control_response])
+	int fd = a0;
+	uint64_t resp_len = a1;
+	char* resp = (char*)a2;
+
+	// Wait for the next control request from the host and answer it with resp.
+	struct usb_ctrlrequest ctrl;
+	if (usb_raw_fetch_control(fd, &ctrl))
+		return -1;
+	debug("syz_usb_control_io: control request 0x%x/0x%x value 0x%x len %d\n",
+	      ctrl.bRequestType, ctrl.bRequest, ctrl.wValue, ctrl.wLength);
+	char data[USB_MAX_DESCS_SIZE];
+	if (resp_len > sizeof(data))
+		resp_len = sizeof(data);
+	NONFAILING(memcpy(data, resp, resp_len));
+	return usb_raw_ep0_respond(fd, &ctrl, data, resp_len);
+}
+#endif
+
+#ifdef __NR_syz_test
+static uintptr_t syz_test()
+{
+	return 0;
+}
+#endif
+
+// Pseudo-syscalls are calls of descriptions named syz_* that are implemented here in C,
+// so that complex multi-step interactions with the kernel can be described as a single call.
+// sysgen assigns them numbers starting from SYZ_PSEUDO_SYSCALL_BASE (__NR_syz_* macros).
+// A new pseudo-syscall needs a description, an implementation that takes up to 9 uintptr_t
+// arguments and an entry in pseudo_syscalls. Pseudo-syscalls without an implementation
+// fail with ENOSYS like syscalls that are missing in the kernel.
+#define SYZ_PSEUDO_SYSCALL_BASE 1000000
+
+typedef uintptr_t (*pseudo_syscall_t)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+
+struct pseudo_syscall_entry_t {
+	int nr;
+	pseudo_syscall_t fn;
+};
+
+static const struct pseudo_syscall_entry_t pseudo_syscalls[] = {
+#ifdef __NR_syz_test
+    {__NR_syz_test, (pseudo_syscall_t)syz_test},
 #endif
 #ifdef __NR_syz_open_dev
-	case __NR_syz_open_dev:
-		return syz_open_dev(a0, a1, a2);
+    {__NR_syz_open_dev, (pseudo_syscall_t)syz_open_dev},
 #endif
 #ifdef __NR_syz_open_pts
-	case __NR_syz_open_pts:
-		return syz_open_pts(a0, a1);
+    {__NR_syz_open_pts, (pseudo_syscall_t)syz_open_pts},
 #endif
 #ifdef __NR_syz_fuse_mount
-	case __NR_syz_fuse_mount:
-		return syz_fuse_mount(a0, a1, a2, a3, a4, a5);
+    {__NR_syz_fuse_mount, (pseudo_syscall_t)syz_fuse_mount},
 #endif
 #ifdef __NR_syz_fuseblk_mount
-	case __NR_syz_fuseblk_mount:
-		return syz_fuseblk_mount(a0, a1, a2, a3, a4, a5, a6, a7);
+    {__NR_syz_fuseblk_mount, (pseudo_syscall_t)syz_fuseblk_mount},
 #endif
 #ifdef __NR_syz_emit_ethernet
-	case __NR_syz_emit_ethernet:
-		return syz_emit_ethernet(a0, a1);
+    {__NR_syz_emit_ethernet, (pseudo_syscall_t)syz_emit_ethernet},
 #endif
 #ifdef __NR_syz_kvm_setup_cpu
-	case __NR_syz_kvm_setup_cpu:
-		return syz_kvm_setup_cpu(a0, a1, a2, a3, a4, a5, a6, a7);
+    {__NR_syz_kvm_setup_cpu, (pseudo_syscall_t)syz_kvm_setup_cpu},
+#endif
+#ifdef __NR_syz_mount_image
+    {__NR_syz_mount_image, (pseudo_syscall_t)syz_mount_image},
+#endif
+#ifdef __NR_syz_usb_connect
+    {__NR_syz_usb_connect, (pseudo_syscall_t)syz_usb_connect},
 #endif
+#ifdef __NR_syz_usb_control_io
+    {__NR_syz_usb_control_io, (pseudo_syscall_t)syz_usb_control_io},
+#endif
+#ifdef __NR_syz_80211_inject_frame
+    {__NR_syz_80211_inject_frame, (pseudo_syscall_t)syz_80211_inject_frame},
+#endif
+    {0, 0},
+};
+
+static uintptr_t execute_syscall(int nr, uintptr_t a0, uintptr_t a1, uintptr_t a2, uintptr_t a3, uintptr_t a4, uintptr_t a5, uintptr_t a6, uintptr_t a7, uintptr_t a8)
+{
+	if (nr > SYZ_PSEUDO_SYSCALL_BASE) {
+		for (int i = 0; pseudo_syscalls[i].fn; i++) {
+			if (pseudo_syscalls[i].nr == nr)
+				return pseudo_syscalls[i].fn(a0, a1, a2, a3, a4, a5, a6, a7, a8);
+		}
+		errno = ENOSYS;
+		return -1;
+	}
+#if defined(__i386__)
+	// Descriptions use the 64-bit mmap signature, on i386 it is mmap2 (old mmap takes a struct).
+	if (nr == __NR_mmap)
+		nr = __NR_mmap2;
+#endif
+	return syscall(nr, a0, a1, a2, a3, a4, a5);
+}
+
+#if defined(SYZ_EXECUTOR) || defined(SYZ_SANDBOX_NAMESPACE) || defined(SYZ_SANDBOX_ANDROID_UNTRUSTED_APP) || defined(SYZ_FAULT_INJECTION) || defined(SYZ_ENABLE_CGROUPS)
+static bool write_file(const char* file, const char* what, ...)
+{
+	char buf[1024];
+	va_list args;
+	va_start(args, what);
+	vsnprintf(buf, sizeof(buf), what, args);
+	va_end(args);
+	buf[sizeof(buf) - 1] = 0;
+	int len = strlen(buf);
+
+	int fd = open(file, O_WRONLY | O_CLOEXEC);
+	if (fd == -1)
+		return false;
+	if (write(fd, buf, len) != len) {
+		close(fd);
+		return false;
+	}
+	close(fd);
+	return true;
+}
+#endif
+
+#if defined(SYZ_EXECUTOR) || defined(SYZ_ENABLE_CGROUPS)
+// Each process gets own cgroups in the cgroup v2 hierarchy and in two cgroup v1 hierarchies
+// (for controllers that are not available in v2). Test processes access them via links
+// in the test dir (see sys/cgroup.txt). The hierarchies are shared by all processes.
+#define SYZ_CGROUP_ROOT "/syzcgroup"
+
+struct cgroup_hierarchy {
+	const char* name; // mount point under SYZ_CGROUP_ROOT
+	const char* controllers; // cgroup v1 controllers, NULL for cgroup v2
+	const char* link; // link to the process cgroup in the test dir
+};
+
+static struct cgroup_hierarchy cgroup_hierarchies[] = {
+    {"unified", NULL, "./cgroup"},
+    {"cpu", "cpuset,cpuacct,perf_event,hugetlb", "./cgroup.cpu"},
+    {"net", "net_cls,net_prio,devices,freezer", "./cgroup.net"},
+};
+
+#define SYZ_CGROUP_HIERARCHIES (sizeof(cgroup_hierarchies) / sizeof(cgroup_hierarchies[0]))
+
+// Knobs of process cgroups that a test can change in a way that breaks subsequent tests
+// (e.g. freeze or OOM-kill the loop process), they are restored after each test.
+// NULL value means that the value is copied from the root of the hierarchy.
+static struct {
+	int hierarchy;
+	const char* file;
+	const char* value;
+} cgroup_knobs[] = {
+    {0, "memory.max", "max"},
+    {0, "memory.high", "max"},
+    {0, "pids.max", "max"},
+    {0, "cpu.max", "max"},
+    {1, "cpuset.cpus", NULL},
+    {1, "cpuset.mems", NULL},
+    {2, "freezer.state", "THAWED"},
+};
+
+static bool cgroups_enabled;
+static uint64_t cgroups_pid;
+
+static void cgroup_path(char* buf, int size, int hierarchy, const char* file)
+{
+	snprintf(buf, size, SYZ_CGROUP_ROOT "/%s/syz%llu%s%s", cgroup_hierarchies[hierarchy].name,
+		 (unsigned long long)cgroups_pid, file ? "/" : "", file ? file : "");
+}
+
+static void setup_cgroups()
+{
+	if (mkdir(SYZ_CGROUP_ROOT, 0777) && errno != EEXIST) {
+		debug("mkdir(%s) failed: %d\n", SYZ_CGROUP_ROOT, errno);
+		return;
+	}
+	char path[128];
+	for (unsigned i = 0; i < SYZ_CGROUP_HIERARCHIES; i++) {
+		struct cgroup_hierarchy* h = &cgroup_hierarchies[i];
+		snprintf(path, sizeof(path), SYZ_CGROUP_ROOT "/%s", h->name);
+		if (mkdir(path, 0777) && errno != EEXIST) {
+			debug("mkdir(%s) failed: %d\n", path, errno);
+			continue;
+		}
+		// Other processes may have already mounted the hierarchy.
+		struct statfs fs;
+		if (statfs(path, &fs) || (fs.f_type != CGROUP_SUPER_MAGIC && fs.f_type != CGROUP2_SUPER_MAGIC)) {
+			int res = h->controllers ? mount("none", path, "cgroup", 0, h->controllers) : mount("none", path, "cgroup2", 0, NULL);
+			if (res)
+				debug("mount(%s) failed: %d\n", path, errno);
+		}
+		chmod(path, 0777);
+	}
+	// Controllers are enabled one-by-one because some of them may be not available.
+	const char* controllers[] = {"+cpu", "+memory", "+io", "+pids", "+rdma"};
+	for (unsigned i = 0; i < sizeof(controllers) / sizeof(controllers[0]); i++)
+		write_file(SYZ_CGROUP_ROOT "/unified/cgroup.subtree_control", controllers[i]);
+	// Child cgroups need cpuset.cpus/mems to be set to be usable.
+	write_file(SYZ_CGROUP_ROOT "/cpu/cgroup.clone_children", "1");
+
+	for (unsigned i = 0; i < SYZ_CGROUP_HIERARCHIES; i++) {
+		cgroup_path(path, sizeof(path), i, NULL);
+		if (mkdir(path, 0777) && errno != EEXIST) {
+			debug("mkdir(%s) failed: %d\n", path, errno);
+			continue;
+		}
+		// The cgroups must be usable from within the setuid sandbox as well.
+		chmod(path, 0777);
+		DIR* dp = opendir(path);
+		if (dp) {
+			struct dirent* ep;
+			while ((ep = readdir(dp))) {
+				if (ep->d_type != DT_REG)
+					continue;
+				char file[512];
+				snprintf(file, sizeof(file), "%s/%s", path, ep->d_name);
+				chmod(file, 0666);
+			}
+			closedir(dp);
+		}
+		cgroup_path(path, sizeof(path), i, "cgroup.procs");
+		if (!write_file(path, "%d", getpid()))
+			debug("write(%s) failed: %d\n", path, errno);
 	}
 }
 
-static void setup_main_process(uint64_t pid, bool enable_tun)
+static void setup_cgroups_test()
+{
+	if (!cgroups_enabled)
+		return;
+	for (unsigned i = 0; i < SYZ_CGROUP_HIERARCHIES; i++) {
+		char path[128];
+		cgroup_path(path, sizeof(path), i, NULL);
+		if (symlink(path, cgroup_hierarchies[i].link))
+			debug("symlink(%s) failed: %d\n", cgroup_hierarchies[i].link, errno);
+	}
+}
+
+static void remove_cgroup_children(const char* dir)
+{
+	DIR* dp = opendir(dir);
+	if (!dp)
+		return;
+	struct dirent* ep;
+	while ((ep = readdir(dp))) {
+		if (ep->d_type != DT_DIR || strcmp(ep->d_name, ".") == 0 || strcmp(ep->d_name, "..") == 0)
+			continue;
+		char path[512];
+		snprintf(path, sizeof(path), "%s/%s", dir, ep->d_name);
+		remove_cgroup_children(path);
+		// Killed test processes may need some time to leave the cgroup.
+		for (int i = 0; rmdir(path) && i < 100; i++)
+			usleep(1000);
+	}
+	closedir(dp);
+}
+
+static void reset_cgroups()
+{
+	if (!cgroups_enabled)
+		return;
+	char path[256];
+	for (unsigned i = 0; i < SYZ_CGROUP_HIERARCHIES; i++) {
+		cgroup_path(path, sizeof(path), i, NULL);
+		remove_cgroup_children(path);
+	}
+	for (unsigned i = 0; i < sizeof(cgroup_knobs) / sizeof(cgroup_knobs[0]); i++) {
+		char value[1024];
+		const char* v = cgroup_knobs[i].value;
+		if (!v) {
+			snprintf(path, sizeof(path), SYZ_CGROUP_ROOT "/%s/%s",
+				 cgroup_hierarchies[cgroup_knobs[i].hierarchy].name, cgroup_knobs[i].file);
+			int fd = open(path, O_RDONLY);
+			if (fd == -1)
+				continue;
+			int n = read(fd, value, sizeof(value) - 1);
+			close(fd);
+			if (n <= 0)
+				continue;
+			value[n] = 0;
+			v = value;
+		}
+		cgroup_path(path, sizeof(path), cgroup_knobs[i].hierarchy, cgroup_knobs[i].file);
+		write_file(path, "%s", v);
+	}
+}
+#endif
+
+static void setup_main_process(uint64_t pid, bool enable_tun, bool enable_wifi, bool enable_cgroups)
 {
 	// Don't need that SIGCANCEL/SIGSETXID glibc stuff.
 	// SIGCANCEL sent to main thread causes it to exit
@@ -421,8 +1273,26 @@ static void setup_main_process(uint64_t pid, bool enable_tun)
 	install_segv_handler();
 
 #ifdef __NR_syz_emit_ethernet
-	if (enable_tun)
-		initialize_tun(pid);
+	// The device is created later in the sandboxed process (see setup_tun),
+	// so that it ends up in the network namespace of test processes.
+	tun_enabled = enable_tun;
+	tun_pid = pid;
+#endif
+#ifdef __NR_syz_80211_inject_frame
+	// Radios are created in the sandboxed process as well (see setup_wifi).
+	wifi_enabled = enable_wifi;
+	wifi_pid = pid;
+#endif
+#ifdef __NR_syz_usb_connect
+	// Each executor uses own UDC, dummy_hcd needs to be loaded with num >= number of procs.
+	usb_procid = pid;
+#endif
+#if defined(SYZ_EXECUTOR) || defined(SYZ_ENABLE_CGROUPS)
+	// Cgroups are set up before sandboxing, so that all descendants inherit them.
+	cgroups_enabled = enable_cgroups;
+	cgroups_pid = pid;
+	if (cgroups_enabled)
+		setup_cgroups();
 #endif
 
 	char tmpdir_template[] = "./syzkaller.XXXXXX";
@@ -442,6 +1312,9 @@ static void sandbox_common()
 	prctl(PR_SET_PDEATHSIG, SIGKILL, 0, 0, 0);
 	setpgrp();
 	setsid();
+	// Test processes that escape the process group of the test are reparented to us
+	// when their parent dies, so that kill_and_wait can find them.
+	prctl(PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0);
 
 	struct rlimit rlim;
 	rlim.rlim_cur = rlim.rlim_max = 128 << 20;
@@ -466,6 +1339,12 @@ static int do_sandbox_none()
 	if (pid)
 		return pid;
 	sandbox_common();
+#ifdef __NR_syz_emit_ethernet
+	setup_tun();
+#endif
+#ifdef __NR_syz_80211_inject_frame
+	setup_wifi();
+#endif
 	loop();
 	doexit(1);
 }
@@ -479,6 +1358,17 @@ static int do_sandbox_setuid()
 		return pid;
 
 	sandbox_common();
+#ifdef __NR_syz_emit_ethernet
+	setup_tun();
+#endif
+#ifdef __NR_syz_80211_inject_frame
+	setup_wifi();
+#endif
+
+	// All test processes run as the same user, so limit resources each of them can hold.
+	struct rlimit rlim;
+	rlim.rlim_cur = rlim.rlim_max = 256;
+	setrlimit(RLIMIT_NOFILE, &rlim);
 
 	const int nobody = 65534;
 	if (setgroups(0, NULL))
@@ -493,31 +1383,169 @@ static int do_sandbox_setuid()
 }
 #endif
 
-#if defined(SYZ_EXECUTOR) || defined(SYZ_SANDBOX_NAMESPACE)
-static int real_uid;
-static int real_gid;
-__attribute__((aligned(64 << 10))) static char sandbox_stack[1 << 20];
+#if defined(SYZ_EXECUTOR) || defined(SYZ_SANDBOX_ANDROID_UNTRUSTED_APP)
+#include <linux/audit.h>
+#include <linux/filter.h>
+#include <linux/seccomp.h>
+#include <sys/xattr.h>
+
+// The sandbox emulates an app installed by user: uid, groups, SELinux domain
+// and seccomp filter of the untrusted_app context.
+// The uid must match ipc.untrustedAppUid.
+#define UNTRUSTED_APP_UID 10999
+#define AID_NET_BT_ADMIN 3001
+#define AID_NET_BT 3002
+#define AID_INET 3003
+#define AID_EVERYBODY 9997
+#define UNTRUSTED_APP_CONTEXT "u:r:untrusted_app:s0:c512,c768"
+#define UNTRUSTED_APP_DATA_CONTEXT "u:object_r:app_data_file:s0:c512,c768"
+
+// Audit arch of seccomp filters (also used by the seccomp allowlist of executor).
+#if defined(__x86_64__)
+#define SYZ_AUDIT_ARCH AUDIT_ARCH_X86_64
+#elif defined(__aarch64__)
+#define SYZ_AUDIT_ARCH AUDIT_ARCH_AARCH64
+#elif defined(__powerpc64__)
+#define SYZ_AUDIT_ARCH AUDIT_ARCH_PPC64LE
+#elif defined(__riscv)
+#define SYZ_AUDIT_ARCH AUDIT_ARCH_RISCV64
+#elif defined(__i386__)
+#define SYZ_AUDIT_ARCH AUDIT_ARCH_I386
+#endif
 
-static bool write_file(const char* file, const char* what, ...)
+// Blocklist of bionic's seccomp filter for apps: calls that change ids, time and machine configuration.
+// Most of them require privileges anyway, but e.g. setresuid to own uid is denied too.
+// Test processes can't mount, so remove_dir does not need umount2.
+static const int untrusted_app_denied_syscalls[] = {
+    SYS_setuid,
+    SYS_setgid,
+    SYS_setreuid,
+    SYS_setregid,
+    SYS_setresuid,
+    SYS_setresgid,
+    SYS_setfsuid,
+    SYS_setfsgid,
+    SYS_setgroups,
+    SYS_adjtimex,
+    SYS_clock_adjtime,
+    SYS_clock_settime,
+    SYS_settimeofday,
+    SYS_acct,
+    SYS_syslog,
+    SYS_capset,
+    SYS_chroot,
+    SYS_init_module,
+    SYS_delete_module,
+    SYS_mount,
+    SYS_umount2,
+    SYS_swapon,
+    SYS_swapoff,
+    SYS_setdomainname,
+    SYS_sethostname,
+    SYS_reboot,
+};
+
+#define UNTRUSTED_APP_DENIED (sizeof(untrusted_app_denied_syscalls) / sizeof(untrusted_app_denied_syscalls[0]))
+
+static void setup_untrusted_app_seccomp()
 {
-	char buf[1024];
-	va_list args;
-	va_start(args, what);
-	vsnprintf(buf, sizeof(buf), what, args);
-	va_end(args);
-	buf[sizeof(buf) - 1] = 0;
-	int len = strlen(buf);
+	// Android kills apps with SIGSYS, but tests are more useful if they continue after a denied call.
+	struct sock_filter filter[UNTRUSTED_APP_DENIED + 6];
+	unsigned n = 0;
+	filter[n++] = (struct sock_filter)BPF_STMT(BPF_LD | BPF_W | BPF_ABS, offsetof(struct seccomp_data, arch));
+	// Calls of other arches (e.g. 32-bit compat) are denied altogether.
+	filter[n++] = (struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K, SYZ_AUDIT_ARCH, 1, 0);
+	filter[n++] = (struct sock_filter)BPF_STMT(BPF_RET | BPF_K, SECCOMP_RET_ERRNO | EPERM);
+	filter[n++] = (struct sock_filter)BPF_STMT(BPF_LD | BPF_W | BPF_ABS, offsetof(struct seccomp_data, nr));
+	unsigned i;
+	for (i = 0; i < UNTRUSTED_APP_DENIED; i++)
+		filter[n++] = (struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K, (uint32_t)untrusted_app_denied_syscalls[i], (uint8_t)(UNTRUSTED_APP_DENIED - i), 0);
+	filter[n++] = (struct sock_filter)BPF_STMT(BPF_RET | BPF_K, SECCOMP_RET_ALLOW);
+	filter[n++] = (struct sock_filter)BPF_STMT(BPF_RET | BPF_K, SECCOMP_RET_ERRNO | EPERM);
+	struct sock_fprog prog = {(unsigned short)n, filter};
+	if (prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0))
+		fail("prctl(PR_SET_NO_NEW_PRIVS) failed");
+	if (syscall(SYS_seccomp, SECCOMP_SET_MODE_FILTER, 0, &prog))
+		fail("seccomp failed");
+}
 
-	int fd = open(file, O_WRONLY | O_CLOEXEC);
-	if (fd == -1)
-		return false;
-	if (write(fd, buf, len) != len) {
-		close(fd);
-		return false;
+static int do_sandbox_android_untrusted_app()
+{
+	int pid = fork();
+	if (pid)
+		return pid;
+
+	sandbox_common();
+#ifdef __NR_syz_emit_ethernet
+	setup_tun();
+#endif
+#ifdef __NR_syz_80211_inject_frame
+	setup_wifi();
+#endif
+
+	// Kernels for Android devices are not necessarily tested with SELinux enabled.
+	bool selinux = access("/sys/fs/selinux/enforce", F_OK) == 0;
+	if (selinux) {
+		const char* ctx = UNTRUSTED_APP_DATA_CONTEXT;
+		if (setxattr(".", "security.selinux", ctx, strlen(ctx) + 1, 0))
+			fail("failed to label the working dir");
 	}
-	close(fd);
-	return true;
+
+	struct rlimit rlim;
+	rlim.rlim_cur = rlim.rlim_max = 256;
+	setrlimit(RLIMIT_NOFILE, &rlim);
+
+	gid_t groups[] = {UNTRUSTED_APP_UID, AID_NET_BT_ADMIN, AID_NET_BT, AID_INET, AID_EVERYBODY};
+	if (setgroups(sizeof(groups) / sizeof(groups[0]), groups))
+		fail("failed to setgroups");
+	if (syscall(SYS_setresgid, UNTRUSTED_APP_UID, UNTRUSTED_APP_UID, UNTRUSTED_APP_UID))
+		fail("failed to setresgid");
+	if (syscall(SYS_setresuid, UNTRUSTED_APP_UID, UNTRUSTED_APP_UID, UNTRUSTED_APP_UID))
+		fail("failed to setresuid");
+	// Transition to the app domain after setresuid, the domain is not allowed to change uid.
+	if (selinux && !write_file("/proc/self/attr/current", UNTRUSTED_APP_CONTEXT))
+		fail("failed to transition to %s", UNTRUSTED_APP_CONTEXT);
+	setup_untrusted_app_seccomp();
+
+	loop();
+	doexit(1);
+}
+#endif
+
+#if defined(SYZ_EXECUTOR) || defined(SYZ_FAULT_INJECTION)
+static void setup_fault()
+{
+	// Fail allocations regardless of gfp flags,
+	// otherwise most allocations in syscalls are never failed.
+	if (!write_file("/sys/kernel/debug/failslab/ignore-gfp-wait", "N"))
+		fail("failed to write /sys/kernel/debug/failslab/ignore-gfp-wait");
+	write_file("/sys/kernel/debug/fail_page_alloc/ignore-gfp-wait", "N");
+	write_file("/sys/kernel/debug/fail_page_alloc/ignore-gfp-highmem", "N");
+	write_file("/sys/kernel/debug/fail_page_alloc/min-order", "0");
+	write_file("/sys/kernel/debug/fail_futex/ignore-private", "N");
+}
+
+// inject_fault arms injection of a fault into nth (0-based) fault site
+// hit by the current thread and returns fd of its fail-nth file.
+static int inject_fault(int nth)
+{
+	int fd = open("/proc/thread-self/fail-nth", O_RDWR);
+	if (fd == -1)
+		fail("failed to open /proc/thread-self/fail-nth");
+	// fail-nth is 1-based, nth is 0-based.
+	char buf[16];
+	sprintf(buf, "%d", nth + 1);
+	if (write(fd, buf, strlen(buf)) != (ssize_t)strlen(buf))
+		fail("failed to write /proc/thread-self/fail-nth");
+	debug("injecting fault #%d\n", nth);
+	return fd;
 }
+#endif
+
+#if defined(SYZ_EXECUTOR) || defined(SYZ_SANDBOX_NAMESPACE)
+static int real_uid;
+static int real_gid;
+__attribute__((aligned(64 << 10))) static char sandbox_stack[1 << 20];
 
 static int namespace_sandbox_proc(void* arg)
 {
@@ -529,6 +1557,14 @@ static int namespace_sandbox_proc(void* arg)
 		fail("write of /proc/self/uid_map failed");
 	if (!write_file("/proc/self/gid_map", "0 %d 1\n", real_gid))
 		fail("write of /proc/self/gid_map failed");
+#ifdef __NR_syz_emit_ethernet
+	// Needs to be done after uid mapping (requires root in the namespace)
+	// and before pivot_root (requires the ip utility).
+	setup_tun();
+#endif
+#ifdef __NR_syz_80211_inject_frame
+	setup_wifi();
+#endif
 
 	if (mkdir("./syz-tmp", 0777))
 		fail("mkdir(syz-tmp) failed");
@@ -540,6 +1576,22 @@ static int namespace_sandbox_proc(void* arg)
 		fail("mkdir failed");
 	if (mount("/dev", "./syz-tmp/newroot/dev", NULL, MS_BIND | MS_REC | MS_PRIVATE, NULL))
 		fail("mount(dev) failed");
+#if defined(SYZ_EXECUTOR) || defined(SYZ_ENABLE_CGROUPS)
+	// Test processes refer to their cgroups by absolute paths.
+	if (cgroups_enabled) {
+		if (mkdir("./syz-tmp/newroot" SYZ_CGROUP_ROOT, 0700))
+			fail("mkdir failed");
+		if (mount(SYZ_CGROUP_ROOT, "./syz-tmp/newroot" SYZ_CGROUP_ROOT, NULL, MS_BIND | MS_REC | MS_PRIVATE, NULL))
+			debug("mount(cgroup) failed: %d\n", errno);
+	}
+#endif
+	// Private devpts instance, so that test processes don't see and mess with ptys of the machine.
+	// Older kernels don't allow to mount devpts in a user namespace, then the machine's devpts is used.
+	if (mount("devpts", "./syz-tmp/newroot/dev/pts", "devpts", 0, "newinstance,ptmxmode=0666")) {
+		debug("mount(devpts) failed: %d\n", errno);
+	} else if (mount("./syz-tmp/newroot/dev/pts/ptmx", "./syz-tmp/newroot/dev/ptmx", NULL, MS_BIND, NULL)) {
+		debug("mount(ptmx) failed: %d\n", errno);
+	}
 	if (mkdir("./syz-tmp/pivot", 0777))
 		fail("mkdir failed");
 	if (syscall(SYS_pivot_root, "./syz-tmp", "./syz-tmp/pivot")) {
@@ -677,6 +1729,68 @@ static uint64_t current_time_ms()
 }
 #endif
 
+#if defined(SYZ_EXECUTOR) || defined(SYZ_REPEAT)
+// Kills the test process pid, its process group and leftover descendants that escaped
+// the group with setsid/setpgid, and reaps them all. status receives the exit status
+// of pid, unless the caller has already reaped it.
+static void kill_and_wait(int pid, int* status)
+{
+	kill(-pid, SIGKILL);
+	kill(pid, SIGKILL);
+	while (waitpid(pid, status, __WALL) == -1 && errno == EINTR) {
+	}
+	// Leftovers can be stuck in the kernel for some time, don't wait for them forever.
+	uint64_t start = current_time_ms();
+	for (;;) {
+		if (getpid() == 1) {
+			// We are init of the namespace sandbox, this kills all other processes in the namespace.
+			kill(-1, SIGKILL);
+		} else {
+			DIR* dp = opendir("/proc");
+			if (dp) {
+				struct dirent* ep;
+				while ((ep = readdir(dp))) {
+					char path[512];
+					snprintf(path, sizeof(path), "/proc/%s/stat", ep->d_name);
+					int fd = open(path, O_RDONLY);
+					if (fd == -1)
+						continue;
+					char buf[256];
+					int n = read(fd, buf, sizeof(buf) - 1);
+					close(fd);
+					if (n <= 0)
+						continue;
+					buf[n] = 0;
+					// The format is "pid (comm) state ppid ...", comm can contain anything.
+					char* p = strrchr(buf, ')');
+					int ppid = 0;
+					if (p && sscanf(p, ") %*c %d", &ppid) == 1 && ppid == getpid())
+						kill(atoi(ep->d_name), SIGKILL);
+				}
+				closedir(dp);
+			}
+		}
+		int st = 0;
+		int res = waitpid(-1, &st, __WALL | WNOHANG);
+		if (res > 0)
+			continue;
+		if (res == -1 || current_time_ms() - start > 1000)
+			break;
+		usleep(1000);
+	}
+}
+
+// Closes all fds the test could have created, so that sockets, devices, etc are released
+// before the next test starts. Otherwise they are released only when all threads
+// of the test process exit, and some of them can be still blocked in syscalls.
+static void close_fds()
+{
+	int fd;
+	for (fd = 3; fd < 256; fd++)
+		close(fd);
+}
+#endif
+
 #if defined(SYZ_REPEAT)
 static void test();
 
@@ -696,7 +1810,11 @@ void loop()
 			setpgrp();
 			if (chdir(cwdbuf))
 				fail("failed to chdir");
+#if defined(SYZ_ENABLE_CGROUPS)
+			setup_cgroups_test();
+#endif
 			test();
+			close_fds();
 			doexit(0);
 		}
 		int status = 0;
@@ -706,14 +1824,16 @@ void loop()
 			if (res == pid)
 				break;
 			usleep(1000);
-			if (current_time_ms() - start > 5 * 1000) {
-				kill(-pid, SIGKILL);
-				kill(pid, SIGKILL);
-				while (waitpid(-1, &status, __WALL) != pid) {
-				}
+			if (current_time_ms() - start > 5 * 1000)
 				break;
-			}
 		}
+		kill_and_wait(pid, &status);
+#if defined(SYZ_ENABLE_CGROUPS)
+		reset_cgroups();
+#endif
+#ifdef __NR_syz_emit_ethernet
+		reset_tun();
+#endif
 		remove_dir(cwdbuf);
 	}
 }
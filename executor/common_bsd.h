@@ -0,0 +1,391 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// This file is the FreeBSD, NetBSD and OpenBSD counterpart of common.h, it is used only by executor.
+// It provides the same interface, features that the BSDs lack
+// (namespaces, fault injection, cgroups, tun) are either no-ops or fail.
+
+#include <sys/mman.h>
+#include <sys/mount.h>
+#if defined(__FreeBSD__)
+#include <sys/procctl.h>
+#endif
+#include <sys/resource.h>
+#include <sys/socket.h>
+#include <sys/stat.h>
+#include <sys/syscall.h>
+#include <sys/time.h>
+#include <sys/types.h>
+#include <sys/wait.h>
+
+#include <dirent.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <pthread.h>
+#include <setjmp.h>
+#include <signal.h>
+#include <stdarg.h>
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+// BSD waitpid waits for all children by default.
+#define __WALL 0
+
+const int kFailStatus = 67;
+const int kErrorStatus = 68;
+const int kRetryStatus = 69;
+
+// See the comment in common.h for why this is not just _exit.
+__attribute__((noreturn)) void doexit(int status)
+{
+	volatile unsigned i;
+	syscall(SYS_exit, status);
+	for (i = 0;; i++) {
+	}
+}
+
+// exit/_exit do not necessary work.
+#define exit use_doexit_instead
+#define _exit use_doexit_instead
+
+// logical error (e.g. invalid input program), use as an assert() alernative
+__attribute__((noreturn)) void fail(const char* msg, ...)
+{
+	int e = errno;
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, " (errno %d)\n", e);
+	doexit(e == ENOMEM ? kRetryStatus : kFailStatus);
+}
+
+// kernel error (e.g. wrong syscall return value)
+__attribute__((noreturn)) void error(const char* msg, ...)
+{
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, "\n");
+	doexit(kErrorStatus);
+}
+
+// just exit (e.g. due to temporal ENOMEM error)
+__attribute__((noreturn)) void exitf(const char* msg, ...)
+{
+	int e = errno;
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, " (errno %d)\n", e);
+	doexit(kRetryStatus);
+}
+
+static int flag_debug;
+
+void debug(const char* msg, ...)
+{
+	if (!flag_debug)
+		return;
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stdout, msg, args);
+	va_end(args);
+	fflush(stdout);
+}
+
+__thread int skip_segv;
+__thread jmp_buf segv_env;
+
+static void segv_handler(int sig, siginfo_t* info, void* uctx)
+{
+	if (__atomic_load_n(&skip_segv, __ATOMIC_RELAXED))
+		_longjmp(segv_env, 1);
+	doexit(sig);
+	for (;;) {
+	}
+}
+
+static void install_segv_handler()
+{
+	struct sigaction sa;
+	memset(&sa, 0, sizeof(sa));
+	sa.sa_sigaction = segv_handler;
+	sa.sa_flags = SA_NODEFER | SA_SIGINFO;
+	sigaction(SIGSEGV, &sa, NULL);
+	sigaction(SIGBUS, &sa, NULL);
+}
+
+#define NONFAILING(...)                                              \
+	{                                                            \
+		__atomic_fetch_add(&skip_segv, 1, __ATOMIC_SEQ_CST); \
+		if (_setjmp(segv_env) == 0) {                        \
+			__VA_ARGS__;                                 \
+		}                                                    \
+		__atomic_fetch_sub(&skip_segv, 1, __ATOMIC_SEQ_CST); \
+	}
+
+#include "common_glob.h"
+
+// There are no pseudo-syscalls on the BSDs yet.
+// __syscall is used because syscall returns int, which truncates e.g. mmap results.
+// NetBSD and OpenBSD syscalls with off_t arguments (e.g. mmap) take a padding argument, so they have up to 7 args.
+static uintptr_t execute_syscall(int nr, uintptr_t a0, uintptr_t a1, uintptr_t a2, uintptr_t a3, uintptr_t a4, uintptr_t a5, uintptr_t a6, uintptr_t a7, uintptr_t a8)
+{
+	return __syscall(nr, a0, a1, a2, a3, a4, a5, a6);
+}
+
+static bool write_file(const char* file, const char* what, ...)
+{
+	char buf[1024];
+	va_list args;
+	va_start(args, what);
+	vsnprintf(buf, sizeof(buf), what, args);
+	va_end(args);
+	buf[sizeof(buf) - 1] = 0;
+	int len = strlen(buf);
+
+	int fd = open(file, O_WRONLY | O_CLOEXEC);
+	if (fd == -1)
+		return false;
+	if (write(fd, buf, len) != len) {
+		close(fd);
+		return false;
+	}
+	close(fd);
+	return true;
+}
+
+static void setup_main_process(uint64_t pid, bool enable_tun, bool enable_wifi, bool enable_cgroups)
+{
+	if (enable_tun || enable_wifi || enable_cgroups)
+		fail("tun, wifi and cgroups are not supported on BSD");
+	install_segv_handler();
+
+	char tmpdir_template[] = "./syzkaller.XXXXXX";
+	char* tmpdir = mkdtemp(tmpdir_template);
+	if (!tmpdir)
+		fail("failed to mkdtemp");
+	if (chmod(tmpdir, 0777))
+		fail("failed to chmod");
+	if (chdir(tmpdir))
+		fail("failed to chdir");
+}
+
+static void setup_cgroups_test()
+{
+}
+
+static void reset_cgroups()
+{
+}
+
+static void reset_tun()
+{
+}
+
+static void loop();
+
+static void sandbox_common()
+{
+	setpgid(0, 0);
+	setsid();
+#if defined(__FreeBSD__)
+	// Become a reaper as on Linux (see sandbox_common in common.h).
+	// NetBSD and OpenBSD have no reapers, escaped processes are left to init.
+	procctl(P_PID, getpid(), PROC_REAP_ACQUIRE, NULL);
+#endif
+
+	struct rlimit rlim;
+	rlim.rlim_cur = rlim.rlim_max = 128 << 20;
+#if defined(__OpenBSD__)
+	// OpenBSD has no RLIMIT_AS, RLIMIT_DATA limits anonymous mappings.
+	setrlimit(RLIMIT_DATA, &rlim);
+#else
+	setrlimit(RLIMIT_AS, &rlim);
+#endif
+	rlim.rlim_cur = rlim.rlim_max = 1 << 20;
+	setrlimit(RLIMIT_FSIZE, &rlim);
+	rlim.rlim_cur = rlim.rlim_max = 1 << 20;
+	setrlimit(RLIMIT_STACK, &rlim);
+	rlim.rlim_cur = rlim.rlim_max = 0;
+	setrlimit(RLIMIT_CORE, &rlim);
+}
+
+static int do_sandbox_none()
+{
+	int pid = fork();
+	if (pid)
+		return pid;
+	sandbox_common();
+	loop();
+	doexit(1);
+}
+
+static int do_sandbox_setuid()
+{
+	int pid = fork();
+	if (pid)
+		return pid;
+
+	sandbox_common();
+
+	// All test processes run as the same user, so limit resources each of them can hold.
+	struct rlimit rlim;
+	rlim.rlim_cur = rlim.rlim_max = 256;
+	setrlimit(RLIMIT_NOFILE, &rlim);
+
+	// NetBSD has no setresuid, setgid/setuid done by root change the real, effective and saved ids.
+	const int nobody = 65534;
+	if (setgroups(0, NULL))
+		fail("failed to setgroups");
+	if (setgid(nobody))
+		fail("failed to setgid");
+	if (setuid(nobody))
+		fail("failed to setuid");
+
+	loop();
+	doexit(1);
+}
+
+static int do_sandbox_namespace()
+{
+	fail("namespace sandbox is not supported on BSD");
+}
+
+static int do_sandbox_android_untrusted_app()
+{
+	fail("android_untrusted_app sandbox is not supported on BSD");
+}
+
+static void setup_fault()
+{
+	fail("fault injection is not supported on BSD");
+}
+
+static int inject_fault(int nth)
+{
+	fail("fault injection is not supported on BSD");
+}
+
+// See the comment in common.h, the BSDs have no lazy unmount, so mounts are unmounted forcibly.
+static void remove_dir(const char* dir)
+{
+	DIR* dp;
+	struct dirent* ep;
+	int iter = 0;
+retry:
+	dp = opendir(dir);
+	if (dp == NULL) {
+		if (errno == EMFILE)
+			exitf("opendir(%s) failed due to NOFILE, exiting", dir);
+		exitf("opendir(%s) failed", dir);
+	}
+	while ((ep = readdir(dp))) {
+		if (strcmp(ep->d_name, ".") == 0 || strcmp(ep->d_name, "..") == 0)
+			continue;
+		char filename[FILENAME_MAX];
+		snprintf(filename, sizeof(filename), "%s/%s", dir, ep->d_name);
+		struct stat st;
+		if (lstat(filename, &st))
+			exitf("lstat(%s) failed", filename);
+		if (S_ISDIR(st.st_mode)) {
+			remove_dir(filename);
+			continue;
+		}
+		int i;
+		for (i = 0;; i++) {
+			debug("unlink(%s)\n", filename);
+			if (unlink(filename) == 0)
+				break;
+			if (errno == EROFS) {
+				debug("ignoring EROFS\n");
+				break;
+			}
+			if (errno != EBUSY || i > 100)
+				exitf("unlink(%s) failed", filename);
+			debug("unmount(%s)\n", filename);
+			if (unmount(filename, MNT_FORCE))
+				exitf("unmount(%s) failed", filename);
+		}
+	}
+	closedir(dp);
+	int i;
+	for (i = 0;; i++) {
+		debug("rmdir(%s)\n", dir);
+		if (rmdir(dir) == 0)
+			break;
+		if (i < 100) {
+			if (errno == EROFS) {
+				debug("ignoring EROFS\n");
+				break;
+			}
+			if (errno == EBUSY) {
+				debug("unmount(%s)\n", dir);
+				if (unmount(dir, MNT_FORCE))
+					exitf("unmount(%s) failed", dir);
+				continue;
+			}
+			if (errno == ENOTEMPTY) {
+				if (iter < 100) {
+					iter++;
+					goto retry;
+				}
+			}
+		}
+		exitf("rmdir(%s) failed", dir);
+	}
+}
+
+static uint64_t current_time_ms()
+{
+	struct timespec ts;
+
+	if (clock_gettime(CLOCK_MONOTONIC, &ts))
+		fail("clock_gettime failed");
+	return (uint64_t)ts.tv_sec * 1000 + (uint64_t)ts.tv_nsec / 1000000;
+}
+
+// Kills the test process pid, its process group and on FreeBSD all other descendants of the reaper
+// (see sandbox_common), and reaps them all. Like on Linux, stuck leftovers are waited for at most 1s.
+static void kill_and_wait(int pid, int* status)
+{
+	kill(-pid, SIGKILL);
+	kill(pid, SIGKILL);
+	while (waitpid(pid, status, 0) == -1 && errno == EINTR) {
+	}
+	uint64_t start = current_time_ms();
+	for (;;) {
+#if defined(__FreeBSD__)
+		struct procctl_reaper_kill rk;
+		memset(&rk, 0, sizeof(rk));
+		rk.rk_sig = SIGKILL;
+		procctl(P_PID, getpid(), PROC_REAP_KILL, &rk);
+#endif
+		int st = 0;
+		int res = waitpid(-1, &st, WNOHANG);
+		if (res > 0)
+			continue;
+		if (res == -1 || current_time_ms() - start > 1000)
+			break;
+		usleep(1000);
+	}
+}
+
+// Closes all fds the test could have created, see the comment in common.h.
+static void close_fds()
+{
+	int fd;
+	for (fd = 3; fd < 256; fd++)
+		close(fd);
+}
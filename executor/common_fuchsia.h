@@ -0,0 +1,232 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// This file is the Fuchsia counterpart of common.h, it is used only by executor.
+// Fuchsia has no fork, signals and kcov, so only sandbox none is supported and programs
+// are executed by the loop process itself (see loop in executor.cc), which does not need
+// the per-test setup (cgroups, tun) of common.h.
+
+#include <zircon/process.h>
+#include <zircon/syscalls.h>
+
+#include <dirent.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <pthread.h>
+#include <setjmp.h>
+#include <stdarg.h>
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/mman.h>
+#include <sys/stat.h>
+#include <sys/types.h>
+#include <unistd.h>
+
+const int kFailStatus = 67;
+const int kErrorStatus = 68;
+const int kRetryStatus = 69;
+
+__attribute__((noreturn)) void doexit(int status)
+{
+	zx_process_exit(status);
+	for (;;) {
+	}
+}
+
+// exit/_exit do not necessary work.
+#define exit use_doexit_instead
+#define _exit use_doexit_instead
+
+// logical error (e.g. invalid input program), use as an assert() alernative
+__attribute__((noreturn)) void fail(const char* msg, ...)
+{
+	int e = errno;
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, " (errno %d)\n", e);
+	doexit(e == ENOMEM ? kRetryStatus : kFailStatus);
+}
+
+// kernel error (e.g. wrong syscall return value)
+__attribute__((noreturn)) void error(const char* msg, ...)
+{
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, "\n");
+	doexit(kErrorStatus);
+}
+
+// just exit (e.g. due to temporal ENOMEM error)
+__attribute__((noreturn)) void exitf(const char* msg, ...)
+{
+	int e = errno;
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, " (errno %d)\n", e);
+	doexit(kRetryStatus);
+}
+
+static int flag_debug;
+
+void debug(const char* msg, ...)
+{
+	if (!flag_debug)
+		return;
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stdout, msg, args);
+	va_end(args);
+	fflush(stdout);
+}
+
+// Zircon has no signals, faults go to exception ports that the executor does not handle,
+// so a fault in a NONFAILING block kills the executor and the fuzzer restarts it.
+// Copyin addresses are in the data region, so this is rare.
+#define NONFAILING(...)      \
+	{                    \
+		__VA_ARGS__; \
+	}
+
+#include "common_glob.h"
+
+// returns_status says if the call returns zx_status_t rather than a value and errno.
+// POSIX functions of libc set errno, a few Zircon calls return a value (time or a handle).
+static bool returns_status(const char* name)
+{
+	static const char* value_calls[] = {
+	    "zx_clock_get",
+	    "zx_deadline_after",
+	    "zx_ticks_get",
+	    "zx_process_self",
+	    "zx_vmar_root_self",
+	};
+	if (strncmp(name, "zx_", 3) != 0 && strncmp(name, "fdio_", 5) != 0)
+		return false;
+	for (unsigned i = 0; i < sizeof(value_calls) / sizeof(value_calls[0]); i++) {
+		if (strcmp(name, value_calls[i]) == 0)
+			return false;
+	}
+	return true;
+}
+
+// Calls are functions (Zircon calls go through the vDSO), negative zx_status_t results
+// are returned as -1 with errno set to the negated status, so that they look like errnos to the fuzzer.
+static uintptr_t execute_syscall(call_t* c, uintptr_t a0, uintptr_t a1, uintptr_t a2, uintptr_t a3, uintptr_t a4, uintptr_t a5, uintptr_t a6, uintptr_t a7, uintptr_t a8)
+{
+	if (!c->call) {
+		errno = ENOSYS;
+		return -1;
+	}
+	intptr_t res = c->call(a0, a1, a2, a3, a4, a5, a6, a7, a8);
+	if (!returns_status(c->name))
+		return res;
+	zx_status_t status = (zx_status_t)res;
+	if (status == ZX_OK)
+		return 0;
+	if (status < 0) {
+		errno = -status;
+		return -1;
+	}
+	return status;
+}
+
+static void setup_main_process(uint64_t pid, bool enable_tun, bool enable_wifi, bool enable_cgroups)
+{
+	if (enable_tun || enable_wifi || enable_cgroups)
+		fail("tun, wifi and cgroups are not supported on Fuchsia");
+
+	// The root file system is read-only, /tmp is a memory file system.
+	if (chdir("/tmp"))
+		fail("failed to chdir to /tmp");
+	char tmpdir_template[] = "./syzkaller.XXXXXX";
+	char* tmpdir = mkdtemp(tmpdir_template);
+	if (!tmpdir)
+		fail("failed to mkdtemp");
+	if (chdir(tmpdir))
+		fail("failed to chdir");
+}
+
+static void loop();
+
+// There is no fork, so the loop runs in the executor process and never returns.
+static int do_sandbox_none()
+{
+	loop();
+	doexit(1);
+}
+
+static int do_sandbox_setuid()
+{
+	fail("setuid sandbox is not supported on Fuchsia");
+}
+
+static int do_sandbox_namespace()
+{
+	fail("namespace sandbox is not supported on Fuchsia");
+}
+
+static int do_sandbox_android_untrusted_app()
+{
+	fail("android_untrusted_app sandbox is not supported on Fuchsia");
+}
+
+static void setup_fault()
+{
+	fail("fault injection is not supported on Fuchsia");
+}
+
+static int inject_fault(int nth)
+{
+	fail("fault injection is not supported on Fuchsia");
+}
+
+// See the comment in common.h, Fuchsia has no mounts in the test dir, so this only removes files.
+static void remove_dir(const char* dir)
+{
+	DIR* dp = opendir(dir);
+	if (dp == NULL)
+		exitf("opendir(%s) failed", dir);
+	struct dirent* ep;
+	while ((ep = readdir(dp))) {
+		if (strcmp(ep->d_name, ".") == 0 || strcmp(ep->d_name, "..") == 0)
+			continue;
+		char filename[FILENAME_MAX];
+		snprintf(filename, sizeof(filename), "%s/%s", dir, ep->d_name);
+		struct stat st;
+		if (lstat(filename, &st))
+			exitf("lstat(%s) failed", filename);
+		if (S_ISDIR(st.st_mode)) {
+			remove_dir(filename);
+			continue;
+		}
+		debug("unlink(%s)\n", filename);
+		if (unlink(filename))
+			exitf("unlink(%s) failed", filename);
+	}
+	closedir(dp);
+	debug("rmdir(%s)\n", dir);
+	if (rmdir(dir))
+		exitf("rmdir(%s) failed", dir);
+}
+
+static uint64_t current_time_ms()
+{
+	struct timespec ts;
+
+	if (clock_gettime(CLOCK_MONOTONIC, &ts))
+		fail("clock_gettime failed");
+	return (uint64_t)ts.tv_sec * 1000 + (uint64_t)ts.tv_nsec / 1000000;
+}
@@ -0,0 +1,31 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// This file is included by common.h, common_bsd.h and common_fuchsia.h after NONFAILING,
+// common_windows.h has its own expand_glob on top of FindFirstFile.
+
+#include <glob.h>
+
+// expand_glob replaces glob pattern in buf with one of the matching file names.
+// The last byte of buf selects the match. If nothing matches, the pattern is left as is.
+// buf is program memory and accesses to it can fault, but glob takes locks and allocates,
+// so it must not run inside NONFAILING: it works on a copy of the pattern instead.
+static void expand_glob(char* buf, uint64_t size)
+{
+	char pattern[4096];
+	if (size < 2 || size > sizeof(pattern))
+		return;
+	volatile int copied = 0;
+	NONFAILING(memcpy(pattern, buf, size); buf[size - 1] = 0; copied = 1);
+	if (!copied)
+		return;
+	unsigned idx = (unsigned char)pattern[size - 1];
+	pattern[size - 1] = 0;
+	glob_t g;
+	memset(&g, 0, sizeof(g));
+	if (glob(pattern, 0, NULL, &g) == 0 && g.gl_pathc != 0) {
+		const char* match = g.gl_pathv[idx % g.gl_pathc];
+		NONFAILING(strncpy(buf, match, size - 1));
+	}
+	globfree(&g);
+}
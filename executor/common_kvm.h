@@ -321,6 +321,8 @@ static uintptr_t syz_kvm_setup_cpu(uintptr_t a0, uintptr_t a1, uintptr_t a2, uin
 	regs.rip = guest_mem + ADDR_TEXT;
 	regs.rsp = ADDR_STACK0;
 
+	// Segment descriptor types for code and data segments with CPL 0 and 3.
+	uint64_t cstype0 = 11, cstype3 = 11, dstype0 = 3, dstype3 = 3;
 	if (opt_count > 2)
 		opt_count = 2;
 	for (i = 0; i < opt_count; i++) {
@@ -344,6 +346,18 @@ static uintptr_t syz_kvm_setup_cpu(uintptr_t a0, uintptr_t a1, uintptr_t a2, uin
 			regs.rflags ^= val & ((1 << 8) | (1 << 9) | (1 << 10) | (1 << 12) | (1 << 13) | (1 << 14) |
 					      (1 << 15) | (1 << 18) | (1 << 19) | (1 << 20) | (1 << 21));
 			break;
+		case 5:
+			cstype0 = val & 0xf;
+			break;
+		case 6:
+			cstype3 = val & 0xf;
+			break;
+		case 7:
+			dstype0 = val & 0xf;
+			break;
+		case 8:
+			dstype3 = val & 0xf;
+			break;
 		}
 	}
 	regs.rflags |= 2; // bit 1 is always set
@@ -369,7 +383,7 @@ static uintptr_t syz_kvm_setup_cpu(uintptr_t a0, uintptr_t a1, uintptr_t a2, uin
 
 	struct kvm_segment seg_cs16;
 	seg_cs16.selector = SEL_CS16;
-	seg_cs16.type = 11;
+	seg_cs16.type = cstype0;
 	seg_cs16.base = 0;
 	seg_cs16.limit = 0xfffff;
 	seg_cs16.present = 1;
@@ -382,17 +396,19 @@ static uintptr_t syz_kvm_setup_cpu(uintptr_t a0, uintptr_t a1, uintptr_t a2, uin
 
 	struct kvm_segment seg_ds16 = seg_cs16;
 	seg_ds16.selector = SEL_DS16;
-	seg_ds16.type = 3;
+	seg_ds16.type = dstype0;
 	fill_segment_descriptor(gdt, ldt, &seg_ds16);
 
 	struct kvm_segment seg_cs16_cpl3 = seg_cs16;
 	seg_cs16_cpl3.selector = SEL_CS16_CPL3;
 	seg_cs16_cpl3.dpl = 3;
+	seg_cs16_cpl3.type = cstype3;
 	fill_segment_descriptor(gdt, ldt, &seg_cs16_cpl3);
 
 	struct kvm_segment seg_ds16_cpl3 = seg_ds16;
 	seg_ds16_cpl3.selector = SEL_DS16_CPL3;
 	seg_ds16_cpl3.dpl = 3;
+	seg_ds16_cpl3.type = dstype3;
 	fill_segment_descriptor(gdt, ldt, &seg_ds16_cpl3);
 
 	struct kvm_segment seg_cs32 = seg_cs16;
@@ -408,11 +424,13 @@ static uintptr_t syz_kvm_setup_cpu(uintptr_t a0, uintptr_t a1, uintptr_t a2, uin
 	struct kvm_segment seg_cs32_cpl3 = seg_cs32;
 	seg_cs32_cpl3.selector = SEL_CS32_CPL3;
 	seg_cs32_cpl3.dpl = 3;
+	seg_cs32_cpl3.type = cstype3;
 	fill_segment_descriptor(gdt, ldt, &seg_cs32_cpl3);
 
 	struct kvm_segment seg_ds32_cpl3 = seg_ds32;
 	seg_ds32_cpl3.selector = SEL_DS32_CPL3;
 	seg_ds32_cpl3.dpl = 3;
+	seg_ds32_cpl3.type = dstype3;
 	fill_segment_descriptor(gdt, ldt, &seg_ds32_cpl3);
 
 	struct kvm_segment seg_cs64 = seg_cs16;
@@ -427,11 +445,13 @@ static uintptr_t syz_kvm_setup_cpu(uintptr_t a0, uintptr_t a1, uintptr_t a2, uin
 	struct kvm_segment seg_cs64_cpl3 = seg_cs64;
 	seg_cs64_cpl3.selector = SEL_CS64_CPL3;
 	seg_cs64_cpl3.dpl = 3;
+	seg_cs64_cpl3.type = cstype3;
 	fill_segment_descriptor(gdt, ldt, &seg_cs64_cpl3);
 
 	struct kvm_segment seg_ds64_cpl3 = seg_ds64;
 	seg_ds64_cpl3.selector = SEL_DS64_CPL3;
 	seg_ds64_cpl3.dpl = 3;
+	seg_ds64_cpl3.type = dstype3;
 	fill_segment_descriptor(gdt, ldt, &seg_ds64_cpl3);
 
 	struct kvm_segment seg_tss32;
@@ -0,0 +1,315 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// This file is the Windows counterpart of common.h, it is used only by executor.
+// Windows has no fork, signals and kcov, so, as on Fuchsia, only sandbox none is supported
+// and programs are executed by the loop process itself (see loop in executor.cc).
+// NT calls are issued directly with the syscall instruction, so call numbers depend
+// on the Windows build (see sys/windows/*.const).
+
+#include <windows.h>
+
+#include <direct.h>
+#include <dirent.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <io.h>
+#include <pthread.h>
+#include <stdarg.h>
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/stat.h>
+#include <sys/types.h>
+#include <unistd.h>
+
+// There is no mode in Windows mkdir.
+#define mkdir(path, mode) _mkdir(path)
+
+const int kFailStatus = 67;
+const int kErrorStatus = 68;
+const int kRetryStatus = 69;
+
+// ExitProcess runs DLL detach routines, which can deadlock on locks held by blocked worker threads.
+__attribute__((noreturn)) void doexit(int status)
+{
+	TerminateProcess(GetCurrentProcess(), status);
+	for (;;) {
+	}
+}
+
+// exit/_exit do not necessary work.
+#define exit use_doexit_instead
+#define _exit use_doexit_instead
+
+// logical error (e.g. invalid input program), use as an assert() alernative
+__attribute__((noreturn)) void fail(const char* msg, ...)
+{
+	int e = errno;
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, " (errno %d, error %lu)\n", e, GetLastError());
+	doexit(e == ENOMEM ? kRetryStatus : kFailStatus);
+}
+
+// kernel error (e.g. wrong syscall return value)
+__attribute__((noreturn)) void error(const char* msg, ...)
+{
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, "\n");
+	doexit(kErrorStatus);
+}
+
+// just exit (e.g. due to temporal ENOMEM error)
+__attribute__((noreturn)) void exitf(const char* msg, ...)
+{
+	int e = errno;
+	fflush(stdout);
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stderr, msg, args);
+	va_end(args);
+	fprintf(stderr, " (errno %d)\n", e);
+	doexit(kRetryStatus);
+}
+
+static int flag_debug;
+
+void debug(const char* msg, ...)
+{
+	if (!flag_debug)
+		return;
+	va_list args;
+	va_start(args, msg);
+	vfprintf(stdout, msg, args);
+	va_end(args);
+	fflush(stdout);
+}
+
+// Faults are not caught, as on Fuchsia (SEH exceptions are not handled).
+// The data region is committed at startup (see setup_main_process), so they are rare.
+#define NONFAILING(...)      \
+	{                    \
+		__VA_ARGS__; \
+	}
+
+// expand_glob is the counterpart of the glob(3)-based version in common_glob.h.
+// FindFirstFile supports wildcards only in the last path component, so does expand_glob.
+static void expand_glob(char* buf, uint64_t size)
+{
+	if (size < 2)
+		return;
+	unsigned idx = (unsigned char)buf[size - 1];
+	buf[size - 1] = 0;
+	char dir[MAX_PATH];
+	const char* slash = strrchr(buf, '\\');
+	int dirlen = slash ? slash - buf + 1 : 0;
+	if (dirlen >= (int)sizeof(dir))
+		return;
+	memcpy(dir, buf, dirlen);
+	dir[dirlen] = 0;
+	WIN32_FIND_DATAA data;
+	HANDLE h = FindFirstFileA(buf, &data);
+	if (h == INVALID_HANDLE_VALUE)
+		return;
+	unsigned n = 0;
+	do {
+		n++;
+	} while (FindNextFileA(h, &data));
+	FindClose(h);
+	h = FindFirstFileA(buf, &data);
+	if (h == INVALID_HANDLE_VALUE)
+		return;
+	for (idx %= n; idx != 0 && FindNextFileA(h, &data); idx--) {
+	}
+	FindClose(h);
+	snprintf(buf, size - 1, "%s%s", dir, data.cFileName);
+}
+
+// map_fd maps size bytes of the file opened by the fuzzer as fd.
+// Private mappings (the input) are copy-on-write, shared ones (the output) are seen by the fuzzer.
+static char* map_fd(int fd, uint64_t size, bool shared)
+{
+	HANDLE file = (HANDLE)_get_osfhandle(fd);
+	if (file == INVALID_HANDLE_VALUE)
+		fail("bad fd %d", fd);
+	HANDLE mapping = CreateFileMappingA(file, NULL, PAGE_READWRITE, size >> 32, (DWORD)size, NULL);
+	if (mapping == NULL)
+		fail("CreateFileMapping of fd %d failed", fd);
+	void* data = MapViewOfFile(mapping, shared ? FILE_MAP_WRITE : FILE_MAP_COPY, 0, 0, size);
+	if (data == NULL)
+		fail("MapViewOfFile of fd %d failed", fd);
+	// The view keeps the mapping alive.
+	CloseHandle(mapping);
+	return (char*)data;
+}
+
+// Numbers of calls that are emulated by execute_syscall, must match sys/windows/memory_amd64.const.
+const int kSysMmap = 65536;
+const int kSysMunmap = 65537;
+
+// Each stub is the same as the ntdll one: mov r10, rcx; mov eax, nr; syscall; ret.
+const int kStubSize = 16;
+static char* syscall_stubs;
+
+static void setup_syscall_stubs()
+{
+	int n = sizeof(syscalls) / sizeof(syscalls[0]);
+	syscall_stubs = (char*)VirtualAlloc(NULL, n * kStubSize, MEM_RESERVE | MEM_COMMIT, PAGE_READWRITE);
+	if (!syscall_stubs)
+		fail("failed to allocate syscall stubs");
+	for (int i = 0; i < n; i++) {
+		unsigned char* stub = (unsigned char*)syscall_stubs + i * kStubSize;
+		uint32_t nr = syscalls[i].sys_nr;
+		unsigned char code[] = {0x4c, 0x8b, 0xd1, 0xb8, (unsigned char)nr, (unsigned char)(nr >> 8),
+					(unsigned char)(nr >> 16), (unsigned char)(nr >> 24), 0x0f, 0x05, 0xc3};
+		memset(stub, 0xcc, kStubSize);
+		memcpy(stub, code, sizeof(code));
+	}
+	DWORD old;
+	if (!VirtualProtect(syscall_stubs, n * kStubSize, PAGE_EXECUTE_READ, &old))
+		fail("failed to protect syscall stubs");
+}
+
+// page_protection converts PROT_* flags of the emulated mmap to PAGE_* protection.
+static DWORD page_protection(uintptr_t prot)
+{
+	bool r = prot & 1, w = prot & 2, x = prot & 4;
+	if (x)
+		return w ? PAGE_EXECUTE_READWRITE : (r ? PAGE_EXECUTE_READ : PAGE_EXECUTE);
+	if (w)
+		return PAGE_READWRITE;
+	return r ? PAGE_READONLY : PAGE_NOACCESS;
+}
+
+// Negative NTSTATUS results are returned as -1 with errno set to the status,
+// so that they look like errnos to the fuzzer. Other statuses (e.g. STATUS_PENDING) are returned as is.
+static uintptr_t execute_syscall(call_t* c, uintptr_t a0, uintptr_t a1, uintptr_t a2, uintptr_t a3, uintptr_t a4, uintptr_t a5, uintptr_t a6, uintptr_t a7, uintptr_t a8)
+{
+	if (c->sys_nr == kSysMmap) {
+		void* addr = VirtualAlloc((void*)a0, a1, MEM_COMMIT, page_protection(a2));
+		if (!addr)
+			addr = VirtualAlloc((void*)a0, a1, MEM_RESERVE | MEM_COMMIT, page_protection(a2));
+		if (!addr) {
+			errno = GetLastError();
+			return -1;
+		}
+		return (uintptr_t)addr;
+	}
+	if (c->sys_nr == kSysMunmap) {
+		if (!VirtualFree((void*)a0, a1, MEM_DECOMMIT)) {
+			errno = GetLastError();
+			return -1;
+		}
+		return 0;
+	}
+	syscall_t stub = (syscall_t)(syscall_stubs + (c - syscalls) * kStubSize);
+	int32_t status = (int32_t)stub(a0, a1, a2, a3, a4, a5, a6, a7, a8);
+	if (status < 0) {
+		errno = status;
+		return -1;
+	}
+	return status;
+}
+
+static void setup_main_process(uint64_t pid, bool enable_tun, bool enable_wifi, bool enable_cgroups)
+{
+	if (enable_tun || enable_wifi || enable_cgroups)
+		fail("tun, wifi and cgroups are not supported on Windows");
+
+	// Programs assume that the data region is mapped, mmap calls only change protection of parts of it.
+	if (VirtualAlloc((void*)SYZ_DATA_OFFSET, SYZ_DATA_SIZE, MEM_RESERVE | MEM_COMMIT, PAGE_READWRITE) != (void*)SYZ_DATA_OFFSET)
+		fail("failed to allocate the data region");
+	setup_syscall_stubs();
+
+	char tmpdir[MAX_PATH];
+	if (!GetTempPathA(sizeof(tmpdir), tmpdir))
+		fail("GetTempPath failed");
+	if (chdir(tmpdir))
+		fail("failed to chdir to %s", tmpdir);
+	snprintf(tmpdir, sizeof(tmpdir), "syzkaller.%lu.%llu", GetCurrentProcessId(), (unsigned long long)GetTickCount64());
+	if (mkdir(tmpdir, 0777))
+		fail("failed to mkdir");
+	if (chdir(tmpdir))
+		fail("failed to chdir");
+}
+
+static void loop();
+
+static int do_sandbox_none()
+{
+	loop();
+	doexit(1);
+}
+
+static int do_sandbox_setuid()
+{
+	fail("setuid sandbox is not supported on Windows");
+}
+
+static int do_sandbox_namespace()
+{
+	fail("namespace sandbox is not supported on Windows");
+}
+
+static int do_sandbox_android_untrusted_app()
+{
+	fail("android_untrusted_app sandbox is not supported on Windows");
+}
+
+static void setup_fault()
+{
+	fail("fault injection is not supported on Windows");
+}
+
+static int inject_fault(int nth)
+{
+	fail("fault injection is not supported on Windows");
+}
+
+// See the comment in common.h, there are no mounts in the test dir, so this only removes files.
+// Files that are still open by leaked handles can't be removed, in such case the executor exits.
+static void remove_dir(const char* dir)
+{
+	DIR* dp = opendir(dir);
+	if (dp == NULL)
+		exitf("opendir(%s) failed", dir);
+	struct dirent* ep;
+	while ((ep = readdir(dp))) {
+		if (strcmp(ep->d_name, ".") == 0 || strcmp(ep->d_name, "..") == 0)
+			continue;
+		char filename[FILENAME_MAX];
+		snprintf(filename, sizeof(filename), "%s\\%s", dir, ep->d_name);
+		struct stat st;
+		if (stat(filename, &st))
+			exitf("stat(%s) failed", filename);
+		if (S_ISDIR(st.st_mode)) {
+			remove_dir(filename);
+			continue;
+		}
+		debug("unlink(%s)\n", filename);
+		// Programs can create read-only files.
+		SetFileAttributesA(filename, FILE_ATTRIBUTE_NORMAL);
+		if (unlink(filename))
+			exitf("unlink(%s) failed", filename);
+	}
+	closedir(dp);
+	debug("rmdir(%s)\n", dir);
+	if (rmdir(dir))
+		exitf("rmdir(%s) failed", dir);
+}
+
+static uint64_t current_time_ms()
+{
+	return GetTickCount64();
+}
@@ -7,9 +7,8 @@
 #include <errno.h>
 #include <fcntl.h>
 #include <limits.h>
-#include <linux/futex.h>
-#include <linux/reboot.h>
 #include <pthread.h>
+#include <sched.h>
 #include <setjmp.h>
 #include <signal.h>
 #include <stddef.h>
@@ -17,26 +16,106 @@
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
+#if !defined(_WIN32)
 #include <sys/ioctl.h>
-#include <sys/prctl.h>
-#include <sys/reboot.h>
+#include <sys/mman.h>
+#include <sys/resource.h>
+#endif
 #include <sys/stat.h>
-#include <sys/syscall.h>
 #include <sys/time.h>
 #include <sys/types.h>
+#if !defined(_WIN32)
 #include <sys/wait.h>
+#endif
 #include <time.h>
 #include <unistd.h>
 
+#if defined(__Fuchsia__)
+// Calls of the generated syscalls table are functions declared in these headers.
+#include <lib/fdio/util.h>
+#include <zircon/process.h>
+#include <zircon/syscalls.h>
+#elif defined(_WIN32)
+#include <windows.h>
+#else
+#include <sys/reboot.h>
+#include <sys/syscall.h>
+#endif
+
+#if defined(__linux__)
+#include <linux/filter.h>
+#include <linux/futex.h>
+#include <linux/reboot.h>
+#include <linux/seccomp.h>
+#include <sys/prctl.h>
+#elif defined(__FreeBSD__)
+#include <sys/cpuset.h>
+#include <sys/umtx.h>
+#elif defined(__OpenBSD__)
+#include <sys/futex.h>
+#endif
+
 #include "syscalls.h"
 
 #define SYZ_EXECUTOR
+#if defined(__FreeBSD__) || defined(__NetBSD__) || defined(__OpenBSD__)
+#include "common_bsd.h"
+#elif defined(__Fuchsia__)
+#include "common_fuchsia.h"
+#elif defined(_WIN32)
+#include "common_windows.h"
+#else
 #include "common.h"
+#endif
 
+#if defined(__FreeBSD__)
+// FreeBSD kcov has the same buffer layout and trace modes as Linux kcov,
+// but the buffer size is set with a different ioctl and there are no remote handles.
+#define KCOV_PATH "/dev/kcov"
+#define KCOV_INIT_TRACE _IOWINT('c', 4)
+#define KCOV_ENABLE _IOWINT('c', 2)
+#define KCOV_DISABLE _IO('c', 3)
+#define KCOV_TRACE_PC 0
+#define KCOV_TRACE_CMP 1
+#elif defined(__NetBSD__) || defined(__OpenBSD__)
+// NetBSD and OpenBSD kcov have the same buffer layout too, but their ioctls take pointers
+// to the buffer size and to the trace mode, and trace modes start from 1.
+#define KCOV_PATH "/dev/kcov"
+#define KCOV_INIT_TRACE _IOW('K', 1, uint64_t)
+#define KCOV_ENABLE _IOW('K', 2, int)
+#define KCOV_DISABLE _IO('K', 3)
+#define KCOV_TRACE_PC 1
+#define KCOV_TRACE_CMP 2
+#elif defined(_WIN32)
+// Windows has no kcov, the definitions only keep the code below compilable.
+#define KCOV_PATH "kcov"
+#define KCOV_TRACE_PC 0
+#define KCOV_TRACE_CMP 1
+#else
+#define KCOV_PATH "/sys/kernel/debug/kcov"
 #define KCOV_INIT_TRACE _IOR('c', 1, unsigned long long)
 #define KCOV_INIT_TABLE _IOR('c', 2, unsigned long long)
 #define KCOV_ENABLE _IO('c', 100)
 #define KCOV_DISABLE _IO('c', 101)
+#define KCOV_TRACE_PC 0
+#define KCOV_TRACE_CMP 1
+#endif
+
+struct kcov_remote_arg {
+	uint32_t trace_mode;
+	uint32_t area_size;
+	uint32_t num_handles;
+	uint32_t pad;
+	uint64_t common_handle;
+	uint64_t handles[0];
+};
+
+#if !defined(_WIN32)
+#define KCOV_REMOTE_ENABLE _IOW('c', 102, struct kcov_remote_arg)
+#endif
+
+#define KCOV_SUBSYSTEM_COMMON (0x00ull << 56)
+#define KCOV_SUBSYSTEM_USB (0x01ull << 56)
 
 const int kInFd = 3;
 const int kOutFd = 4;
@@ -45,17 +124,48 @@ const int kOutPipeFd = 6;
 const int kMaxInput = 2 << 20;
 const int kMaxOutput = 16 << 20;
 const int kMaxArgs = 9;
+const uint64_t kDefaultCallTimeout = 100; // ms
 const int kMaxThreads = 16;
 const int kMaxCommands = 4 << 10;
 const int kCoverSize = 64 << 10;
+const uint32_t kExtraCoverIndex = -1; // call index of extra coverage records in output
+const uint32_t kErrnoBlocked = -2;     // errno of calls that have not completed by the end of the program
+const int kMaxSeccompCalls = 4096;    // size of the bitmap of allowed calls in handshake, must match ipc.maxSeccompCalls
+const int kMaxSeccompNr = 1024;       // allowed syscall numbers must be below this
+
+// Must match ipc.handshakeMagic/handshakeVersion/knownFlags.
+const uint64_t handshake_magic = 0x53595a4b48534b45ull;
+const uint64_t handshake_version = 2;
+const uint64_t known_flags = (1 << 17) - 1;
+
+struct handshake_req {
+	uint64_t magic;
+	uint64_t version;
+	uint64_t flags;
+	uint64_t pid;
+	uint64_t seccomp_calls[kMaxSeccompCalls / 64]; // bitmap of call indexes allowed with flag_seccomp
+};
+
+struct handshake_reply {
+	uint64_t magic;
+	uint64_t version;
+};
+
+// Must match prog.ExecMagic/ExecVersion, see prog/encodingexec.go for the format.
+const uint64_t exec_magic = 0x53595a4b45584543ull;
+const uint64_t exec_version = 5;
 
 const uint64_t instr_eof = -1;
 const uint64_t instr_copyin = -2;
 const uint64_t instr_copyout = -3;
+const uint64_t instr_timeout = -4;
+const uint64_t instr_async = -5;
+const uint64_t instr_delay = -6;
 
 const uint64_t arg_const = 0;
 const uint64_t arg_result = 1;
 const uint64_t arg_data = 2;
+const uint64_t arg_glob = 3;
 
 // We use the default value instead of results of failed syscalls.
 // -1 is an invalid fd and an invalid address and deterministic,
@@ -66,6 +176,7 @@ enum sandbox_type {
 	sandbox_none,
 	sandbox_setuid,
 	sandbox_namespace,
+	sandbox_android_untrusted_app,
 };
 
 bool flag_cover;
@@ -75,9 +186,34 @@ bool flag_deduplicate;
 bool flag_sandbox_privs;
 sandbox_type flag_sandbox;
 bool flag_enable_tun;
+bool flag_enable_wifi;
+bool flag_enable_cgroups;
+bool flag_trace;
+bool flag_pin_cpu;
+bool flag_low_priority;
+bool flag_enable_fault_injection;
+bool flag_extra_cover;
+bool flag_seccomp;
+
+// Index of this executor among executors of one fuzzer.
+uint64_t procid;
 
+// Per-execution fault injection parameters.
+bool flag_inject_fault;
+int flag_fault_call;
+int flag_fault_nth;
+
+// Per-execution flag: collect comparison operands (KCOV_TRACE_CMP) instead of PCs.
+bool flag_collect_comps;
+
+#if defined(_WIN32)
+// Windows can't map files at fixed addresses in the image, the views are mapped anywhere (see map_fd).
+char* input_data;
+char* output_data;
+#else
 __attribute__((aligned(64 << 10))) char input_data[kMaxInput];
 __attribute__((aligned(64 << 10))) char output_data[kMaxOutput];
+#endif
 uint32_t* output_pos;
 int completed;
 int running;
@@ -108,10 +244,22 @@ struct thread_t {
 	uint64_t reserrno;
 	uint64_t cover_size;
 	int cover_fd;
+	bool fault_injected;
+	uint32_t duration_us;
 };
 
 thread_t threads[kMaxThreads];
 
+// Extra coverage collected from kernel background threads via remote kcov handles,
+// one per subsystem (must match ipc.Subsystem* constants).
+enum extra_cover_subsystem {
+	subsystem_common, // softirqs and background work started by the program's threads
+	subsystem_usb,    // USB hub events
+	num_subsystems,
+};
+
+thread_t extra_cover[num_subsystems];
+
 void execute_one();
 uint64_t read_input(uint64_t** input_posp, bool peek = false);
 uint64_t read_arg(uint64_t** input_posp);
@@ -126,23 +274,54 @@ void thread_create(thread_t* th, int id);
 void* worker_thread(void* arg);
 bool write_file(const char* file, const char* what, ...);
 void cover_open();
+void cover_open_one(thread_t* th);
 void cover_enable(thread_t* th);
+void extra_cover_enable(thread_t* th, int subsystem);
+void write_blocked();
+void pin_cpu(uint64_t pid);
+void trace_call(thread_t* th);
+void trace_result(thread_t* th, bool blocked);
+void write_extra_cover();
 void cover_reset(thread_t* th);
 uint64_t cover_read(thread_t* th);
 uint64_t cover_dedup(thread_t* th, uint64_t n);
+bool fault_injected(int fail_fd);
+uint64_t current_time_us();
+void futex_wait(int* addr, int val, const timespec* ts);
+void futex_wake(int* addr);
+void set_parent_death_signal();
+void seccomp_build(const uint64_t* calls);
+void seccomp_install();
 
 int main(int argc, char** argv)
 {
 	if (argc == 2 && strcmp(argv[1], "reboot") == 0) {
+#if defined(__FreeBSD__)
+		reboot(RB_AUTOBOOT);
+#elif defined(__NetBSD__)
+		reboot(RB_AUTOBOOT, NULL);
+#elif defined(__OpenBSD__)
+		reboot(RB_AUTOBOOT);
+#elif defined(__Fuchsia__)
+		fail("reboot is not supported on Fuchsia");
+#elif defined(_WIN32)
+		fail("reboot is not supported on Windows");
+#else
 		reboot(LINUX_REBOOT_CMD_RESTART);
+#endif
 		return 0;
 	}
 
-	prctl(PR_SET_PDEATHSIG, SIGKILL, 0, 0, 0);
+	set_parent_death_signal();
+#if defined(_WIN32)
+	input_data = map_fd(kInFd, kMaxInput, false);
+	output_data = map_fd(kOutFd, kMaxOutput, true);
+#else
 	if (mmap(&input_data[0], kMaxInput, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_FIXED, kInFd, 0) != &input_data[0])
 		fail("mmap of input file failed");
 	if (mmap(&output_data[0], kMaxOutput, PROT_READ | PROT_WRITE, MAP_SHARED | MAP_FIXED, kOutFd, 0) != &output_data[0])
 		fail("mmap of output file failed");
+#endif
 	// Prevent random programs to mess with these fds.
 	// Due to races in collider mode, a program can e.g. ftruncate one of these fds,
 	// which will cause fuzzer to crash.
@@ -150,7 +329,22 @@ int main(int argc, char** argv)
 	close(kInFd);
 	close(kOutFd);
 
-	uint64_t flags = *(uint64_t*)input_data;
+	handshake_req req = {};
+	if (read(kInPipeFd, &req, sizeof(req)) != (ssize_t)sizeof(req))
+		fail("handshake read failed");
+	if (req.magic != handshake_magic)
+		fail("bad handshake magic 0x%lx", req.magic);
+	if (req.version != handshake_version)
+		fail("bad handshake version %lu, executor version %lu", req.version, handshake_version);
+	uint64_t flags = req.flags;
+	if (flags & ~known_flags)
+		fail("unknown flags 0x%lx", flags & ~known_flags);
+	if (__builtin_popcountll(flags & ((1 << 5) | (1 << 6) | (1 << 15))) > 1)
+		fail("conflicting sandbox flags 0x%lx", flags);
+	handshake_reply reply = {handshake_magic, handshake_version};
+	if (write(kOutPipeFd, &reply, sizeof(reply)) != (ssize_t)sizeof(reply))
+		fail("handshake write failed");
+
 	flag_debug = flags & (1 << 0);
 	flag_cover = flags & (1 << 1);
 	flag_threaded = flags & (1 << 2);
@@ -161,13 +355,55 @@ int main(int argc, char** argv)
 		flag_sandbox = sandbox_setuid;
 	else if (flags & (1 << 6))
 		flag_sandbox = sandbox_namespace;
+	else if (flags & (1 << 15))
+		flag_sandbox = sandbox_android_untrusted_app;
 	if (!flag_threaded)
 		flag_collide = false;
 	flag_enable_tun = flags & (1 << 7);
-	uint64_t executor_pid = *((uint64_t*)input_data + 1);
+	flag_enable_fault_injection = flags & (1 << 8);
+	// Remote coverage handles are attached to the task that executes syscalls,
+	// which already has its own kcov in non-threaded mode.
+	flag_extra_cover = flags & (1 << 9) && flag_cover && flag_threaded;
+#if defined(__FreeBSD__) || defined(__NetBSD__) || defined(__OpenBSD__)
+	// BSD kcov does not support remote coverage.
+	flag_extra_cover = false;
+#endif
+#if defined(__Fuchsia__)
+	if (flag_cover)
+		fail("coverage is not supported on Fuchsia");
+#endif
+#if defined(_WIN32)
+	if (flag_cover)
+		fail("coverage is not supported on Windows");
+#endif
+	flag_enable_wifi = flags & (1 << 10);
+	flag_enable_cgroups = flags & (1 << 11);
+	flag_trace = flags & (1 << 12);
+	flag_pin_cpu = flags & (1 << 13);
+	flag_low_priority = flags & (1 << 14);
+	flag_seccomp = flags & (1 << 16);
+	uint64_t executor_pid = req.pid;
+	procid = executor_pid;
+
+	// Done before any forks, so that all test processes inherit them.
+	if (flag_pin_cpu)
+		pin_cpu(executor_pid);
+#if defined(_WIN32)
+	if (flag_low_priority && !SetPriorityClass(GetCurrentProcess(), BELOW_NORMAL_PRIORITY_CLASS))
+		debug("SetPriorityClass failed: %lu\n", GetLastError());
+#else
+	if (flag_low_priority && setpriority(PRIO_PROCESS, 0, 19))
+		debug("setpriority failed: %d\n", errno);
+#endif
 
 	cover_open();
-	setup_main_process(executor_pid, flag_enable_tun);
+	if (flag_enable_fault_injection)
+		setup_fault();
+	setup_main_process(executor_pid, flag_enable_tun, flag_enable_wifi, flag_enable_cgroups);
+	// The filter is built once here, but installed in each test process (see loop),
+	// the loop process needs a lot more syscalls to clean up after tests.
+	if (flag_seccomp)
+		seccomp_build(req.seccomp_calls);
 
 	int pid = -1;
 	switch (flag_sandbox) {
@@ -180,11 +416,18 @@ int main(int argc, char** argv)
 	case sandbox_namespace:
 		pid = do_sandbox_namespace();
 		break;
+	case sandbox_android_untrusted_app:
+		pid = do_sandbox_android_untrusted_app();
+		break;
 	default:
 		fail("unknown sandbox type");
 	}
 	if (pid < 0)
 		fail("clone failed");
+#if defined(_WIN32)
+	// Sandboxes run the loop in the executor process and never return.
+	fail("loop returned");
+#else
 	debug("spawned loop pid %d\n", pid);
 	int status = 0;
 	while (waitpid(-1, &status, __WALL) != pid) {
@@ -199,8 +442,13 @@ int main(int argc, char** argv)
 	// This is unfortunate, but I don't have a better solution than ignoring it for now.
 	exitf("loop exited with status %d", status);
 	return 0;
+#endif
 }
 
+#if defined(__Fuchsia__) || defined(_WIN32)
+// Fuchsia and Windows have no fork, so programs are executed by the loop process itself one after another.
+// Calls that are still blocked at the end of a program can't be killed and would mess
+// with the next programs, in such case the executor exits and the fuzzer restarts it.
 void loop()
 {
 	// Tell parent that we are ready to serve.
@@ -209,31 +457,106 @@ void loop()
 		fail("control pipe write failed");
 
 	for (int iter = 0;; iter++) {
-		// Create a new private work dir for this test (removed at the end of the loop).
 		char cwdbuf[256];
 		sprintf(cwdbuf, "./%d", iter);
 		if (mkdir(cwdbuf, 0777))
 			fail("failed to mkdir");
-
 		if (read(kInPipeFd, &tmp, 1) != 1)
 			fail("control pipe read failed");
+		if (chdir(cwdbuf))
+			fail("failed to chdir");
+		// Reset the state that a forked worker would have started with.
+		memset(results, 0, sizeof(results));
+		completed = 0;
+		running = 0;
+		collide = false;
+		execute_one();
+		for (int i = 0; i < kMaxThreads; i++) {
+			thread_t* th = &threads[i];
+			if (!th->created)
+				continue;
+			if (!__atomic_load_n(&th->done, __ATOMIC_ACQUIRE))
+				exitf("call %d [%s] is blocked at the end of the program", th->call_index, syscalls[th->call_num].name);
+			// Calls that completed after the end of the program are not reported.
+			th->handled = true;
+		}
+#if defined(__Fuchsia__)
+		// Close fds created by the program, except for the control pipes.
+		// Zircon handles are leaked, there is no way to enumerate them.
+		for (int fd = 3; fd < 256; fd++) {
+			if (fd != kInPipeFd && fd != kOutPipeFd)
+				close(fd);
+		}
+#else
+		// NT handles are leaked, closing arbitrary handle values could close handles of the executor.
+		// CRT fds are not closed either, the CRT aborts on close of an invalid fd.
+#endif
+		if (chdir(".."))
+			fail("failed to chdir");
+		remove_dir(cwdbuf);
+		if (write(kOutPipeFd, &tmp, 1) != 1)
+			fail("control pipe write failed");
+	}
+}
+#else
+void loop()
+{
+	// Tell parent that we are ready to serve.
+	char tmp;
+	if (write(kOutPipeFd, &tmp, 1) != 1)
+		fail("control pipe write failed");
+	// USB handles are not tied to the task that started the work,
+	// so they are enabled once in the loop process for all test processes.
+	if (flag_extra_cover)
+		extra_cover_enable(&extra_cover[subsystem_usb], subsystem_usb);
 
+	for (int iter = 0;; iter++) {
+		// Create a new private work dir for this test (removed at the end of the loop).
+		char cwdbuf[256];
+		sprintf(cwdbuf, "./%d", iter);
+		if (mkdir(cwdbuf, 0777))
+			fail("failed to mkdir");
+
+		// The worker is forked and initialized before the next program arrives,
+		// so that this is not on the critical path of execution.
+		// The worker waits for a byte on the start pipe before executing the program.
+		int start_pipe[2];
+		if (pipe(start_pipe))
+			fail("pipe failed");
 		int pid = fork();
 		if (pid < 0)
 			fail("clone failed");
 		if (pid == 0) {
-			prctl(PR_SET_PDEATHSIG, SIGKILL, 0, 0, 0);
-			setpgrp();
+			set_parent_death_signal();
+			setpgid(0, 0);
 			if (chdir(cwdbuf))
 				fail("failed to chdir");
+			setup_cgroups_test();
 			close(kInPipeFd);
 			close(kOutPipeFd);
+			close(start_pipe[1]);
+			// Must be done before creation of worker threads, so that they inherit the common handle.
+			if (flag_extra_cover)
+				extra_cover_enable(&extra_cover[subsystem_common], subsystem_common);
+			if (flag_seccomp)
+				seccomp_install();
+			if (read(start_pipe[0], &tmp, 1) != 1)
+				fail("start pipe read failed");
+			close(start_pipe[0]);
 			execute_one();
+			close_fds();
 			debug("worker exiting\n");
 			doexit(0);
 		}
+		close(start_pipe[0]);
 		debug("spawned worker pid %d\n", pid);
 
+		if (read(kInPipeFd, &tmp, 1) != 1)
+			fail("control pipe read failed");
+		if (write(start_pipe[1], &tmp, 1) != 1)
+			fail("start pipe write failed");
+		close(start_pipe[1]);
+
 		// We used to use sigtimedwait(SIGCHLD) to wait for the subprocess.
 		// But SIGCHLD is also delivered when a process stops/continues,
 		// so it would require a loop with status analysis and timeout recalculation.
@@ -252,41 +575,64 @@ void loop()
 			if (current_time_ms() - start > 5 * 1000) {
 				debug("waitpid(%d)=%d (%d)\n", pid, res, errno0);
 				debug("killing\n");
-				kill(-pid, SIGKILL);
-				kill(pid, SIGKILL);
-				for (;;) {
-					int res = waitpid(-1, &status, __WALL);
-					debug("waitpid(%d)=%d (%d)\n", pid, res, errno);
-					if (res == pid)
-						break;
-				}
 				break;
 			}
 		}
+		// Kill and reap leftover test processes even if the worker exited normally,
+		// they must not interfere with the next program.
+		kill_and_wait(pid, &status);
 		status = WEXITSTATUS(status);
 		if (status == kFailStatus)
 			fail("child failed");
 		if (status == kErrorStatus)
 			error("child errored");
+		reset_cgroups();
+		reset_tun();
 		remove_dir(cwdbuf);
 		if (write(kOutPipeFd, &tmp, 1) != 1)
 			fail("control pipe write failed");
 	}
 }
+#endif
 
 void execute_one()
 {
 retry:
 	uint64_t* input_pos = (uint64_t*)&input_data[0];
-	read_input(&input_pos); // flags
-	read_input(&input_pos); // pid
+	uint64_t fault_call = read_input(&input_pos);
+	uint64_t fault_nth = read_input(&input_pos);
+	flag_inject_fault = fault_call != (uint64_t)-1;
+	flag_fault_call = fault_call;
+	flag_fault_nth = fault_nth;
+	if (flag_inject_fault && !flag_enable_fault_injection)
+		fail("fault injection is requested, but is not enabled");
+	flag_collect_comps = read_input(&input_pos);
+	if (flag_collect_comps && !flag_cover)
+		fail("comparisons collection is requested, but coverage is not enabled");
+	uint64_t magic = read_input(&input_pos);
+	if (magic != exec_magic)
+		fail("bad program magic 0x%lx", magic);
+	uint64_t version = read_input(&input_pos);
+	if (version != exec_version)
+		fail("program version %lu does not match executor version %lu", version, exec_version);
+	read_input(&input_pos); // program flags
+	uint64_t arch = read_input(&input_pos);
+	if (arch != SYZ_ARCH_ID)
+		fail("program arch %lu does not match executor arch %d", arch, SYZ_ARCH_ID);
 	output_pos = (uint32_t*)&output_data[0];
 	write_output(0); // Number of executed syscalls (updated later).
 
 	if (!collide && !flag_threaded)
 		cover_enable(&threads[0]);
+	if (!collide && flag_extra_cover) {
+		for (int i = 0; i < num_subsystems; i++)
+			cover_reset(&extra_cover[i]);
+	}
 
 	int call_index = 0;
+	uint64_t call_timeout = kDefaultCallTimeout;
+	bool call_async = false;
+	uint64_t call_delay = 0;
 	for (int n = 0;; n++) {
 		uint64_t call_num = read_input(&input_pos);
 		if (call_num == instr_eof)
@@ -307,11 +653,14 @@ retry:
 				copyin(addr, val, size);
 				break;
 			}
-			case arg_data: {
+			case arg_data:
+			case arg_glob: {
 				NONFAILING(memcpy(addr, input_pos, size));
 				// Read out the data.
 				for (uint64_t i = 0; i < (size + 7) / 8; i++)
 					read_input(&input_pos);
+				if (typ == arg_glob)
+					expand_glob(addr, size);
 				break;
 			}
 			default:
@@ -325,6 +674,21 @@ retry:
 			// The copyout will happen when/if the call completes.
 			continue;
 		}
+		if (call_num == instr_timeout) {
+			// Applies to the next call only.
+			call_timeout = read_input(&input_pos);
+			continue;
+		}
+		if (call_num == instr_async) {
+			// Applies to the next call only.
+			call_async = true;
+			continue;
+		}
+		if (call_num == instr_delay) {
+			// Applies to the next call only.
+			call_delay = read_input(&input_pos);
+			continue;
+		}
 
 		// Normal syscall.
 		if (call_num >= sizeof(syscalls) / sizeof(syscalls[0]))
@@ -337,11 +701,25 @@ retry:
 			args[i] = read_arg(&input_pos);
 		for (uint64_t i = num_args; i < 6; i++)
 			args[i] = 0;
+		if (call_delay) {
+			// Shifts the call relative to the still running async calls (see PerturbSchedule).
+			debug("delaying call %d by %luus\n", call_index, call_delay);
+			usleep(call_delay);
+			call_delay = 0;
+		}
 		thread_t* th = schedule_call(n, call_index++, call_num, num_args, args, input_pos);
+		uint64_t timeout = call_timeout;
+		call_timeout = kDefaultCallTimeout;
+		bool async = call_async;
+		call_async = false;
 
 		if (collide && (call_index % 2) == 0) {
 			// Don't wait for every other call.
 			// We already have results from the previous execution.
+		} else if (async && flag_threaded) {
+			// Don't wait for the call, so that it runs concurrently with the next call.
+			// Its completion is handled when it finishes while waiting for later calls.
+			debug("not waiting for async call %d\n", call_index - 1);
 		} else if (flag_threaded) {
 			// Wait for call completion.
 			uint64_t start = current_time_ms();
@@ -349,12 +727,14 @@ retry:
 			for (;;) {
 				timespec ts = {};
 				ts.tv_sec = 0;
-				ts.tv_nsec = (100 - (now - start)) * 1000 * 1000;
-				syscall(SYS_futex, &th->done, FUTEX_WAIT, 0, &ts);
+				uint64_t left = timeout - (now - start);
+				ts.tv_sec = left / 1000;
+				ts.tv_nsec = (left % 1000) * 1000 * 1000;
+				futex_wait(&th->done, 0, &ts);
 				if (__atomic_load_n(&th->done, __ATOMIC_RELAXED))
 					break;
 				now = current_time_ms();
-				if (now - start > 100)
+				if (now - start > timeout)
 					break;
 			}
 			if (__atomic_load_n(&th->done, __ATOMIC_ACQUIRE))
@@ -382,7 +762,13 @@ retry:
 		}
 	}
 
-	if (flag_collide && !collide) {
+	if (!collide && flag_threaded)
+		write_blocked();
+	if (!collide && flag_extra_cover && !flag_collect_comps)
+		write_extra_cover();
+
+	// Faults are injected and comparisons are collected only in the first, non-colliding execution.
+	if (flag_collide && !flag_inject_fault && !flag_collect_comps && !collide) {
 		debug("enabling collider\n");
 		collide = true;
 		goto retry;
@@ -419,7 +805,7 @@ thread_t* schedule_call(int n, int call_index, int call_num, uint64_t num_args,
 	for (int i = 0; i < kMaxArgs; i++)
 		th->args[i] = args[i];
 	__atomic_store_n(&th->ready, 1, __ATOMIC_RELEASE);
-	syscall(SYS_futex, &th->ready, FUTEX_WAKE);
+	futex_wake(&th->ready);
 	running++;
 	return th;
 }
@@ -456,11 +842,29 @@ void handle_completion(thread_t* th)
 		write_output(th->call_index);
 		write_output(th->call_num);
 		write_output(th->res != (uint64_t)-1 ? 0 : th->reserrno);
-		write_output(th->cover_size);
-		// Truncate PCs to uint32_t assuming that they fit into 32-bits.
-		// True for x86_64 and arm64 without KASLR.
-		for (uint64_t i = 0; i < th->cover_size; i++)
-			write_output((uint32_t)th->cover_data[i + 1]);
+		write_output(th->fault_injected);
+		write_output(th->duration_us);
+		if (flag_collect_comps) {
+			write_output(0); // cover size
+			// Comparisons are written as type, arg1 and arg2 (64-bit args as 2 words),
+			// the PC of the comparison is not needed.
+			write_output(th->cover_size);
+			for (uint64_t i = 0; i < th->cover_size; i++) {
+				uint64_t* comp = &th->cover_data[1 + i * 4];
+				write_output((uint32_t)comp[0]);
+				write_output((uint32_t)comp[1]);
+				write_output((uint32_t)(comp[1] >> 32));
+				write_output((uint32_t)comp[2]);
+				write_output((uint32_t)(comp[2] >> 32));
+			}
+		} else {
+			write_output(th->cover_size);
+			// Truncate PCs to uint32_t assuming that they fit into 32-bits.
+			// True for x86_64 and arm64 without KASLR.
+			for (uint64_t i = 0; i < th->cover_size; i++)
+				write_output((uint32_t)th->cover_data[i + 1]);
+			write_output(0); // comparisons size
+		}
 		completed++;
 		__atomic_store_n((uint32_t*)&output_data[0], completed, __ATOMIC_RELEASE);
 	}
@@ -491,7 +895,7 @@ void* worker_thread(void* arg)
 	cover_enable(th);
 	for (;;) {
 		while (!__atomic_load_n(&th->ready, __ATOMIC_ACQUIRE))
-			syscall(SYS_futex, &th->ready, FUTEX_WAIT, 0, 0);
+			futex_wait(&th->ready, 0, NULL);
 		execute_call(th);
 	}
 	return 0;
@@ -509,44 +913,327 @@ void execute_call(thread_t* th)
 	}
 	debug(")\n");
 
+	int fail_fd = -1;
+	if (flag_inject_fault && th->call_index == flag_fault_call)
+		fail_fd = inject_fault(flag_fault_nth);
+
+	if (flag_trace)
+		trace_call(th);
 	cover_reset(th);
+	uint64_t start = current_time_us();
+#if defined(__Fuchsia__) || defined(_WIN32)
+	th->res = execute_syscall(call, th->args[0], th->args[1], th->args[2], th->args[3], th->args[4], th->args[5], th->args[6], th->args[7], th->args[8]);
+#else
 	th->res = execute_syscall(call->sys_nr, th->args[0], th->args[1], th->args[2], th->args[3], th->args[4], th->args[5], th->args[6], th->args[7], th->args[8]);
+#endif
 	th->reserrno = errno;
+	uint64_t duration = current_time_us() - start;
+	th->duration_us = duration < UINT32_MAX ? duration : UINT32_MAX;
 	th->cover_size = cover_read(th);
+	th->fault_injected = false;
+
+	if (fail_fd != -1)
+		th->fault_injected = fault_injected(fail_fd);
 
+	if (flag_trace)
+		trace_result(th, false);
 	if (th->res == (uint64_t)-1)
 		debug("#%d: %s = errno(%d)\n", th->id, call->name, th->reserrno);
 	else
 		debug("#%d: %s = 0x%lx\n", th->id, call->name, th->res);
 	__atomic_store_n(&th->done, 1, __ATOMIC_RELEASE);
-	syscall(SYS_futex, &th->done, FUTEX_WAKE);
+	futex_wake(&th->done);
 }
 
 void cover_open()
 {
 	if (!flag_cover)
 		return;
-	for (int i = 0; i < kMaxThreads; i++) {
-		thread_t* th = &threads[i];
-		th->cover_fd = open("/sys/kernel/debug/kcov", O_RDWR);
-		if (th->cover_fd == -1)
-			fail("open of /sys/kernel/debug/kcov failed");
-		if (ioctl(th->cover_fd, KCOV_INIT_TRACE, kCoverSize))
-			fail("cover init write failed");
-		th->cover_data = (uint64_t*)mmap(NULL, kCoverSize * sizeof(th->cover_data[0]), PROT_READ | PROT_WRITE, MAP_SHARED, th->cover_fd, 0);
-		if ((void*)th->cover_data == MAP_FAILED)
-			fail("cover mmap failed");
+	for (int i = 0; i < kMaxThreads; i++)
+		cover_open_one(&threads[i]);
+	if (flag_extra_cover) {
+		for (int i = 0; i < num_subsystems; i++) {
+			extra_cover[i].id = kMaxThreads + i;
+			cover_open_one(&extra_cover[i]);
+		}
 	}
 }
 
+void cover_open_one(thread_t* th)
+{
+#if defined(_WIN32)
+	fail("coverage is not supported on Windows");
+#else
+	th->cover_fd = open(KCOV_PATH, O_RDWR);
+	if (th->cover_fd == -1)
+		fail("open of " KCOV_PATH " failed");
+#if defined(__NetBSD__) || defined(__OpenBSD__)
+	uint64_t cover_size = kCoverSize;
+	if (ioctl(th->cover_fd, KCOV_INIT_TRACE, &cover_size))
+		fail("cover init write failed");
+#else
+	if (ioctl(th->cover_fd, KCOV_INIT_TRACE, kCoverSize))
+		fail("cover init write failed");
+#endif
+	th->cover_data = (uint64_t*)mmap(NULL, kCoverSize * sizeof(th->cover_data[0]), PROT_READ | PROT_WRITE, MAP_SHARED, th->cover_fd, 0);
+	if ((void*)th->cover_data == MAP_FAILED)
+		fail("cover mmap failed");
+#endif
+}
+
 void cover_enable(thread_t* th)
 {
 	if (!flag_cover)
 		return;
-	debug("#%d: enabling /sys/kernel/debug/kcov\n", th->id);
-	if (ioctl(th->cover_fd, KCOV_ENABLE, 0))
+	debug("#%d: enabling " KCOV_PATH "\n", th->id);
+	int mode = flag_collect_comps ? KCOV_TRACE_CMP : KCOV_TRACE_PC;
+#if defined(_WIN32)
+	(void)mode;
+	fail("coverage is not supported on Windows");
+#elif defined(__NetBSD__) || defined(__OpenBSD__)
+	if (ioctl(th->cover_fd, KCOV_ENABLE, &mode))
 		fail("cover enable write failed");
-	debug("#%d: enabled /sys/kernel/debug/kcov\n", th->id);
+#else
+	if (ioctl(th->cover_fd, KCOV_ENABLE, mode))
+		fail("cover enable write failed");
+#endif
+	debug("#%d: enabled " KCOV_PATH "\n", th->id);
+}
+
+void extra_cover_enable(thread_t* th, int subsystem)
+{
+#if defined(__FreeBSD__) || defined(__NetBSD__) || defined(__OpenBSD__)
+	fail("remote cover is not supported on BSD");
+#elif defined(_WIN32)
+	fail("remote cover is not supported on Windows");
+#else
+	// Instances are per executor, so that concurrent executors don't steal each other's coverage.
+	struct {
+		kcov_remote_arg arg;
+		uint64_t handle;
+	} remote = {};
+	remote.arg.trace_mode = KCOV_TRACE_PC;
+	remote.arg.area_size = kCoverSize;
+	if (subsystem == subsystem_common) {
+		remote.arg.common_handle = KCOV_SUBSYSTEM_COMMON | (procid + 1);
+	} else {
+		remote.arg.num_handles = 1;
+		remote.handle = KCOV_SUBSYSTEM_USB | (procid + 1);
+	}
+	debug("enabling remote kcov for subsystem %d\n", subsystem);
+	if (ioctl(th->cover_fd, KCOV_REMOTE_ENABLE, &remote.arg))
+		fail("remote cover enable write failed");
+#endif
+}
+
+// Reports calls that have not completed by the end of the program.
+// Such calls have exceeded their timeout and the rest of the program was executed without them.
+void write_blocked()
+{
+	for (int i = 0; i < kMaxThreads; i++) {
+		thread_t* th = &threads[i];
+		if (!th->created)
+			continue;
+		if (__atomic_load_n(&th->done, __ATOMIC_ACQUIRE)) {
+			if (!th->handled)
+				handle_completion(th);
+			continue;
+		}
+		debug("call %d [%s] on thread %d is blocked\n", th->call_index, syscalls[th->call_num].name, th->id);
+		if (flag_trace)
+			trace_result(th, true);
+		write_output(th->call_index);
+		write_output(th->call_num);
+		write_output(kErrnoBlocked);
+		write_output(0); // fault injected
+		write_output(0); // duration
+		write_output(0); // cover size
+		write_output(0); // comparisons size
+		completed++;
+		__atomic_store_n((uint32_t*)&output_data[0], completed, __ATOMIC_RELEASE);
+	}
+}
+
+// Pins the process to a single CPU out of the CPUs it is allowed to run on,
+// executors with different pids get different CPUs while there are enough of them.
+#if defined(__NetBSD__)
+// NetBSD cpu sets are opaque and allocated dynamically, see cpuset(3).
+void pin_cpu(uint64_t pid)
+{
+	cpuset_t* set = cpuset_create();
+	if (!set)
+		fail("cpuset_create failed");
+	if (sched_getaffinity_np(getpid(), cpuset_size(set), set))
+		fail("sched_getaffinity_np failed");
+	cpuid_t max = cpuset_size(set) * 8;
+	int n = 0;
+	for (cpuid_t cpu = 0; cpu < max; cpu++)
+		n += cpuset_isset(cpu, set) > 0;
+	int idx = n ? pid % n : -1;
+	for (cpuid_t cpu = 0; cpu < max; cpu++) {
+		if (cpuset_isset(cpu, set) <= 0 || idx-- != 0)
+			continue;
+		cpuset_zero(set);
+		cpuset_set(cpu, set);
+		if (sched_setaffinity_np(getpid(), cpuset_size(set), set))
+			fail("sched_setaffinity_np failed");
+		debug("pinned to cpu %d\n", (int)cpu);
+		break;
+	}
+	cpuset_destroy(set);
+}
+#elif defined(__OpenBSD__) || defined(__Fuchsia__)
+// OpenBSD and Fuchsia do not allow to bind processes to CPUs.
+void pin_cpu(uint64_t pid)
+{
+	debug("cpu pinning is not supported\n");
+}
+#elif defined(_WIN32)
+// Affinity masks cover only the processor group of the process, which is enough for test machines.
+void pin_cpu(uint64_t pid)
+{
+	DWORD_PTR mask, system_mask;
+	if (!GetProcessAffinityMask(GetCurrentProcess(), &mask, &system_mask))
+		fail("GetProcessAffinityMask failed");
+	int n = __builtin_popcountll(mask);
+	if (n == 0)
+		return;
+	int idx = pid % n;
+	for (int cpu = 0; cpu < (int)sizeof(mask) * 8; cpu++) {
+		if (!(mask & ((DWORD_PTR)1 << cpu)) || idx-- != 0)
+			continue;
+		if (!SetProcessAffinityMask(GetCurrentProcess(), (DWORD_PTR)1 << cpu))
+			fail("SetProcessAffinityMask failed");
+		debug("pinned to cpu %d\n", cpu);
+		return;
+	}
+}
+#else
+void pin_cpu(uint64_t pid)
+{
+#if defined(__FreeBSD__)
+	cpuset_t set;
+	if (cpuset_getaffinity(CPU_LEVEL_WHICH, CPU_WHICH_PID, -1, sizeof(set), &set))
+		fail("cpuset_getaffinity failed");
+#else
+	cpu_set_t set;
+	if (sched_getaffinity(0, sizeof(set), &set))
+		fail("sched_getaffinity failed");
+#endif
+	int n = CPU_COUNT(&set);
+	if (n == 0)
+		return;
+	int idx = pid % n;
+	for (int cpu = 0; cpu < CPU_SETSIZE; cpu++) {
+		if (!CPU_ISSET(cpu, &set) || idx-- != 0)
+			continue;
+		CPU_ZERO(&set);
+		CPU_SET(cpu, &set);
+#if defined(__FreeBSD__)
+		if (cpuset_setaffinity(CPU_LEVEL_WHICH, CPU_WHICH_PID, -1, sizeof(set), &set))
+			fail("cpuset_setaffinity failed");
+#else
+		if (sched_setaffinity(0, sizeof(set), &set))
+			fail("sched_setaffinity failed");
+#endif
+		debug("pinned to cpu %d\n", cpu);
+		return;
+	}
+}
+#endif
+
+// Strace-like log of executed calls for debugging of programs on the target (FlagTrace).
+// Calls of different threads interleave, so each call is logged when it starts and when it returns.
+// Each line is written with a single write, so that lines of different threads don't mix.
+const int kTraceMaxString = 64;
+
+int trace_arg(char* buf, int size, uint64_t v)
+{
+	int n = snprintf(buf, size, "0x%lx", v);
+	if (v < SYZ_DATA_OFFSET || v >= SYZ_DATA_OFFSET + SYZ_DATA_SIZE || n >= size)
+		return n;
+	// Show what pointers into the data region point to if it looks like a string.
+	char str[kTraceMaxString + 1];
+	volatile int len = 0;
+	volatile bool terminated = false;
+	NONFAILING(
+	    for (; len < kTraceMaxString && v + len < SYZ_DATA_OFFSET + SYZ_DATA_SIZE; len++) {
+		    char c = ((char*)v)[len];
+		    if (c == 0) {
+			    terminated = true;
+			    break;
+		    }
+		    if (c < 0x20 || c >= 0x7f || c == '"' || c == '\\')
+			    break;
+		    str[len] = c;
+	    });
+	if (len == 0 || (!terminated && len < kTraceMaxString))
+		return n;
+	str[len] = 0;
+	return n + snprintf(buf + n, size - n, "=\"%s\"%s", str, terminated ? "" : "...");
+}
+
+void trace_call(thread_t* th)
+{
+	char buf[1024];
+	int n = snprintf(buf, sizeof(buf), "[%lu] #%d: %s(", procid, th->id, syscalls[th->call_num].name);
+	for (int i = 0; i < th->num_args && n < (int)sizeof(buf); i++) {
+		if (i != 0)
+			n += snprintf(buf + n, sizeof(buf) - n, ", ");
+		if (n < (int)sizeof(buf))
+			n += trace_arg(buf + n, sizeof(buf) - n, th->args[i]);
+	}
+	if (n < (int)sizeof(buf))
+		n += snprintf(buf + n, sizeof(buf) - n, ") ...\n");
+	if (n >= (int)sizeof(buf)) {
+		n = sizeof(buf);
+		buf[n - 1] = '\n';
+	}
+	if (write(2, buf, n) != n)
+		debug("trace write failed\n");
+}
+
+void trace_result(thread_t* th, bool blocked)
+{
+	char buf[256];
+	const char* name = syscalls[th->call_num].name;
+	int n;
+	if (blocked)
+		n = snprintf(buf, sizeof(buf), "[%lu] #%d: ... %s = ? <blocked>\n", procid, th->id, name);
+	else if (th->res == (uint64_t)-1)
+		n = snprintf(buf, sizeof(buf), "[%lu] #%d: ... %s = -1 errno %lu (%s) <%u us>\n",
+			     procid, th->id, name, th->reserrno, strerror(th->reserrno), th->duration_us);
+	else
+		n = snprintf(buf, sizeof(buf), "[%lu] #%d: ... %s = 0x%lx <%u us>\n",
+			     procid, th->id, name, th->res, th->duration_us);
+	if (n >= (int)sizeof(buf)) {
+		n = sizeof(buf);
+		buf[n - 1] = '\n';
+	}
+	if (write(2, buf, n) != n)
+		debug("trace write failed\n");
+}
+
+void write_extra_cover()
+{
+	for (int i = 0; i < num_subsystems; i++) {
+		thread_t* th = &extra_cover[i];
+		uint64_t cover_size = cover_read(th);
+		if (cover_size == 0)
+			continue;
+		// Extra coverage does not belong to any call, the subsystem is passed instead of the call number.
+		write_output(kExtraCoverIndex);
+		write_output(i);
+		write_output(0); // errno
+		write_output(0); // fault injected
+		write_output(0); // duration
+		write_output(cover_size);
+		for (uint64_t j = 0; j < cover_size; j++)
+			write_output((uint32_t)th->cover_data[j + 1]);
+		write_output(0); // comparisons size
+		completed++;
+		__atomic_store_n((uint32_t*)&output_data[0], completed, __ATOMIC_RELEASE);
+	}
 }
 
 void cover_reset(thread_t* th)
@@ -556,11 +1243,300 @@ void cover_reset(thread_t* th)
 	__atomic_store_n(&th->cover_data[0], 0, __ATOMIC_RELAXED);
 }
 
+// futex_wait blocks while *addr == val, until futex_wake(addr) or until the relative timeout ts expires (if not NULL).
+void futex_wait(int* addr, int val, const timespec* ts)
+{
+#if defined(__FreeBSD__)
+	_umtx_op(addr, UMTX_OP_WAIT_UINT_PRIVATE, val, ts ? (void*)sizeof(*ts) : NULL, (void*)ts);
+#elif defined(__NetBSD__)
+	// NetBSD has no futexes, poll the value instead.
+	uint64_t deadline = ts ? current_time_us() + ts->tv_sec * 1000000 + ts->tv_nsec / 1000 : 0;
+	while (__atomic_load_n(addr, __ATOMIC_ACQUIRE) == val) {
+		if (ts && current_time_us() >= deadline)
+			break;
+		usleep(20);
+	}
+#elif defined(__OpenBSD__)
+	futex((volatile uint32_t*)addr, FUTEX_WAIT | FUTEX_PRIVATE_FLAG, val, ts, NULL);
+#elif defined(__Fuchsia__)
+	zx_time_t deadline = ts ? zx_deadline_after(ZX_SEC(ts->tv_sec) + ts->tv_nsec) : ZX_TIME_INFINITE;
+	zx_futex_wait((zx_futex_t*)addr, val, deadline);
+#elif defined(_WIN32)
+	WaitOnAddress(addr, &val, sizeof(val), ts ? ts->tv_sec * 1000 + ts->tv_nsec / 1000000 : INFINITE);
+#else
+	syscall(SYS_futex, addr, FUTEX_WAIT, val, ts);
+#endif
+}
+
+void futex_wake(int* addr)
+{
+#if defined(__FreeBSD__)
+	_umtx_op(addr, UMTX_OP_WAKE_PRIVATE, INT_MAX, NULL, NULL);
+#elif defined(__NetBSD__)
+	// Waiters poll the value.
+#elif defined(__OpenBSD__)
+	futex((volatile uint32_t*)addr, FUTEX_WAKE | FUTEX_PRIVATE_FLAG, INT_MAX, NULL, NULL);
+#elif defined(__Fuchsia__)
+	zx_futex_wake((zx_futex_t*)addr, UINT32_MAX);
+#elif defined(_WIN32)
+	WakeByAddressAll(addr);
+#else
+	syscall(SYS_futex, addr, FUTEX_WAKE, INT_MAX);
+#endif
+}
+
+// set_parent_death_signal makes the process die with its parent, there is no such facility on the BSDs, Fuchsia and Windows.
+void set_parent_death_signal()
+{
+#if defined(__linux__)
+	prctl(PR_SET_PDEATHSIG, SIGKILL, 0, 0, 0);
+#endif
+}
+
+#if defined(__linux__)
+// Syscalls that executor itself issues in test processes: threads, waiting for calls,
+// coverage, fault injection, glob expansion, NONFAILING, debug output and exit.
+static const int seccomp_executor_syscalls[] = {
+    SYS_read,
+    SYS_write,
+    SYS_close,
+    SYS_openat,
+    SYS_lseek,
+    SYS_getdents64,
+    SYS_fstat,
+    SYS_mmap,
+    SYS_munmap,
+    SYS_mprotect,
+    SYS_madvise,
+    SYS_brk,
+    SYS_clone,
+    SYS_set_robust_list,
+    SYS_rt_sigaction,
+    SYS_rt_sigprocmask,
+    SYS_rt_sigreturn,
+    SYS_sigaltstack,
+    SYS_futex,
+    SYS_nanosleep,
+    SYS_clock_nanosleep,
+    SYS_clock_gettime,
+    SYS_sched_yield,
+    SYS_getpid,
+    SYS_gettid,
+    SYS_tgkill,
+    SYS_exit,
+    SYS_exit_group,
+#ifdef SYS_open
+    SYS_open,
+#endif
+#ifdef SYS_newfstatat
+    SYS_newfstatat,
+#endif
+#ifdef SYS_statx
+    SYS_statx,
+#endif
+#ifdef SYS_clone3
+    SYS_clone3,
+#endif
+#ifdef SYS_rseq
+    SYS_rseq,
+#endif
+#ifdef SYS_mmap2
+    SYS_mmap2,
+#endif
+};
+
+static bool seccomp_allowed[kMaxSeccompNr];
+static struct sock_filter seccomp_filter[2 * kMaxSeccompNr + 16];
+static unsigned short seccomp_filter_len;
+
+static void seccomp_allow(int nr)
+{
+	if (nr < 0 || nr >= kMaxSeccompNr)
+		fail("seccomp: syscall number %d is too large", nr);
+	seccomp_allowed[nr] = true;
+}
+
+static void seccomp_allow_open()
+{
+	seccomp_allow(SYS_openat);
+#ifdef SYS_open
+	seccomp_allow(SYS_open);
+#endif
+}
+
+// seccomp_allow_pseudo allows syscalls issued by pseudo-syscall nr,
+// must be kept in sync with the pseudo-syscalls in common.h.
+static void seccomp_allow_pseudo(int nr)
+{
+	switch (nr) {
+#ifdef __NR_syz_open_dev
+	case __NR_syz_open_dev:
+		seccomp_allow_open();
+		break;
+#endif
+#ifdef __NR_syz_open_pts
+	case __NR_syz_open_pts:
+		seccomp_allow_open();
+		seccomp_allow(SYS_ioctl);
+		break;
+#endif
+#ifdef __NR_syz_fuse_mount
+	case __NR_syz_fuse_mount:
+		seccomp_allow_open();
+		seccomp_allow(SYS_mount);
+		break;
+#endif
+#ifdef __NR_syz_fuseblk_mount
+	case __NR_syz_fuseblk_mount:
+		seccomp_allow_open();
+		seccomp_allow(SYS_mknodat);
+		seccomp_allow(SYS_mount);
+		break;
+#endif
+#ifdef __NR_syz_emit_ethernet
+	case __NR_syz_emit_ethernet:
+		break;
+#endif
+#ifdef __NR_syz_80211_inject_frame
+	case __NR_syz_80211_inject_frame:
+		seccomp_allow(SYS_socket);
+		seccomp_allow(SYS_sendto);
+		seccomp_allow(SYS_recvfrom);
+		break;
+#endif
+#ifdef __NR_syz_kvm_setup_cpu
+	case __NR_syz_kvm_setup_cpu:
+		seccomp_allow_open();
+		seccomp_allow(SYS_ioctl);
+		break;
+#endif
+#ifdef __NR_syz_mount_image
+	case __NR_syz_mount_image:
+		seccomp_allow_open();
+		seccomp_allow(SYS_ftruncate);
+		seccomp_allow(SYS_pwrite64);
+		seccomp_allow(SYS_ioctl);
+		seccomp_allow(SYS_mkdirat);
+#ifdef SYS_mkdir
+		seccomp_allow(SYS_mkdir);
+#endif
+		seccomp_allow(SYS_mount);
+		break;
+#endif
+#ifdef __NR_syz_usb_connect
+	case __NR_syz_usb_connect:
+		seccomp_allow_open();
+		seccomp_allow(SYS_ioctl);
+		break;
+#endif
+#ifdef __NR_syz_usb_control_io
+	case __NR_syz_usb_control_io:
+		seccomp_allow(SYS_ioctl);
+		break;
+#endif
+	}
+}
+
+static void seccomp_emit(struct sock_filter insn)
+{
+	if (seccomp_filter_len >= sizeof(seccomp_filter) / sizeof(seccomp_filter[0]))
+		fail("seccomp: filter is too long");
+	seccomp_filter[seccomp_filter_len++] = insn;
+}
+#endif
+
+// seccomp_build builds the seccomp filter that allows test processes only calls
+// from the calls bitmap (indexes in syscalls) and syscalls that executor needs itself.
+// Denied syscalls fail with EPERM, so that programs continue after them.
+void seccomp_build(const uint64_t* calls)
+{
+#if defined(__linux__)
+	const int ncalls = sizeof(syscalls) / sizeof(syscalls[0]);
+	if (ncalls > kMaxSeccompCalls)
+		fail("seccomp: too many calls %d", ncalls);
+	for (int i = 0; i < ncalls; i++) {
+		if (!(calls[i / 64] & (1ull << (i % 64))))
+			continue;
+		call_t* call = &syscalls[i];
+		// Pseudo-syscalls are numbered after SYZ_PSEUDO_SYSCALL_BASE, see execute_syscall.
+		if (call->sys_nr <= SYZ_PSEUDO_SYSCALL_BASE) {
+			seccomp_allow(call->sys_nr);
+#if defined(__i386__)
+			// See execute_syscall.
+			if (call->sys_nr == __NR_mmap)
+				seccomp_allow(__NR_mmap2);
+#endif
+		} else {
+			seccomp_allow_pseudo(call->sys_nr);
+		}
+	}
+	for (unsigned i = 0; i < sizeof(seccomp_executor_syscalls) / sizeof(seccomp_executor_syscalls[0]); i++)
+		seccomp_allow(seccomp_executor_syscalls[i]);
+
+	seccomp_emit((struct sock_filter)BPF_STMT(BPF_LD | BPF_W | BPF_ABS, offsetof(struct seccomp_data, arch)));
+	// Calls of other arches (e.g. 32-bit compat) are denied altogether.
+	seccomp_emit((struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K, SYZ_AUDIT_ARCH, 1, 0));
+	seccomp_emit((struct sock_filter)BPF_STMT(BPF_RET | BPF_K, SECCOMP_RET_ERRNO | EPERM));
+	seccomp_emit((struct sock_filter)BPF_STMT(BPF_LD | BPF_W | BPF_ABS, offsetof(struct seccomp_data, nr)));
+	for (int nr = 0; nr < kMaxSeccompNr; nr++) {
+		if (!seccomp_allowed[nr])
+			continue;
+		seccomp_emit((struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K, (uint32_t)nr, 0, 1));
+		seccomp_emit((struct sock_filter)BPF_STMT(BPF_RET | BPF_K, SECCOMP_RET_ALLOW));
+	}
+	if (flag_cover && !seccomp_allowed[SYS_ioctl]) {
+		// Coverage needs ioctl to enable kcov in worker threads, but allow only kcov commands then.
+		// The command is the low half of the second argument.
+		unsigned cmd_offset = offsetof(struct seccomp_data, args[1]);
+#if __BYTE_ORDER__ == __ORDER_BIG_ENDIAN__
+		cmd_offset += 4;
+#endif
+		seccomp_emit((struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K, SYS_ioctl, 0, 4));
+		seccomp_emit((struct sock_filter)BPF_STMT(BPF_LD | BPF_W | BPF_ABS, cmd_offset));
+		seccomp_emit((struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K, (uint32_t)KCOV_ENABLE, 1, 0));
+		seccomp_emit((struct sock_filter)BPF_JUMP(BPF_JMP | BPF_JEQ | BPF_K, (uint32_t)KCOV_DISABLE, 0, 1));
+		seccomp_emit((struct sock_filter)BPF_STMT(BPF_RET | BPF_K, SECCOMP_RET_ALLOW));
+	}
+	seccomp_emit((struct sock_filter)BPF_STMT(BPF_RET | BPF_K, SECCOMP_RET_ERRNO | EPERM));
+	debug("seccomp filter: %d instructions\n", seccomp_filter_len);
+#else
+	fail("seccomp is not supported on this OS");
+#endif
+}
+
+// seccomp_install applies the filter built by seccomp_build to the current process and its future threads.
+void seccomp_install()
+{
+#if defined(__linux__)
+	struct sock_fprog prog = {seccomp_filter_len, seccomp_filter};
+	// Required to install a filter without CAP_SYS_ADMIN (e.g. in the setuid sandbox).
+	if (prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0))
+		fail("prctl(PR_SET_NO_NEW_PRIVS) failed");
+	if (syscall(SYS_seccomp, SECCOMP_SET_MODE_FILTER, 0, &prog))
+		fail("seccomp failed");
+#endif
+}
+
+uint64_t current_time_us()
+{
+	struct timespec ts;
+	if (clock_gettime(CLOCK_MONOTONIC, &ts))
+		fail("clock_gettime failed");
+	return (uint64_t)ts.tv_sec * 1000000 + (uint64_t)ts.tv_nsec / 1000;
+}
+
 uint64_t cover_read(thread_t* th)
 {
 	if (!flag_cover)
 		return 0;
 	uint64_t n = __atomic_load_n(&th->cover_data[0], __ATOMIC_RELAXED);
+	if (flag_collect_comps) {
+		// Each comparison record takes 4 words: type, arg1, arg2 and PC.
+		debug("#%d: read comps = %d\n", th->id, n);
+		if (n * 4 >= kCoverSize)
+			fail("#%d: too many comparisons %d", th->id, n);
+		return n;
+	}
 	debug("#%d: read cover = %d\n", th->id, n);
 	if (n >= kCoverSize)
 		fail("#%d: too much cover %d", th->id, n);
@@ -586,6 +1562,24 @@ uint64_t cover_dedup(thread_t* th, uint64_t n)
 	return w;
 }
 
+bool fault_injected(int fail_fd)
+{
+#if defined(_WIN32)
+	fail("fault injection is not supported on Windows");
+#else
+	// fail-nth counts down to 0 when the fault is injected.
+	char buf[16];
+	int n = pread(fail_fd, buf, sizeof(buf) - 1, 0);
+	bool res = n >= 1 && buf[0] == '0';
+	// Disarm the fault if it was not injected, so that it does not fire in later calls.
+	if (write(fail_fd, "0", 1) != 1)
+		fail("failed to write /proc/thread-self/fail-nth");
+	close(fail_fd);
+	debug("fault injected: %d\n", res);
+	return res;
+#endif
+}
+
 void copyin(char* addr, uint64_t val, uint64_t size)
 {
 	NONFAILING(switch (size) {
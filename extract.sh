@@ -3,7 +3,7 @@
 # Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
 
 # Assuming x86 host, you also need to install:
-# sudo apt-get install gcc-aarch64-linux-gnu gcc-powerpc64le-linux-gnu
+# sudo apt-get install gcc-aarch64-linux-gnu gcc-powerpc64le-linux-gnu gcc-riscv64-linux-gnu gcc-multilib
 
 if [ "$LINUX" == "" ]; then
 	if [ "$ANDROID" == "" ]; then
@@ -21,8 +21,8 @@ fi
 COMMON_FILES="sys/socket.txt sys/tty.txt sys/perf.txt sys/kvm.txt \
 	sys/key.txt sys/bpf.txt sys/fuse.txt sys/dri.txt sys/kdbus.txt sys/sctp.txt \
 	sys/sndseq.txt sys/sndtimer.txt sys/sndcontrol.txt sys/input.txt \
-	sys/netlink.txt sys/tun.txt sys/random.txt sys/netrom.txt \
-	sys/vnet.txt"
+	sys/netlink.txt sys/netlink_route.txt sys/genetlink.txt sys/nl80211.txt \
+	sys/tun.txt sys/random.txt sys/netrom.txt sys/vnet.txt sys/usb.txt"
 
 UPSTREAM_FILES="sys/sys.txt sys/kcm.txt"
 ANDROID_FILES=sys/tlk_device.txt
@@ -47,18 +47,17 @@ generate_arch() {
 		echo "$OUT"
 		exit 1
 	fi
-	for F in $FILES; do
-		echo "extracting from $F"
-		bin/syz-extract -arch $1 -linux "$LINUX" -linuxbld "$LINUXBLD" $F
-		if [ $? -ne 0 ]; then
-			exit 1
-		fi
-	done
+	bin/syz-extract -arch $1 -linux "$LINUX" -linuxbld "$LINUXBLD" $FILES
+	if [ $? -ne 0 ]; then
+		exit 1
+	fi
 	echo
 }
 
 generate_arch amd64 x86_64 x86_64
 generate_arch arm64 arm64 aarch64
+generate_arch i386 i386 x86_64
 if [ "$BUILD_FOR_ANDROID" == "no" ]; then
 	generate_arch ppc64le powerpc powerpc64le
+	generate_arch riscv64 riscv riscv64
 fi
@@ -12,7 +12,6 @@ import (
 	"strconv"
 	"sync"
 	"syscall"
-	"unsafe"
 )
 
 var copyMu sync.Mutex
@@ -57,6 +56,62 @@ func WriteTempFile(data []byte) (string, error) {
 	return f.Name(), nil
 }
 
+// TempSuffix is a part of names of temp files created by WriteFileAtomic, files with it
+// are left over after a crash in the middle of a write and can be removed.
+const TempSuffix = ".tmp"
+
+// WriteFileAtomic writes data to file so that after a crash or a kill the file contains
+// either the old or the new data: data is written to a temp file in the same dir,
+// synced to disk and then renamed over file.
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(file, data, perm, true)
+}
+
+// WriteFileAtomicNoSync is WriteFileAtomic without syncing data to disk. A killed process
+// still leaves either the old or the new data, but after a machine crash the file may be empty.
+// It is meant for frequently written files that are cheap to lose (corpus inputs, crash logs).
+func WriteFileAtomicNoSync(file string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(file, data, perm, false)
+}
+
+func writeFileAtomic(file string, data []byte, perm os.FileMode, sync bool) error {
+	dir, name := filepath.Split(file)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, name+TempSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if !sync {
+		return nil
+	}
+	// Persist the rename, failure to sync the dir is not fatal.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
 // ProcessTempDir creates a new temp dir in where and returns its path and an unique index.
 // It also cleans up old, unused temp dirs after dead processes.
 func ProcessTempDir(where string) (string, error) {
@@ -77,21 +132,9 @@ func ProcessTempDir(where string) (string, error) {
 		err := os.Mkdir(path, 0700)
 		if os.IsExist(err) {
 			// Try to clean up.
-			data, err := ioutil.ReadFile(pidfile)
-			if err == nil && len(data) > 0 {
-				pid, err := strconv.Atoi(string(data))
-				if err == nil && pid > 1 {
-					if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
-						if os.Remove(pidfile) == nil {
-							if os.RemoveAll(path) == nil {
-								i--
-								continue
-							}
-						}
-					}
-				}
+			if StaleProcessTempDir(path) && os.Remove(pidfile) == nil && os.RemoveAll(path) == nil {
+				i--
 			}
-			// If err != nil, assume that the pid file is not created yet.
 			continue
 		}
 		if err != nil {
@@ -105,15 +148,22 @@ func ProcessTempDir(where string) (string, error) {
 	return "", fmt.Errorf("too many live instances")
 }
 
-// UmountAll recurusively unmounts all mounts in dir.
-func UmountAll(dir string) {
-	files, _ := ioutil.ReadDir(dir)
-	for _, f := range files {
-		name := filepath.Join(dir, f.Name())
-		if f.IsDir() {
-			UmountAll(name)
+// StaleProcessTempDir returns true if the temp dir created by ProcessTempDir does not exist anymore
+// or the process that created it has exited, i.e. nobody should use the dir.
+func StaleProcessTempDir(path string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(path, ".pid"))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return true
 		}
-		fn := []byte(name + "\x00")
-		syscall.Syscall(syscall.SYS_UMOUNT2, uintptr(unsafe.Pointer(&fn[0])), syscall.MNT_FORCE, 0)
 	}
+	if err != nil || len(data) == 0 {
+		// Assume that the pid file is not created yet.
+		return false
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil || pid <= 1 {
+		return false
+	}
+	return syscall.Kill(pid, 0) == syscall.ESRCH
 }
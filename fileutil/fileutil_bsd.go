@@ -0,0 +1,26 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+//go:build freebsd || netbsd || openbsd
+// +build freebsd netbsd openbsd
+
+package fileutil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+)
+
+// UmountAll recurusively unmounts all mounts in dir.
+func UmountAll(dir string) {
+	const mntForce = 0x80000 // MNT_FORCE, same on FreeBSD, NetBSD and OpenBSD
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		name := filepath.Join(dir, f.Name())
+		if f.IsDir() {
+			UmountAll(name)
+		}
+		syscall.Unmount(name, mntForce)
+	}
+}
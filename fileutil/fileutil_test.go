@@ -63,3 +63,74 @@ func TestProcessTempDir(t *testing.T) {
 		}()
 	}
 }
+
+func TestStaleProcessTempDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "syz")
+	if err != nil {
+		t.Fatalf("failed to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	dir, err := ProcessTempDir(tmp)
+	if err != nil {
+		t.Fatalf("failed to create process temp dir: %v", err)
+	}
+	if StaleProcessTempDir(dir) {
+		t.Fatalf("dir of the live process is stale")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".pid"), []byte(strconv.Itoa(999999999)), 0600); err != nil {
+		t.Fatalf("failed to write pid file: %v", err)
+	}
+	if !StaleProcessTempDir(dir) {
+		t.Fatalf("dir of the dead process is not stale")
+	}
+	os.RemoveAll(dir)
+	if !StaleProcessTempDir(dir) {
+		t.Fatalf("removed dir is not stale")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	testWriteFileAtomic(t, WriteFileAtomic)
+}
+
+func TestWriteFileAtomicNoSync(t *testing.T) {
+	testWriteFileAtomic(t, WriteFileAtomicNoSync)
+}
+
+func testWriteFileAtomic(t *testing.T, write func(string, []byte, os.FileMode) error) {
+	dir, err := ioutil.TempDir("", "syz")
+	if err != nil {
+		t.Fatalf("failed to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	for _, data := range []string{"foo", "barbaz", ""} {
+		if err := write(file, []byte(data), 0640); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		got, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if string(got) != data {
+			t.Fatalf("file contains %q, want %q", got, data)
+		}
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("file has mode %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temp files are left in the dir: %v", len(files))
+	}
+	if err := write(filepath.Join(dir, "nonexistent", "file"), nil, 0640); err == nil {
+		t.Fatalf("write to a nonexistent dir succeeded")
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package host
+
+import (
+	"syscall"
+)
+
+// IsDebugfsMounted returns true if debugfs is mounted at /sys/kernel/debug
+// (kcov, kmemleak and fault injection knobs live there).
+func IsDebugfsMounted() bool {
+	const debugfsMagic = 0x64626720
+	var st syscall.Statfs_t
+	if err := syscall.Statfs("/sys/kernel/debug", &st); err != nil {
+		return false
+	}
+	return st.Type == debugfsMagic
+}
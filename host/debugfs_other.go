@@ -0,0 +1,12 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package host
+
+// IsDebugfsMounted returns false, debugfs exists only on Linux.
+func IsDebugfsMounted() bool {
+	return false
+}
@@ -0,0 +1,49 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package host
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// EnumerateFiles returns paths of files, device nodes and directories
+// under dir up to the given depth. Per-process entries in /proc
+// (numeric directories) are skipped, /proc/self covers them.
+// Symlinks are returned, but not followed.
+func EnumerateFiles(dir string, depth int) []string {
+	var files []string
+	enumerateFiles(dir, depth, &files)
+	return files
+}
+
+func enumerateFiles(dir string, depth int, files *[]string) {
+	if depth <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range entries {
+		if dir == "/proc" && isNumber(fi.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		*files = append(*files, path)
+		if fi.Mode()&os.ModeSymlink == 0 && fi.IsDir() {
+			enumerateFiles(path, depth-1, files)
+		}
+	}
+}
+
+func isNumber(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
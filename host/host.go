@@ -5,12 +5,17 @@ package host
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"unsafe"
 
 	"github.com/google/syzkaller/sys"
 )
@@ -37,6 +42,318 @@ func DetectSupportedSyscalls() (map[*sys.Call]bool, error) {
 	return supported, nil
 }
 
+// kcovPath returns the kcov device: debugfs file on Linux, /dev/kcov on the BSDs.
+func kcovPath() string {
+	if runtime.GOOS == "freebsd" || runtime.GOOS == "netbsd" || runtime.GOOS == "openbsd" {
+		return "/dev/kcov"
+	}
+	return "/sys/kernel/debug/kcov"
+}
+
+// IsKcovSupported returns true if kcov coverage is available (CONFIG_KCOV on Linux,
+// options COVERAGE and KCOV on FreeBSD, options KCOV on NetBSD, pseudo-device kcov on OpenBSD).
+// On Linux it also checks that kcov actually collects PCs of syscalls.
+func IsKcovSupported() bool {
+	fd, err := syscall.Open(kcovPath(), syscall.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	syscall.Close(fd)
+	if runtime.GOOS == "linux" {
+		return isKcovCollecting()
+	}
+	return true
+}
+
+// isKcovCollecting traces a getpid call of the current thread and returns true if some PCs were collected.
+// Kernels of new arches (e.g. riscv64) can have the kcov file, but instrumentation of
+// syscall code may be missing (or KCOV_INSTRUMENT_ALL disabled), then coverage is always empty.
+func isKcovCollecting() bool {
+	const (
+		kcovCoverSize = 64 << 10
+		kcovEnable    = 0x6364 // _IO('c', 100)
+		kcovDisable   = 0x6365 // _IO('c', 101)
+		kcovTracePC   = 0
+	)
+	// _IOR('c', 1, unsigned long)
+	kcovInitTrace := uintptr(0x80086301)
+	if runtime.GOARCH == "ppc64le" {
+		kcovInitTrace = 0x40086301
+	}
+	fd, err := syscall.Open(kcovPath(), syscall.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovInitTrace, kcovCoverSize); errno != 0 {
+		return false
+	}
+	mem, err := syscall.Mmap(fd, 0, kcovCoverSize*8, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return false
+	}
+	defer syscall.Munmap(mem)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovEnable, kcovTracePC); errno != 0 {
+		return false
+	}
+	// The first word of the area is the number of collected PCs.
+	n := (*uint64)(unsafe.Pointer(&mem[0]))
+	atomic.StoreUint64(n, 0)
+	syscall.Syscall(syscall.SYS_GETPID, 0, 0, 0)
+	collected := atomic.LoadUint64(n)
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovDisable, 0)
+	return collected != 0
+}
+
+// IsLeakCheckingSupported returns true if kmemleak is available (CONFIG_DEBUG_KMEMLEAK).
+func IsLeakCheckingSupported() bool {
+	_, err := os.Stat("/sys/kernel/debug/kmemleak")
+	return err == nil
+}
+
+// IsNetInjectionSupported returns true if executor can inject network packets
+// via a tun device (requires CONFIG_TUN, root and the ip utility to set up the device).
+func IsNetInjectionSupported() bool {
+	if _, err := os.Stat("/dev/net/tun"); err != nil || syscall.Getuid() != 0 {
+		return false
+	}
+	_, err := exec.LookPath("ip")
+	return err == nil
+}
+
+// IsWifiSupported returns true if executor can create virtual wifi radios
+// and inject 802.11 frames into them (requires CONFIG_MAC80211_HWSIM and root).
+func IsWifiSupported() bool {
+	_, err := os.Stat("/sys/module/mac80211_hwsim")
+	return err == nil && syscall.Getuid() == 0
+}
+
+// IsCgroupsSupported returns true if executor can put test processes
+// into per-process cgroups (requires CONFIG_CGROUPS and root to mount the hierarchies).
+func IsCgroupsSupported() bool {
+	_, err := os.Stat("/proc/cgroups")
+	return err == nil && syscall.Getuid() == 0
+}
+
+// IsSeccompSupported returns true if the kernel supports seccomp filters
+// (the Seccomp field of /proc/self/status is present only with CONFIG_SECCOMP).
+func IsSeccompSupported() bool {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	return err == nil && bytes.Contains(status, []byte("\nSeccomp:"))
+}
+
+// CheckSandbox returns an error if the sandbox (none/setuid/namespace/android_untrusted_app) can't work on the machine.
+func CheckSandbox(sandbox string) error {
+	switch sandbox {
+	case "none":
+		return nil
+	case "setuid":
+		if syscall.Getuid() != 0 {
+			return fmt.Errorf("setuid sandbox requires root")
+		}
+		return nil
+	case "namespace":
+		for _, ns := range []string{"user", "pid", "net", "uts", "ipc"} {
+			if _, err := os.Stat("/proc/self/ns/" + ns); err != nil {
+				return fmt.Errorf("namespace sandbox requires %v namespaces (CONFIG_%v_NS)",
+					ns, strings.ToUpper(ns))
+			}
+		}
+		return nil
+	case "android_untrusted_app":
+		if syscall.Getuid() != 0 {
+			return fmt.Errorf("android_untrusted_app sandbox requires root")
+		}
+		if !IsSeccompSupported() {
+			return fmt.Errorf("android_untrusted_app sandbox requires seccomp (CONFIG_SECCOMP_FILTER)")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown sandbox %v", sandbox)
+	}
+}
+
+// IsFaultInjectionSupported returns true if the kernel supports injection of faults
+// into particular syscalls with /proc/thread-self/fail-nth (CONFIG_FAULT_INJECTION)
+// and failslab is configurable via debugfs (CONFIG_FAILSLAB).
+func IsFaultInjectionSupported() bool {
+	for _, file := range []string{
+		"/proc/self/make-it-fail",
+		"/proc/thread-self/fail-nth",
+		"/sys/kernel/debug/failslab/ignore-gfp-wait",
+	} {
+		if _, err := os.Stat(file); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// IsCompsSupported returns true if kcov supports collection of comparison operands (KCOV_TRACE_CMP).
+func IsCompsSupported() bool {
+	switch runtime.GOOS {
+	case "freebsd":
+		return isCompsSupportedFreeBSD()
+	case "netbsd", "openbsd":
+		return isCompsSupportedNetBSD()
+	}
+	const (
+		kcovCoverSize = 64 << 10
+		kcovEnable    = 0x6364 // _IO('c', 100)
+		kcovDisable   = 0x6365 // _IO('c', 101)
+		kcovTraceCmp  = 1
+	)
+	// _IOR('c', 1, unsigned long)
+	kcovInitTrace := uintptr(0x80086301)
+	if runtime.GOARCH == "ppc64le" {
+		kcovInitTrace = 0x40086301
+	}
+	fd, err := syscall.Open(kcovPath(), syscall.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovInitTrace, kcovCoverSize); errno != 0 {
+		return false
+	}
+	mem, err := syscall.Mmap(fd, 0, kcovCoverSize*8, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return false
+	}
+	defer syscall.Munmap(mem)
+	// kcov is enabled for the current thread.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovEnable, kcovTraceCmp); errno != 0 {
+		return false
+	}
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovDisable, 0)
+	return true
+}
+
+// IsKcovRemoteSupported returns true if kcov can collect coverage of kernel background threads
+// via remote handles (KCOV_REMOTE_ENABLE), see ipc.FlagExtraCover.
+func IsKcovRemoteSupported() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	const (
+		kcovCoverSize = 64 << 10
+		kcovDisable   = 0x6365 // _IO('c', 101)
+		kcovTracePC   = 0
+	)
+	kcovInitTrace := uintptr(0x80086301)
+	// _IOW('c', 102, struct kcov_remote_arg)
+	kcovRemoteEnable := uintptr(0x40186366)
+	if runtime.GOARCH == "ppc64le" {
+		kcovInitTrace = 0x40086301
+		kcovRemoteEnable = 0x80186366
+	}
+	fd, err := syscall.Open(kcovPath(), syscall.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovInitTrace, kcovCoverSize); errno != 0 {
+		return false
+	}
+	mem, err := syscall.Mmap(fd, 0, kcovCoverSize*8, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return false
+	}
+	defer syscall.Munmap(mem)
+	// struct kcov_remote_arg without handles: only the common handle of the current thread.
+	arg := struct {
+		TraceMode    uint32
+		AreaSize     uint32
+		NumHandles   uint32
+		Pad          uint32
+		CommonHandle uint64
+	}{
+		TraceMode:    kcovTracePC,
+		AreaSize:     kcovCoverSize,
+		CommonHandle: uint64(syscall.Getpid()) & 0xffffffff, // KCOV_SUBSYSTEM_COMMON
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovRemoteEnable,
+		uintptr(unsafe.Pointer(&arg))); errno != 0 {
+		return false
+	}
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovDisable, 0)
+	return true
+}
+
+// isCompsSupportedFreeBSD is IsCompsSupported for FreeBSD kcov which has different ioctls.
+func isCompsSupportedFreeBSD() bool {
+	const (
+		kcovCoverSize  = 64 << 10
+		kcovSetBufSize = 0x20046304 // _IOWINT('c', 4)
+		kcovEnable     = 0x20046302 // _IOWINT('c', 2)
+		kcovDisable    = 0x20006303 // _IO('c', 3)
+		kcovTraceCmp   = 1
+	)
+	fd, err := syscall.Open(kcovPath(), syscall.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovSetBufSize, kcovCoverSize); errno != 0 {
+		return false
+	}
+	mem, err := syscall.Mmap(fd, 0, kcovCoverSize*8, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return false
+	}
+	defer syscall.Munmap(mem)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovEnable, kcovTraceCmp); errno != 0 {
+		return false
+	}
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovDisable, 0)
+	return true
+}
+
+// isCompsSupportedNetBSD is IsCompsSupported for NetBSD kcov,
+// its ioctls take pointers to the buffer size and the trace mode.
+// OpenBSD kcov has the same ioctls.
+func isCompsSupportedNetBSD() bool {
+	const (
+		kcovCoverSize  = 64 << 10
+		kcovSetBufSize = 0x80084b01 // _IOW('K', 1, uint64_t)
+		kcovEnable     = 0x80044b02 // _IOW('K', 2, int)
+		kcovDisable    = 0x20004b03 // _IO('K', 3)
+		kcovTraceCmp   = 2
+	)
+	fd, err := syscall.Open(kcovPath(), syscall.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	size := uint64(kcovCoverSize)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovSetBufSize,
+		uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return false
+	}
+	mem, err := syscall.Mmap(fd, 0, kcovCoverSize*8, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return false
+	}
+	defer syscall.Munmap(mem)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	mode := int32(kcovTraceCmp)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovEnable,
+		uintptr(unsafe.Pointer(&mode))); errno != 0 {
+		return false
+	}
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), kcovDisable, 0)
+	return true
+}
+
 func isSupported(kallsyms []byte, c *sys.Call) bool {
 	if c.NR == -1 {
 		return false // don't even have a syscall number
@@ -94,15 +411,27 @@ func isSupportedSyzkall(c *sys.Call) bool {
 		_, err := os.Stat("/dev/fuse")
 		return err == nil && syscall.Getuid() == 0
 	case "syz_emit_ethernet":
-		_, err := os.Stat("/dev/net/tun")
+		return IsNetInjectionSupported()
+	case "syz_80211_inject_frame":
+		return IsWifiSupported()
+	case "syz_mount_image":
+		_, err := os.Stat("/dev/loop-control")
 		return err == nil && syscall.Getuid() == 0
+	case "syz_usb_connect", "syz_usb_control_io":
+		// Devices are emulated with raw gadget on top of dummy_hcd.
+		_, err1 := os.Stat("/dev/raw-gadget")
+		_, err2 := os.Stat("/sys/class/udc/dummy_udc.0")
+		return err1 == nil && err2 == nil && syscall.Getuid() == 0
 	case "syz_kvm_setup_cpu":
 		switch c.Name {
 		case "syz_kvm_setup_cpu$x86":
 			return runtime.GOARCH == "amd64" || runtime.GOARCH == "386"
 		}
+		return false
 	}
-	panic("unknown syzkall: " + c.Name)
+	// Pseudo-syscalls without special requirements are treated like normal syscalls:
+	// if executor does not implement one, it fails with ENOSYS.
+	return true
 }
 
 func isSupportedSocket(c *sys.Call) bool {
@@ -131,6 +460,12 @@ func isSupportedOpen(c *sys.Call) bool {
 }
 
 func isSupportedOpenAt(c *sys.Call) bool {
+	if ptr, ok := c.Args[1].(*sys.PtrType); ok {
+		if glob, ok := ptr.Type.(*sys.BufferType); ok && glob.Kind == sys.BufferGlob {
+			files, err := filepath.Glob(glob.Values[0])
+			return err == nil && len(files) != 0
+		}
+	}
 	fname, ok := extractStringConst(c.Args[1])
 	if !ok {
 		return true
@@ -4,6 +4,7 @@
 package host
 
 import (
+	"strings"
 	"syscall"
 	"testing"
 
@@ -70,3 +71,32 @@ func TestSupportedSyscalls(t *testing.T) {
 		}
 	}
 }
+
+func TestEnumerateFiles(t *testing.T) {
+	files := EnumerateFiles("/dev", 2)
+	if len(files) == 0 {
+		t.Skipf("skipping: no files in /dev")
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f, "/dev/") {
+			t.Fatalf("bad path %q", f)
+		}
+	}
+	for _, f := range EnumerateFiles("/proc", 1) {
+		if isNumber(strings.TrimPrefix(f, "/proc/")) {
+			t.Fatalf("per-process dir %q is not skipped", f)
+		}
+	}
+}
+
+func TestCheckSandbox(t *testing.T) {
+	if err := CheckSandbox("none"); err != nil {
+		t.Fatalf("sandbox none does not work: %v", err)
+	}
+	if err := CheckSandbox("foo"); err == nil {
+		t.Fatalf("unknown sandbox works")
+	}
+	if err := CheckSandbox("setuid"); (err == nil) != (syscall.Getuid() == 0) {
+		t.Fatalf("setuid sandbox check returned %v for uid %v", err, syscall.Getuid())
+	}
+}
@@ -6,13 +6,17 @@ package ipc
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -26,16 +30,48 @@ type Env struct {
 	In  []byte
 	Out []byte
 
+	hdr     []byte // header of the input mapping, see inHdr* consts
 	cmd     *command
+	cmdMu   sync.Mutex // protects changes of cmd against concurrent Kill
 	inFile  *os.File
 	outFile *os.File
 	bin     []string
 	timeout time.Duration
 	flags   uint64
+	policy  ExecPolicy
 	pid     int
 
+	cmdExecs int // executions done by the current executor process
+	failures int // consecutive executions in which all calls failed
+
+	// SeccompCalls are IDs of calls that test processes are allowed to issue with FlagSeccomp
+	// (along with syscalls that executor itself needs), must be set before the first execution.
+	SeccompCalls []int
+
+	// ExtraCover is coverage of kernel background threads (softirqs, workqueues, USB hub events)
+	// collected during the last execution, indexed by Subsystem* (requires FlagExtraCover).
+	ExtraCover [NumSubsystems][]uint32
+
 	StatExecs    uint64
 	StatRestarts uint64
+	StatRetries  uint64
+}
+
+// ExecPolicy describes how Env handles executor errors and when it restarts the executor process.
+type ExecPolicy struct {
+	// Executions that failed with a transient error (executor crashed, did not answer
+	// or failed to start, e.g. due to ENOMEM) are retried up to Retries times, RetryDelay apart.
+	// ExecutorFailure is never retried.
+	Retries    int
+	RetryDelay time.Duration
+	// The executor process is restarted after this many consecutive executions in which
+	// all executed calls failed (0 - never), programs can break the test environment
+	// (e.g. exhaust rlimits or close pipes) so that everything fails afterwards.
+	// Requires errnos, i.e. FlagCover or ExecErrnos.
+	RestartFailures int
+	// The executor process is reused for this many executions and then restarted
+	// (0 - reuse it while it works, 1 - a fresh process for every program).
+	MaxExecs int
 }
 
 const (
@@ -47,14 +83,110 @@ const (
 	FlagSandboxSetuid                        // impersonate nobody user
 	FlagSandboxNamespace                     // use namespaces for sandboxing
 	FlagEnableTun                            // initialize and use tun in executor
+	FlagEnableFault                          // enable fault injection support in executor
+	FlagExtraCover                           // collect coverage of background threads with remote kcov (requires FlagThreaded)
+	FlagEnableWifi                           // initialize and use mac80211_hwsim radios in executor
+	FlagEnableCgroups                        // put test processes into per-process cgroups
+	FlagTrace                                // strace-like log of executed calls to stderr
+	FlagPinCpu                               // pin executor to a dedicated CPU (selected by pid)
+	FlagLowPriority                          // run executor with the lowest scheduling priority (nice 19)
+	FlagSandboxAndroid                       // emulate untrusted_app context on Android (uid, groups, SELinux, seccomp)
+	FlagSeccomp                              // deny test processes all syscalls except SeccompCalls with a seccomp filter
 )
 
+// sandboxUid is the uid/gid test processes run under with FlagSandboxSetuid
+// (user nobody, must match do_sandbox_setuid in executor).
+const sandboxUid = 65534
+
+// untrustedAppUid is the uid/gid test processes run under with FlagSandboxAndroid
+// (must match UNTRUSTED_APP_UID in executor).
+const untrustedAppUid = 10999
+
+const sandboxFlags = FlagSandboxSetuid | FlagSandboxNamespace | FlagSandboxAndroid
+
+// FaultDisabledErr is returned for programs that request a fault (FailNth attribute of a call)
+// from an env without FlagEnableFault.
+var FaultDisabledErr = errors.New("fault injection is not enabled")
+
+// Subsystems of extra coverage (see ExtraCover), must match extra_cover_subsystem in executor.
+const (
+	SubsystemCommon = iota // softirqs and background work started by the program
+	SubsystemUSB           // USB hub events
+	NumSubsystems
+)
+
+var SubsystemNames = [NumSubsystems]string{"common", "usb"}
+
+// Special values of errnos returned by Exec.
+const (
+	ErrnoNotExecuted = -1
+	ErrnoBlocked     = -2 // call has exceeded its timeout and has not completed by the end of the program
+)
+
+// extraCoverIndex is the call index of extra coverage records in executor output,
+// the record's call number is the subsystem.
+const extraCoverIndex = ^uint32(0)
+
+// Layout of the header of the input mapping (program follows the header),
+// the header is written before each execution.
+const (
+	inHdrCall  = 0  // fault call index, -1 if fault injection is disabled
+	inHdrNth   = 8  // fault nth
+	inHdrComps = 16 // collect comparisons instead of coverage
+	inHdrSize  = 24
+)
+
+// Handshake is the first message exchanged with executor over the control pipes,
+// it passes executor configuration and detects mismatching syz-executor binaries.
+// Must match handshake_req/handshake_reply in executor.
+const (
+	handshakeMagic   = uint64(0x53595a4b48534b45) // "SYZKHSKE"
+	handshakeVersion = uint64(2)                  // bump on any change to the IPC protocol
+	knownFlags       = FlagSeccomp<<1 - 1
+	maxSeccompCalls  = 4096 // size of the bitmap of allowed calls in handshake, must match kMaxSeccompCalls
+)
+
+type handshakeReq struct {
+	magic        uint64
+	version      uint64
+	flags        uint64
+	pid          uint64
+	seccompCalls [maxSeccompCalls / 64]uint64 // bitmap of call IDs allowed with FlagSeccomp
+}
+
+type handshakeReply struct {
+	magic   uint64
+	version uint64
+}
+
+// Comparison types as reported by KCOV_TRACE_CMP.
+const (
+	compConst = 1 // one of the operands is a compile-time constant
+)
+
+// execOpts are per-execution options.
+type execOpts struct {
+	faultCall int
+	faultNth  int
+	comps     bool
+	bench     bool
+	errnos    bool
+}
+
 var (
 	flagThreaded = flag.Bool("threaded", true, "use threaded mode in executor")
 	flagCollide  = flag.Bool("collide", true, "collide syscalls to provoke data races")
 	flagCover    = flag.Bool("cover", true, "collect coverage")
-	flagSandbox  = flag.String("sandbox", "setuid", "sandbox for fuzzing (none/setuid/namespace)")
+	flagSandbox  = flag.String("sandbox", "setuid", "sandbox for fuzzing (none/setuid/namespace/android_untrusted_app)")
 	flagDebug    = flag.Bool("debug", false, "debug output from executor")
+	flagTrace    = flag.Bool("trace", false, "log executed calls with decoded arguments and results to stderr")
+	flagPinCpus  = flag.Bool("pin_cpus", false, "pin each executor to a dedicated CPU")
+	flagLowPrio  = flag.Bool("low_priority", false, "run executors with the lowest scheduling priority")
+	flagSeccomp  = flag.Bool("seccomp", false, "allow test processes only enabled syscalls with a seccomp filter")
+	// See ExecPolicy.
+	flagRetries         = flag.Int("exec_retries", 10, "number of retries of executions that failed with a transient error")
+	flagRestartFailures = flag.Int("exec_restart_failures", 0, "restart executor after this many executions in a row in which all calls failed (0 - never)")
+	flagMaxExecs        = flag.Int("exec_max_execs", 0, "restart executor after this many executions (0 - reuse while it works)")
 	// Executor protects against most hangs, so we use quite large timeout here.
 	// Executor can be slow due to global locks in namespaces and other things,
 	// so let's better wait than report false misleading crashes.
@@ -87,16 +219,40 @@ func DefaultFlags() (uint64, time.Duration, error) {
 		flags |= FlagSandboxSetuid
 	case "namespace":
 		flags |= FlagSandboxNamespace
+	case "android_untrusted_app":
+		flags |= FlagSandboxAndroid
 	default:
-		return 0, 0, fmt.Errorf("flag sandbox must contain one of none/setuid/namespace")
+		return 0, 0, fmt.Errorf("flag sandbox must contain one of none/setuid/namespace/android_untrusted_app")
 	}
 	if *flagDebug {
 		flags |= FlagDebug
 	}
+	if *flagTrace {
+		flags |= FlagTrace
+	}
+	if *flagPinCpus {
+		flags |= FlagPinCpu
+	}
+	if *flagLowPrio {
+		flags |= FlagLowPriority
+	}
+	if *flagSeccomp {
+		flags |= FlagSeccomp
+	}
 	return flags, *flagTimeout, nil
 }
 
-func MakeEnv(bin string, timeout time.Duration, flags uint64, pid int) (*Env, error) {
+// DefaultPolicy returns ExecPolicy according to command line flags.
+func DefaultPolicy() ExecPolicy {
+	return ExecPolicy{
+		Retries:         *flagRetries,
+		RetryDelay:      time.Second,
+		RestartFailures: *flagRestartFailures,
+		MaxExecs:        *flagMaxExecs,
+	}
+}
+
+func MakeEnv(bin string, timeout time.Duration, flags uint64, policy ExecPolicy, pid int) (*Env, error) {
 	// IPC timeout must be larger then executor timeout.
 	// Otherwise IPC will kill parent executor but leave child executor alive.
 	if timeout < 7*time.Second {
@@ -120,19 +276,25 @@ func MakeEnv(bin string, timeout time.Duration, flags uint64, pid int) (*Env, er
 			closeMapping(outf, outmem)
 		}
 	}()
-	for i := 0; i < 8; i++ {
-		inmem[i] = byte(flags >> (8 * uint(i)))
+	if flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("unknown flags 0x%x", flags&^knownFlags)
+	}
+	if sandbox := flags & sandboxFlags; sandbox&(sandbox-1) != 0 {
+		return nil, fmt.Errorf("sandbox flags are mutually exclusive: 0x%x", sandbox)
+	}
+	if policy.Retries < 0 || policy.RestartFailures < 0 || policy.MaxExecs < 0 {
+		return nil, fmt.Errorf("bad exec policy: %+v", policy)
 	}
-	*(*uint64)(unsafe.Pointer(&inmem[8])) = uint64(pid)
-	inmem = inmem[16:]
 	env := &Env{
-		In:      inmem,
+		In:      inmem[inHdrSize:],
+		hdr:     inmem[:inHdrSize],
 		Out:     outmem,
 		inFile:  inf,
 		outFile: outf,
 		bin:     strings.Split(bin, " "),
 		timeout: timeout,
 		flags:   flags,
+		policy:  policy,
 		pid:     pid,
 	}
 	if len(env.bin) == 0 {
@@ -164,9 +326,9 @@ func MakeEnv(bin string, timeout time.Duration, flags uint64, pid int) (*Env, er
 
 func (env *Env) Close() error {
 	if env.cmd != nil {
-		env.cmd.close()
+		env.closeCmd()
 	}
-	err1 := closeMapping(env.inFile, env.In)
+	err1 := closeMapping(env.inFile, env.hdr[:cap(env.hdr)])
 	err2 := closeMapping(env.outFile, env.Out)
 	switch {
 	case err1 != nil:
@@ -178,23 +340,161 @@ func (env *Env) Close() error {
 	}
 }
 
+// Kill kills the executor process (if it is running), the current execution fails
+// and the next execution starts a new executor process. Unlike Close, Kill can be called
+// concurrently with executions, e.g. to halt all executions immediately.
+func (env *Env) Kill() {
+	env.cmdMu.Lock()
+	defer env.cmdMu.Unlock()
+	if env.cmd != nil {
+		env.cmd.kill()
+	}
+}
+
+// closeCmd stops the executor process.
+func (env *Env) closeCmd() {
+	env.cmdMu.Lock()
+	cmd := env.cmd
+	env.cmd = nil
+	env.cmdMu.Unlock()
+	cmd.close()
+}
+
 // Exec starts executor binary to execute program p and returns information about the execution:
 // output: process output
 // cov: per-call coverage, len(cov) == len(p.Calls)
+// errnos: per-call errno, ErrnoNotExecuted or ErrnoBlocked for calls that have not completed
 // failed: true if executor has detected a kernel bug
 // hanged: program hanged and was killed
 // err0: failed to start process, or executor has detected a logical error
+// Transient errors are retried and the executor process is restarted according to ExecPolicy of env.
+// If a call in p has FailNth attribute, the fault is injected as in ExecFault.
 func (env *Env) Exec(p *prog.Prog) (output []byte, cov [][]uint32, errnos []int, failed, hanged bool, err0 error) {
+	output, cov, _, errnos, _, _, failed, hanged, err0 = env.exec(p, execOpts{faultCall: -1})
+	return
+}
+
+// ExecBench is the same as Exec, but additionally returns execution time of each call
+// (as measured by executor around the syscall, zero for calls that were not executed).
+func (env *Env) ExecBench(p *prog.Prog) (output []byte, cov [][]uint32, errnos []int, durations []time.Duration, failed, hanged bool, err0 error) {
+	output, cov, _, errnos, durations, _, failed, hanged, err0 = env.exec(p, execOpts{faultCall: -1, bench: true})
+	return
+}
+
+// ExecFault is the same as Exec, but additionally injects a fault into nth (0-based)
+// fault site (e.g. a memory allocation) in the call with index call (requires FlagEnableFault).
+// call = -1 injects faults according to FailNth attributes of calls in p. faultInjected is false if the call has
+// less than nth+1 fault sites, so there is no point in trying larger nth.
+// Explicit call/nth take precedence over FailNth attributes of calls in p.
+func (env *Env) ExecFault(p *prog.Prog, call, nth int) (output []byte, cov [][]uint32, errnos []int, faultInjected, failed, hanged bool, err0 error) {
+	output, cov, _, errnos, _, faultInjected, failed, hanged, err0 = env.exec(p, execOpts{faultCall: call, faultNth: nth})
+	return
+}
+
+// ExecErrnos is the same as ExecFault, but returns errnos even if coverage is not collected
+// (e.g. to compare results of the same program on different kernels).
+func (env *Env) ExecErrnos(p *prog.Prog, call, nth int) (output []byte, cov [][]uint32, errnos []int, faultInjected, failed, hanged bool, err0 error) {
+	output, cov, _, errnos, _, faultInjected, failed, hanged, err0 = env.exec(p, execOpts{faultCall: call, faultNth: nth, errnos: true})
+	return
+}
+
+// ExecComps is the same as Exec, but collects comparison operands (KCOV_TRACE_CMP)
+// instead of coverage (requires FlagCover and kernel support, see host.IsCompsSupported).
+// comps[i] contains comparisons done during execution of call i.
+func (env *Env) ExecComps(p *prog.Prog) (output []byte, comps []prog.CompMap, failed, hanged bool, err0 error) {
+	output, _, comps, _, _, _, failed, hanged, err0 = env.exec(p, execOpts{faultCall: -1, comps: true})
+	return
+}
+
+func (env *Env) exec(p *prog.Prog, opts execOpts) (output []byte, cov [][]uint32, comps []prog.CompMap, errnos []int, durations []time.Duration, faultInjected, failed, hanged bool, err0 error) {
+	env.ExtraCover = [NumSubsystems][]uint32{}
+	if opts.faultCall < 0 && p != nil {
+		for i, c := range p.Calls {
+			if c.FailNth != 0 {
+				opts.faultCall, opts.faultNth = i, c.FailNth-1
+			}
+		}
+	}
+	if opts.faultCall >= 0 && env.flags&FlagEnableFault == 0 {
+		err0 = FaultDisabledErr
+		return
+	}
+	if opts.comps && env.flags&FlagCover == 0 {
+		err0 = fmt.Errorf("executor %v: comparisons collection requires coverage", env.pid)
+		return
+	}
+	if env.flags&FlagSeccomp != 0 && len(env.SeccompCalls) == 0 {
+		err0 = fmt.Errorf("executor %v: seccomp filter requires allowed calls", env.pid)
+		return
+	}
+	*(*uint64)(unsafe.Pointer(&env.hdr[inHdrCall])) = uint64(int64(opts.faultCall))
+	*(*uint64)(unsafe.Pointer(&env.hdr[inHdrNth])) = uint64(opts.faultNth)
+	collectComps := uint64(0)
+	if opts.comps {
+		collectComps = 1
+	}
+	*(*uint64)(unsafe.Pointer(&env.hdr[inHdrComps])) = collectComps
 	if p != nil {
-		// Copy-in serialized program.
-		progData := p.SerializeForExec(env.pid)
-		if len(progData) > len(env.In) {
-			err0 = fmt.Errorf("executor %v: program is too long: %v/%v", env.pid, len(progData), len(env.In))
+		// Serialize the program directly into the shared input buffer.
+		if _, err := p.SerializeForExecBuf(env.In, env.pid); err != nil {
+			err0 = fmt.Errorf("executor %v: program is too long: %v", env.pid, err)
 			return
 		}
-		copy(env.In, progData)
 	}
-	if env.flags&FlagCover != 0 {
+	readOutput := env.flags&FlagCover != 0 || opts.faultCall >= 0 || opts.bench || opts.errnos
+	for try := 0; ; try++ {
+		output, cov, comps, errnos, durations, faultInjected, failed, hanged, err0 = env.exec1(p, opts, readOutput)
+		if err0 == nil {
+			break
+		}
+		// Hangs and kernel bugs detected by executor are results of the program, not transient errors.
+		if _, ok := err0.(ExecutorFailure); ok || failed || hanged || try >= env.policy.Retries {
+			return
+		}
+		atomic.AddUint64(&env.StatRetries, 1)
+		// Executor frequently fails to start due to ENOMEM.
+		debug.FreeOSMemory()
+		time.Sleep(env.policy.RetryDelay)
+	}
+	if env.cmd != nil && env.needRestart(errnos) {
+		env.closeCmd()
+	}
+	return
+}
+
+// needRestart updates execution counters of the current executor process and
+// returns whether the process needs to be restarted according to the policy.
+func (env *Env) needRestart(errnos []int) bool {
+	env.cmdExecs++
+	if env.policy.RestartFailures != 0 && errnos != nil {
+		executed, succeeded := false, false
+		for _, errno := range errnos {
+			if errno == ErrnoNotExecuted {
+				continue
+			}
+			executed = true
+			if errno == 0 || errno == ErrnoBlocked {
+				succeeded = true
+			}
+		}
+		if succeeded {
+			env.failures = 0
+		} else if executed {
+			env.failures++
+		}
+	}
+	if env.policy.MaxExecs != 0 && env.cmdExecs >= env.policy.MaxExecs ||
+		env.policy.RestartFailures != 0 && env.failures >= env.policy.RestartFailures {
+		env.cmdExecs = 0
+		env.failures = 0
+		return true
+	}
+	return false
+}
+
+// exec1 does a single execution of the program in env.In.
+func (env *Env) exec1(p *prog.Prog, opts execOpts, readOutput bool) (output []byte, cov [][]uint32, comps []prog.CompMap, errnos []int, durations []time.Duration, faultInjected, failed, hanged bool, err0 error) {
+	if readOutput {
 		// Zero out the first word (ncmd), so that we don't have garbage there
 		// if executor crashes before writing non-garbage there.
 		for i := 0; i < 4; i++ {
@@ -204,34 +504,43 @@ func (env *Env) Exec(p *prog.Prog) (output []byte, cov [][]uint32, errnos []int,
 
 	atomic.AddUint64(&env.StatExecs, 1)
 	if env.cmd == nil {
+		env.cmdExecs = 0
+		env.failures = 0
 		atomic.AddUint64(&env.StatRestarts, 1)
-		env.cmd, err0 = makeCommand(env.pid, env.bin, env.timeout, env.flags, env.inFile, env.outFile)
-		if err0 != nil {
+		cmd, err := makeCommand(env.pid, env.bin, env.timeout, env.flags, env.SeccompCalls, env.inFile, env.outFile)
+		if err != nil {
+			err0 = err
 			return
 		}
+		env.cmdMu.Lock()
+		env.cmd = cmd
+		env.cmdMu.Unlock()
 	}
 	var restart bool
 	output, failed, hanged, restart, err0 = env.cmd.exec()
 	if err0 != nil || restart {
-		env.cmd.close()
-		env.cmd = nil
+		env.closeCmd()
 		return
 	}
 
-	if env.flags&FlagCover == 0 || p == nil {
+	if !readOutput || p == nil {
 		return
 	}
 	// Read out coverage information.
-	r := bytes.NewReader(env.Out)
+	r := &outputReader{env.Out}
 	var ncmd uint32
-	if err := binary.Read(r, binary.LittleEndian, &ncmd); err != nil {
+	if err := r.read(&ncmd); err != nil {
 		err0 = fmt.Errorf("executor %v: failed to read output coverage: %v", env.pid, err)
 		return
 	}
 	cov = make([][]uint32, len(p.Calls))
+	if opts.comps {
+		comps = make([]prog.CompMap, len(p.Calls))
+	}
 	errnos = make([]int, len(p.Calls))
+	durations = make([]time.Duration, len(p.Calls))
 	for i := range errnos {
-		errnos[i] = -1 // not executed
+		errnos[i] = ErrnoNotExecuted
 	}
 	dumpCov := func() string {
 		buf := new(bytes.Buffer)
@@ -245,23 +554,50 @@ func (env *Env) Exec(p *prog.Prog) (output []byte, cov [][]uint32, errnos []int,
 		return buf.String()
 	}
 	for i := uint32(0); i < ncmd; i++ {
-		var callIndex, callNum, errno, coverSize, pc uint32
-		if err := binary.Read(r, binary.LittleEndian, &callIndex); err != nil {
+		var callIndex, callNum, errno, faultInjected1, durationUs, coverSize, compsSize uint32
+		if err := r.read(&callIndex); err != nil {
 			err0 = fmt.Errorf("executor %v: failed to read output coverage: %v", env.pid, err)
 			return
 		}
-		if err := binary.Read(r, binary.LittleEndian, &callNum); err != nil {
+		if err := r.read(&callNum); err != nil {
 			err0 = fmt.Errorf("executor %v: failed to read output coverage: %v", env.pid, err)
 			return
 		}
-		if err := binary.Read(r, binary.LittleEndian, &errno); err != nil {
+		if err := r.read(&errno); err != nil {
 			err0 = fmt.Errorf("executor %v: failed to read output errno: %v", env.pid, err)
 			return
 		}
-		if err := binary.Read(r, binary.LittleEndian, &coverSize); err != nil {
+		if err := r.read(&faultInjected1); err != nil {
+			err0 = fmt.Errorf("executor %v: failed to read output fault: %v", env.pid, err)
+			return
+		}
+		if err := r.read(&durationUs); err != nil {
+			err0 = fmt.Errorf("executor %v: failed to read output duration: %v", env.pid, err)
+			return
+		}
+		if err := r.read(&coverSize); err != nil {
 			err0 = fmt.Errorf("executor %v: failed to read output coverage: %v", env.pid, err)
 			return
 		}
+		if callIndex == extraCoverIndex {
+			if callNum >= NumSubsystems || env.ExtraCover[callNum] != nil {
+				err0 = fmt.Errorf("executor %v: failed to read output coverage: bad extra cover subsystem %v",
+					env.pid, callNum)
+				return
+			}
+			cov1 := make([]uint32, coverSize)
+			if err := r.readArray(cov1); err != nil {
+				err0 = fmt.Errorf("executor %v: failed to read output extra coverage: %v", env.pid, err)
+				return
+			}
+			if err := r.read(&compsSize); err != nil || compsSize != 0 {
+				err0 = fmt.Errorf("executor %v: failed to read output extra coverage: comps %v, err %v",
+					env.pid, compsSize, err)
+				return
+			}
+			env.ExtraCover[callNum] = cov1
+			continue
+		}
 		if int(callIndex) > len(cov) {
 			err0 = fmt.Errorf("executor %v: failed to read output coverage: record %v, call %v, total calls %v (cov: %v)",
 				env.pid, i, callIndex, len(cov), dumpCov())
@@ -279,19 +615,73 @@ func (env *Env) Exec(p *prog.Prog) (output []byte, cov [][]uint32, errnos []int,
 			return
 		}
 		cov1 := make([]uint32, coverSize)
-		for j := uint32(0); j < coverSize; j++ {
-			if err := binary.Read(r, binary.LittleEndian, &pc); err != nil {
-				err0 = fmt.Errorf("executor %v: failed to read output coverage: record %v, call %v, coversize=%v err=%v", env.pid, i, callIndex, coverSize, err)
+		if err := r.readArray(cov1); err != nil {
+			err0 = fmt.Errorf("executor %v: failed to read output coverage: record %v, call %v, coversize=%v err=%v", env.pid, i, callIndex, coverSize, err)
+			return
+		}
+		if err := r.read(&compsSize); err != nil {
+			err0 = fmt.Errorf("executor %v: failed to read output comparisons: %v", env.pid, err)
+			return
+		}
+		if compsSize != 0 && !opts.comps {
+			err0 = fmt.Errorf("executor %v: got %v comparisons for call %v, but did not request them",
+				env.pid, compsSize, callIndex)
+			return
+		}
+		for j := uint32(0); j < compsSize; j++ {
+			var comp [5]uint32 // type, arg1 and arg2 as pairs of 32-bit words
+			if err := r.readArray(comp[:]); err != nil {
+				err0 = fmt.Errorf("executor %v: failed to read output comparisons: record %v, call %v, compssize=%v err=%v", env.pid, i, callIndex, compsSize, err)
 				return
 			}
-			cov1[j] = pc
+			typ := comp[0]
+			arg1 := uint64(comp[1]) | uint64(comp[2])<<32
+			arg2 := uint64(comp[3]) | uint64(comp[4])<<32
+			if comps[callIndex] == nil {
+				comps[callIndex] = make(prog.CompMap)
+			}
+			// Arg1 of a comparison with a constant is the constant,
+			// so it can't come from the program and is not worth replacing.
+			comps[callIndex].AddComp(arg2, arg1)
+			if typ&compConst == 0 {
+				comps[callIndex].AddComp(arg1, arg2)
+			}
 		}
 		cov[callIndex] = cov1
-		errnos[callIndex] = int(errno)
+		errnos[callIndex] = int(int32(errno)) // executor writes ErrnoBlocked as a 32-bit value
+		durations[callIndex] = time.Duration(durationUs) * time.Microsecond
+		if int(callIndex) == opts.faultCall && faultInjected1 != 0 {
+			faultInjected = true
+		}
 	}
 	return
 }
 
+// outputReader decodes executor output directly from the shared output mapping.
+type outputReader struct {
+	data []byte
+}
+
+func (r *outputReader) read(v *uint32) error {
+	if len(r.data) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	*v = binary.LittleEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return nil
+}
+
+func (r *outputReader) readArray(v []uint32) error {
+	if len(r.data) < 4*len(v) {
+		return io.ErrUnexpectedEOF
+	}
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint32(r.data[4*i:])
+	}
+	r.data = r.data[4*len(v):]
+	return nil
+}
+
 func createMapping(size int) (f *os.File, mem []byte, err error) {
 	f, err = ioutil.TempFile("./", "syzkaller-shm")
 	if err != nil {
@@ -339,27 +729,29 @@ func closeMapping(f *os.File, mem []byte) error {
 }
 
 type command struct {
-	pid      int
-	timeout  time.Duration
-	cmd      *exec.Cmd
-	flags    uint64
-	dir      string
-	readDone chan []byte
-	inrp     *os.File
-	outwp    *os.File
+	pid          int
+	timeout      time.Duration
+	cmd          *exec.Cmd
+	flags        uint64
+	seccompCalls []int
+	dir          string
+	readDone     chan []byte
+	inrp         *os.File
+	outwp        *os.File
 }
 
-func makeCommand(pid int, bin []string, timeout time.Duration, flags uint64, inFile *os.File, outFile *os.File) (*command, error) {
+func makeCommand(pid int, bin []string, timeout time.Duration, flags uint64, seccompCalls []int, inFile *os.File, outFile *os.File) (*command, error) {
 	dir, err := ioutil.TempDir("./", "syzkaller-testdir")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp dir: %v", err)
 	}
 
 	c := &command{
-		pid:     pid,
-		timeout: timeout,
-		flags:   flags,
-		dir:     dir,
+		pid:          pid,
+		timeout:      timeout,
+		flags:        flags,
+		seccompCalls: seccompCalls,
+		dir:          dir,
 	}
 	defer func() {
 		if c != nil {
@@ -367,7 +759,16 @@ func makeCommand(pid int, bin []string, timeout time.Duration, flags uint64, inF
 		}
 	}()
 
-	if flags&(FlagSandboxSetuid|FlagSandboxNamespace) != 0 {
+	if flags&FlagSandboxSetuid != 0 {
+		// The dir is private to the test process running as nobody.
+		if err := os.Chown(dir, sandboxUid, sandboxUid); err != nil {
+			return nil, fmt.Errorf("failed to chown temp dir: %v", err)
+		}
+	} else if flags&FlagSandboxAndroid != 0 {
+		if err := os.Chown(dir, untrustedAppUid, untrustedAppUid); err != nil {
+			return nil, fmt.Errorf("failed to chown temp dir: %v", err)
+		}
+	} else if flags&FlagSandboxNamespace != 0 {
 		if err := os.Chmod(dir, 0777); err != nil {
 			return nil, fmt.Errorf("failed to chmod temp dir: %v", err)
 		}
@@ -427,6 +828,10 @@ func makeCommand(pid int, bin []string, timeout time.Duration, flags uint64, inF
 				}
 			}
 		}(c)
+		if flags&FlagTrace != 0 {
+			// Trace goes to the console, executor failure messages go there too then.
+			cmd.Stderr = os.Stderr
+		}
 	} else {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stdout
@@ -437,6 +842,9 @@ func makeCommand(pid int, bin []string, timeout time.Duration, flags uint64, inF
 	c.cmd = cmd
 	wp.Close()
 	inwp.Close()
+	if err := c.handshake(); err != nil {
+		return nil, err
+	}
 	if err := c.waitServing(); err != nil {
 		return nil, err
 	}
@@ -461,6 +869,53 @@ func (c *command) close() {
 	}
 }
 
+// handshake sends executor configuration and checks that executor speaks the same protocol.
+func (c *command) handshake() error {
+	req := &handshakeReq{
+		magic:   handshakeMagic,
+		version: handshakeVersion,
+		flags:   c.flags,
+		pid:     uint64(c.pid),
+	}
+	if c.flags&FlagSeccomp != 0 {
+		for _, id := range c.seccompCalls {
+			if id < 0 || id >= maxSeccompCalls {
+				return fmt.Errorf("executor handshake failed: bad seccomp call %v", id)
+			}
+			req.seccompCalls[id/64] |= 1 << uint(id%64)
+		}
+	}
+	reqData := (*[unsafe.Sizeof(*req)]byte)(unsafe.Pointer(req))[:]
+	if _, err := c.outwp.Write(reqData); err != nil {
+		return c.failure("executor handshake failed", fmt.Errorf("failed to write control pipe: %v", err))
+	}
+	read := make(chan error, 1)
+	reply := new(handshakeReply)
+	go func() {
+		replyData := (*[unsafe.Sizeof(*reply)]byte)(unsafe.Pointer(reply))[:]
+		_, err := io.ReadFull(c.inrp, replyData)
+		read <- err
+	}()
+	timeout := time.NewTimer(time.Minute)
+	select {
+	case err := <-read:
+		timeout.Stop()
+		if err != nil {
+			return c.failure("executor handshake failed", fmt.Errorf("failed to read control pipe: %v", err))
+		}
+		if reply.magic != handshakeMagic {
+			return fmt.Errorf("executor handshake failed: bad magic 0x%x (stale syz-executor binary?)", reply.magic)
+		}
+		if reply.version != handshakeVersion {
+			return fmt.Errorf("executor handshake failed: executor protocol version %v, expect %v",
+				reply.version, handshakeVersion)
+		}
+		return nil
+	case <-timeout.C:
+		return fmt.Errorf("executor handshake failed: timed out")
+	}
+}
+
 // Wait for executor to start serving (sandbox setup can take significant time).
 func (c *command) waitServing() error {
 	read := make(chan error, 1)
@@ -474,26 +929,32 @@ func (c *command) waitServing() error {
 	case err := <-read:
 		timeout.Stop()
 		if err != nil {
-			c.kill()
-			output := <-c.readDone
-			err = fmt.Errorf("executor is not serving: %v\n%s", err, output)
-			c.cmd.Wait()
-			if c.cmd.ProcessState != nil {
-				sys := c.cmd.ProcessState.Sys()
-				if ws, ok := sys.(syscall.WaitStatus); ok {
-					// Magic values returned by executor.
-					if ws.ExitStatus() == 67 {
-						err = ExecutorFailure(fmt.Sprintf("executor is not serving:\n%s", output))
-					}
-				}
-			}
+			return c.failure("executor is not serving", err)
 		}
-		return err
+		return nil
 	case <-timeout.C:
 		return fmt.Errorf("executor is not serving")
 	}
 }
 
+// failure kills executor during startup and returns an error with executor output,
+// the error is ExecutorFailure if executor has exited by calling fail function.
+func (c *command) failure(what string, err error) error {
+	c.kill()
+	output := <-c.readDone
+	c.cmd.Wait()
+	if c.cmd.ProcessState != nil {
+		sys := c.cmd.ProcessState.Sys()
+		if ws, ok := sys.(syscall.WaitStatus); ok {
+			// Magic values returned by executor.
+			if ws.ExitStatus() == 67 {
+				return ExecutorFailure(fmt.Sprintf("%v:\n%s", what, output))
+			}
+		}
+	}
+	return fmt.Errorf("%v: %v\n%s", what, err, output)
+}
+
 func (c *command) kill() {
 	syscall.Kill(c.cmd.Process.Pid, syscall.SIGKILL)
 }
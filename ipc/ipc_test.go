@@ -6,12 +6,15 @@ package ipc
 import (
 	"math/rand"
 	"os"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/google/syzkaller/csource"
 	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/host"
 	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/sys"
 )
 
 const timeout = 10 * time.Second
@@ -52,7 +55,7 @@ func TestEmptyProg(t *testing.T) {
 	bin := buildExecutor(t)
 	defer os.Remove(bin)
 
-	env, err := MakeEnv(bin, timeout, 0, 0)
+	env, err := MakeEnv(bin, timeout, 0, ExecPolicy{}, 0)
 	if err != nil {
 		t.Fatalf("failed to create env: %v", err)
 	}
@@ -82,7 +85,7 @@ func TestExecute(t *testing.T) {
 	flags := []uint64{0, FlagThreaded, FlagThreaded | FlagCollide}
 	for _, flag := range flags {
 		t.Logf("testing flags 0x%x\n", flag)
-		env, err := MakeEnv(bin, timeout, flag, 0)
+		env, err := MakeEnv(bin, timeout, flag, ExecPolicy{}, 0)
 		if err != nil {
 			t.Fatalf("failed to create env: %v", err)
 		}
@@ -98,3 +101,98 @@ func TestExecute(t *testing.T) {
 		}
 	}
 }
+
+func TestSeccomp(t *testing.T) {
+	if !host.IsSeccompSupported() {
+		t.Skip("seccomp is not supported")
+	}
+	bin := buildExecutor(t)
+	defer os.Remove(bin)
+
+	env, err := MakeEnv(bin, timeout, FlagSeccomp, ExecPolicy{}, 0)
+	if err != nil {
+		t.Fatalf("failed to create env: %v", err)
+	}
+	defer env.Close()
+	env.SeccompCalls = []int{sys.CallMap["getpid"].ID}
+
+	p, err := prog.Deserialize([]byte("getpid()\ngetuid()\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, _, errnos, _, _, _, err := env.ExecErrnos(p, -1, 0)
+	if err != nil {
+		t.Fatalf("failed to run executor: %v\n%s", err, output)
+	}
+	// getuid is not allowed, so the filter fails it with EPERM.
+	if len(errnos) != 2 || errnos[0] != 0 || errnos[1] != int(syscall.EPERM) {
+		t.Fatalf("got errnos %v, want [0 %v]", errnos, int(syscall.EPERM))
+	}
+}
+
+func TestOutputReader(t *testing.T) {
+	r := &outputReader{[]byte{1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 1, 3}}
+	var v uint32
+	if err := r.read(&v); err != nil || v != 1 {
+		t.Fatalf("read %v, %v, want 1", v, err)
+	}
+	arr := make([]uint32, 2)
+	if err := r.readArray(arr); err != nil || arr[0] != 2 || arr[1] != 1<<24 {
+		t.Fatalf("read %v, %v, want [2 %v]", arr, err, 1<<24)
+	}
+	if err := r.read(&v); err == nil {
+		t.Fatalf("read from truncated output succeeded")
+	}
+	if err := r.readArray(arr); err == nil {
+		t.Fatalf("read array from truncated output succeeded")
+	}
+}
+
+func TestExecPolicy(t *testing.T) {
+	const (
+		ok  = 0
+		bad = 22
+		na  = ErrnoNotExecuted
+		blk = ErrnoBlocked
+	)
+	tests := []struct {
+		policy  ExecPolicy
+		errnos  [][]int
+		restart []bool
+	}{
+		{
+			ExecPolicy{},
+			[][]int{{bad}, {bad}, {bad}, nil},
+			[]bool{false, false, false, false},
+		},
+		{
+			ExecPolicy{MaxExecs: 1},
+			[][]int{nil, {ok}, {bad}},
+			[]bool{true, true, true},
+		},
+		{
+			ExecPolicy{MaxExecs: 3},
+			[][]int{nil, nil, nil, nil, nil, nil, nil},
+			[]bool{false, false, true, false, false, true, false},
+		},
+		{
+			ExecPolicy{RestartFailures: 2},
+			[][]int{{bad, bad}, {bad, ok}, {bad, na}, {na, na}, {bad}, {blk}, {bad}, {bad, bad}, {bad}},
+			[]bool{false, false, false, false, true, false, false, true, false},
+		},
+		{
+			// Without errnos failures are not detected.
+			ExecPolicy{RestartFailures: 1},
+			[][]int{nil, nil, {bad}},
+			[]bool{false, false, true},
+		},
+	}
+	for i, test := range tests {
+		env := &Env{policy: test.policy}
+		for j, errnos := range test.errnos {
+			if got := env.needRestart(errnos); got != test.restart[j] {
+				t.Errorf("#%v: execution %v: restart %v, want %v", i, j, got, test.restart[j])
+			}
+		}
+	}
+}
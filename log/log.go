@@ -2,31 +2,70 @@
 // Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
 
 // log package provides functionality similar to standard log package with some extensions:
-//  - verbosity levels
-//  - global verbosity setting that can be used by multiple packages
-//  - ability to disable all output
-//  - ability to cache recent output in memory
+//   - verbosity levels
+//   - global verbosity setting that can be used by multiple packages
+//   - per-component verbosity (e.g. -vmodule=vm=2,rpc=1,exec=3)
+//   - ability to disable all output
+//   - ability to cache recent output in memory
+//   - JSON output (one object per line) for log aggregation
 package log
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	golog "log"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 var (
 	flagV        = flag.Int("v", 0, "verbosity")
+	flagVModule  = flag.String("vmodule", "", "per-component verbosity (e.g. vm=2,rpc=1,exec=3)")
+	flagJSON     = flag.Bool("log_json", false, "write log as JSON objects, one per line")
 	mu           sync.Mutex
 	cacheMem     int
 	cacheMaxMem  int
 	cachePos     int
-	cacheEntries []string
-	prependTime  = true // for testing
+	cacheEntries []*Entry
+	vmodule      map[string]int
+	vmoduleStr   string
+	output       io.Writer = os.Stderr
+	prependTime            = true // for testing
 )
 
+// Severity levels of log entries.
+const (
+	LevelInfo  = "info"
+	LevelError = "error"
+	LevelFatal = "fatal"
+)
+
+// Entry is a single log message.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Component string    `json:"component,omitempty"`
+	V         int       `json:"v"`
+	Msg       string    `json:"msg"`
+}
+
+func (e *Entry) String() string {
+	if !prependTime {
+		return e.Msg
+	}
+	return e.Time.Format("2006/01/02 15:04:05 ") + e.Msg
+}
+
+// Component is a logger of a subsystem (e.g. vm, rpc, exec), its verbosity can be set
+// separately with -vmodule, other components use -v.
+type Component string
+
 // EnableCaching enables in memory caching of log output.
 // Caches up to maxLines, but no more than maxMem bytes.
 // Cached output can later be queried with CachedOutput.
@@ -34,65 +73,156 @@ func EnableLogCaching(maxLines, maxMem int) {
 	mu.Lock()
 	defer mu.Unlock()
 	if cacheEntries != nil {
-		Fatalf("log caching is already enabled")
+		golog.Fatalf("log caching is already enabled")
 	}
 	if maxLines < 1 || maxMem < 1 {
 		panic("invalid maxLines/maxMem")
 	}
 	cacheMaxMem = maxMem
-	cacheEntries = make([]string, maxLines)
+	cacheEntries = make([]*Entry, maxLines)
 }
 
 // Retrieves cached log output.
 func CachedLogOutput() string {
+	buf := new(bytes.Buffer)
+	for _, e := range CachedLogEntries() {
+		str := e.String()
+		if str == "" {
+			continue
+		}
+		buf.WriteString(str)
+		buf.Write([]byte{'\n'})
+	}
+	return buf.String()
+}
+
+// CachedLogEntries returns cached log entries, oldest first.
+func CachedLogEntries() []*Entry {
 	mu.Lock()
 	defer mu.Unlock()
-	buf := new(bytes.Buffer)
+	var res []*Entry
 	for i := range cacheEntries {
 		pos := (cachePos + i) % len(cacheEntries)
-		if cacheEntries[pos] == "" {
+		if cacheEntries[pos] != nil {
+			res = append(res, cacheEntries[pos])
+		}
+	}
+	return res
+}
+
+// V returns whether messages of the component with verbosity v are logged.
+func (c Component) V(v int) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return v <= c.verbosity()
+}
+
+// verbosity returns verbosity of the component, mu must be held.
+func (c Component) verbosity() int {
+	if vmoduleStr != *flagVModule {
+		vmoduleStr = *flagVModule
+		vmodule = parseVModule(vmoduleStr)
+	}
+	if v, ok := vmodule[string(c)]; ok {
+		return v
+	}
+	return *flagV
+}
+
+func parseVModule(str string) map[string]int {
+	res := make(map[string]int)
+	for _, kv := range strings.Split(str, ",") {
+		eq := strings.IndexByte(kv, '=')
+		if eq == -1 {
 			continue
 		}
-		buf.WriteString(cacheEntries[pos])
-		buf.Write([]byte{'\n'})
+		v, err := strconv.Atoi(strings.TrimSpace(kv[eq+1:]))
+		if err != nil {
+			continue
+		}
+		res[strings.TrimSpace(kv[:eq])] = v
 	}
-	return buf.String()
+	return res
 }
 
-func Logf(v int, msg string, args ...interface{}) {
+func (c Component) Logf(v int, msg string, args ...interface{}) {
+	c.log(LevelInfo, v, msg, args...)
+}
+
+// Errorf logs an error, errors are always logged.
+func (c Component) Errorf(msg string, args ...interface{}) {
+	c.log(LevelError, 0, msg, args...)
+}
+
+func (c Component) Fatalf(msg string, args ...interface{}) {
+	if *flagJSON {
+		c.log(LevelFatal, 0, msg, args...)
+		os.Exit(1)
+	}
+	golog.Fatalf(msg, args...)
+}
+
+func (c Component) log(level string, v int, msg string, args ...interface{}) {
 	mu.Lock()
-	doLog := v <= *flagV
-	if cacheEntries != nil && v <= 1 {
-		cacheMem -= len(cacheEntries[cachePos])
+	doLog := v <= c.verbosity()
+	// Messages that are logged are cached as well, so that the cache contains
+	// verbose output of components with increased verbosity.
+	doCache := cacheEntries != nil && (v <= 1 || doLog)
+	var e *Entry
+	if doLog || doCache {
+		e = &Entry{
+			Time:      time.Now(),
+			Level:     level,
+			Component: string(c),
+			V:         v,
+			Msg:       fmt.Sprintf(msg, args...),
+		}
+	}
+	if doCache {
+		if old := cacheEntries[cachePos]; old != nil {
+			cacheMem -= len(old.Msg)
+		}
 		if cacheMem < 0 {
 			panic("log cache size underflow")
 		}
-		timeStr := ""
-		if prependTime {
-			timeStr = time.Now().Format("2006/01/02 15:04:05 ")
-		}
-		cacheEntries[cachePos] = fmt.Sprintf(timeStr+msg, args...)
-		cacheMem += len(cacheEntries[cachePos])
+		cacheEntries[cachePos] = e
+		cacheMem += len(e.Msg)
 		cachePos++
 		if cachePos == len(cacheEntries) {
 			cachePos = 0
 		}
 		for i := 0; i < len(cacheEntries)-1 && cacheMem > cacheMaxMem; i++ {
 			pos := (cachePos + i) % len(cacheEntries)
-			cacheMem -= len(cacheEntries[pos])
-			cacheEntries[pos] = ""
+			if cacheEntries[pos] != nil {
+				cacheMem -= len(cacheEntries[pos].Msg)
+				cacheEntries[pos] = nil
+			}
 		}
 		if cacheMem < 0 {
 			panic("log cache size underflow")
 		}
 	}
+	if doLog && *flagJSON {
+		// Holding mu keeps lines of concurrent writers intact.
+		data, _ := json.Marshal(e)
+		output.Write(append(data, '\n'))
+	}
 	mu.Unlock()
 
-	if doLog {
-		golog.Printf(msg, args...)
+	if doLog && !*flagJSON {
+		golog.Print(e.Msg)
 	}
 }
 
+func Logf(v int, msg string, args ...interface{}) {
+	Component("").Logf(v, msg, args...)
+}
+
+// Errorf logs an error, errors are always logged.
+func Errorf(msg string, args ...interface{}) {
+	Component("").Errorf(msg, args...)
+}
+
 func Fatalf(msg string, args ...interface{}) {
-	golog.Fatalf(msg, args...)
+	Component("").Fatalf(msg, args...)
 }
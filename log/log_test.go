@@ -4,6 +4,10 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -30,3 +34,61 @@ func TestCaching(t *testing.T) {
 		}
 	}
 }
+
+func TestVModule(t *testing.T) {
+	*flagV = 1
+	*flagVModule = "vm=3, rpc=0,bad,exec=x"
+	defer func() {
+		*flagV = 0
+		*flagVModule = ""
+	}()
+	tests := []struct {
+		c    Component
+		v    int
+		want bool
+	}{
+		{"", 1, true},
+		{"", 2, false},
+		{"vm", 3, true},
+		{"vm", 4, false},
+		{"rpc", 0, true},
+		{"rpc", 1, false},
+		{"exec", 1, true},
+		{"exec", 2, false},
+	}
+	for _, test := range tests {
+		if got := test.c.V(test.v); got != test.want {
+			t.Errorf("component %q, v=%v: got %v, want %v", test.c, test.v, got, test.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := new(bytes.Buffer)
+	output = buf
+	*flagJSON = true
+	defer func() {
+		output = os.Stderr
+		*flagJSON = false
+	}()
+	Component("vm").Logf(0, "vm %v booted", 1)
+	Component("vm").Logf(1, "not logged")
+	Errorf("failed: %v", "foo")
+	var entries []Entry
+	for _, ln := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e Entry
+		if err := json.Unmarshal([]byte(ln), &e); err != nil {
+			t.Fatalf("bad JSON line %q: %v", ln, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %v entries, want 2:\n%s", len(entries), buf.Bytes())
+	}
+	if e := entries[0]; e.Component != "vm" || e.Level != LevelInfo || e.Msg != "vm 1 booted" {
+		t.Errorf("bad entry: %+v", e)
+	}
+	if e := entries[1]; e.Component != "" || e.Level != LevelError || e.Msg != "failed: foo" {
+		t.Errorf("bad entry: %+v", e)
+	}
+}
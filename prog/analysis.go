@@ -10,12 +10,13 @@ package prog
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/google/syzkaller/sys"
 )
 
 const (
-	maxPages = 4 << 10
+	maxPages = sys.NumPages // number of pages in the data region of programs
 )
 
 type state struct {
@@ -150,9 +151,23 @@ func foreachArg(c *Call, f func(arg, base *Arg, parent *[]*Arg)) {
 	foreachArgArray(&c.Args, nil, f)
 }
 
+// splitOptions splits zero-terminated comma-separated list of options (like mount data).
+func splitOptions(data []byte) []string {
+	str := strings.TrimRight(string(data), "\x00")
+	if str == "" {
+		return nil
+	}
+	return strings.Split(str, ",")
+}
+
+// joinOptions is the reverse of splitOptions.
+func joinOptions(opts []string) []byte {
+	return []byte(strings.Join(opts, ",") + "\x00")
+}
+
 func generateSize(arg *Arg, lenType *sys.LenType) *Arg {
 	if arg == nil {
-		// Arg is an optional pointer, set size to 0.
+		// Arg is an optional or a special pointer, set size to 0.
 		return constArg(lenType, 0)
 	}
 
@@ -205,9 +220,17 @@ func assignSizes(args []*Arg) {
 }
 
 func assignSizesCall(c *Call) {
+	c.cacheSizes()
 	assignSizes(c.Args)
 	foreachArg(c, func(arg, base *Arg, parent *[]*Arg) {
-		if _, ok := arg.Type.(*sys.StructType); ok {
+		if typ, ok := arg.Type.(*sys.StructType); ok {
+			if typ.OverlayField != 0 {
+				// Input and output layouts are sized independently,
+				// len fields can refer only to fields of the same layout.
+				assignSizes(arg.Inner[:typ.OverlayField])
+				assignSizes(arg.Inner[typ.OverlayField:])
+				return
+			}
 			assignSizes(arg.Inner)
 		}
 	})
@@ -230,53 +253,13 @@ func sanitizeCall(c *Call) {
 			panic("mmap flag arg is not const")
 		}
 		flags.Val |= sys.MAP_FIXED
-	case "mremap":
-		// Add MREMAP_FIXED flag, otherwise it produces non-deterministic results.
-		flags := c.Args[3]
-		if flags.Kind != ArgConst {
-			panic("mremap flag arg is not const")
-		}
-		if flags.Val&sys.MREMAP_MAYMOVE != 0 {
-			flags.Val |= sys.MREMAP_FIXED
-		}
-	case "mknod", "mknodat":
-		mode := c.Args[1]
-		if c.Meta.CallName == "mknodat" {
-			mode = c.Args[2]
-		}
-		if mode.Kind != ArgConst {
-			panic("mknod mode is not const")
-		}
-		// Char and block devices read/write io ports, kernel memory and do other nasty things.
-		// TODO: not required if executor drops privileges.
-		if mode.Val != sys.S_IFREG && mode.Val != sys.S_IFIFO && mode.Val != sys.S_IFSOCK {
-			mode.Val = sys.S_IFIFO
-		}
-	case "syslog":
-		cmd := c.Args[0]
-		// These disable console output, but we need it.
-		if cmd.Val == sys.SYSLOG_ACTION_CONSOLE_OFF || cmd.Val == sys.SYSLOG_ACTION_CONSOLE_ON {
-			cmd.Val = sys.SYSLOG_ACTION_SIZE_UNREAD
-		}
-	case "ioctl":
-		cmd := c.Args[1]
-		// Freeze kills machine. Though, it is an interesting functions,
-		// so we need to test it somehow.
-		// TODO: not required if executor drops privileges.
-		if uint32(cmd.Val) == sys.FIFREEZE {
-			cmd.Val = sys.FITHAW
-		}
-	case "ptrace":
-		// PTRACE_TRACEME leads to unkillable processes, see:
-		// https://groups.google.com/forum/#!topic/syzkaller/uGzwvhlCXAw
-		if c.Args[0].Val == sys.PTRACE_TRACEME {
-			c.Args[0].Val = ^uintptr(0)
-		}
 	case "exit", "exit_group":
 		code := c.Args[0]
 		// These codes are reserved by executor.
 		if code.Val%128 == 67 || code.Val%128 == 68 {
 			code.Val = 1
 		}
+	default:
+		sanitizeTargetCall(c)
 	}
 }
@@ -0,0 +1,307 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"encoding/binary"
+	"math/rand"
+)
+
+// bpfText generates eBPF programs that have a chance to pass the verifier:
+// opcodes are valid, registers are in range, memory accesses mostly go to the stack,
+// jumps go forward to instruction boundaries and the program ends with exit.
+type bpfText struct{}
+
+// bpfInsn is a decoded eBPF instruction. Wide (ld_imm64) instructions occupy 2 slots.
+type bpfInsn struct {
+	code uint8
+	dst  uint8
+	src  uint8
+	off  int16
+	imm  int64
+}
+
+const (
+	bpfInsnSize = 8
+	bpfMaxReg   = 10 // r10 is read-only frame pointer
+	bpfStack    = 512
+
+	bpfClassLD    = 0x00
+	bpfClassLDX   = 0x01
+	bpfClassST    = 0x02
+	bpfClassSTX   = 0x03
+	bpfClassALU   = 0x04
+	bpfClassJMP   = 0x05
+	bpfClassALU64 = 0x07
+
+	bpfSrcK = 0x00
+	bpfSrcX = 0x08
+
+	bpfModeIMM  = 0x00
+	bpfModeABS  = 0x20
+	bpfModeIND  = 0x40
+	bpfModeMEM  = 0x60
+	bpfModeXADD = 0xc0
+
+	bpfSizeW  = 0x00
+	bpfSizeH  = 0x08
+	bpfSizeB  = 0x10
+	bpfSizeDW = 0x18
+
+	bpfAluNeg  = 0x80
+	bpfAluMov  = 0xb0
+	bpfAluEnd  = 0xd0
+	bpfJmpJA   = 0x00
+	bpfJmpCall = 0x80
+	bpfJmpExit = 0x90
+
+	bpfLdImm64 = bpfClassLD | bpfModeIMM | bpfSizeDW
+	bpfMaxFunc = 40 // helper function numbers are generated in [0, bpfMaxFunc]
+)
+
+var (
+	bpfAluOps   = []uint8{0x00, 0x10, 0x20, 0x30, 0x40, 0x50, 0x60, 0x70, bpfAluNeg, 0x90, 0xa0, bpfAluMov, 0xc0, bpfAluEnd}
+	bpfJmpOps   = []uint8{bpfJmpJA, 0x10, 0x20, 0x30, 0x40, 0x50, 0x60, 0x70}
+	bpfSizes    = []uint8{bpfSizeW, bpfSizeH, bpfSizeB, bpfSizeDW}
+	bpfSizeLens = map[uint8]int16{bpfSizeW: 4, bpfSizeH: 2, bpfSizeB: 1, bpfSizeDW: 8}
+)
+
+func (t bpfText) generate(r *rand.Rand) []byte {
+	n := r.Intn(textLen*2) + 1
+	insns := make([]bpfInsn, 0, n+2)
+	for i := 0; i < n; i++ {
+		insns = append(insns, t.randInsn(r))
+	}
+	// Verifier requires r0 to be initialized before exit.
+	insns = append(insns, bpfInsn{code: bpfClassALU64 | bpfAluMov | bpfSrcK, imm: int64(r.Intn(3))})
+	insns = append(insns, bpfInsn{code: bpfClassJMP | bpfJmpExit})
+	return t.encode(r, insns)
+}
+
+func (t bpfText) mutate(r *rand.Rand, text []byte) []byte {
+	insns := t.decode(text)
+	for stop := false; !stop || len(insns) == 0; stop = r.Intn(2) == 0 {
+		n := len(insns)
+		switch x := r.Intn(100); {
+		case x < 30 && n != 0:
+			insns[r.Intn(n)] = t.randInsn(r)
+		case x < 60 && n != 0:
+			// Change one field of an instruction.
+			insn := &insns[r.Intn(n)]
+			switch r.Intn(4) {
+			case 0:
+				insn.dst = t.randReg(r)
+			case 1:
+				insn.src = t.randReg(r)
+			case 2:
+				insn.off = t.randOff(r, insn.code)
+			default:
+				insn.imm = t.randImm(r, insn.code)
+			}
+		case x < 80 || n == 0:
+			i := r.Intn(n + 1)
+			insns = append(insns[:i], append([]bpfInsn{t.randInsn(r)}, insns[i:]...)...)
+		default:
+			i := r.Intn(n)
+			insns = append(insns[:i], insns[i+1:]...)
+		}
+	}
+	if exit := (bpfInsn{code: bpfClassJMP | bpfJmpExit}); insns[len(insns)-1] != exit {
+		insns = append(insns, exit)
+	}
+	return t.encode(r, insns)
+}
+
+func (t bpfText) randInsn(r *rand.Rand) bpfInsn {
+	var code uint8
+	switch x := r.Intn(100); {
+	case x < 40:
+		code = bpfClassALU64
+		if r.Intn(3) == 0 {
+			code = bpfClassALU
+		}
+		op := bpfAluOps[r.Intn(len(bpfAluOps))]
+		code |= op
+		if op != bpfAluNeg && r.Intn(2) == 0 {
+			code |= bpfSrcX
+		}
+	case x < 60:
+		code = bpfClassJMP | bpfJmpOps[r.Intn(len(bpfJmpOps))]
+		if code != bpfClassJMP|bpfJmpJA && r.Intn(2) == 0 {
+			code |= bpfSrcX
+		}
+	case x < 65:
+		code = bpfClassJMP | bpfJmpCall
+	case x < 75:
+		code = bpfClassLDX | bpfModeMEM | bpfSizes[r.Intn(len(bpfSizes))]
+	case x < 85:
+		code = bpfClassSTX | bpfModeMEM | bpfSizes[r.Intn(len(bpfSizes))]
+		if r.Intn(5) == 0 {
+			code = bpfClassSTX | bpfModeXADD | []uint8{bpfSizeW, bpfSizeDW}[r.Intn(2)]
+		}
+	case x < 92:
+		code = bpfClassST | bpfModeMEM | bpfSizes[r.Intn(len(bpfSizes))]
+	case x < 97:
+		code = bpfLdImm64
+	default:
+		code = bpfClassLD | []uint8{bpfModeABS, bpfModeIND}[r.Intn(2)] | bpfSizes[r.Intn(3)]
+	}
+	insn := bpfInsn{
+		code: code,
+		dst:  t.randReg(r),
+		src:  t.randReg(r),
+		off:  t.randOff(r, code),
+		imm:  t.randImm(r, code),
+	}
+	// Clear reserved fields, verifier rejects instructions that use them.
+	switch class := code & 0x7; class {
+	case bpfClassALU, bpfClassALU64, bpfClassJMP:
+		if code&bpfSrcX == 0 {
+			insn.src = 0
+		} else {
+			insn.imm = 0
+		}
+		switch {
+		case code&0xf0 == bpfJmpCall && class == bpfClassJMP:
+			insn.dst, insn.src = 0, 0
+		case code&0xf0 == bpfJmpJA && class == bpfClassJMP:
+			insn.dst, insn.src, insn.imm = 0, 0, 0
+		case class != bpfClassJMP:
+			insn.dst = uint8(r.Intn(bpfMaxReg)) // r10 is read-only
+			if code&0xf0 == bpfAluNeg {
+				insn.imm = 0
+			}
+		}
+	case bpfClassLDX:
+		insn.imm = 0
+		insn.dst = uint8(r.Intn(bpfMaxReg))
+		if r.Intn(4) != 0 {
+			insn.src = bpfMaxReg // most of memory accesses go to the stack
+		}
+	case bpfClassST, bpfClassSTX:
+		if class == bpfClassST {
+			insn.src = 0
+		} else {
+			insn.imm = 0
+		}
+		if r.Intn(4) != 0 {
+			insn.dst = bpfMaxReg
+		}
+	case bpfClassLD:
+		if code == bpfLdImm64 {
+			insn.dst = uint8(r.Intn(bpfMaxReg))
+			insn.src = 0
+		} else {
+			insn.dst = 0
+			if code&0xe0 == bpfModeABS {
+				insn.src = 0
+			}
+		}
+	}
+	return insn
+}
+
+func (t bpfText) randReg(r *rand.Rand) uint8 {
+	return uint8(r.Intn(bpfMaxReg + 1))
+}
+
+func (t bpfText) randOff(r *rand.Rand, code uint8) int16 {
+	switch code & 0x7 {
+	case bpfClassLDX, bpfClassST, bpfClassSTX:
+		size := bpfSizeLens[code&0x18]
+		return -size * int16(r.Intn(bpfStack/int(size))+1)
+	case bpfClassJMP:
+		// Jumps with invalid offsets are pointed to a random instruction in encode.
+		return -1
+	}
+	return 0
+}
+
+func (t bpfText) randImm(r *rand.Rand, code uint8) int64 {
+	switch {
+	case code == bpfClassJMP|bpfJmpCall:
+		return int64(r.Intn(bpfMaxFunc + 1))
+	case code&0xf0 == bpfAluEnd && (code&0x7 == bpfClassALU || code&0x7 == bpfClassALU64):
+		return []int64{16, 32, 64}[r.Intn(3)]
+	case (code&0xf0 == 0x60 || code&0xf0 == 0x70 || code&0xf0 == 0xc0) &&
+		(code&0x7 == bpfClassALU || code&0x7 == bpfClassALU64):
+		// Shifts.
+		if code&0x7 == bpfClassALU {
+			return int64(r.Intn(32))
+		}
+		return int64(r.Intn(64))
+	case code == bpfLdImm64:
+		return r.Int63() - r.Int63()
+	}
+	return int64(int32(r.Uint32()))
+}
+
+func (t bpfText) isJump(insn bpfInsn) bool {
+	op := insn.code & 0xf0
+	return insn.code&0x7 == bpfClassJMP && op != bpfJmpCall && op != bpfJmpExit
+}
+
+// encode serializes insns, pointing jumps that go out of bounds or into the middle
+// of a wide instruction to a random following instruction.
+func (t bpfText) encode(r *rand.Rand, insns []bpfInsn) []byte {
+	var slots []int // slot index of each instruction
+	total := 0
+	for _, insn := range insns {
+		slots = append(slots, total)
+		total++
+		if insn.code == bpfLdImm64 {
+			total++
+		}
+	}
+	isStart := make(map[int]bool)
+	for _, s := range slots {
+		isStart[s] = true
+	}
+	text := make([]byte, 0, total*bpfInsnSize)
+	for i, insn := range insns {
+		if t.isJump(insn) {
+			target := slots[i] + 1 + int(insn.off)
+			if target <= slots[i] || target >= total || !isStart[target] {
+				target = slots[i] + 1
+				if i+1 < len(insns) {
+					target = slots[i+1+r.Intn(len(insns)-i-1)]
+				}
+				insn.off = int16(target - slots[i] - 1)
+			}
+		}
+		text = t.appendInsn(text, insn.code, insn.dst, insn.src, insn.off, int32(insn.imm))
+		if insn.code == bpfLdImm64 {
+			text = t.appendInsn(text, 0, 0, 0, 0, int32(insn.imm>>32))
+		}
+	}
+	return text
+}
+
+func (t bpfText) appendInsn(text []byte, code, dst, src uint8, off int16, imm int32) []byte {
+	var buf [bpfInsnSize]byte
+	buf[0] = code
+	buf[1] = dst&0xf | src<<4
+	binary.LittleEndian.PutUint16(buf[2:], uint16(off))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(imm))
+	return append(text, buf[:]...)
+}
+
+func (t bpfText) decode(text []byte) []bpfInsn {
+	var insns []bpfInsn
+	for i := 0; i+bpfInsnSize <= len(text); i += bpfInsnSize {
+		insn := bpfInsn{
+			code: text[i],
+			dst:  text[i+1] & 0xf,
+			src:  text[i+1] >> 4,
+			off:  int16(binary.LittleEndian.Uint16(text[i+2:])),
+			imm:  int64(int32(binary.LittleEndian.Uint32(text[i+4:]))),
+		}
+		if insn.code == bpfLdImm64 && i+2*bpfInsnSize <= len(text) {
+			i += bpfInsnSize
+			insn.imm = int64(uint32(insn.imm)) | int64(binary.LittleEndian.Uint32(text[i+4:]))<<32
+		}
+		insns = append(insns, insn)
+	}
+	return insns
+}
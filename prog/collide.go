@@ -0,0 +1,75 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"math/rand"
+)
+
+// Collide returns a copy of p for a collided execution that tries to provoke data races:
+// random pairs of adjacent calls are issued concurrently from different threads
+// (the first call of a pair is marked as Async, so executor does not wait for its completion).
+// Calls that produce resources used by the next call are not paired,
+// since the next call would not get the resource anyway.
+// Fault injection and delays are dropped from the copy.
+func (p *Prog) Collide(rs rand.Source) *Prog {
+	r := newRand(rs)
+	p1 := p.Clone()
+	for _, c := range p1.Calls {
+		c.FailNth = 0
+		c.Async = false
+		c.Delay = 0
+	}
+	for i := 0; i+1 < len(p1.Calls); i++ {
+		c := p1.Calls[i]
+		if !r.bin() || usesResultsOf(p1.Calls[i+1], c) {
+			continue
+		}
+		c.Async = true
+		i++ // the next call is already paired
+	}
+	return p1
+}
+
+// MaxScheduleDelay is the maximum delay (in microseconds) PerturbSchedule inserts before a call.
+const MaxScheduleDelay = 10000
+
+// PerturbSchedule returns a copy of p with a random schedule of calls that tries to
+// trigger races that don't show up with the default schedule and with Collide:
+// random calls are marked as Async (so that they run concurrently with the following calls)
+// and random calls get a Delay that shifts them relative to the still running async calls.
+// The schedule is recorded in call attributes, so the copy replays the same schedule.
+// The schedule is determined by rs, so a perturbation can be reproduced from its seed as well.
+// Fault injection attributes are preserved.
+func (p *Prog) PerturbSchedule(rs rand.Source) *Prog {
+	r := newRand(rs)
+	p1 := p.Clone()
+	for i, c := range p1.Calls {
+		c.Async = i+1 < len(p1.Calls) && r.bin() && !usesResultsOf(p1.Calls[i+1], c)
+		c.Delay = 0
+		if i != 0 && p1.Calls[i-1].Async && !r.oneOf(3) {
+			// Delays make sense mostly after async calls, otherwise the previous call is already finished.
+			// Prefer short delays, most races have a narrow window.
+			c.Delay = r.Intn(MaxScheduleDelay>>uint(r.Intn(10))) + 1
+		}
+	}
+	return p1
+}
+
+// usesResultsOf returns true if call c uses results produced by call c0.
+func usesResultsOf(c, c0 *Call) bool {
+	produced := map[*Arg]bool{c0.Ret: true}
+	foreachArg(c0, func(arg, _ *Arg, _ *[]*Arg) {
+		if len(arg.Uses) != 0 {
+			produced[arg] = true
+		}
+	})
+	uses := false
+	foreachArg(c, func(arg, _ *Arg, _ *[]*Arg) {
+		if arg.Kind == ArgResult && produced[arg.Res] {
+			uses = true
+		}
+	})
+	return uses
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCollide(t *testing.T) {
+	rs, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		p := Generate(rs, 10, nil)
+		p.Calls[0].FailNth = 1
+		data0 := p.Serialize()
+		p1 := p.Collide(rs)
+		if data := p.Serialize(); !bytes.Equal(data0, data) {
+			t.Fatalf("program changed after collide\noriginal:\n%s\n\nnew:\n%s\n", data0, data)
+		}
+		for j, c := range p1.Calls {
+			if c.FailNth != 0 {
+				t.Fatalf("call %v injects fault after collide:\n%s", j, p1.Serialize())
+			}
+			if !c.Async {
+				continue
+			}
+			if j == len(p1.Calls)-1 {
+				t.Fatalf("last call is async:\n%s", p1.Serialize())
+			}
+			if p1.Calls[j+1].Async {
+				t.Fatalf("calls %v and %v are both async:\n%s", j, j+1, p1.Serialize())
+			}
+			if usesResultsOf(p1.Calls[j+1], c) {
+				t.Fatalf("call %v uses results of async call %v:\n%s", j+1, j, p1.Serialize())
+			}
+		}
+		p2, err := Deserialize(p1.Serialize())
+		if err != nil {
+			t.Fatalf("failed to deserialize collided program: %v\n%s", err, p1.Serialize())
+		}
+		for j, c := range p2.Calls {
+			if c.Async != p1.Calls[j].Async {
+				t.Fatalf("call %v: async attribute is lost after serialization:\n%s", j, p1.Serialize())
+			}
+		}
+	}
+}
+
+func TestPerturbSchedule(t *testing.T) {
+	rs, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		p := Generate(rs, 10, nil)
+		p.Calls[0].FailNth = 1
+		data0 := p.Serialize()
+		p1 := p.PerturbSchedule(rs)
+		if data := p.Serialize(); !bytes.Equal(data0, data) {
+			t.Fatalf("program changed after perturbation\noriginal:\n%s\n\nnew:\n%s\n", data0, data)
+		}
+		if p1.Calls[0].FailNth != 1 {
+			t.Fatalf("fault is lost after perturbation:\n%s", p1.Serialize())
+		}
+		for j, c := range p1.Calls {
+			if c.Async && j == len(p1.Calls)-1 {
+				t.Fatalf("last call is async:\n%s", p1.Serialize())
+			}
+			if c.Delay < 0 || c.Delay > MaxScheduleDelay {
+				t.Fatalf("call %v has bad delay %v:\n%s", j, c.Delay, p1.Serialize())
+			}
+		}
+		data1 := p1.Serialize()
+		p2, err := Deserialize(data1)
+		if err != nil {
+			t.Fatalf("failed to deserialize perturbed program: %v\n%s", err, data1)
+		}
+		if data2 := p2.Serialize(); !bytes.Equal(data1, data2) {
+			t.Fatalf("schedule is lost after serialization:\n%s\nwant:\n%s", data2, data1)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/syzkaller/sys"
+)
+
+// ExecProg is a decoded exec program, see encodingexec.go for the format description.
+type ExecProg struct {
+	Magic   uintptr
+	Version uintptr
+	Flags   uintptr
+	Arch    uintptr
+	Calls   []*ExecCall
+}
+
+type ExecCall struct {
+	Meta    *sys.Call
+	Index   uintptr // result index of the call
+	Timeout uintptr // in ms, 0 means default
+	Async   bool
+	Delay   uintptr // in us, 0 means no delay
+	Args    []*ExecArg
+	Copyin  []*ExecCopyin // executed before the call
+	Copyout []*ExecCopyout
+}
+
+type ExecCopyin struct {
+	Addr uintptr
+	Arg  *ExecArg
+}
+
+type ExecCopyout struct {
+	Index uintptr // result index of the copyout
+	Addr  uintptr
+	Size  uintptr
+}
+
+type ExecArg struct {
+	Kind  uintptr // ExecArgConst/ExecArgResult/ExecArgData/ExecArgGlob
+	Size  uintptr
+	Value uintptr // for ExecArgConst
+	Index uintptr // for ExecArgResult
+	OpDiv uintptr // for ExecArgResult
+	OpAdd uintptr // for ExecArgResult
+	Data  []byte  // for ExecArgData and ExecArgGlob
+}
+
+// DecodeExec decodes a program serialized with SerializeForExec.
+func DecodeExec(data []byte) (*ExecProg, error) {
+	dec := &execDecoder{data: data}
+	p := &ExecProg{
+		Magic:   dec.read(),
+		Version: dec.read(),
+		Flags:   dec.read(),
+		Arch:    dec.read(),
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	if p.Magic != ExecMagic {
+		return nil, fmt.Errorf("bad exec magic 0x%x", p.Magic)
+	}
+	if p.Version != ExecVersion {
+		return nil, fmt.Errorf("unsupported exec version %v, want %v", p.Version, ExecVersion)
+	}
+	var copyins []*ExecCopyin
+	var instrSeq, timeout, delay uintptr
+	async := false
+	for dec.err == nil {
+		switch instr := dec.read(); instr {
+		case ExecInstrEOF:
+			if len(copyins) != 0 || timeout != 0 || async || delay != 0 {
+				return nil, fmt.Errorf("copyin/timeout/async/delay instructions at the end of program")
+			}
+			return p, nil
+		case ExecInstrCopyin:
+			addr := dec.read()
+			copyins = append(copyins, &ExecCopyin{Addr: addr, Arg: dec.readArg(true)})
+			instrSeq++
+		case ExecInstrCopyout:
+			if len(p.Calls) == 0 {
+				return nil, fmt.Errorf("copyout instruction before the first call")
+			}
+			c := p.Calls[len(p.Calls)-1]
+			c.Copyout = append(c.Copyout, &ExecCopyout{
+				Index: instrSeq,
+				Addr:  dec.read(),
+				Size:  dec.read(),
+			})
+			instrSeq++
+		case ExecInstrTimeout:
+			timeout = dec.read()
+			instrSeq++
+		case ExecInstrAsync:
+			async = true
+			instrSeq++
+		case ExecInstrDelay:
+			delay = dec.read()
+			instrSeq++
+		default:
+			if instr >= uintptr(len(sys.Calls)) {
+				return nil, fmt.Errorf("bad call ID %v", instr)
+			}
+			c := &ExecCall{
+				Meta:    sys.Calls[instr],
+				Index:   instrSeq,
+				Timeout: timeout,
+				Async:   async,
+				Delay:   delay,
+				Copyin:  copyins,
+			}
+			copyins, timeout, async, delay = nil, 0, false, 0
+			instrSeq++
+			nargs := dec.read()
+			if nargs > uintptr(len(c.Meta.Args)) {
+				return nil, fmt.Errorf("call %v has %v args, want %v", c.Meta.Name, nargs, len(c.Meta.Args))
+			}
+			for i := uintptr(0); i < nargs; i++ {
+				c.Args = append(c.Args, dec.readArg(false))
+			}
+			p.Calls = append(p.Calls, c)
+		}
+	}
+	return nil, dec.err
+}
+
+type execDecoder struct {
+	data []byte
+	err  error
+}
+
+func (dec *execDecoder) read() uintptr {
+	if dec.err != nil {
+		return 0
+	}
+	if len(dec.data) < 8 {
+		dec.err = fmt.Errorf("exec program overflow")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(dec.data)
+	dec.data = dec.data[8:]
+	return uintptr(v)
+}
+
+func (dec *execDecoder) readArg(allowData bool) *ExecArg {
+	arg := &ExecArg{
+		Kind: dec.read(),
+		Size: dec.read(),
+	}
+	switch arg.Kind {
+	case ExecArgConst:
+		arg.Value = dec.read()
+	case ExecArgResult:
+		arg.Index = dec.read()
+		arg.OpDiv = dec.read()
+		arg.OpAdd = dec.read()
+	case ExecArgData, ExecArgGlob:
+		if !allowData {
+			dec.setErr(fmt.Errorf("data arg outside of copyin"))
+			break
+		}
+		padded := (arg.Size + 7) / 8 * 8
+		if uintptr(len(dec.data)) < padded {
+			dec.setErr(fmt.Errorf("exec program overflow"))
+			break
+		}
+		arg.Data = append([]byte{}, dec.data[:arg.Size]...)
+		dec.data = dec.data[padded:]
+	default:
+		dec.setErr(fmt.Errorf("bad arg kind %v", arg.Kind))
+	}
+	return arg
+}
+
+func (dec *execDecoder) setErr(err error) {
+	if dec.err == nil {
+		dec.err = err
+	}
+}
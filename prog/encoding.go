@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 
 	"github.com/google/syzkaller/sys"
 )
@@ -27,6 +28,16 @@ func (p *Prog) String() string {
 }
 
 func (p *Prog) Serialize() []byte {
+	return p.serialize(true)
+}
+
+// SerializeNoComments is like Serialize, but omits call comments,
+// so that programs that differ only in comments serialize identically.
+func (p *Prog) SerializeNoComments() []byte {
+	return p.serialize(false)
+}
+
+func (p *Prog) serialize(comments bool) []byte {
 	/*
 		if err := p.validate(); err != nil {
 			panic("serializing invalid program")
@@ -51,11 +62,33 @@ func (p *Prog) Serialize() []byte {
 			}
 			a.serialize(buf, vars, &varSeq)
 		}
-		fmt.Fprintf(buf, ")\n")
+		fmt.Fprintf(buf, ")")
+		var attrs []string
+		if c.FailNth != 0 {
+			attrs = append(attrs, fmt.Sprintf("fail_nth: %v", c.FailNth))
+		}
+		if c.Async {
+			attrs = append(attrs, "async")
+		}
+		if c.Delay != 0 {
+			attrs = append(attrs, fmt.Sprintf("delay: %v", c.Delay))
+		}
+		if len(attrs) != 0 {
+			fmt.Fprintf(buf, " (%v)", strings.Join(attrs, ", "))
+		}
+		if comments && c.Comment != "" {
+			fmt.Fprintf(buf, " # %v", serializeComment(c.Comment))
+		}
+		fmt.Fprintf(buf, "\n")
 	}
 	return buf.Bytes()
 }
 
+// serializeComment makes the comment fit into a single line.
+func serializeComment(comment string) string {
+	return strings.TrimSpace(strings.Replace(strings.Replace(comment, "\r", " ", -1), "\n", " ", -1))
+}
+
 func (a *Arg) serialize(buf io.Writer, vars map[*Arg]int, varSeq *int) {
 	if a == nil {
 		fmt.Fprintf(buf, "nil")
@@ -118,6 +151,16 @@ func (a *Arg) serialize(buf io.Writer, vars map[*Arg]int, varSeq *int) {
 }
 
 func Deserialize(data []byte) (prog *Prog, err error) {
+	prog, _, err = deserialize(data, false)
+	return
+}
+
+// deserialize parses program in text format. In lossy mode calls with unknown names
+// are replaced with a variant of the same syscall that accepts the arguments (or dropped),
+// arguments that can't be parsed, missing arguments and arguments of replaced calls
+// are left nil for the caller to fill in, extra arguments are dropped.
+// Returns number of calls that were fixed up.
+func deserialize(data []byte, lossy bool) (prog *Prog, fixed int, err error) {
 	prog = new(Prog)
 	p := &parser{r: bufio.NewScanner(bytes.NewReader(data))}
 	p.r.Buffer(nil, maxLineLen)
@@ -135,50 +178,175 @@ func Deserialize(data []byte) (prog *Prog, err error) {
 
 		}
 		meta := sys.CallMap[name]
-		if meta == nil {
-			return nil, fmt.Errorf("unknown syscall %v", name)
-		}
-		c := &Call{
-			Meta: meta,
-			Ret:  returnArg(meta.Ret),
-		}
-		prog.Calls = append(prog.Calls, c)
-		p.Parse('(')
-		for i := 0; p.Char() != ')'; i++ {
-			if i >= len(meta.Args) {
-				return nil, fmt.Errorf("wrong call arg count: %v, want %v", i+1, len(meta.Args))
+		var c *Call
+		if meta != nil {
+			var callFixed bool
+			c, callFixed, err = parseCall(p, meta, vars, lossy)
+			if err != nil {
+				return nil, 0, err
 			}
-			typ := meta.Args[i]
-			if sys.IsPad(typ) {
-				return nil, fmt.Errorf("padding in syscall %v arguments", name)
+			if callFixed {
+				fixed++
 			}
-			arg, err := parseArg(typ, p, vars)
-			if err != nil {
-				return nil, err
+		} else if !lossy {
+			return nil, 0, fmt.Errorf("unknown syscall %v", name)
+		} else {
+			// The call was probably renamed, try other variants of the same syscall.
+			fixed++
+			c = parseRenamedCall(p, name, vars)
+			if c == nil {
+				continue
 			}
-			c.Args = append(c.Args, arg)
+		}
+		prog.Calls = append(prog.Calls, c)
+		if r != "" {
+			vars[r] = c.Ret
+		}
+	}
+	if err := p.Err(); err != nil {
+		return nil, 0, err
+	}
+	if lossy {
+		return prog, fixed, nil
+	}
+	if err := prog.validate(); err != nil {
+		return nil, 0, err
+	}
+	return prog, 0, nil
+}
+
+// parseCall parses call arguments, attributes and comment after the call name.
+func parseCall(p *parser, meta *sys.Call, vars map[string]*Arg, lossy bool) (*Call, bool, error) {
+	c := &Call{
+		Meta: meta,
+		Ret:  returnArg(meta.Ret),
+	}
+	fixed := false
+	p.Parse('(')
+	for i := 0; p.e == nil && p.Char() != ')'; i++ {
+		if i >= len(meta.Args) {
+			if !lossy {
+				return nil, false, fmt.Errorf("wrong call arg count: %v, want %v", i+1, len(meta.Args))
+			}
+			fixed = true
+			p.skipArg()
 			if p.Char() != ')' {
 				p.Parse(',')
 			}
+			continue
 		}
-		p.Parse(')')
-		if !p.EOF() {
-			return nil, fmt.Errorf("tailing data (line #%v)", p.l)
+		typ := meta.Args[i]
+		if sys.IsPad(typ) {
+			return nil, false, fmt.Errorf("padding in syscall %v arguments", meta.Name)
 		}
-		if len(c.Args) != len(meta.Args) {
-			return nil, fmt.Errorf("wrong call arg count: %v, want %v", len(c.Args), len(meta.Args))
+		start := p.i
+		arg, err := parseArg(typ, p, vars)
+		if err != nil || p.e != nil || p.Char() != ')' && p.Char() != ',' {
+			if !lossy {
+				if err == nil {
+					err = p.e
+				}
+				if err == nil {
+					err = fmt.Errorf("failed to parse argument %v of %v (line #%v)", i, meta.Name, p.l)
+				}
+				return nil, false, err
+			}
+			fixed = true
+			arg = nil
+			p.e = nil
+			p.i = start
+			p.skipArg()
 		}
-		if r != "" {
-			vars[r] = c.Ret
+		c.Args = append(c.Args, arg)
+		if p.Char() != ')' {
+			p.Parse(',')
 		}
 	}
-	if err := p.Err(); err != nil {
-		return nil, err
+	p.Parse(')')
+	if !p.EOF() && p.Char() == '(' {
+		if err := parseCallAttrs(c, p); err != nil {
+			return nil, false, err
+		}
 	}
-	if err := prog.validate(); err != nil {
-		return nil, err
+	if !p.EOF() && p.Char() == '#' {
+		c.Comment = strings.TrimSpace(p.s[p.i+1:])
+		p.i = len(p.s)
 	}
-	return
+	if !p.EOF() {
+		return nil, false, fmt.Errorf("tailing data (line #%v)", p.l)
+	}
+	if len(c.Args) != len(meta.Args) {
+		if !lossy {
+			return nil, false, fmt.Errorf("wrong call arg count: %v, want %v", len(c.Args), len(meta.Args))
+		}
+		fixed = true
+		for len(c.Args) < len(meta.Args) {
+			c.Args = append(c.Args, nil)
+		}
+	}
+	return c, fixed, nil
+}
+
+// parseRenamedCall tries to parse the rest of the line as arguments of all variants
+// of the syscall of the unknown call name. Returns nil if none of them matches.
+func parseRenamedCall(p *parser, name string, vars map[string]*Arg) *Call {
+	callName := name
+	if pos := strings.IndexByte(name, '$'); pos != -1 {
+		callName = name[:pos]
+	}
+	start := p.i
+	for _, meta := range sys.Calls {
+		if meta.CallName != callName {
+			continue
+		}
+		vars1 := make(map[string]*Arg)
+		for k, v := range vars {
+			vars1[k] = v
+		}
+		p.i, p.e = start, nil
+		c, _, err := parseCall(p, meta, vars1, false)
+		if err == nil && p.e == nil {
+			for k, v := range vars1 {
+				vars[k] = v
+			}
+			return c
+		}
+	}
+	p.i, p.e = len(p.s), nil
+	return nil
+}
+
+// parseCallAttrs parses call attributes, e.g. "(fail_nth: 3, async, delay: 100)".
+func parseCallAttrs(c *Call, p *parser) error {
+	p.Parse('(')
+	for p.e == nil {
+		switch attr := p.Ident(); attr {
+		case "fail_nth":
+			p.Parse(':')
+			nth, err := strconv.Atoi(p.Ident())
+			if err != nil || nth <= 0 {
+				return fmt.Errorf("bad fail_nth value (line #%v)", p.l)
+			}
+			c.FailNth = nth
+		case "async":
+			c.Async = true
+		case "delay":
+			p.Parse(':')
+			delay, err := strconv.Atoi(p.Ident())
+			if err != nil || delay <= 0 {
+				return fmt.Errorf("bad delay value (line #%v)", p.l)
+			}
+			c.Delay = delay
+		default:
+			return fmt.Errorf("unknown call attribute %v (line #%v)", attr, p.l)
+		}
+		if p.Char() != ',' {
+			break
+		}
+		p.Parse(',')
+	}
+	p.Parse(')')
+	return nil
 }
 
 func parseArg(typ sys.Type, p *parser, vars map[string]*Arg) (*Arg, error) {
@@ -233,22 +401,24 @@ func parseArg(typ sys.Type, p *parser, vars map[string]*Arg) (*Arg, error) {
 			return nil, fmt.Errorf("& arg is not a pointer: %#v", typ)
 		}
 		p.Parse('&')
-		page, off, size, err := parseAddr(p, true)
+		addr, off, size, err := parseAddr(p, true)
 		if err != nil {
 			return nil, err
 		}
+		page, off, npages := decodeAddr(addr, off, size, pageSize)
 		p.Parse('=')
 		inner, err := parseArg(typ1, p, vars)
 		if err != nil {
 			return nil, err
 		}
-		arg = pointerArg(typ, page, off, size, inner)
+		arg = pointerArg(typ, page, off, npages, inner)
 	case '(':
-		page, off, _, err := parseAddr(p, false)
+		size, off, _, err := parseAddr(p, false)
 		if err != nil {
 			return nil, err
 		}
-		arg = pageSizeArg(typ, page, off)
+		npages, off := decodePageSize(size, off, pageSize)
+		arg = pageSizeArg(typ, npages, off)
 	case '"':
 		p.Parse('"')
 		val := ""
@@ -268,7 +438,7 @@ func parseArg(typ sys.Type, p *parser, vars map[string]*Arg) (*Arg, error) {
 		}
 		p.Parse('{')
 		var inner []*Arg
-		for i := 0; p.Char() != '}'; i++ {
+		for i := 0; p.e == nil && p.Char() != '}'; i++ {
 			if i >= len(t1.Fields) {
 				return nil, fmt.Errorf("wrong struct arg count: %v, want %v", i+1, len(t1.Fields))
 			}
@@ -298,7 +468,7 @@ func parseArg(typ sys.Type, p *parser, vars map[string]*Arg) (*Arg, error) {
 		}
 		p.Parse('[')
 		var inner []*Arg
-		for i := 0; p.Char() != ']'; i++ {
+		for i := 0; p.e == nil && p.Char() != ']'; i++ {
 			arg, err := parseArg(t1.Type, p, vars)
 			if err != nil {
 				return nil, err
@@ -349,35 +519,76 @@ func parseArg(typ sys.Type, p *parser, vars map[string]*Arg) (*Arg, error) {
 	return arg, nil
 }
 
+// Addresses are serialized as byte offsets in the data region regardless of sys.PageSize,
+// so that textual programs look the same for all targets and programs from targets
+// with a different page size (e.g. 4K pages on amd64 and 64K pages on ppc64le) can be used.
 const (
 	encodingAddrBase = 0x7f0000000000
-	encodingPageSize = 4 << 10
-	maxLineLen       = 64 << 10
+	encodingPageSize = 4 << 10 // serialized addresses are aligned to the smallest page size
+	maxLineLen       = 4 << 20 // programs with filesystem images have long lines
 )
 
 func serializeAddr(a *Arg, base bool) string {
-	page := a.AddrPage * encodingPageSize
+	page, off, size := encodeAddr(a.AddrPage, a.AddrOffset, a.AddrPagesNum, pageSize)
 	if base {
 		page += encodingAddrBase
 	}
 	soff := ""
-	if off := a.AddrOffset; off != 0 {
+	if off != 0 {
 		sign := "+"
 		if off < 0 {
 			sign = "-"
 			off = -off
-			page += encodingPageSize
 		}
 		soff = fmt.Sprintf("%v0x%x", sign, off)
 	}
 	ssize := ""
-	if size := a.AddrPagesNum; size != 0 {
-		size *= encodingPageSize
+	if size != 0 {
 		ssize = fmt.Sprintf("/0x%x", size)
 	}
 	return fmt.Sprintf("(0x%x%v%v)", page, soff, ssize)
 }
 
+// encodeAddr converts a page-based address to the serialized form: byte offset of the page,
+// offset relative to it and size in bytes. Negative offsets are relative to the end of the page,
+// so they are serialized relative to the next page.
+func encodeAddr(page uintptr, off int, npages, pageSize uintptr) (uintptr, int, uintptr) {
+	addr := page * pageSize
+	if off < 0 {
+		addr += pageSize
+	}
+	return addr, off, npages * pageSize
+}
+
+// decodeAddr is the reverse of encodeAddr. Programs serialized on targets with smaller pages
+// can have addresses that are not aligned to pageSize, the rest of such address goes to the offset
+// (and negative offsets become positive), sizes are rounded up to whole pages.
+func decodeAddr(addr uintptr, off int, size, pageSize uintptr) (uintptr, int, uintptr) {
+	npages := (size + pageSize - 1) / pageSize
+	if off >= 0 {
+		return addr / pageSize, off + int(addr%pageSize), npages
+	}
+	if addr%pageSize == 0 && addr != 0 {
+		return addr/pageSize - 1, off, npages
+	}
+	abs := int(addr) + off
+	if abs < 0 {
+		abs = 0
+	}
+	return uintptr(abs) / pageSize, abs % int(pageSize), npages
+}
+
+// decodePageSize converts a serialized length in bytes to whole pages, see decodeAddr.
+func decodePageSize(size uintptr, off int, pageSize uintptr) (uintptr, int) {
+	if off < 0 {
+		page, off, _ := decodeAddr(size, off, 0, pageSize)
+		return page, off
+	}
+	return (size + pageSize - 1) / pageSize, off
+}
+
+// parseAddr parses a serialized address and returns the address (without encodingAddrBase),
+// the offset and the size in bytes.
 func parseAddr(p *parser, base bool) (uintptr, int, uintptr, error) {
 	p.Parse('(')
 	pstr := p.Ident()
@@ -409,7 +620,6 @@ func parseAddr(p *parser, base bool) (uintptr, int, uintptr, error) {
 			return 0, 0, 0, fmt.Errorf("failed to parse addr offset: '%v'", ostr)
 		}
 		if minus {
-			page -= encodingPageSize
 			off = -off
 		}
 	}
@@ -423,8 +633,6 @@ func parseAddr(p *parser, base bool) (uintptr, int, uintptr, error) {
 		}
 	}
 	p.Parse(')')
-	page /= encodingPageSize
-	size /= encodingPageSize
 	return uintptr(page), int(off), uintptr(size), nil
 }
 
@@ -489,6 +697,29 @@ func (p *parser) Parse(ch byte) {
 	p.SkipWs()
 }
 
+// skipArg skips an argument that can't be parsed up to the next ',' or ')' on the same level.
+func (p *parser) skipArg() {
+	depth := 0
+	quoted := false
+	for ; p.i < len(p.s); p.i++ {
+		switch ch := p.s[p.i]; {
+		case quoted:
+			quoted = ch != '"'
+		case ch == '"':
+			quoted = true
+		case ch == '(' || ch == '[' || ch == '{' || ch == '<':
+			depth++
+		case ch == ')' || ch == ']' || ch == '}' || ch == '>':
+			if depth == 0 {
+				return
+			}
+			depth--
+		case ch == ',' && depth == 0:
+			return
+		}
+	}
+}
+
 func (p *parser) SkipWs() {
 	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
 		p.i++
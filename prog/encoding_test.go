@@ -4,7 +4,9 @@
 package prog
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"sort"
 	"testing"
@@ -93,3 +95,201 @@ func TestCallSetRandom(t *testing.T) {
 		}
 	}
 }
+
+func TestSerializeComments(t *testing.T) {
+	data := []byte("mmap(&(0x7f0000000000/0x1000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0) # from strace pid 1234\n" +
+		"# a standalone comment\n" +
+		"r0 = open(&(0x7f0000000000)=\"2e2f66696c653000\", 0x0, 0x0)\n" +
+		"close(r0) #minimized from crash X \n")
+	p, err := Deserialize(data)
+	if err != nil {
+		t.Fatalf("failed to deserialize program: %v", err)
+	}
+	want := []string{"from strace pid 1234", "", "minimized from crash X"}
+	for i, c := range p.Calls {
+		if c.Comment != want[i] {
+			t.Fatalf("call %v: got comment %q, want %q", i, c.Comment, want[i])
+		}
+	}
+	p.Calls[1].Comment = "multi\nline"
+	p1, err := Deserialize(p.Clone().Serialize())
+	if err != nil {
+		t.Fatalf("failed to deserialize program: %v", err)
+	}
+	want[1] = "multi line"
+	for i, c := range p1.Calls {
+		if c.Comment != want[i] {
+			t.Fatalf("call %v: got comment %q after round trip, want %q", i, c.Comment, want[i])
+		}
+	}
+	noComments := p.SerializeNoComments()
+	if bytes.Contains(noComments, []byte("#")) {
+		t.Fatalf("serialized program contains comments:\n%s", noComments)
+	}
+	for _, c := range p1.Calls {
+		c.Comment = ""
+	}
+	if data1 := p1.Serialize(); !bytes.Equal(noComments, data1) {
+		t.Fatalf("program without comments serialized differently:\n%s\nvs:\n%s", noComments, data1)
+	}
+}
+
+func TestSerializeCallAttrs(t *testing.T) {
+	data := []byte("mmap(&(0x7f0000000000/0x1000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0)\n" +
+		"r0 = open(&(0x7f0000000000)=\"2e2f66696c653000\", 0x0, 0x0) (fail_nth: 3, async) # comment\n" +
+		"close(r0) (delay: 100)\n")
+	p, err := Deserialize(data)
+	if err != nil {
+		t.Fatalf("failed to deserialize program: %v", err)
+	}
+	want := []int{0, 3, 0}
+	for i, c := range p.Calls {
+		if c.FailNth != want[i] {
+			t.Fatalf("call %v: got fail_nth %v, want %v", i, c.FailNth, want[i])
+		}
+	}
+	if !p.Calls[1].Async || p.Calls[0].Async || p.Calls[2].Async {
+		t.Fatalf("async attribute is not parsed")
+	}
+	if p.Calls[2].Delay != 100 || p.Calls[0].Delay != 0 || p.Calls[1].Delay != 0 {
+		t.Fatalf("delay attribute is not parsed")
+	}
+	if p.Calls[1].Comment != "comment" {
+		t.Fatalf("got comment %q, want %q", p.Calls[1].Comment, "comment")
+	}
+	if data1 := p.Clone().Serialize(); !bytes.Equal(data, data1) {
+		t.Fatalf("program changed after round trip:\n%s\nwant:\n%s", data1, data)
+	}
+	for _, bad := range []string{
+		"close(0xffffffffffffffff) (fail_nth: 0)\n",
+		"close(0xffffffffffffffff) (fail_nth: x)\n",
+		"close(0xffffffffffffffff) (fail: 1)\n",
+		"close(0xffffffffffffffff) (async, )\n",
+		"close(0xffffffffffffffff) (delay: 0)\n",
+		"close(0xffffffffffffffff) (delay: -1)\n",
+		"close(0xffffffffffffffff) (fail_nth: 1)\nclose(0xffffffffffffffff) (fail_nth: 2)\n",
+	} {
+		if _, err := Deserialize([]byte(bad)); err == nil {
+			t.Fatalf("deserialized bad program:\n%s", bad)
+		}
+	}
+}
+
+func TestSerializeLongLines(t *testing.T) {
+	// Programs with filesystem images contain hundreds of kilobytes of data in a single call.
+	data := []byte(fmt.Sprintf("mmap(&(0x7f0000000000/0x41000)=nil, (0x41000), 0x3, 0x32, 0xffffffffffffffff, 0x0)\n"+
+		"write(0xffffffffffffffff, &(0x7f0000001000)=\"%x\", 0x40000)\n", bytes.Repeat([]byte{0xab}, 256<<10)))
+	p, err := Deserialize(data)
+	if err != nil {
+		t.Fatalf("failed to deserialize program: %v", err)
+	}
+	if data1 := p.Serialize(); !bytes.Equal(data, data1) {
+		t.Fatalf("program changed after round trip")
+	}
+	if _, err := CallSet(data); err != nil {
+		t.Fatalf("CallSet failed: %v", err)
+	}
+}
+
+func TestAddrEncoding(t *testing.T) {
+	type addr struct {
+		page, npages uintptr
+		off          int
+	}
+	for _, pageSize := range []uintptr{4 << 10, 64 << 10} {
+		for _, a := range []addr{
+			{0, 1, 0},
+			{1, 0, 0},
+			{3, 2, 0x10},
+			{5, 1, -0x10},
+			{7, 0, -int(pageSize)},
+		} {
+			enc, off, size := encodeAddr(a.page, a.off, a.npages, pageSize)
+			page, off, npages := decodeAddr(enc, off, size, pageSize)
+			if got := (addr{page, npages, off}); got != a {
+				t.Errorf("page size 0x%x: address %+v changed after round trip: %+v", pageSize, a, got)
+			}
+		}
+	}
+	// Addresses from programs serialized on targets with 4K pages.
+	const pageSize = 64 << 10
+	for _, test := range []struct {
+		addr, size uintptr
+		off        int
+		res        addr
+	}{
+		{0x1000, 0x1000, 0, addr{0, 1, 0x1000}},
+		{0x11000, 0x2000, 0x10, addr{1, 1, 0x1010}},
+		{0x20000, 0x21000, -0x10, addr{1, 3, -0x10}},
+		{0x3000, 0, -0x10, addr{0, 0, 0x2ff0}},
+		{0, 0, -0x10, addr{0, 0, 0}},
+	} {
+		page, off, npages := decodeAddr(test.addr, test.off, test.size, pageSize)
+		if got := (addr{page, npages, off}); got != test.res {
+			t.Errorf("address 0x%x%+d/0x%x: got %+v, want %+v", test.addr, test.off, test.size, got, test.res)
+		}
+	}
+}
+
+// TestDeserializeMalformed feeds corrupted serialized programs to the parser,
+// programs come from corpora and the hub, so malformed input must produce errors, not panics.
+func TestDeserializeMalformed(t *testing.T) {
+	rs, iters := initTest(t)
+	r := rand.New(rs)
+	// Tokens that can turn a valid program into a malformed one.
+	tokens := []string{"(", ")", "[", "]", "{", "}", "<", ">", "&", "@", "=", ",", "\"", "/", "+", "-", "r0",
+		"r99", "0x0", "0xffffffffffffffff", "0x7f0000000000", "0x7fffffffffff", "0x7f0000000000/0xfffffffffffff000",
+		"(0xfffffffffffff000)", "(0x1000-0x1000)", "&(0x7f0000000000)=nil", "nil", "\"00\"", "syz_test", "mmap",
+		"(fail_nth: 1)", "(async)", "(delay: 1)", "#", "\n", " "}
+	for i := 0; i < iters; i++ {
+		data := []byte(Generate(rs, 10, nil).Serialize())
+		for n := r.Intn(5) + 1; n > 0 && len(data) != 0; n-- {
+			pos := r.Intn(len(data))
+			switch r.Intn(4) {
+			case 0:
+				data = append(data[:pos:pos], data[pos+r.Intn(len(data)-pos)+1:]...)
+			case 1:
+				data = append(data[:pos:pos], append([]byte(tokens[r.Intn(len(tokens))]), data[pos:]...)...)
+			case 2:
+				data[pos] = byte(r.Intn(256))
+			case 3:
+				end := pos + r.Intn(len(data)-pos)
+				data = append(data[:end:end], append(data[pos:end:end], data[end:]...)...)
+			}
+		}
+		checkMalformed(t, data)
+	}
+	for _, data := range []string{
+		"mmap(&(0x7f0000000000/0x1000)=nil, (0xfffffffffffff000), 0x3, 0x32, 0xffffffffffffffff, 0x0)",
+		"mmap(&(0x7ffffffff000/0x1000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0)",
+		"mmap(&(0x7f0000000000/0xfffffffffffff000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0)",
+		"mmap(&(0x7f0000000000-0x7fffffffffff)=nil, (0x1000-0x7fffffffffff), 0x3, 0x32, 0xffffffffffffffff, 0x0)",
+		"mmap(&(0x7f0000000000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0)",
+		"munmap(&(0x7f0000000000/0x1000)=nil, (0xffffffffff000))",
+		"r0 = socket(0x2, 0x1, 0x0)\nclose(r0/0x0+0xffffffffffffffff)",
+		"r0 = socket(0x2, 0x1, 0x0)\nr0 = socket(0x2, 0x1, 0x0)\nclose(r0)",
+		"syz_test$align0(&(0x7f0000000000)={0x0, 0x0, 0x0, 0x0, 0x0, 0x0})",
+		"syz_test$union0(&(0x7f0000000000)={0x0, @f1=0x0})",
+		"syz_test$array0(&(0x7f0000000000)={0x0, [@f0=0x0, @f1=[0x0, 0x0]], 0x0})",
+	} {
+		checkMalformed(t, []byte(data))
+	}
+}
+
+// checkMalformed deserializes data and does with the program what the fuzzer does with corpus programs.
+func checkMalformed(t *testing.T, data []byte) {
+	defer func() {
+		if err := recover(); err != nil {
+			t.Fatalf("panic on malformed program: %v\n%s", err, data)
+		}
+	}()
+	CallSet(data)
+	Migrate(data, nil)
+	p, err := Deserialize(data)
+	if err != nil {
+		return
+	}
+	p.Serialize()
+	p.SerializeForExec(0)
+	p.Clone().Mutate(rand.NewSource(0), 10, nil, nil)
+}
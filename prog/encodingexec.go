@@ -3,11 +3,42 @@
 
 // This file does serialization of programs for executor binary.
 // The format aims at simple parsing: binary and irreversible.
+//
+// Exec format is a sequence of little-endian uint64 words.
+// It starts with a header:
+//	ExecMagic, ExecVersion, flags (reserved, 0), sys.ArchID
+// Executor checks the header and fails if it does not match its own
+// magic/version/arch, so mismatching fuzzer and executor binaries are detected early.
+// The header is followed by a sequence of instructions terminated with ExecInstrEOF.
+// An instruction is one of:
+//	- a syscall: call ID, number of arguments, arguments...
+//	- ExecInstrCopyin, address, argument: copies argument into memory at address
+//	- ExecInstrCopyout, address, size: reads value at address after the preceding
+//	  syscall completes, the value can be referenced by ExecArgResult arguments
+//	- ExecInstrTimeout, timeout: execution timeout in ms for the following syscall
+//	  (emitted only for calls with non-default timeout, see sys.Call.Timeout)
+//	- ExecInstrAsync: executor does not wait for completion of the following syscall
+//	  before issuing the next one (emitted only for calls with Async attribute)
+//	- ExecInstrDelay, delay: executor sleeps for delay microseconds before issuing
+//	  the following syscall (emitted only for calls with Delay attribute)
+// Each instruction (except for ExecInstrEOF) is assigned a sequential index,
+// results of syscall and copyout instructions are referenced by these indexes.
+// An argument is one of:
+//	- ExecArgConst, size, value: a constant value
+//	- ExecArgResult, size, index, div, add: result with the given index
+//	  (or default value if it is not available) transformed as result/div+add
+//	- ExecArgData, size, data: a binary blob of the given size padded to 8 bytes
+//	  (only allowed in copyin instructions); integers of fmt types are also
+//	  serialized as data with the textual representation of the value
+//	- ExecArgGlob, size, data: same as ExecArgData, but data is a glob pattern that
+//	  executor replaces with one of the matching file names (see sys.GlobSize)
+// DecodeExec parses this format back, it is mostly intended for testing.
 
 package prog
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/google/syzkaller/sys"
 )
@@ -16,37 +47,67 @@ const (
 	ExecInstrEOF = ^uintptr(iota)
 	ExecInstrCopyin
 	ExecInstrCopyout
+	ExecInstrTimeout
+	ExecInstrAsync
+	ExecInstrDelay
 )
 
 const (
 	ExecArgConst = uintptr(iota)
 	ExecArgResult
 	ExecArgData
+	ExecArgGlob
 )
 
 const (
-	ptrSize    = 8
-	pageSize   = 4 << 10
-	dataOffset = 512 << 20
+	ExecMagic   = uintptr(0x53595a4b45584543) // "SYZKEXEC"
+	ExecVersion = uintptr(5)                  // bump on any incompatible format change
 )
 
+const (
+	ptrSize    = sys.PtrSize
+	pageSize   = sys.PageSize   // depends on the target, see sys.NumPages
+	dataOffset = sys.DataOffset // start of the data region in target address space
+)
+
+// SerializeForExec serializes program p for execution by process pid.
 func (p *Prog) SerializeForExec(pid int) []byte {
+	w := getExecContext(nil)
+	defer putExecContext(w)
+	p.serializeForExec(w, pid)
+	return append([]byte{}, w.buf...)
+}
+
+// SerializeForExecBuf serializes program p for execution by process pid
+// into the provided buffer and returns the number of bytes written.
+// Unlike SerializeForExec it does not allocate memory for the result,
+// so it is suitable for serializing programs directly into executor input buffer.
+// If the program does not fit into the buffer, an error is returned.
+func (p *Prog) SerializeForExecBuf(buffer []byte, pid int) (int, error) {
+	w := getExecContext(buffer)
+	defer putExecContext(w)
+	p.serializeForExec(w, pid)
+	if w.eof {
+		return 0, fmt.Errorf("program does not fit into %v byte buffer", len(buffer))
+	}
+	return len(w.buf), nil
+}
+
+func (p *Prog) serializeForExec(w *execContext, pid int) {
 	if err := p.validate(); err != nil {
 		panic(fmt.Errorf("serializing invalid program: %v", err))
 	}
+	w.write(ExecMagic)
+	w.write(ExecVersion)
+	w.write(0) // flags
+	w.write(sys.ArchID)
 	var instrSeq uintptr
-	w := &execContext{args: make(map[*Arg]*argInfo)}
 	for _, c := range p.Calls {
-		// Calculate arg offsets within structs.
-		foreachArg(c, func(arg, base *Arg, _ *[]*Arg) {
-			if base == nil || arg.Kind == ArgGroup || arg.Kind == ArgUnion {
-				return
-			}
-			if w.args[base] == nil {
-				w.args[base] = &argInfo{}
+		// Calculate arg offsets within pointed-to data.
+		foreachArg(c, func(arg, _ *Arg, _ *[]*Arg) {
+			if arg.Kind == ArgPointer && arg.Res != nil {
+				w.calcOffsets(arg.Res, 0)
 			}
-			w.args[arg] = &argInfo{Offset: w.args[base].CurSize}
-			w.args[base].CurSize += arg.Size()
 		})
 		// Generate copyin instructions that fill in data into pointer arguments.
 		foreachArg(c, func(arg, _ *Arg, _ *[]*Arg) {
@@ -80,6 +141,20 @@ func (p *Prog) SerializeForExec(pid int) []byte {
 			}
 		})
 		// Generate the call itself.
+		if c.Meta.Timeout != 0 {
+			w.write(ExecInstrTimeout)
+			w.write(uintptr(c.Meta.Timeout))
+			instrSeq++
+		}
+		if c.Async {
+			w.write(ExecInstrAsync)
+			instrSeq++
+		}
+		if c.Delay != 0 {
+			w.write(ExecInstrDelay)
+			w.write(uintptr(c.Delay))
+			instrSeq++
+		}
 		w.write(uintptr(c.Meta.ID))
 		w.write(uintptr(len(c.Args)))
 		for _, arg := range c.Args {
@@ -112,7 +187,29 @@ func (p *Prog) SerializeForExec(pid int) []byte {
 		})
 	}
 	w.write(ExecInstrEOF)
-	return w.buf
+}
+
+// calcOffsets assigns offsets from the base pointer to arg and all its subargs
+// (except for data referenced by nested pointers), arg is located at offset off.
+func (w *execContext) calcOffsets(arg *Arg, off uintptr) {
+	w.args[arg] = &argInfo{Offset: off}
+	switch arg.Kind {
+	case ArgGroup:
+		overlay := -1
+		if typ, ok := arg.Type.(*sys.StructType); ok && typ.OverlayField != 0 {
+			overlay = typ.OverlayField
+		}
+		start := off
+		for i, arg1 := range arg.Inner {
+			if i == overlay {
+				off = start // output layout starts from the beginning of the struct
+			}
+			w.calcOffsets(arg1, off)
+			off += arg1.Size()
+		}
+	case ArgUnion:
+		w.calcOffsets(arg.Option, off)
+	}
 }
 
 func physicalAddr(arg *Arg) uintptr {
@@ -129,23 +226,65 @@ func physicalAddr(arg *Arg) uintptr {
 }
 
 type execContext struct {
-	buf  []byte
-	args map[*Arg]*argInfo
+	buf   []byte
+	fixed bool // buf is provided by caller and must not be reallocated
+	eof   bool // fixed buf has overflowed
+	args  map[*Arg]*argInfo
+}
+
+// execContexts caches serialization contexts (output buffers and arg maps)
+// across SerializeForExec invocations, as programs are serialized on every execution.
+var execContexts = sync.Pool{
+	New: func() interface{} {
+		return &execContext{args: make(map[*Arg]*argInfo)}
+	},
+}
+
+func getExecContext(buffer []byte) *execContext {
+	w := execContexts.Get().(*execContext)
+	if buffer != nil {
+		w.buf = buffer[:0:len(buffer)]
+		w.fixed = true
+	} else {
+		w.buf = w.buf[:0]
+	}
+	return w
+}
+
+func putExecContext(w *execContext) {
+	if w.fixed {
+		// Don't retain caller's buffer.
+		w.buf = nil
+	}
+	w.fixed = false
+	w.eof = false
+	for arg := range w.args {
+		delete(w.args, arg)
+	}
+	execContexts.Put(w)
 }
 
 type argInfo struct {
-	Offset  uintptr // from base pointer
-	CurSize uintptr
-	Idx     uintptr // instruction index
+	Offset uintptr // from base pointer
+	Idx    uintptr // instruction index
 }
 
 func (w *execContext) write(v uintptr) {
+	if w.fixed && len(w.buf)+8 > cap(w.buf) {
+		w.eof = true
+		return
+	}
 	w.buf = append(w.buf, byte(v>>0), byte(v>>8), byte(v>>16), byte(v>>24), byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
 }
 
 func (w *execContext) writeArg(arg *Arg, pid int) {
 	switch arg.Kind {
 	case ArgConst:
+		if data := arg.FormattedValue(pid); data != nil {
+			// Formatted values are passed as data, so executor does not need to know about formats.
+			w.writeData(data)
+			break
+		}
 		w.write(ExecArgConst)
 		w.write(arg.Size())
 		w.write(arg.Value(pid))
@@ -164,19 +303,31 @@ func (w *execContext) writeArg(arg *Arg, pid int) {
 		w.write(arg.Size())
 		w.write(arg.AddrPage * pageSize)
 	case ArgData:
-		w.write(ExecArgData)
-		w.write(uintptr(len(arg.Data)))
-		for i := 0; i < len(arg.Data); i += 8 {
-			var v uintptr
-			for j := 0; j < 8; j++ {
-				if i+j >= len(arg.Data) {
-					break
-				}
-				v |= uintptr(arg.Data[i+j]) << uint(j*8)
-			}
-			w.write(v)
+		if typ, ok := arg.Type.(*sys.BufferType); ok && typ.Kind == sys.BufferGlob {
+			w.writeBlob(ExecArgGlob, arg.Data)
+			break
 		}
+		w.writeData(arg.Data)
 	default:
 		panic("unknown arg type")
 	}
 }
+
+func (w *execContext) writeData(data []byte) {
+	w.writeBlob(ExecArgData, data)
+}
+
+func (w *execContext) writeBlob(kind uintptr, data []byte) {
+	w.write(kind)
+	w.write(uintptr(len(data)))
+	for i := 0; i < len(data); i += 8 {
+		var v uintptr
+		for j := 0; j < 8; j++ {
+			if i+j >= len(data) {
+				break
+			}
+			v |= uintptr(data[i+j]) << uint(j*8)
+		}
+		w.write(v)
+	}
+}
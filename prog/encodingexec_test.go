@@ -20,27 +20,114 @@ func TestSerializeForExecRandom(t *testing.T) {
 	}
 }
 
+func TestSerializeForExecBuf(t *testing.T) {
+	rs, iters := initTest(t)
+	buf := make([]byte, 2<<20)
+	for i := 0; i < iters; i++ {
+		p := Generate(rs, 10, nil)
+		data := p.SerializeForExec(i % 16)
+		n, err := p.SerializeForExecBuf(buf, i%16)
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		if !bytes.Equal(data, buf[:n]) {
+			t.Fatalf("SerializeForExecBuf result differs from SerializeForExec\n%s", p.Serialize())
+		}
+		if _, err := p.SerializeForExecBuf(buf[:len(data)-8], i%16); err == nil {
+			t.Fatalf("serialized program into too small buffer")
+		}
+	}
+}
+
+func TestDecodeExec(t *testing.T) {
+	rs, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		p := Generate(rs, 10, nil)
+		data := p.SerializeForExec(i % 16)
+		ep, err := DecodeExec(data)
+		if err != nil {
+			t.Fatalf("failed to decode program: %v\n%s", err, p.Serialize())
+		}
+		if ep.Arch != sys.ArchID {
+			t.Fatalf("decoded arch %v, want %v", ep.Arch, sys.ArchID)
+		}
+		if len(ep.Calls) != len(p.Calls) {
+			t.Fatalf("decoded %v calls, want %v\n%s", len(ep.Calls), len(p.Calls), p.Serialize())
+		}
+		for j, c := range ep.Calls {
+			if c.Meta != p.Calls[j].Meta || len(c.Args) != len(p.Calls[j].Args) {
+				t.Fatalf("decoded call %v mismatch: %v(%v args), want %v(%v args)",
+					j, c.Meta.Name, len(c.Args), p.Calls[j].Meta.Name, len(p.Calls[j].Args))
+			}
+			if c.Timeout != uintptr(c.Meta.Timeout) {
+				t.Fatalf("decoded call %v timeout %v, want %v", c.Meta.Name, c.Timeout, c.Meta.Timeout)
+			}
+		}
+		if _, err := DecodeExec(data[:len(data)-8]); err == nil {
+			t.Fatalf("decoded truncated program")
+		}
+	}
+	data := Generate(rs, 10, nil).SerializeForExec(0)
+	data[0]++
+	if _, err := DecodeExec(data); err == nil {
+		t.Fatalf("decoded program with bad magic")
+	}
+}
+
+func TestDecodeExecIndex(t *testing.T) {
+	// Copyin instructions take result indexes too, so the index of open
+	// must account for the copyin of the file name.
+	p, err := Deserialize([]byte("r0 = open(&(0x7f0000000000)=\"2e2f66696c653000\", 0x0, 0x0)\nclose(r0)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := DecodeExec(p.SerializeForExec(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ep.Calls) != 2 || len(ep.Calls[0].Copyin) != 1 || len(ep.Calls[1].Args) != 1 {
+		t.Fatalf("decoded bad program: %+v", ep)
+	}
+	arg := ep.Calls[1].Args[0]
+	if arg.Kind != ExecArgResult || arg.Index != ep.Calls[0].Index {
+		t.Fatalf("close arg refers to result %v (kind %v), open has index %v",
+			arg.Index, arg.Kind, ep.Calls[0].Index)
+	}
+}
+
 func TestSerializeForExec(t *testing.T) {
 	// A brief recap of exec format.
 	// Exec format is an sequence of uint64's which encodes a sequence of calls.
-	// The sequence is terminated by a speciall call ExecInstrEOF.
+	// The sequence starts with a header (magic, version, flags, arch)
+	// and is terminated by a speciall call ExecInstrEOF.
 	// Each call is (call ID, number of arguments, arguments...).
 	// Each argument is (type, size, value).
 	// There are 3 types of arguments:
 	//  - ExecArgConst: value is const value
 	//  - ExecArgResult: value is index of a call whose result we want to reference
 	//  - ExecArgData: value is a binary blob (represented as ]size/8[ uint64's)
-	// There are 2 other special call:
+	//  - ExecArgGlob: same as ExecArgData, but the blob is a glob pattern
+	// There are 5 other special calls:
 	//  - ExecInstrCopyin: copies its second argument into address specified by first argument
 	//  - ExecInstrCopyout: reads value at address specified by first argument (result can be referenced by ExecArgResult)
+	//  - ExecInstrTimeout: sets execution timeout for the next call
+	//  - ExecInstrAsync: executor does not wait for completion of the next call
+	//  - ExecInstrDelay: executor sleeps before issuing the next call
 	const (
 		instrEOF     = uint64(ExecInstrEOF)
 		instrCopyin  = uint64(ExecInstrCopyin)
 		instrCopyout = uint64(ExecInstrCopyout)
+		instrTimeout = uint64(ExecInstrTimeout)
+		instrAsync   = uint64(ExecInstrAsync)
+		instrDelay   = uint64(ExecInstrDelay)
 		argConst     = uint64(ExecArgConst)
 		argResult    = uint64(ExecArgResult)
 		argData      = uint64(ExecArgData)
+		argGlob      = uint64(ExecArgGlob)
 	)
+	glob := make([]byte, sys.GlobSize)
+	copy(glob, "/sys/class/net/*/mtu")
+	glob[len(glob)-1] = 0x3
 	callID := func(name string) uint64 {
 		c := sys.CallMap[name]
 		if c == nil {
@@ -59,6 +146,33 @@ func TestSerializeForExec(t *testing.T) {
 				instrEOF,
 			},
 		},
+		{
+			"sync()",
+			[]uint64{
+				instrTimeout, 1000,
+				callID("sync"), 0,
+				instrEOF,
+			},
+		},
+		{
+			"syz_test() (async)\nsyz_test()",
+			[]uint64{
+				instrAsync,
+				callID("syz_test"), 0,
+				callID("syz_test"), 0,
+				instrEOF,
+			},
+		},
+		{
+			"syz_test() (async)\nsyz_test() (delay: 100)",
+			[]uint64{
+				instrAsync,
+				callID("syz_test"), 0,
+				instrDelay, 100,
+				callID("syz_test"), 0,
+				instrEOF,
+			},
+		},
 		{
 			"syz_test$int(0x1, 0x2, 0x3, 0x4, 0x5)",
 			[]uint64{
@@ -151,6 +265,41 @@ func TestSerializeForExec(t *testing.T) {
 				instrEOF,
 			},
 		},
+		{
+			"syz_test$fmt0(&(0x7f0000000000)={0x1ff, 0x2, 0x8, 0x3e})",
+			join(
+				[]uint64{instrCopyin, dataOffset + 0, argData, 20}, strWords("00000000000000000255"),
+				[]uint64{instrCopyin, dataOffset + 20, argData, 18}, strWords("0x0000000000000002"),
+				[]uint64{instrCopyin, dataOffset + 38, argData, 23}, strWords("00000000000000000000010"),
+				[]uint64{
+					instrCopyin, dataOffset + 61, argConst, 1, 0x3e,
+					callID("syz_test$fmt0"), 1, argConst, ptrSize, dataOffset,
+					instrEOF,
+				},
+			),
+		},
+		{
+			fmt.Sprintf("syz_test$glob0(&(0x7f0000000000)={\"%x\", 0x5})", glob),
+			join(
+				[]uint64{instrCopyin, dataOffset + 0, argGlob, sys.GlobSize}, strWords(string(glob)),
+				[]uint64{
+					instrCopyin, dataOffset + sys.GlobSize, argConst, 1, 0x5,
+					callID("syz_test$glob0"), 1, argConst, ptrSize, dataOffset,
+					instrEOF,
+				},
+			),
+		},
+		{
+			"syz_test$overlay0(&(0x7f0000000000)={0x1, 0x2, 0x0, <r0=>0x0, 0x0})\nclose(r0)",
+			[]uint64{
+				instrCopyin, dataOffset + 0, argConst, 1, 1,
+				instrCopyin, dataOffset + 4, argConst, 4, 2,
+				callID("syz_test$overlay0"), 1, argConst, ptrSize, dataOffset,
+				instrCopyout, dataOffset + 4, 4,
+				callID("close"), 1, argResult, 4, 3, 0, 0,
+				instrEOF,
+			},
+		},
 	}
 
 	for i, test := range tests {
@@ -160,12 +309,13 @@ func TestSerializeForExec(t *testing.T) {
 		}
 		t.Run(fmt.Sprintf("%v:%v", i, p.String()), func(t *testing.T) {
 			data := p.SerializeForExec(i % 16)
+			want := append([]uint64{uint64(ExecMagic), uint64(ExecVersion), 0, sys.ArchID}, test.serialized...)
 			w := new(bytes.Buffer)
-			binary.Write(w, binary.LittleEndian, test.serialized)
+			binary.Write(w, binary.LittleEndian, want)
 			if !bytes.Equal(data, w.Bytes()) {
 				got := make([]uint64, len(data)/8)
 				binary.Read(bytes.NewReader(data), binary.LittleEndian, &got)
-				t.Logf("want: %v", test.serialized)
+				t.Logf("want: %v", want)
 				t.Logf("got:  %v", got)
 				t.Fatalf("mismatch")
 			}
@@ -173,3 +323,24 @@ func TestSerializeForExec(t *testing.T) {
 		})
 	}
 }
+
+// strWords returns string s packed into little-endian uint64 words as in ExecArgData.
+func strWords(s string) []uint64 {
+	var res []uint64
+	for i := 0; i < len(s); i += 8 {
+		var v uint64
+		for j := 0; j < 8 && i+j < len(s); j++ {
+			v |= uint64(s[i+j]) << uint(j*8)
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+func join(parts ...[]uint64) []uint64 {
+	var res []uint64
+	for _, p := range parts {
+		res = append(res, p...)
+	}
+	return res
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+// Hints are mutations driven by comparison operands collected in the kernel
+// (KCOV_TRACE_CMP): if an argument value was compared with some other value,
+// we try to replace the argument with that value to flip the comparison.
+// E.g. if the kernel did "if (cmd == 0x1234)" and the call passed cmd = 0,
+// we get comparison (0, 0x1234) and replace 0 with 0x1234.
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/google/syzkaller/sys"
+)
+
+// CompMap maps a value that was compared in the kernel to the set of values it was compared with.
+type CompMap map[uint64]map[uint64]bool
+
+// AddComp records that arg1 was compared with arg2.
+func (m CompMap) AddComp(arg1, arg2 uint64) {
+	if arg1 == arg2 {
+		return
+	}
+	if m[arg1] == nil {
+		m[arg1] = make(map[uint64]bool)
+	}
+	m[arg1][arg2] = true
+}
+
+// MutateWithHints calls exec for each mutation of call callIndex obtained by replacing
+// an integer argument or a part of a data argument with a value it was compared with
+// (comps are comparisons collected during execution of the call).
+// p is mutated in place and restored after exec returns, so exec must not retain p.
+func (p *Prog) MutateWithHints(callIndex int, comps CompMap, exec func(p *Prog)) {
+	if len(comps) == 0 {
+		return
+	}
+	c := p.Calls[callIndex]
+	args, _ := mutationArgs(c)
+	for _, arg := range args {
+		switch arg.Kind {
+		case ArgConst:
+			mutateConstWithHints(p, arg, comps, exec)
+		case ArgData:
+			mutateDataWithHints(p, arg, comps, exec)
+		}
+	}
+}
+
+func mutateConstWithHints(p *Prog, arg *Arg, comps CompMap, exec func(p *Prog)) {
+	var size uintptr
+	var bigEndian bool
+	switch typ := arg.Type.(type) {
+	case *sys.IntType:
+		size, bigEndian = typ.TypeSize, typ.BigEndian
+	case *sys.FlagsType:
+		size, bigEndian = typ.TypeSize, typ.BigEndian
+	default:
+		return
+	}
+	if size == 0 || size > 8 {
+		return
+	}
+	// Comparisons see the value as it is stored in memory, so swap big-endian values.
+	original := arg.Val
+	v := uint64(encodeValue(original, size, bigEndian))
+	for _, r := range hintReplacers(v, size, comps) {
+		arg.Val = encodeValue(uintptr(r), size, bigEndian)
+		exec(p)
+	}
+	arg.Val = original
+}
+
+func mutateDataWithHints(p *Prog, arg *Arg, comps CompMap, exec func(p *Prog)) {
+	typ, ok := arg.Type.(*sys.BufferType)
+	if !ok || typ.Kind != sys.BufferBlobRand && typ.Kind != sys.BufferBlobRange {
+		return
+	}
+	data := arg.Data
+	var buf [8]byte
+	for off := range data {
+		for _, width := range []int{1, 2, 4, 8} {
+			if off+width > len(data) {
+				break
+			}
+			window := data[off : off+width]
+			copy(buf[:], window)
+			for i := width; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			original := append([]byte{}, window...)
+			v := binary.LittleEndian.Uint64(buf[:])
+			for _, r := range widthReplacers(v, uint(width), comps) {
+				binary.LittleEndian.PutUint64(buf[:], r)
+				copy(window, buf[:width])
+				exec(p)
+			}
+			copy(window, original)
+		}
+	}
+}
+
+// hintReplacers returns sorted unique values that v (an integer of the given size in bytes)
+// can be replaced with. The kernel can compare truncated or sign-extended v,
+// so we also look for comparisons of the lower 1, 2 and 4 bytes of v.
+func hintReplacers(v uint64, size uintptr, comps CompMap) []uint64 {
+	set := make(map[uint64]bool)
+	for _, width := range []uint{1, 2, 4, 8} {
+		if uintptr(width) > size {
+			break
+		}
+		for _, r := range widthReplacers(v, width, comps) {
+			set[r] = true
+		}
+	}
+	var res []uint64
+	for r := range set {
+		res = append(res, r)
+	}
+	sort.Sort(uint64Array(res))
+	return res
+}
+
+// widthReplacers returns values obtained by replacing the lower width bytes of v
+// with values the lower bytes were compared with.
+func widthReplacers(v uint64, width uint, comps CompMap) []uint64 {
+	mask := ^uint64(0) >> (64 - 8*width)
+	low := v & mask
+	keys := []uint64{low}
+	if width < 8 && low&(mask>>1+1) != 0 {
+		// Negative values are sign-extended when compared.
+		keys = append(keys, low|^mask)
+	}
+	var res []uint64
+	for _, key := range keys {
+		for r := range comps[key] {
+			if r&^mask != 0 && r|mask != ^uint64(0) {
+				continue // does not fit into width bytes
+			}
+			if v1 := v&^mask | r&mask; v1 != v {
+				res = append(res, v1)
+			}
+		}
+	}
+	sort.Sort(uint64Array(res))
+	// Both keys can give the same replacer.
+	var uniq []uint64
+	for _, r := range res {
+		if len(uniq) == 0 || r != uniq[len(uniq)-1] {
+			uniq = append(uniq, r)
+		}
+	}
+	return uniq
+}
+
+type uint64Array []uint64
+
+func (a uint64Array) Len() int           { return len(a) }
+func (a uint64Array) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64Array) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
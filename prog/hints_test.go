@@ -0,0 +1,96 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHintReplacers(t *testing.T) {
+	tests := []struct {
+		v     uint64
+		size  uintptr
+		comps CompMap
+		res   []uint64
+	}{
+		{
+			v:     0x1234,
+			size:  8,
+			comps: CompMap{0x1234: {0x5678: true, 0x1: true}},
+			res:   []uint64{0x1, 0x5678},
+		},
+		{
+			// Lower byte of v is compared with a byte constant.
+			v:     0x1234,
+			size:  4,
+			comps: CompMap{0x34: {0x56: true, 0x5678: true}},
+			res:   []uint64{0x1256},
+		},
+		{
+			// Negative int8 is sign-extended in comparison.
+			v:     0xff,
+			size:  1,
+			comps: CompMap{0xffffffffffffffff: {0xfffffffffffffffe: true}},
+			res:   []uint64{0xfe},
+		},
+		{
+			// Replacer does not fit into the value.
+			v:     0x12,
+			size:  1,
+			comps: CompMap{0x12: {0x1234: true}},
+			res:   nil,
+		},
+	}
+	for i, test := range tests {
+		res := hintReplacers(test.v, test.size, test.comps)
+		if !reflect.DeepEqual(res, test.res) {
+			t.Errorf("#%v: got %#v, want %#v", i, res, test.res)
+		}
+	}
+}
+
+func TestMutateWithHints(t *testing.T) {
+	tests := []struct {
+		prog  string
+		comps CompMap
+		res   []string
+	}{
+		{
+			prog:  "syz_test$int(0x1, 0x2, 0x3, 0x4, 0x5)",
+			comps: CompMap{0x2: {0x42: true}, 0x4: {0xfffffffffffffff0: true}},
+			res: []string{
+				"syz_test$int(0x1, 0x42, 0x3, 0x4, 0x5)",
+				"syz_test$int(0x1, 0x2, 0x3, 0xf0, 0x5)",
+				"syz_test$int(0x1, 0x2, 0x3, 0xfff0, 0x5)",
+				"syz_test$int(0x1, 0x2, 0x3, 0xfffffff0, 0x5)",
+			},
+		},
+		{
+			prog:  `write(0xffffffffffffffff, &(0x7f0000000000)="0102030405", 0x5)`,
+			comps: CompMap{0x0201: {0xabcd: true}, 0x05: {0x06: true}},
+			res: []string{
+				`write(0xffffffffffffffff, &(0x7f0000000000)="cdab030405", 0x5)`,
+				`write(0xffffffffffffffff, &(0x7f0000000000)="0102030406", 0x5)`,
+			},
+		},
+	}
+	for i, test := range tests {
+		p, err := Deserialize([]byte(test.prog))
+		if err != nil {
+			t.Fatalf("#%v: failed to deserialize: %v", i, err)
+		}
+		var res []string
+		p.MutateWithHints(0, test.comps, func(p1 *Prog) {
+			res = append(res, strings.TrimSpace(string(p1.Serialize())))
+		})
+		if !reflect.DeepEqual(res, test.res) {
+			t.Errorf("#%v: got:\n%v\nwant:\n%v", i, strings.Join(res, "\n"), strings.Join(test.res, "\n"))
+		}
+		if data := strings.TrimSpace(string(p.Serialize())); data != test.prog {
+			t.Errorf("#%v: program is not restored: %v", i, data)
+		}
+	}
+}
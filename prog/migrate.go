@@ -0,0 +1,59 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Migrate deserializes a program serialized with older syscall descriptions.
+// It does best-effort fix-ups instead of failing: calls that were renamed are
+// replaced with a variant of the same syscall that accepts the arguments,
+// calls that can't be remapped are dropped, extra arguments are dropped,
+// and missing or mismatching arguments are generated anew.
+// Returns the program and the number of calls that were fixed up.
+func Migrate(data []byte, ct *ChoiceTable) (p *Prog, fixed int, err error) {
+	p, fixed, err = deserialize(data, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(p.Calls) == 0 {
+		return nil, 0, fmt.Errorf("no calls left after migration")
+	}
+	if fixed == 0 {
+		if err := p.validate(); err != nil {
+			return nil, 0, err
+		}
+		return p, 0, nil
+	}
+	defer func() {
+		// Generation can panic on args that don't satisfy its invariants,
+		// such programs are just lost.
+		if e := recover(); e != nil {
+			p, fixed, err = nil, 0, fmt.Errorf("failed to fix up program: %v", e)
+		}
+	}()
+	r := newRand(rand.NewSource(0))
+	for _, c := range append([]*Call{}, p.Calls...) {
+		regenerated := false
+		for i, arg := range c.Args {
+			if arg != nil {
+				continue
+			}
+			s := analyze(ct, p, c)
+			arg, calls := r.generateArg(s, c.Meta.Args[i])
+			c.Args[i] = arg
+			p.insertBefore(c, calls)
+			regenerated = true
+		}
+		if regenerated {
+			assignSizesCall(c)
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, 0, err
+	}
+	return p, fixed, nil
+}
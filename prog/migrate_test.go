@@ -0,0 +1,83 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	ct := BuildChoiceTable(CalculatePriorities(nil), nil)
+	tests := []struct {
+		prog  string
+		fixed int
+		calls []string
+	}{
+		{
+			"getpid()\n",
+			0,
+			[]string{"getpid"},
+		},
+		{
+			// Extra argument.
+			"getpid(0x1)\n",
+			1,
+			[]string{"getpid"},
+		},
+		{
+			// Unknown syscall is dropped.
+			"foobar(0x1)\ngetpid()\n",
+			1,
+			[]string{"getpid"},
+		},
+		{
+			// Renamed variant is remapped to a variant that accepts the arguments.
+			"socket$old_variant(0x2, 0x1, 0x0)\n",
+			1,
+			[]string{"socket"},
+		},
+		{
+			// Missing argument and reference to a dropped call are regenerated.
+			"r0 = foobar()\nclose()\ngetpid()\n",
+			2,
+			[]string{"close", "getpid"},
+		},
+		{
+			// Argument that does not match the type is regenerated.
+			"close({0x1, 0x2})\n",
+			1,
+			[]string{"close"},
+		},
+	}
+	for i, test := range tests {
+		p, fixed, err := Migrate([]byte(test.prog), ct)
+		if err != nil {
+			t.Fatalf("#%v: failed to migrate: %v", i, err)
+		}
+		if fixed != test.fixed {
+			t.Errorf("#%v: fixed %v calls, want %v", i, fixed, test.fixed)
+		}
+		// Calls that are needed to create resources may be inserted before the fixed calls.
+		var calls []string
+		for _, c := range p.Calls {
+			calls = append(calls, c.Meta.CallName)
+		}
+		j := 0
+		for _, c := range calls {
+			if j < len(test.calls) && c == test.calls[j] {
+				j++
+			}
+		}
+		if j != len(test.calls) {
+			t.Errorf("#%v: got calls %v, want %v", i, calls, test.calls)
+		}
+		data := p.Serialize()
+		if _, err := Deserialize(data); err != nil {
+			t.Errorf("#%v: migrated program does not deserialize: %v\n%s", i, err, data)
+		}
+	}
+	if _, _, err := Migrate([]byte("foobar()\n"), ct); err == nil {
+		t.Errorf("migration of a program without known calls succeeded")
+	}
+}
@@ -6,27 +6,68 @@ package prog
 import (
 	"fmt"
 	"math/rand"
+	"strings"
 	"unsafe"
 
 	"github.com/google/syzkaller/sys"
 )
 
+// MutationOps selects mutation operators for MutateWithOps.
+type MutationOps struct {
+	Splice    bool // splice with a random program from corpus
+	Insert    bool // insert a new call
+	MutateArg bool // change arguments of a call
+	Remove    bool // remove a call
+}
+
+// AllMutationOps enables all mutation operators, this is what Mutate uses.
+var AllMutationOps = MutationOps{Splice: true, Insert: true, MutateArg: true, Remove: true}
+
+// maxMutateRetries bounds the number of consecutive operators that are not applicable
+// to the program, with restricted operators none of them may be applicable
+// (e.g. only removal is enabled and the program is empty).
+const maxMutateRetries = 100
+
 func (p *Prog) Mutate(rs rand.Source, ncalls int, ct *ChoiceTable, corpus []*Prog) {
+	p.MutateWithOps(rs, ncalls, ct, corpus, AllMutationOps)
+}
+
+// MutateWithOps is the same as Mutate, but uses only the given mutation operators.
+func (p *Prog) MutateWithOps(rs rand.Source, ncalls int, ct *ChoiceTable, corpus []*Prog, ops MutationOps) {
 	r := newRand(rs)
 
-	if r.oneOf(100) && corpus != nil {
+	weight := func(enabled bool, w int) int {
+		if !enabled {
+			return 0
+		}
+		return w
+	}
+	mutate := ops.Insert || ops.MutateArg || ops.Remove
+	if (!mutate || r.oneOf(100)) && ops.Splice && corpus != nil {
 		// Splice with another prog from corpus.
 		p0 := corpus[r.Intn(len(corpus))]
 		p0c := p0.Clone()
+		for _, c := range p0c.Calls {
+			// A program can inject at most one fault.
+			c.FailNth = 0
+		}
 		idx := r.Intn(len(p.Calls))
 		p.Calls = append(p.Calls[:idx], append(p0c.Calls, p.Calls[idx:]...)...)
-	} else {
+	} else if mutate {
 		// Mutate current prog without splicing.
 		retry := false
+		retries := 0
 		for stop := false; !stop || retry; stop = r.bin() {
+			if retry {
+				if retries++; retries > maxMutateRetries {
+					break
+				}
+			} else {
+				retries = 0
+			}
 			retry = false
 			r.choose(
-				20, func() {
+				weight(ops.Insert, 20), func() {
 					// Insert a new call.
 					if len(p.Calls) >= ncalls {
 						retry = true
@@ -41,7 +82,7 @@ func (p *Prog) Mutate(rs rand.Source, ncalls int, ct *ChoiceTable, corpus []*Pro
 					calls := r.generateCall(s, p)
 					p.insertBefore(c, calls)
 				},
-				10, func() {
+				weight(ops.MutateArg, 10), func() {
 					// Change args of a call.
 					if len(p.Calls) == 0 {
 						retry = true
@@ -104,6 +145,10 @@ func (p *Prog) Mutate(rs rand.Source, ncalls int, ct *ChoiceTable, corpus []*Pro
 								arg.Data = []byte(r.filename(s))
 							case sys.BufferText:
 								arg.Data = r.mutateText(a.Text, arg.Data)
+							case sys.BufferOptions:
+								arg.Data = mutateOptions(r, arg.Data, a.Values)
+							case sys.BufferGlob:
+								arg.Data = r.globData(a.Values[0])
 							default:
 								panic("unknown buffer kind")
 							}
@@ -145,6 +190,20 @@ func (p *Prog) Mutate(rs rand.Source, ncalls int, ct *ChoiceTable, corpus []*Pro
 							}
 							// TODO: swap elements of the array
 						case *sys.PtrType:
+							if r.oneOf(20) {
+								// Faulting addresses exercise error paths that valid pointers never reach.
+								if arg.Res != nil {
+									p.removeArg(c, arg.Res)
+								}
+								p.replaceArg(c, arg, constArg(a, r.specialPointer()), nil)
+								break
+							}
+							if arg.Kind == ArgConst {
+								// A nil or special pointer, generate a new object.
+								arg1, calls1 := r.generateArg(s, a)
+								p.replaceArg(c, arg, arg1, calls1)
+								break
+							}
 							// TODO: we don't know size for out args
 							size := uintptr(1)
 							if arg.Res != nil {
@@ -179,6 +238,9 @@ func (p *Prog) Mutate(rs rand.Source, ncalls int, ct *ChoiceTable, corpus []*Pro
 							panic(fmt.Sprintf("bad arg returned by mutationArgs: %#v, type=%#v", *arg, arg.Type))
 						}
 
+						// Sizes of the arg and all its parents might have changed.
+						c.invalidateSizes()
+
 						// Update base pointer if size has increased.
 						if base != nil && baseSize < base.Res.Size() {
 							arg1, calls1 := r.addr(s, base.Type, base.Res.Size(), base.Res)
@@ -195,7 +257,7 @@ func (p *Prog) Mutate(rs rand.Source, ncalls int, ct *ChoiceTable, corpus []*Pro
 						assignSizesCall(c)
 					}
 				},
-				1, func() {
+				weight(ops.Remove, 1), func() {
 					// Remove a random call.
 					if len(p.Calls) == 0 {
 						retry = true
@@ -281,6 +343,37 @@ func Minimize(p0 *Prog, callIndex0 int, pred func(*Prog, int) bool, crash bool)
 		callIndex0 = callIndex
 	}
 
+	// Try to collapse calls that produce equivalent resources:
+	// rewire consumers of a later call to an earlier call and remove the later call.
+	// This helps when several calls can't be removed one-by-one
+	// because each of them produces a resource that is used later.
+	// pred can be expensive (e.g. a VM run in repro), so each call is collapsed
+	// only into the closest earlier call producing matching resources,
+	// which gives a single pred invocation per call.
+	for j := len(p0.Calls) - 1; j > 0; j-- {
+		if j == callIndex0 || j >= len(p0.Calls) {
+			continue
+		}
+		// collapseResources leaves p intact on failure, so p is reused.
+		p := p0.Clone()
+		collapsed := false
+		for i := j - 1; i >= 0 && !collapsed; i-- {
+			collapsed = p.collapseResources(i, j)
+		}
+		if !collapsed {
+			continue
+		}
+		callIndex := callIndex0
+		if j < callIndex {
+			callIndex--
+		}
+		if !pred(p, callIndex) {
+			continue
+		}
+		p0 = p
+		callIndex0 = callIndex
+	}
+
 	var triedPaths map[string]bool
 
 	var rec func(p *Prog, call *Call, arg *Arg, path string) bool
@@ -502,6 +595,65 @@ func swap64(v uint64) uint64 {
 	return v
 }
 
+// mutateOptions mutates a comma-separated list of options (like mount data)
+// taking its structure into account: it inserts, removes, reorders options
+// and changes option values. vals is the set of known option tokens.
+func mutateOptions(r *randGen, data []byte, vals []string) []byte {
+	opts := splitOptions(data)
+	for stop := false; !stop; stop = r.bin() {
+		r.choose(
+			100, func() {
+				// Insert a known option.
+				if len(vals) == 0 {
+					return
+				}
+				i := r.Intn(len(opts) + 1)
+				opts = append(opts[:i], append([]string{r.randOption(vals)}, opts[i:]...)...)
+			},
+			50, func() {
+				// Remove an option.
+				if len(opts) == 0 {
+					return
+				}
+				i := r.Intn(len(opts))
+				opts = append(opts[:i], opts[i+1:]...)
+			},
+			50, func() {
+				// Swap two options.
+				if len(opts) < 2 {
+					return
+				}
+				i1, i2 := r.Intn(len(opts)), r.Intn(len(opts))
+				opts[i1], opts[i2] = opts[i2], opts[i1]
+			},
+			50, func() {
+				// Change value of a key=value option.
+				if len(opts) == 0 {
+					return
+				}
+				i := r.Intn(len(opts))
+				if eq := strings.IndexByte(opts[i], '='); eq != -1 {
+					opts[i] = opts[i][:eq+1] + r.randOptionValue()
+				}
+			},
+			20, func() {
+				// Duplicate an option.
+				if len(opts) == 0 {
+					return
+				}
+				i := r.Intn(len(opts))
+				opts = append(opts[:i+1], append([]string{opts[i]}, opts[i+1:]...)...)
+			},
+		)
+	}
+	data = joinOptions(opts)
+	if r.oneOf(20) {
+		// Sometimes corrupt the syntax as well.
+		data = mutateData(r, data, 0, ^int(0))
+	}
+	return data
+}
+
 func mutateData(r *randGen, data []byte, minLen, maxLen int) []byte {
 	const maxInc = 35
 	for stop := false; !stop; stop = r.bin() {
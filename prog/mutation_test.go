@@ -6,6 +6,7 @@ package prog
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -46,6 +47,29 @@ next:
 	}
 }
 
+func TestMutateWithOps(t *testing.T) {
+	rs, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		p := Generate(rs, 10, nil)
+		n := len(p.Calls)
+		p.MutateWithOps(rs, 20, nil, nil, MutationOps{Insert: true})
+		if len(p.Calls) < n {
+			t.Fatalf("insertion removed calls: %v -> %v\n%s", n, len(p.Calls), p.Serialize())
+		}
+		n = len(p.Calls)
+		p.MutateWithOps(rs, 20, nil, nil, MutationOps{Remove: true})
+		if len(p.Calls) >= n {
+			t.Fatalf("removal did not remove calls: %v -> %v\n%s", n, len(p.Calls), p.Serialize())
+		}
+	}
+	// None of the operators is applicable, mutation must not loop forever.
+	p := &Prog{}
+	p.MutateWithOps(rs, 0, nil, nil, MutationOps{Insert: true, Remove: true})
+	if len(p.Calls) != 0 {
+		t.Fatalf("mutation of an empty program with no space for calls produced:\n%s", p.Serialize())
+	}
+}
+
 func TestMutateTable(t *testing.T) {
 	tests := [][2]string{
 		// Insert calls.
@@ -239,6 +263,29 @@ func TestMinimize(t *testing.T) {
 				"sched_yield()\n",
 			-1,
 		},
+		// Collapse calls that produce equivalent resources.
+		{
+			"mmap(&(0x7f0000000000/0x1000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0)\n" +
+				"r0=open(&(0x7f0000000000)=\"1155\", 0x0, 0x0)\n" +
+				"r1=open(&(0x7f0000000000)=\"1155\", 0x0, 0x0)\n" +
+				"write(r0, &(0x7f0000000000)=\"1155\", 0x2)\n" +
+				"write(r1, &(0x7f0000000000)=\"1155\", 0x2)\n",
+			4,
+			func(p *Prog, callIndex int) bool {
+				// Both writes must use an fd.
+				for _, c := range p.Calls {
+					if c.Meta.Name == "write" && c.Args[0].Kind != ArgResult {
+						return false
+					}
+				}
+				return p.String() == "mmap-open-write-write" || p.String() == "mmap-open-open-write-write"
+			},
+			"mmap(&(0x7f0000000000/0x1000)=nil, (0x1000), 0x0, 0x0, 0xffffffffffffffff, 0x0)\n" +
+				"r0 = open(&(0x7f0000000000)=\"1155\", 0x0, 0x0)\n" +
+				"write(r0, &(0x7f0000000000)=\"\", 0x0)\n" +
+				"write(r0, &(0x7f0000000000)=\"\", 0x0)\n",
+			3,
+		},
 		// Glue several mmaps together.
 		{
 			"sched_yield()\n" +
@@ -307,3 +354,41 @@ func TestMinimizeRandom(t *testing.T) {
 		}, false)
 	}
 }
+
+func TestMutateOptions(t *testing.T) {
+	rs, iters := initTest(t)
+	r := newRand(rs)
+	vals := []string{"ro", "mode=", "uid=", "nr_inodes="}
+	known := make(map[string]bool)
+	for _, v := range vals {
+		known[v] = true
+	}
+	changed := 0
+	for i := 0; i < iters; i++ {
+		data := r.randOptions(vals)
+		for _, opt := range splitOptions(data) {
+			if eq := strings.IndexByte(opt, '='); eq != -1 {
+				opt = opt[:eq+1]
+			}
+			if !known[opt] {
+				t.Fatalf("generated unknown option %q in %q", opt, data)
+			}
+		}
+		if !bytes.Equal(data, mutateOptions(r, append([]byte{}, data...), vals)) {
+			changed++
+		}
+	}
+	if changed < iters/2 {
+		t.Fatalf("mutation changed options only %v out of %v times", changed, iters)
+	}
+	opts := splitOptions([]byte("ro,mode=0777,uid=1\x00"))
+	if len(opts) != 3 || opts[0] != "ro" || opts[1] != "mode=0777" || opts[2] != "uid=1" {
+		t.Fatalf("bad split options: %q", opts)
+	}
+	if data := joinOptions(opts); string(data) != "ro,mode=0777,uid=1\x00" {
+		t.Fatalf("bad joined options: %q", data)
+	}
+	if opts := splitOptions([]byte("\x00")); len(opts) != 0 {
+		t.Fatalf("bad split of empty options: %q", opts)
+	}
+}
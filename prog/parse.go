@@ -5,15 +5,24 @@ package prog
 
 import (
 	"bytes"
+	"fmt"
 	"strconv"
+	"time"
 )
 
 // LogEntry describes one program in execution log.
 type LogEntry struct {
 	P     *Prog
-	Proc  int // index of parallel proc
-	Start int // start offset in log
-	End   int // end offset in log
+	Proc  int       // index of parallel proc
+	Time  time.Time // when the proc started executing the program (zero if not logged)
+	Start int       // start offset in log
+	End   int       // end offset in log
+}
+
+// LogHeader returns the line that precedes program executed by proc at time t in execution log.
+// The proc and the time allow to find programs that were running concurrently when a crash happened.
+func LogHeader(proc int, t time.Time) string {
+	return fmt.Sprintf("executing program %v (time=%v):\n", proc, t.UnixNano()/1e6)
 }
 
 func ParseLog(data []byte) []*LogEntry {
@@ -44,6 +53,7 @@ func ParseLog(data []byte) []*LogEntry {
 			proc, _ := strconv.Atoi(string(line[procStart:procEnd]))
 			ent = &LogEntry{
 				Proc:  proc,
+				Time:  parseLogTime(line[procEnd:]),
 				Start: pos0,
 			}
 			cur = nil
@@ -66,3 +76,21 @@ func ParseLog(data []byte) []*LogEntry {
 	}
 	return entries
 }
+
+// parseLogTime parses time of LogHeader, logs of older versions don't have it.
+func parseLogTime(line []byte) time.Time {
+	const prefix = " (time="
+	if !bytes.HasPrefix(line, []byte(prefix)) {
+		return time.Time{}
+	}
+	line = line[len(prefix):]
+	end := bytes.IndexByte(line, ')')
+	if end == -1 {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(string(line[:end]), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(ms/1e3, ms%1e3*1e6)
+}
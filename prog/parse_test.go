@@ -5,6 +5,7 @@ package prog
 
 import (
 	"testing"
+	"time"
 )
 
 func TestParseSingle(t *testing.T) {
@@ -89,3 +90,27 @@ getpid()
 2015/12/21 12:18:05 executing program 9:
 munlockall()
 `
+
+func TestParseTime(t *testing.T) {
+	t0 := time.Unix(1508846400, 123e6)
+	log := "2017/10/24 12:00:00 " + LogHeader(3, t0) + "getpid()\n" +
+		"[ 2351.935478] Modules linked in:\n" +
+		LogHeader(5, t0.Add(1500*time.Millisecond)) + "gettid()\n" +
+		"executing program 1:\ngetpid()\n"
+	entries := ParseLog([]byte(log))
+	if len(entries) != 3 {
+		t.Fatalf("got %v programs, want 3", len(entries))
+	}
+	if entries[0].Proc != 3 || !entries[0].Time.Equal(t0) {
+		t.Fatalf("bad program 0: proc %v, time %v", entries[0].Proc, entries[0].Time)
+	}
+	if entries[1].Proc != 5 || !entries[1].Time.Equal(t0.Add(1500*time.Millisecond)) {
+		t.Fatalf("bad program 1: proc %v, time %v", entries[1].Proc, entries[1].Time)
+	}
+	if entries[2].Proc != 1 || !entries[2].Time.IsZero() {
+		t.Fatalf("bad program 2: proc %v, time %v", entries[2].Proc, entries[2].Time)
+	}
+	if s := entries[1].P.String(); s != "gettid" {
+		t.Fatalf("bad program 1: %s", s)
+	}
+}
@@ -22,7 +22,8 @@ import (
 // The dynamic component is based on frequency of occurrence of a particular
 // pair of syscalls in a single program in corpus. For example, if socket and
 // connect frequently occur in programs together, we give higher priority to
-// this pair of syscalls.
+// this pair of syscalls. Variants of the same syscall (e.g. ioctl$FOO and ioctl$BAR)
+// are treated as a family and partially share the dynamic priority.
 // Note: the current implementation is very basic, there is no theory behind any
 // constants.
 
@@ -81,11 +82,11 @@ func calcStaticPriorities() [][]float32 {
 			case *sys.BufferType:
 				switch a.Kind {
 				case sys.BufferBlobRand, sys.BufferBlobRange, sys.BufferText:
-				case sys.BufferString:
+				case sys.BufferString, sys.BufferOptions:
 					if a.SubKind != "" {
 						noteUsage(0.2, fmt.Sprintf("str-%v", a.SubKind))
 					}
-				case sys.BufferFilename:
+				case sys.BufferFilename, sys.BufferGlob:
 					noteUsage(1.0, "filename")
 				default:
 					panic("unknown buffer kind")
@@ -139,20 +140,59 @@ func calcDynamicPrio(corpus []*Prog) [][]float32 {
 	for i := range prios {
 		prios[i] = make([]float32, len(sys.Calls))
 	}
+	families, nvariants := callFamilies()
+	familyPrios := make([][]float32, len(nvariants))
+	for i := range familyPrios {
+		familyPrios[i] = make([]float32, len(nvariants))
+	}
 	for _, p := range corpus {
-		for i0 := 0; i0 < len(p.Calls); i0++ {
-			for i1 := 0; i1 < len(p.Calls); i1++ {
+		for i0, c0 := range p.Calls {
+			for i1, c1 := range p.Calls {
 				if i0 == i1 {
 					continue
 				}
-				prios[i0][i1] += 1.0
+				id0, id1 := c0.Meta.ID, c1.Meta.ID
+				prios[id0][id1] += 1.0
+				familyPrios[families[id0]][families[id1]] += 1.0
 			}
 		}
 	}
+	// Variants of a syscall (foo$bar) are flavours of the same call, so otherwise
+	// the corpus statistics would be diluted among numerous variants (e.g. ioctl).
+	// Each pair of calls also inherits a share of the priority of their families,
+	// the family priority is evenly split among variants of the second call.
+	for i, prio := range prios {
+		for j := range prio {
+			f0, f1 := families[i], families[j]
+			prio[j] += variantPrio * familyPrios[f0][f1] / float32(nvariants[f1])
+		}
+	}
 	normalizePrio(prios)
 	return prios
 }
 
+// variantPrio is weight of family priority inherited by individual syscall variants.
+const variantPrio = 0.5
+
+// callFamilies groups variants of the same syscall (calls with the same CallName).
+// Returns family index for each call ID and number of variants in each family.
+func callFamilies() ([]int, []int) {
+	families := make([]int, len(sys.Calls))
+	index := make(map[string]int)
+	var nvariants []int
+	for _, c := range sys.Calls {
+		f, ok := index[c.CallName]
+		if !ok {
+			f = len(nvariants)
+			index[c.CallName] = f
+			nvariants = append(nvariants, 0)
+		}
+		families[c.ID] = f
+		nvariants[f]++
+	}
+	return families, nvariants
+}
+
 // normalizePrio assigns some minimal priorities to calls with zero priority,
 // and then normalizes priorities to 0.1..1 range.
 func normalizePrio(prios [][]float32) {
@@ -197,6 +237,8 @@ type ChoiceTable struct {
 	run          [][]int
 	enabledCalls []*sys.Call
 	enabled      map[*sys.Call]bool
+	files        []string // paths that exist on the target (see AddFiles)
+	filesRun     []int    // cumulative weights of files
 }
 
 func BuildChoiceTable(prios [][]float32, enabled map[*sys.Call]bool) *ChoiceTable {
@@ -224,7 +266,33 @@ func BuildChoiceTable(prios [][]float32, enabled map[*sys.Call]bool) *ChoiceTabl
 			run[i][j] = sum
 		}
 	}
-	return &ChoiceTable{run, enabledCalls, enabled}
+	return &ChoiceTable{run: run, enabledCalls: enabledCalls, enabled: enabled}
+}
+
+// AddFiles adds paths that exist on the target machine
+// (e.g. entries enumerated in /dev, /proc and /sys) to filename generation.
+// Each of the paths is chosen with the given weight relative to other added paths.
+func (ct *ChoiceTable) AddFiles(files []string, weight int) {
+	if weight <= 0 {
+		return
+	}
+	sum := 0
+	if len(ct.filesRun) != 0 {
+		sum = ct.filesRun[len(ct.filesRun)-1]
+	}
+	for _, f := range files {
+		sum += weight
+		ct.files = append(ct.files, f+"\x00")
+		ct.filesRun = append(ct.filesRun, sum)
+	}
+}
+
+func (ct *ChoiceTable) chooseFile(r *rand.Rand) string {
+	if ct == nil || len(ct.files) == 0 {
+		return ""
+	}
+	x := r.Intn(ct.filesRun[len(ct.filesRun)-1])
+	return ct.files[sort.SearchInts(ct.filesRun, x+1)]
 }
 
 func (ct *ChoiceTable) Choose(r *rand.Rand, call int) int {
@@ -0,0 +1,37 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/sys"
+)
+
+func TestDynamicPrioVariants(t *testing.T) {
+	call := func(name string) *Call {
+		meta := sys.CallMap[name]
+		if meta == nil {
+			t.Fatalf("unknown syscall %v", name)
+		}
+		return &Call{Meta: meta}
+	}
+	corpus := []*Prog{
+		{Calls: []*Call{call("getpid"), call("syz_test$int")}},
+		{Calls: []*Call{call("getpid"), call("syz_test$int")}},
+	}
+	prios := calcDynamicPrio(corpus)
+	getpid := sys.CallMap["getpid"].ID
+	used := prios[getpid][sys.CallMap["syz_test$int"].ID]
+	variant := prios[getpid][sys.CallMap["syz_test$align0"].ID]
+	unrelated := prios[getpid][sys.CallMap["getuid"].ID]
+	if !(used > variant && variant > unrelated) {
+		t.Fatalf("bad priorities: used %v, variant %v, unrelated %v", used, variant, unrelated)
+	}
+	// The reverse direction: variants inherit priority of their base call family.
+	align0 := sys.CallMap["syz_test$align0"].ID
+	if prios[align0][getpid] <= prios[align0][sys.CallMap["getuid"].ID] {
+		t.Fatalf("syscall variant did not inherit family priority")
+	}
+}
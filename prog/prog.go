@@ -17,6 +17,23 @@ type Call struct {
 	Meta *sys.Call
 	Args []*Arg
 	Ret  *Arg
+
+	// Free-form single-line comment (e.g. origin of the call),
+	// preserved across Serialize/Deserialize and Clone.
+	Comment string
+
+	// FailNth, if non-zero, asks to inject a fault into the FailNth (1-based)
+	// fault-injection site (e.g. memory allocation) hit during execution of the call.
+	FailNth int
+
+	// Async, if set, asks executor to not wait for completion of the call
+	// before issuing the next call, so that the two calls run concurrently
+	// in different threads (see Collide).
+	Async bool
+
+	// Delay, if non-zero, asks executor to sleep for Delay microseconds
+	// before issuing the call (see PerturbSchedule).
+	Delay int
 }
 
 type Arg struct {
@@ -36,6 +53,10 @@ type Arg struct {
 	// ArgUnion/UnionType
 	Option     *Arg
 	OptionType sys.Type
+
+	// Cached size of ArgGroup/ArgUnion args, see cacheSizes and invalidateSizes.
+	size      uintptr
+	sizeValid bool
 }
 
 type ArgKind int
@@ -56,7 +77,7 @@ func (a *Arg) InnerArg() *Arg {
 	switch typ := a.Type.(type) {
 	case *sys.PtrType:
 		if a.Res == nil {
-			if !typ.Optional() {
+			if !typ.Optional() && a.Kind != ArgConst {
 				panic(fmt.Sprintf("non-optional pointer is nil\narg: %+v\ntype: %+v", a, typ))
 			}
 			return nil
@@ -88,20 +109,54 @@ func encodeValue(value, size uintptr, bigEndian bool) uintptr {
 func (a *Arg) Value(pid int) uintptr {
 	switch typ := a.Type.(type) {
 	case *sys.IntType:
-		return encodeValue(a.Val, typ.Size(), typ.BigEndian)
+		return encodeValue(a.Val, typ.TypeSize, typ.BigEndian)
 	case *sys.ConstType:
-		return encodeValue(a.Val, typ.Size(), typ.BigEndian)
+		return encodeValue(a.Val, typ.TypeSize, typ.BigEndian)
 	case *sys.FlagsType:
-		return encodeValue(a.Val, typ.Size(), typ.BigEndian)
+		return encodeValue(a.Val, typ.TypeSize, typ.BigEndian)
 	case *sys.LenType:
 		return encodeValue(a.Val, typ.Size(), typ.BigEndian)
 	case *sys.ProcType:
 		val := uintptr(typ.ValuesStart) + uintptr(typ.ValuesPerProc)*uintptr(pid) + a.Val
-		return encodeValue(val, typ.Size(), typ.BigEndian)
+		return encodeValue(val, typ.TypeSize, typ.BigEndian)
 	}
 	return a.Val
 }
 
+// FormattedValue returns textual representation of the value for args
+// of fmt types (e.g. fmt[dec, int32]), or nil for natively represented values.
+func (a *Arg) FormattedValue(pid int) []byte {
+	var size uintptr
+	var format sys.IntFormat
+	switch typ := a.Type.(type) {
+	case *sys.IntType:
+		size, format = typ.TypeSize, typ.Format
+	case *sys.ConstType:
+		size, format = typ.TypeSize, typ.Format
+	case *sys.FlagsType:
+		size, format = typ.TypeSize, typ.Format
+	case *sys.ProcType:
+		size, format = typ.TypeSize, typ.Format
+	}
+	if format == sys.FormatNative {
+		return nil
+	}
+	val := uint64(a.Value(pid))
+	if size < 8 {
+		val &= 1<<(size*8) - 1
+	}
+	switch format {
+	case sys.FormatStrDec:
+		return []byte(fmt.Sprintf("%020d", val))
+	case sys.FormatStrHex:
+		return []byte(fmt.Sprintf("0x%016x", val))
+	case sys.FormatStrOct:
+		return []byte(fmt.Sprintf("%023o", val))
+	default:
+		panic(fmt.Sprintf("unknown int format %v", format))
+	}
+}
+
 func (a *Arg) Size() uintptr {
 	switch typ := a.Type.(type) {
 	case *sys.IntType, *sys.LenType, *sys.FlagsType, *sys.ConstType,
@@ -109,25 +164,58 @@ func (a *Arg) Size() uintptr {
 		return typ.Size()
 	case *sys.BufferType:
 		return uintptr(len(a.Data))
-	case *sys.StructType:
-		var size uintptr
-		for _, fld := range a.Inner {
-			size += fld.Size()
+	case *sys.StructType, *sys.ArrayType:
+		if a.sizeValid {
+			return a.size
+		}
+		inner := a.Inner
+		if t, ok := typ.(*sys.StructType); ok && t.OverlayField != 0 {
+			inner = inner[:t.OverlayField] // both layouts have the same size
 		}
-		return size
-	case *sys.UnionType:
-		return a.Option.Size()
-	case *sys.ArrayType:
 		var size uintptr
-		for _, in := range a.Inner {
+		for _, in := range inner {
 			size += in.Size()
 		}
 		return size
+	case *sys.UnionType:
+		if a.sizeValid {
+			return a.size
+		}
+		return a.Option.Size()
 	default:
 		panic("unknown arg type")
 	}
 }
 
+// cacheSizes fills cached sizes of all args of call c.
+// Size only reads the cache, so that programs shared between goroutines
+// (corpus, hints) can be serialized concurrently; the cache is filled
+// only here, on programs owned by the caller (generated, mutated or cloned).
+func (c *Call) cacheSizes() {
+	var args []*Arg
+	foreachArg(c, func(arg, _ *Arg, _ *[]*Arg) {
+		arg.sizeValid = false
+		args = append(args, arg)
+	})
+	// Subargs follow their parents, so walk backwards to fill subargs first.
+	for i := len(args) - 1; i >= 0; i-- {
+		arg := args[i]
+		switch arg.Type.(type) {
+		case *sys.StructType, *sys.ArrayType, *sys.UnionType:
+			arg.size, arg.sizeValid = arg.Size(), true
+		}
+	}
+}
+
+// invalidateSizes drops cached sizes of all args of call c.
+// Must be called after any change to the args that can affect their sizes
+// (changed data, array length or union option).
+func (c *Call) invalidateSizes() {
+	foreachArg(c, func(arg, _ *Arg, _ *[]*Arg) {
+		arg.sizeValid = false
+	})
+}
+
 func constArg(t sys.Type, v uintptr) *Arg {
 	return &Arg{Type: t, Kind: ArgConst, Val: v}
 }
@@ -211,6 +299,7 @@ func (p *Prog) replaceArg(c *Call, arg, arg1 *Arg, calls []*Call) {
 		delete(arg.Res.Uses, arg1)
 		arg.Res.Uses[arg] = true
 	}
+	c.invalidateSizes()
 	sanitizeCall(c)
 }
 
@@ -243,3 +332,57 @@ func (p *Prog) removeCall(idx int) {
 	}
 	p.removeArg(c, c.Ret)
 }
+
+// collapseResources rewires all uses of resources produced by call j
+// to resources of the same kind produced by an earlier call i, and removes call j.
+// Returns false (and leaves p intact) if call j produces no used resources
+// or call i does not produce a matching resource for each of them.
+func (p *Prog) collapseResources(i, j int) bool {
+	if i >= j {
+		panic("bad call indices")
+	}
+	produced := func(c *Call) []*Arg {
+		var res []*Arg
+		foreachArgArray(&c.Args, c.Ret, func(arg, _ *Arg, _ *[]*Arg) {
+			if _, ok := arg.Type.(*sys.ResourceType); ok && arg.Type.Dir() != sys.DirIn {
+				res = append(res, arg)
+			}
+		})
+		return res
+	}
+	var used []*Arg
+	for _, arg := range produced(p.Calls[j]) {
+		if len(arg.Uses) != 0 {
+			used = append(used, arg)
+		}
+	}
+	if len(used) == 0 {
+		return false
+	}
+	candidates := produced(p.Calls[i])
+	repl := make(map[*Arg]*Arg)
+	for _, arg := range used {
+		name := arg.Type.(*sys.ResourceType).Desc.Name
+		for _, arg1 := range candidates {
+			if arg1.Type.(*sys.ResourceType).Desc.Name == name {
+				repl[arg] = arg1
+				break
+			}
+		}
+		if repl[arg] == nil {
+			return false
+		}
+	}
+	for arg, arg1 := range repl {
+		if arg1.Uses == nil {
+			arg1.Uses = make(map[*Arg]bool)
+		}
+		for use := range arg.Uses {
+			use.Res = arg1
+			arg1.Uses[use] = true
+		}
+		arg.Uses = nil
+	}
+	p.removeCall(j)
+	return true
+}
@@ -5,6 +5,7 @@ package prog
 
 import (
 	"bytes"
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
@@ -86,3 +87,52 @@ func TestVmaType(t *testing.T) {
 		check(c.Args[4], c.Args[5], 7, 9)
 	}
 }
+
+func TestSpecialPointers(t *testing.T) {
+	for _, ptr := range sys.SpecialPointers {
+		if _, err := Deserialize([]byte(fmt.Sprintf("pipe(0x%x)\n", ptr))); err != nil {
+			t.Fatalf("special pointer 0x%x is rejected: %v", ptr, err)
+		}
+	}
+	if _, err := Deserialize([]byte("pipe(0x1234)\n")); err == nil {
+		t.Fatalf("const non optional pointer is accepted")
+	}
+	// Mutation must substitute special pointers and replace them back with valid pointers.
+	rs, iters := initTest(t)
+	found := false
+	for i := 0; i < iters && !found; i++ {
+		p := Generate(rs, 10, nil)
+		for j := 0; j < 10; j++ {
+			p.Mutate(rs, 10, nil, nil)
+		}
+		for _, c := range p.Calls {
+			foreachArg(c, func(arg, _ *Arg, _ *[]*Arg) {
+				if typ, ok := arg.Type.(*sys.PtrType); ok && !typ.Optional() && arg.Kind == ArgConst {
+					found = true
+				}
+			})
+		}
+	}
+	if !found {
+		t.Fatalf("mutation produced no special pointers")
+	}
+}
+
+func TestTargetFiles(t *testing.T) {
+	rs, iters := initTest(t)
+	r := newRand(rs)
+	ct := BuildChoiceTable(CalculatePriorities(nil), nil)
+	ct.AddFiles([]string{"/dev/null", "/dev/zero"}, 10)
+	ct.AddFiles([]string{"/sys/kernel"}, 1)
+	ct.AddFiles([]string{"/proc/never"}, 0)
+	counts := make(map[string]int)
+	for i := 0; i < iters*10; i++ {
+		counts[r.filename(newState(ct))]++
+	}
+	if counts["/proc/never\x00"] != 0 {
+		t.Fatalf("chosen file with zero weight")
+	}
+	if counts["/dev/null\x00"] == 0 || counts["/dev/null\x00"] < counts["/sys/kernel\x00"] {
+		t.Fatalf("bad file distribution: %v", counts)
+	}
+}
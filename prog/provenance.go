@@ -0,0 +1,179 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/syzkaller/sys"
+)
+
+// CallProvenance says where a call of a mutated program comes from.
+type CallProvenance struct {
+	New     bool     // the call is not present in the seed (inserted, spliced or regenerated)
+	Mutated []string // paths of args that differ from the seed call, e.g. "addr.sin_port" or "buf[4:8]"
+}
+
+// Inherited says that the call is the same as in the seed.
+func (cp *CallProvenance) Inherited() bool {
+	return !cp.New && len(cp.Mutated) == 0
+}
+
+func (cp *CallProvenance) String() string {
+	switch {
+	case cp.New:
+		return "new"
+	case len(cp.Mutated) != 0:
+		return "mutated: " + strings.Join(cp.Mutated, ", ")
+	default:
+		return "inherited"
+	}
+}
+
+// ParseCallProvenance parses provenance from a call comment set by AnnotateProvenance,
+// ok is false if the comment is not a provenance.
+func ParseCallProvenance(comment string) (cp CallProvenance, ok bool) {
+	switch {
+	case comment == "new":
+		cp.New = true
+	case strings.HasPrefix(comment, "mutated: "):
+		cp.Mutated = strings.Split(strings.TrimPrefix(comment, "mutated: "), ", ")
+	case comment != "inherited":
+		return cp, false
+	}
+	return cp, true
+}
+
+// Provenance returns provenance of every call of p that was mutated from seed.
+// Calls of p are matched to calls of seed with the same syscall in order (the longest
+// common subsequence), args of matched calls are compared value by value
+// (results are compared by their operations, not by the calls they refer to).
+func Provenance(seed, p *Prog) []CallProvenance {
+	// lcs[i][j] is the length of the common subsequence of seed.Calls[i:] and p.Calls[j:].
+	lcs := make([][]int, len(seed.Calls)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(p.Calls)+1)
+	}
+	for i := len(seed.Calls) - 1; i >= 0; i-- {
+		for j := len(p.Calls) - 1; j >= 0; j-- {
+			switch {
+			case seed.Calls[i].Meta == p.Calls[j].Meta:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	res := make([]CallProvenance, len(p.Calls))
+	for i, j := 0, 0; j < len(p.Calls); {
+		switch {
+		case i < len(seed.Calls) && seed.Calls[i].Meta == p.Calls[j].Meta && lcs[i][j] == lcs[i+1][j+1]+1:
+			for k, arg := range p.Calls[j].Args {
+				diffArg(seed.Calls[i].Args[k], arg, arg.Type.Name(), &res[j].Mutated)
+			}
+			i++
+			j++
+		case i < len(seed.Calls) && lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			res[j].New = true
+			j++
+		}
+	}
+	return res
+}
+
+// AnnotateProvenance sets comments of calls of p to their provenance (see Provenance),
+// so that logs of executed programs show what was changed since the seed.
+func AnnotateProvenance(seed, p *Prog) {
+	for i, cp := range Provenance(seed, p) {
+		p.Calls[i].Comment = cp.String()
+	}
+}
+
+// diffArg appends paths of sub-args of arg that differ from the corresponding sub-args of seed to res.
+func diffArg(seed, arg *Arg, path string, res *[]string) {
+	if sys.IsPad(arg.Type) {
+		return
+	}
+	if seed.Kind != arg.Kind || seed.Type != arg.Type {
+		*res = append(*res, path)
+		return
+	}
+	switch arg.Kind {
+	case ArgConst:
+		if seed.Val != arg.Val {
+			*res = append(*res, path)
+		}
+	case ArgPageSize:
+		if seed.AddrPage != arg.AddrPage {
+			*res = append(*res, path)
+		}
+	case ArgResult:
+		if (seed.Res == nil) != (arg.Res == nil) || seed.Val != arg.Val ||
+			seed.OpDiv != arg.OpDiv || seed.OpAdd != arg.OpAdd {
+			*res = append(*res, path)
+		}
+	case ArgPointer:
+		if seed.AddrPage != arg.AddrPage || seed.AddrOffset != arg.AddrOffset || seed.AddrPagesNum != arg.AddrPagesNum {
+			*res = append(*res, path)
+			return
+		}
+		switch {
+		case seed.Res == nil && arg.Res == nil:
+		case seed.Res == nil || arg.Res == nil:
+			*res = append(*res, path)
+		default:
+			diffArg(seed.Res, arg.Res, path, res)
+		}
+	case ArgData:
+		diffData(seed.Data, arg.Data, path, res)
+	case ArgGroup:
+		_, isArray := arg.Type.(*sys.ArrayType)
+		for i, inner := range arg.Inner {
+			if i >= len(seed.Inner) {
+				*res = append(*res, fmt.Sprintf("%v[%v:]", path, i))
+				break
+			}
+			if isArray {
+				diffArg(seed.Inner[i], inner, fmt.Sprintf("%v[%v]", path, i), res)
+			} else {
+				diffArg(seed.Inner[i], inner, path+"."+inner.Type.Name(), res)
+			}
+		}
+		if len(seed.Inner) > len(arg.Inner) {
+			*res = append(*res, fmt.Sprintf("%v[%v:]", path, len(arg.Inner)))
+		}
+	case ArgUnion:
+		if seed.OptionType != arg.OptionType {
+			*res = append(*res, path)
+			return
+		}
+		diffArg(seed.Option, arg.Option, path+"."+arg.OptionType.Name(), res)
+	}
+}
+
+// diffData appends the range of bytes of data that differ from seed, e.g. "buf[4:8]",
+// or "buf[4:]" if the data changed size.
+func diffData(seed, data []byte, path string, res *[]string) {
+	start := 0
+	for start < len(seed) && start < len(data) && seed[start] == data[start] {
+		start++
+	}
+	if len(seed) != len(data) {
+		*res = append(*res, fmt.Sprintf("%v[%v:]", path, start))
+		return
+	}
+	if start == len(data) {
+		return
+	}
+	end := len(data)
+	for seed[end-1] == data[end-1] {
+		end--
+	}
+	*res = append(*res, fmt.Sprintf("%v[%v:%v]", path, start, end))
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	seed, err := Deserialize([]byte("mmap(&(0x7f0000000000/0x1000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0)\n" +
+		"r0 = open(&(0x7f0000000000)=\"2e2f66696c653000\", 0x0, 0x0)\n" +
+		"getpid()\n" +
+		"close(r0)\n"))
+	if err != nil {
+		t.Fatalf("failed to deserialize program: %v", err)
+	}
+	p, err := Deserialize([]byte("mmap(&(0x7f0000000000/0x1000)=nil, (0x1000), 0x3, 0x32, 0xffffffffffffffff, 0x0)\n" +
+		"r0 = open(&(0x7f0000000000)=\"2e2f66696c653100\", 0x2, 0x0)\n" +
+		"gettid()\n" +
+		"close(r0)\n" +
+		"open(&(0x7f0000000000)=\"2e2f66696c6530\", 0x0, 0x0)\n"))
+	if err != nil {
+		t.Fatalf("failed to deserialize program: %v", err)
+	}
+	want := []string{
+		"inherited",
+		"mutated: file[6:7], flags",
+		"new",
+		"inherited",
+		"new",
+	}
+	AnnotateProvenance(seed, p)
+	for i, c := range p.Calls {
+		if c.Comment != want[i] {
+			t.Errorf("call %v: got provenance %q, want %q", i, c.Comment, want[i])
+		}
+	}
+	for i, c := range p.Calls {
+		cp, ok := ParseCallProvenance(c.Comment)
+		if !ok || cp.String() != want[i] {
+			t.Errorf("call %v: parsed provenance %q (ok=%v), want %q", i, cp.String(), ok, want[i])
+		}
+	}
+	if _, ok := ParseCallProvenance("from strace"); ok {
+		t.Errorf("parsed provenance from an unrelated comment")
+	}
+	for i, cp := range Provenance(seed, seed.Clone()) {
+		if !cp.Inherited() {
+			t.Errorf("call %v of the same program: got provenance %q", i, cp.String())
+		}
+	}
+}
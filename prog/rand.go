@@ -8,8 +8,8 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"strings"
 
-	"github.com/google/syzkaller/ifuzz"
 	"github.com/google/syzkaller/sys"
 )
 
@@ -125,8 +125,22 @@ func (r *randGen) flags(vv []uintptr) uintptr {
 	return v
 }
 
+// globData returns contents of a glob buffer: zero-terminated pattern
+// padded to sys.GlobSize, the last byte selects one of the matching files.
+func (r *randGen) globData(pattern string) []byte {
+	data := make([]byte, sys.GlobSize)
+	copy(data, pattern)
+	data[len(data)-1] = byte(r.Intn(256))
+	return data
+}
+
 func (r *randGen) filename(s *state) string {
-	// TODO: support procfs and sysfs
+	if r.oneOf(3) {
+		// Use a path that exists on the target (device nodes, procfs, sysfs).
+		if f := s.ct.chooseFile(r.Rand); f != "" {
+			return f
+		}
+	}
 	dir := "."
 	if r.oneOf(2) && len(s.files) != 0 {
 		files := make([]string, 0, len(s.files))
@@ -207,6 +221,37 @@ func (r *randGen) randStringImpl(s *state, vals []string) []byte {
 	return buf.Bytes()
 }
 
+// randOptions generates a comma-separated list of options (like mount data)
+// out of known option tokens. Tokens that end with '=' require a value.
+func (r *randGen) randOptions(vals []string) []byte {
+	var opts []string
+	for !r.oneOf(3) && len(vals) != 0 {
+		opts = append(opts, r.randOption(vals))
+	}
+	return joinOptions(opts)
+}
+
+func (r *randGen) randOption(vals []string) string {
+	opt := vals[r.Intn(len(vals))]
+	if strings.HasSuffix(opt, "=") {
+		opt += r.randOptionValue()
+	}
+	return opt
+}
+
+func (r *randGen) randOptionValue() string {
+	var v string
+	r.choose(
+		10, func() { v = fmt.Sprint(r.randInt() % 1e4) },
+		5, func() { v = fmt.Sprint(r.randInt()) },
+		5, func() { v = fmt.Sprintf("0x%x", r.randInt()) },
+		5, func() { v = fmt.Sprintf("0%o", r.rand(01000)) },
+		3, func() { v = fmt.Sprintf("%vk", r.rand(1<<10)) },
+		1, func() { v = "" },
+	)
+	return v
+}
+
 func isSpecialStruct(typ sys.Type) func(r *randGen, s *state) (*Arg, []*Call) {
 	a, ok := typ.(*sys.StructType)
 	if !ok {
@@ -300,10 +345,13 @@ func createMmapCall(start, npages uintptr) *Call {
 			constArg(meta.Args[2], sys.PROT_READ|sys.PROT_WRITE),
 			constArg(meta.Args[3], sys.MAP_ANONYMOUS|sys.MAP_PRIVATE|sys.MAP_FIXED),
 			constArg(meta.Args[4], sys.InvalidFD),
-			constArg(meta.Args[5], 0),
 		},
 		Ret: returnArg(meta.Ret),
 	}
+	// The rest is the offset, which NetBSD and OpenBSD mmap precede with a padding argument.
+	for _, typ := range meta.Args[5:] {
+		mmap.Args = append(mmap.Args, constArg(typ, 0))
+	}
 	return mmap
 }
 
@@ -351,6 +399,22 @@ func (r *randGen) addr(s *state, typ sys.Type, size uintptr, data *Arg) (*Arg, [
 	return arg, calls
 }
 
+// specialPointer returns one of special pointer values of the target (sys.SpecialPointers):
+// NULL, kernel, non-canonical and last page addresses.
+func (r *randGen) specialPointer() uintptr {
+	return uintptr(sys.SpecialPointers[r.Intn(len(sys.SpecialPointers))])
+}
+
+// isSpecialPointer says if v can be used as a value of a non-optional pointer.
+func isSpecialPointer(v uintptr) bool {
+	for _, ptr := range sys.SpecialPointers {
+		if uintptr(ptr) == v {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *randGen) randPageAddr(s *state, typ sys.Type, npages uintptr, data *Arg, vma bool) *Arg {
 	var starts []uintptr
 	for i := uintptr(0); i < maxPages-npages; i++ {
@@ -453,48 +517,6 @@ func (r *randGen) createResource(s *state, res *sys.ResourceType) (arg *Arg, cal
 	panic("failed to create a resource")
 }
 
-func (r *randGen) generateText(kind sys.TextKind) []byte {
-	cfg := createIfuzzConfig(kind)
-	return ifuzz.Generate(cfg, r.Rand)
-}
-
-func (r *randGen) mutateText(kind sys.TextKind, text []byte) []byte {
-	cfg := createIfuzzConfig(kind)
-	return ifuzz.Mutate(cfg, r.Rand, text)
-}
-
-func createIfuzzConfig(kind sys.TextKind) *ifuzz.Config {
-	cfg := &ifuzz.Config{
-		Len:  10,
-		Priv: true,
-		Exec: true,
-		MemRegions: []ifuzz.MemRegion{
-			{0 << 12, 1 << 12},
-			{1 << 12, 1 << 12},
-			{2 << 12, 1 << 12},
-			{3 << 12, 1 << 12},
-			{4 << 12, 1 << 12},
-			{5 << 12, 1 << 12},
-			{6 << 12, 1 << 12},
-			{7 << 12, 1 << 12},
-			{8 << 12, 1 << 12},
-			{9 << 12, 1 << 12},
-			{0xfec00000, 0x100}, // ioapic
-		},
-	}
-	switch kind {
-	case sys.Text_x86_real:
-		cfg.Mode = ifuzz.ModeReal16
-	case sys.Text_x86_16:
-		cfg.Mode = ifuzz.ModeProt16
-	case sys.Text_x86_32:
-		cfg.Mode = ifuzz.ModeProt32
-	case sys.Text_x86_64:
-		cfg.Mode = ifuzz.ModeLong64
-	}
-	return cfg
-}
-
 func (r *randGen) choose(args ...interface{}) {
 	if len(args) == 0 || len(args)%2 != 0 {
 		panic("bad number of args to choose")
@@ -636,6 +658,10 @@ func (r *randGen) generateArg(s *state, typ sys.Type) (arg *Arg, calls []*Call)
 			return dataArg(a, []byte(filename)), nil
 		case sys.BufferText:
 			return dataArg(a, r.generateText(a.Text)), nil
+		case sys.BufferOptions:
+			return dataArg(a, r.randOptions(a.Values)), nil
+		case sys.BufferGlob:
+			return dataArg(a, r.globData(a.Values[0])), nil
 		default:
 			panic("unknown buffer kind")
 		}
@@ -0,0 +1,60 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+//go:build !freebsd && !netbsd && !openbsd && !fuchsia && !windows_nt
+// +build !freebsd,!netbsd,!openbsd,!fuchsia,!windows_nt
+
+package prog
+
+import (
+	"github.com/google/syzkaller/sys"
+)
+
+// sanitizeTargetCall fixes up arguments of Linux syscalls that are known to
+// break the machine or to produce non-deterministic results.
+func sanitizeTargetCall(c *Call) {
+	switch c.Meta.CallName {
+	case "mremap":
+		// Add MREMAP_FIXED flag, otherwise it produces non-deterministic results.
+		flags := c.Args[3]
+		if flags.Kind != ArgConst {
+			panic("mremap flag arg is not const")
+		}
+		if flags.Val&sys.MREMAP_MAYMOVE != 0 {
+			flags.Val |= sys.MREMAP_FIXED
+		}
+	case "mknod", "mknodat":
+		mode := c.Args[1]
+		if c.Meta.CallName == "mknodat" {
+			mode = c.Args[2]
+		}
+		if mode.Kind != ArgConst {
+			panic("mknod mode is not const")
+		}
+		// Char and block devices read/write io ports, kernel memory and do other nasty things.
+		// TODO: not required if executor drops privileges.
+		if mode.Val != sys.S_IFREG && mode.Val != sys.S_IFIFO && mode.Val != sys.S_IFSOCK {
+			mode.Val = sys.S_IFIFO
+		}
+	case "syslog":
+		cmd := c.Args[0]
+		// These disable console output, but we need it.
+		if cmd.Val == sys.SYSLOG_ACTION_CONSOLE_OFF || cmd.Val == sys.SYSLOG_ACTION_CONSOLE_ON {
+			cmd.Val = sys.SYSLOG_ACTION_SIZE_UNREAD
+		}
+	case "ioctl":
+		cmd := c.Args[1]
+		// Freeze kills machine. Though, it is an interesting functions,
+		// so we need to test it somehow.
+		// TODO: not required if executor drops privileges.
+		if uint32(cmd.Val) == sys.FIFREEZE {
+			cmd.Val = sys.FITHAW
+		}
+	case "ptrace":
+		// PTRACE_TRACEME leads to unkillable processes, see:
+		// https://groups.google.com/forum/#!topic/syzkaller/uGzwvhlCXAw
+		if c.Args[0].Val == sys.PTRACE_TRACEME {
+			c.Args[0].Val = ^uintptr(0)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+//go:build freebsd || netbsd || openbsd
+// +build freebsd netbsd openbsd
+
+package prog
+
+import (
+	"github.com/google/syzkaller/sys"
+)
+
+// sanitizeTargetCall fixes up arguments of BSD syscalls that are known to
+// break the machine or to produce non-deterministic results.
+func sanitizeTargetCall(c *Call) {
+	switch c.Meta.CallName {
+	case "mknod", "mknodat":
+		mode := c.Args[1]
+		if c.Meta.CallName == "mknodat" {
+			mode = c.Args[2]
+		}
+		if mode.Kind != ArgConst {
+			panic("mknod mode is not const")
+		}
+		// Char and block devices read/write io ports, kernel memory and do other nasty things.
+		if mode.Val != sys.S_IFREG && mode.Val != sys.S_IFIFO && mode.Val != sys.S_IFSOCK {
+			mode.Val = sys.S_IFIFO
+		}
+	case "ptrace":
+		// PT_TRACE_ME leads to unkillable processes, same as on Linux.
+		if c.Args[0].Val == sys.PT_TRACE_ME {
+			c.Args[0].Val = ^uintptr(0)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+//go:build windows_nt
+// +build windows_nt
+
+package prog
+
+// sanitizeTargetCall fixes up arguments of Windows calls. NT calls that could break
+// the executor (e.g. releasing the data region) are excluded by the descriptions instead.
+func sanitizeTargetCall(c *Call) {
+}
@@ -33,6 +33,50 @@ func TestAssignSizeRandom(t *testing.T) {
 	}
 }
 
+func TestSizeCache(t *testing.T) {
+	rs, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		p := Generate(rs, 10, nil)
+		p.SerializeForExec(0)
+		for try := 0; try <= 10; try++ {
+			p.Mutate(rs, 10, nil, nil)
+			// Deserialized program does not have any cached sizes,
+			// so if cached sizes in p are stale, the results will differ.
+			p1, err := Deserialize(p.Serialize())
+			if err != nil {
+				t.Fatalf("failed to deserialize program: %v", err)
+			}
+			if data, data1 := p.SerializeForExec(0), p1.SerializeForExec(0); !bytes.Equal(data, data1) {
+				t.Fatalf("stale cached sizes after mutation:\n%s", p.Serialize())
+			}
+		}
+	}
+}
+
+func TestSizeConcurrent(t *testing.T) {
+	// Programs are shared between procs (corpus, hints),
+	// run with -race to check that serialization does not write to them.
+	rs, iters := initTest(t)
+	for i := 0; i < iters; i++ {
+		p := Generate(rs, 10, nil)
+		p1, err := Deserialize(p.Serialize())
+		if err != nil {
+			t.Fatalf("failed to deserialize program: %v", err)
+		}
+		for _, p := range []*Prog{p, p1} {
+			done := make(chan []byte)
+			for j := 0; j < 2; j++ {
+				go func() {
+					done <- p.SerializeForExec(0)
+				}()
+			}
+			if data, data1 := <-done, <-done; !bytes.Equal(data, data1) {
+				t.Fatalf("concurrent serialization results differ:\n%s", p.Serialize())
+			}
+		}
+	}
+}
+
 func TestAssignSize(t *testing.T) {
 	tests := []struct {
 		unsizedProg string
@@ -106,6 +150,18 @@ func TestAssignSize(t *testing.T) {
 			"syz_test$length16(&(0x7f0000000000)={[0x42, 0x42], 0xff, 0xff, 0xff, 0xff, 0xff})",
 			"syz_test$length16(&(0x7f0000000000)={[0x42, 0x42], 0x2, 0x10, 0x8, 0x4, 0x2})",
 		},
+		{
+			"syz_test$netlink0(&(0x7f0000000000)={0x0, 0x10, 0x1, 0x0, 0x0, {0xff, [@a0={{0x0, 0x1, 0x42}}, @a1={{0x0, 0x2, [{{0x0, 0x3, 0x1}}, {{0x0, 0x3, 0x2}}]}}, @a2={{0x0, 0x4}}]}})",
+			"syz_test$netlink0(&(0x7f0000000000)={0x34, 0x10, 0x1, 0x0, 0x0, {0xff, [@a0={{0x8, 0x1, 0x42}}, @a1={{0x14, 0x2, [{{0x5, 0x3, 0x1}}, {{0x5, 0x3, 0x2}}]}}, @a2={{0x4, 0x4}}]}})",
+		},
+		{
+			"syz_test$fmt0(&(0x7f0000000000)={0x1ff, 0x2, 0x8, 0x0})",
+			"syz_test$fmt0(&(0x7f0000000000)={0x1ff, 0x2, 0x8, 0x3e})",
+		},
+		{
+			"syz_test$template0(&(0x7f0000000000)={0x42, 0x0, {0x43, 0x0, 0xff}})",
+			"syz_test$template0(&(0x7f0000000000)={0x42, 0xc, {0x43, 0x8, 0xff}})",
+		},
 	}
 
 	for i, test := range tests {
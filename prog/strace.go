@@ -0,0 +1,496 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/syzkaller/sys"
+)
+
+// ParseStrace converts strace output (e.g. strace -f -s 65500 -o trace ./workload)
+// into a program. Call arguments are taken from the trace where they can be converted
+// (numbers, strings, arrays and structs), the rest are generated randomly. Resources
+// are threaded through the program: an argument equal to the value returned by a preceding
+// call that produces a compatible resource refers to the result of that call.
+// Symbolic constants (e.g. O_RDONLY) are not known, strace -X raw prints numeric values.
+// Returns the program and number of skipped calls per name (calls without descriptions).
+func ParseStrace(data []byte, rs rand.Source, ct *ChoiceTable) (*Prog, map[string]int, error) {
+	ctx := &straceCtx{
+		r:       newRand(rs),
+		s:       newState(ct),
+		p:       new(Prog),
+		results: make(map[uintptr][]*Arg),
+		skipped: make(map[string]int),
+	}
+	pending := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		pid, ln := straceLinePrefix(s.Text())
+		if ln == "" || strings.HasPrefix(ln, "---") || strings.HasPrefix(ln, "+++") {
+			// Signals and exits.
+			continue
+		}
+		if pos := strings.Index(ln, " <unfinished ...>"); pos != -1 {
+			pending[pid] = ln[:pos]
+			continue
+		}
+		if strings.HasPrefix(ln, "<... ") {
+			pos := strings.Index(ln, " resumed>")
+			if pos == -1 || pending[pid] == "" {
+				continue
+			}
+			ln = pending[pid] + ln[pos+len(" resumed>"):]
+			delete(pending, pid)
+		}
+		call, err := parseStraceCall(ln)
+		if err != nil {
+			continue
+		}
+		ctx.convertCall(call)
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.p.validate(); err != nil {
+		return nil, nil, fmt.Errorf("converted program is broken: %v", err)
+	}
+	return ctx.p, ctx.skipped, nil
+}
+
+// straceSkip are calls that would break the program memory layout or terminate it.
+var straceSkip = map[string]bool{
+	"mmap":       true,
+	"munmap":     true,
+	"mremap":     true,
+	"brk":        true,
+	"exit":       true,
+	"exit_group": true,
+	"execve":     true,
+}
+
+var (
+	stracePidRe  = regexp.MustCompile(`^(?:\[pid +([0-9]+)\]|([0-9]+)) +`)
+	straceTimeRe = regexp.MustCompile(`^[0-9:.]+ +`)
+	straceCallRe = regexp.MustCompile(`^([a-z0-9_]+)\(`)
+	straceRetRe  = regexp.MustCompile(`^ *= +(-?[0-9a-fx]+|\?)`)
+)
+
+// straceLinePrefix strips pid (strace -f) and timestamp (strace -t/-tt/-ttt) off the line.
+func straceLinePrefix(ln string) (string, string) {
+	pid := ""
+	if m := stracePidRe.FindStringSubmatch(ln); m != nil {
+		pid = m[1] + m[2]
+		ln = ln[len(m[0]):]
+	}
+	if m := straceTimeRe.FindString(ln); m != "" {
+		ln = ln[len(m):]
+	}
+	return pid, strings.TrimSpace(ln)
+}
+
+type straceKind int
+
+const (
+	straceAtom   straceKind = iota // number, symbolic constant, NULL, etc
+	straceString                   // quoted string
+	straceList                     // [a, b]
+	straceStruct                   // {a=1, b=2}
+)
+
+type straceVal struct {
+	kind  straceKind
+	atom  string
+	str   []byte
+	inner []*straceVal
+}
+
+type straceCall struct {
+	name   string
+	args   []*straceVal
+	ret    uintptr
+	hasRet bool // call succeeded and returned ret
+}
+
+func parseStraceCall(ln string) (*straceCall, error) {
+	m := straceCallRe.FindStringSubmatch(ln)
+	if m == nil {
+		return nil, fmt.Errorf("not a syscall")
+	}
+	p := &straceParser{data: ln[len(m[0]):]}
+	call := &straceCall{name: m[1]}
+	call.args = p.parseList(')')
+	if p.err != nil {
+		return nil, p.err
+	}
+	r := straceRetRe.FindStringSubmatch(p.data)
+	if r == nil {
+		return nil, fmt.Errorf("no return value")
+	}
+	if v, err := strconv.ParseInt(r[1], 0, 64); err == nil && v >= 0 {
+		call.ret, call.hasRet = uintptr(v), true
+	} else if v, err := strconv.ParseUint(r[1], 0, 64); err == nil && int64(v) >= 0 {
+		call.ret, call.hasRet = uintptr(v), true
+	}
+	return call, nil
+}
+
+type straceParser struct {
+	data string
+	err  error
+}
+
+func (p *straceParser) skipSpace() {
+	for {
+		p.data = strings.TrimLeft(p.data, " ")
+		if !strings.HasPrefix(p.data, "/*") {
+			return
+		}
+		end := strings.Index(p.data, "*/")
+		if end == -1 {
+			p.data = ""
+			return
+		}
+		p.data = p.data[end+2:]
+	}
+}
+
+// parseList parses comma-separated values up to the closing character (consumed).
+func (p *straceParser) parseList(end byte) []*straceVal {
+	var vals []*straceVal
+	for p.err == nil {
+		p.skipSpace()
+		if p.data == "" {
+			p.err = fmt.Errorf("unexpected end of line")
+			return nil
+		}
+		if p.data[0] == end {
+			p.data = p.data[1:]
+			return vals
+		}
+		if v := p.parseVal(); v != nil {
+			vals = append(vals, v)
+		}
+		p.skipSpace()
+		if strings.HasPrefix(p.data, ",") {
+			p.data = p.data[1:]
+		}
+	}
+	return nil
+}
+
+func (p *straceParser) parseVal() *straceVal {
+	// Struct fields look as "name=value".
+	if pos := strings.IndexAny(p.data, "=,{}[]()\""); pos > 0 && p.data[pos] == '=' &&
+		!strings.ContainsAny(p.data[:pos], " |") {
+		p.data = p.data[pos+1:]
+	}
+	if p.data == "" {
+		p.err = fmt.Errorf("unexpected end of line")
+		return nil
+	}
+	switch p.data[0] {
+	case '"':
+		v := &straceVal{kind: straceString, str: p.parseString()}
+		// Truncated strings are followed by "...".
+		p.data = strings.TrimPrefix(p.data, "...")
+		return v
+	case '[':
+		p.data = p.data[1:]
+		return &straceVal{kind: straceList, inner: p.parseList(']')}
+	case '{':
+		p.data = p.data[1:]
+		return &straceVal{kind: straceStruct, inner: p.parseList('}')}
+	}
+	// Atom extends up to the next top-level comma or closing bracket.
+	depth := 0
+	i := 0
+loop:
+	for ; i < len(p.data); i++ {
+		switch p.data[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth == 0 {
+				break loop
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				break loop
+			}
+		}
+	}
+	if i == 0 {
+		p.err = fmt.Errorf("unexpected %q", p.data[0])
+		return nil
+	}
+	atom := strings.TrimSpace(p.data[:i])
+	p.data = p.data[i:]
+	if atom == "..." {
+		return nil
+	}
+	return &straceVal{kind: straceAtom, atom: atom}
+}
+
+func (p *straceParser) parseString() []byte {
+	var buf []byte
+	for i := 1; i < len(p.data); i++ {
+		c := p.data[i]
+		switch c {
+		case '"':
+			p.data = p.data[i+1:]
+			return buf
+		case '\\':
+			if i+1 == len(p.data) {
+				break
+			}
+			i++
+			switch c1 := p.data[i]; c1 {
+			case 'n':
+				buf = append(buf, '\n')
+			case 't':
+				buf = append(buf, '\t')
+			case 'r':
+				buf = append(buf, '\r')
+			case 'v':
+				buf = append(buf, '\v')
+			case 'f':
+				buf = append(buf, '\f')
+			case 'x':
+				if i+2 < len(p.data) {
+					if v, err := strconv.ParseUint(p.data[i+1:i+3], 16, 8); err == nil {
+						buf = append(buf, byte(v))
+						i += 2
+					}
+				}
+			default:
+				if c1 >= '0' && c1 <= '7' {
+					// Octal escape of up to 3 digits.
+					j := i
+					for j < len(p.data) && j < i+3 && p.data[j] >= '0' && p.data[j] <= '7' {
+						j++
+					}
+					v, _ := strconv.ParseUint(p.data[i:j], 8, 8)
+					buf = append(buf, byte(v))
+					i = j - 1
+				} else {
+					buf = append(buf, c1)
+				}
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+	p.err = fmt.Errorf("unterminated string")
+	p.data = ""
+	return buf
+}
+
+// number returns numeric value of an atom, "A|B" atoms are or-ed if all parts are numeric.
+func (v *straceVal) number() (uintptr, bool) {
+	if v == nil || v.kind != straceAtom {
+		return 0, false
+	}
+	if v.atom == "NULL" {
+		return 0, true
+	}
+	var res uintptr
+	for _, part := range strings.Split(v.atom, "|") {
+		n, err := strconv.ParseInt(part, 0, 64)
+		if err != nil {
+			u, err := strconv.ParseUint(part, 0, 64)
+			if err != nil {
+				return 0, false
+			}
+			n = int64(u)
+		}
+		res |= uintptr(n)
+	}
+	return res, true
+}
+
+type straceCtx struct {
+	r       *randGen
+	s       *state
+	p       *Prog
+	results map[uintptr][]*Arg // return values of preceding calls that produce resources
+	skipped map[string]int
+}
+
+func (ctx *straceCtx) convertCall(call *straceCall) {
+	meta := sys.CallMap[call.name]
+	if meta == nil {
+		// Use any variant of the syscall if there is no base description.
+		for _, c := range sys.Calls {
+			if c.CallName == call.name {
+				meta = c
+				break
+			}
+		}
+	}
+	if meta == nil || straceSkip[call.name] {
+		ctx.skipped[call.name]++
+		return
+	}
+	c := &Call{
+		Meta: meta,
+		Ret:  returnArg(meta.Ret),
+	}
+	var calls []*Call
+	for i, typ := range meta.Args {
+		var val *straceVal
+		if i < len(call.args) {
+			val = call.args[i]
+		}
+		arg, calls1 := ctx.arg(typ, val)
+		c.Args = append(c.Args, arg)
+		calls = append(calls, calls1...)
+	}
+	assignSizesCall(c)
+	calls = append(calls, c)
+	for _, c1 := range calls {
+		sanitizeCall(c1)
+		ctx.s.analyze(c1)
+		ctx.p.Calls = append(ctx.p.Calls, c1)
+	}
+	if call.hasRet && c.Ret != nil {
+		if _, ok := c.Ret.Type.(*sys.ResourceType); ok {
+			ctx.results[call.ret] = append(ctx.results[call.ret], c.Ret)
+		}
+	}
+}
+
+// arg converts trace value val to an argument of type typ,
+// falls back to random generation if the value can't be converted.
+func (ctx *straceCtx) arg(typ sys.Type, val *straceVal) (*Arg, []*Call) {
+	if val == nil {
+		return ctx.r.generateArg(ctx.s, typ)
+	}
+	if typ.Dir() == sys.DirOut {
+		switch typ.(type) {
+		case *sys.StructType, *sys.ArrayType:
+			// Converted field-by-field to find output resources.
+		default:
+			arg, calls := ctx.r.generateArg(ctx.s, typ)
+			if _, ok := typ.(*sys.ResourceType); ok {
+				// Output resources (e.g. fds returned by pipe) can be referenced by later calls.
+				if v, ok := val.number(); ok {
+					ctx.results[v] = append(ctx.results[v], arg)
+				}
+			}
+			return arg, calls
+		}
+	}
+	switch a := typ.(type) {
+	case *sys.ResourceType:
+		v, ok := val.number()
+		if !ok {
+			break
+		}
+		if a.Size() == 4 && v <= 0xffffffff {
+			// Raw values of int resources are printed as unsigned 32-bit (e.g. 0xffffff9c for AT_FDCWD).
+			v = uintptr(int64(int32(v)))
+		}
+		// The latest compatible resource with this value.
+		res := ctx.results[v]
+		for i := len(res) - 1; i >= 0; i-- {
+			if sys.IsCompatibleResource(a.Desc.Name, res[i].Type.(*sys.ResourceType).Desc.Name) {
+				return resultArg(a, res[i]), nil
+			}
+		}
+		for _, special := range a.SpecialValues() {
+			if v == special {
+				return constArg(a, v), nil
+			}
+		}
+	case *sys.IntType, *sys.FlagsType:
+		if v, ok := val.number(); ok {
+			return constArg(a, v), nil
+		}
+	case *sys.ConstType:
+		return constArg(a, a.Val), nil
+	case *sys.LenType:
+		// Assigned by assignSizesCall.
+		return constArg(a, 0), nil
+	case *sys.BufferType:
+		if val.kind != straceString {
+			break
+		}
+		data := append([]byte{}, val.str...)
+		switch a.Kind {
+		case sys.BufferString, sys.BufferFilename:
+			if len(data) == 0 || data[len(data)-1] != 0 {
+				data = append(data, 0)
+			}
+		case sys.BufferBlobRange:
+			for uintptr(len(data)) < a.RangeBegin {
+				data = append(data, 0)
+			}
+			if uintptr(len(data)) > a.RangeEnd {
+				data = data[:a.RangeEnd]
+			}
+		case sys.BufferBlobRand, sys.BufferOptions:
+		default:
+			return ctx.r.generateArg(ctx.s, typ)
+		}
+		return dataArg(a, data), nil
+	case *sys.ArrayType:
+		if val.kind != straceList {
+			break
+		}
+		elems := val.inner
+		if a.Kind == sys.ArrayRangeLen {
+			if uintptr(len(elems)) > a.RangeEnd {
+				elems = elems[:a.RangeEnd]
+			}
+			for uintptr(len(elems)) < a.RangeBegin {
+				elems = append(elems, nil)
+			}
+		}
+		var inner []*Arg
+		var calls []*Call
+		for _, elem := range elems {
+			arg, calls1 := ctx.arg(a.Type, elem)
+			inner = append(inner, arg)
+			calls = append(calls, calls1...)
+		}
+		return groupArg(a, inner), calls
+	case *sys.StructType:
+		// strace prints some structs as arrays (e.g. pipe fds).
+		if val.kind != straceStruct && val.kind != straceList || isSpecialStruct(a) != nil {
+			break
+		}
+		// strace field names differ from descriptions, so fields are matched by position.
+		var inner []*Arg
+		var calls []*Call
+		idx := 0
+		for _, field := range a.Fields {
+			var fval *straceVal
+			if !sys.IsPad(field) && idx < len(val.inner) {
+				fval = val.inner[idx]
+				idx++
+			}
+			arg, calls1 := ctx.arg(field, fval)
+			inner = append(inner, arg)
+			calls = append(calls, calls1...)
+		}
+		return groupArg(a, inner), calls
+	case *sys.PtrType:
+		if v, ok := val.number(); ok && v == 0 && a.Optional() {
+			return constArg(a, a.Default()), nil
+		}
+		inner, calls := ctx.arg(a.Type, val)
+		arg, calls1 := ctx.r.addr1(ctx.s, a, inner.Size(), inner)
+		return arg, append(calls, calls1...)
+	}
+	return ctx.r.generateArg(ctx.s, typ)
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStrace(t *testing.T) {
+	rs, _ := initTest(t)
+	trace := `execve("./a.out", ["./a.out"], 0x7ffd6e1c4f40 /* 20 vars */) = 0
+brk(NULL)                               = 0x1c4f000
+1234  openat(0xffffff9c, "/etc/passwd", 0x80000) = 3
+1234  read(3, "root:x:0:0:root:/root:/bin/bash\n"..., 4096) = 4096
+[pid  1235] 12:34:56.123456 pipe([4, 5]) = 0
+[pid  1235] write(5, "\x01\x02\003abc", 6 <unfinished ...>
+1234  close(3)                          = 0
+[pid  1235] <... write resumed> )       = 6
+1234  dup(4) = 6
+1234  openat(0xffffff9c, "/nonexistent", 0) = -1 ENOENT (No such file or directory)
+1234  close(6)                          = 0
+1234  unknown_syscall(1, 2) = 0
+--- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=1235} ---
+1234  exit_group(0)                     = ?
++++ exited with 0 +++
+`
+	p, skipped, err := ParseStrace([]byte(trace), rs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped["execve"] != 1 || skipped["brk"] != 1 || skipped["exit_group"] != 1 || skipped["unknown_syscall"] != 1 {
+		t.Errorf("bad skipped calls: %v", skipped)
+	}
+	var names []string
+	for _, c := range p.Calls {
+		if c.Meta.Name != "mmap" {
+			names = append(names, c.Meta.Name)
+		}
+	}
+	want := "openat read pipe close write dup openat close"
+	if got := strings.Join(names, " "); got != want {
+		t.Fatalf("got calls %q, want %q\n%s", got, want, p.Serialize())
+	}
+	data := string(p.Serialize())
+	for _, s := range []string{
+		// Strings are converted and resources are threaded.
+		`r0 = openat(0xffffffffffffff9c, &(0x7f`,
+		`="2f6574632f70617373776400", 0x80000, `,
+		`read(r0, `,
+		`pipe(&(0x7f`,
+		`={<r1=>0xffffffffffffffff, <r2=>0xffffffffffffffff})`,
+		`write(r2, &(0x7f`,
+		`="010203616263", 0x6)`,
+		`close(r0)`,
+		`r3 = dup(r1)`,
+		`openat(0xffffffffffffff9c, &(0x7f`,
+		`close(r3)`,
+	} {
+		if !strings.Contains(data, s) {
+			t.Errorf("program does not contain %q:\n%s", s, data)
+		}
+	}
+}
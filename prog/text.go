@@ -0,0 +1,155 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/google/syzkaller/ifuzz"
+	"github.com/google/syzkaller/sys"
+)
+
+// textGenerator generates and mutates machine code for one of text kinds.
+// New architectures are supported by adding a generator to textGenerators.
+type textGenerator interface {
+	generate(r *rand.Rand) []byte
+	mutate(r *rand.Rand, text []byte) []byte
+}
+
+var textGenerators = map[sys.TextKind]textGenerator{
+	sys.Text_x86_real: x86Text{ifuzz.ModeReal16},
+	sys.Text_x86_16:   x86Text{ifuzz.ModeProt16},
+	sys.Text_x86_32:   x86Text{ifuzz.ModeProt32},
+	sys.Text_x86_64:   x86Text{ifuzz.ModeLong64},
+	sys.Text_arm64:    arm64Text{},
+	sys.Text_bpf:      bpfText{},
+}
+
+func (r *randGen) generateText(kind sys.TextKind) []byte {
+	return textGenerators[kind].generate(r.Rand)
+}
+
+func (r *randGen) mutateText(kind sys.TextKind, text []byte) []byte {
+	return textGenerators[kind].mutate(r.Rand, text)
+}
+
+const textLen = 10 // number of instructions in generated text
+
+type x86Text struct {
+	mode int
+}
+
+func (t x86Text) generate(r *rand.Rand) []byte {
+	return ifuzz.Generate(t.config(), r)
+}
+
+func (t x86Text) mutate(r *rand.Rand, text []byte) []byte {
+	return ifuzz.Mutate(t.config(), r, text)
+}
+
+func (t x86Text) config() *ifuzz.Config {
+	return &ifuzz.Config{
+		Len:  textLen,
+		Mode: t.mode,
+		Priv: true,
+		Exec: true,
+		MemRegions: []ifuzz.MemRegion{
+			{0 << 12, 1 << 12},
+			{1 << 12, 1 << 12},
+			{2 << 12, 1 << 12},
+			{3 << 12, 1 << 12},
+			{4 << 12, 1 << 12},
+			{5 << 12, 1 << 12},
+			{6 << 12, 1 << 12},
+			{7 << 12, 1 << 12},
+			{8 << 12, 1 << 12},
+			{9 << 12, 1 << 12},
+			{0xfec00000, 0x100}, // ioapic
+		},
+	}
+}
+
+// arm64Text generates sequences of arm64 instructions. All instructions are 4 bytes,
+// so instead of a full instruction table we use encoding classes: fixed bits of a class
+// are taken from the template and the rest (registers, immediates, options) are random.
+type arm64Text struct{}
+
+type arm64Insn struct {
+	bits uint32 // values of fixed bits
+	mask uint32 // which bits are fixed
+}
+
+var arm64Insns = []arm64Insn{
+	{0x11000000, 0x1f800000}, // add/sub (immediate)
+	{0x12000000, 0x1f800000}, // logical (immediate)
+	{0x12800000, 0x1f800000}, // move wide (immediate)
+	{0x13000000, 0x1f800000}, // bitfield
+	{0x13800000, 0x1f800000}, // extract
+	{0x10000000, 0x1f000000}, // adr/adrp
+	{0x0a000000, 0x1f000000}, // logical (shifted register)
+	{0x0b000000, 0x1f200000}, // add/sub (shifted register)
+	{0x1a000000, 0x1fe00000}, // add/sub with carry
+	{0x1a800000, 0x1fe00000}, // conditional select
+	{0x1ac00000, 0x1fe00000}, // data processing (2 source)
+	{0x1b000000, 0x1f000000}, // data processing (3 source)
+	{0x14000000, 0x7c000000}, // b/bl
+	{0x54000000, 0xff000010}, // b.cond
+	{0x34000000, 0x7e000000}, // cbz/cbnz
+	{0x36000000, 0x7e000000}, // tbz/tbnz
+	{0xd61f0000, 0xff9ffc1f}, // br/blr/ret
+	{0xd4000000, 0xff000000}, // svc/hvc/smc/brk/hlt
+	{0xd5000000, 0xffc00000}, // system: msr/mrs, hints, barriers, sys
+	{0xd69f03e0, 0xffffffff}, // eret
+	{0x08000000, 0x3f000000}, // load/store exclusive
+	{0x18000000, 0x3b000000}, // load literal
+	{0x28000000, 0x3a000000}, // load/store pair
+	{0x38000000, 0x3b200000}, // load/store (unscaled/pre/post-indexed)
+	{0x38200800, 0x3b200c00}, // load/store (register offset)
+	{0x39000000, 0x3b000000}, // load/store (unsigned immediate)
+	{0x1e200000, 0x5f200000}, // floating point data processing
+}
+
+func (t arm64Text) generate(r *rand.Rand) []byte {
+	text := make([]byte, 0, textLen*4)
+	for i := 0; i < textLen; i++ {
+		text = t.appendInsn(r, text)
+	}
+	return text
+}
+
+func (t arm64Text) mutate(r *rand.Rand, text []byte) []byte {
+	text = append([]byte{}, text[:len(text)/4*4]...)
+	for stop := false; !stop || len(text) == 0; stop = r.Intn(2) == 0 {
+		n := len(text) / 4
+		switch x := r.Intn(100); {
+		case x < 30 && n != 0:
+			// Replace an instruction.
+			i := r.Intn(n) * 4
+			insn := t.appendInsn(r, nil)
+			copy(text[i:], insn)
+		case x < 60 && n != 0:
+			// Flip a random bit in an instruction.
+			i := r.Intn(n) * 4
+			v := binary.LittleEndian.Uint32(text[i:])
+			binary.LittleEndian.PutUint32(text[i:], v^(1<<uint(r.Intn(32))))
+		case x < 80 || n == 0:
+			// Insert an instruction.
+			i := r.Intn(n+1) * 4
+			insn := t.appendInsn(r, nil)
+			text = append(text[:i], append(insn, text[i:]...)...)
+		default:
+			// Remove an instruction.
+			i := r.Intn(n) * 4
+			text = append(text[:i], text[i+4:]...)
+		}
+	}
+	return text
+}
+
+func (t arm64Text) appendInsn(r *rand.Rand, text []byte) []byte {
+	insn := arm64Insns[r.Intn(len(arm64Insns))]
+	v := insn.bits | uint32(r.Int63())&^insn.mask
+	return append(text, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package prog
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/google/syzkaller/sys"
+)
+
+func TestTextGenerators(t *testing.T) {
+	for kind := sys.Text_x86_real; kind <= sys.Text_arm64; kind++ {
+		if textGenerators[kind] == nil {
+			t.Fatalf("no text generator for kind %v", kind)
+		}
+	}
+}
+
+func TestTextArm64(t *testing.T) {
+	rs, iters := initTest(t)
+	r := rand.New(rs)
+	gen := arm64Text{}
+	checkInsns := func(text []byte) {
+		if len(text) == 0 || len(text)%4 != 0 {
+			t.Fatalf("bad text length %v", len(text))
+		}
+	}
+	for i := 0; i < iters; i++ {
+		text := gen.generate(r)
+		checkInsns(text)
+		if len(text) != textLen*4 {
+			t.Fatalf("generated %v bytes, want %v", len(text), textLen*4)
+		}
+		for j := 0; j < len(text); j += 4 {
+			v := binary.LittleEndian.Uint32(text[j:])
+			found := false
+			for _, insn := range arm64Insns {
+				if v&insn.mask == insn.bits {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatalf("instruction 0x%08x does not belong to any class", v)
+			}
+		}
+		orig := append([]byte{}, text...)
+		text1 := gen.mutate(r, text)
+		checkInsns(text1)
+		if string(orig) != string(text) {
+			t.Fatalf("mutation changed the original text")
+		}
+	}
+}
+
+func TestTextBpf(t *testing.T) {
+	rs, iters := initTest(t)
+	r := rand.New(rs)
+	gen := bpfText{}
+	check := func(text []byte) {
+		if len(text) == 0 || len(text)%bpfInsnSize != 0 {
+			t.Fatalf("bad text length %v", len(text))
+		}
+		insns := gen.decode(text)
+		starts := make(map[int]bool)
+		slot := 0
+		for _, insn := range insns {
+			starts[slot] = true
+			slot++
+			if insn.code == bpfLdImm64 {
+				slot++
+			}
+		}
+		slot = 0
+		for _, insn := range insns {
+			if insn.dst > bpfMaxReg || insn.src > bpfMaxReg {
+				t.Fatalf("bad register in %+v", insn)
+			}
+			if gen.isJump(insn) {
+				target := slot + 1 + int(insn.off)
+				if target <= slot || !starts[target] {
+					t.Fatalf("jump %+v at %v goes to bad target %v", insn, slot, target)
+				}
+			}
+			slot++
+			if insn.code == bpfLdImm64 {
+				slot++
+			}
+		}
+	}
+	for i := 0; i < iters; i++ {
+		text := gen.generate(r)
+		check(text)
+		if last := text[len(text)-bpfInsnSize]; last != bpfClassJMP|bpfJmpExit {
+			t.Fatalf("program does not end with exit: 0x%x", last)
+		}
+		check(gen.mutate(r, text))
+	}
+}
@@ -16,10 +16,23 @@ type validCtx struct {
 
 func (p *Prog) validate() error {
 	ctx := &validCtx{make(map[*Arg]bool), make(map[*Arg]*Arg)}
+	faults := 0
 	for _, c := range p.Calls {
 		if err := c.validate(ctx); err != nil {
 			return err
 		}
+		if c.FailNth < 0 {
+			return fmt.Errorf("syscall %v: negative fail_nth %v", c.Meta.Name, c.FailNth)
+		}
+		if c.FailNth != 0 {
+			faults++
+		}
+		if c.Delay < 0 {
+			return fmt.Errorf("syscall %v: negative delay %v", c.Meta.Name, c.Delay)
+		}
+	}
+	if faults > 1 {
+		return fmt.Errorf("program injects faults into %v calls, at most 1 is supported", faults)
 	}
 	for u, orig := range ctx.uses {
 		if !ctx.args[u] {
@@ -93,6 +106,16 @@ func (c *Call) validate(ctx *validCtx) error {
 			default:
 				return fmt.Errorf("syscall %v: union arg '%v' has bad kind %v", c.Meta.Name, typ.Name(), arg.Kind)
 			}
+		case *sys.PtrType:
+			switch arg.Kind {
+			case ArgPointer:
+			case ArgConst:
+				if !typ1.Optional() && !isSpecialPointer(arg.Val) {
+					return fmt.Errorf("syscall %v: non optional pointer arg '%v' is a const", c.Meta.Name, typ.Name())
+				}
+			default:
+				return fmt.Errorf("syscall %v: pointer arg '%v' has bad kind %v", c.Meta.Name, typ.Name(), arg.Kind)
+			}
 		case *sys.ProcType:
 			if arg.Val >= uintptr(typ1.ValuesPerProc) {
 				return fmt.Errorf("syscall %v: per proc arg '%v' has bad value '%v'", c.Meta.Name, typ.Name(), arg.Val)
@@ -112,6 +135,10 @@ func (c *Call) validate(ctx *validCtx) error {
 				return fmt.Errorf("syscall %v: result arg '%v' has broken link (%+v)", c.Meta.Name, typ.Name(), arg.Res.Uses)
 			}
 		case ArgPointer:
+			if arg.AddrPage+arg.AddrPagesNum > maxPages {
+				return fmt.Errorf("syscall %v: pointer arg '%v' is out of data region: page %v, npages %v",
+					c.Meta.Name, typ.Name(), arg.AddrPage, arg.AddrPagesNum)
+			}
 			switch typ1 := typ.(type) {
 			case *sys.VmaType:
 				if arg.Res != nil {
@@ -145,6 +172,10 @@ func (c *Call) validate(ctx *validCtx) error {
 				if typ2, ok := typ1.Type.(*sys.IntType); !ok || typ2.Size() != 1 {
 					return fmt.Errorf("syscall %v: data arg '%v' should be an array", c.Meta.Name, typ.Name())
 				}
+			case *sys.BufferType:
+				if typ1.Kind == sys.BufferGlob && len(arg.Data) != sys.GlobSize {
+					return fmt.Errorf("syscall %v: glob arg '%v' has wrong size %v", c.Meta.Name, typ.Name(), len(arg.Data))
+				}
 			}
 		case ArgGroup:
 			switch typ1 := typ.(type) {
@@ -191,13 +222,24 @@ func (c *Call) validate(ctx *validCtx) error {
 		return nil
 	}
 	for i, arg := range c.Args {
-		if arg.Kind == ArgReturn {
+		if arg != nil && arg.Kind == ArgReturn {
 			return fmt.Errorf("syscall %v: arg '%v' has wrong return kind", c.Meta.Name, arg.Type.Name())
 		}
 		if err := checkArg(arg, c.Meta.Args[i]); err != nil {
 			return err
 		}
 	}
+	// Analysis marks pages mapped by these calls (see analyze), they must be within the data region.
+	switch c.Meta.Name {
+	case "mmap", "munmap":
+		if err := checkAddressable(c, c.Args[0], c.Args[1]); err != nil {
+			return err
+		}
+	case "mremap":
+		if err := checkAddressable(c, c.Args[4], c.Args[2]); err != nil {
+			return err
+		}
+	}
 	if c.Ret == nil {
 		return fmt.Errorf("syscall %v: return value is absent", c.Meta.Name)
 	}
@@ -213,3 +255,18 @@ func (c *Call) validate(ctx *validCtx) error {
 	}
 	return nil
 }
+
+func checkAddressable(c *Call, addr, size *Arg) error {
+	if addr.Kind != ArgPointer || size.Kind != ArgPageSize {
+		return fmt.Errorf("syscall %v: address args are not pages: %v, %v", c.Meta.Name, addr.Kind, size.Kind)
+	}
+	n := size.AddrPage
+	if size.AddrOffset != 0 {
+		n++
+	}
+	if size.AddrPage > maxPages || addr.AddrPage+n > maxPages {
+		return fmt.Errorf("syscall %v: address range is out of data region: page %v, npages %v",
+			c.Meta.Name, addr.AddrPage, size.AddrPage)
+	}
+	return nil
+}
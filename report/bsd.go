@@ -0,0 +1,170 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"regexp"
+)
+
+// Reports of BSD kernels end when the kernel enters ddb ("db> ", "db{0}> " or "ddb{0}> ").
+var bsdEndRe = regexp.MustCompile(`^d?db(?:\{[0-9]+\})?> `)
+
+// FreeBSD traps panic with the trap type after the "Fatal trap" report (e.g. "panic: page fault").
+var bsdSecondaryRe = regexp.MustCompile(`panic: [a-z ]+fault\r?$`)
+
+// bsdFrame matches a frame of a ddb backtrace and captures the function, frames look as:
+// "vm_fault_hold() at vm_fault_hold+0x2304/frame 0xfffffe00e8ba2a70" (FreeBSD),
+// "sys_ioctl() at netbsd:sys_ioctl+0x1d2" (NetBSD),
+// "sys_ioctl(ffff800022a2c5f8,ffff800022a4a2a0,ffff800022a4a2f0) at sys_ioctl+0x1d2" (OpenBSD).
+const bsdFrame = "([a-zA-Z0-9_]+)\\(.*\\) at (?:netbsd:)?[a-zA-Z0-9_]+\\+"
+
+var bsdFrameRe = regexp.MustCompile(bsdFrame)
+
+// bsdStopped captures the function ddb stopped in:
+// "Stopped in pid 1234.1 (syz-executor0) at netbsd:foo+0x12:" (NetBSD),
+// "Stopped at      foo+0x12:  movq    0x8(%rdi),%rax" (OpenBSD).
+const bsdStopped = "Stopped (?:in pid .* )?at[ \\t]+(?:netbsd:)?([a-zA-Z0-9_]+)\\+"
+
+// bsdPanics are panic formats common to BSD kernels.
+var bsdPanics = []oopsFormat{
+	{
+		compile("panic: kernel diagnostic assertion \"(.*)\" failed: file \"(.*)\", line [0-9]+"),
+		"assert %[1]v failed in %[2]v",
+	},
+	{
+		compile("panic: (.*)"),
+		"panic: %[1]v",
+	},
+}
+
+// bsdLockOrderReversal is a witness report (FreeBSD and OpenBSD), locks look as:
+// " 1st 0xfffff80003b2e4b8 so_rcv (so_rcv, sleep mutex) @ /usr/src/sys/kern/uipc_sockbuf.c:480".
+var bsdLockOrderReversal = &oops{
+	[]byte("lock order reversal:"),
+	[]oopsFormat{
+		{
+			compile("lock order reversal:.*\\n[ \\t]*1st {{ADDR}} (.+?) \\(.*\\n[ \\t]*2nd {{ADDR}} (.+?) \\("),
+			"lock order reversal: %[1]v, %[2]v",
+		},
+	},
+	[]*regexp.Regexp{},
+}
+
+var freebsdOopses = []*oops{
+	&oops{
+		[]byte("Fatal trap"),
+		[]oopsFormat{
+			{
+				compile("Fatal trap ([0-9]+): (.*) while in kernel mode(?:.*\\n)+?--- trap .*---\\n" + bsdFrame),
+				"Fatal trap %[1]v: %[2]v in %[3]v",
+			},
+			{
+				compile("Fatal trap ([0-9]+): (.*) while in kernel mode"),
+				"Fatal trap %[1]v: %[2]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		[]byte("panic:"),
+		bsdPanics,
+		[]*regexp.Regexp{},
+	},
+	bsdLockOrderReversal,
+}
+
+var netbsdOopses = []*oops{
+	&oops{
+		[]byte("fatal page fault in supervisor mode"),
+		[]oopsFormat{
+			{
+				compile("fatal page fault in supervisor mode(?:.*\\n)+?.*" + bsdStopped),
+				"page fault in %[1]v",
+			},
+			{
+				compile("fatal page fault in supervisor mode"),
+				"page fault",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		[]byte("fatal protection fault in supervisor mode"),
+		[]oopsFormat{
+			{
+				compile("fatal protection fault in supervisor mode(?:.*\\n)+?.*" + bsdStopped),
+				"protection fault in %[1]v",
+			},
+			{
+				compile("fatal protection fault in supervisor mode"),
+				"protection fault",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		[]byte("panic:"),
+		bsdPanics,
+		[]*regexp.Regexp{},
+	},
+	// LOCKDEBUG reports: "Mutex error: mutex_vector_enter,542: locking against myself".
+	&oops{
+		[]byte("Mutex error:"),
+		[]oopsFormat{
+			{
+				compile("Mutex error: ([a-zA-Z0-9_]+),[0-9]+: (.*)"),
+				"Mutex error: %[2]v in %[1]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		[]byte("Reader / writer lock error:"),
+		[]oopsFormat{
+			{
+				compile("Reader / writer lock error: ([a-zA-Z0-9_]+),[0-9]+: (.*)"),
+				"Reader / writer lock error: %[2]v in %[1]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+}
+
+var openbsdOopses = []*oops{
+	// "uvm_fault(0xffffffff81e3c4c8, 0x0, 0, 1) -> e" followed by "kernel: page fault trap, code=0".
+	&oops{
+		[]byte("uvm_fault("),
+		[]oopsFormat{
+			{
+				compile("uvm_fault\\((?:.*\\n)+?.*" + bsdStopped),
+				"uvm_fault in %[1]v",
+			},
+			{
+				compile("uvm_fault\\("),
+				"uvm_fault",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		[]byte("kernel: protection fault trap"),
+		[]oopsFormat{
+			{
+				compile("kernel: protection fault trap(?:.*\\n)+?.*" + bsdStopped),
+				"protection fault in %[1]v",
+			},
+			{
+				compile("kernel: protection fault trap"),
+				"protection fault",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		[]byte("panic:"),
+		bsdPanics,
+		[]*regexp.Regexp{},
+	},
+	bsdLockOrderReversal,
+}
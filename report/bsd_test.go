@@ -0,0 +1,145 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"testing"
+)
+
+func TestParseBSD(t *testing.T) {
+	defer SetOS("linux")
+	tests := []struct {
+		os     string
+		log    string
+		title  string
+		report string
+	}{
+		{
+			"freebsd",
+			`syzkaller login: Fatal trap 12: page fault while in kernel mode
+cpuid = 0; apic id = 00
+fault virtual address	= 0x0
+instruction pointer	= 0x20:0xffffffff80b1c4f2
+current process		= 825 (syz-executor0)
+trap number		= 12
+panic: page fault
+cpuid = 0
+KDB: stack backtrace:
+db_trace_self_wrapper() at db_trace_self_wrapper+0x2b/frame 0xfffffe00e8ba2470
+vpanic() at vpanic+0x19c/frame 0xfffffe00e8ba24f0
+panic() at panic+0x43/frame 0xfffffe00e8ba2550
+trap_fatal() at trap_fatal+0x34d/frame 0xfffffe00e8ba25a0
+calltrap() at calltrap+0x8/frame 0xfffffe00e8ba2600
+--- trap 0xc, rip = 0xffffffff80b1c4f2, rsp = 0xfffffe00e8ba26d0, rbp = 0xfffffe00e8ba2700 ---
+sctp_sendm() at sctp_sendm+0x22/frame 0xfffffe00e8ba2700
+sosend_generic() at sosend_generic+0x5a4/frame 0xfffffe00e8ba2790
+KDB: enter: panic
+[ thread pid 825 tid 100123 ]
+Stopped at      kdb_enter+0x3b: movq    $0,kdb_why
+db>
+after ddb
+`,
+			"Fatal trap 12: page fault in sctp_sendm",
+			"",
+		},
+		{
+			"freebsd",
+			`panic: vm_fault_hold: fault on nofault entry, addr: 0xfffffe00e1b6d000
+cpuid = 1
+`,
+			"panic: vm_fault_hold: fault on nofault entry, addr: 0xfffffe00e1b6d000",
+			"",
+		},
+		{
+			"freebsd",
+			`lock order reversal:
+ 1st 0xfffff80003b2e4b8 so_rcv (so_rcv, sleep mutex) @ /usr/src/sys/kern/uipc_sockbuf.c:480
+ 2nd 0xfffff80003a12c08 tcpinp (tcpinp, rw) @ /usr/src/sys/netinet/tcp_usrreq.c:1034
+stack backtrace:
+`,
+			"lock order reversal: so_rcv, tcpinp",
+			"",
+		},
+		{
+			"netbsd",
+			`[  45.1234567] fatal page fault in supervisor mode
+[  45.1234567] trap type 6 code 0 rip 0xffffffff80a1f21f cs 0x8 rflags 0x10246 cr2 0 ilevel 0 rsp 0xffff8000ab4a3d60
+[  45.1234567] curlwp 0xffff8000aa6e6000 pid 1234.1 lowest kstack 0xffff8000ab4a02c0
+Stopped in pid 1234.1 (syz-executor0) at netbsd:pipe_ioctl+0x23:  movq    0x8(%rdi),%rax
+db{0}> bt
+`,
+			"page fault in pipe_ioctl",
+			`fatal page fault in supervisor mode
+trap type 6 code 0 rip 0xffffffff80a1f21f cs 0x8 rflags 0x10246 cr2 0 ilevel 0 rsp 0xffff8000ab4a3d60
+curlwp 0xffff8000aa6e6000 pid 1234.1 lowest kstack 0xffff8000ab4a02c0
+`,
+		},
+		{
+			"netbsd",
+			`[  45.1234567] Mutex error: mutex_vector_enter,542: locking against myself
+`,
+			"Mutex error: locking against myself in mutex_vector_enter",
+			"",
+		},
+		{
+			"netbsd",
+			`panic: kernel diagnostic assertion "uio->uio_resid >= 0" failed: file "/usr/src/sys/kern/subr_copy.c", line 123
+`,
+			"assert uio->uio_resid >= 0 failed in /usr/src/sys/kern/subr_copy.c",
+			"",
+		},
+		{
+			"openbsd",
+			`uvm_fault(0xffffffff81e3c4c8, 0x0, 0, 1) -> e
+kernel: page fault trap, code=0
+Stopped at      pf_test+0x12:   movq    0x8(%rdi),%rax
+ddb{0}> trace
+pf_test(2,1,ffff800000088000,ffff800022a4a2f0) at pf_test+0x12
+`,
+			"uvm_fault in pf_test",
+			`uvm_fault(0xffffffff81e3c4c8, 0x0, 0, 1) -> e
+kernel: page fault trap, code=0
+Stopped at      pf_test+0x12:   movq    0x8(%rdi),%rax
+ddb{0}> trace
+`,
+		},
+		{
+			"openbsd",
+			`witness: lock order reversal:
+ 1st 0xffffff01fbd2c8b8 vmmaplk (&map->lock) @ /usr/src/sys/uvm/uvm_map.c:4321
+ 2nd 0xffffff01fc8af6a0 inode (&ip->i_lock) @ /usr/src/sys/ufs/ufs/ufs_vnops.c:1573
+`,
+			"lock order reversal: vmmaplk, inode",
+			"",
+		},
+		{
+			// Linux formats are not used for other OSes.
+			"openbsd",
+			`BUG: KASAN: use-after-free in __memset+0x24/0x30
+`,
+			"",
+			"",
+		},
+	}
+	for i, test := range tests {
+		if err := SetOS(test.os); err != nil {
+			t.Fatal(err)
+		}
+		rep := ParseReport([]byte(test.log), nil)
+		title := ""
+		if rep != nil {
+			title = rep.Title
+		}
+		if title != test.title {
+			t.Errorf("#%v: got title %q, want %q", i, title, test.title)
+			continue
+		}
+		if test.report != "" && string(rep.Report) != test.report {
+			t.Errorf("#%v: got report:\n%s\nwant:\n%s", i, rep.Report, test.report)
+		}
+	}
+	if err := SetOS("plan9"); err == nil {
+		t.Errorf("no error for unsupported OS")
+	}
+}
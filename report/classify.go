@@ -0,0 +1,91 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"regexp"
+)
+
+// Severity is a rough estimation of how dangerous a bug is, used to prioritize crashes.
+type Severity int
+
+const (
+	SeverityLow    Severity = iota // warnings, leaks, data races, undefined behavior
+	SeverityMedium                 // crashes, hangs, deadlocks, uses of uninitialized memory
+	SeverityHigh                   // memory corruptions, use-after-frees in particular
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityLow:
+		return "low"
+	case SeverityMedium:
+		return "medium"
+	case SeverityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// Class is a bug type (e.g. "use-after-free" or "warning") and severity of a crash.
+type Class struct {
+	Type     string
+	Severity Severity
+}
+
+// bugClasses map crash titles to classes, the first matching entry wins.
+var bugClasses = []struct {
+	re    *regexp.Regexp
+	class Class
+}{
+	{
+		regexp.MustCompile(`use-after-free|use-after-scope`),
+		Class{"use-after-free", SeverityHigh},
+	},
+	{
+		regexp.MustCompile(`out-of-bounds|double-free|invalid-free|wild-memory-access|^BUG: Bad page|^BUG: corrupted list|stack-protector|stack guard page`),
+		Class{"memory corruption", SeverityHigh},
+	},
+	{
+		regexp.MustCompile(`^KMSAN:|uninit-value`),
+		Class{"uninitialized memory", SeverityMedium},
+	},
+	{
+		regexp.MustCompile(`^KCSAN:|data-race`),
+		Class{"data race", SeverityLow},
+	},
+	{
+		regexp.MustCompile(`^UBSAN:`),
+		Class{"undefined behavior", SeverityLow},
+	},
+	{
+		regexp.MustCompile(`^memory leak`),
+		Class{"leak", SeverityLow},
+	},
+	{
+		regexp.MustCompile(`possible deadlock|inconsistent lock state|lock order reversal|^Mutex error|^Reader / writer lock error|^BUG: spinlock|still has locks held`),
+		Class{"deadlock", SeverityMedium},
+	},
+	{
+		regexp.MustCompile(`^INFO: task hung|^INFO: rcu detected|^BUG: soft lockup`),
+		Class{"hang", SeverityMedium},
+	},
+	{
+		regexp.MustCompile(`^WARNING|^suspicious RCU usage`),
+		Class{"warning", SeverityLow},
+	},
+}
+
+// Classify returns the bug type and severity of a kernel crash with the given title.
+// Crashes that don't match any specific class (e.g. general protection faults
+// and kernel BUGs) are of "crash" type and medium severity.
+func Classify(title string) Class {
+	for _, bc := range bugClasses {
+		if bc.re.MatchString(title) {
+			return bc.class
+		}
+	}
+	return Class{"crash", SeverityMedium}
+}
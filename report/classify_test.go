@@ -0,0 +1,34 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := map[string]Class{
+		"KASAN: use-after-free Read in tun_detach_all":                  {"use-after-free", SeverityHigh},
+		"KASAN: slab-out-of-bounds Write in memcpy":                     {"memory corruption", SeverityHigh},
+		"KASAN: double-free or invalid-free in kfree":                   {"memory corruption", SeverityHigh},
+		"KMSAN: uninit-value in strlen":                                 {"uninitialized memory", SeverityMedium},
+		"KCSAN: data-race in __d_lookup / d_alloc":                      {"data race", SeverityLow},
+		"UBSAN: shift-out-of-bounds in ip6_fl_create":                   {"memory corruption", SeverityHigh},
+		"UBSAN: signed integer overflow in tcp_ack":                     {"undefined behavior", SeverityLow},
+		"memory leak in tcp_sendmsg (size 64)":                          {"leak", SeverityLow},
+		"possible deadlock on rtnl_mutex in rtnetlink_rcv_msg":          {"deadlock", SeverityMedium},
+		"INFO: task hung in __flush_work":                               {"hang", SeverityMedium},
+		"INFO: rcu detected stall in sys_ioctl":                         {"hang", SeverityMedium},
+		"WARNING in tcp_fastretrans_alert":                              {"warning", SeverityLow},
+		"general protection fault in __lock_acquire":                    {"crash", SeverityMedium},
+		"BUG: unable to handle kernel NULL pointer dereference in sctp": {"crash", SeverityMedium},
+		"Fatal trap 12: page fault in sctp_sendm":                       {"crash", SeverityMedium},
+		"lock order reversal: so_rcv, tcpinp":                           {"deadlock", SeverityMedium},
+	}
+	for title, want := range tests {
+		if got := Classify(title); got != want {
+			t.Errorf("%q: got class %+v, want %+v", title, got, want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"bytes"
+	"regexp"
+)
+
+var (
+	linuxFrameRe = regexp.MustCompile(`[a-zA-Z0-9_.]+\+0x[0-9a-f]+/0x[0-9a-f]+`)
+	// Reports of sanitizers end with a line of '=', warnings and oopses with an end trace marker.
+	linuxEndTypes = map[string]bool{
+		"KASAN":   true,
+		"KMSAN":   true,
+		"KCSAN":   true,
+		"UBSAN":   true,
+		"WARNING": true,
+		"GPF":     true,
+	}
+)
+
+// corruptedReason returns why the report looks corrupted, or an empty string if it looks fine.
+// ended says if the report ended with the end line.
+func corruptedReason(rep *Report, oops *oops, ended bool, ignores []*regexp.Regexp) string {
+	lines := bytes.Split(rep.Report, []byte{'\n'})
+	if len(lines) != 0 {
+		// The first line is the header, it may contain a frame (e.g. "BUG: KASAN: ... in foo+0x1/0x2").
+		lines = lines[1:]
+	}
+	if endTypes[rep.Type] && !ended {
+		return "report is truncated (no end marker)"
+	}
+	hasFrames := false
+	for _, line := range lines {
+		if frameRe.Match(line) {
+			hasFrames = true
+		}
+		// Panics caused by the report itself and repeated headers of the same kind
+		// (e.g. several hung tasks) are part of the report.
+		if secondaryRe.Match(line) {
+			continue
+		}
+		for _, oops1 := range oopses {
+			if oops1 != oops && matchOops(line, oops1, ignores) != -1 {
+				return "report is interleaved with another report"
+			}
+		}
+	}
+	if !hasFrames {
+		return "report has no stack trace"
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"testing"
+)
+
+func TestCorrupted(t *testing.T) {
+	tests := []struct {
+		log    string
+		reason string
+	}{
+		{
+			`[   12.100000] BUG: KASAN: use-after-free in __memset+0x24/0x30
+[   12.100000] Write of size 8 at addr ffff88002bde1e40 by task syz-executor/4070
+[   12.100000]  [<ffffffff82d4e304>] __memset+0x24/0x30
+[   12.100000]  [<ffffffff82d4e305>] sock_ioctl+0x24/0x30
+[   12.100000] ==================================================================
+`,
+			"",
+		},
+		{
+			`[   12.100000] BUG: KASAN: use-after-free in __memset+0x24/0x30
+[   12.100000] Write of size 8 at addr ffff88002bde1e40 by task syz-executor/4070
+[   12.100000]  [<ffffffff82d4e304>] __memset+0x24/0x30
+`,
+			"report is truncated (no end marker)",
+		},
+		{
+			`[   20.000000] WARNING: CPU: 1 PID: 1 at net/core/dev.c:123 dev_close+0x12/0x30
+[   20.000001] Modules linked in:
+[   20.000002] Call Trace:
+[   20.000003] BUG: unable to handle kernel NULL pointer dereference at 0000000000000010
+[   20.000004]  dev_close+0x12/0x30
+[   20.000005] ---[ end trace 8b5a4e6c9a0a5c2d ]---
+`,
+			"report is interleaved with another report",
+		},
+		{
+			`[   20.000000] WARNING: CPU: 1 PID: 1 at net/core/dev.c:123 dev_close+0x12/0x30
+[   20.000001] Modules linked in:
+[   20.000005] ---[ end trace 8b5a4e6c9a0a5c2d ]---
+`,
+			"report has no stack trace",
+		},
+		{
+			`[   20.000000] WARNING: CPU: 1 PID: 1 at net/core/dev.c:123 dev_close+0x12/0x30
+[   20.000001] Kernel panic - not syncing: panic_on_warn set ...
+[   20.000002] Call Trace:
+[   20.000004]  dev_close+0x12/0x30
+[   20.000005] ---[ end Kernel panic - not syncing: panic_on_warn set ...
+`,
+			"",
+		},
+		{
+			`[  246.752114] INFO: task syz-executor0:5043 blocked for more than 120 seconds.
+[  246.777440] Call Trace:
+[  246.780024]  schedule+0xf5/0x430
+[  246.780025]  rtnl_lock+0x17/0x20
+[  246.780026] INFO: task syz-executor1:5044 blocked for more than 120 seconds.
+[  246.780027] Call Trace:
+[  246.780028]  schedule+0xf5/0x430
+`,
+			"",
+		},
+	}
+	for i, test := range tests {
+		// The first report in the log, ParseReport may select another one.
+		rep := parseReport([]byte(test.log), 0, nil)
+		if rep == nil {
+			t.Fatalf("#%v: no report", i)
+		}
+		if rep.CorruptedReason != test.reason || rep.Corrupted != (test.reason != "") {
+			t.Errorf("#%v: got corrupted %v %q, want %q", i, rep.Corrupted, rep.CorruptedReason, test.reason)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"regexp"
+)
+
+// Zircon panics end with the end of the backtrace ("bt#05: end").
+var fuchsiaEndRe = regexp.MustCompile(`bt#[0-9]+: end`)
+
+// fuchsiaFrameRe matches a frame of a Zircon backtrace: "bt#01: 0xffffffff8011f7d9".
+// Frames contain only PCs, function names appear only after symbolization.
+var fuchsiaFrameRe = regexp.MustCompile(`bt#[0-9]+: 0x[0-9a-f]+`)
+
+// Zircon panics are not caused by other reports, empty lines never contain a panic header.
+var fuchsiaSecondaryRe = regexp.MustCompile(`^$`)
+
+// fuchsiaOopses describe Zircon panics, the panic message follows the header:
+// "panic (caller 0xffffffff80137f1a frame 0xffffff9cfa6c7c50): DEBUG ASSERT FAILED at (kernel/object/handle.cpp:107): ...".
+var fuchsiaOopses = []*oops{
+	&oops{
+		[]byte("ZIRCON KERNEL PANIC"),
+		[]oopsFormat{
+			{
+				compile("ZIRCON KERNEL PANIC(?:.*\\n)+?panic \\(caller {{ADDR}} frame {{ADDR}}\\): (?:DEBUG )?ASSERT FAILED at \\((.+?):[0-9]+\\): (.*)"),
+				"ASSERT FAILED in %[1]v: %[2]v",
+			},
+			{
+				compile("ZIRCON KERNEL PANIC(?:.*\\n)+?panic \\(caller {{ADDR}} frame {{ADDR}}\\): (.*)"),
+				"KERNEL PANIC: %[1]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"testing"
+)
+
+func TestParseFuchsia(t *testing.T) {
+	if err := SetOS("fuchsia"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetOS("linux")
+	tests := []struct {
+		log       string
+		title     string
+		report    string
+		corrupted bool
+	}{
+		{
+			`[00012.345] 01234.01290> executing program 0
+ZIRCON KERNEL PANIC
+
+panic (caller 0xffffffff80137f1a frame 0xffffff9cfa6c7c50): DEBUG ASSERT FAILED at (kernel/object/handle.cpp:107): handle->process_id() == 0
+platform_halt suggested_action 0 reason 9
+Halting...
+bt#00: 0xffffffff80136f6e
+bt#01: 0xffffffff8011f7d9
+bt#02: 0xffffffff8014a08e
+bt#03: end
+Halted
+`,
+			"ASSERT FAILED in kernel/object/handle.cpp: handle->process_id() == 0",
+			`ZIRCON KERNEL PANIC
+
+panic (caller 0xffffffff80137f1a frame 0xffffff9cfa6c7c50): DEBUG ASSERT FAILED at (kernel/object/handle.cpp:107): handle->process_id() == 0
+platform_halt suggested_action 0 reason 9
+Halting...
+bt#00: 0xffffffff80136f6e
+bt#01: 0xffffffff8011f7d9
+bt#02: 0xffffffff8014a08e
+bt#03: end
+`,
+			false,
+		},
+		{
+			`ZIRCON KERNEL PANIC
+
+panic (caller 0xffffffff8010e5f0 frame 0xffffff9ccb2dfb90): pmm_alloc_page failed
+bt#00: 0xffffffff8010e5f0
+bt#01: end
+`,
+			"KERNEL PANIC: pmm_alloc_page failed",
+			"",
+			false,
+		},
+		{
+			// The panic message is lost, the header is the title.
+			`ZIRCON KERNEL PANIC
+`,
+			"ZIRCON KERNEL PANIC",
+			"",
+			true,
+		},
+	}
+	for i, test := range tests {
+		rep := ParseReport([]byte(test.log), nil)
+		if rep == nil {
+			t.Errorf("#%v: no report found", i)
+			continue
+		}
+		if rep.Title != test.title {
+			t.Errorf("#%v: got title %q, want %q", i, rep.Title, test.title)
+		}
+		if test.report != "" && string(rep.Report) != test.report {
+			t.Errorf("#%v: got report:\n%s\nwant:\n%s", i, rep.Report, test.report)
+		}
+		if rep.Corrupted != test.corrupted {
+			t.Errorf("#%v: got corrupted %v (%v), want %v", i, rep.Corrupted, rep.CorruptedReason, test.corrupted)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Source file references in symbolized frames and in WARNING/BUG headers.
+	guiltyFileRe = regexp.MustCompile(`(?:^|[\s(])([a-zA-Z0-9_\-/.]+\.[chS]):[0-9]+`)
+	// Files of sanitizers, allocators, locking, tracing and oops machinery that
+	// appear in reports but are almost never responsible for the bug.
+	guiltyFileBlacklist = []*regexp.Regexp{
+		regexp.MustCompile(`^mm/kasan/`),
+		regexp.MustCompile(`^mm/kmsan/`),
+		regexp.MustCompile(`^kernel/kcsan/`),
+		regexp.MustCompile(`^kernel/kcov\.c`),
+		regexp.MustCompile(`^mm/sl[aou]b(?:_common)?\.c`),
+		regexp.MustCompile(`^mm/(?:page_alloc|vmalloc|kmemleak|percpu|util|mempool)\.c`),
+		regexp.MustCompile(`^lib/(?:bug|dump_stack|ubsan|stackdepot|vsprintf|refcount|list_debug|debugobjects)\.c`),
+		regexp.MustCompile(`^lib/(?:string|usercopy|iov_iter)\.c`),
+		regexp.MustCompile(`^kernel/(?:panic|exit|softirq|fork|kthread|workqueue|stacktrace)\.c`),
+		regexp.MustCompile(`^kernel/printk/`),
+		regexp.MustCompile(`^kernel/locking/`),
+		regexp.MustCompile(`^kernel/rcu/`),
+		regexp.MustCompile(`^kernel/sched/`),
+		regexp.MustCompile(`^kernel/time/(?:timer|hrtimer)\.c`),
+		regexp.MustCompile(`^kernel/irq/`),
+		regexp.MustCompile(`^kernel/trace/`),
+		regexp.MustCompile(`^arch/[a-z0-9]+/`),
+		regexp.MustCompile(`^include/`),
+		regexp.MustCompile(`^fs/(?:read_write|open|ioctl|file_table)\.c`),
+		regexp.MustCompile(`^net/socket\.c`),
+	}
+)
+
+// ExtractGuiltyFile returns the source file that is most likely responsible for the crash:
+// the first file referenced in the (symbolized) report that is not a sanitizer, allocator
+// or other common infrastructure file. It returns an empty string if there is no such file.
+func ExtractGuiltyFile(report []byte) string {
+	for _, line := range bytes.Split(report, []byte{'\n'}) {
+		for _, match := range guiltyFileRe.FindAllSubmatch(line, -1) {
+			file := filepath.Clean(string(match[1]))
+			if filepath.IsAbs(file) || strings.HasPrefix(file, "..") {
+				continue
+			}
+			blacklisted := false
+			for _, re := range guiltyFileBlacklist {
+				if re.MatchString(file) {
+					blacklisted = true
+					break
+				}
+			}
+			if !blacklisted {
+				return file
+			}
+		}
+	}
+	return ""
+}
+
+// GetMaintainers returns emails of maintainers and mailing lists of the file
+// according to scripts/get_maintainer.pl in the kernel source tree kernelSrc.
+func GetMaintainers(kernelSrc, file string) ([]string, error) {
+	cmd := exec.Command(filepath.Join(kernelSrc, "scripts", "get_maintainer.pl"),
+		"--no-n", "--no-rolestats", "--no-git", "--no-git-fallback", "-f", file)
+	cmd.Dir = kernelSrc
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("get_maintainer.pl failed: %v", err)
+	}
+	return parseMaintainers(out), nil
+}
+
+func parseMaintainers(out []byte) []string {
+	var emails []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		// Emails are either bare or "Name <email>" (with --no-n names are normally omitted).
+		if start := strings.LastIndexByte(line, '<'); start != -1 && strings.HasSuffix(line, ">") {
+			line = line[start+1 : len(line)-1]
+		}
+		if strings.Contains(line, "@") && !strings.ContainsAny(line, " \t") {
+			emails = append(emails, line)
+		}
+	}
+	return emails
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractGuiltyFile(t *testing.T) {
+	tests := []struct {
+		report string
+		file   string
+	}{
+		{
+			`BUG: KASAN: use-after-free in __list_del_entry_valid+0xd2/0xf0 lib/list_debug.c:54
+Read of size 8 at addr ffff8801c9a4d398 by task syz-executor0/3149
+
+CPU: 1 PID: 3149 Comm: syz-executor0 Not tainted 4.14.0-rc1+ #25
+Call Trace:
+ __dump_stack lib/dump_stack.c:16 [inline]
+ dump_stack+0x194/0x257 lib/dump_stack.c:52
+ print_address_description+0x73/0x250 mm/kasan/report.c:252
+ kasan_report+0x25b/0x340 mm/kasan/report.c:409
+ __asan_report_load8_noabort+0x14/0x20 mm/kasan/report.c:430
+ __list_del_entry_valid+0xd2/0xf0 lib/list_debug.c:54
+ __list_del_entry include/linux/list.h:117 [inline]
+ list_del include/linux/list.h:125 [inline]
+ tun_detach_all+0x1a8/0x5e0 drivers/net/tun.c:661
+ tun_chr_close+0x3e/0x50 drivers/net/tun.c:2872
+`,
+			"drivers/net/tun.c",
+		},
+		{
+			`WARNING: CPU: 0 PID: 3021 at net/ipv4/tcp_input.c:2818 tcp_fastretrans_alert+0x1ab/0x2a50
+Kernel panic - not syncing: panic_on_warn set ...
+`,
+			"net/ipv4/tcp_input.c",
+		},
+		{
+			`BUG: KASAN: slab-out-of-bounds in memcpy+0x37/0x50 mm/kasan/kasan.c:303
+ kasan_report+0x25b/0x340 mm/kasan/report.c:409
+ memcpy+0x37/0x50 mm/kasan/kasan.c:303
+ __do_sys_ioctl+0x1a8/0x5e0 /home/user/linux/fs/ioctl.c:661
+`,
+			"",
+		},
+		{
+			`general protection fault: 0000 [#1] SMP KASAN
+RIP: 0010:__lock_acquire+0x2d4/0x4360
+`,
+			"",
+		},
+	}
+	for i, test := range tests {
+		if file := ExtractGuiltyFile([]byte(test.report)); file != test.file {
+			t.Errorf("#%v: got guilty file %q, want %q", i, file, test.file)
+		}
+	}
+}
+
+func TestParseMaintainers(t *testing.T) {
+	out := `"David S. Miller" <davem@davemloft.net>
+netdev@vger.kernel.org
+linux-kernel@vger.kernel.org
+`
+	want := []string{"davem@davemloft.net", "netdev@vger.kernel.org", "linux-kernel@vger.kernel.org"}
+	if got := parseMaintainers([]byte(out)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got maintainers %q, want %q", got, want)
+	}
+}
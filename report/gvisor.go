@@ -0,0 +1,62 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"regexp"
+)
+
+// The Sentry is a Go program, its panics have no end marker and last until the end of the output.
+var gvisorEndRe = regexp.MustCompile(`[^\s\S]`)
+
+// gvisorFrame matches a frame of a goroutine stack in a Sentry package and captures
+// the function with its package and receiver, frames look as:
+// "gvisor.googlesource.com/gvisor/pkg/sentry/kernel.(*Task).run(0xc4201a0000, 0x1)".
+// Frames of the Go runtime are not in gVisor packages, so they are skipped.
+const gvisorFrame = "(?:gvisor\\.googlesource\\.com|gvisor\\.dev)/gvisor/pkg/(?:[a-z0-9_]+/)*([a-z0-9_]+\\.(?:\\(\\*?[a-zA-Z0-9_]+\\)\\.)?[a-zA-Z0-9_.]+)\\("
+
+var gvisorFrameRe = regexp.MustCompile(gvisorFrame)
+
+// Sentry panics are not caused by other reports, empty lines never contain a panic header.
+var gvisorSecondaryRe = regexp.MustCompile(`^$`)
+
+// gvisorOopses describe Sentry panics, Go runtime errors and data races (with runsc built with -race).
+// Titles contain the first Sentry function of the goroutine stack.
+var gvisorOopses = []*oops{
+	&oops{
+		[]byte("panic:"),
+		[]oopsFormat{
+			{
+				// The watchdog panics with -watchdog-action=panic, stacks of all goroutines follow.
+				compile("panic: Sentry detected [0-9]+ stuck task"),
+				"Sentry detected stuck tasks",
+			},
+			{
+				compile("panic: (.*)(?:.*\\n)+?goroutine [0-9]+ \\[(?:.*\\n)+?.*" + gvisorFrame),
+				"panic: %[1]v in %[2]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		[]byte("fatal error:"),
+		[]oopsFormat{
+			{
+				compile("fatal error: (.*)(?:.*\\n)+?goroutine [0-9]+ \\[(?:.*\\n)+?.*" + gvisorFrame),
+				"fatal error: %[1]v in %[2]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		[]byte("WARNING: DATA RACE"),
+		[]oopsFormat{
+			{
+				compile("WARNING: DATA RACE(?:.*\\n)+?.*" + gvisorFrame),
+				"DATA RACE in %[1]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+}
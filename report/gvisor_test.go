@@ -0,0 +1,115 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"testing"
+)
+
+func TestParseGvisor(t *testing.T) {
+	if err := SetOS("gvisor"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetOS("linux")
+	tests := []struct {
+		log       string
+		title     string
+		report    string
+		corrupted bool
+	}{
+		{
+			`2018/05/02 12:34:56 executing program 0:
+panic: runtime error: invalid memory address or nil pointer dereference
+[signal SIGSEGV: segmentation violation code=0x1 addr=0x8 pc=0x6a0f3e]
+
+goroutine 123 [running]:
+panic(0xa2d5e0, 0x1056a10)
+	GOROOT/src/runtime/panic.go:502 +0x229
+gvisor.googlesource.com/gvisor/pkg/sentry/fs.(*Dirent).walk(0x0, 0xc4201a0000, 0xc420b2e000, 0xc42017c1e0, 0x3, 0x1, 0x0, 0x0, 0x0)
+	pkg/sentry/fs/dirent.go:496 +0x2e
+gvisor.googlesource.com/gvisor/pkg/sentry/syscalls/linux.Openat(0xc4201a0000, 0x101, 0xffffffffffffff9c, 0x20000000, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, ...)
+	pkg/sentry/syscalls/linux/sys_file.go:432 +0x8b
+created by gvisor.googlesource.com/gvisor/pkg/sentry/kernel.(*Task).Start
+	pkg/sentry/kernel/task_start.go:258 +0xfe
+`,
+			"panic: runtime error: invalid memory address or nil pointer dereference in fs.(*Dirent).walk",
+			`panic: runtime error: invalid memory address or nil pointer dereference
+[signal SIGSEGV: segmentation violation code=0x1 addr=0x8 pc=0x6a0f3e]
+
+goroutine 123 [running]:
+panic(0xa2d5e0, 0x1056a10)
+	GOROOT/src/runtime/panic.go:502 +0x229
+gvisor.googlesource.com/gvisor/pkg/sentry/fs.(*Dirent).walk(0x0, 0xc4201a0000, 0xc420b2e000, 0xc42017c1e0, 0x3, 0x1, 0x0, 0x0, 0x0)
+	pkg/sentry/fs/dirent.go:496 +0x2e
+gvisor.googlesource.com/gvisor/pkg/sentry/syscalls/linux.Openat(0xc4201a0000, 0x101, 0xffffffffffffff9c, 0x20000000, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, ...)
+	pkg/sentry/syscalls/linux/sys_file.go:432 +0x8b
+created by gvisor.googlesource.com/gvisor/pkg/sentry/kernel.(*Task).Start
+	pkg/sentry/kernel/task_start.go:258 +0xfe
+`,
+			false,
+		},
+		{
+			`panic: Sentry detected 1 stuck task(s):
+	Task tid: 1234 (goroutine 56), entered RunSys state 3m0.1s ago.
+
+goroutine 56 [semacquire]:
+gvisor.googlesource.com/gvisor/pkg/sentry/kernel.(*Task).block(0xc4201a0000, 0x0, 0x0, 0x0)
+	pkg/sentry/kernel/task_block.go:145 +0x1a4
+`,
+			"Sentry detected stuck tasks",
+			"",
+			false,
+		},
+		{
+			`fatal error: concurrent map writes
+
+goroutine 77 [running]:
+runtime.throw(0xa4e1b0, 0x15)
+	GOROOT/src/runtime/panic.go:616 +0x81
+runtime.mapassign_fast64(0x9f3e40, 0xc420456000, 0x5, 0xc4204a0000)
+	GOROOT/src/runtime/hashmap_fast.go:522 +0x3cb
+gvisor.dev/gvisor/pkg/sentry/socket/netlink.(*Socket).Bind(0xc420100000, 0xc4201a0000, 0xc420b2e000, 0xc, 0xc, 0x0)
+	pkg/sentry/socket/netlink/socket.go:240 +0x11c
+`,
+			"fatal error: concurrent map writes in netlink.(*Socket).Bind",
+			"",
+			false,
+		},
+		{
+			`==================
+WARNING: DATA RACE
+Write at 0x00c4200a8e10 by goroutine 57:
+  gvisor.googlesource.com/gvisor/pkg/sentry/mm.(*MemoryManager).MMap()
+      pkg/sentry/mm/syscalls.go:96 +0x53
+`,
+			"DATA RACE in mm.(*MemoryManager).MMap",
+			"",
+			false,
+		},
+		{
+			// The stack is lost, only the message is known.
+			`panic: unexpected state
+`,
+			"panic: unexpected state",
+			"",
+			true,
+		},
+	}
+	for i, test := range tests {
+		rep := ParseReport([]byte(test.log), nil)
+		if rep == nil {
+			t.Errorf("#%v: no report found", i)
+			continue
+		}
+		if rep.Title != test.title {
+			t.Errorf("#%v: got title %q, want %q", i, rep.Title, test.title)
+		}
+		if test.report != "" && string(rep.Report) != test.report {
+			t.Errorf("#%v: got report:\n%s\nwant:\n%s", i, rep.Report, test.report)
+		}
+		if rep.Corrupted != test.corrupted {
+			t.Errorf("#%v: got corrupted %v (%v), want %v", i, rep.Corrupted, rep.CorruptedReason, test.corrupted)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -26,7 +27,78 @@ type oopsFormat struct {
 	fmt string
 }
 
-var oopses = []*oops{
+// lockdepFormats describe lockdep reports, older kernels print them as INFO, newer as WARNING.
+// Titles contain the function that takes the lock, deadlock titles are kept in the format
+// of older syzkaller versions ("possible deadlock in func"), so that crashes are still
+// deduplicated with existing crash dirs and dashboard bugs.
+var lockdepFormats = []oopsFormat{
+	{
+		compile("possible circular locking dependency detected(?:.*\\n)+?.*is trying to acquire lock:\\r?\\n{{LOCK}}"),
+		"possible deadlock in %[2]v",
+	},
+	{
+		compile("possible recursive locking detected(?:.*\\n)+?.*is trying to acquire lock:\\r?\\n{{LOCK}}"),
+		"possible deadlock in %[2]v",
+	},
+	{
+		compile("possible irq lock inversion dependency detected(?:.*\\n)+?.*just changed the state of lock:\\r?\\n{{LOCK}}"),
+		"possible deadlock in %[2]v",
+	},
+	{
+		compile("inconsistent lock state(?:.*\\n)+?.*takes:\\r?\\n{{LOCK}}"),
+		"inconsistent lock state in %[2]v",
+	},
+}
+
+// skipFrames are functions skipped by {{STACK}}: functions a hung task waits in,
+// so the title of a hung task report contains the first function on the stack that is not one of these.
+// Users can add more with Rules.Skip_Frames.
+var skipFrames = []string{
+	"__schedule", "schedule", "schedule_timeout", "schedule_preempt_disabled", "io_schedule", "io_schedule_timeout",
+	"context_switch", "__switch_to", "__switch_to_asm", "[a-z_]*mutex_lock[a-z_]*", "[a-z_]*down_(?:read|write)[a-z_]*",
+	"__down[a-z_]*", "down", "[a-z_]*wait_for_completion[a-z_]*", "[a-z_]*wait_for_common[a-z_]*", "rwsem_[a-z_]*",
+	"call_rwsem_[a-z_]*", "__lock_page[a-z_]*", "lock_page", "wait_on_page_bit[a-z_]*", "bit_wait[a-z_]*",
+	"__wait_on_bit[a-z_]*", "out_of_line_wait_on_bit[a-z_]*",
+}
+
+// Rules of the target OS selected with SetOS.
+var (
+	oopses      = linuxOopses
+	reportEndRe = linuxEndRe
+	frameRe     = linuxFrameRe
+	secondaryRe = linuxSecondaryRe
+	endTypes    = linuxEndTypes
+)
+
+var osParsers = map[string]struct {
+	oopses    []*oops
+	end       *regexp.Regexp  // line that ends a report
+	frame     *regexp.Regexp  // stack frame
+	secondary *regexp.Regexp  // oops line caused by a preceding report, it does not start a report
+	endTypes  map[string]bool // types of reports that always end with the end line
+}{
+	"linux":   {linuxOopses, linuxEndRe, linuxFrameRe, linuxSecondaryRe, linuxEndTypes},
+	"freebsd": {freebsdOopses, bsdEndRe, bsdFrameRe, bsdSecondaryRe, nil},
+	"netbsd":  {netbsdOopses, bsdEndRe, bsdFrameRe, bsdSecondaryRe, nil},
+	"openbsd": {openbsdOopses, bsdEndRe, bsdFrameRe, bsdSecondaryRe, nil},
+	"fuchsia": {fuchsiaOopses, fuchsiaEndRe, fuchsiaFrameRe, fuchsiaSecondaryRe, nil},
+	"windows": {windowsOopses, windowsEndRe, windowsFrameRe, windowsSecondaryRe, nil},
+	"gvisor":  {gvisorOopses, gvisorEndRe, gvisorFrameRe, gvisorSecondaryRe, nil},
+}
+
+// SetOS selects report parsing rules of the target OS ("linux" by default).
+// It must be called before AddRules and before any output is parsed.
+func SetOS(os string) error {
+	parser, ok := osParsers[os]
+	if !ok {
+		return fmt.Errorf("unsupported OS %q", os)
+	}
+	oopses, reportEndRe, frameRe = parser.oopses, parser.end, parser.frame
+	secondaryRe, endTypes = parser.secondary, parser.endTypes
+	return nil
+}
+
+var linuxOopses = []*oops{
 	&oops{
 		[]byte("BUG:"),
 		[]oopsFormat{
@@ -38,6 +110,22 @@ var oopses = []*oops{
 				compile("BUG: KASAN: ([a-z\\-]+) on address(?:.*\\n)+?.*(Read|Write) of size ([0-9]+)"),
 				"KASAN: %[1]v %[2]v of size %[3]v",
 			},
+			{
+				compile("BUG: KASAN: double-free or invalid-free in {{FUNC}}"),
+				"KASAN: double-free or invalid-free in %[1]v",
+			},
+			{
+				compile("BUG: KMSAN: ([a-z\\-]+) in ([a-zA-Z0-9_]+)"),
+				"KMSAN: %[1]v in %[2]v",
+			},
+			{
+				compile("BUG: KCSAN: ([a-z\\-]+) in ([a-zA-Z0-9_]+) / ([a-zA-Z0-9_]+)"),
+				"KCSAN: %[1]v in %[2]v / %[3]v",
+			},
+			{
+				compile("BUG: KCSAN: ([a-z\\-]+) in ([a-zA-Z0-9_]+)"),
+				"KCSAN: %[1]v in %[2]v",
+			},
 			{
 				compile("BUG: unable to handle kernel paging request(?:.*\\n)+?.*IP: {{PC}} +{{FUNC}}"),
 				"BUG: unable to handle kernel paging request in %[1]v",
@@ -50,6 +138,15 @@ var oopses = []*oops{
 				compile("BUG: unable to handle kernel NULL pointer dereference(?:.*\\n)+?.*IP: {{PC}} +{{FUNC}}"),
 				"BUG: unable to handle kernel NULL pointer dereference in %[1]v",
 			},
+			{
+				// Newer kernels print RIP without the PC.
+				compile("BUG: kernel NULL pointer dereference(?:.*\\n)+?.*RIP: [0-9]+:{{FUNC}}"),
+				"BUG: unable to handle kernel NULL pointer dereference in %[1]v",
+			},
+			{
+				compile("BUG: unable to handle page fault(?:.*\\n)+?.*RIP: [0-9]+:{{FUNC}}"),
+				"BUG: unable to handle kernel paging request in %[1]v",
+			},
 			{
 				compile("BUG: spinlock lockup suspected"),
 				"BUG: spinlock lockup suspected",
@@ -78,27 +175,32 @@ var oopses = []*oops{
 				compile("BUG: non-zero nr_pmds on freeing mm"),
 				"BUG: non-zero nr_pmds on freeing mm",
 			},
+			{
+				// Leak reports printed by syz-fuzzer in -leak mode.
+				compile("BUG: memory leak(?:.*\n)+?.*unreferenced object {{ADDR}} \\(size ([0-9]+)\\):(?:.*\n)+?.*backtrace:.*\n.*{{PC}}.*\n.*{{PC}}.*\n.*{{PC}} {{FUNC}}"),
+				"memory leak in %[2]v (size %[1]v)",
+			},
 		},
 		[]*regexp.Regexp{},
 	},
 	&oops{
 		[]byte("WARNING:"),
-		[]oopsFormat{
+		append([]oopsFormat{
 			{
 				compile("WARNING: .* at {{SRC}} {{FUNC}}"),
 				"WARNING in %[2]v",
 			},
-		},
+		}, lockdepFormats...),
 		[]*regexp.Regexp{
 			compile("WARNING: /etc/ssh/moduli does not exist, using fixed modulus"), // printed by sshd
 		},
 	},
 	&oops{
 		[]byte("INFO:"),
-		[]oopsFormat{
+		append([]oopsFormat{
 			{
-				compile("INFO: possible circular locking dependency detected \\](?:.*\\n)+?.*is trying to acquire lock(?:.*\\n)+?.*at: {{PC}} +{{FUNC}}"),
-				"possible deadlock in %[1]v",
+				compile("INFO: rcu_(?:preempt|sched|bh) (?:self-)?detected stall(?:.*\\n)+?.*RIP: [0-9]+:(?:{{PC}} +{{PC}} +)?{{FUNC}}"),
+				"INFO: rcu detected stall in %[1]v",
 			},
 			{
 				compile("INFO: rcu_preempt detected stalls"),
@@ -116,15 +218,23 @@ var oopses = []*oops{
 				compile("INFO: rcu_sched self-detected stall on CPU"),
 				"INFO: rcu detected stall",
 			},
+			{
+				compile("INFO: rcu_(?:preempt|sched|bh) detected expedited stalls"),
+				"INFO: rcu detected expedited stall",
+			},
 			{
 				compile("INFO: suspicious RCU usage(?:.*\n)+?.*?{{SRC}}"),
 				"suspicious RCU usage at %[1]v",
 			},
+			{
+				compile("INFO: task .* blocked for more than [0-9]+ seconds(?:.*\\n)+?.*Call Trace:\\r?\\n{{STACK}}"),
+				"INFO: task hung in %[1]v",
+			},
 			{
 				compile("INFO: task .* blocked for more than [0-9]+ seconds"),
 				"INFO: task hung",
 			},
-		},
+		}, lockdepFormats...),
 		[]*regexp.Regexp{
 			compile("INFO: lockdep is turned off"),
 			compile("INFO: Stall ended before state dump start"),
@@ -147,6 +257,21 @@ var oopses = []*oops{
 				compile("general protection fault:(?:.*\\n)+?.*RIP: [0-9]+:{{PC}} +{{PC}} +{{FUNC}}"),
 				"general protection fault in %[1]v",
 			},
+			{
+				compile("general protection fault:(?:.*\\n)+?.*RIP: [0-9]+:{{FUNC}}"),
+				"general protection fault in %[1]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+	&oops{
+		// Newer kernels, "general protection fault" without the colon is also printed for user processes.
+		[]byte("general protection fault, probably for non-canonical address"),
+		[]oopsFormat{
+			{
+				compile("general protection fault, probably for non-canonical address(?:.*\\n)+?.*RIP: [0-9]+:{{FUNC}}"),
+				"general protection fault in %[1]v",
+			},
 		},
 		[]*regexp.Regexp{},
 	},
@@ -222,18 +347,75 @@ var oopses = []*oops{
 }
 
 var (
-	consoleOutputRe = regexp.MustCompile(`^\[ *[0-9]+\.[0-9]+\] `)
-	questionableRe  = regexp.MustCompile(`(?:\[\<[0-9a-f]+\>\])? \? +[a-zA-Z0-9_.]+\+0x[0-9a-f]+/[0-9a-f]+`)
-	symbolizeRe     = regexp.MustCompile(`(?:\[\<(?:[0-9a-f]+)\>\])? +(?:[0-9]+:)?([a-zA-Z0-9_.]+)\+0x([0-9a-f]+)/0x([0-9a-f]+)`)
-	eoi             = []byte("<EOI>")
+	// Console prefix is the printk timestamp optionally followed by the caller id (CONFIG_PRINTK_CALLER).
+	consoleOutputRe = regexp.MustCompile(`^\[ *[0-9]+\.[0-9]+\](?:\[ *[CT][0-9]+\])? `)
+	// Reports of sanitizers end with a line of '=', oopses with an end trace marker.
+	linuxEndRe = regexp.MustCompile(`^(?:={20,}|.*---\[ end (?:trace|Kernel panic))`)
+	// Panics that are caused by a preceding report (panic_on_warn, hung task and softlockup panics)
+	// and kmemleak objects that follow the "BUG: memory leak" line printed by syz-fuzzer.
+	linuxSecondaryRe = regexp.MustCompile(`Kernel panic - not syncing: (?:panic_on_warn set|hung_task: blocked tasks|softlockup: hung tasks|Fatal exception)|unreferenced object 0x`)
+	questionableRe   = regexp.MustCompile(`(?:\[\<[0-9a-f]+\>\])? \? +[a-zA-Z0-9_.]+\+0x[0-9a-f]+/[0-9a-f]+`)
+	// Frames of kernels without kallsyms contain only PC (the last token on the line).
+	rawPCRe     = regexp.MustCompile(`(?:^|[ \t:])0x(ffff[0-9a-f]{12})\s*$`)
+	symbolizeRe = regexp.MustCompile(`(?:\[\<(?:[0-9a-f]+)\>\])? +(?:[0-9]+:)?([a-zA-Z0-9_.]+)\+0x([0-9a-f]+)/0x([0-9a-f]+)`)
+	eoi         = []byte("<EOI>")
+)
+
+var (
+	titleAddrRe = regexp.MustCompile(`\b(?:0x[0-9a-fA-F]+|[0-9a-f]{8,})\b`)
+	titleTaskRe = regexp.MustCompile(`[a-zA-Z0-9_.:\-]+/[0-9]+\b`)
+	titlePidRe  = regexp.MustCompile(`\b(?:PID|pid):? *[0-9]+\b`)
+	titleSrcRe  = regexp.MustCompile(`(\.[chS]):[0-9]+\b`)
+	titleProcRe = regexp.MustCompile(`\bsyz-(executor|fuzzer)[0-9]+\b`)
+	titleNumRe  = regexp.MustCompile(`\b(?:CPU|cpu)(?::|#)? *[0-9]+\b`)
+	titleSpace  = regexp.MustCompile(`\s+`)
 )
 
+// NormalizeTitle strips parts of a crash description that vary between
+// occurrences of the same bug (addresses, pids, task names, source line numbers),
+// so that the result can be used to group crashes.
+func NormalizeTitle(desc string) string {
+	desc = titleTaskRe.ReplaceAllString(desc, "TASK")
+	desc = titlePidRe.ReplaceAllString(desc, "PID")
+	desc = titleProcRe.ReplaceAllString(desc, "syz-$1")
+	desc = titleNumRe.ReplaceAllString(desc, "CPU")
+	desc = titleSrcRe.ReplaceAllString(desc, "$1")
+	desc = titleAddrRe.ReplaceAllStringFunc(desc, func(addr string) string {
+		// Don't replace words that merely consist of hex letters.
+		if !strings.ContainsAny(addr, "0123456789") {
+			return addr
+		}
+		return "ADDR"
+	})
+	for _, rule := range titleRules {
+		desc = rule.re.ReplaceAllString(desc, rule.replacement)
+	}
+	desc = titleSpace.ReplaceAllString(desc, " ")
+	return strings.TrimSpace(desc)
+}
+
 func compile(re string) *regexp.Regexp {
+	res := regexp.MustCompile(expandTemplates(re, skipFrames))
+	if strings.Contains(re, "{{STACK}}") {
+		stackSources[res] = re
+	}
+	return res
+}
+
+// expandTemplates replaces templates in a report regexp with regexps,
+// skip are the functions skipped by {{STACK}}.
+func expandTemplates(re string, skip []string) string {
+	// Stack trace up to the first frame that is neither questionable nor skipped, captures its function.
+	re = strings.Replace(re, "{{STACK}}", "(?:{{FRAME}}(?:\\? |(?:"+strings.Join(skip, "|")+")[+.]).*\\n)*{{FRAME}}{{FUNC}}", -1)
+	// Lock description printed by lockdep: "(&mm->mmap_sem){++++}, at: [<ffffffff81234567>] func+0x1/0x2".
+	re = strings.Replace(re, "{{LOCK}}", "[^(\\n]*\\((.+?)(?:/[0-9]+)?\\)\\{.*at: (?:{{PC}} +)?{{FUNC}}", -1)
+	// Beginning of a stack frame line (console prefix, indentation and PC), up to the function.
+	re = strings.Replace(re, "{{FRAME}}", "(?:\\[[^\\]\\n]*\\])*[ \\t]+(?:{{PC}} +)?", -1)
 	re = strings.Replace(re, "{{ADDR}}", "0x[0-9a-f]+", -1)
 	re = strings.Replace(re, "{{PC}}", "\\[\\<[0-9a-f]+\\>\\]", -1)
 	re = strings.Replace(re, "{{FUNC}}", "([a-zA-Z0-9_]+)(?:\\.|\\+)", -1)
 	re = strings.Replace(re, "{{SRC}}", "([a-zA-Z0-9-_/.]+\\.[a-z]+:[0-9]+)", -1)
-	return regexp.MustCompile(re)
+	return re
 }
 
 // ContainsCrash searches kernel console output for oops messages.
@@ -257,53 +439,228 @@ func ContainsCrash(output []byte, ignores []*regexp.Regexp) bool {
 	return false
 }
 
-// Parse extracts information about oops from console output.
-// Desc contains a representative description of the first oops (empty if no oops found),
-// text contains whole oops text,
-// start and end denote region of output with oops message(s).
-func Parse(output []byte, ignores []*regexp.Regexp) (desc string, text []byte, start int, end int) {
+// Report contains a kernel crash report extracted from console output.
+type Report struct {
+	// Title is a representative description of the crash (e.g. "KASAN: use-after-free Read in foo").
+	Title string
+	// Type is the kind of the crash (e.g. "KASAN" or "WARNING"), see crashTypes.
+	Type string
+	// Report is the text of the first crash report without console prefixes,
+	// it ends at the end marker of the report if there is one.
+	Report []byte
+	// StartPos and EndPos denote the region of output with the report and subsequent oops messages.
+	StartPos int
+	EndPos   int
+	// Corrupted is set if the report looks corrupted (e.g. truncated or interleaved with
+	// output of other CPUs), CorruptedReason describes why.
+	Corrupted       bool
+	CorruptedReason string
+	// Others are the other reports found in the output (e.g. back-to-back oopses),
+	// in the order of appearance. They are not used for the title, but give context.
+	Others []*Report
+}
+
+// Max number of reports ParseReport extracts from the output.
+const maxReports = 10
+
+// crashTypes maps title prefixes to crash types, crashes of other types are "BUG".
+var crashTypes = []struct {
+	prefix string
+	typ    string
+}{
+	{"KASAN:", "KASAN"},
+	{"KMSAN:", "KMSAN"},
+	{"KCSAN:", "KCSAN"},
+	{"UBSAN:", "UBSAN"},
+	{"WARNING", "WARNING"},
+	{"general protection fault", "GPF"},
+	{"INFO: rcu detected", "RCU stall"},
+	{"INFO: task hung", "HANG"},
+	{"possible deadlock", "LOCKDEP"},
+	{"inconsistent lock state", "LOCKDEP"},
+	{"kernel panic", "panic"},
+	{"panic:", "panic"},
+	{"lock order reversal", "LOCKDEP"},
+	{"Mutex error", "LOCKDEP"},
+	{"Reader / writer lock error", "LOCKDEP"},
+	{"memory leak", "LEAK"},
+}
+
+// ParseReport extracts crash reports from console output, it returns nil if there are none.
+// If the output contains several reports, the primary one is the first report that does
+// not look corrupted (or the first one if all of them do), the rest are attached as Others.
+// Panics caused by a preceding report (e.g. panic_on_warn) are reported only if the output
+// does not contain a root report.
+func ParseReport(output []byte, ignores []*regexp.Regexp) *Report {
+	var reports []*Report
+	for pos := 0; pos < len(output) && len(reports) < maxReports; {
+		rep := parseReport(output, pos, ignores)
+		if rep == nil {
+			break
+		}
+		reports = append(reports, rep)
+		pos = nextReport(output, rep.StartPos, ignores)
+	}
+	return selectReport(reports, nil)
+}
+
+// Select returns the primary report among rep and rep.Others ignoring reports that match
+// any of suppressions, see ParseReport. It returns nil if all reports are suppressed.
+func (rep *Report) Select(suppressions []*regexp.Regexp) *Report {
+	reports := append([]*Report{rep}, rep.Others...)
+	sort.Sort(reportArray(reports))
+	return selectReport(reports, suppressions)
+}
+
+func selectReport(reports []*Report, suppressions []*regexp.Regexp) *Report {
+	var primary *Report
+	for _, rep := range reports {
+		if primary != nil && !primary.Corrupted {
+			break
+		}
+		if rep.suppressed(suppressions) {
+			continue
+		}
+		if primary == nil || !rep.Corrupted {
+			primary = rep
+		}
+	}
+	if primary == nil {
+		return nil
+	}
+	primary.Others = nil
+	for _, rep := range reports {
+		if rep != primary {
+			rep.Others = nil
+			primary.Others = append(primary.Others, rep)
+		}
+	}
+	return primary
+}
+
+func (rep *Report) suppressed(suppressions []*regexp.Regexp) bool {
+	for _, re := range suppressions {
+		if re.Match(rep.Report) {
+			return true
+		}
+	}
+	return false
+}
+
+type reportArray []*Report
+
+func (a reportArray) Len() int           { return len(a) }
+func (a reportArray) Less(i, j int) bool { return a[i].StartPos < a[j].StartPos }
+func (a reportArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// nextReport returns position of the next root oops line after the line at pos,
+// or len(output) if there is none.
+func nextReport(output []byte, pos int, ignores []*regexp.Regexp) int {
+	if next := bytes.IndexByte(output[pos:], '\n'); next != -1 {
+		pos += next + 1
+	} else {
+		return len(output)
+	}
+	for pos < len(output) {
+		next := bytes.IndexByte(output[pos:], '\n')
+		if next != -1 {
+			next += pos
+		} else {
+			next = len(output)
+		}
+		line := output[pos:next]
+		if !secondaryRe.Match(line) {
+			for _, oops := range oopses {
+				if matchOops(line, oops, ignores) != -1 {
+					return pos
+				}
+			}
+		}
+		pos = next + 1
+	}
+	return len(output)
+}
+
+// parseReport extracts the first crash report that starts at or after start.
+func parseReport(output []byte, start int, ignores []*regexp.Regexp) *Report {
 	var oops *oops
-	for pos := 0; pos < len(output); {
+	secondary := false
+	rep := new(Report)
+	// Consoles without printk timestamps are taken as is, otherwise only kernel lines are taken.
+	timestamps := false
+	ended := false
+	for pos := start; pos < len(output); {
 		next := bytes.IndexByte(output[pos:], '\n')
 		if next != -1 {
 			next += pos
 		} else {
 			next = len(output)
 		}
+		line := output[pos:next]
 		for _, oops1 := range oopses {
-			match := matchOops(output[pos:next], oops1, ignores)
+			match := matchOops(line, oops1, ignores)
 			if match == -1 {
 				continue
 			}
-			if oops == nil {
+			if oops == nil || secondary && !secondaryRe.Match(line) {
 				oops = oops1
-				start = pos
-				desc = string(output[pos+match : next])
+				secondary = secondaryRe.Match(line)
+				rep.StartPos = pos
+				rep.Report = nil
+				timestamps = consoleOutputRe.Match(line)
+				ended = false
 			}
-			end = next
+			rep.EndPos = next
 		}
-		if oops != nil {
-			if consoleOutputRe.Match(output[pos:next]) &&
-				(!questionableRe.Match(output[pos:next]) || bytes.Index(output[pos:next], eoi) != -1) {
-				lineStart := bytes.Index(output[pos:next], []byte("] ")) + pos + 2
-				lineEnd := next
-				if lineEnd != 0 && output[lineEnd-1] == '\r' {
-					lineEnd--
+		if oops != nil && !ended {
+			if len(line) != 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			prefix := consoleOutputRe.FindIndex(line)
+			if (prefix != nil || !timestamps) &&
+				(!questionableRe.Match(line) || bytes.Index(line, eoi) != -1) {
+				if prefix != nil {
+					line = line[prefix[1]:]
+				}
+				rep.Report = append(rep.Report, line...)
+				rep.Report = append(rep.Report, '\n')
+				if pos != rep.StartPos && reportEndRe.Match(line) {
+					ended = true
+					if rep.EndPos < next {
+						rep.EndPos = next
+					}
 				}
-				text = append(text, output[lineStart:lineEnd]...)
-				text = append(text, '\n')
 			}
 		}
 		pos = next + 1
 	}
 	if oops == nil {
-		return
+		return nil
 	}
-	desc = extractDescription(output[start:], oops)
-	if len(desc) > 0 && desc[len(desc)-1] == '\r' {
-		desc = desc[:len(desc)-1]
+	rep.Title = strings.TrimSuffix(extractDescription(output[rep.StartPos:], oops), "\r")
+	rep.Type = "BUG"
+	for _, ct := range crashTypes {
+		if strings.HasPrefix(rep.Title, ct.prefix) {
+			rep.Type = ct.typ
+			break
+		}
+	}
+	rep.CorruptedReason = corruptedReason(rep, oops, ended, ignores)
+	rep.Corrupted = rep.CorruptedReason != ""
+	return rep
+}
+
+// Parse extracts information about oops from console output.
+// Desc contains a representative description of the first oops (empty if no oops found),
+// text contains the oops text,
+// start and end denote region of output with oops message(s).
+// See ParseReport for details.
+func Parse(output []byte, ignores []*regexp.Regexp) (desc string, text []byte, start int, end int) {
+	rep := ParseReport(output, ignores)
+	if rep == nil {
+		return
 	}
-	return
+	return rep.Title, rep.Report, rep.StartPos, rep.EndPos
 }
 
 func matchOops(line []byte, oops *oops, ignores []*regexp.Regexp) int {
@@ -358,16 +715,30 @@ func extractDescription(output []byte, oops *oops) string {
 	return string(output[pos:end])
 }
 
+// Symbolize adds file:line info to frames in the crash report text using vmlinux.
 func Symbolize(vmlinux string, text []byte) ([]byte, error) {
+	return SymbolizeCached(vmlinux, text, nil)
+}
+
+// SymbolizeCached is Symbolize that reuses results from cache (if not nil) and adds new results to it.
+// The caller is responsible for flushing the cache.
+func SymbolizeCached(vmlinux string, text []byte, cache *symbolizer.Cache) ([]byte, error) {
 	var symbolized []byte
-	symbols, err := symbolizer.ReadSymbols(vmlinux)
+	readSymbols := symbolizer.ReadSymbols
+	if cache != nil {
+		readSymbols = cache.ReadSymbols
+	}
+	symbols, err := readSymbols(vmlinux)
 	if err != nil {
 		return nil, err
 	}
 	symb := symbolizer.NewSymbolizer()
 	defer symb.Close()
-	symbFunc := func(bin string, pc uint64) ([]symbolizer.Frame, error) {
-		return symb.Symbolize(bin, pc)
+	symbFunc := symb.Symbolize
+	if cache != nil {
+		symbFunc = func(bin string, pc uint64) ([]symbolizer.Frame, error) {
+			return cache.Symbolize(symb.Symbolize, bin, pc)
+		}
 	}
 	// Strip vmlinux location from all paths.
 	strip, _ := filepath.Abs(vmlinux)
@@ -377,7 +748,7 @@ func Symbolize(vmlinux string, text []byte) ([]byte, error) {
 	// so we can infer correct strip prefix from it.
 	if covSymbols := symbols["__sanitizer_cov_trace_pc"]; len(covSymbols) != 0 {
 		for _, covSymb := range covSymbols {
-			frames, _ := symb.Symbolize(vmlinux, covSymb.Addr)
+			frames, _ := symbFunc(vmlinux, covSymb.Addr)
 			if len(frames) > 0 {
 				file := frames[len(frames)-1].File
 				if idx := strings.Index(file, "kernel/kcov.c"); idx != -1 {
@@ -387,9 +758,16 @@ func Symbolize(vmlinux string, text []byte) ([]byte, error) {
 			}
 		}
 	}
+	var sorted []namedSymbol
 	s := bufio.NewScanner(bytes.NewReader(text))
 	for s.Scan() {
 		line := append([]byte{}, s.Bytes()...)
+		if rawPCRe.Match(line) {
+			if sorted == nil {
+				sorted = sortSymbols(symbols)
+			}
+			line = resolveRawPC(sorted, line)
+		}
 		line = append(line, '\n')
 		line = symbolizeLine(symbFunc, symbols, vmlinux, strip, line)
 		symbolized = append(symbolized, line...)
@@ -447,6 +825,47 @@ func symbolizeLine(symbFunc func(bin string, pc uint64) ([]symbolizer.Frame, err
 	return symbolized
 }
 
+type namedSymbol struct {
+	name string
+	symbolizer.Symbol
+}
+
+// sortSymbols returns symbols sorted by address.
+func sortSymbols(symbols map[string][]symbolizer.Symbol) []namedSymbol {
+	var sorted []namedSymbol
+	for name, symbs := range symbols {
+		for _, symb := range symbs {
+			sorted = append(sorted, namedSymbol{name, symb})
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Addr < sorted[j].Addr
+	})
+	return sorted
+}
+
+// resolveRawPC replaces a raw PC printed by kernels without kallsyms with function+offset/size,
+// so that the frame can be symbolized as any other frame.
+func resolveRawPC(sorted []namedSymbol, line []byte) []byte {
+	match := rawPCRe.FindSubmatchIndex(line)
+	if match == nil {
+		return line
+	}
+	pc, err := strconv.ParseUint(string(line[match[2]:match[3]]), 16, 64)
+	if err != nil {
+		return line
+	}
+	idx := sort.Search(len(sorted), func(i int) bool {
+		return sorted[i].Addr > pc
+	}) - 1
+	if idx < 0 || pc >= sorted[idx].Addr+uint64(sorted[idx].Size) {
+		return line
+	}
+	symb := sorted[idx]
+	frame := fmt.Sprintf("%v+0x%x/0x%x", symb.name, pc-symb.Addr, symb.Size)
+	return replace(line, match[2]-2, match[3], []byte(frame))
+}
+
 // replace replaces [start:end] in where with what, inplace.
 func replace(where []byte, start, end int, what []byte) []byte {
 	if len(what) >= end-start {
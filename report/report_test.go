@@ -5,6 +5,7 @@ package report
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -142,6 +143,55 @@ kacpi_hotplug/246 is trying to acquire lock:
 [  131.449866] 
 `: `possible deadlock in serial8250_console_write`,
 
+		`
+[  405.116432] ======================================================
+[  405.122637] WARNING: possible circular locking dependency detected
+[  405.128950] 4.14.0-rc1+ #27 Not tainted
+[  405.132908] ------------------------------------------------------
+[  405.139213] syz-executor7/12467 is trying to acquire lock:
+[  405.144826]  (&mm->mmap_sem){++++}, at: [<ffffffff8186d0bd>] __might_fault+0xdd/0x1d0
+[  405.153018] 
+`: `possible deadlock in __might_fault`,
+
+		`
+[   85.351329] ============================================
+[   85.356771] WARNING: possible recursive locking detected
+[   85.362206] 4.14.0-rc3+ #28 Not tainted
+[   85.366153] --------------------------------------------
+[   85.371592] syz-executor2/3302 is trying to acquire lock:
+[   85.377123]  (sk_lock-AF_INET6/1){+.+.}, at: [<ffffffff83ab6d45>] l2tp_xmit_skb+0x1425/0x1490
+[   85.385677] 
+`: `possible deadlock in l2tp_xmit_skb`,
+
+		`
+[  150.115043] =========================================================
+[  150.121601] WARNING: possible irq lock inversion dependency detected
+[  150.128084] 4.14.0-rc4+ #82 Not tainted
+[  150.132034] ---------------------------------------------------------
+[  150.138592] syz-executor3/17405 just changed the state of lock:
+[  150.144632]  (&(&timer->lock)->rlock){+.-.}, at: sync_timer_callback+0x19/0x80
+[  150.152067] 
+`: `possible deadlock in sync_timer_callback`,
+
+		`
+[  269.312154] ================================
+[  269.316556] WARNING: inconsistent lock state
+[  269.320950] 4.14.0-rc2+ #22 Not tainted
+[  269.324903] --------------------------------
+[  269.329295] inconsistent {SOFTIRQ-ON-W} -> {IN-SOFTIRQ-W} usage.
+[  269.335454] swapper/1/0 [HC0[0]:SC1[1]:HE1:SE0] takes:
+[  269.340812]  (&(&hashinfo->ehash_locks[i])->rlock){+.?.}, at: [<ffffffff83a6a370>] inet_ehash_insert+0x240/0xad0
+[  269.351143] 
+`: `inconsistent lock state in inet_ehash_insert`,
+
+		`
+[  179.113540] INFO: rcu_sched self-detected stall on CPU
+[  179.119003] 	0-...: (1 GPs behind) idle=5d2/140000000000001/0 softirq=12283/12284 fqs=13749 
+[  179.127763] 	 (t=27500 jiffies g=5470 c=5469 q=134)
+[  179.132874] NMI backtrace for cpu 0
+[  179.244520] RIP: 0010:ip6_fragment+0x27e4/0x3860
+`: `INFO: rcu detected stall in ip6_fragment`,
+
 		`
 [ INFO: suspicious RCU usage. ]
 4.3.5-smp-DEV #101 Not tainted
@@ -362,6 +412,25 @@ unreferenced object 0xffff8800342540c0 (size 1864):
     [<ffffffff84b5f47c>] __sock_create+0x37c/0x640 net/socket.c:1162 
 `: `memory leak in sk_prot_alloc (size 1864)`,
 
+		`
+2017/03/01 10:20:30 BUG: memory leak
+unreferenced object 0xffff8800342540c0 (size 1864): 
+  comm "syz-executor3", pid 24109, jiffies 4299060398 (age 27.984s) 
+  hex dump (first 32 bytes): 
+    00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00  ................ 
+  backtrace: 
+    [<ffffffff85c73a22>] kmemleak_alloc+0x72/0xc0 mm/kmemleak.c:915 
+    [<ffffffff816cc14d>] kmem_cache_alloc+0x12d/0x2c0 mm/slub.c:2607 
+    [<ffffffff84b642c9>] sk_prot_alloc+0x69/0x340 net/core/sock.c:1344 
+    [<ffffffff84b6d36a>] sk_alloc+0x3a/0x6b0 net/core/sock.c:1419 
+unreferenced object 0xffff880039a55260 (size 64): 
+  comm "syz-executor3", pid 11746, jiffies 4298984475 (age 16.078s) 
+  backtrace: 
+    [<ffffffff848a2f5f>] sock_kmalloc+0x7f/0xc0 net/core/sock.c:1774 
+    [<ffffffff84e5bea0>] do_ipv6_setsockopt.isra.7+0x15d0/0x2830 net/ipv6/ipv6_sockglue.c:483 
+    [<ffffffff84e5d19b>] ipv6_setsockopt+0x9b/0x140 net/ipv6/ipv6_sockglue.c:885 
+`: `memory leak in sk_prot_alloc (size 1864)`,
+
 		`
 unreferenced object 0xffff880133c63800 (size 1024):
   comm "exe", pid 1521, jiffies 4294894652
@@ -476,8 +545,79 @@ BUG: spinlock lockup suspected on CPU#2, syz-executor/12636
 [  843.340437]  [<ffffffff835bec62>] ? preempt_schedule+0x62/0xa0
 [  843.346418]  [<ffffffff835cbdd2>] tty_ldisc_lock_pair_timeout+0xb2/0x160
 [  843.353363]  [<ffffffff81f8b03f>] tty_ldisc_hangup+0x21f/0x720
+`: `INFO: task hung in tty_ldisc_lock_pair_timeout`,
+
+		`
+[  246.752114] INFO: task syz-executor0:5043 blocked for more than 120 seconds.
+[  246.759388]       Not tainted 4.14.0-rc1+ #25
+[  246.763856] "echo 0 > /proc/sys/kernel/hung_task_timeout_secs" disables this message.
+[  246.771828] syz-executor0   D24008  5043   3020 0x00000004
+[  246.777440] Call Trace:
+[  246.780024]  __schedule+0x8eb/0x2060
+[  246.790556]  ? __sched_text_start+0x8/0x8
+[  246.795117]  schedule+0xf5/0x430
+[  246.809094]  schedule_preempt_disabled+0x10/0x20
+[  246.813826]  __mutex_lock+0x5d4/0x1560
+[  246.840107]  mutex_lock_nested+0x16/0x20
+[  246.844140]  rtnl_lock+0x17/0x20
+[  246.847503]  sock_ioctl+0x1d0/0x4b0
+`: `INFO: task hung in rtnl_lock`,
+
+		`
+[  843.240752] INFO: task getty:2986 blocked for more than 120 seconds.
+[  843.247365]       Not tainted 3.18.0-13280-g93f6785-dirty #12
 `: `INFO: task hung`,
 
+		`
+[   27.453108] BUG: KMSAN: uninit-value in tcp_v4_rcv+0x1db5/0x3fa0
+[   27.453108] CPU: 0 PID: 3551 Comm: syz-executor0 Not tainted 4.13.0+ #4
+`: `KMSAN: uninit-value in tcp_v4_rcv`,
+
+		`
+[   44.211219] BUG: KCSAN: data-race in __d_lookup_rcu / __d_rehash
+[   44.211219]
+[   44.211219] write to 0xffff888108a5e4d8 of 8 bytes by task 2884 on cpu 1:
+`: `KCSAN: data-race in __d_lookup_rcu / __d_rehash`,
+
+		`
+[   44.211219] BUG: KCSAN: data-race in ext4_mark_iloc_dirty
+`: `KCSAN: data-race in ext4_mark_iloc_dirty`,
+
+		`
+[   12.612241] BUG: KASAN: double-free or invalid-free in kfree+0xd6/0x260
+`: `KASAN: double-free or invalid-free in kfree`,
+
+		`
+[   73.110286] UBSAN: shift-out-of-bounds in net/sched/sch_api.c:1237:10
+`: `UBSAN: shift-out-of-bounds in net/sched/sch_api.c:1237:10`,
+
+		`
+[   38.351214] general protection fault, probably for non-canonical address 0xdffffc0000000003: 0000 [#1] PREEMPT SMP KASAN
+[   38.351214] KASAN: null-ptr-deref in range [0x0000000000000018-0x000000000000001f]
+[   38.351214] CPU: 1 PID: 3602 Comm: syz-executor0 Not tainted 4.14.0+ #1
+[   38.351214] RIP: 0010:tcp_sendmsg_locked+0x1a5/0x3a70
+`: `general protection fault in tcp_sendmsg_locked`,
+
+		`
+[   11.101112] traps: syz-executor0[3602] general protection fault ip:4004d7 sp:7ffd1a8 error:0 in syz-executor0[400000+1000]
+`: ``,
+
+		`
+[   52.112233] BUG: kernel NULL pointer dereference, address: 0000000000000010
+[   52.112233] #PF: supervisor read access in kernel mode
+[   52.112233] RIP: 0010:sock_sendmsg+0x45/0x130
+`: `BUG: unable to handle kernel NULL pointer dereference in sock_sendmsg`,
+
+		`
+[   52.112233] BUG: unable to handle page fault for address: ffffeb0000000008
+[   52.112233] #PF: supervisor read access in kernel mode
+[   52.112233] RIP: 0010:kfree+0x5c/0x250
+`: `BUG: unable to handle kernel paging request in kfree`,
+
+		`
+[  300.120210] rcu: INFO: rcu_sched detected expedited stalls on CPUs/tasks: { 0-... } 10502 jiffies s: 1145 root: 0x1/.
+`: `INFO: rcu detected expedited stall`,
+
 		`
 BUG UNIX (Not tainted): kasan: bad access detected
 `: ``,
@@ -522,6 +662,168 @@ WARNING: /etc/ssh/moduli does not exist, using fixed modulus
 	}
 }
 
+func TestParseReport(t *testing.T) {
+	tests := []struct {
+		log    string
+		title  string
+		typ    string
+		report string
+	}{
+		{
+			log: `[   10.000000] syz-fuzzer output
+==================================================================
+[   12.100000][ T4070] BUG: KASAN: use-after-free in __memset+0x24/0x30
+[   12.100000][ T4070] Write of size 8 at addr ffff88002bde1e40 by task syz-executor/4070
+2017/06/12 10:00:01 executing program 1:
+[   12.100000][ T4070]  [<ffffffff82d4e304>] ? __memset+0x24/0x30
+[   12.100000][ T4070] ==================================================================
+[   12.100000][ T4070] Disabling lock debugging due to kernel taint
+[   12.200000][ T4070] Kernel panic - not syncing: panic_on_warn set ...
+`,
+			title: "KASAN: use-after-free Write in __memset",
+			typ:   "KASAN",
+			report: `BUG: KASAN: use-after-free in __memset+0x24/0x30
+Write of size 8 at addr ffff88002bde1e40 by task syz-executor/4070
+==================================================================
+`,
+		},
+		{
+			log: "WARNING: CPU: 1 PID: 1 at net/core/dev.c:123 dev_close+0x12/0x30\r\n" +
+				"Modules linked in:\r\n" +
+				"---[ end trace 8b5a4e6c9a0a5c2d ]---\r\n" +
+				"after the end\r\n",
+			title: "WARNING in dev_close",
+			typ:   "WARNING",
+			report: `WARNING: CPU: 1 PID: 1 at net/core/dev.c:123 dev_close+0x12/0x30
+Modules linked in:
+---[ end trace 8b5a4e6c9a0a5c2d ]---
+`,
+		},
+		{
+			// Output of other CPUs is interleaved, the root report is printed after the panic.
+			log: `[   20.000000] Kernel panic - not syncing: panic_on_warn set ...
+[   20.000001] CPU: 0 PID: 3020 Comm: syz-executor0 Not tainted 4.14.0-rc1+ #25
+[   20.000002] INFO: task syz-executor0:5043 blocked for more than 120 seconds.
+[   20.000003] Call Trace:
+[   20.000004]  schedule+0xf5/0x430
+[   20.000005]  rtnl_lock+0x17/0x20
+`,
+			title: "INFO: task hung in rtnl_lock",
+			typ:   "HANG",
+			report: `INFO: task syz-executor0:5043 blocked for more than 120 seconds.
+Call Trace:
+ schedule+0xf5/0x430
+ rtnl_lock+0x17/0x20
+`,
+		},
+		{
+			log: `[   20.000000] Kernel panic - not syncing: hung_task: blocked tasks
+[   20.000001] CPU: 0 PID: 3020 Comm: khungtaskd Not tainted 4.14.0-rc1+ #25
+`,
+			title: "kernel panic: hung_task: blocked tasks",
+			typ:   "panic",
+			report: `Kernel panic - not syncing: hung_task: blocked tasks
+CPU: 0 PID: 3020 Comm: khungtaskd Not tainted 4.14.0-rc1+ #25
+`,
+		},
+	}
+	for i, test := range tests {
+		rep := ParseReport([]byte(test.log), nil)
+		if rep == nil {
+			t.Fatalf("#%v: no report", i)
+		}
+		if rep.Title != test.title || rep.Type != test.typ {
+			t.Errorf("#%v: got title %q, type %q, want %q, %q", i, rep.Title, rep.Type, test.title, test.typ)
+		}
+		if string(rep.Report) != test.report {
+			t.Errorf("#%v: got report:\n%s\nwant:\n%s", i, rep.Report, test.report)
+		}
+		header := test.report[:strings.IndexByte(test.report, '\n')]
+		if line := test.log[rep.StartPos:]; !strings.Contains(line[:strings.IndexByte(line, '\n')], header) {
+			t.Errorf("#%v: report starts at %v, not at the header line", i, rep.StartPos)
+		}
+	}
+	if rep := ParseReport([]byte("no crash here\n"), nil); rep != nil {
+		t.Fatalf("found report %q in output without crashes", rep.Title)
+	}
+}
+
+func TestParseMultiple(t *testing.T) {
+	truncated := `[   12.100000] BUG: KASAN: use-after-free in __memset+0x24/0x30
+[   12.100000] Write of size 8 at addr ffff88002bde1e40 by task syz-executor/4070
+`
+	warning := `[   20.000000] WARNING: CPU: 1 PID: 1 at net/core/dev.c:123 dev_close+0x12/0x30
+[   20.000001] Call Trace:
+[   20.000002]  dev_close+0x12/0x30
+[   20.000003] ---[ end trace 8b5a4e6c9a0a5c2d ]---
+`
+	gpf := `[   30.000000] general protection fault: 0000 [#1] SMP KASAN
+[   30.000001] RIP: 0010:__lock_acquire+0x2d4/0x4360
+[   30.000002] Call Trace:
+[   30.000003]  lock_acquire+0x1d5/0x580
+[   30.000004] ---[ end trace 8b5a4e6c9a0a5c2e ]---
+`
+	tests := []struct {
+		log          string
+		suppressions []string
+		title        string
+		others       []string
+	}{
+		{
+			truncated + warning,
+			nil,
+			"WARNING in dev_close",
+			[]string{"KASAN: use-after-free Write in __memset"},
+		},
+		{
+			warning + gpf,
+			nil,
+			"WARNING in dev_close",
+			[]string{"general protection fault in __lock_acquire"},
+		},
+		{
+			warning + gpf,
+			[]string{"WARNING: .* dev_close"},
+			"general protection fault in __lock_acquire",
+			[]string{"WARNING in dev_close"},
+		},
+		{
+			gpf + warning,
+			[]string{"general protection fault"},
+			"WARNING in dev_close",
+			[]string{"general protection fault in __lock_acquire"},
+		},
+		{
+			warning + gpf,
+			[]string{"WARNING", "general protection fault"},
+			"",
+			nil,
+		},
+	}
+	for i, test := range tests {
+		var suppressions []*regexp.Regexp
+		for _, supp := range test.suppressions {
+			suppressions = append(suppressions, regexp.MustCompile(supp))
+		}
+		rep := ParseReport([]byte(test.log), nil)
+		if rep == nil {
+			t.Fatalf("#%v: no report", i)
+		}
+		rep = rep.Select(suppressions)
+		title := ""
+		var others []string
+		if rep != nil {
+			title = rep.Title
+			for _, other := range rep.Others {
+				others = append(others, other.Title)
+			}
+		}
+		if title != test.title || !reflect.DeepEqual(others, test.others) {
+			t.Errorf("#%v: got title %q, others %q, want %q, %q", i, title, others, test.title, test.others)
+		}
+	}
+}
+
 func TestIgnores(t *testing.T) {
 	const log = `
 		BUG: bug1
@@ -568,6 +870,29 @@ func TestIgnores(t *testing.T) {
 	}
 }
 
+func TestNormalizeTitle(t *testing.T) {
+	tests := map[string]string{
+		"KASAN: use-after-free Read in __memset":                          "KASAN: use-after-free Read in __memset",
+		"kernel BUG at mm/memory.c:1234!":                                 "kernel BUG at mm/memory.c!",
+		"suspicious RCU usage at net/ipv4/tcp.c:55":                       "suspicious RCU usage at net/ipv4/tcp.c",
+		"BUG: unable to handle kernel paging request at ffff88002bde1e40": "BUG: unable to handle kernel paging request at ADDR",
+		"KASAN: slab-out-of-bounds on address 0xffff8800a1b2c3d4":         "KASAN: slab-out-of-bounds on address ADDR",
+		"kernel panic: syz-executor3/4070 killed":                         "kernel panic: TASK killed",
+		"kernel panic: Out of memory in syz-executor12":                   "kernel panic: Out of memory in syz-executor",
+		"BUG: scheduling while atomic: pid 123 on CPU: 1":                 "BUG: scheduling while atomic: PID on CPU",
+		"BUG: deadbeef in   foo  ":                                        "BUG: deadbeef in foo",
+		"lost connection to test machine":                                 "lost connection to test machine",
+	}
+	for desc, want := range tests {
+		if got := NormalizeTitle(desc); got != want {
+			t.Errorf("NormalizeTitle(%q) = %q, want %q", desc, got, want)
+		}
+		if got := NormalizeTitle(want); got != want {
+			t.Errorf("NormalizeTitle is not idempotent on %q: got %q", want, got)
+		}
+	}
+}
+
 func TestReplace(t *testing.T) {
 	tests := []struct {
 		where  string
@@ -745,3 +1070,44 @@ func TestSymbolizeLine(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveRawPC(t *testing.T) {
+	sorted := sortSymbols(map[string][]symbolizer.Symbol{
+		"foo": []symbolizer.Symbol{
+			{Addr: 0xffffffff81001000, Size: 0x100},
+		},
+		"bar": []symbolizer.Symbol{
+			{Addr: 0xffffffff81002000, Size: 0x80},
+		},
+	})
+	tests := []struct {
+		line   string
+		result string
+	}{
+		{
+			"[   12.345678]  [<ffffffff81001010>] 0xffffffff81001010",
+			"[   12.345678]  [<ffffffff81001010>] foo+0x10/0x100",
+		},
+		{
+			"RIP: 0010:0xffffffff8100207f",
+			"RIP: 0010:bar+0x7f/0x80",
+		},
+		{
+			" 0xffffffff81002080",
+			" 0xffffffff81002080",
+		},
+		{
+			" 0xffffffff80000000",
+			" 0xffffffff80000000",
+		},
+		{
+			"RAX: 0xffffffff81001010 RBX: 0000000000000000",
+			"RAX: 0xffffffff81001010 RBX: 0000000000000000",
+		},
+	}
+	for i, test := range tests {
+		if result := string(resolveRawPC(sorted, []byte(test.line))); result != test.result {
+			t.Errorf("#%v: want %q\n\tget %q", i, test.result, result)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rules extend the builtin report parsing rules, so that kernels with out-of-tree sanitizers
+// or vendor-specific oops formats get proper titles without changes to this package.
+type Rules struct {
+	// Report formats. Formats with the header of a builtin report take precedence over the builtin formats,
+	// reports with new headers take precedence over builtin reports with less specific headers.
+	Oopses []OopsRule
+	// Replacements applied to titles by NormalizeTitle after the builtin ones,
+	// crashes with equal normalized titles are considered duplicates.
+	Titles []TitleRule
+	// Regexps of functions skipped by {{STACK}} (e.g. wait functions of a custom lock).
+	Skip_Frames []string
+}
+
+// OopsRule describes reports that start with a line containing Header.
+type OopsRule struct {
+	Header string // e.g. "BUG: VSAN:"
+	// Formats are tried in order, the format that matches earliest in the report makes the title.
+	// Reports that don't match any format are titled with their first line.
+	Formats []FormatRule
+	// Lines with the header that match any of these regexps don't start a report.
+	Suppressions []string
+}
+
+// FormatRule titles reports matching Regexp with Title, a fmt format string that gets submatches
+// of Regexp as arguments (e.g. "VSAN: %[1]v in %[2]v"). Regexp can use the builtin templates:
+// {{ADDR}}, {{PC}}, {{FUNC}} (captures a function name), {{SRC}} (captures file:line),
+// {{LOCK}} (captures a lockdep lock and a function), {{FRAME}} (beginning of a stack frame line)
+// and {{STACK}} (captures the first function of a stack trace, see Skip_Frames).
+type FormatRule struct {
+	Regexp string
+	Title  string
+}
+
+// TitleRule replaces all matches of Regexp in titles with Replacement ($1 refers to a submatch).
+type TitleRule struct {
+	Regexp      string
+	Replacement string
+}
+
+type titleRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+var (
+	// Title rules added with AddRules.
+	titleRules []titleRule
+	// Sources of regexps with {{STACK}}, they are recompiled when Skip_Frames are added.
+	stackSources = make(map[*regexp.Regexp]string)
+)
+
+// AddRules adds rules to the builtin ones. If rules are invalid, nothing is added.
+// It must be called before any output is parsed.
+func AddRules(rules *Rules) error {
+	if rules == nil {
+		return nil
+	}
+	skip := append(append([]string{}, skipFrames...), rules.Skip_Frames...)
+	for _, fn := range rules.Skip_Frames {
+		if _, err := regexp.Compile(fn); err != nil {
+			return fmt.Errorf("bad skip frame %q: %v", fn, err)
+		}
+	}
+	var newOopses []*oops
+	newStack := make(map[*regexp.Regexp]string)
+	for _, rule := range rules.Oopses {
+		if rule.Header == "" {
+			return fmt.Errorf("oops rule without header")
+		}
+		o := &oops{header: []byte(rule.Header)}
+		for _, format := range rule.Formats {
+			re, err := regexp.Compile(expandTemplates(format.Regexp, skip))
+			if err != nil {
+				return fmt.Errorf("bad format regexp %q: %v", format.Regexp, err)
+			}
+			args := make([]interface{}, re.NumSubexp())
+			for i := range args {
+				args[i] = "arg"
+			}
+			if title := fmt.Sprintf(format.Title, args...); format.Title == "" || strings.Contains(title, "%!") {
+				return fmt.Errorf("bad title %q for format regexp %q with %v submatches",
+					format.Title, format.Regexp, len(args))
+			}
+			o.formats = append(o.formats, oopsFormat{re, format.Title})
+			if strings.Contains(format.Regexp, "{{STACK}}") {
+				newStack[re] = format.Regexp
+			}
+		}
+		for _, supp := range rule.Suppressions {
+			re, err := regexp.Compile(supp)
+			if err != nil {
+				return fmt.Errorf("bad suppression %q: %v", supp, err)
+			}
+			o.suppressions = append(o.suppressions, re)
+		}
+		newOopses = append(newOopses, o)
+	}
+	var newTitles []titleRule
+	for _, rule := range rules.Titles {
+		re, err := regexp.Compile(rule.Regexp)
+		if err != nil {
+			return fmt.Errorf("bad title regexp %q: %v", rule.Regexp, err)
+		}
+		newTitles = append(newTitles, titleRule{re, rule.Replacement})
+	}
+
+	if len(rules.Skip_Frames) != 0 {
+		skipFrames = skip
+		recompiled := make(map[*regexp.Regexp]*regexp.Regexp)
+		for _, o := range oopses {
+			for i, format := range o.formats {
+				if src, ok := stackSources[format.re]; ok {
+					if recompiled[format.re] == nil {
+						recompiled[format.re] = regexp.MustCompile(expandTemplates(src, skipFrames))
+					}
+					o.formats[i].re = recompiled[format.re]
+				}
+			}
+		}
+		for old, re := range recompiled {
+			stackSources[re] = stackSources[old]
+			delete(stackSources, old)
+		}
+	}
+	for re, src := range newStack {
+		stackSources[re] = src
+	}
+	var added []*oops
+	for _, o := range newOopses {
+		merged := false
+		for _, builtin := range oopses {
+			if string(builtin.header) == string(o.header) {
+				builtin.formats = append(o.formats, builtin.formats...)
+				builtin.suppressions = append(builtin.suppressions, o.suppressions...)
+				merged = true
+				break
+			}
+		}
+		if merged {
+			continue
+		}
+		// The new header is more specific than builtin headers it contains (e.g. "BUG: VSAN:"
+		// and "BUG:"), so it goes first and its suppressions apply to these builtin headers too.
+		for _, builtin := range oopses {
+			if bytes.Contains(o.header, builtin.header) {
+				builtin.suppressions = append(builtin.suppressions, o.suppressions...)
+			}
+		}
+		added = append(added, o)
+	}
+	oopses = append(added, oopses...)
+	titleRules = append(titleRules, newTitles...)
+	return nil
+}
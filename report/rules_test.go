@@ -0,0 +1,119 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"regexp"
+	"testing"
+)
+
+// restoreRules returns a function that restores the builtin rules changed by AddRules.
+func restoreRules() func() {
+	savedOopses := append([]*oops{}, oopses...)
+	saved := make([]oops, len(oopses))
+	for i, o := range oopses {
+		saved[i] = *o
+		saved[i].formats = append([]oopsFormat{}, o.formats...)
+		saved[i].suppressions = append([]*regexp.Regexp{}, o.suppressions...)
+	}
+	savedSkip, savedTitles := skipFrames, titleRules
+	savedStack := make(map[*regexp.Regexp]string)
+	for re, src := range stackSources {
+		savedStack[re] = src
+	}
+	return func() {
+		oopses = savedOopses
+		for i := range saved {
+			*oopses[i] = saved[i]
+		}
+		skipFrames, titleRules, stackSources = savedSkip, savedTitles, savedStack
+	}
+}
+
+func TestAddRules(t *testing.T) {
+	defer restoreRules()()
+	rules := &Rules{
+		Oopses: []OopsRule{
+			{
+				Header: "BUG: VSAN:",
+				Formats: []FormatRule{
+					{"BUG: VSAN: ([a-z\\-]+) in {{FUNC}}", "VSAN: %[1]v in %[2]v"},
+				},
+				Suppressions: []string{"BUG: VSAN: self-test"},
+			},
+			{
+				Header: "WARNING:",
+				Formats: []FormatRule{
+					{"WARNING: .* at vendor/{{SRC}} {{FUNC}}", "WARNING in vendor %[2]v"},
+				},
+			},
+		},
+		Titles: []TitleRule{
+			{"vendor_drv[0-9]+", "vendor_drv"},
+		},
+		Skip_Frames: []string{"vendor_wait_[a-z_]+"},
+	}
+	if err := AddRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		log   string
+		title string
+	}{
+		{
+			"BUG: VSAN: use-after-free in vendor_drv3_ioctl+0x12/0x80\n",
+			"VSAN: use-after-free in vendor_drv3_ioctl",
+		},
+		{
+			"BUG: VSAN: self-test passed\n",
+			"",
+		},
+		{
+			"WARNING: CPU: 0 PID: 1 at vendor/drv/main.c:12 vendor_probe+0x12/0x80\n",
+			"WARNING in vendor vendor_probe",
+		},
+		{
+			"WARNING: CPU: 0 PID: 1 at net/core/dev.c:123 dev_close+0x12/0x30\n",
+			"WARNING in dev_close",
+		},
+		{
+			`[  246.752114] INFO: task syz-executor0:5043 blocked for more than 120 seconds.
+[  246.777440] Call Trace:
+[  246.780024]  schedule+0xf5/0x430
+[  246.790556]  vendor_wait_event+0x10/0x20
+[  246.795117]  vendor_drv_read+0x20/0x40
+`,
+			"INFO: task hung in vendor_drv_read",
+		},
+	}
+	for i, test := range tests {
+		title, _, _, _ := Parse([]byte(test.log), nil)
+		if title != test.title {
+			t.Errorf("#%v: got title %q, want %q", i, title, test.title)
+		}
+	}
+	if title := NormalizeTitle("VSAN: use-after-free in vendor_drv3_ioctl"); title != "VSAN: use-after-free in vendor_drv_ioctl" {
+		t.Errorf("got normalized title %q", title)
+	}
+}
+
+func TestAddRulesInvalid(t *testing.T) {
+	defer restoreRules()()
+	formats := len(oopses[0].formats)
+	rules := &Rules{
+		Oopses: []OopsRule{
+			{
+				Header:  string(oopses[0].header),
+				Formats: []FormatRule{{"foo (bar)", "foo in %[1]v"}},
+			},
+		},
+		Skip_Frames: []string{"vendor_wait_[a-z_+"},
+	}
+	if err := AddRules(rules); err == nil {
+		t.Fatalf("no error for invalid rules")
+	}
+	if len(oopses[0].formats) != formats {
+		t.Fatalf("rules were partially added")
+	}
+}
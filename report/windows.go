@@ -0,0 +1,44 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"regexp"
+)
+
+// Bugchecks are reported by the kernel debugger (kd) attached to the serial port of the VM,
+// the report ends with the end of the "!analyze -v" output ("Followup:     MachineOwner").
+var windowsEndRe = regexp.MustCompile(`^Followup: `)
+
+// windowsFrameRe matches a frame of the STACK_TEXT section of "!analyze -v":
+// "ffffd000`2a5ef5a8 fffff802`7f5e8fe9 : 00000000`0000003b ... : nt!KiBugCheckDispatch+0x69".
+var windowsFrameRe = regexp.MustCompile(` : [a-zA-Z0-9_]+![a-zA-Z0-9_]+`)
+
+// Bugchecks are not caused by other reports, empty lines never contain a bugcheck header.
+var windowsSecondaryRe = regexp.MustCompile(`^$`)
+
+// windowsOopses describe bugchecks, the faulting function is captured from the analysis:
+// "SYMBOL_NAME:  nt!ObpCloseHandle+45" (recent kd),
+// "Probably caused by : ntkrnlmp.exe ( nt!ObpCloseHandle+45 )" (older kd).
+// Without symbols or analysis only the bugcheck code is known.
+var windowsOopses = []*oops{
+	&oops{
+		[]byte("*** Fatal System Error:"),
+		[]oopsFormat{
+			{
+				compile("\\*\\*\\* Fatal System Error: 0x0*([0-9a-fA-F]+)(?:.*\\n)+?SYMBOL_NAME: +([a-zA-Z0-9_]+![a-zA-Z0-9_]+)"),
+				"BUGCHECK 0x%[1]v in %[2]v",
+			},
+			{
+				compile("\\*\\*\\* Fatal System Error: 0x0*([0-9a-fA-F]+)(?:.*\\n)+?Probably caused by : .+? \\( ([a-zA-Z0-9_]+![a-zA-Z0-9_]+)"),
+				"BUGCHECK 0x%[1]v in %[2]v",
+			},
+			{
+				compile("\\*\\*\\* Fatal System Error: 0x0*([0-9a-fA-F]+)"),
+				"BUGCHECK 0x%[1]v",
+			},
+		},
+		[]*regexp.Regexp{},
+	},
+}
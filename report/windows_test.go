@@ -0,0 +1,106 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package report
+
+import (
+	"testing"
+)
+
+func TestParseWindows(t *testing.T) {
+	if err := SetOS("windows"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetOS("linux")
+	tests := []struct {
+		log       string
+		title     string
+		report    string
+		corrupted bool
+	}{
+		// Backticks in 64-bit addresses of kd output are omitted, they don't fit into Go raw strings.
+		{
+			`executing program 0
+
+*** Fatal System Error: 0x0000003b
+                       (0x00000000C0000005,0xFFFFF8027F8A1D5B,0xFFFFD0002A5EF0D0,0x0000000000000000)
+
+Break instruction exception - code 80000003 (first chance)
+
+A fatal system error has occurred.
+
+SYSTEM_SERVICE_EXCEPTION (3b)
+An exception happened while executing a system service routine.
+
+STACK_TEXT:  
+ffffd0002a5ef5a8 fffff8027f5e8fe9 : 000000000000003b 00000000c0000005 : nt!KeBugCheckEx
+ffffd0002a5ef5b0 fffff8027f5e891c : 0000000000000000 0000000000000000 : nt!KiBugCheckDispatch+0x69
+ffffd0002a5efa00 fffff8027f8a1d5b : 0000000000000000 0000000000000000 : nt!ObpCloseHandle+0x45
+
+SYMBOL_NAME:  nt!ObpCloseHandle+45
+
+MODULE_NAME: nt
+
+Followup:     MachineOwner
+---------
+
+0: kd> q
+quit:
+`,
+			"BUGCHECK 0x3b in nt!ObpCloseHandle",
+			"",
+			false,
+		},
+		{
+			`*** Fatal System Error: 0x0000000a
+                       (0x0000000000000000,0x0000000000000002,0x0000000000000000,0xFFFFF8027F8C3E12)
+
+STACK_TEXT:  
+ffffd0002a5ef5a8 fffff8027f5e8fe9 : 000000000000000a 0000000000000000 : nt!KeBugCheckEx
+ffffd0002a5ef5b0 fffff8027f5e891c : 0000000000000000 0000000000000000 : nt!MiZeroPageChain+0x2a2
+
+Probably caused by : ntkrnlmp.exe ( nt!MiZeroPageChain+2a2 )
+
+Followup:     MachineOwner
+`,
+			"BUGCHECK 0xa in nt!MiZeroPageChain",
+			`*** Fatal System Error: 0x0000000a
+                       (0x0000000000000000,0x0000000000000002,0x0000000000000000,0xFFFFF8027F8C3E12)
+
+STACK_TEXT:  
+ffffd0002a5ef5a8 fffff8027f5e8fe9 : 000000000000000a 0000000000000000 : nt!KeBugCheckEx
+ffffd0002a5ef5b0 fffff8027f5e891c : 0000000000000000 0000000000000000 : nt!MiZeroPageChain+0x2a2
+
+Probably caused by : ntkrnlmp.exe ( nt!MiZeroPageChain+2a2 )
+
+Followup:     MachineOwner
+`,
+			false,
+		},
+		{
+			// No symbols and no analysis, only the bugcheck code is known.
+			`*** Fatal System Error: 0x000000d1
+                       (0x0000000000000000,0x0000000000000002,0x0000000000000000,0xFFFFF8027F8C3E12)
+`,
+			"BUGCHECK 0xd1",
+			"",
+			true,
+		},
+	}
+	for i, test := range tests {
+		rep := ParseReport([]byte(test.log), nil)
+		if rep == nil {
+			t.Errorf("#%v: no report found", i)
+			continue
+		}
+		if rep.Title != test.title {
+			t.Errorf("#%v: got title %q, want %q", i, rep.Title, test.title)
+		}
+		if test.report != "" && string(rep.Report) != test.report {
+			t.Errorf("#%v: got report:\n%s\nwant:\n%s", i, rep.Report, test.report)
+		}
+		if rep.Corrupted != test.corrupted {
+			t.Errorf("#%v: got corrupted %v (%v), want %v", i, rep.Corrupted, rep.CorruptedReason, test.corrupted)
+		}
+	}
+}
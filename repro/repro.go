@@ -5,9 +5,10 @@ package repro
 
 import (
 	"fmt"
+	"math/rand"
 	"os"
-	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,11 +27,28 @@ type Result struct {
 	CRepro bool
 }
 
+// State is a checkpoint of reproduction progress.
+// It allows to resume reproduction after a restart without redoing completed stages.
+type State struct {
+	Stage    string          // last completed stage: "extracted", "minimized" or "simplified"
+	Prog     []byte          // serialized program that reproduces the crash
+	Opts     csource.Options // options the program reproduces the crash with
+	Duration time.Duration   // execution duration required to trigger the crash
+}
+
+const (
+	stageExtracted  = "extracted"
+	stageMinimized  = "minimized"
+	stageSimplified = "simplified"
+)
+
 type context struct {
 	cfg          *config.Config
 	crashDesc    string
 	instances    chan *instance
 	bootRequests chan int
+	state        *State
+	save         func(*State)
 }
 
 type instance struct {
@@ -41,11 +59,17 @@ type instance struct {
 }
 
 func Run(crashLog []byte, cfg *config.Config, vmIndexes []int) (*Result, error) {
+	return Resume(crashLog, cfg, vmIndexes, nil, nil)
+}
+
+// Resume is like Run, but skips stages already completed in state (if not nil)
+// and calls save (if not nil) with the new state after each completed stage.
+func Resume(crashLog []byte, cfg *config.Config, vmIndexes []int, state *State, save func(*State)) (*Result, error) {
 	if len(vmIndexes) == 0 {
 		return nil, fmt.Errorf("no VMs provided")
 	}
-	if _, err := os.Stat(filepath.Join(cfg.Syzkaller, "bin/syz-execprog")); err != nil {
-		return nil, fmt.Errorf("bin/syz-execprog is missing (run 'make execprog')")
+	if _, err := os.Stat(config.TargetBin(cfg, "syz-execprog")); err != nil {
+		return nil, fmt.Errorf("syz-execprog is missing for %v (run 'make execprog' or 'bin/syz-make -config=manager.cfg')", config.TargetDir(cfg))
 	}
 	entries := prog.ParseLog(crashLog)
 	if len(entries) == 0 {
@@ -57,12 +81,17 @@ func Run(crashLog []byte, cfg *config.Config, vmIndexes []int) (*Result, error)
 		crashDesc = "hang"
 	}
 	Logf(0, "reproducing crash '%v': %v programs, %v VMs", crashDesc, len(entries), len(vmIndexes))
+	if state != nil {
+		Logf(0, "reproducing crash '%v': resuming after stage %v", crashDesc, state.Stage)
+	}
 
 	ctx := &context{
 		cfg:          cfg,
 		crashDesc:    crashDesc,
 		instances:    make(chan *instance, len(vmIndexes)),
 		bootRequests: make(chan int, len(vmIndexes)),
+		state:        state,
+		save:         save,
 	}
 	var wg sync.WaitGroup
 	wg.Add(len(vmIndexes))
@@ -86,14 +115,14 @@ func Run(crashLog []byte, cfg *config.Config, vmIndexes []int) (*Result, error)
 						continue
 
 					}
-					execprogBin, err := vmInst.Copy(filepath.Join(cfg.Syzkaller, "bin/syz-execprog"))
+					execprogBin, err := vmInst.Copy(config.TargetBin(cfg, "syz-execprog"))
 					if err != nil {
 						Logf(0, "reproducing crash '%v': failed to copy to VM: %v", crashDesc, err)
 						vmInst.Close()
 						time.Sleep(10 * time.Second)
 						continue
 					}
-					executorBin, err := vmInst.Copy(filepath.Join(cfg.Syzkaller, "bin/syz-executor"))
+					executorBin, err := vmInst.Copy(config.TargetBin(cfg, "syz-executor"))
 					if err != nil {
 						Logf(0, "reproducing crash '%v': failed to copy to VM: %v", crashDesc, err)
 						vmInst.Close()
@@ -125,27 +154,103 @@ func Run(crashLog []byte, cfg *config.Config, vmIndexes []int) (*Result, error)
 }
 
 func (ctx *context) repro(entries []*prog.LogEntry, crashStart int) (*Result, error) {
-	// Cut programs that were executed after crash.
-	for i, ent := range entries {
-		if ent.Start > crashStart {
-			entries = entries[:i]
-			break
+	res, duration, stage, err := ctx.restore()
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res, duration, err = ctx.extractProg(entries, crashStart)
+		if res == nil || err != nil {
+			return nil, err
 		}
+		ctx.checkpoint(stageExtracted, res, duration)
 	}
-	// Extract last program on every proc.
-	procs := make(map[int]int)
-	for i, ent := range entries {
-		procs[ent.Proc] = i
+	defer func() {
+		res.Opts.Repro = false
+	}()
+
+	if stage == "" || stage == stageExtracted {
+		Logf(2, "reproducing crash '%v': minimizing guilty program", ctx.crashDesc)
+		res.Prog, _ = prog.Minimize(res.Prog, -1, func(p1 *prog.Prog, callIndex int) bool {
+			crashed, err := ctx.testProg(p1, duration, res.Opts, false)
+			if err != nil {
+				Logf(1, "reproducing crash '%v': minimization failed with %v", ctx.crashDesc, err)
+				return false
+			}
+			return crashed
+		}, true)
+		ctx.checkpoint(stageMinimized, res, duration)
 	}
-	var indices []int
-	for _, idx := range procs {
-		indices = append(indices, idx)
+
+	if stage != stageSimplified {
+		if err := ctx.simplifyOpts(res, duration); err != nil {
+			return res, err
+		}
+		ctx.checkpoint(stageSimplified, res, duration)
 	}
-	sort.Ints(indices)
-	var suspected []*prog.LogEntry
-	for i := len(indices) - 1; i >= 0; i-- {
-		suspected = append(suspected, entries[indices[i]])
+	// The fault is recorded in options too, so that the reproducer can be replayed
+	// with the exact options by tools that don't look at call attributes.
+	res.Opts = csource.FaultOptions(res.Prog, res.Opts)
+
+	src, err := csource.Write(res.Prog, res.Opts)
+	if err != nil {
+		return res, err
 	}
+	srcf, err := fileutil.WriteTempFile(src)
+	if err != nil {
+		return res, err
+	}
+	bin, err := csource.Build("c", srcf)
+	if err != nil {
+		return res, err
+	}
+	defer os.Remove(bin)
+	crashed, err := ctx.testBin(bin, duration, false)
+	if err != nil {
+		return res, err
+	}
+	res.CRepro = crashed
+	return res, nil
+}
+
+// restore returns the result and the last completed stage saved in ctx.state.
+func (ctx *context) restore() (*Result, time.Duration, string, error) {
+	st := ctx.state
+	if st == nil {
+		return nil, 0, "", nil
+	}
+	switch st.Stage {
+	case stageExtracted, stageMinimized, stageSimplified:
+	default:
+		return nil, 0, "", fmt.Errorf("bad repro state stage %q", st.Stage)
+	}
+	p, err := prog.Deserialize(st.Prog)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("bad repro state program: %v", err)
+	}
+	res := &Result{
+		Prog: p,
+		Opts: st.Opts,
+	}
+	return res, st.Duration, st.Stage, nil
+}
+
+func (ctx *context) checkpoint(stage string, res *Result, duration time.Duration) {
+	if ctx.save == nil {
+		return
+	}
+	ctx.save(&State{
+		Stage:    stage,
+		Prog:     res.Prog.Serialize(),
+		Opts:     res.Opts,
+		Duration: duration,
+	})
+}
+
+// extractProg finds the program in the log that triggers the crash.
+// Returns nil result if no program crashed.
+func (ctx *context) extractProg(entries []*prog.LogEntry, crashStart int) (*Result, time.Duration, error) {
+	suspected := suspectedPrograms(entries, crashStart)
 	Logf(2, "reproducing crash '%v': suspecting %v programs", ctx.crashDesc, len(suspected))
 	opts := csource.Options{
 		Threaded: true,
@@ -166,7 +271,7 @@ func (ctx *context) repro(entries []*prog.LogEntry, crashStart int) (*Result, er
 		for _, ent := range suspected {
 			crashed, err := ctx.testProg(ent.P, dur, opts, true)
 			if err != nil {
-				return nil, err
+				return nil, 0, err
 			}
 			if crashed {
 				res = &Result{
@@ -181,37 +286,160 @@ func (ctx *context) repro(entries []*prog.LogEntry, crashStart int) (*Result, er
 			break
 		}
 	}
+	if res == nil && suspectedRace(ctx.crashDesc) {
+		var err error
+		res, duration, err = ctx.perturbSchedules(suspected, opts)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
 	if res == nil {
 		Logf(0, "reproducing crash '%v': no program crashed", ctx.crashDesc)
-		return nil, nil
 	}
-	defer func() {
-		res.Opts.Repro = false
-	}()
+	return res, duration, nil
+}
 
-	Logf(2, "reproducing crash '%v': minimizing guilty program", ctx.crashDesc)
-	res.Prog, _ = prog.Minimize(res.Prog, -1, func(p1 *prog.Prog, callIndex int) bool {
-		crashed, err := ctx.testProg(p1, duration, res.Opts, false)
-		if err != nil {
-			Logf(1, "reproducing crash '%v': minimization failed with %v", ctx.crashDesc, err)
-			return false
+const (
+	// Number of random schedules tried for every suspected program by perturbSchedules.
+	schedulePerturbations = 8
+	// Execution duration of a program with a perturbed schedule.
+	scheduleDuration = time.Minute
+)
+
+// raceBugs are substrings of descriptions of crashes that are often caused by races.
+var raceBugs = []string{"use-after-free", "double-free", "out-of-bounds", "race", "list_add corruption",
+	"list_del corruption", "refcount", "WARNING", "general protection fault"}
+
+// suspectedRace returns true if the crash could be caused by a race,
+// only such crashes are worth the time to try perturbed schedules.
+func suspectedRace(desc string) bool {
+	for _, bug := range raceBugs {
+		if strings.Contains(desc, bug) {
+			return true
+		}
+	}
+	return false
+}
+
+// perturbSchedules tries to reproduce a race that the suspected programs do not trigger
+// with the default schedule: every program with several calls is executed with random
+// schedules (see prog.PerturbSchedule). The schedule that triggers the crash is recorded
+// in call attributes of the resulting program, so the reproducer replays it.
+// Collide mode is disabled, since it would execute calls with a different schedule.
+func (ctx *context) perturbSchedules(suspected []*prog.LogEntry, opts csource.Options) (*Result, time.Duration, error) {
+	opts.Collide = false
+	for _, ent := range suspected {
+		if len(ent.P.Calls) < 2 {
+			continue
+		}
+		for seed := int64(0); seed < schedulePerturbations; seed++ {
+			p := ent.P.PerturbSchedule(rand.NewSource(seed))
+			Logf(2, "reproducing crash '%v': testing schedule %v", ctx.crashDesc, seed)
+			crashed, err := ctx.testProg(p, scheduleDuration, opts, true)
+			if err != nil {
+				return nil, 0, err
+			}
+			if crashed {
+				Logf(0, "reproducing crash '%v': triggered with schedule %v", ctx.crashDesc, seed)
+				res := &Result{
+					Prog: p,
+					Opts: opts,
+				}
+				return res, scheduleDuration * 3 / 2, nil
+			}
+		}
+	}
+	return nil, 0, nil
+}
+
+const (
+	// Programs that were running on any proc within concurrencyWindow before a crash are suspected,
+	// crashes are often caused by programs that finished a bit earlier (e.g. by delayed work).
+	concurrencyWindow = time.Second
+	// At most maxSuspectedPerProc most recent programs of every proc are suspected,
+	// procs execute lots of programs per second and every suspected program is tested.
+	maxSuspectedPerProc = 5
+)
+
+// suspectedPrograms returns programs of the log that could cause the crash that starts
+// at offset crashStart, the most recent ones first. If the log records when procs started
+// executing programs, these are programs that were running concurrently shortly before
+// the crash (see concurrencyWindow), otherwise the last program of every proc is suspected.
+func suspectedPrograms(entries []*prog.LogEntry, crashStart int) []*prog.LogEntry {
+	// Cut programs that were executed after crash.
+	for i, ent := range entries {
+		if ent.Start > crashStart {
+			entries = entries[:i]
+			break
+		}
+	}
+	timed := len(entries) != 0
+	for _, ent := range entries {
+		if ent.Time.IsZero() {
+			timed = false
+			break
+		}
+	}
+	if !timed {
+		// Extract last program on every proc.
+		procs := make(map[int]int)
+		for i, ent := range entries {
+			procs[ent.Proc] = i
+		}
+		var indices []int
+		for _, idx := range procs {
+			indices = append(indices, idx)
+		}
+		sort.Ints(indices)
+		var suspected []*prog.LogEntry
+		for i := len(indices) - 1; i >= 0; i-- {
+			suspected = append(suspected, entries[indices[i]])
 		}
-		return crashed
-	}, true)
+		return suspected
+	}
+	// The crash happened after the start of the latest program. Output of procs is interleaved
+	// on the console, so the order in the log does not necessary match the order of execution.
+	var crashTime time.Time
+	for _, ent := range entries {
+		if ent.Time.After(crashTime) {
+			crashTime = ent.Time
+		}
+	}
+	windowStart := crashTime.Add(-concurrencyWindow)
+	// A program runs until the next program of the same proc starts.
+	next := make(map[int]time.Time)
+	count := make(map[int]int)
+	var suspected []*prog.LogEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		ent := entries[i]
+		end, ok := next[ent.Proc]
+		next[ent.Proc] = ent.Time
+		if ok && end.Before(windowStart) || count[ent.Proc] >= maxSuspectedPerProc {
+			continue
+		}
+		count[ent.Proc]++
+		suspected = append(suspected, ent)
+	}
+	sort.SliceStable(suspected, func(i, j int) bool {
+		return suspected[i].Time.After(suspected[j].Time)
+	})
+	return suspected
+}
 
-	// Try to "minimize" threaded/collide/sandbox/etc to find simpler reproducer.
-	opts = res.Opts
+// simplifyOpts tries to "minimize" threaded/collide/sandbox/etc to find simpler reproducer.
+func (ctx *context) simplifyOpts(res *Result, duration time.Duration) error {
+	opts := res.Opts
 	opts.Collide = false
 	crashed, err := ctx.testProg(res.Prog, duration, opts, false)
 	if err != nil {
-		return res, err
+		return err
 	}
 	if crashed {
 		res.Opts = opts
 		opts.Threaded = false
 		crashed, err := ctx.testProg(res.Prog, duration, opts, false)
 		if err != nil {
-			return res, err
+			return err
 		}
 		if crashed {
 			res.Opts = opts
@@ -222,7 +450,7 @@ func (ctx *context) repro(entries []*prog.LogEntry, crashStart int) (*Result, er
 		opts.Sandbox = "none"
 		crashed, err := ctx.testProg(res.Prog, duration, opts, false)
 		if err != nil {
-			return res, err
+			return err
 		}
 		if crashed {
 			res.Opts = opts
@@ -233,7 +461,7 @@ func (ctx *context) repro(entries []*prog.LogEntry, crashStart int) (*Result, er
 		opts.Procs = 1
 		crashed, err := ctx.testProg(res.Prog, duration, opts, false)
 		if err != nil {
-			return res, err
+			return err
 		}
 		if crashed {
 			res.Opts = opts
@@ -244,32 +472,14 @@ func (ctx *context) repro(entries []*prog.LogEntry, crashStart int) (*Result, er
 		opts.Repeat = false
 		crashed, err := ctx.testProg(res.Prog, duration, opts, false)
 		if err != nil {
-			return res, err
+			return err
 		}
 		if crashed {
 			res.Opts = opts
 		}
 	}
 
-	src, err := csource.Write(res.Prog, res.Opts)
-	if err != nil {
-		return res, err
-	}
-	srcf, err := fileutil.WriteTempFile(src)
-	if err != nil {
-		return res, err
-	}
-	bin, err := csource.Build("c", srcf)
-	if err != nil {
-		return res, err
-	}
-	defer os.Remove(bin)
-	crashed, err = ctx.testBin(bin, duration, false)
-	if err != nil {
-		return res, err
-	}
-	res.CRepro = crashed
-	return res, nil
+	return nil
 }
 
 func (ctx *context) testProg(p *prog.Prog, duration time.Duration, opts csource.Options, reboot bool) (crashed bool, err error) {
@@ -296,8 +506,9 @@ func (ctx *context) testProg(p *prog.Prog, duration time.Duration, opts csource.
 	if opts.Repeat {
 		repeat = "0"
 	}
-	command := fmt.Sprintf("%v -executor %v -cover=0 -procs=%v -repeat=%v -sandbox %v -threaded=%v -collide=%v %v",
-		inst.execprogBin, inst.executorBin, opts.Procs, repeat, opts.Sandbox, opts.Threaded, opts.Collide, vmProgFile)
+	command := fmt.Sprintf("%v -executor %v -cover=0 -procs=%v -repeat=%v -sandbox %v -threaded=%v -collide=%v -trace=%v -pin_cpus=%v -low_priority=%v %v",
+		inst.execprogBin, inst.executorBin, opts.Procs, repeat, opts.Sandbox, opts.Threaded, opts.Collide,
+		ctx.cfg.Trace, ctx.cfg.Pin_Cpus, ctx.cfg.Low_Priority, vmProgFile)
 	Logf(2, "reproducing crash '%v': testing program (duration=%v, %+v): %s",
 		ctx.crashDesc, duration, opts, p)
 	return ctx.testImpl(inst, command, duration)
@@ -325,12 +536,17 @@ func (ctx *context) testImpl(inst vm.Instance, command string, duration time.Dur
 	if err != nil {
 		return false, fmt.Errorf("failed to run command in VM: %v", err)
 	}
-	desc, text, output, crashed, timedout := vm.MonitorExecution(outc, errc, false, false, ctx.cfg.ParsedIgnores)
+	desc, text, output, crashed, timedout := vm.MonitorExecution(inst, outc, errc, false, false, ctx.cfg.ParsedIgnores)
 	_, _, _ = text, output, timedout
 	if !crashed {
 		Logf(2, "reproducing crash '%v': program did not crash", ctx.crashDesc)
 		return false, nil
 	}
+	if vm.Classify(desc) == vm.FuzzerCrash {
+		// A failure of syz-execprog or syz-executor is not the kernel crash we are looking for.
+		Logf(2, "reproducing crash '%v': test binary failed: %v", ctx.crashDesc, desc)
+		return false, nil
+	}
 	Logf(2, "reproducing crash '%v': program crashed: %v", ctx.crashDesc, desc)
 	return true, nil
 }
@@ -0,0 +1,80 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package repro
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/prog"
+)
+
+func TestSuspectedPrograms(t *testing.T) {
+	t0 := time.Unix(1508846400, 0)
+	type exec struct {
+		proc int
+		ms   int
+	}
+	calls := []string{"getpid", "gettid", "munlockall", "sched_yield", "getuid"}
+	execs := []exec{
+		{0, 0},    // finished long before the crash
+		{0, 100},  // finished within the window
+		{1, 200},  // still running
+		{0, 1500}, // still running, the latest start
+		// Logged after proc 0, but started earlier (console output of procs is interleaved).
+		{2, 1400},
+	}
+	buf := new(bytes.Buffer)
+	for i, e := range execs {
+		buf.WriteString(prog.LogHeader(e.proc, t0.Add(time.Duration(e.ms)*time.Millisecond)))
+		fmt.Fprintf(buf, "%v()\n", calls[i])
+	}
+	crashStart := buf.Len()
+	buf.WriteString("BUG: KASAN: use-after-free in foo\n")
+	buf.WriteString(prog.LogHeader(1, t0.Add(3*time.Second)) + "getgid()\n")
+	entries := prog.ParseLog(buf.Bytes())
+	if len(entries) != len(execs)+1 {
+		t.Fatalf("got %v programs, want %v", len(entries), len(execs)+1)
+	}
+	suspected := suspectedPrograms(entries, crashStart)
+	want := []int{3, 4, 2, 1}
+	if len(suspected) != len(want) {
+		t.Fatalf("got %v suspected programs, want %v", len(suspected), len(want))
+	}
+	for i, idx := range want {
+		if suspected[i] != entries[idx] {
+			t.Errorf("suspected program #%v is %v (proc %v), want %v", i, suspected[i].P, suspected[i].Proc, entries[idx].P)
+		}
+	}
+
+	// Logs without timestamps: the last program of every proc.
+	for _, ent := range entries {
+		ent.Time = time.Time{}
+	}
+	suspected = suspectedPrograms(entries, crashStart)
+	want = []int{4, 3, 2}
+	if len(suspected) != len(want) {
+		t.Fatalf("got %v suspected programs, want %v", len(suspected), len(want))
+	}
+	for i, idx := range want {
+		if suspected[i] != entries[idx] {
+			t.Errorf("suspected program #%v is %v (proc %v), want %v", i, suspected[i].P, suspected[i].Proc, entries[idx].P)
+		}
+	}
+}
+
+func TestSuspectedRace(t *testing.T) {
+	for desc, race := range map[string]bool{
+		"KASAN: use-after-free Read in foo": true,
+		"WARNING in bar":                    true,
+		"INFO: task hung in baz":            false,
+		"kernel BUG at mm/slab.c:LINE!":     false,
+	} {
+		if got := suspectedRace(desc); got != race {
+			t.Errorf("suspectedRace(%q) = %v, want %v", desc, got, race)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package rpctype
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+)
+
+// Connections can be authenticated with a shared token: the client sends the token
+// terminated by a new line right after connecting, before any rpc messages.
+
+const maxTokenLen = 1 << 10
+
+// RpcDial connects to a jsonrpc server at addr.
+// If tlsConfig is not nil, TLS is used. If token is not empty, it is sent to the server
+// to authenticate the connection (see RpcAuthenticate). If compress is set,
+// rpc messages are compressed, the server must wrap the connection with NewCompressedConn.
+func RpcDial(addr string, tlsConfig *tls.Config, token string, compress bool) (*rpc.Client, error) {
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		if _, err := conn.Write([]byte(token + "\n")); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send auth token: %v", err)
+		}
+	}
+	if compress {
+		conn = NewCompressedConn(conn)
+	}
+	return jsonrpc.NewClient(conn), nil
+}
+
+// RpcAuthenticate reads the token sent by RpcDial from a server connection and
+// checks that it matches token. Does nothing if token is empty.
+func RpcAuthenticate(conn net.Conn, token string) error {
+	if token == "" {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	defer conn.SetReadDeadline(time.Time{})
+	// Read byte-by-byte to not consume rpc messages that follow the token.
+	var got []byte
+	var buf [1]byte
+	for {
+		if _, err := conn.Read(buf[:]); err != nil {
+			return fmt.Errorf("failed to read auth token: %v", err)
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		if len(got) >= maxTokenLen {
+			return fmt.Errorf("auth token is too long")
+		}
+		got = append(got, buf[0])
+	}
+	if subtle.ConstantTimeCompare(got, []byte(token)) != 1 {
+		return fmt.Errorf("bad auth token")
+	}
+	return nil
+}
+
+// PinnedTLSConfig returns client TLS config that accepts only server certificates
+// stored in PEM file certFile. Pinning does not depend on the address the server is dialed at,
+// which is different for every VM type (e.g. forwarded ports).
+func PinnedTLSConfig(certFile string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	var pinned [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			pinned = append(pinned, block.Bytes)
+		}
+	}
+	if len(pinned) == 0 {
+		return nil, fmt.Errorf("no certificates in %v", certFile)
+	}
+	cfg := &tls.Config{
+		// Standard verification checks host names, the certificate is verified below instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server did not present a certificate")
+			}
+			for _, cert := range pinned {
+				if bytes.Equal(rawCerts[0], cert) {
+					return nil
+				}
+			}
+			return fmt.Errorf("server certificate does not match the pinned one")
+		},
+	}
+	return cfg, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package rpctype
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"testing"
+	"time"
+)
+
+type Echo struct{}
+
+func (Echo) Echo(a string, r *string) error {
+	*r = a
+	return nil
+}
+
+// genCert generates a self-signed certificate and returns it in PEM form.
+func genCert(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syz-manager"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestAuth(t *testing.T) {
+	cert, certPEM := genCert(t)
+	_, otherPEM := genCert(t)
+	dir, err := ioutil.TempDir("", "syz-rpctype-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := dir + "/cert.pem"
+	otherFile := dir + "/other.pem"
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(otherFile, otherPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rpc.NewServer()
+	s.Register(Echo{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				if err := RpcAuthenticate(conn, "secret"); err != nil {
+					conn.Close()
+					return
+				}
+				s.ServeCodec(jsonrpc.NewServerCodec(conn))
+			}()
+		}
+	}()
+
+	call := func(certFile, token string) error {
+		tlsConfig, err := PinnedTLSConfig(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := RpcDial(ln.Addr().String(), tlsConfig, token, false)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		var r string
+		if err := c.Call("Echo.Echo", "foo", &r); err != nil {
+			return err
+		}
+		if r != "foo" {
+			t.Fatalf("got %q, want %q", r, "foo")
+		}
+		return nil
+	}
+	if err := call(certFile, "secret"); err != nil {
+		t.Fatalf("authenticated call failed: %v", err)
+	}
+	if err := call(certFile, "wrong"); err == nil {
+		t.Fatalf("call with a wrong token succeeded")
+	}
+	if err := call(certFile, ""); err == nil {
+		t.Fatalf("call without a token succeeded")
+	}
+	if err := call(otherFile, "secret"); err == nil {
+		t.Fatalf("call to a server with unpinned certificate succeeded")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package rpctype
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+)
+
+// compressedConn compresses all traffic of an rpc connection with deflate.
+// Programs and coverage compress several times, which matters for managers with lots of VMs.
+// Every write is flushed, so that the peer can decode the message without waiting for more data.
+type compressedConn struct {
+	net.Conn
+	r  io.ReadCloser
+	mu sync.Mutex
+	w  *flate.Writer
+}
+
+// NewCompressedConn wraps conn so that all traffic is compressed,
+// both ends of the connection need to be wrapped (see RpcDial).
+func NewCompressedConn(conn net.Conn) net.Conn {
+	// BestSpeed: the point is to save network bandwidth without spending much CPU.
+	w, err := flate.NewWriter(conn, flate.BestSpeed)
+	if err != nil {
+		panic(err)
+	}
+	return &compressedConn{
+		Conn: conn,
+		r:    flate.NewReader(conn),
+		w:    w,
+	}
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *compressedConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package rpctype
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"testing"
+)
+
+type Sum struct{}
+
+func (Sum) Sum(a []uint32, r *uint64) error {
+	for _, v := range a {
+		*r += uint64(v)
+	}
+	return nil
+}
+
+func TestCompressedConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rpc.NewServer()
+	s.Register(Echo{})
+	s.Register(Sum{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeCodec(jsonrpc.NewServerCodec(NewCompressedConn(conn)))
+		}
+	}()
+	c, err := RpcDial(ln.Addr().String(), nil, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Concurrent calls of different sizes, responses must not wait for subsequent messages.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < 20; j++ {
+				data := make([]uint32, rnd.Intn(10000))
+				want := uint64(0)
+				for k := range data {
+					data[k] = uint32(rnd.Intn(1000))
+					want += uint64(data[k])
+				}
+				var got uint64
+				if err := c.Call("Sum.Sum", data, &got); err != nil {
+					t.Errorf("call failed: %v", err)
+					return
+				}
+				if got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				str := string(bytes.Repeat([]byte{'a' + byte(i)}, rnd.Intn(1000)))
+				var res string
+				if err := c.Call("Echo.Echo", str, &res); err != nil {
+					t.Errorf("call failed: %v", err)
+					return
+				}
+				if res != str {
+					t.Errorf("echo returned a different string")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
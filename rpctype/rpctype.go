@@ -5,8 +5,12 @@
 // between various parts of the system.
 package rpctype
 
+import (
+	"time"
+)
+
 type RpcInput struct {
-	Call      string
+	Call      string // syscall variant name (e.g. ioctl$FOO)
 	Prog      []byte
 	CallIndex int
 	Cover     []uint32
@@ -20,27 +24,69 @@ type ConnectRes struct {
 	Prios        [][]float32
 	EnabledCalls string
 	NeedCheck    bool
+
+	CoverFilter       []PCRange // parts of the kernel to focus on (no filtering if empty)
+	CoverFilterWeight int       // see config.CoverFilter.Weight
+
+	MaxCover map[string][]byte // full max cover of all fuzzers: syscall name (e.g. ioctl) -> cover.Serialize'd PCs
 }
 
-type CheckArgs struct {
-	Name  string
-	Kcov  bool
-	Calls []string
+// PCRange is a range [Start, End) of PCs in the same 32-bit form as in RpcInput.Cover.
+type PCRange struct {
+	Start uint32
+	End   uint32
 }
 
-type NewInputArgs struct {
-	Name string
-	RpcInput
+// CheckArgs describes results of probing of the machine by fuzzer.
+// Fuzzer disables features and syscalls that can't work on the machine.
+type CheckArgs struct {
+	Name          string
+	Calls         []string          // enabled syscalls
+	DisabledCalls map[string]string // disabled syscalls -> reason
+
+	Debugfs      bool   // debugfs is mounted
+	Kcov         bool   // coverage collection with kcov
+	KcovComps    bool   // comparison operands collection with kcov
+	KcovRemote   bool   // coverage of kernel background threads with remote kcov handles
+	Leak         bool   // memory leak detection with kmemleak
+	Fault        bool   // fault injection
+	NetInjection bool   // network packet injection with tun
+	Wifi         bool   // 802.11 frame injection with mac80211_hwsim
+	Cgroups      bool   // per-process cgroups
+	SandboxError string // why the configured sandbox can't work (empty if it can)
 }
 
+// Max cover is synchronized between fuzzers incrementally:
+// fuzzer sends max cover it discovered since the previous poll,
+// manager replies with max cover discovered by other fuzzers since the previous
+// acknowledged reply (identified by MaxCoverSeq).
+// Unacknowledged max cover is resent in the next reply.
+// New corpus inputs are sent by fuzzer in batches with polls as well.
 type PollArgs struct {
-	Name  string
-	Stats map[string]uint64
+	Name        string
+	Stats       map[string]uint64
+	NewInputs   []RpcInput                // inputs added to corpus since the previous poll
+	MaxCover    map[string][]byte         // syscall name (e.g. ioctl) -> cover.Serialize'd PCs
+	MaxCoverAck uint64                    // MaxCoverSeq of the last received PollRes
+	Errnos      map[string]map[int]uint64 // syscall name -> errno (0 for success) -> executions since the previous poll
+	Triaged     bool                      // all candidates received by the fuzzer are triaged and resulting inputs are sent
 }
 
 type PollRes struct {
-	Candidates [][]byte
-	NewInputs  []RpcInput
+	Candidates  []RpcCandidate
+	NewInputs   []RpcInput
+	MaxCover    map[string][]byte // syscall name (e.g. ioctl) -> cover.Serialize'd PCs
+	MaxCoverSeq uint64
+	Backoff     time.Duration // manager is overloaded, fuzzer should not poll for this long
+	Pending     int           // candidates left in the queue of manager (sent later if candidate rate is capped)
+	Paused      bool          // fuzzing is paused, procs should not execute programs until a poll says otherwise
+	Stop        bool          // emergency stop, fuzzer should kill executors and exit
+}
+
+// RpcCandidate is a program from persistent corpus or hub that fuzzer needs to triage.
+type RpcCandidate struct {
+	Prog      []byte
+	Minimized bool // the program was minimized with the same kernel and descriptions
 }
 
 type HubConnectArgs struct {
@@ -61,3 +107,24 @@ type HubSyncArgs struct {
 type HubSyncRes struct {
 	Inputs [][]byte
 }
+
+// ManagerSummary is served by syz-manager as JSON on /api/summary,
+// syz-federation aggregates summaries of several managers into a combined dashboard.
+type ManagerSummary struct {
+	Name    string
+	Tag     string            // kernel tag of the manager (tag config param)
+	Stats   map[string]uint64 // the same stats as exported on /metrics
+	Crashes []CrashSummary
+}
+
+type CrashSummary struct {
+	Description string
+	ID          string // the crash is shown on /crash?id=ID page of the manager
+	Type        string // bug type, e.g. "use-after-free"
+	Severity    int    // report.Severity of the bug type
+	Count       int
+	First       time.Time // zero if unknown
+	Last        time.Time
+	Triaged     string // e.g. "has C repro"
+	Suppressed  bool
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package signal implements feedback signal: a set of elements reached by an execution
+// (basic blocks, edges between them, comparison operands), each element has a priority
+// that says how valuable is an input that brings the element for the first time.
+// Signal of different sources can be mixed, elements of all sources share one space,
+// so collisions are possible, but they are rare and only lead to some missed inputs.
+package signal
+
+type (
+	elem uint32
+	Prio int8
+)
+
+// Priorities of signal sources: a new basic block (or a new function) is more valuable
+// than a new path through known blocks, which is more valuable than new comparison operands.
+const (
+	PrioComps Prio = iota
+	PrioEdge
+	PrioPC
+)
+
+type Signal map[elem]Prio
+
+// FromPCs returns signal of coverage PCs (order of PCs does not matter).
+func FromPCs(pcs []uint32) Signal {
+	s := make(Signal, len(pcs))
+	for _, pc := range pcs {
+		s[elem(pc)] = PrioPC
+	}
+	return s
+}
+
+// FromEdges returns signal of edges between consecutive PCs of a coverage trace,
+// pcs must be in the execution order (not deduplicated and sorted).
+func FromEdges(pcs []uint32) Signal {
+	s := make(Signal, len(pcs))
+	prev := uint32(0)
+	for _, pc := range pcs {
+		s[elem(pc^hash(prev))] = PrioEdge
+		prev = pc
+	}
+	return s
+}
+
+// FromComps returns signal of comparison operands (arg1 -> arg2 -> compared).
+func FromComps(comps map[uint64]map[uint64]bool) Signal {
+	s := make(Signal)
+	for arg1, args2 := range comps {
+		for arg2 := range args2 {
+			s[elem(hash64(arg1)^hash(hash64(arg2)))] = PrioComps
+		}
+	}
+	return s
+}
+
+func (s Signal) Len() int {
+	return len(s)
+}
+
+func (s Signal) Empty() bool {
+	return len(s) == 0
+}
+
+func (s Signal) Copy() Signal {
+	c := make(Signal, len(s))
+	for e, p := range s {
+		c[e] = p
+	}
+	return c
+}
+
+// MaxPrio returns the highest priority of elements of s, -1 if s is empty.
+func (s Signal) MaxPrio() Prio {
+	max := Prio(-1)
+	for _, p := range s {
+		if p > max {
+			max = p
+		}
+	}
+	return max
+}
+
+// Diff returns elements of s that are not present in s0 or have higher priority in s.
+func (s Signal) Diff(s0 Signal) Signal {
+	var res Signal
+	for e, p := range s {
+		if p0, ok := s0[e]; ok && p0 >= p {
+			continue
+		}
+		if res == nil {
+			res = make(Signal)
+		}
+		res[e] = p
+	}
+	return res
+}
+
+// Intersection returns elements present in both s and s1 with the lower of their priorities.
+func (s Signal) Intersection(s1 Signal) Signal {
+	res := make(Signal)
+	for e, p := range s {
+		if p1, ok := s1[e]; ok {
+			if p1 < p {
+				p = p1
+			}
+			res[e] = p
+		}
+	}
+	return res
+}
+
+// Merge adds elements of s1 to s, elements present in both get the higher priority.
+func (s *Signal) Merge(s1 Signal) {
+	if len(s1) == 0 {
+		return
+	}
+	if *s == nil {
+		*s = make(Signal, len(s1))
+	}
+	s0 := *s
+	for e, p := range s1 {
+		if p0, ok := s0[e]; !ok || p > p0 {
+			s0[e] = p
+		}
+	}
+}
+
+// hash is a cheap 32-bit mixing function (finalizer of murmur3).
+func hash(v uint32) uint32 {
+	v ^= v >> 16
+	v *= 0x85ebca6b
+	v ^= v >> 13
+	v *= 0xc2b2ae35
+	v ^= v >> 16
+	return v
+}
+
+func hash64(v uint64) uint32 {
+	return hash(uint32(v) ^ hash(uint32(v>>32)))
+}
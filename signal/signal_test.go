@@ -0,0 +1,88 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package signal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFromEdges(t *testing.T) {
+	// Same PCs in a different order are different edges.
+	s0 := FromEdges([]uint32{1, 2, 3})
+	s1 := FromEdges([]uint32{1, 3, 2})
+	if s0.Len() != 3 || s1.Len() != 3 {
+		t.Fatalf("bad number of edges: %v, %v", s0.Len(), s1.Len())
+	}
+	if diff := s1.Diff(s0); diff.Len() != 2 {
+		t.Fatalf("bad number of new edges: %v", diff.Len())
+	}
+	if p := s0.MaxPrio(); p != PrioEdge {
+		t.Fatalf("bad priority of edges: %v", p)
+	}
+	if !FromEdges([]uint32{1, 2, 3}).Diff(s0).Empty() {
+		t.Fatalf("edges of the same trace are different")
+	}
+}
+
+func TestFromComps(t *testing.T) {
+	comps := map[uint64]map[uint64]bool{
+		1:       {2: true, 3: true},
+		1 << 32: {2: true},
+	}
+	s := FromComps(comps)
+	if s.Len() != 3 {
+		t.Fatalf("bad number of elements: %v", s.Len())
+	}
+	if p := s.MaxPrio(); p != PrioComps {
+		t.Fatalf("bad priority of comparisons: %v", p)
+	}
+	// Operands are not interchangeable.
+	if FromComps(map[uint64]map[uint64]bool{2: {1: true}}).Diff(s).Empty() {
+		t.Fatalf("swapped operands are not new")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	max := Signal{1: PrioEdge, 2: PrioPC}
+	s := Signal{1: PrioPC, 2: PrioPC, 3: PrioComps}
+	want := Signal{1: PrioPC, 3: PrioComps}
+	if diff := s.Diff(max); !reflect.DeepEqual(diff, want) {
+		t.Fatalf("bad diff: %v, want %v", diff, want)
+	}
+	if diff := s.Diff(s); diff != nil {
+		t.Fatalf("diff with itself is not empty: %v", diff)
+	}
+	if diff := s.Diff(nil); !reflect.DeepEqual(diff, s) {
+		t.Fatalf("diff with empty signal: %v, want %v", diff, s)
+	}
+}
+
+func TestIntersection(t *testing.T) {
+	s0 := Signal{1: PrioPC, 2: PrioPC, 3: PrioComps}
+	s1 := Signal{1: PrioEdge, 3: PrioComps, 4: PrioPC}
+	want := Signal{1: PrioEdge, 3: PrioComps}
+	if res := s0.Intersection(s1); !reflect.DeepEqual(res, want) {
+		t.Fatalf("bad intersection: %v, want %v", res, want)
+	}
+	if res := s1.Intersection(s0); !reflect.DeepEqual(res, want) {
+		t.Fatalf("bad intersection: %v, want %v", res, want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var s Signal
+	s.Merge(Signal{1: PrioEdge, 2: PrioPC})
+	s.Merge(Signal{1: PrioPC, 2: PrioComps, 3: PrioComps})
+	want := Signal{1: PrioPC, 2: PrioPC, 3: PrioComps}
+	if !reflect.DeepEqual(s, want) {
+		t.Fatalf("bad merge: %v, want %v", s, want)
+	}
+	if p := s.MaxPrio(); p != PrioPC {
+		t.Fatalf("bad max priority: %v", p)
+	}
+	if p := Signal(nil).MaxPrio(); p != -1 {
+		t.Fatalf("bad max priority of empty signal: %v", p)
+	}
+}
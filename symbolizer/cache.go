@@ -0,0 +1,202 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package symbolizer
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cache is a persistent cache of symbolization results. Results are keyed by the build id
+// of the binary, so they survive manager restarts and moves of the binary,
+// but are never used for a rebuilt binary. Binaries without build id are not cached.
+type Cache struct {
+	dir     string
+	mu      sync.Mutex
+	ids     map[string]binaryID           // binary path -> build id
+	frames  map[string]map[uint64][]Frame // build id -> pc -> frames
+	symbols map[string]map[string][]Symbol
+	dirty   map[string]bool
+}
+
+type binaryID struct {
+	id      string
+	size    int64
+	modTime time.Time
+}
+
+// NewCache creates a cache that persists results in dir.
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create symbolizer cache dir: %v", err)
+	}
+	return &Cache{
+		dir:     dir,
+		ids:     make(map[string]binaryID),
+		frames:  make(map[string]map[uint64][]Frame),
+		symbols: make(map[string]map[string][]Symbol),
+		dirty:   make(map[string]bool),
+	}, nil
+}
+
+// Symbolize returns frames for pc in bin from the cache,
+// or symbolizes it with symb and caches the result.
+func (c *Cache) Symbolize(symb func(bin string, pc uint64) ([]Frame, error), bin string, pc uint64) ([]Frame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.buildID(bin)
+	if id == "" {
+		return symb(bin, pc)
+	}
+	frames := c.loadFrames(id)
+	if res, ok := frames[pc]; ok {
+		return res, nil
+	}
+	res, err := symb(bin, pc)
+	if err != nil {
+		return nil, err
+	}
+	frames[pc] = res
+	c.dirty[id] = true
+	return res, nil
+}
+
+// ReadSymbols is ReadSymbols that reuses the result for binaries with the same build id.
+// Symbols are cached only in memory.
+func (c *Cache) ReadSymbols(bin string) (map[string][]Symbol, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.buildID(bin)
+	if symbols := c.symbols[id]; id != "" && symbols != nil {
+		return symbols, nil
+	}
+	symbols, err := ReadSymbols(bin)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		c.symbols[id] = symbols
+	}
+	return symbols, nil
+}
+
+// Flush persists results added since the previous Flush.
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.dirty {
+		entries := make(map[string][]Frame)
+		for pc, frames := range c.frames[id] {
+			entries[strconv.FormatUint(pc, 16)] = frames
+		}
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		file := c.file(id)
+		if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+			return fmt.Errorf("failed to write symbolizer cache: %v", err)
+		}
+		if err := os.Rename(file+".tmp", file); err != nil {
+			return fmt.Errorf("failed to write symbolizer cache: %v", err)
+		}
+		delete(c.dirty, id)
+	}
+	return nil
+}
+
+func (c *Cache) file(id string) string {
+	return filepath.Join(c.dir, id+".json")
+}
+
+// buildID returns build id of bin, or an empty string if it does not have one.
+// It is re-read only if the binary changes.
+func (c *Cache) buildID(bin string) string {
+	fi, err := os.Stat(bin)
+	if err != nil {
+		return ""
+	}
+	if bid, ok := c.ids[bin]; ok && bid.size == fi.Size() && bid.modTime.Equal(fi.ModTime()) {
+		return bid.id
+	}
+	id, _ := BuildID(bin)
+	c.ids[bin] = binaryID{id, fi.Size(), fi.ModTime()}
+	return id
+}
+
+func (c *Cache) loadFrames(id string) map[uint64][]Frame {
+	if frames := c.frames[id]; frames != nil {
+		return frames
+	}
+	frames := make(map[uint64][]Frame)
+	c.frames[id] = frames
+	data, err := ioutil.ReadFile(c.file(id))
+	if err != nil {
+		return frames
+	}
+	// A corrupted cache file is discarded and rebuilt.
+	entries := make(map[string][]Frame)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return frames
+	}
+	for pc, res := range entries {
+		if v, err := strconv.ParseUint(pc, 16, 64); err == nil {
+			frames[v] = res
+		}
+	}
+	return frames
+}
+
+// BuildID returns the GNU build id of the ELF binary bin in hex.
+func BuildID(bin string) (string, error) {
+	f, err := elf.Open(bin)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, sec := range f.Sections {
+		if sec.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return "", err
+		}
+		if id := parseBuildID(data, f.ByteOrder); id != "" {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("%v does not have build id", bin)
+}
+
+// parseBuildID finds the build id note in the contents of an ELF note section.
+func parseBuildID(data []byte, order binary.ByteOrder) string {
+	const ntGNUBuildID = 3
+	align := func(v uint64) uint64 { return (v + 3) &^ 3 }
+	for len(data) >= 12 {
+		nameSize := uint64(order.Uint32(data[0:]))
+		descSize := uint64(order.Uint32(data[4:]))
+		typ := order.Uint32(data[8:])
+		data = data[12:]
+		if align(nameSize)+align(descSize) > uint64(len(data)) {
+			break
+		}
+		name := data[:nameSize]
+		desc := data[align(nameSize) : align(nameSize)+descSize]
+		data = data[align(nameSize)+align(descSize):]
+		if typ == ntGNUBuildID && string(name) == "GNU\x00" {
+			return hex.EncodeToString(desc)
+		}
+	}
+	return ""
+}
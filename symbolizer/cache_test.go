@@ -0,0 +1,117 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package symbolizer
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseBuildID(t *testing.T) {
+	note := func(name string, typ uint32, desc []byte) []byte {
+		var data []byte
+		hdr := make([]byte, 12)
+		binary.LittleEndian.PutUint32(hdr[0:], uint32(len(name)))
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(len(desc)))
+		binary.LittleEndian.PutUint32(hdr[8:], typ)
+		data = append(data, hdr...)
+		data = append(data, name...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+		data = append(data, desc...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+		return data
+	}
+	id := []byte{0xde, 0xad, 0xbe, 0xef, 0x01}
+	tests := []struct {
+		data []byte
+		id   string
+	}{
+		{note("GNU\x00", 3, id), "deadbeef01"},
+		{append(note("Go\x00\x00", 4, []byte("go-build-id")), note("GNU\x00", 3, id)...), "deadbeef01"},
+		{note("GNU\x00", 1, id), ""},
+		{note("GNU\x00", 3, id)[:14], ""},
+		{nil, ""},
+	}
+	for i, test := range tests {
+		if got := parseBuildID(test.data, binary.LittleEndian); got != test.id {
+			t.Errorf("#%v: got build id %q, want %q", i, got, test.id)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-symbolizer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "vmlinux")
+	if err := ioutil.WriteFile(bin, []byte("not an elf"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	symb := func(bin string, pc uint64) ([]Frame, error) {
+		calls++
+		return []Frame{{PC: pc, Func: "foo", File: "foo.c", Line: int(pc)}}, nil
+	}
+	want := []Frame{{PC: 10, Func: "foo", File: "foo.c", Line: 10}}
+	newCache := func() *Cache {
+		c, err := NewCache(filepath.Join(dir, "cache"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ids[bin] = binaryID{"1234", fi.Size(), fi.ModTime()}
+		return c
+	}
+
+	c := newCache()
+	for i := 0; i < 2; i++ {
+		frames, err := c.Symbolize(symb, bin, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(frames, want) {
+			t.Fatalf("got frames %+v, want %+v", frames, want)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("symbolized %v times, want 1", calls)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Results are reused by a new cache.
+	c = newCache()
+	frames, err := c.Symbolize(symb, bin, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(frames, want) || calls != 1 {
+		t.Fatalf("got frames %+v after %v calls, want %+v after 1 call", frames, calls, want)
+	}
+
+	// Binaries without build id are not cached.
+	delete(c.ids, bin)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Symbolize(symb, bin, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("symbolized %v times, want 3", calls)
+	}
+}
@@ -35,10 +35,60 @@ func addAlignment(t *StructType) {
 	if t.packed {
 		return
 	}
-	var fields []Type
+	if t.OverlayField != 0 {
+		addOverlayAlignment(t)
+		return
+	}
+	fields, off, align, varLen := alignFields(t.Fields)
+	if t.align != 0 {
+		align = t.align // overrided by user attribute
+	}
+	if align != 0 && off%align != 0 && !varLen {
+		pad := align - off%align
+		off += pad
+		fields = append(fields, makePad(pad))
+	}
+	t.Fields = fields
+}
+
+// addOverlayAlignment pads input and output layouts of t separately (both start at offset 0)
+// and then pads the shorter one, so that both layouts have the size of the struct.
+func addOverlayAlignment(t *StructType) {
+	in, inSize, align, inVarLen := alignFields(t.Fields[:t.OverlayField])
+	out, outSize, outAlign, outVarLen := alignFields(t.Fields[t.OverlayField:])
+	if inVarLen || outVarLen {
+		panic("varlen field in struct with out_overlay")
+	}
+	if align < outAlign {
+		align = outAlign
+	}
+	if t.align != 0 {
+		align = t.align // overrided by user attribute
+	}
+	size := inSize
+	if size < outSize {
+		size = outSize
+	}
+	if align != 0 && size%align != 0 {
+		size += align - size%align
+	}
+	if inSize != size {
+		in = append(in, makePad(size-inSize))
+	}
+	if outSize != size {
+		out = append(out, makePad(size-outSize))
+	}
+	t.OverlayField = len(in)
+	t.Fields = append(in, out...)
+}
+
+// alignFields inserts padding before fields according to their alignment.
+// Returns padded fields, their total size, max field alignment and whether the last field is varlen.
+func alignFields(fields []Type) ([]Type, uintptr, uintptr, bool) {
+	var res []Type
 	var off, align uintptr
 	varLen := false
-	for i, f := range t.Fields {
+	for i, f := range fields {
 		a := f.Align()
 		if align < a {
 			align = a
@@ -46,28 +96,51 @@ func addAlignment(t *StructType) {
 		if off%a != 0 {
 			pad := a - off%a
 			off += pad
-			fields = append(fields, makePad(pad))
-		}
-		fields = append(fields, f)
-		if at, ok := f.(*ArrayType); ok && (at.Kind == ArrayRandLen || (at.Kind == ArrayRangeLen && at.RangeBegin != at.RangeEnd)) {
-			varLen = true
+			res = append(res, makePad(pad))
 		}
-		if at, ok := f.(*BufferType); ok && (at.Kind == BufferBlobRand || (at.Kind == BufferBlobRange && at.RangeBegin != at.RangeEnd)) {
+		res = append(res, f)
+		if IsVarlen(f) {
 			varLen = true
 		}
-		if varLen && i != len(t.Fields)-1 {
+		if varLen && i != len(fields)-1 {
 			panic("embed array in middle of a struct")
 		}
 		if !varLen {
 			off += f.Size()
 		}
 	}
-	if align != 0 && off%align != 0 && !varLen {
-		pad := align - off%align
-		off += pad
-		fields = append(fields, makePad(pad))
+	return res, off, align, varLen
+}
+
+// IsVarlen returns true if size of objects of type t is not statically known.
+func IsVarlen(t Type) bool {
+	switch t1 := t.(type) {
+	case *ArrayType:
+		return t1.Kind == ArrayRandLen || (t1.Kind == ArrayRangeLen && t1.RangeBegin != t1.RangeEnd) || IsVarlen(t1.Type)
+	case *BufferType:
+		switch t1.Kind {
+		case BufferBlobRand, BufferFilename, BufferText, BufferOptions:
+			return true
+		case BufferBlobRange:
+			return t1.RangeBegin != t1.RangeEnd
+		case BufferString:
+			for _, s := range t1.Values {
+				if len(s) != len(t1.Values[0]) {
+					return true
+				}
+			}
+			return len(t1.Values) == 0
+		}
+	case *UnionType:
+		return t1.varlen
+	case *StructType:
+		for _, f := range t1.Fields {
+			if IsVarlen(f) {
+				return true
+			}
+		}
 	}
-	t.Fields = fields
+	return false
 }
 
 func makePad(sz uintptr) Type {
@@ -7,8 +7,6 @@ import (
 	"fmt"
 )
 
-const ptrSize = 8
-
 type Call struct {
 	ID       int
 	NR       int // kernel syscall number
@@ -17,6 +15,8 @@ type Call struct {
 	CallName string
 	Args     []Type
 	Ret      Type
+	Timeout  uint64 // execution timeout in ms, 0 means default executor timeout
+	Errnos   []int  // errors the call is expected to fail with besides success (errno attribute)
 }
 
 type Dir int
@@ -105,8 +105,14 @@ const (
 	BufferString
 	BufferFilename
 	BufferText
+	BufferOptions // comma-separated list of options (e.g. mount data)
+	BufferGlob    // file name glob pattern that is expanded by executor on the target
 )
 
+// GlobSize is the size of glob buffers. Executor replaces the pattern with one of
+// the matching file names in place, the last byte of the buffer selects the match.
+const GlobSize = 256
+
 type TextKind int
 
 const (
@@ -114,6 +120,8 @@ const (
 	Text_x86_16
 	Text_x86_32
 	Text_x86_64
+	Text_arm64
+	Text_bpf
 )
 
 type BufferType struct {
@@ -123,7 +131,7 @@ type BufferType struct {
 	RangeEnd   uintptr  // for BufferBlobRange kind
 	Text       TextKind // for BufferText
 	SubKind    string
-	Values     []string // possible values for BufferString kind
+	Values     []string // possible values for BufferString kind, known option tokens for BufferOptions kind, pattern for BufferGlob kind
 }
 
 func (t *BufferType) Size() uintptr {
@@ -144,6 +152,8 @@ func (t *BufferType) Size() uintptr {
 		if t.RangeBegin == t.RangeEnd {
 			return t.RangeBegin
 		}
+	case BufferGlob:
+		return GlobSize
 	}
 	panic(fmt.Sprintf("buffer size is not statically known: %v", t.Name()))
 }
@@ -159,7 +169,7 @@ type VmaType struct {
 }
 
 func (t *VmaType) Size() uintptr {
-	return ptrSize
+	return PtrSize
 }
 
 func (t *VmaType) Align() uintptr {
@@ -179,38 +189,84 @@ func (t *LenType) Size() uintptr {
 }
 
 func (t *LenType) Align() uintptr {
-	return t.Size()
+	return scalarAlign(t.Size())
+}
+
+// IntFormat says how an integer value is represented in memory.
+type IntFormat int
+
+const (
+	FormatNative IntFormat = iota // binary value of TypeSize bytes
+	FormatStrDec                  // zero-padded decimal ASCII string (e.g. "00000000000000000042")
+	FormatStrHex                  // zero-padded hex ASCII string (e.g. "0x000000000000002a")
+	FormatStrOct                  // zero-padded octal ASCII string (e.g. "00000000000000000000052")
+)
+
+// FormatSize returns size of an integer of the given size in format f.
+// Textual formats have fixed width regardless of the value,
+// so that sizes of enclosing objects stay static.
+func FormatSize(size uintptr, f IntFormat) uintptr {
+	switch f {
+	case FormatNative:
+		return size
+	case FormatStrDec:
+		return 20
+	case FormatStrHex:
+		return 18
+	case FormatStrOct:
+		return 23
+	default:
+		panic(fmt.Sprintf("unknown int format %v", f))
+	}
+}
+
+func formatAlign(size uintptr, f IntFormat) uintptr {
+	if f != FormatNative {
+		return 1
+	}
+	return scalarAlign(size)
+}
+
+// scalarAlign returns alignment of an integer of the given size.
+// Integers wider than a pointer are pointer-aligned (e.g. int64 in structs on i386).
+func scalarAlign(size uintptr) uintptr {
+	if size > PtrSize {
+		return PtrSize
+	}
+	return size
 }
 
 type FlagsType struct {
 	TypeCommon
 	TypeSize  uintptr
 	BigEndian bool
+	Format    IntFormat
 	Vals      []uintptr
 }
 
 func (t *FlagsType) Size() uintptr {
-	return t.TypeSize
+	return FormatSize(t.TypeSize, t.Format)
 }
 
 func (t *FlagsType) Align() uintptr {
-	return t.Size()
+	return formatAlign(t.TypeSize, t.Format)
 }
 
 type ConstType struct {
 	TypeCommon
 	TypeSize  uintptr
 	BigEndian bool
+	Format    IntFormat
 	Val       uintptr
 	IsPad     bool
 }
 
 func (t *ConstType) Size() uintptr {
-	return t.TypeSize
+	return FormatSize(t.TypeSize, t.Format)
 }
 
 func (t *ConstType) Align() uintptr {
-	return t.Size()
+	return formatAlign(t.TypeSize, t.Format)
 }
 
 type IntKind int
@@ -226,33 +282,35 @@ type IntType struct {
 	TypeCommon
 	TypeSize   uintptr
 	BigEndian  bool
+	Format     IntFormat
 	Kind       IntKind
 	RangeBegin int64
 	RangeEnd   int64
 }
 
 func (t *IntType) Size() uintptr {
-	return t.TypeSize
+	return FormatSize(t.TypeSize, t.Format)
 }
 
 func (t *IntType) Align() uintptr {
-	return t.Size()
+	return formatAlign(t.TypeSize, t.Format)
 }
 
 type ProcType struct {
 	TypeCommon
 	TypeSize      uintptr
 	BigEndian     bool
+	Format        IntFormat
 	ValuesStart   int64
 	ValuesPerProc uint64
 }
 
 func (t *ProcType) Size() uintptr {
-	return t.TypeSize
+	return FormatSize(t.TypeSize, t.Format)
 }
 
 func (t *ProcType) Align() uintptr {
-	return t.Size()
+	return formatAlign(t.TypeSize, t.Format)
 }
 
 type ArrayKind int
@@ -287,7 +345,7 @@ type PtrType struct {
 }
 
 func (t *PtrType) Size() uintptr {
-	return ptrSize
+	return PtrSize
 }
 
 func (t *PtrType) Align() uintptr {
@@ -297,17 +355,25 @@ func (t *PtrType) Align() uintptr {
 type StructType struct {
 	TypeCommon
 	Fields []Type
-	padded bool
-	packed bool
-	align  uintptr
+	// OverlayField is index of the first field of the output layout, 0 if there is none.
+	// Fields before it describe the input layout, and the rest describe the output layout
+	// that occupies the same memory. After padding both layouts have the same size.
+	OverlayField int
+	padded       bool
+	packed       bool
+	align        uintptr
 }
 
 func (t *StructType) Size() uintptr {
 	if !t.padded {
 		panic("struct is not padded yet")
 	}
+	fields := t.Fields
+	if t.OverlayField != 0 {
+		fields = fields[:t.OverlayField]
+	}
 	var size uintptr
-	for _, f := range t.Fields {
+	for _, f := range fields {
 		size += f.Size()
 	}
 	return size
@@ -355,16 +421,27 @@ func (t *UnionType) Align() uintptr {
 	return align
 }
 
-var ctors = make(map[string][]*Call)
+var (
+	ctors        = make(map[string][]*Call)
+	preciseCtors = make(map[string][]*Call)
+)
 
 // ResourceConstructors returns a list of calls that can create a resource of the given kind.
 func ResourceConstructors(name string) []*Call {
 	return ctors[name]
 }
 
+// PreciseResourceConstructors returns a list of calls that can create a resource
+// that can be passed as an argument of the given kind. Unlike ResourceConstructors
+// it does not include calls that create less specialized resources (e.g. open for sock).
+func PreciseResourceConstructors(name string) []*Call {
+	return preciseCtors[name]
+}
+
 func initResources() {
 	for name, res := range Resources {
 		ctors[name] = resourceCtors(res.Kind, false)
+		preciseCtors[name] = resourceCtors(res.Kind, true)
 	}
 }
 
@@ -441,47 +518,59 @@ func (c *Call) InputResources() []*ResourceType {
 	return resources
 }
 
+// TransitivelyEnabledCalls returns subset of enabled calls that can be generated,
+// i.e. all resources they need as inputs have enabled constructors.
 func TransitivelyEnabledCalls(enabled map[*Call]bool) map[*Call]bool {
+	supported, _ := TransitivelyEnabledCallsReasons(enabled)
+	return supported
+}
+
+// TransitivelyEnabledCallsReasons is the same as TransitivelyEnabledCalls,
+// but also returns the dead calls (enabled, but can't be generated)
+// along with the reason why each of them is dead.
+func TransitivelyEnabledCallsReasons(enabled map[*Call]bool) (map[*Call]bool, map[*Call]string) {
 	supported := make(map[*Call]bool)
 	for c := range enabled {
 		supported[c] = true
 	}
+	dead := make(map[*Call]string)
 	for {
 		n := len(supported)
 		haveGettime := supported[CallMap["clock_gettime"]]
 		for c := range supported {
-			canCreate := true
+			reason := ""
 			for _, res := range c.InputResources() {
 				noctors := true
-				for _, ctor := range resourceCtors(res.Desc.Kind, true) {
+				for _, ctor := range preciseCtors[res.Desc.Name] {
 					if supported[ctor] {
 						noctors = false
 						break
 					}
 				}
 				if noctors {
-					canCreate = false
+					reason = fmt.Sprintf("no enabled constructors for resource %v", res.Desc.Name)
 					break
 				}
 			}
 			// We need to support structs as resources,
 			// but for now we just special-case timespec/timeval.
-			if canCreate && !haveGettime {
+			if reason == "" && !haveGettime {
 				ForeachType(c, func(typ Type) {
 					if a, ok := typ.(*StructType); ok && a.Dir() != DirOut && (a.Name() == "timespec" || a.Name() == "timeval") {
-						canCreate = false
+						reason = fmt.Sprintf("%v requires clock_gettime", a.Name())
 					}
 				})
 			}
-			if !canCreate {
+			if reason != "" {
 				delete(supported, c)
+				dead[c] = reason
 			}
 		}
 		if n == len(supported) {
 			break
 		}
 	}
-	return supported
+	return supported, dead
 }
 
 func ForeachType(meta *Call, f func(Type)) {
@@ -46,3 +46,42 @@ func TestClockGettime(t *testing.T) {
 		t.Fatalf("clock_gettime did not disable enough calls: before %v, after %v", len(calls), len(trans))
 	}
 }
+
+func TestTransitivelyEnabledCallsReasons(t *testing.T) {
+	calls := make(map[*Call]bool)
+	for _, c := range Calls {
+		calls[c] = true
+	}
+	delete(calls, CallMap["epoll_create"])
+	delete(calls, CallMap["epoll_create1"])
+	trans, dead := TransitivelyEnabledCallsReasons(calls)
+	if len(trans)+len(dead) != len(calls) {
+		t.Fatalf("live %v + dead %v calls != enabled %v calls", len(trans), len(dead), len(calls))
+	}
+	for _, name := range []string{"epoll_ctl", "epoll_wait", "epoll_pwait"} {
+		reason := dead[CallMap[name]]
+		if reason != "no enabled constructors for resource fd_epoll" {
+			t.Fatalf("bad reason for %v: %q", name, reason)
+		}
+	}
+}
+
+func TestPreciseResourceConstructors(t *testing.T) {
+	has := func(ctors []*Call, name string) bool {
+		for _, c := range ctors {
+			if c.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	if ctors := PreciseResourceConstructors("fd"); !has(ctors, "open") || !has(ctors, "socket") {
+		t.Fatalf("fd constructors must include open and socket")
+	}
+	if ctors := PreciseResourceConstructors("sock"); has(ctors, "open") || !has(ctors, "socket") {
+		t.Fatalf("sock constructors must include socket, but not open")
+	}
+	if ctors := ResourceConstructors("sock"); !has(ctors, "open") {
+		t.Fatalf("imprecise sock constructors must include open")
+	}
+}
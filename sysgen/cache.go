@@ -0,0 +1,129 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// buildCache records hashes of input files that were used to generate each output file,
+// and hash of the output itself. An output needs to be regenerated only if any of its
+// inputs has changed or the output was modified/removed since the last run.
+// Generated Go code for an arch depends on all description files, const files
+// for that arch and sysgen itself; so e.g. updating consts for one arch
+// regenerates only that arch and executor/syscalls.h.
+type buildCache struct {
+	file    string
+	Outputs map[string]*cacheEntry
+	hashes  map[string]string
+	changed bool
+}
+
+type cacheEntry struct {
+	Inputs map[string]string // input file -> content hash
+	Hash   string            // content hash of the output file
+}
+
+const cacheFile = "sys/.sysgen_cache"
+
+func loadCache(file string, reset bool) *buildCache {
+	c := &buildCache{
+		file:    file,
+		Outputs: make(map[string]*cacheEntry),
+		hashes:  make(map[string]string),
+	}
+	if reset {
+		c.changed = true
+		return c
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, c); err != nil || c.Outputs == nil {
+		logf(0, "ignoring corrupted cache file %v: %v", file, err)
+		c.Outputs = make(map[string]*cacheEntry)
+	}
+	return c
+}
+
+// upToDate returns true if output was generated from exactly the same inputs
+// and was not changed since then.
+func (c *buildCache) upToDate(output string, inputs []string) bool {
+	ent := c.Outputs[output]
+	if ent == nil || len(ent.Inputs) != len(inputs) {
+		return false
+	}
+	for _, in := range inputs {
+		if h := c.hash(in); h == "" || ent.Inputs[in] != h {
+			logf(1, "%v: %v has changed", output, in)
+			return false
+		}
+	}
+	return hashFile(output) == ent.Hash
+}
+
+// update records that output with contents data was generated from inputs.
+func (c *buildCache) update(output string, inputs []string, data []byte) {
+	ent := &cacheEntry{
+		Inputs: make(map[string]string),
+		Hash:   hashData(data),
+	}
+	for _, in := range inputs {
+		ent.Inputs[in] = c.hash(in)
+	}
+	c.Outputs[output] = ent
+	c.changed = true
+}
+
+func (c *buildCache) save() {
+	if !c.changed {
+		return
+	}
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		failf("failed to serialize cache: %v", err)
+	}
+	if err := ioutil.WriteFile(c.file, data, 0644); err != nil {
+		failf("failed to write cache file: %v", err)
+	}
+}
+
+// hash returns memoized content hash of file, or "" if the file can't be read.
+func (c *buildCache) hash(file string) string {
+	h, ok := c.hashes[file]
+	if !ok {
+		h = hashFile(file)
+		c.hashes[file] = h
+	}
+	return h
+}
+
+func hashFile(file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return hashData(data)
+}
+
+func hashData(data []byte) string {
+	h := sha1.Sum(data)
+	return hex.EncodeToString(h[:])
+}
+
+// sysgenBinary returns path to the running sysgen binary, so that changes
+// in sysgen itself invalidate all outputs. Returns "" if the path is unknown,
+// in which case the cache is not used.
+func sysgenBinary() string {
+	bin, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return bin
+}
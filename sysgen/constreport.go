@@ -0,0 +1,108 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Modes of handling of consts that descriptions use, but that are missing for an arch.
+const (
+	missingSkip = "skip" // skip syscalls and flag values that use missing consts
+	missingFail = "fail" // fail generation
+)
+
+// missingConsts collects consts that are used by descriptions but are missing
+// for the arch that is currently being generated.
+var missingConsts map[string]bool
+
+func noteMissingConst(name string) {
+	if missingConsts != nil {
+		missingConsts[name] = true
+	}
+}
+
+// checkMissingConsts fails generation for arch in missingFail mode if some consts were missing.
+func checkMissingConsts(arch string) {
+	if *flagMissing != missingFail || len(missingConsts) == 0 {
+		return
+	}
+	var names []string
+	for name := range missingConsts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failf("%v: %v consts are missing: %v", arch, len(names), strings.Join(names, ", "))
+}
+
+// constReport describes consts that are not the same on all arches.
+// It is meant to help porting descriptions to new arches.
+type constReport struct {
+	Arches []string           `json:"arches"`
+	Consts []constReportEntry `json:"consts"`
+}
+
+type constReportEntry struct {
+	Name    string            `json:"name"`
+	Values  map[string]uint64 `json:"values"`            // arch -> value, for arches that define the const
+	Missing []string          `json:"missing,omitempty"` // arches that don't define the const
+	Differ  bool              `json:"differ,omitempty"`  // values are different across arches
+}
+
+// writeConstReport writes JSON report of consts that are missing on some arches or have
+// different values on different arches. Syscall numbers (__NR_*) are expected to differ,
+// so they are reported only if missing.
+func writeConstReport(file string, archs []*Arch, consts map[string]map[string]uint64) {
+	report := &constReport{Consts: []constReportEntry{}}
+	names := make(map[string]bool)
+	for _, arch := range archs {
+		report.Arches = append(report.Arches, arch.Name)
+		for name := range consts[arch.Name] {
+			names[name] = true
+		}
+	}
+	for name := range names {
+		ent := constReportEntry{
+			Name:   name,
+			Values: make(map[string]uint64),
+		}
+		first, haveFirst := uint64(0), false
+		for _, arch := range archs {
+			v, ok := consts[arch.Name][name]
+			if !ok {
+				ent.Missing = append(ent.Missing, arch.Name)
+				continue
+			}
+			ent.Values[arch.Name] = v
+			if haveFirst && v != first {
+				ent.Differ = true
+			}
+			first, haveFirst = v, true
+		}
+		if strings.HasPrefix(name, "__NR_") {
+			ent.Differ = false
+		}
+		if len(ent.Missing) != 0 || ent.Differ {
+			report.Consts = append(report.Consts, ent)
+		}
+	}
+	sort.Sort(constReportArray(report.Consts))
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		failf("failed to serialize const report: %v", err)
+	}
+	if err := ioutil.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		failf("failed to write const report: %v", err)
+	}
+	logf(0, "const report: %v consts differ or are missing, written to %v", len(report.Consts), file)
+}
+
+type constReportArray []constReportEntry
+
+func (a constReportArray) Len() int           { return len(a) }
+func (a constReportArray) Less(i, j int) bool { return a[i].Name < a[j].Name }
+func (a constReportArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
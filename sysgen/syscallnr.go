@@ -5,7 +5,9 @@ package main
 
 import (
 	"bytes"
+	"path/filepath"
 	"sort"
+	"strings"
 	"text/template"
 
 	. "github.com/google/syzkaller/sysparser"
@@ -13,65 +15,204 @@ import (
 
 type Arch struct {
 	Name  string
+	ID    int // identifies arch in exec programs, must not change
 	CARCH []string
+	// Programs place all data into NumPages pages of PageSize bytes starting at DataOffset.
+	// PageSize must not be smaller than the kernel page size, otherwise fixed mmaps fail.
+	// The region must lie within the user address space [minUserAddr, UserSpaceEnd).
+	PageSize     uint64
+	NumPages     uint64
+	DataOffset   uint64
+	UserSpaceEnd uint64
+	PtrSize      uint64
+	// Go arch of binaries that use descriptions of a 32-bit compat arch (prog keeps values in uintptr,
+	// so it needs a 64-bit host), such descriptions are selected with the arch name as build tag.
+	// Empty for native arches, their descriptions are selected by GOARCH.
+	HostArch string
 }
 
-var archs = []*Arch{
-	{"amd64", []string{"__x86_64__"}},
-	{"arm64", []string{"__aarch64__"}},
-	{"ppc64le", []string{"__ppc64__", "__PPC64__", "__powerpc64__"}},
+// Target is an OS supported by syzkaller.
+type Target struct {
+	Name    string
+	Dir     string // directory with descriptions and consts
+	CDEFINE string // macro that the C compiler defines for the OS
+	// Syscalls are not invoked by number, but by calling functions of the same name
+	// (e.g. Fuchsia vDSO calls), __NR_ consts only identify the calls.
+	CallFuncs bool
+	// Go build tag that selects descriptions of the OS in host binaries, the name by default.
+	// Go treats names of OSes it knows as GOOS, so such OSes that are fuzzed from a different
+	// host OS (windows from Linux) need a different tag.
+	BuildTag string
+	Archs    []*Arch
 }
 
-var syzkalls = map[string]uint64{
-	"syz_test":          1000001,
-	"syz_open_dev":      1000002,
-	"syz_open_pts":      1000003,
-	"syz_fuse_mount":    1000004,
-	"syz_fuseblk_mount": 1000005,
-	"syz_emit_ethernet": 1000006,
-	"syz_kvm_setup_cpu": 1000007,
+func (target *Target) buildTag() string {
+	if target.BuildTag != "" {
+		return target.BuildTag
+	}
+	return target.Name
+}
+
+// targets lists supported OSes, linux must go first.
+var targets = []*Target{
+	{Name: "linux", Dir: "sys", CDEFINE: "__linux__", Archs: []*Arch{
+		{"amd64", 1, []string{"__x86_64__"}, 4 << 10, 4 << 10, 512 << 20, 1 << 47, 8, ""},
+		// arm64 kernels can be configured with 39-bit VA and 64K pages.
+		{"arm64", 2, []string{"__aarch64__"}, 64 << 10, 256, 512 << 20, 1 << 39, 8, ""},
+		// ppc64le kernels commonly use 64K pages.
+		{"ppc64le", 3, []string{"__ppc64__", "__PPC64__", "__powerpc64__"}, 64 << 10, 256, 512 << 20, 1 << 46, 8, ""},
+		// riscv64 kernels use Sv39 paging by default, user space is 256GB.
+		{"riscv64", 10, []string{"__riscv"}, 4 << 10, 4 << 10, 512 << 20, 1 << 38, 8, ""},
+		// 32-bit executor on x86_64 kernels, syscalls go through the compat entry, user space ends below 4GB.
+		{"i386", 11, []string{"__i386__"}, 4 << 10, 4 << 10, 512 << 20, 0xffffe000, 4, "amd64"},
+	}},
+	{Name: "freebsd", Dir: filepath.Join("sys", "freebsd"), CDEFINE: "__FreeBSD__", Archs: []*Arch{
+		{"amd64", 4, []string{"__x86_64__"}, 4 << 10, 4 << 10, 512 << 20, 1 << 47, 8, ""},
+	}},
+	{Name: "netbsd", Dir: filepath.Join("sys", "netbsd"), CDEFINE: "__NetBSD__", Archs: []*Arch{
+		// NetBSD user space ends at VM_MAXUSER_ADDRESS, slightly below 128TB.
+		{"amd64", 5, []string{"__x86_64__"}, 4 << 10, 4 << 10, 512 << 20, 0x7f7fffffc000, 8, ""},
+	}},
+	{Name: "openbsd", Dir: filepath.Join("sys", "openbsd"), CDEFINE: "__OpenBSD__", Archs: []*Arch{
+		// Same VM_MAXUSER_ADDRESS as on NetBSD.
+		{"amd64", 6, []string{"__x86_64__"}, 4 << 10, 4 << 10, 512 << 20, 0x7f7fffffc000, 8, ""},
+	}},
+	{Name: "fuchsia", Dir: filepath.Join("sys", "fuchsia"), CDEFINE: "__Fuchsia__", CallFuncs: true, Archs: []*Arch{
+		{"amd64", 7, []string{"__x86_64__"}, 4 << 10, 4 << 10, 512 << 20, 1 << 47, 8, ""},
+		{"arm64", 8, []string{"__aarch64__"}, 4 << 10, 4 << 10, 512 << 20, 1 << 47, 8, ""},
+	}},
+	{Name: "windows", Dir: filepath.Join("sys", "windows"), CDEFINE: "_WIN32", BuildTag: "windows_nt", Archs: []*Arch{
+		// User space of 64-bit Windows 8.1 and later ends 64K below 128TB.
+		{"amd64", 9, []string{"__x86_64__"}, 4 << 10, 4 << 10, 512 << 20, 0x7fffffff0000, 8, ""},
+	}},
+}
+
+// specialPointers lists additional special pointer values of targets (see Arch.specialPointers),
+// e.g. addresses of kernel text and of the kernel direct mapping of physical memory.
+var specialPointers = map[string][]uint64{
+	"linux/amd64": {0xffffffff81000000, 0xffff880000000000},
+	"linux/arm64": {0xffff000008080000},
+}
+
+// specialPointers returns pointer values that prog occasionally uses instead of valid pointers
+// to exercise handling of faulting addresses: NULL, the last user page, the first address
+// above user space (kernel or non-canonical), the last page of the address space (error pointers)
+// and, for 64-bit arches, a non-canonical address.
+func (arch *Arch) specialPointers(target *Target) []uint64 {
+	ptrs := []uint64{0, arch.UserSpaceEnd - arch.PageSize, arch.UserSpaceEnd}
+	if arch.PtrSize == 8 {
+		ptrs = append(ptrs, ^uint64(0)-arch.PageSize+1, 1<<63)
+	} else {
+		ptrs = append(ptrs, 1<<(arch.PtrSize*8)-arch.PageSize)
+	}
+	return append(ptrs, specialPointers[target.Name+"/"+arch.Name]...)
+}
+
+// minUserAddr is the default value of vm.mmap_min_addr, pages below it can't be mapped.
+const minUserAddr = 64 << 10
+
+// checkArch verifies that address space configuration of arch is sane.
+func checkArch(target *Target, arch *Arch) {
+	name := target.Name + "/" + arch.Name
+	if arch.PageSize == 0 || arch.PageSize&(arch.PageSize-1) != 0 {
+		failf("%v: page size %v is not a power of 2", name, arch.PageSize)
+	}
+	if arch.NumPages == 0 {
+		failf("%v: no data pages", name)
+	}
+	if arch.DataOffset%arch.PageSize != 0 {
+		failf("%v: data offset 0x%x is not page aligned", name, arch.DataOffset)
+	}
+	end := arch.DataOffset + arch.NumPages*arch.PageSize
+	if arch.DataOffset < minUserAddr || end > arch.UserSpaceEnd || end < arch.DataOffset {
+		failf("%v: data region [0x%x, 0x%x) does not fit into user address space [0x%x, 0x%x)",
+			name, arch.DataOffset, end, minUserAddr, arch.UserSpaceEnd)
+	}
 }
 
-func generateExecutorSyscalls(syscalls []Syscall, consts map[string]map[string]uint64) {
-	var data SyscallsData
-	for _, arch := range archs {
-		var calls []SyscallData
-		for _, c := range syscalls {
-			syscallNR := -1
-			if nr, ok := consts[arch.Name]["__NR_"+c.CallName]; ok {
-				syscallNR = int(nr)
-			}
-			calls = append(calls, SyscallData{c.Name, syscallNR})
+// pseudoSyscallBase precedes numbers of pseudo-syscalls: calls of descriptions named syz_*
+// that are implemented by executor in C (see execute_syscall in executor/common.h).
+// Must match SYZ_PSEUDO_SYSCALL_BASE in executor/common.h.
+const pseudoSyscallBase = 1000000
+
+// maxPseudoSyscallArgs is the number of arguments executor passes to pseudo-syscalls.
+const maxPseudoSyscallArgs = 9
+
+// pseudoSyscalls returns pseudo-syscalls of descriptions of a target. They are numbered
+// in the order of names, the number of arguments is the maximum over all variants of a call.
+func pseudoSyscalls(syscalls []Syscall) []SyscallData {
+	nargs := make(map[string]int)
+	for _, c := range syscalls {
+		if !strings.HasPrefix(c.CallName, "syz_") {
+			continue
+		}
+		if len(c.Args) > maxPseudoSyscallArgs {
+			failf("pseudo-syscall %v has %v args, at most %v are supported", c.Name, len(c.Args), maxPseudoSyscallArgs)
+		}
+		if n, ok := nargs[c.CallName]; !ok || n < len(c.Args) {
+			nargs[c.CallName] = len(c.Args)
 		}
-		data.Archs = append(data.Archs, ArchData{arch.CARCH, calls})
 	}
-	for name, nr := range syzkalls {
-		data.FakeCalls = append(data.FakeCalls, SyscallData{name, int(nr)})
+	var calls []SyscallData
+	for name, n := range nargs {
+		calls = append(calls, SyscallData{Name: name, NArgs: n})
 	}
-	sort.Sort(SyscallArray(data.FakeCalls))
+	sort.Sort(SyscallArray(calls))
+	for i := range calls {
+		calls[i].NR = pseudoSyscallBase + i + 1
+	}
+	return calls
+}
 
-	hdrcode := "executor/syscalls.h"
-	logf(1, "Generate header with syscall numbers in %v", hdrcode)
+func archData(target *Target, arch *Arch, syscalls []Syscall, pseudo []SyscallData, consts map[string]uint64) ArchData {
+	var calls []SyscallData
+	for _, c := range syscalls {
+		syscallNR := -1
+		if nr, ok := consts["__NR_"+c.CallName]; ok {
+			syscallNR = int(nr)
+		}
+		call := SyscallData{Name: c.Name, NR: syscallNR}
+		if target.CallFuncs && syscallNR != -1 {
+			call.Func = c.CallName
+		}
+		calls = append(calls, call)
+	}
+	return ArchData{target.CDEFINE, arch.ID, arch.CARCH, arch.DataOffset, arch.NumPages * arch.PageSize, calls, pseudo}
+}
+
+func generateExecutorSyscalls(archs []ArchData) []byte {
+	data := SyscallsData{Archs: archs}
+
+	logf(1, "Generate header with syscall numbers in %v", syscallsHeaderFile)
 	buf := new(bytes.Buffer)
 	if err := syscallsTempl.Execute(buf, data); err != nil {
 		failf("failed to execute syscalls template: %v", err)
 	}
-	writeFile(hdrcode, buf.Bytes())
+	writeFile(syscallsHeaderFile, buf.Bytes())
+	return buf.Bytes()
 }
 
+const syscallsHeaderFile = "executor/syscalls.h"
+
 type SyscallsData struct {
-	Archs     []ArchData
-	FakeCalls []SyscallData
+	Archs []ArchData
 }
 
 type ArchData struct {
-	CARCH []string
-	Calls []SyscallData
+	COS        string
+	ID         int
+	CARCH      []string
+	DataOffset uint64
+	DataSize   uint64
+	Calls      []SyscallData
+	Pseudo     []SyscallData // pseudo-syscalls of the target
 }
 
 type SyscallData struct {
-	Name string
-	NR   int
+	Name  string
+	NR    int
+	Func  string // function that implements the call for CallFuncs targets
+	NArgs int    // max number of args of variants of a pseudo-syscall
 }
 
 type SyscallArray []SyscallData
@@ -83,18 +224,24 @@ func (a SyscallArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 var syscallsTempl = template.Must(template.New("").Parse(
 	`// AUTOGENERATED FILE
 
-{{range $c := $.FakeCalls}}#define __NR_{{$c.Name}}	{{$c.NR}}
-{{end}}
+#include <stdint.h>
+
+typedef intptr_t (*syscall_t)(intptr_t, intptr_t, intptr_t, intptr_t, intptr_t, intptr_t, intptr_t, intptr_t, intptr_t);
 
 struct call_t {
 	const char*	name;
 	int		sys_nr;
+	syscall_t	call;
 };
 
 {{range $arch := $.Archs}}
-#if {{range $cdef := $arch.CARCH}}defined({{$cdef}}) || {{end}}0
-call_t syscalls[] = {
-{{range $c := $arch.Calls}}	{"{{$c.Name}}", {{$c.NR}}},
+#if defined({{$arch.COS}}) && ({{range $cdef := $arch.CARCH}}defined({{$cdef}}) || {{end}}0)
+#define SYZ_ARCH_ID {{$arch.ID}}
+#define SYZ_DATA_OFFSET {{$arch.DataOffset}}ull
+#define SYZ_DATA_SIZE {{$arch.DataSize}}ull
+{{range $c := $arch.Pseudo}}#define __NR_{{$c.Name}}	{{$c.NR}}	// {{$c.NArgs}} args
+{{end}}call_t syscalls[] = {
+{{range $c := $arch.Calls}}	{"{{$c.Name}}", {{$c.NR}}{{if $c.Func}}, (syscall_t){{$c.Func}}{{end}}},
 {{end}}
 };
 #endif
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"go/format"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -20,20 +21,109 @@ import (
 )
 
 var (
-	flagV = flag.Int("v", 0, "verbosity")
+	flagV       = flag.Int("v", 0, "verbosity")
+	flagLint    = flag.Bool("lint", false, "report likely bugs in descriptions (unused types, unreachable resources)")
+	flagForce   = flag.Bool("force", false, "regenerate all files ignoring the build cache")
+	flagMissing = flag.String("missing", missingSkip, "handling of consts missing for an arch: skip (skip syscalls/flags using them) or fail")
+	flagReport  = flag.String("constreport", "", "write JSON report of consts that differ or are missing across arches to this file")
 )
 
-const (
-	ptrSize = 8
-)
+const globSize = 256 // sys.GlobSize
+
+// ptrSize is the pointer size of the arch being generated, it is the default size of syscall args.
+var ptrSize uint64
 
 func main() {
 	flag.Parse()
+	if *flagMissing != missingSkip && *flagMissing != missingFail {
+		failf("bad -missing value %q, want %v or %v", *flagMissing, missingSkip, missingFail)
+	}
+
+	cache := loadCache(cacheFile, *flagForce)
+	generator := sysgenBinary()
+	allInputs := []string{generator}
+	inputFiles := make(map[*Target][]string)
+	consts := make(map[*Target]map[string]map[string]uint64)
+	archInputs := make(map[*Arch][]string)
+	stale := make(map[*Arch]bool)
+	noConsts := make(map[*Arch]bool)
+	for _, target := range targets {
+		files, err := filepath.Glob(filepath.Join(target.Dir, "*\\.txt"))
+		if err != nil || len(files) == 0 {
+			failf("failed to find input files for %v: %v", target.Name, err)
+		}
+		inputFiles[target] = files
+		allInputs = append(allInputs, files...)
+		consts[target] = make(map[string]map[string]uint64)
+		for _, arch := range target.Archs {
+			checkArch(target, arch)
+			constFiles := constFiles(target, arch.Name)
+			if len(constFiles) == 0 {
+				// A new arch is added before its consts are extracted, nothing can be generated for it.
+				logf(0, "no const files for %v/%v, extract them with make extract", target.Name, arch.Name)
+				noConsts[arch] = true
+				continue
+			}
+			consts[target][arch.Name] = readConsts(target, arch.Name)
+			allInputs = append(allInputs, constFiles...)
+			archInputs[arch] = append(append([]string{generator}, files...), constFiles...)
+			// In fail mode all arches are regenerated to check that no consts are missing.
+			if *flagMissing == missingFail || !cache.upToDate(archSourceFile(target, arch), archInputs[arch]) {
+				stale[arch] = true
+			}
+		}
+	}
+	if *flagReport != "" {
+		// Consts are compared across arches of the same OS, so the report covers only linux.
+		var archs []*Arch
+		for _, arch := range targets[0].Archs {
+			if !noConsts[arch] {
+				archs = append(archs, arch)
+			}
+		}
+		writeConstReport(*flagReport, archs, consts[targets[0]])
+	}
+	staleHeader := !cache.upToDate(syscallsHeaderFile, allInputs)
+	if len(stale) == 0 && !staleHeader && !*flagLint {
+		logf(0, "everything is up-to-date")
+		return
+	}
 
-	inputFiles, err := filepath.Glob("sys/*\\.txt")
-	if err != nil {
-		failf("failed to find input files: %v", err)
+	var headerArchs []ArchData
+	for _, target := range targets {
+		targetStale := false
+		for _, arch := range target.Archs {
+			targetStale = targetStale || stale[arch]
+		}
+		if !targetStale && !staleHeader && !*flagLint {
+			continue
+		}
+		desc := parseDescriptions(target, inputFiles[target])
+		pseudo := pseudoSyscalls(desc.Syscalls)
+		for _, arch := range target.Archs {
+			if noConsts[arch] {
+				continue
+			}
+			for _, c := range pseudo {
+				consts[target][arch.Name]["__NR_"+c.Name] = uint64(c.NR)
+			}
+			headerArchs = append(headerArchs, archData(target, arch, desc.Syscalls, pseudo, consts[target][arch.Name]))
+			if !stale[arch] {
+				logf(1, "%v/%v is up-to-date", target.Name, arch.Name)
+				continue
+			}
+			generateArch(target, arch, desc, consts[target][arch.Name], cache, archInputs[arch])
+		}
 	}
+
+	if staleHeader {
+		cache.update(syscallsHeaderFile, allInputs, generateExecutorSyscalls(headerArchs))
+	}
+	cache.save()
+}
+
+// parseDescriptions parses description files of target and lints them if requested.
+func parseDescriptions(target *Target, inputFiles []string) *Description {
 	var r io.Reader = bytes.NewReader(nil)
 	for _, f := range inputFiles {
 		inf, err := os.Open(f)
@@ -45,55 +135,91 @@ func main() {
 		r = io.MultiReader(r, bufio.NewReader(inf))
 	}
 
-	logf(1, "Parse system call descriptions")
+	logf(1, "Parse %v system call descriptions", target.Name)
 	desc := Parse(r)
+	if *flagLint {
+		for _, w := range Lint(desc) {
+			logf(0, "warning: %v", w)
+		}
+		for _, f := range inputFiles {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				failf("failed to read input file: %v", err)
+			}
+			if formatted, err := Format(data); err != nil {
+				logf(0, "warning: failed to format %v: %v", f, err)
+			} else if !bytes.Equal(data, formatted) {
+				logf(0, "warning: %v is not formatted, run syz-fmt -w %v", f, f)
+			}
+		}
+	}
+	return desc
+}
 
-	consts := make(map[string]map[string]uint64)
-	for _, arch := range archs {
-		logf(0, "generating %v...", arch.Name)
-		consts[arch.Name] = readConsts(arch.Name)
-
-		unsupported := make(map[string]bool)
-		archFlags := make(map[string][]string)
-		for f, vals := range desc.Flags {
-			var archVals []string
-			for _, val := range vals {
-				if isIdentifier(val) {
-					if v, ok := consts[arch.Name][val]; ok {
-						archVals = append(archVals, fmt.Sprint(v))
-					} else {
-						if !unsupported[val] {
-							unsupported[val] = true
-							logf(0, "unsupported flag: %v", val)
-						}
-					}
+func generateArch(target *Target, arch *Arch, desc *Description, consts map[string]uint64, cache *buildCache, inputs []string) {
+	logf(0, "generating %v/%v...", target.Name, arch.Name)
+
+	ptrSize = arch.PtrSize
+	missingConsts = make(map[string]bool)
+	unsupported := make(map[string]bool)
+	archFlags := make(map[string][]string)
+	for f, vals := range desc.Flags {
+		var archVals []string
+		for _, val := range vals {
+			if isIdentifier(val) {
+				if v, ok := consts[val]; ok {
+					archVals = append(archVals, fmt.Sprint(v))
 				} else {
-					archVals = append(archVals, val)
+					if !unsupported[val] {
+						unsupported[val] = true
+						logf(0, "unsupported flag: %v", val)
+					}
+					noteMissingConst(val)
 				}
+			} else {
+				archVals = append(archVals, val)
 			}
-			archFlags[f] = archVals
 		}
-
-		sysFile := filepath.Join("sys", "sys_"+arch.Name+".go")
-		logf(1, "Generate code to init system call data in %v", sysFile)
-		out := new(bytes.Buffer)
-		archDesc := *desc
-		archDesc.Flags = archFlags
-		generate(arch.Name, &archDesc, consts[arch.Name], out)
-		writeSource(sysFile, out.Bytes())
-		logf(0, "")
+		archFlags[f] = archVals
 	}
 
-	generateExecutorSyscalls(desc.Syscalls, consts)
+	sysFile := archSourceFile(target, arch)
+	logf(1, "Generate code to init system call data in %v", sysFile)
+	out := new(bytes.Buffer)
+	archDesc := *desc
+	archDesc.Flags = archFlags
+	generate(target, arch, &archDesc, consts, out)
+	checkMissingConsts(target.Name + "/" + arch.Name)
+	missingConsts = nil
+	cache.update(sysFile, inputs, writeSource(sysFile, out.Bytes()))
+	logf(0, "")
 }
 
-func readConsts(arch string) map[string]uint64 {
-	constFiles, err := filepath.Glob("sys/*_" + arch + ".const")
+// archSourceFile returns the generated Go file for target/arch. Linux files are not
+// suffixed with the OS name, so that Linux descriptions are used on all other hosts.
+// Other files are suffixed with the build tag, so that Go does not restrict them to GOOS.
+func archSourceFile(target *Target, arch *Arch) string {
+	if arch.HostArch != "" {
+		// Compat arches are not Go arches, files are restricted to the host arch by the suffix.
+		return filepath.Join("sys", "sys_"+arch.Name+"_"+arch.HostArch+".go")
+	}
+	if target.Name == "linux" {
+		return filepath.Join("sys", "sys_"+arch.Name+".go")
+	}
+	return filepath.Join("sys", "sys_"+target.buildTag()+"_"+arch.Name+".go")
+}
+
+func constFiles(target *Target, arch string) []string {
+	files, err := filepath.Glob(filepath.Join(target.Dir, "*_"+arch+".const"))
 	if err != nil {
 		failf("failed to find const files: %v", err)
 	}
+	return files
+}
+
+func readConsts(target *Target, arch string) map[string]uint64 {
 	consts := make(map[string]uint64)
-	for _, fname := range constFiles {
+	for _, fname := range constFiles(target, arch) {
 		f, err := os.Open(fname)
 		if err != nil {
 			failf("failed to open const file: %v", err)
@@ -123,26 +249,63 @@ func readConsts(arch string) map[string]uint64 {
 			failf("failed to read const file: %v", err)
 		}
 	}
-	for name, nr := range syzkalls {
-		consts["__NR_"+name] = nr
-	}
 	return consts
 }
 
 var skipCurrentSyscall string
 
 func skipSyscall(why string) {
-	if skipCurrentSyscall != "" {
+	if skipCurrentSyscall == "" {
 		skipCurrentSyscall = why
 	}
 }
 
-func generate(arch string, desc *Description, consts map[string]uint64, out io.Writer) {
+func generate(target *Target, arch *Arch, desc *Description, consts map[string]uint64, out io.Writer) {
 	unsupported := make(map[string]bool)
 
-	fmt.Fprintf(out, "// AUTOGENERATED FILE\n")
+	fmt.Fprintf(out, "// AUTOGENERATED FILE\n\n")
+	if arch.HostArch != "" {
+		// The host arch is required by the file name.
+		fmt.Fprintf(out, "// +build %v\n\n", arch.Name)
+	} else if target.Name == "linux" {
+		var tags []string
+		for _, target1 := range targets {
+			if target1 != target {
+				tags = append(tags, "!"+target1.buildTag())
+			}
+		}
+		for _, arch1 := range target.Archs {
+			if arch1.HostArch != "" {
+				tags = append(tags, "!"+arch1.Name)
+			}
+		}
+		fmt.Fprintf(out, "// +build %v\n\n", strings.Join(tags, ","))
+	} else {
+		// Go does not know some OSes (fuchsia) and then looks only at the arch suffix
+		// of the file name, so the OS is also required with a build tag.
+		fmt.Fprintf(out, "// +build %v\n\n", target.buildTag())
+	}
 	fmt.Fprintf(out, "package sys\n\n")
 
+	fmt.Fprintf(out, "const (\n")
+	fmt.Fprintf(out, "OS = \"%v\"\n", target.Name)
+	fmt.Fprintf(out, "Arch = \"%v\"\n", arch.Name)
+	fmt.Fprintf(out, "ArchID = %v\n", arch.ID)
+	fmt.Fprintf(out, "PageSize = %v\n", arch.PageSize)
+	fmt.Fprintf(out, "NumPages = %v\n", arch.NumPages)
+	fmt.Fprintf(out, "DataOffset = %v\n", arch.DataOffset)
+	fmt.Fprintf(out, "PtrSize = %v\n", arch.PtrSize)
+	fmt.Fprintf(out, ")\n\n")
+
+	fmt.Fprintf(out, "var SpecialPointers = []uint64{")
+	for i, ptr := range arch.specialPointers(target) {
+		if i != 0 {
+			fmt.Fprintf(out, ", ")
+		}
+		fmt.Fprintf(out, "0x%x", ptr)
+	}
+	fmt.Fprintf(out, "}\n\n")
+
 	generateResources(desc, consts, out)
 	generateStructs(desc, consts, out)
 
@@ -158,6 +321,7 @@ func generate(arch string, desc *Description, consts map[string]uint64, out io.W
 				unsupported[s.CallName] = true
 				logf(0, "unsupported syscall: %v", s.CallName)
 			}
+			noteMissingConst("__NR_" + s.CallName)
 		}
 		fmt.Fprintf(out, "func() { Calls = append(Calls, &Call{Name: \"%v\", CallName: \"%v\"", s.Name, s.CallName)
 		if len(s.Ret) != 0 {
@@ -176,7 +340,21 @@ func generate(arch string, desc *Description, consts map[string]uint64, out io.W
 			logf(0, "unsupported syscall: %v due to %v", s.Name, skipCurrentSyscall)
 			syscallNR = -1
 		}
-		fmt.Fprintf(out, "}, NR: %v})}()\n", syscallNR)
+		fmt.Fprintf(out, "}, NR: %v", syscallNR)
+		if s.Timeout != 0 {
+			fmt.Fprintf(out, ", Timeout: %v", s.Timeout)
+		}
+		if len(s.Errnos) != 0 {
+			fmt.Fprintf(out, ", Errnos: []int{")
+			for i, e := range s.Errnos {
+				if i != 0 {
+					fmt.Fprintf(out, ", ")
+				}
+				fmt.Fprintf(out, "%v", e)
+			}
+			fmt.Fprintf(out, "}")
+		}
+		fmt.Fprintf(out, "})}()\n")
 	}
 	fmt.Fprintf(out, "}\n\n")
 
@@ -280,8 +458,12 @@ func generateStructEntry(str Struct, key structKey, out io.Writer) {
 	if str.Align != 0 {
 		align = fmt.Sprintf(", align: %v", str.Align)
 	}
-	fmt.Fprintf(out, "\"%v\": &%v{TypeCommon: TypeCommon{TypeName: \"%v\", ArgDir: %v, IsOptional: %v} %v %v %v},\n",
-		key, typ, name, fmtDir(key.dir), false, packed, align, varlen)
+	overlay := ""
+	if str.OutOverlay != 0 {
+		overlay = fmt.Sprintf(", OverlayField: %v", str.OutOverlay)
+	}
+	fmt.Fprintf(out, "\"%v\": &%v{TypeCommon: TypeCommon{TypeName: \"%v\", ArgDir: %v, IsOptional: %v} %v %v %v %v},\n",
+		key, typ, name, fmtDir(key.dir), false, packed, align, varlen, overlay)
 }
 
 func generateStructFields(str Struct, key structKey, desc *Description, consts map[string]uint64, out io.Writer) {
@@ -292,9 +474,17 @@ func generateStructFields(str Struct, key structKey, desc *Description, consts m
 		fields = "Options"
 	}
 	fmt.Fprintf(out, "func() { s := Structs[\"%v\"].(*%v)\n", key, typ)
-	for _, a := range str.Flds {
+	for i, a := range str.Flds {
+		dir := key.dir
+		if str.OutOverlay != 0 {
+			// Fields before the overlay are the input layout, the rest is the output layout.
+			dir = "in"
+			if i >= str.OutOverlay {
+				dir = "out"
+			}
+		}
 		fmt.Fprintf(out, "s.%v = append(s.%v, ", fields, fields)
-		generateArg(str.Name, a[0], a[1], key.dir, a[2:], desc, consts, false, true, out)
+		generateArg(str.Name, a[0], a[1], dir, a[2:], desc, consts, false, true, out)
 		fmt.Fprintf(out, ")\n")
 	}
 	fmt.Fprintf(out, "}()\n")
@@ -449,6 +639,27 @@ func generateArg(
 			}
 		}
 		fmt.Fprintf(out, "&BufferType{%v, Kind: BufferString, SubKind: %q, Values: %#v}", common(), subkind, vals)
+	case "fsopts":
+		if want := 1; len(a) != want {
+			failf("wrong number of arguments for %v arg %v, want %v, got %v", typ, name, want, len(a))
+		}
+		vals, ok := desc.StrFlags[a[0]]
+		if !ok {
+			failf("unknown string flags %v", a[0])
+		}
+		fmt.Fprintf(out, "&BufferType{%v, Kind: BufferOptions, SubKind: %q, Values: %#v}", common(), a[0], vals)
+	case "glob":
+		if want := 1; len(a) != want {
+			failf("wrong number of arguments for %v arg %v, want %v, got %v", typ, name, want, len(a))
+		}
+		if a[0][0] != '"' {
+			failf("glob pattern for arg %v must be a string in quotes, got %v", name, a[0])
+		}
+		pattern := a[0][1 : len(a[0])-1]
+		if len(pattern) >= globSize {
+			failf("glob pattern %q for arg %v is too long, max length is %v", pattern, name, globSize-1)
+		}
+		fmt.Fprintf(out, "&BufferType{%v, Kind: BufferGlob, Values: []string{%q}}", common(), pattern)
 	case "salg_type":
 		if want := 0; len(a) != want {
 			failf("wrong number of arguments for %v arg %v, want %v, got %v", typ, name, want, len(a))
@@ -534,6 +745,7 @@ func generateArg(
 			// Skip this syscall on this arch.
 			val = "0"
 			skipSyscall(fmt.Sprintf("missing const %v", a[0]))
+			noteMissingConst(a[0])
 		}
 		fmt.Fprintf(out, "&ConstType{%v, TypeSize: %v, BigEndian: %v, Val: uintptr(%v)}", common(), size, bigEndian, val)
 	case "proc":
@@ -556,23 +768,26 @@ func generateArg(
 			valuesStart = a[0]
 			valuesPerProc = a[1]
 		}
-		valuesStartInt, err := strconv.ParseInt(valuesStart, 10, 64)
+		valuesStartInt, err := strconv.ParseInt(valuesStart, 0, 64)
 		if err != nil {
 			failf("couldn't parse '%v' as int64", valuesStart)
 		}
-		valuesPerProcInt, err := strconv.ParseInt(valuesPerProc, 10, 64)
+		valuesPerProcInt, err := strconv.ParseInt(valuesPerProc, 0, 64)
 		if err != nil {
 			failf("couldn't parse '%v' as int64", valuesPerProc)
 		}
 		if valuesPerProcInt < 1 {
 			failf("values per proc '%v' should be >= 1", valuesPerProcInt)
 		}
-		if valuesStartInt >= (1 << (size * 8)) {
-			failf("values starting from '%v' overflow desired type of size '%v'", valuesStartInt, size)
-		}
-		const maxPids = 32 // executor knows about this constant (MAX_PIDS)
-		if valuesStartInt+maxPids*valuesPerProcInt >= (1 << (size * 8)) {
-			failf("not enough values starting from '%v' with step '%v' and type size '%v' for 32 procs", valuesStartInt, valuesPerProcInt, size)
+		// 1<<64 does not fit into int64, but all values fit into 8-byte types anyway.
+		if size < 8 {
+			if valuesStartInt >= (1 << (size * 8)) {
+				failf("values starting from '%v' overflow desired type of size '%v'", valuesStartInt, size)
+			}
+			const maxPids = 32 // executor knows about this constant (MAX_PIDS)
+			if valuesStartInt+maxPids*valuesPerProcInt >= (1 << (size * 8)) {
+				failf("not enough values starting from '%v' with step '%v' and type size '%v' for 32 procs", valuesStartInt, valuesPerProcInt, size)
+			}
 		}
 		fmt.Fprintf(out, "&ProcType{%v, TypeSize: %v, BigEndian: %v, ValuesStart: %v, ValuesPerProc: %v}", common(), size, bigEndian, valuesStartInt, valuesPerProcInt)
 	case "int8", "int16", "int32", "int64", "intptr", "int16be", "int32be", "int64be", "intptrbe":
@@ -587,6 +802,36 @@ func generateArg(
 		default:
 			failf("wrong number of arguments for %v arg %v, want 0 or 1, got %v", typ, name, len(a))
 		}
+	case "fmt":
+		if want := 2; len(a) != want {
+			failf("wrong number of arguments for %v arg %v, want %v, got %v", typ, name, want, len(a))
+		}
+		format := ""
+		switch a[0] {
+		case "dec":
+			format = "FormatStrDec"
+		case "hex":
+			format = "FormatStrHex"
+		case "oct":
+			format = "FormatStrOct"
+		default:
+			failf("unknown format %v for %v arg %v, want dec, hex or oct", a[0], typ, name)
+		}
+		typ1, a1 := a[1], []string(nil)
+		if inner, ok := desc.Unnamed[typ1]; ok {
+			typ1, a1 = inner[0], inner[1:]
+		}
+		switch typ1 {
+		case "int8", "int16", "int32", "int64", "intptr", "flags", "const", "proc":
+		default:
+			failf("bad %v arg %v underlying type %v, want an integer, flags, const or proc", typ, name, typ1)
+		}
+		buf := new(bytes.Buffer)
+		generateArg(parent, origName, typ1, dir, a1, desc, consts, false, true, buf)
+		if strings.Contains(buf.String(), "BigEndian: true") {
+			failf("%v arg %v can't have big-endian underlying type", typ, name)
+		}
+		fmt.Fprintf(out, "%v, Format: %v}", strings.TrimSuffix(buf.String(), "}"), format)
 	case "signalno":
 		canBeArg = true
 		if want := 0; len(a) != want {
@@ -608,7 +853,7 @@ func generateArg(
 		}
 		kind := ""
 		switch a[0] {
-		case "x86_real", "x86_16", "x86_32", "x86_64":
+		case "x86_real", "x86_16", "x86_32", "x86_64", "arm64", "bpf":
 			kind = "Text_" + a[0]
 		default:
 			failf("unknown text type %v for %v arg %v", a[0], typ, name)
@@ -727,22 +972,26 @@ func isIdentifier(s string) bool {
 	return true
 }
 
-func writeSource(file string, data []byte) {
+func writeSource(file string, data []byte) []byte {
 	src, err := format.Source(data)
 	if err != nil {
 		fmt.Printf("%s\n", data)
 		failf("failed to format output: %v", err)
 	}
 	writeFile(file, src)
+	return src
 }
 
+// writeFile writes data to file, unless file already has the same contents
+// (this preserves modification time and avoids needless rebuilds).
 func writeFile(file string, data []byte) {
-	outf, err := os.Create(file)
-	if err != nil {
-		failf("failed to create output file: %v", err)
+	if old, err := ioutil.ReadFile(file); err == nil && bytes.Equal(old, data) {
+		logf(1, "%v is unchanged", file)
+		return
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		failf("failed to write output file: %v", err)
 	}
-	defer outf.Close()
-	outf.Write(data)
 }
 
 type NameValue struct {
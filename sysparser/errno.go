@@ -0,0 +1,103 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Errnos maps names of errors that can be used in errno syscall attribute to their values.
+// Values are the generic Linux ones (asm-generic/errno-base.h and errno.h), they are the same
+// on all supported Linux arches. Descriptions of other OSes must use numeric values.
+var Errnos = map[string]uint64{
+	"EPERM":           1,
+	"ENOENT":          2,
+	"ESRCH":           3,
+	"EINTR":           4,
+	"EIO":             5,
+	"ENXIO":           6,
+	"E2BIG":           7,
+	"ENOEXEC":         8,
+	"EBADF":           9,
+	"ECHILD":          10,
+	"EAGAIN":          11,
+	"ENOMEM":          12,
+	"EACCES":          13,
+	"EFAULT":          14,
+	"ENOTBLK":         15,
+	"EBUSY":           16,
+	"EEXIST":          17,
+	"EXDEV":           18,
+	"ENODEV":          19,
+	"ENOTDIR":         20,
+	"EISDIR":          21,
+	"EINVAL":          22,
+	"ENFILE":          23,
+	"EMFILE":          24,
+	"ENOTTY":          25,
+	"ETXTBSY":         26,
+	"EFBIG":           27,
+	"ENOSPC":          28,
+	"ESPIPE":          29,
+	"EROFS":           30,
+	"EMLINK":          31,
+	"EPIPE":           32,
+	"EDOM":            33,
+	"ERANGE":          34,
+	"EDEADLK":         35,
+	"ENAMETOOLONG":    36,
+	"ENOLCK":          37,
+	"ENOSYS":          38,
+	"ENOTEMPTY":       39,
+	"ELOOP":           40,
+	"ENOMSG":          42,
+	"EIDRM":           43,
+	"ENODATA":         61,
+	"ETIME":           62,
+	"EOVERFLOW":       75,
+	"EBADFD":          77,
+	"EILSEQ":          84,
+	"ENOTSOCK":        88,
+	"EDESTADDRREQ":    89,
+	"EMSGSIZE":        90,
+	"EPROTOTYPE":      91,
+	"ENOPROTOOPT":     92,
+	"EPROTONOSUPPORT": 93,
+	"EOPNOTSUPP":      95,
+	"EAFNOSUPPORT":    97,
+	"EADDRINUSE":      98,
+	"EADDRNOTAVAIL":   99,
+	"ENETDOWN":        100,
+	"ENETUNREACH":     101,
+	"ECONNABORTED":    103,
+	"ECONNRESET":      104,
+	"ENOBUFS":         105,
+	"EISCONN":         106,
+	"ENOTCONN":        107,
+	"ETIMEDOUT":       110,
+	"ECONNREFUSED":    111,
+	"EALREADY":        114,
+	"EINPROGRESS":     115,
+	"ENOKEY":          126,
+}
+
+// ErrnoName returns name of the errno value (or the number if the name is unknown).
+func ErrnoName(v uint64) string {
+	for name, v1 := range Errnos {
+		if v1 == v {
+			return name
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// parseErrno parses an element of errno syscall attribute: an errno name or a positive number.
+func parseErrno(s string) (uint64, bool) {
+	if v, ok := Errnos[s]; ok {
+		return v, true
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	return v, err == nil && v != 0
+}
@@ -0,0 +1,29 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestErrnoAttr(t *testing.T) {
+	desc := Parse(strings.NewReader(`
+foo() (errno[ECHILD, 100])
+bar() (timeout[10], errno[EINVAL])
+baz()
+`))
+	want := map[string][]uint64{"foo": {10, 100}, "bar": {22}, "baz": nil}
+	for _, c := range desc.Syscalls {
+		if !reflect.DeepEqual(c.Errnos, want[c.Name]) {
+			t.Errorf("call %v: got errnos %v, want %v", c.Name, c.Errnos, want[c.Name])
+		}
+	}
+	for v, name := range map[uint64]string{22: "EINVAL", 38: "ENOSYS", 1000: "1000"} {
+		if got := ErrnoName(v); got != name {
+			t.Errorf("ErrnoName(%v) = %v, want %v", v, got, name)
+		}
+	}
+}
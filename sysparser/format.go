@@ -0,0 +1,323 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format returns description file data in canonical form:
+//   - tokens are separated by canonical spacing (e.g. "ptr[in, foo]");
+//   - struct fields are separated from their types and attributes by tabs;
+//   - flag values are deduplicated and sorted (numbers by value first, then names);
+//   - comments have a space after '#', runs of empty lines are collapsed.
+//
+// Formatting does not change meaning of descriptions and is idempotent.
+func Format(data []byte) ([]byte, error) {
+	out := new(bytes.Buffer)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 1<<20)
+	inStruct := false
+	empty := true // the previous line is empty (or there is no previous line)
+	for line := 1; s.Scan(); line++ {
+		ln := strings.TrimRight(s.Text(), " \t")
+		if ln == "" {
+			if !empty {
+				out.WriteByte('\n')
+			}
+			empty = true
+			continue
+		}
+		empty = false
+		// The parser recognizes comments only at the beginning of a line.
+		if trimmed := strings.TrimLeft(ln, " \t"); trimmed[0] == '#' {
+			ln = trimmed
+			if len(ln) > 1 && ln[1] != ' ' && ln[1] != '\t' {
+				ln = "# " + ln[1:]
+			}
+			fmt.Fprintf(out, "%v\n", ln)
+			continue
+		}
+		f, err := formatLine(ln, inStruct)
+		if err != nil {
+			return nil, fmt.Errorf("line #%v: %v: %v", line, err, ln)
+		}
+		fmt.Fprintf(out, "%v\n", f.text)
+		inStruct = f.inStruct
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	res := out.Bytes()
+	for bytes.HasSuffix(res, []byte("\n\n")) {
+		res = res[:len(res)-1]
+	}
+	return res, nil
+}
+
+type formattedLine struct {
+	text     string
+	inStruct bool // the following lines belong to a struct/union
+}
+
+func formatLine(ln string, inStruct bool) (formattedLine, error) {
+	trimmed := strings.TrimSpace(ln)
+	// Includes and defines contain C code that is not tokenized.
+	if !inStruct {
+		switch {
+		case strings.HasPrefix(trimmed, "include") && strings.HasPrefix(strings.TrimSpace(trimmed[7:]), "<"):
+			return formattedLine{text: "include " + strings.TrimSpace(trimmed[7:])}, nil
+		case strings.HasPrefix(trimmed, "define "), strings.HasPrefix(trimmed, "define\t"):
+			fields := strings.Fields(trimmed)
+			val := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(trimmed[6:]), fields[1]))
+			if val == "" {
+				return formattedLine{text: "define " + fields[1]}, nil
+			}
+			return formattedLine{text: fmt.Sprintf("define %v %v", fields[1], val)}, nil
+		}
+	}
+	toks, err := tokenize(trimmed)
+	if err != nil {
+		return formattedLine{}, err
+	}
+	f := &formatter{toks: toks}
+	var text string
+	if inStruct {
+		text, inStruct = f.structLine()
+	} else {
+		text, inStruct = f.topLevel()
+	}
+	if f.err == nil && f.pos != len(f.toks) {
+		f.failf("trailing data %q", strings.Join(f.toks[f.pos:], " "))
+	}
+	return formattedLine{text, inStruct}, f.err
+}
+
+// tokenize splits line into identifiers (as understood by the parser), strings and punctuation.
+func tokenize(ln string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(ln); {
+		ch := ln[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+		case ch == '"':
+			end := strings.IndexByte(ln[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, ln[i:i+end+2])
+			i += end + 2
+		case strings.IndexByte("()[]{},=", ch) != -1:
+			toks = append(toks, ln[i:i+1])
+			i++
+		case isIdentChar(ch):
+			start := i
+			for i < len(ln) && isIdentChar(ln[i]) {
+				i++
+			}
+			toks = append(toks, ln[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected character %q", ch)
+		}
+	}
+	return toks, nil
+}
+
+func isIdentChar(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' ||
+		ch == '_' || ch == '$' || ch == '-' || ch == ':'
+}
+
+type formatter struct {
+	toks []string
+	pos  int
+	err  error
+}
+
+func (f *formatter) failf(msg string, args ...interface{}) {
+	if f.err == nil {
+		f.err = fmt.Errorf(msg, args...)
+	}
+	f.pos = len(f.toks)
+}
+
+func (f *formatter) peek() string {
+	if f.pos == len(f.toks) {
+		return ""
+	}
+	return f.toks[f.pos]
+}
+
+func (f *formatter) next() string {
+	if f.pos == len(f.toks) {
+		f.failf("unexpected end of line")
+		return ""
+	}
+	f.pos++
+	return f.toks[f.pos-1]
+}
+
+func (f *formatter) expect(tok string) {
+	if got := f.next(); got != tok && f.err == nil {
+		f.failf("want %q, got %q", tok, got)
+	}
+}
+
+func (f *formatter) ident() string {
+	tok := f.next()
+	if tok != "" && !isIdentChar(tok[0]) && tok[0] != '"' {
+		f.failf("want identifier, got %q", tok)
+	}
+	return tok
+}
+
+// typ formats a type with optional arguments: name[arg, arg[arg]].
+func (f *formatter) typ() string {
+	name := f.ident()
+	if f.peek() != "[" {
+		return name
+	}
+	return name + f.list("[", "]", f.typ)
+}
+
+// list formats a possibly empty list of elements enclosed in open/close.
+func (f *formatter) list(open, close string, elem func() string) string {
+	f.expect(open)
+	var elems []string
+	for f.err == nil && f.peek() != close {
+		if len(elems) != 0 {
+			f.expect(",")
+		}
+		elems = append(elems, elem())
+	}
+	f.expect(close)
+	return open + strings.Join(elems, ", ") + close
+}
+
+func (f *formatter) topLevel() (string, bool) {
+	name := f.ident()
+	switch {
+	case name == "resource":
+		id := f.ident()
+		base := f.list("[", "]", f.ident)
+		text := fmt.Sprintf("resource %v%v", id, base)
+		if f.peek() == "" {
+			return text, false
+		}
+		// ':' is an identifier character, so it may be glued to the first value.
+		tok := f.next()
+		if tok[0] != ':' {
+			f.failf("want ':', got %q", tok)
+		}
+		var vals []string
+		if tok != ":" {
+			vals = append(vals, tok[1:])
+		} else {
+			vals = append(vals, f.ident())
+		}
+		for f.err == nil && f.peek() != "" {
+			f.expect(",")
+			vals = append(vals, f.ident())
+		}
+		return fmt.Sprintf("%v: %v", text, strings.Join(vals, ", ")), false
+	case name == "type" && f.peek() != "(" && f.peek() != "=":
+		id := f.ident()
+		params := f.list("[", "]", f.ident)
+		open := f.next()
+		if open != "{" && open != "[" {
+			f.failf("want '{' or '[', got %q", open)
+		}
+		return fmt.Sprintf("type %v%v %v", id, params, open), true
+	}
+	switch tok := f.next(); tok {
+	case "(":
+		f.pos--
+		args := f.list("(", ")", func() string {
+			return f.ident() + " " + f.typ()
+		})
+		text := name + args
+		if f.peek() != "" && f.peek() != "(" {
+			text += " " + f.typ()
+		}
+		if f.peek() == "(" {
+			text += " " + f.list("(", ")", f.typ)
+		}
+		return text, false
+	case "=":
+		var vals []string
+		for f.err == nil {
+			vals = append(vals, f.ident())
+			if f.peek() == "" {
+				break
+			}
+			f.expect(",")
+		}
+		return fmt.Sprintf("%v = %v", name, strings.Join(sortFlags(vals), ", ")), false
+	case "{", "[":
+		return fmt.Sprintf("%v %v", name, tok), true
+	default:
+		f.failf("unexpected %q", tok)
+		return "", false
+	}
+}
+
+func (f *formatter) structLine() (string, bool) {
+	if tok := f.peek(); tok == "}" || tok == "]" {
+		f.next()
+		if f.peek() == "" {
+			return tok, false
+		}
+		return tok + " " + f.list("[", "]", f.ident), false
+	}
+	text := "\t" + f.ident() + "\t" + f.typ()
+	if f.peek() == "(" {
+		text += "\t" + f.list("(", ")", f.ident)
+	}
+	return text, true
+}
+
+// sortFlags deduplicates and sorts flag values: numbers by value, then names and strings.
+func sortFlags(vals []string) []string {
+	dedup := make(map[string]bool)
+	var res []string
+	for _, v := range vals {
+		if !dedup[v] {
+			dedup[v] = true
+			res = append(res, v)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		negi, vi, iok := flagValue(res[i])
+		negj, vj, jok := flagValue(res[j])
+		switch {
+		case iok && jok:
+			if negi != negj {
+				return negi
+			}
+			return vi < vj
+		case iok != jok:
+			return iok
+		default:
+			return res[i] < res[j]
+		}
+	})
+	return res
+}
+
+// flagValue parses numeric flag value, negative values are returned in two's complement.
+func flagValue(v string) (neg bool, val uint64, ok bool) {
+	if u, err := strconv.ParseUint(v, 0, 64); err == nil {
+		return false, u, true
+	}
+	if i, err := strconv.ParseInt(v, 0, 64); err == nil {
+		return true, uint64(i), true
+	}
+	return false, 0, false
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	input := `
+
+#comment
+include   <linux/foo.h>
+define  FOO   (1 << 2)
+resource fd_foo[fd]:-1,  FOO
+  # indented comment
+foo$bar(fd   fd_foo,arg ptr[ in , array[ int8 , 4 ] ],len len[arg]) fd_foo
+foo$baz( ) (timeout[100])
+
+
+
+foo_flags = FOO_B, 0x10, FOO_A, 2, -1, FOO_A
+foo_names = "b", "a"
+
+foo_struct {
+  f0    int32 (out_overlay)
+	f1	foo_union
+} [packed,align_4]
+
+foo_union [
+	u0 int8
+	u1 array[int16,  2]
+]
+
+type foo_tmpl[A,B] {
+	f	A
+}
+`
+	want := `# comment
+include <linux/foo.h>
+define FOO (1 << 2)
+resource fd_foo[fd]: -1, FOO
+# indented comment
+foo$bar(fd fd_foo, arg ptr[in, array[int8, 4]], len len[arg]) fd_foo
+foo$baz() (timeout[100])
+
+foo_flags = -1, 2, 0x10, FOO_A, FOO_B
+foo_names = "a", "b"
+
+foo_struct {
+	f0	int32	(out_overlay)
+	f1	foo_union
+} [packed, align_4]
+
+foo_union [
+	u0	int8
+	u1	array[int16, 2]
+]
+
+type foo_tmpl[A, B] {
+	f	A
+}
+`
+	got, err := Format([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	got2, err := Format(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, got2) {
+		t.Fatalf("formatting is not idempotent:\n%s", got2)
+	}
+	for _, bad := range []string{
+		"foo(a int32",
+		"foo = A,",
+		"resource foo[fd] FOO",
+		"foo {\n\tf0 int32 %\n}",
+	} {
+		if _, err := Format([]byte(bad)); err == nil {
+			t.Errorf("formatted bad input %q", bad)
+		}
+	}
+}
+
+// TestFormatSys checks that formatting of the real descriptions is idempotent
+// and does not change their meaning.
+func TestFormatSys(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "sys", "*.txt"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("failed to find description files: %v", err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		formatted, err := Format(data)
+		if err != nil {
+			t.Fatalf("%v: %v", file, err)
+		}
+		formatted2, err := Format(formatted)
+		if err != nil {
+			t.Fatalf("%v: %v", file, err)
+		}
+		if !bytes.Equal(formatted, formatted2) {
+			t.Fatalf("%v: formatting is not idempotent", file)
+		}
+		if !reflect.DeepEqual(declTokens(t, data), declTokens(t, formatted)) {
+			t.Fatalf("%v: formatting changed declarations", file)
+		}
+		Parse(bytes.NewReader(formatted))
+	}
+}
+
+// declTokens returns tokens of all declarations (comments are skipped),
+// flag values are deduplicated and sorted.
+func declTokens(t *testing.T, data []byte) [][]string {
+	var decls [][]string
+	for _, ln := range strings.Split(string(data), "\n") {
+		ln = strings.TrimSpace(ln)
+		if ln == "" || ln[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(ln, "include") || strings.HasPrefix(ln, "define") {
+			decls = append(decls, strings.Fields(ln))
+			continue
+		}
+		toks, err := tokenize(ln)
+		if err != nil {
+			t.Fatalf("failed to tokenize %q: %v", ln, err)
+		}
+		if len(toks) > 2 && toks[1] == "=" {
+			vals := make(map[string]bool)
+			for _, v := range toks[2:] {
+				if v != "," {
+					vals[v] = true
+				}
+			}
+			toks = toks[:2]
+			for v := range vals {
+				toks = append(toks, v)
+			}
+			sort.Strings(toks[2:])
+		}
+		decls = append(decls, toks)
+	}
+	return decls
+}
@@ -28,6 +28,8 @@ type Syscall struct {
 	CallName string
 	Args     [][]string
 	Ret      []string
+	Timeout  uint64   // in ms, 0 means default
+	Errnos   []uint64 // errors the call is expected to fail with besides success (see Errnos)
 }
 
 type Struct struct {
@@ -37,6 +39,9 @@ type Struct struct {
 	Packed  bool
 	Varlen  bool
 	Align   int
+	// OutOverlay is index of the first field of the output layout of the struct
+	// (the field with out_overlay attribute), 0 if the struct has no overlay.
+	OutOverlay int
 }
 
 type Resource struct {
@@ -55,7 +60,9 @@ func Parse(in io.Reader) *Description {
 	flags := make(map[string][]string)
 	strflags := make(map[string][]string)
 	resources := make(map[string]Resource)
+	templates := make(map[string]template)
 	var str *Struct
+	var strParams []string // template parameters if str is a template
 	for p.Scan() {
 		if p.EOF() || p.Char() == '#' {
 			continue
@@ -95,6 +102,9 @@ func Parse(in io.Reader) *Description {
 						failf("union %v has only %v fields, need at least 2", str.Name, len(str.Flds))
 					}
 				}
+				if str.OutOverlay != 0 && str.Packed {
+					failf("struct %v with out_overlay field can't be packed", str.Name)
+				}
 				fields := make(map[string]bool)
 				for _, f := range str.Flds {
 					if f[0] == "parent" {
@@ -105,12 +115,39 @@ func Parse(in io.Reader) *Description {
 					}
 					fields[f[0]] = true
 				}
-				structs[str.Name] = *str
-				str = nil
+				if strParams != nil {
+					templates[str.Name] = template{*str, strParams}
+				} else {
+					structs[str.Name] = *str
+				}
+				str, strParams = nil, nil
 			} else {
 				p.SkipWs()
 				fld := []string{p.Ident()}
 				fld = append(fld, parseType(p, unnamed, flags)...)
+				if !p.EOF() && p.Char() == '(' {
+					// field attributes
+					p.Parse('(')
+					for {
+						switch attr := p.Ident(); {
+						case attr == "out_overlay" && !str.IsUnion:
+							if len(str.Flds) == 0 {
+								failf("struct %v: out_overlay can't be specified for the first field", str.Name)
+							}
+							if str.OutOverlay != 0 {
+								failf("struct %v has several out_overlay fields", str.Name)
+							}
+							str.OutOverlay = len(str.Flds)
+						default:
+							failf("unknown field %v.%v attribute: %v", str.Name, fld[0], attr)
+						}
+						if p.Char() == ')' {
+							break
+						}
+						p.Parse(',')
+					}
+					p.Parse(')')
+				}
 				str.Flds = append(str.Flds, fld)
 			}
 		} else {
@@ -162,6 +199,28 @@ func Parse(in io.Reader) *Description {
 					failf("struct '%v' is redefined as resource", name)
 				}
 				resources[id] = Resource{id, base, vals}
+			} else if name == "type" {
+				// struct/union template: type name[PARAM1, PARAM2] { ... }
+				p.SkipWs()
+				id := p.Ident()
+				p.Parse('[')
+				for {
+					strParams = append(strParams, p.Ident())
+					if p.Char() == ']' {
+						break
+					}
+					p.Parse(',')
+				}
+				p.Parse(']')
+				ch := p.Char()
+				if ch != '{' && ch != '[' {
+					failf("bad template %v definition, want '{' or '['", id)
+				}
+				p.Parse(ch)
+				if _, ok := templates[id]; ok {
+					failf("template '%v' is defined multiple times", id)
+				}
+				str = &Struct{Name: id, IsUnion: ch == '['}
 			} else {
 				switch ch := p.Char(); ch {
 				case '(':
@@ -178,9 +237,41 @@ func Parse(in io.Reader) *Description {
 					}
 					p.Parse(')')
 					var ret []string
-					if !p.EOF() {
+					if !p.EOF() && p.Char() != '(' {
 						ret = parseType(p, unnamed, flags)
 					}
+					var timeout uint64
+					var errnos []uint64
+					if !p.EOF() {
+						// syscall attributes
+						p.Parse('(')
+						for {
+							attr := parseType(p, unnamed, flags)
+							switch {
+							case attr[0] == "timeout" && len(attr) == 2:
+								v, err := strconv.ParseUint(attr[1], 10, 64)
+								if err != nil || v == 0 {
+									failf("bad syscall %v timeout %v", name, attr[1])
+								}
+								timeout = v
+							case attr[0] == "errno" && len(attr) >= 2:
+								for _, e := range attr[1:] {
+									v, ok := parseErrno(e)
+									if !ok {
+										failf("bad syscall %v errno %v", name, e)
+									}
+									errnos = append(errnos, v)
+								}
+							default:
+								failf("unknown syscall %v attribute: %v", name, attr)
+							}
+							if p.Char() == ')' {
+								break
+							}
+							p.Parse(',')
+						}
+						p.Parse(')')
+					}
 					callName := name
 					if idx := strings.IndexByte(callName, '$'); idx != -1 {
 						callName = callName[:idx]
@@ -192,7 +283,7 @@ func Parse(in io.Reader) *Description {
 						}
 						fields[a[0]] = true
 					}
-					syscalls = append(syscalls, Syscall{name, callName, args, ret})
+					syscalls = append(syscalls, Syscall{name, callName, args, ret, timeout, errnos})
 				case '=':
 					// flag
 					p.Parse('=')
@@ -232,6 +323,8 @@ func Parse(in io.Reader) *Description {
 			failf("trailing data (%v)", p.Str())
 		}
 	}
+	instantiateTemplates(templates, syscalls, structs, unnamed, flags)
+	desugarNetlink(syscalls, structs, unnamed)
 	sort.Sort(syscallArray(syscalls))
 	return &Description{
 		Includes:  includes,
@@ -284,8 +377,8 @@ func parseType1(p *parser, unnamed map[string][]string, flags map[string][]strin
 		}
 		p.Parse(']')
 	}
-	if name == "const" && len(typ) > 1 {
-		// Create a fake flag with the const value.
+	if (name == "const" || name == "nlmsg" || name == "nlattr") && len(typ) > 1 {
+		// Create a fake flag with the const value (message/attribute type for netlink).
 		id := fmt.Sprintf("const_flag_%v", constSeq)
 		constSeq++
 		flags[id] = typ[1:2]
@@ -0,0 +1,197 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Lint checks descriptions for things that are not errors per se,
+// but most likely indicate a bug in descriptions:
+//   - resources that are never produced or never consumed;
+//   - structs/unions and flags that are not referenced;
+//   - calls that require a resource that can't be produced.
+//
+// Returns a sorted list of warnings.
+func Lint(desc *Description) []string {
+	l := &linter{
+		desc:     desc,
+		produced: make(map[string]bool),
+		consumed: make(map[string]bool),
+		required: make(map[string]map[string]bool),
+		used:     make(map[string]bool),
+		visited:  make(map[string]bool),
+	}
+	for _, c := range desc.Syscalls {
+		l.call = c.Name
+		l.required[c.Name] = make(map[string]bool)
+		for _, arg := range c.Args {
+			l.walk(arg[1:], "in", false)
+		}
+		if len(c.Ret) != 0 {
+			l.walk(c.Ret, "out", true)
+		}
+	}
+	// Flags referenced only from unused structs are not reported separately.
+	for _, str := range desc.Structs {
+		for _, fld := range str.Flds {
+			l.markFlags(fld[1:])
+		}
+	}
+	for _, typ := range desc.Unnamed {
+		l.markFlags(typ)
+	}
+
+	var warnings []string
+	warn := func(msg string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(msg, args...))
+	}
+	for name := range desc.Resources {
+		if !l.resourceProduced(name) {
+			warn("resource %v is never produced", name)
+		}
+		if !l.resourceConsumed(name) {
+			warn("resource %v is never consumed", name)
+		}
+	}
+	for name := range desc.Structs {
+		if !l.used[name] {
+			warn("struct %v is unused", name)
+		}
+	}
+	for name := range desc.Flags {
+		if !l.used[name] && !strings.HasPrefix(name, "const_flag_") {
+			warn("flags %v are unused", name)
+		}
+	}
+	for name := range desc.StrFlags {
+		if !l.used[name] {
+			warn("string flags %v are unused", name)
+		}
+	}
+	for call, resources := range l.required {
+		for res := range resources {
+			if !l.resourceProduced(res) {
+				warn("call %v requires resource %v that is never produced", call, res)
+			}
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+type linter struct {
+	desc     *Description
+	call     string
+	produced map[string]bool
+	consumed map[string]bool
+	required map[string]map[string]bool // call -> resources that must be passed to the call
+	used     map[string]bool            // referenced structs and flags
+	visited  map[string]bool
+}
+
+// walk visits type typ used in direction dir. opt says if the object is optional
+// (e.g. behind an optional pointer, in a union or in a variable-length array).
+func (l *linter) walk(typ []string, dir string, opt bool) {
+	name := typ[0]
+	for _, a := range typ[1:] {
+		if a == "opt" {
+			opt = true
+		}
+	}
+	if inner, ok := l.desc.Unnamed[name]; ok {
+		l.walk(inner, dir, opt)
+		return
+	}
+	if _, ok := l.desc.Resources[name]; ok {
+		if dir != "in" {
+			l.produced[name] = true
+		}
+		if dir != "out" {
+			l.consumed[name] = true
+			if !opt {
+				l.required[l.call][name] = true
+			}
+		}
+		return
+	}
+	if str, ok := l.desc.Structs[name]; ok {
+		l.used[name] = true
+		key := fmt.Sprintf("%v/%v/%v/%v", l.call, name, dir, opt)
+		if l.visited[key] {
+			return
+		}
+		l.visited[key] = true
+		for _, fld := range str.Flds {
+			l.walk(fld[1:], dir, opt || str.IsUnion)
+		}
+		return
+	}
+	switch name {
+	case "ptr":
+		if len(typ) > 2 {
+			l.walk(typ[2:3], typ[1], opt)
+		}
+		return
+	case "array":
+		if len(typ) > 1 {
+			l.walk(typ[1:2], dir, opt || len(typ) == 2 || strings.HasPrefix(typ[2], "0"))
+		}
+		return
+	}
+	for _, a := range typ[1:] {
+		if _, ok := l.desc.Flags[a]; ok {
+			l.used[a] = true
+		}
+		if _, ok := l.desc.StrFlags[a]; ok {
+			l.used[a] = true
+		}
+		if _, ok := l.desc.Unnamed[a]; ok {
+			l.walk([]string{a}, dir, opt)
+		}
+	}
+}
+
+func (l *linter) markFlags(typ []string) {
+	for _, a := range typ[1:] {
+		if _, ok := l.desc.Flags[a]; ok {
+			l.used[a] = true
+		}
+		if _, ok := l.desc.StrFlags[a]; ok {
+			l.used[a] = true
+		}
+	}
+}
+
+// resourceProduced returns true if res or any of its subtypes is produced by some call.
+func (l *linter) resourceProduced(res string) bool {
+	for name := range l.desc.Resources {
+		if l.produced[name] && l.isSubtype(name, res) {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceConsumed returns true if res or any of its base types is consumed by some call.
+func (l *linter) resourceConsumed(res string) bool {
+	for name := range l.desc.Resources {
+		if l.consumed[name] && l.isSubtype(res, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *linter) isSubtype(sub, base string) bool {
+	for seen := 0; sub != "" && seen <= len(l.desc.Resources); seen++ {
+		if sub == base {
+			return true
+		}
+		sub = l.desc.Resources[sub].Base
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	desc := Parse(strings.NewReader(`
+resource fd[int32]
+resource sock[fd]
+resource nonprod[fd]
+resource noncons[int32]
+
+open(file ptr[in, string[names]]) fd
+socket(dom flags[domains]) sock
+close(fd fd)
+foo(fd nonprod, arg ptr[in, used_struct])
+bar(arg ptr[out, out_struct], opt ptr[in, nonprod, opt])
+
+used_struct {
+	f0	int32
+}
+
+out_struct {
+	r	noncons
+}
+
+unused_struct {
+	f0	flags[unused_flags, int32]
+}
+
+names = "foo", "bar"
+unused_names = "baz"
+domains = 1, 2
+unused_flags = 1, 2
+dead_flags = 3
+`))
+	want := []string{
+		"call foo requires resource nonprod that is never produced",
+		"flags dead_flags are unused",
+		"resource noncons is never consumed",
+		"resource nonprod is never produced",
+		"string flags unused_names are unused",
+		"struct unused_struct is unused",
+	}
+	got := Lint(desc)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got warnings:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// desugarNetlink replaces nlmsg[type, payload] and nlattr[type, payload] types
+// with automatically generated structs that consist of netlink message/attribute
+// header followed by the payload. Length fields in the headers are described
+// as len[parent], so they are filled in by the size assignment pass.
+// Attributes are padded to 4 bytes, but nla_len does not include the padding,
+// so the header and payload go into a packed struct wrapped into an aligned one.
+func desugarNetlink(syscalls []Syscall, structs map[string]Struct, unnamed map[string][]string) {
+	// Generated structs contain payloads that need desugaring as well,
+	// so structs are processed as a worklist rather than by ranging over the map
+	// (keys inserted during iteration may or may not be visited).
+	var queue []string
+	for name := range structs {
+		queue = append(queue, name)
+	}
+	sort.Strings(queue)
+	generated := make(map[string]string) // type string -> struct name
+	var desugar func(typ []string) []string
+	desugar = func(typ []string) []string {
+		if len(typ) == 0 || typ[0] != "nlmsg" && typ[0] != "nlattr" {
+			return typ
+		}
+		kind := typ[0]
+		if len(typ) != 2 && len(typ) != 3 {
+			failf("wrong number of arguments for %v, want 1 or 2, got %v", kind, len(typ)-1)
+		}
+		key := typeString(typ, unnamed)
+		if name := generated[key]; name != "" {
+			return []string{name}
+		}
+		name := fmt.Sprintf("%v_%v", kind, typ[1])
+		for i := 1; structs[name].Name != "" || structs[name+"_unpadded"].Name != ""; i++ {
+			name = fmt.Sprintf("%v_%v_%v", kind, typ[1], i)
+		}
+		generated[key] = name
+		var flds [][]string
+		switch kind {
+		case "nlmsg":
+			flds = [][]string{
+				{"len", "len", "parent", "int32"},
+				{"type", "const", typ[1], "int16"},
+				{"flags", "flags", "netlink_msg_flags", "int16"},
+				{"seq", "int32"},
+				{"pid", "int32"},
+			}
+		case "nlattr":
+			flds = [][]string{
+				{"nla_len", "len", "parent", "int16"},
+				{"nla_type", "const", typ[1], "int16"},
+			}
+		}
+		if len(typ) == 3 {
+			flds = append(flds, []string{"payload", typ[2]})
+		}
+		if kind == "nlattr" {
+			inner := name + "_unpadded"
+			structs[inner] = Struct{Name: inner, Flds: flds, Packed: true}
+			flds = [][]string{{"attr", inner}}
+			queue = append(queue, inner)
+		} else {
+			queue = append(queue, name)
+		}
+		structs[name] = Struct{Name: name, Flds: flds, Align: 4}
+		return []string{name}
+	}
+	for i := range syscalls {
+		for j, arg := range syscalls[i].Args {
+			syscalls[i].Args[j] = append(arg[:1:1], desugar(arg[1:])...)
+		}
+		syscalls[i].Ret = desugar(syscalls[i].Ret)
+	}
+	for id, typ := range unnamed {
+		unnamed[id] = desugar(typ)
+	}
+	for len(queue) != 0 {
+		str := structs[queue[0]]
+		queue = queue[1:]
+		for i, fld := range str.Flds {
+			str.Flds[i] = append(fld[:1:1], desugar(fld[1:])...)
+		}
+	}
+}
+
+// typeString returns textual representation of typ with all unnamed types expanded.
+func typeString(typ []string, unnamed map[string][]string) string {
+	var args []string
+	for _, a := range typ[1:] {
+		if inner, ok := unnamed[a]; ok {
+			a = typeString(inner, unnamed)
+		}
+		args = append(args, a)
+	}
+	if len(args) == 0 {
+		return typ[0]
+	}
+	return fmt.Sprintf("%v[%v]", typ[0], strings.Join(args, ", "))
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDesugarNetlink(t *testing.T) {
+	desc := Parse(strings.NewReader(`
+sendmsg(msg ptr[in, nlmsg[MSG_TYPE, msg_payload]])
+
+msg_payload {
+	hdr	int32
+	attrs	array[msg_attrs]
+}
+
+msg_attrs [
+	val	nlattr[ATTR_VAL, int16]
+	nested	nlattr[ATTR_NESTED, array[nested_attrs]]
+] [varlen]
+
+nested_attrs [
+	inner	nlattr[ATTR_INNER, int32]
+	empty	nlattr[ATTR_EMPTY]
+] [varlen]
+`))
+	want := map[string]Struct{
+		"nlmsg_MSG_TYPE": {Name: "nlmsg_MSG_TYPE", Align: 4, Flds: [][]string{
+			{"len", "len", "parent", "int32"},
+			{"type", "const", "MSG_TYPE", "int16"},
+			{"flags", "flags", "netlink_msg_flags", "int16"},
+			{"seq", "int32"},
+			{"pid", "int32"},
+			{"payload", "msg_payload"},
+		}},
+		"nlattr_ATTR_VAL": {Name: "nlattr_ATTR_VAL", Align: 4, Flds: [][]string{
+			{"attr", "nlattr_ATTR_VAL_unpadded"},
+		}},
+		"nlattr_ATTR_VAL_unpadded": {Name: "nlattr_ATTR_VAL_unpadded", Packed: true, Flds: [][]string{
+			{"nla_len", "len", "parent", "int16"},
+			{"nla_type", "const", "ATTR_VAL", "int16"},
+			{"payload", "int16"},
+		}},
+		"nlattr_ATTR_EMPTY_unpadded": {Name: "nlattr_ATTR_EMPTY_unpadded", Packed: true, Flds: [][]string{
+			{"nla_len", "len", "parent", "int16"},
+			{"nla_type", "const", "ATTR_EMPTY", "int16"},
+		}},
+	}
+	for name, str := range want {
+		if got := desc.Structs[name]; !reflect.DeepEqual(got, str) {
+			t.Errorf("struct %v:\ngot:  %+v\nwant: %+v", name, got, str)
+		}
+	}
+	// Attributes nested into payloads of generated structs are desugared as well.
+	for _, name := range []string{"nlattr_ATTR_NESTED", "nlattr_ATTR_INNER", "nlattr_ATTR_EMPTY"} {
+		if desc.Structs[name].Name == "" {
+			t.Errorf("struct %v is not generated", name)
+		}
+	}
+	for name, str := range desc.Structs {
+		for _, fld := range str.Flds {
+			if fld[1] == "nlmsg" || fld[1] == "nlattr" {
+				t.Errorf("struct %v field %v is not desugared", name, fld[0])
+			}
+		}
+	}
+	for _, typ := range desc.Unnamed {
+		if typ[0] == "nlmsg" || typ[0] == "nlattr" {
+			t.Errorf("unnamed type %v is not desugared", typ)
+		}
+	}
+	// Message and attribute types are registered for const extraction.
+	consts := make(map[string]bool)
+	for _, vals := range desc.Flags {
+		for _, v := range vals {
+			consts[v] = true
+		}
+	}
+	for _, c := range []string{"MSG_TYPE", "ATTR_VAL", "ATTR_NESTED", "ATTR_INNER", "ATTR_EMPTY"} {
+		if !consts[c] {
+			t.Errorf("const %v is not registered", c)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package sysparser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// template is a parametric struct/union definition:
+//
+//	type msghdr_t[PAYLOAD] {
+//		vec	ptr[in, PAYLOAD]
+//	}
+//
+// Each use of the template with particular arguments (e.g. msghdr_t[rtnl_msg])
+// is replaced with a reference to a new struct where all parameters are substituted.
+type template struct {
+	Struct
+	params []string
+}
+
+// instantiateTemplates replaces all uses of templates with instantiated structs.
+func instantiateTemplates(templates map[string]template, syscalls []Syscall, structs map[string]Struct, unnamed, flags map[string][]string) {
+	if len(templates) == 0 {
+		return
+	}
+	// Unnamed types used in template bodies can refer to template parameters,
+	// so move them out of the global map and copy on every instantiation.
+	tmplUnnamed := make(map[string][]string)
+	var moveUnnamed func(typ []string)
+	moveUnnamed = func(typ []string) {
+		for _, t := range typ {
+			if inner, ok := unnamed[t]; ok {
+				tmplUnnamed[t] = inner
+				delete(unnamed, t)
+				moveUnnamed(inner)
+			}
+		}
+	}
+	params := make(map[string]bool)
+	for name, tmpl := range templates {
+		if _, ok := structs[name]; ok {
+			failf("template '%v' is redefined as struct", name)
+		}
+		for _, param := range tmpl.params {
+			params[param] = true
+		}
+		for _, fld := range tmpl.Flds {
+			moveUnnamed(fld[1:])
+		}
+	}
+	// Parser registered params used as const values in template bodies as fake flags,
+	// these are not real consts. Instantiated structs register actual values below.
+	for id, vals := range flags {
+		if strings.HasPrefix(id, "const_flag_") && len(vals) == 1 && params[vals[0]] {
+			delete(flags, id)
+		}
+	}
+	instances := make(map[string]string) // type string -> struct name
+	instantiate := func(typ []string) []string {
+		tmpl, ok := templates[typ[0]]
+		if !ok {
+			return typ
+		}
+		if len(typ)-1 != len(tmpl.params) {
+			failf("wrong number of arguments for template %v, want %v, got %v", typ[0], len(tmpl.params), len(typ)-1)
+		}
+		key := typeString(typ, unnamed)
+		if name := instances[key]; name != "" {
+			return []string{name}
+		}
+		name := mangleTemplateName(key)
+		for i := 1; structs[name].Name != ""; i++ {
+			name = fmt.Sprintf("%v_%v", mangleTemplateName(key), i)
+		}
+		instances[key] = name
+		args := make(map[string]string)
+		for i, param := range tmpl.params {
+			args[param] = typ[i+1]
+		}
+		str := tmpl.Struct
+		str.Name = name
+		str.Flds = nil
+		for _, fld := range tmpl.Flds {
+			fld1 := append([]string{fld[0]}, substituteTemplateArgs(fld[1:], args, tmplUnnamed, unnamed, flags)...)
+			str.Flds = append(str.Flds, fld1)
+		}
+		structs[name] = str
+		return []string{name}
+	}
+	// Instantiated structs can refer to other templates, so iterate until fixed point.
+	for changed := true; changed; {
+		changed = false
+		update := func(typ []string) []string {
+			if len(typ) == 0 {
+				return typ
+			}
+			typ1 := instantiate(typ)
+			if typ1[0] != typ[0] {
+				changed = true
+			}
+			return typ1
+		}
+		for i := range syscalls {
+			for j, arg := range syscalls[i].Args {
+				syscalls[i].Args[j] = append(arg[:1:1], update(arg[1:])...)
+			}
+			syscalls[i].Ret = update(syscalls[i].Ret)
+		}
+		for id, typ := range unnamed {
+			unnamed[id] = update(typ)
+		}
+		for _, str := range structs {
+			for i, fld := range str.Flds {
+				str.Flds[i] = append(fld[:1:1], update(fld[1:])...)
+			}
+		}
+	}
+}
+
+// substituteTemplateArgs returns a copy of template body type typ with all template
+// parameters replaced with arguments. Unnamed types from the template body are copied
+// into the global unnamed map under new names.
+func substituteTemplateArgs(typ []string, args map[string]string, tmplUnnamed, unnamed, flags map[string][]string) []string {
+	var res []string
+	for _, t := range typ {
+		if arg, ok := args[t]; ok {
+			t = arg
+		} else if inner, ok := tmplUnnamed[t]; ok {
+			t = fmt.Sprintf("unnamed%v", unnamedSeq)
+			unnamedSeq++
+			unnamed[t] = substituteTemplateArgs(inner, args, tmplUnnamed, unnamed, flags)
+		}
+		res = append(res, t)
+	}
+	// Register fake const flags for substituted values the same way parseType1 does.
+	if len(typ) > 1 && (typ[0] == "const" || typ[0] == "nlmsg" || typ[0] == "nlattr") && args[typ[1]] != "" ||
+		len(typ) > 2 && typ[0] == "array" && args[typ[2]] != "" {
+		val := res[1]
+		if typ[0] == "array" {
+			val = res[2]
+		}
+		flags[fmt.Sprintf("const_flag_%v", constSeq)] = []string{val}
+		constSeq++
+	}
+	return res
+}
+
+// mangleTemplateName turns template instantiation (e.g. "msghdr_t[ptr[in, foo]]")
+// into an identifier (e.g. "msghdr_t_ptr_in_foo").
+func mangleTemplateName(s string) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			buf = append(buf, c)
+		} else if len(buf) != 0 && buf[len(buf)-1] != '_' {
+			buf = append(buf, '_')
+		}
+	}
+	return strings.TrimRight(string(buf), "_")
+}
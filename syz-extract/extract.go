@@ -18,8 +18,8 @@ import (
 
 var (
 	flagLinux    = flag.String("linux", "", "path to linux kernel source checkout")
-	flagLinuxBld = flag.String("linuxbld", "", "path to linux kernel build directory")
-	flagArch     = flag.String("arch", "", "arch to generate")
+	flagLinuxBld = flag.String("linuxbld", "", "path to linux kernel build directory, or arch=dir,... for several archs")
+	flagArch     = flag.String("arch", "", "comma-separated list of archs to generate")
 	flagV        = flag.Int("v", 0, "verbosity")
 )
 
@@ -34,6 +34,8 @@ var archs = map[string]*Arch{
 	"amd64":   {[]string{"__x86_64__"}, "x86", "asm/unistd.h", []string{"-m64"}},
 	"arm64":   {[]string{"__aarch64__"}, "arm64", "asm/unistd.h", []string{}},
 	"ppc64le": {[]string{"__ppc64__", "__PPC64__", "__powerpc64__"}, "powerpc", "asm/unistd.h", []string{"-D__powerpc64__"}},
+	"riscv64": {[]string{"__riscv"}, "riscv", "asm/unistd.h", []string{"-D__riscv", "-D__riscv_xlen=64"}},
+	"i386":    {[]string{"__i386__"}, "x86", "asm/unistd.h", []string{"-m32"}},
 }
 
 func main() {
@@ -41,37 +43,73 @@ func main() {
 	if *flagLinux == "" {
 		failf("provide path to linux kernel checkout via -linux flag (or make extract LINUX= flag)")
 	}
-	if *flagLinuxBld == "" {
-		logf(1, "No kernel build directory provided, assuming in-place build")
-		*flagLinuxBld = *flagLinux
-	}
 	if *flagArch == "" {
 		failf("-arch flag is required")
 	}
-	if archs[*flagArch] == nil {
-		failf("unknown arch %v", *flagArch)
+	archNames := strings.Split(*flagArch, ",")
+	for _, arch := range archNames {
+		if archs[arch] == nil {
+			failf("unknown arch %v", arch)
+		}
 	}
-	if len(flag.Args()) != 1 {
-		failf("usage: syz-extract -linux=/linux/checkout -arch=arch sys/input_file.txt")
+	builds := parseBuilds(archNames, *flagLinuxBld)
+	if len(flag.Args()) == 0 {
+		failf("usage: syz-extract -linux=/linux/checkout -arch=arch1,arch2 -linuxbld=arch1=/build1,arch2=/build2 sys/input_file1.txt sys/input_file2.txt")
+	}
+
+	for _, inname := range flag.Args() {
+		desc := parseFile(inname)
+		for _, arch := range archNames {
+			logf(0, "extracting %v for %v", inname, arch)
+			outname := strings.TrimSuffix(inname, ".txt") + "_" + arch + ".const"
+			consts := compileConsts(archs[arch], builds[arch], desc)
+			out := new(bytes.Buffer)
+			generateConsts(arch, consts, out)
+			if err := ioutil.WriteFile(outname, out.Bytes(), 0660); err != nil {
+				failf("failed to write output file: %v", err)
+			}
+		}
 	}
+}
 
-	inname := flag.Args()[0]
-	outname := strings.TrimSuffix(inname, ".txt") + "_" + *flagArch + ".const"
+// parseBuilds returns kernel build directory for every arch.
+// Generated headers of a build directory are specific to the arch it's configured for,
+// so several archs require a build directory each: -linuxbld=arch1=dir1,arch2=dir2.
+func parseBuilds(archNames []string, linuxBld string) map[string]string {
+	builds := make(map[string]string)
+	if !strings.Contains(linuxBld, "=") {
+		if len(archNames) != 1 {
+			failf("several archs require a build directory each: -linuxbld=arch1=dir1,arch2=dir2")
+		}
+		if linuxBld == "" {
+			logf(1, "No kernel build directory provided, assuming in-place build")
+			linuxBld = *flagLinux
+		}
+		builds[archNames[0]] = linuxBld
+		return builds
+	}
+	for _, build := range strings.Split(linuxBld, ",") {
+		eq := strings.IndexByte(build, '=')
+		if eq == -1 || archs[build[:eq]] == nil || build[eq+1:] == "" {
+			failf("bad -linuxbld entry %q, want arch=dir", build)
+		}
+		builds[build[:eq]] = build[eq+1:]
+	}
+	for _, arch := range archNames {
+		if builds[arch] == "" {
+			failf("no build directory for arch %v in -linuxbld", arch)
+		}
+	}
+	return builds
+}
 
+func parseFile(inname string) *Description {
 	inf, err := os.Open(inname)
 	if err != nil {
 		failf("failed to open input file: %v", err)
 	}
 	defer inf.Close()
-
-	desc := Parse(inf)
-	consts := compileConsts(archs[*flagArch], desc)
-
-	out := new(bytes.Buffer)
-	generateConsts(*flagArch, consts, out)
-	if err := ioutil.WriteFile(outname, out.Bytes(), 0660); err != nil {
-		failf("failed to write output file: %v", err)
-	}
+	return Parse(inf)
 }
 
 func generateConsts(arch string, consts map[string]uint64, out io.Writer) {
@@ -87,7 +125,7 @@ func generateConsts(arch string, consts map[string]uint64, out io.Writer) {
 	}
 }
 
-func compileConsts(arch *Arch, desc *Description) map[string]uint64 {
+func compileConsts(arch *Arch, build string, desc *Description) map[string]uint64 {
 	vals := make(map[string]bool)
 	for _, fvals := range desc.Flags {
 		for _, v := range fvals {
@@ -121,7 +159,7 @@ func compileConsts(arch *Arch, desc *Description) map[string]uint64 {
 		return nil
 	}
 
-	consts, err := fetchValues(arch.KernelHeaderArch, valArr, append(desc.Includes, arch.KernelInclude), desc.Defines, arch.CFlags)
+	consts, err := fetchValues(arch.KernelHeaderArch, build, valArr, append(desc.Includes, arch.KernelInclude), desc.Defines, arch.CFlags)
 	if err != nil {
 		failf("%v", err)
 	}
@@ -16,8 +16,8 @@ import (
 // fetchValues converts literal constants (e.g. O_APPEND) or any other C expressions
 // into their respective numeric values. It does so by builting and executing a C program
 // that prints values of the provided expressions.
-func fetchValues(arch string, vals []string, includes []string, defines map[string]string, cflags []string) (map[string]uint64, error) {
-	bin, out, err := runCompiler(arch, nil, includes, nil, cflags, nil)
+func fetchValues(arch, build string, vals []string, includes []string, defines map[string]string, cflags []string) (map[string]uint64, error) {
+	bin, out, err := runCompiler(arch, build, nil, includes, nil, cflags, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run gcc: %v\n%v", err, string(out))
 	}
@@ -29,7 +29,7 @@ func fetchValues(arch string, vals []string, includes []string, defines map[stri
 	}
 
 	undeclared := make(map[string]bool)
-	bin, out, err = runCompiler(arch, vals, includes, defines, cflags, undeclared)
+	bin, out, err = runCompiler(arch, build, vals, includes, defines, cflags, undeclared)
 	if err != nil {
 		for _, errMsg := range []string{
 			"error: ‘([a-zA-Z0-9_]+)’ undeclared",
@@ -45,7 +45,7 @@ func fetchValues(arch string, vals []string, includes []string, defines map[stri
 				}
 			}
 		}
-		bin, out, err = runCompiler(arch, vals, includes, defines, cflags, undeclared)
+		bin, out, err = runCompiler(arch, build, vals, includes, defines, cflags, undeclared)
 		if err != nil {
 			return nil, fmt.Errorf("failed to run gcc: %v\n%v", err, string(out))
 		}
@@ -79,7 +79,7 @@ func fetchValues(arch string, vals []string, includes []string, defines map[stri
 	return res, nil
 }
 
-func runCompiler(arch string, vals []string, includes []string, defines map[string]string, cflags []string, undeclared map[string]bool) (bin string, out []byte, err error) {
+func runCompiler(arch, build string, vals []string, includes []string, defines map[string]string, cflags []string, undeclared map[string]bool) (bin string, out []byte, err error) {
 	includeText := ""
 	for _, inc := range includes {
 		includeText += fmt.Sprintf("#include <%v>\n", inc)
@@ -119,14 +119,14 @@ func runCompiler(arch string, vals []string, includes []string, defines map[stri
 		"-D__KERNEL__",
 		"-DKBUILD_MODNAME=\"-\"",
 		"-I" + *flagLinux + "/arch/" + arch + "/include",
-		"-I" + *flagLinuxBld + "/arch/" + arch + "/include/generated/uapi",
-		"-I" + *flagLinuxBld + "/arch/" + arch + "/include/generated",
-		"-I" + *flagLinuxBld + "/include",
+		"-I" + build + "/arch/" + arch + "/include/generated/uapi",
+		"-I" + build + "/arch/" + arch + "/include/generated",
+		"-I" + build + "/include",
 		"-I" + *flagLinux + "/include",
 		"-I" + *flagLinux + "/arch/" + arch + "/include/uapi",
-		"-I" + *flagLinuxBld + "/arch/" + arch + "/include/generated/uapi",
+		"-I" + build + "/arch/" + arch + "/include/generated/uapi",
 		"-I" + *flagLinux + "/include/uapi",
-		"-I" + *flagLinuxBld + "/include/generated/uapi",
+		"-I" + build + "/include/generated/uapi",
 		"-I" + *flagLinux,
 		"-include", *flagLinux + "/include/linux/kconfig.h",
 	}...)
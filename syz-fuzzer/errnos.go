@@ -0,0 +1,51 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/google/syzkaller/ipc"
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/sys"
+)
+
+// Results of executed calls are aggregated per call and sent to manager with polls,
+// manager reports calls that always fail with errors that their descriptions
+// don't expect (see errno syscall attribute).
+var (
+	errnoMu    sync.Mutex
+	errnoStats = make(map[int]map[int]uint64) // call ID -> errno (0 for success) -> number of executions
+)
+
+// noteErrnos records results of calls of executed program p.
+// Calls that were not executed or were blocked, and calls with injected faults are not counted.
+func noteErrnos(p *prog.Prog, errnos []int) {
+	errnoMu.Lock()
+	defer errnoMu.Unlock()
+	for i, errno := range errnos {
+		if errno == ipc.ErrnoNotExecuted || errno == ipc.ErrnoBlocked || p.Calls[i].FailNth != 0 {
+			continue
+		}
+		call := p.Calls[i].Meta.ID
+		stats := errnoStats[call]
+		if stats == nil {
+			stats = make(map[int]uint64)
+			errnoStats[call] = stats
+		}
+		stats[errno]++
+	}
+}
+
+// takeErrnos returns results of calls recorded since the previous call in the PollArgs.Errnos format.
+func takeErrnos() map[string]map[int]uint64 {
+	errnoMu.Lock()
+	defer errnoMu.Unlock()
+	res := make(map[string]map[int]uint64, len(errnoStats))
+	for call, stats := range errnoStats {
+		res[sys.Calls[call].Name] = stats
+	}
+	errnoStats = make(map[int]map[int]uint64)
+	return res
+}
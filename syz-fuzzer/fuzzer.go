@@ -3,21 +3,20 @@
 
 package main
 
-// TODO: implement some form of smashing of new inputs.
-// E.g. alter arguments while the program still gives the new coverage,
-// i.e. aim at cracking new branches and triggering bugs in that new piece of code.
-
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"net/rpc"
-	"net/rpc/jsonrpc"
 	"os"
-	"os/signal"
+	ossignal "os/signal"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,20 +30,54 @@ import (
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/prog"
 	. "github.com/google/syzkaller/rpctype"
+	"github.com/google/syzkaller/signal"
 	"github.com/google/syzkaller/sys"
 )
 
 var (
-	flagName     = flag.String("name", "", "unique name for manager")
-	flagExecutor = flag.String("executor", "", "path to executor binary")
-	flagManager  = flag.String("manager", "", "manager rpc address")
-	flagProcs    = flag.Int("procs", 1, "number of parallel test processes")
-	flagLeak     = flag.Bool("leak", false, "detect memory leaks")
-	flagOutput   = flag.String("output", "stdout", "write programs to none/stdout/dmesg/file")
+	flagName        = flag.String("name", "", "unique name for manager")
+	flagExecutor    = flag.String("executor", "", "path to executor binary")
+	flagManager     = flag.String("manager", "", "manager rpc address")
+	flagProcs       = flag.Int("procs", 1, "number of parallel test processes")
+	flagLeak        = flag.Bool("leak", false, "detect memory leaks")
+	flagLeakPeriod  = flag.Duration("leak_period", 0, "min period between memory leak scans (0 - scan after every batch of programs)")
+	flagFaultCorpus = flag.Bool("fault_corpus", false, "systematically inject faults into calls of corpus programs")
+	flagRecheck     = flag.Bool("recheck_corpus", false, "periodically re-execute corpus programs and down-weight programs with unstable coverage")
+	flagProvenance  = flag.Bool("provenance", false, "annotate calls of mutated programs in the log with args changed since the seed")
+	flagRotate      = flag.Duration("rotate", 0, "period of rotation of per-proc random subsets of enabled syscalls (0 - no rotation)")
+	flagOutput      = flag.String("output", "stdout", "write programs to none/stdout/dmesg/file")
+	flagFiles       = flag.String("files", "/dev:10,/proc/self:3,/sys:1", "comma-separated list of dir:weight to enumerate for filename generation")
+	flagTlsCert     = flag.String("tls_cert", "", "manager TLS certificate, if set manager is dialed over TLS and must present this certificate")
+	flagTokenFile   = flag.String("token_file", "", "file with manager auth token")
+	flagRpcCompress = flag.Bool("rpc_compression", false, "compress rpc messages to manager")
+	flagRpcBatch    = flag.Int("rpc_batch", 1, "send new inputs to manager in batches of this size")
+	flagDedupWindow = flag.Int("dedup_window", 0, "number of recently executed programs remembered to skip exact duplicates (0 - don't skip)")
+	flagPostproc    = flag.String("postproc", "", "comma-separated list of program post-processors applied before execution: plugin:file.so (Go plugin), cmd:binary (subprocess)")
+	flagSignal      = flag.String("signal", "pc", "comma-separated list of feedback sources: pc (new basic blocks), edge (new edges between blocks), comps (new comparison operands)")
 )
 
 const (
 	programLength = 30
+
+	// Parameters of smashing of new corpus inputs.
+	smashMutations = 100 // number of mutations of a new input
+	smashFaults    = 100 // max number of faults injected into each call of a new input
+
+	rotateCalls = 20 // number of randomly chosen calls in each per-proc rotation (see -rotate)
+
+	// Parameters of rechecks of corpus programs (see -recheck_corpus).
+	recheckPeriod       = 50  // every recheckPeriod-th iteration of a proc rechecks a corpus program
+	recheckRuns         = 3   // number of executions of a rechecked program
+	quarantineStability = 0.5 // programs with lower stability are not chosen for mutation
+
+	maxPendingBatches = 10 // max number of batches of new inputs queued for sending to manager
+)
+
+// Loggers of communication with the manager and of program execution,
+// their verbosity can be set with -vmodule=rpc=N,exec=N.
+const (
+	rpcLog  = Component("rpc")
+	execLog = Component("exec")
 )
 
 type Sig [sha1.Size]byte
@@ -54,38 +87,103 @@ func hash(data []byte) Sig {
 }
 
 type Input struct {
-	p     *prog.Prog
-	call  int
-	cover cover.Cover
+	p         *prog.Prog
+	call      int
+	cover     cover.Cover
+	signal    signal.Signal
+	prio      signal.Prio // max priority of new signal, inputs with higher priority are triaged first
+	comps     bool        // the signal comes from comparison operands, so the program is triaged with comps
+	candidate bool        // the program comes from persistent corpus or hub
+	minimized bool        // the program does not need minimization
+}
+
+// CallInfo is the result of execution of a call.
+type CallInfo struct {
+	cover  cover.Cover
+	signal signal.Signal
+}
+
+type Candidate struct {
+	p         *prog.Prog
+	minimized bool
 }
 
 var (
 	manager *rpc.Client
+	// New corpus inputs are queued and sent to manager with polls in batches.
+	// When manager falls behind (asks to back off), the queue fills up and
+	// procs that triage new inputs block until it is drained.
+	newInputs chan RpcInput
+	needPoll  chan struct{}
 
-	coverMu     sync.RWMutex
-	corpusCover []cover.Cover
-	maxCover    []cover.Cover
-	flakes      cover.Cover
+	// Inputs are triaged by signal (see -signal), max cover is exchanged
+	// with manager and other fuzzers, so it is maintained separately.
+	coverMu      sync.RWMutex
+	corpusSignal []signal.Signal
+	maxSignal    []signal.Signal
+	flakes       signal.Signal
+	maxCover     []cover.Cover
+	newMaxCover  []cover.Cover // max cover discovered since the last poll
 
 	corpusMu     sync.RWMutex
 	corpus       []*prog.Prog
 	corpusHashes map[Sig]struct{}
+	corpusFocus  []int        // indices of corpus programs that cover code selected by cover filter
+	corpusActive []*prog.Prog // corpus programs that are not quarantined (chosen for mutation and splicing)
+
+	// Bookkeeping for selection of corpus programs that cover rare PCs.
+	corpusCovers  []cover.Cover  // coverage of corpus programs
+	corpusPCHits  map[uint32]int // number of corpus programs that cover each PC
+	corpusWeights []float64      // cumulative selection weights of first len(corpusWeights) corpus programs
+	// Fraction of coverage of corpus programs reproduced by the last recheck (see recheckProgram).
+	corpusStability []float64
+
+	coverFilter       []PCRange // sorted non-overlapping ranges of PCs to focus on
+	coverFilterWeight int
+
+	// Hashes of the last -dedup_window programs executed by execute,
+	// mutation often produces a program that was just executed.
+	recentMu     sync.Mutex
+	recentHashes map[Sig]struct{}
+	recentRing   []Sig
+	recentPos    int
 
 	triageMu   sync.RWMutex
 	triage     []Input
-	candidates []*prog.Prog
+	candidates []Candidate
 
 	gate *ipc.Gate
 
-	statExecGen       uint64
-	statExecFuzz      uint64
-	statExecCandidate uint64
-	statExecTriage    uint64
-	statExecMinimize  uint64
-	statNewInput      uint64
+	statExecGen         uint64
+	statExecFuzz        uint64
+	statExecCandidate   uint64
+	statExecTriage      uint64
+	statExecMinimize    uint64
+	statExecSmash       uint64
+	statExecFault       uint64
+	statExecFaultCorpus uint64
+	statExecHints       uint64
+	statExecCollide     uint64
+	statExecRecheck     uint64
+	statNewInput        uint64
+	statFlakyInput      uint64
+	statQuarantined     uint64
+	statStaleCandidate  uint64
+	statDuplicate       uint64
+	statBrokenCandidate uint64
+	statRotations       uint64
+	statExtraCover      [ipc.NumSubsystems]uint64
 
-	allTriaged uint32
-	noCover    bool
+	allTriaged        uint32
+	triaging          int // inputs and candidates being triaged by procs, protected by triageMu
+	noCover           bool
+	signalPCs         bool
+	signalEdges       bool
+	signalComps       bool
+	faultEnabled      bool
+	compsEnabled      bool
+	collideEnabled    bool
+	extraCoverEnabled bool
 )
 
 func main() {
@@ -102,18 +200,37 @@ func main() {
 	go func() {
 		// Handles graceful preemption on GCE.
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		ossignal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		<-c
 		Logf(0, "SYZ-FUZZER: PREEMPTED")
 		os.Exit(1)
 	}()
 
-	corpusCover = make([]cover.Cover, sys.CallCount)
+	corpusSignal = make([]signal.Signal, sys.CallCount)
+	maxSignal = make([]signal.Signal, sys.CallCount)
 	maxCover = make([]cover.Cover, sys.CallCount)
+	newMaxCover = make([]cover.Cover, sys.CallCount)
 	corpusHashes = make(map[Sig]struct{})
+	recentHashes = make(map[Sig]struct{})
+	corpusPCHits = make(map[uint32]int)
 
-	Logf(0, "dialing manager at %v", *flagManager)
-	conn, err := jsonrpc.Dial("tcp", *flagManager)
+	rpcLog.Logf(0, "dialing manager at %v", *flagManager)
+	var tlsConfig *tls.Config
+	if *flagTlsCert != "" {
+		var err error
+		if tlsConfig, err = PinnedTLSConfig(*flagTlsCert); err != nil {
+			Fatalf("%v", err)
+		}
+	}
+	token := ""
+	if *flagTokenFile != "" {
+		data, err := ioutil.ReadFile(*flagTokenFile)
+		if err != nil {
+			Fatalf("failed to read auth token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	conn, err := RpcDial(*flagManager, tlsConfig, token, *flagRpcCompress)
 	if err != nil {
 		panic(err)
 	}
@@ -123,67 +240,180 @@ func main() {
 	if err := manager.Call("Manager.Connect", a, r); err != nil {
 		panic(err)
 	}
-	calls := buildCallList(r.EnabledCalls)
-	ct := prog.BuildChoiceTable(r.Prios, calls)
-
+	if err := addMaxCover(r.MaxCover); err != nil {
+		Fatalf("bad max cover from manager: %v", err)
+	}
+	coverFilter = r.CoverFilter
+	coverFilterWeight = r.CoverFilterWeight
+	if len(coverFilter) != 0 {
+		Logf(0, "cover filter: %v PC ranges, weight %v", len(coverFilter), coverFilterWeight)
+	}
+	flags, timeout, err := ipc.DefaultFlags()
+	if err != nil {
+		panic(err)
+	}
+	calls, disabled := buildCallList(r.EnabledCalls)
+	check := checkMachine(flags)
+	check.Name = *flagName
+	check.DisabledCalls = disabled
+	for c := range calls {
+		check.Calls = append(check.Calls, c.Name)
+	}
 	if r.NeedCheck {
-		a := &CheckArgs{Name: *flagName}
-		if fd, err := syscall.Open("/sys/kernel/debug/kcov", syscall.O_RDWR, 0); err == nil {
-			syscall.Close(fd)
-			a.Kcov = true
-		}
-		for c := range calls {
-			a.Calls = append(a.Calls, c.Name)
-		}
-		if err := manager.Call("Manager.Check", a, nil); err != nil {
+		if err := manager.Call("Manager.Check", check, nil); err != nil {
 			panic(err)
 		}
 	}
+	if check.SandboxError != "" {
+		Fatalf("sandbox does not work on the machine: %v", check.SandboxError)
+	}
+	targetFiles := enumerateTargetFiles(*flagFiles)
+	buildChoiceTable := func(enabled map[*sys.Call]bool) *prog.ChoiceTable {
+		ct := prog.BuildChoiceTable(r.Prios, enabled)
+		for _, tf := range targetFiles {
+			ct.AddFiles(tf.files, tf.weight)
+		}
+		return ct
+	}
+	ct := buildChoiceTable(calls)
 
+	if *flagLeak && !check.Leak {
+		Logf(0, "kmemleak is not supported, disabling leak checking")
+		*flagLeak = false
+	}
 	kmemleakInit()
 
-	flags, timeout, err := ipc.DefaultFlags()
-	if err != nil {
-		panic(err)
-	}
-	if _, ok := calls[sys.CallMap["syz_emit_ethernet"]]; ok {
+	if _, ok := calls[sys.CallMap["syz_emit_ethernet"]]; ok && check.NetInjection {
 		flags |= ipc.FlagEnableTun
 	}
+	if _, ok := calls[sys.CallMap["syz_80211_inject_frame"]]; ok && check.Wifi {
+		flags |= ipc.FlagEnableWifi
+	}
+	if check.Cgroups {
+		for c := range calls {
+			if strings.Contains(c.Name, "$cgroup") {
+				flags |= ipc.FlagEnableCgroups
+				break
+			}
+		}
+	}
+	if flags&ipc.FlagCover != 0 && !check.Kcov {
+		Logf(0, "kcov is not supported, disabling coverage")
+		flags &^= ipc.FlagCover | ipc.FlagDedupCover
+	}
 	noCover = flags&ipc.FlagCover == 0
+	if noCover && *flagRecheck {
+		Logf(0, "coverage is disabled, disabling recheck_corpus")
+		*flagRecheck = false
+	}
+	if flags&ipc.FlagThreaded != 0 && flags&ipc.FlagCollide != 0 {
+		// Instead of colliding every execution in executor, we collide
+		// only fuzzing executions by running collided copies of programs.
+		flags &^= ipc.FlagCollide
+		collideEnabled = true
+	}
+	if check.Fault {
+		flags |= ipc.FlagEnableFault
+		faultEnabled = true
+	} else {
+		Logf(0, "fault injection is not supported, smashing will only mutate new inputs")
+		if *flagFaultCorpus {
+			Logf(0, "disabling fault_corpus")
+			*flagFaultCorpus = false
+		}
+	}
+	if !noCover && flags&ipc.FlagThreaded != 0 && check.KcovRemote {
+		flags |= ipc.FlagExtraCover
+		extraCoverEnabled = true
+	}
+	if !noCover && check.KcovComps {
+		compsEnabled = true
+	} else {
+		Logf(0, "comparison tracing is not supported, smashing will not use hints")
+	}
+	for _, src := range strings.Split(*flagSignal, ",") {
+		switch strings.TrimSpace(src) {
+		case "pc":
+			signalPCs = true
+		case "edge":
+			signalEdges = true
+		case "comps":
+			signalComps = true
+		default:
+			Fatalf("unknown signal source %q", src)
+		}
+	}
+	if !signalPCs && !signalEdges {
+		Fatalf("-signal must include pc or edge")
+	}
+	if signalEdges {
+		// Edges are computed from coverage in the execution order.
+		flags &^= ipc.FlagDedupCover
+	}
+	if err := initPostProcessors(*flagPostproc); err != nil {
+		Fatalf("%v", err)
+	}
+	if signalComps && !compsEnabled {
+		Logf(0, "comparison tracing is not supported, disabling comps signal")
+		signalComps = false
+	}
 	leakCallback := func() {
-		if atomic.LoadUint32(&allTriaged) != 0 {
+		if atomic.LoadUint32(&allTriaged) != 0 && time.Since(lastLeakScan) >= *flagLeakPeriod {
 			// Scan for leaks once in a while (it is damn slow).
 			kmemleakScan(true)
+			lastLeakScan = time.Now()
 		}
 	}
 	if !*flagLeak {
 		leakCallback = nil
 	}
 	gate = ipc.NewGate(2**flagProcs, leakCallback)
-	needPoll := make(chan struct{}, 1)
+	if *flagRpcBatch < 1 {
+		*flagRpcBatch = 1
+	}
+	newInputs = make(chan RpcInput, maxPendingBatches**flagRpcBatch)
+	needPoll = make(chan struct{}, 1)
 	needPoll <- struct{}{}
+	// Test processes are allowed all enabled calls regardless of rotation,
+	// the filter is fixed for the lifetime of executor.
+	var seccompCalls []int
+	for c := range calls {
+		seccompCalls = append(seccompCalls, c.ID)
+	}
 	envs := make([]*ipc.Env, *flagProcs)
 	for pid := 0; pid < *flagProcs; pid++ {
-		env, err := ipc.MakeEnv(*flagExecutor, timeout, flags, pid)
+		env, err := ipc.MakeEnv(*flagExecutor, timeout, flags, ipc.DefaultPolicy(), pid)
 		if err != nil {
 			panic(err)
 		}
+		env.SeccompCalls = seccompCalls
 		envs[pid] = env
 
 		pid := pid
 		go func() {
 			rs := rand.NewSource(time.Now().UnixNano() + int64(pid)*1e12)
 			rnd := rand.New(rs)
+			ct := ct
+			var lastRotate time.Time
 
 			for i := 0; ; i++ {
+				waitResumed()
+				if *flagRotate != 0 && time.Since(lastRotate) >= *flagRotate {
+					// Give this proc a dedicated random subset of calls for a while,
+					// so that procs do not all converge on the same hot calls.
+					rotated := rotateCallSubset(rnd, calls, rotateCalls)
+					Logf(1, "#%v: rotated to %v calls", i, len(rotated))
+					ct = buildChoiceTable(rotated)
+					lastRotate = time.Now()
+					atomic.AddUint64(&statRotations, 1)
+				}
 				triageMu.RLock()
 				if len(triage) != 0 || len(candidates) != 0 {
 					triageMu.RUnlock()
 					triageMu.Lock()
 					if len(triage) != 0 {
-						last := len(triage) - 1
-						inp := triage[last]
-						triage = triage[:last]
+						inp := popTriage()
+						triaging++
 						wakePoll := len(triage) < *flagProcs
 						triageMu.Unlock()
 						if wakePoll {
@@ -193,14 +423,18 @@ func main() {
 							}
 						}
 						Logf(1, "triaging : %s", inp.p)
-						triageInput(pid, env, inp)
+						triageInput(pid, env, ct, rnd, inp)
+						doneTriage()
 						continue
 					} else if len(candidates) != 0 {
 						last := len(candidates) - 1
-						p := candidates[last]
+						cand := candidates[last]
 						candidates = candidates[:last]
+						triaging++
 						triageMu.Unlock()
-						execute(pid, env, p, &statExecCandidate)
+						info := execute1(pid, env, cand.p, &statExecCandidate)
+						checkNewSignal(cand.p, info, false, true, cand.minimized)
+						doneTriage()
 						continue
 					} else {
 						triageMu.Unlock()
@@ -209,30 +443,64 @@ func main() {
 					triageMu.RUnlock()
 				}
 
+				if *flagFaultCorpus && i%10 == 5 {
+					if p, call := nextFaultCall(); p != nil {
+						Logf(1, "#%v: failing call %v: %s", i, call, p)
+						failCall(pid, env, p, call, &statExecFaultCorpus)
+						continue
+					}
+				}
+
+				if *flagRecheck && i%recheckPeriod == 3 {
+					if idx, p := nextRecheckProgram(); p != nil {
+						Logf(1, "#%v: rechecking corpus program %v: %s", i, idx, p)
+						recheckProgram(pid, env, idx, p)
+						continue
+					}
+				}
+
 				corpusMu.RLock()
-				if len(corpus) == 0 || i%10 == 0 {
-					// Generate a new prog.
+				var p0 *prog.Prog
+				if len(corpus) != 0 && i%10 != 0 {
+					p0 = chooseProgram(rnd)
+				}
+				if p0 == nil {
+					// Generate a new prog (also if all corpus programs are quarantined).
 					corpusMu.RUnlock()
 					p := prog.Generate(rnd, programLength, ct)
 					Logf(1, "#%v: generated: %s", i, p)
 					execute(pid, env, p, &statExecGen)
+					executeCollide(pid, env, rnd, p)
+					var seed *prog.Prog
+					if *flagProvenance {
+						seed = p.Clone()
+					}
 					p.Mutate(rnd, programLength, ct, nil)
+					if seed != nil {
+						prog.AnnotateProvenance(seed, p)
+					}
 					Logf(1, "#%v: mutated: %s", i, p)
 					execute(pid, env, p, &statExecFuzz)
+					executeCollide(pid, env, rnd, p)
 				} else {
 					// Mutate an existing prog.
-					p0 := corpus[rnd.Intn(len(corpus))]
 					p := p0.Clone()
-					p.Mutate(rs, programLength, ct, corpus)
+					p.Mutate(rs, programLength, ct, corpusActive)
 					corpusMu.RUnlock()
+					if *flagProvenance {
+						prog.AnnotateProvenance(p0, p)
+					}
 					Logf(1, "#%v: mutated: %s <- %s", i, p, p0)
 					execute(pid, env, p, &statExecFuzz)
+					executeCollide(pid, env, rnd, p)
 				}
 			}
 		}()
 	}
 
 	var lastPoll time.Time
+	var pollBackoff time.Time // manager asked not to poll until this time
+	var maxCoverAck uint64
 	var lastPrint time.Time
 	ticker := time.NewTicker(3 * time.Second).C
 	for {
@@ -242,56 +510,113 @@ func main() {
 		case <-needPoll:
 			poll = true
 		}
-		if *flagOutput != "stdout" && time.Since(lastPrint) > 10*time.Second {
+		if isPaused() && time.Since(lastPrint) > 10*time.Second {
+			// Keep-alive for manager, paused procs don't print executed programs.
+			Logf(0, "fuzzing paused")
+			lastPrint = time.Now()
+		} else if *flagOutput != "stdout" && time.Since(lastPrint) > 10*time.Second {
 			// Keep-alive for manager.
 			Logf(0, "alive")
 			lastPrint = time.Now()
 		}
-		if poll || time.Since(lastPoll) > 10*time.Second {
+		if time.Now().Before(pollBackoff) {
+			continue
+		}
+		batchReady := len(newInputs) >= *flagRpcBatch
+		if poll || batchReady || time.Since(lastPoll) > 10*time.Second {
 			triageMu.RLock()
-			if len(candidates) > *flagProcs {
+			if len(candidates) > *flagProcs && !batchReady && !isPaused() {
 				triageMu.RUnlock()
 				continue
 			}
 			triageMu.RUnlock()
 
 			a := &PollArgs{
-				Name:  *flagName,
-				Stats: make(map[string]uint64),
+				Name:        *flagName,
+				Stats:       make(map[string]uint64),
+				MaxCover:    make(map[string][]byte),
+				MaxCoverAck: maxCoverAck,
+				Errnos:      takeErrnos(),
+				// Checked before new inputs are collected, so that inputs of the triaged candidates
+				// are sent with this poll at the latest.
+				Triaged: triaged(),
+			}
+			coverMu.Lock()
+			for name, call := range sys.CallID {
+				if cov := newMaxCover[call]; len(cov) != 0 {
+					a.MaxCover[name] = cover.Serialize(cov)
+				}
+			}
+			newMaxCover = make([]cover.Cover, sys.CallCount)
+			coverMu.Unlock()
+			for n := len(newInputs); n > 0; n-- {
+				a.NewInputs = append(a.NewInputs, <-newInputs)
 			}
 			for _, env := range envs {
 				a.Stats["exec total"] += atomic.SwapUint64(&env.StatExecs, 0)
 				a.Stats["executor restarts"] += atomic.SwapUint64(&env.StatRestarts, 0)
+				a.Stats["executor retries"] += atomic.SwapUint64(&env.StatRetries, 0)
 			}
 			a.Stats["exec gen"] = atomic.SwapUint64(&statExecGen, 0)
 			a.Stats["exec fuzz"] = atomic.SwapUint64(&statExecFuzz, 0)
 			a.Stats["exec candidate"] = atomic.SwapUint64(&statExecCandidate, 0)
 			a.Stats["exec triage"] = atomic.SwapUint64(&statExecTriage, 0)
 			a.Stats["exec minimize"] = atomic.SwapUint64(&statExecMinimize, 0)
+			a.Stats["exec smash"] = atomic.SwapUint64(&statExecSmash, 0)
+			a.Stats["exec fault"] = atomic.SwapUint64(&statExecFault, 0)
+			a.Stats["exec fault corpus"] = atomic.SwapUint64(&statExecFaultCorpus, 0)
+			a.Stats["exec hints"] = atomic.SwapUint64(&statExecHints, 0)
+			a.Stats["exec collide"] = atomic.SwapUint64(&statExecCollide, 0)
+			a.Stats["exec recheck"] = atomic.SwapUint64(&statExecRecheck, 0)
 			a.Stats["fuzzer new inputs"] = atomic.SwapUint64(&statNewInput, 0)
+			a.Stats["fuzzer flaky inputs"] = atomic.SwapUint64(&statFlakyInput, 0)
+			a.Stats["fuzzer quarantined inputs"] = atomic.SwapUint64(&statQuarantined, 0)
+			a.Stats["fuzzer stale candidates"] = atomic.SwapUint64(&statStaleCandidate, 0)
+			a.Stats["fuzzer skipped duplicates"] = atomic.SwapUint64(&statDuplicate, 0)
+			a.Stats["fuzzer broken candidates"] = atomic.SwapUint64(&statBrokenCandidate, 0)
+			a.Stats["fuzzer rotations"] = atomic.SwapUint64(&statRotations, 0)
+			for sub, name := range ipc.SubsystemNames {
+				a.Stats["exec extra cover "+name] = atomic.SwapUint64(&statExtraCover[sub], 0)
+			}
 			r := &PollRes{}
 			if err := manager.Call("Manager.Poll", a, r); err != nil {
 				panic(err)
 			}
+			if r.Stop {
+				emergencyStop(envs)
+			}
+			setPaused(r.Paused)
+			maxCoverAck = r.MaxCoverSeq
+			if r.Backoff != 0 {
+				rpcLog.Logf(1, "manager is overloaded, backing off for %v", r.Backoff)
+				pollBackoff = time.Now().Add(r.Backoff)
+			}
+			if err := addMaxCover(r.MaxCover); err != nil {
+				Fatalf("bad max cover from manager: %v", err)
+			}
 			for _, inp := range r.NewInputs {
 				addInput(inp)
 			}
-			for _, data := range r.Candidates {
-				p, err := prog.Deserialize(data)
+			for _, cand := range r.Candidates {
+				p, err := prog.Deserialize(cand.Prog)
 				if err != nil {
-					panic(err)
+					// Descriptions of the fuzzer and the manager can differ.
+					Logf(0, "dropping broken candidate: %v\n%s", err, cand.Prog)
+					atomic.AddUint64(&statBrokenCandidate, 1)
+					continue
 				}
+				stripFaults(p)
 				if noCover {
 					corpusMu.Lock()
-					corpus = append(corpus, p)
+					addCorpusProgram(p, nil)
 					corpusMu.Unlock()
 				} else {
 					triageMu.Lock()
-					candidates = append(candidates, p)
+					candidates = append(candidates, Candidate{p, cand.Minimized})
 					triageMu.Unlock()
 				}
 			}
-			if len(r.Candidates) == 0 && atomic.LoadUint32(&allTriaged) == 0 {
+			if len(r.Candidates) == 0 && r.Pending == 0 && atomic.LoadUint32(&allTriaged) == 0 {
 				if *flagLeak {
 					kmemleakScan(false)
 				}
@@ -304,8 +629,222 @@ func main() {
 	}
 }
 
-func buildCallList(enabledCalls string) map[*sys.Call]bool {
+// addTargetFiles enumerates dirs given in -files flag
+// and adds the found paths to filename generation.
+type targetFiles struct {
+	files  []string
+	weight int
+}
+
+func enumerateTargetFiles(spec string) []targetFiles {
+	var res []targetFiles
+	for _, ent := range strings.Split(spec, ",") {
+		if ent == "" {
+			continue
+		}
+		colon := strings.LastIndexByte(ent, ':')
+		if colon == -1 {
+			Fatalf("bad -files entry %q, want dir:weight", ent)
+		}
+		weight, err := strconv.Atoi(ent[colon+1:])
+		if err != nil {
+			Fatalf("bad -files entry %q: %v", ent, err)
+		}
+		files := host.EnumerateFiles(ent[:colon], 3)
+		Logf(1, "enumerated %v files in %v", len(files), ent[:colon])
+		res = append(res, targetFiles{files, weight})
+	}
+	return res
+}
+
+// rotateCallSubset returns a random subset of n enabled calls extended with
+// enabled constructors of resources that these calls need (one random constructor
+// per resource), so that all calls in the subset can be generated.
+func rotateCallSubset(rnd *rand.Rand, enabled map[*sys.Call]bool, n int) map[*sys.Call]bool {
+	var all []*sys.Call
+	for c := range enabled {
+		all = append(all, c)
+	}
+	sort.Sort(callArray(all))
+	subset := make(map[*sys.Call]bool)
+	for _, idx := range rnd.Perm(len(all)) {
+		if len(subset) == n {
+			break
+		}
+		subset[all[idx]] = true
+	}
+	if gettime := sys.CallMap["clock_gettime"]; enabled[gettime] {
+		// Required for timespec/timeval arguments.
+		subset[gettime] = true
+	}
+	for added := true; added; {
+		added = false
+		for c := range subset {
+			for _, res := range c.InputResources() {
+				var ctors []*sys.Call
+				have := false
+				for _, ctor := range sys.PreciseResourceConstructors(res.Desc.Name) {
+					if subset[ctor] {
+						have = true
+						break
+					}
+					if enabled[ctor] {
+						ctors = append(ctors, ctor)
+					}
+				}
+				if !have && len(ctors) != 0 {
+					subset[ctors[rnd.Intn(len(ctors))]] = true
+					added = true
+				}
+			}
+		}
+	}
+	return sys.TransitivelyEnabledCalls(subset)
+}
+
+type callArray []*sys.Call
+
+func (a callArray) Len() int           { return len(a) }
+func (a callArray) Less(i, j int) bool { return a[i].ID < a[j].ID }
+func (a callArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// chooseProgram returns a corpus program for mutation, must be called with corpusMu held.
+// With a weighted cover filter, programs that cover the selected code are preferred.
+// Otherwise programs that cover rare PCs and have stable coverage are preferred (see updateCorpusWeights).
+// Quarantined programs are never chosen, returns nil if all corpus programs are quarantined.
+func chooseProgram(rnd *rand.Rand) *prog.Prog {
+	if n := len(corpusFocus) * coverFilterWeight; n != 0 {
+		if idx := rnd.Intn(n + len(corpus) - len(corpusFocus)); idx < n {
+			if idx := corpusFocus[idx/coverFilterWeight]; !quarantined(idx) {
+				return corpus[idx]
+			}
+		}
+	}
+	if n := len(corpusWeights); n != 0 && corpusWeights[n-1] > 0 {
+		// Programs added after the last weights update are chosen uniformly.
+		if idx := rnd.Intn(len(corpus)); idx >= n && !quarantined(idx) {
+			return corpus[idx]
+		}
+		w := rnd.Float64() * corpusWeights[n-1]
+		return corpus[sort.SearchFloat64s(corpusWeights, w)]
+	}
+	if len(corpusActive) == 0 {
+		return nil
+	}
+	return corpusActive[rnd.Intn(len(corpusActive))]
+}
+
+// quarantined says that corpus program idx has unstable coverage and must not be mutated.
+func quarantined(idx int) bool {
+	return corpusStability[idx] < quarantineStability
+}
+
+// addCorpusProgram adds p that covers cov to corpus, must be called with corpusMu held.
+func addCorpusProgram(p *prog.Prog, cov cover.Cover) {
+	corpus = append(corpus, p)
+	corpusCovers = append(corpusCovers, cov)
+	corpusStability = append(corpusStability, 1)
+	corpusActive = append(corpusActive, p)
+	for _, pc := range cov {
+		corpusPCHits[pc]++
+	}
+	if coverFilterWeight != 0 && coversFilter(cov) {
+		corpusFocus = append(corpusFocus, len(corpus)-1)
+	}
+	// Weights depend on the whole corpus, so update them once corpus grows enough.
+	if n := len(corpusWeights); len(corpus)-n >= n/10+10 {
+		updateCorpusWeights()
+	}
+}
+
+// updateCorpusWeights recalculates selection weights of corpus programs:
+// a program gets 1/n for each PC it covers, where n is the number of corpus programs
+// that cover the PC, so programs that cover rarely hit PCs are chosen more often.
+// The weight is scaled by stability of the program, quarantined programs get 0
+// and are excluded from corpusActive.
+func updateCorpusWeights() {
+	weights := make([]float64, len(corpus))
+	var active []*prog.Prog
+	sum := 0.0
+	for i, cov := range corpusCovers {
+		if quarantined(i) {
+			weights[i] = sum
+			continue
+		}
+		active = append(active, corpus[i])
+		w := 0.0
+		for _, pc := range cov {
+			w += 1 / float64(corpusPCHits[pc])
+		}
+		sum += w * corpusStability[i]
+		weights[i] = sum
+	}
+	corpusWeights = weights
+	corpusActive = active
+}
+
+// filterCover returns PCs of cov that fall into cover filter ranges.
+func filterCover(cov cover.Cover) cover.Cover {
+	var res cover.Cover
+	for _, pc := range cov {
+		if inCoverFilter(pc) {
+			res = append(res, pc)
+		}
+	}
+	return res
+}
+
+func coversFilter(cov cover.Cover) bool {
+	for _, pc := range cov {
+		if inCoverFilter(pc) {
+			return true
+		}
+	}
+	return false
+}
+
+func inCoverFilter(pc uint32) bool {
+	idx := sort.Search(len(coverFilter), func(i int) bool {
+		return pc < coverFilter[i].End
+	})
+	return idx < len(coverFilter) && pc >= coverFilter[idx].Start
+}
+
+// checkMachine probes optional features of the machine
+// and whether the sandbox requested by flags can work.
+func checkMachine(flags uint64) *CheckArgs {
+	sandbox := "none"
+	if flags&ipc.FlagSandboxSetuid != 0 {
+		sandbox = "setuid"
+	} else if flags&ipc.FlagSandboxNamespace != 0 {
+		sandbox = "namespace"
+	} else if flags&ipc.FlagSandboxAndroid != 0 {
+		sandbox = "android_untrusted_app"
+	}
+	a := &CheckArgs{
+		Debugfs:      host.IsDebugfsMounted(),
+		Kcov:         host.IsKcovSupported(),
+		Leak:         host.IsLeakCheckingSupported(),
+		Fault:        host.IsFaultInjectionSupported(),
+		NetInjection: host.IsNetInjectionSupported(),
+		Wifi:         host.IsWifiSupported(),
+		Cgroups:      host.IsCgroupsSupported(),
+	}
+	a.KcovComps = a.Kcov && host.IsCompsSupported()
+	a.KcovRemote = a.Kcov && host.IsKcovRemoteSupported()
+	if err := host.CheckSandbox(sandbox); err != nil {
+		a.SandboxError = err.Error()
+	} else if flags&ipc.FlagSeccomp != 0 && !host.IsSeccompSupported() {
+		a.SandboxError = "seccomp allowlist requires seccomp (CONFIG_SECCOMP_FILTER)"
+	}
+	return a
+}
+
+// buildCallList returns syscalls that are enabled and supported on the machine,
+// and reasons for disabling the rest of enabled syscalls.
+func buildCallList(enabledCalls string) (map[*sys.Call]bool, map[string]string) {
 	calls := make(map[*sys.Call]bool)
+	disabled := make(map[string]string)
 	if enabledCalls != "" {
 		for _, id := range strings.Split(enabledCalls, ",") {
 			n, err := strconv.ParseUint(id, 10, 64)
@@ -326,19 +865,19 @@ func buildCallList(enabledCalls string) map[*sys.Call]bool {
 		for c := range calls {
 			if !supp[c] {
 				Logf(1, "disabling unsupported syscall: %v", c.Name)
+				disabled[c.Name] = "not supported on the machine"
 				delete(calls, c)
 			}
 		}
 	}
 
-	trans := sys.TransitivelyEnabledCalls(calls)
-	for c := range calls {
-		if !trans[c] {
-			Logf(1, "disabling transitively unsupported syscall: %v", c.Name)
-			delete(calls, c)
-		}
+	_, dead := sys.TransitivelyEnabledCallsReasons(calls)
+	for c, reason := range dead {
+		Logf(1, "disabling transitively unsupported syscall: %v (%v)", c.Name, reason)
+		disabled[c.Name] = reason
+		delete(calls, c)
 	}
-	return calls
+	return calls, disabled
 }
 
 func addInput(inp RpcInput) {
@@ -357,34 +896,101 @@ func addInput(inp RpcInput) {
 	if inp.CallIndex < 0 || inp.CallIndex >= len(p.Calls) {
 		panic("bad call index")
 	}
+	stripFaults(p)
 	call := p.Calls[inp.CallIndex].Meta
 	sig := hash(inp.Prog)
 	if _, ok := corpusHashes[sig]; ok {
 		return
 	}
+	// Inputs of other fuzzers come with PC coverage only,
+	// their edge and comparison signal is not known.
 	cov := cover.Canonicalize(inp.Cover)
-	diff := cover.Difference(cov, maxCover[call.CallID])
-	diff = cover.Difference(diff, flakes)
-	if len(diff) == 0 {
+	inpSignal := signal.FromPCs(cov)
+	if inpSignal.Diff(maxSignal[call.CallID]).Diff(flakes).Empty() {
 		return
 	}
-	corpus = append(corpus, p)
-	corpusCover[call.CallID] = cover.Union(corpusCover[call.CallID], cov)
+	addCorpusProgram(p, cov)
+	corpusSignal[call.CallID].Merge(inpSignal)
+	maxSignal[call.CallID].Merge(inpSignal)
 	maxCover[call.CallID] = cover.Union(maxCover[call.CallID], cov)
 	corpusHashes[hash(inp.Prog)] = struct{}{}
 }
 
-func triageInput(pid int, env *ipc.Env, inp Input) {
+// stripFaults clears FailNth attributes of calls of p if the kernel does not support fault injection.
+// Corpus of other fuzzers, the hub and candidates can come from kernels that do.
+func stripFaults(p *prog.Prog) {
+	if faultEnabled {
+		return
+	}
+	for _, c := range p.Calls {
+		c.FailNth = 0
+	}
+}
+
+// addMaxCover merges max cover of other fuzzers received from manager.
+func addMaxCover(maxCover1 map[string][]byte) error {
+	coverMu.Lock()
+	defer coverMu.Unlock()
+	for name, data := range maxCover1 {
+		call, ok := sys.CallID[name]
+		if !ok {
+			return fmt.Errorf("unknown call %v", name)
+		}
+		cov, err := cover.Deserialize(data)
+		if err != nil {
+			return fmt.Errorf("call %v: %v", name, err)
+		}
+		maxCover[call] = cover.Union(maxCover[call], cov)
+		maxSignal[call].Merge(signal.FromPCs(cov))
+	}
+	return nil
+}
+
+// popTriage removes the input with the highest signal priority from the triage queue
+// (the most recent one among equals), must be called with triageMu held.
+func doneTriage() {
+	triageMu.Lock()
+	triaging--
+	triageMu.Unlock()
+}
+
+// triaged says that all candidates received from manager are triaged
+// (including inputs with new signal they produced).
+func triaged() bool {
+	if atomic.LoadUint32(&allTriaged) == 0 {
+		return false
+	}
+	triageMu.RLock()
+	defer triageMu.RUnlock()
+	return len(candidates) == 0 && len(triage) == 0 && triaging == 0
+}
+
+func popTriage() Input {
+	best := len(triage) - 1
+	for i := best - 1; i >= 0; i-- {
+		if triage[i].prio > triage[best].prio {
+			best = i
+		}
+	}
+	inp := triage[best]
+	copy(triage[best:], triage[best+1:])
+	triage = triage[:len(triage)-1]
+	return inp
+}
+
+// triageRuns is the number of times a program with new coverage is re-executed during triage.
+const triageRuns = 3
+
+func triageInput(pid int, env *ipc.Env, ct *prog.ChoiceTable, rnd *rand.Rand, inp Input) {
 	if noCover {
 		panic("should not be called when coverage is disabled")
 	}
 
 	call := inp.p.Calls[inp.call].Meta
 	coverMu.RLock()
-	newCover := cover.Difference(inp.cover, corpusCover[call.CallID])
-	newCover = cover.Difference(newCover, flakes)
+	newSignal := inp.signal.Diff(corpusSignal[call.CallID]).Diff(flakes)
 	coverMu.RUnlock()
-	if len(newCover) == 0 {
+	if newSignal.Empty() {
 		return
 	}
 
@@ -395,93 +1001,368 @@ func triageInput(pid int, env *ipc.Env, inp Input) {
 	}
 	corpusMu.RUnlock()
 
+	// Signal of comparison operands is reproduced only by executions that collect comparisons.
+	exec := func(p *prog.Prog, stat *uint64) []CallInfo {
+		if inp.comps {
+			info, _, _ := executeRaw(pid, env, p, true, stat)
+			return info
+		}
+		return execute1(pid, env, p, stat)
+	}
+
+	// Re-execute the program several times and consider only signal that is
+	// present in all runs, so that flaky programs don't get into corpus.
+	minSignal := inp.signal
 	minCover := inp.cover
-	for i := 0; i < 3; i++ {
-		allCover := execute1(pid, env, inp.p, &statExecTriage)
-		if len(allCover[inp.call]) == 0 {
+	notExecuted := 0
+	for i := 0; i < triageRuns; i++ {
+		inf := exec(inp.p, &statExecTriage)[inp.call]
+		if inf.signal.Empty() {
 			// The call was not executed. Happens sometimes, reason unknown.
+			notExecuted++
 			continue
 		}
 		coverMu.RLock()
-		cov := allCover[inp.call]
-		diff := cover.SymmetricDifference(inp.cover, cov)
-		minCover = cover.Intersection(minCover, cov)
-		updateFlakes := len(diff) != 0 && len(cover.Difference(diff, flakes)) != 0
+		diff := inp.signal.Diff(inf.signal)
+		diff.Merge(inf.signal.Diff(inp.signal))
+		minSignal = minSignal.Intersection(inf.signal)
+		minCover = cover.Intersection(minCover, inf.cover)
+		updateFlakes := !diff.Diff(flakes).Empty()
 		coverMu.RUnlock()
 		if updateFlakes {
 			coverMu.Lock()
-			flakes = cover.Union(flakes, diff)
+			flakes.Merge(diff)
 			coverMu.Unlock()
 		}
 	}
-	stableNewCover := cover.Intersection(newCover, minCover)
-	if len(stableNewCover) == 0 {
+	stableNewSignal := newSignal.Intersection(minSignal)
+	if notExecuted > triageRuns/2 || stableNewSignal.Empty() {
+		if inp.candidate {
+			// Coverage of the program has changed (e.g. with a new kernel build).
+			atomic.AddUint64(&statStaleCandidate, 1)
+		} else {
+			atomic.AddUint64(&statFlakyInput, 1)
+		}
 		return
 	}
-	inp.p, inp.call = prog.Minimize(inp.p, inp.call, func(p1 *prog.Prog, call1 int) bool {
-		allCover := execute1(pid, env, p1, &statExecMinimize)
-		coverMu.RLock()
-		defer coverMu.RUnlock()
+	if !inp.minimized {
+		inp.p, inp.call = prog.Minimize(inp.p, inp.call, func(p1 *prog.Prog, call1 int) bool {
+			info := exec(p1, &statExecMinimize)
+			coverMu.RLock()
+			defer coverMu.RUnlock()
 
-		if len(allCover[call1]) == 0 {
-			return false // The call was not executed.
-		}
-		cov := allCover[call1]
-		if len(cover.Intersection(stableNewCover, cov)) != len(stableNewCover) {
-			return false
-		}
-		minCover = cover.Intersection(minCover, cov)
-		return true
-	}, false)
+			inf := info[call1]
+			if inf.signal.Empty() {
+				return false // The call was not executed.
+			}
+			if !stableNewSignal.Diff(inf.signal).Empty() {
+				return false
+			}
+			minSignal = minSignal.Intersection(inf.signal)
+			minCover = cover.Intersection(minCover, inf.cover)
+			return true
+		}, false)
+	}
+	if inp.comps {
+		// Comparison executions don't collect coverage, but manager needs it.
+		minCover = execute1(pid, env, inp.p, &statExecTriage)[inp.call].cover
+	}
 	inp.cover = minCover
 
 	atomic.AddUint64(&statNewInput, 1)
 	data := inp.p.Serialize()
-	Logf(2, "added new input for %v to corpus:\n%s", call.CallName, data)
-	a := &NewInputArgs{*flagName, RpcInput{call.CallName, data, inp.call, []uint32(inp.cover)}}
-	if err := manager.Call("Manager.NewInput", a, nil); err != nil {
-		panic(err)
+	Logf(2, "added new input for %v to corpus:\n%s", call.Name, data)
+	newInputs <- RpcInput{call.Name, data, inp.call, []uint32(inp.cover)}
+	if len(newInputs) >= *flagRpcBatch {
+		select {
+		case needPoll <- struct{}{}:
+		default:
+		}
 	}
 
 	corpusMu.Lock()
-	defer corpusMu.Unlock()
 	coverMu.Lock()
-	defer coverMu.Unlock()
-
-	corpusCover[call.CallID] = cover.Union(corpusCover[call.CallID], minCover)
-	corpus = append(corpus, inp.p)
+	corpusSignal[call.CallID].Merge(minSignal)
+	addCorpusProgram(inp.p, inp.cover)
 	corpusHashes[hash(data)] = struct{}{}
+	coverMu.Unlock()
+	corpusMu.Unlock()
+
+	if !inp.candidate {
+		// Candidates are not new, they were smashed when they were first added to corpus.
+		smashInput(pid, env, ct, rnd, inp.p)
+	}
+}
+
+// smashInput subjects a new corpus input to a burst of focused work before
+// the proc returns to normal scheduling: new inputs are the most productive
+// mutation targets, and their error paths are not covered yet.
+func smashInput(pid int, env *ipc.Env, ct *prog.ChoiceTable, rnd *rand.Rand, p0 *prog.Prog) {
+	if faultEnabled {
+		for call := range p0.Calls {
+			failCall(pid, env, p0, call, &statExecFault)
+		}
+	}
+	if compsEnabled {
+		executeHintSeed(pid, env, p0)
+	}
+	for i := 0; i < smashMutations; i++ {
+		p := p0.Clone()
+		corpusMu.RLock()
+		p.Mutate(rnd, programLength, ct, corpusActive)
+		corpusMu.RUnlock()
+		Logf(1, "#%v: smash mutated: %s <- %s", i, p, p0)
+		execute(pid, env, p, &statExecSmash)
+		executeCollide(pid, env, rnd, p)
+	}
+}
+
+// failCall injects faults into consecutive fault sites of the call
+// until the call runs out of fault sites. The fault is attached to the call
+// as FailNth attribute, so new coverage of error paths is triaged with the fault
+// and corpus inputs that cover them reproduce it.
+func failCall(pid int, env *ipc.Env, p *prog.Prog, call int, stat *uint64) {
+	for nth := 1; nth <= smashFaults; nth++ {
+		p1 := p.Clone()
+		for _, c := range p1.Calls {
+			c.FailNth = 0
+		}
+		p1.Calls[call].FailNth = nth
+		info, _, injected := executeRaw(pid, env, p1, false, stat)
+		checkNewSignal(p1, info, false, false, false)
+		if !injected {
+			break
+		}
+	}
+}
+
+// faultCursor is the next corpus program and call for systematic fault injection.
+var faultCursor struct {
+	sync.Mutex
+	prog int
+	call int
+}
+
+// nextFaultCall returns the next call for systematic fault injection with -fault_corpus.
+// Calls of corpus programs are visited in order; once the whole corpus is visited,
+// the iteration starts over, since corpus programs were smashed with the coverage
+// known at the time of their triage and new error paths may be reachable now.
+func nextFaultCall() (*prog.Prog, int) {
+	corpusMu.RLock()
+	defer corpusMu.RUnlock()
+	if len(corpus) == 0 {
+		return nil, 0
+	}
+	faultCursor.Lock()
+	defer faultCursor.Unlock()
+	if faultCursor.prog >= len(corpus) {
+		faultCursor.prog = 0
+		faultCursor.call = 0
+	}
+	p := corpus[faultCursor.prog]
+	call := faultCursor.call
+	faultCursor.call++
+	if faultCursor.call >= len(p.Calls) {
+		faultCursor.prog++
+		faultCursor.call = 0
+	}
+	return p, call
+}
+
+// recheckCursor is the next corpus program to recheck with -recheck_corpus.
+var recheckCursor struct {
+	sync.Mutex
+	prog int
+}
+
+// nextRecheckProgram returns the next corpus program and its index for a recheck.
+// Programs are visited in order; once the whole corpus is visited, the iteration starts over,
+// so that programs that become flaky (or stable again) with time are noticed.
+func nextRecheckProgram() (int, *prog.Prog) {
+	corpusMu.RLock()
+	defer corpusMu.RUnlock()
+	if len(corpus) == 0 {
+		return 0, nil
+	}
+	recheckCursor.Lock()
+	defer recheckCursor.Unlock()
+	if recheckCursor.prog >= len(corpus) {
+		recheckCursor.prog = 0
+	}
+	idx := recheckCursor.prog
+	recheckCursor.prog++
+	return idx, corpus[idx]
+}
+
+// recheckProgram re-executes corpus program idx and updates its stability: the fraction of
+// its triaged coverage that is reproduced by all runs (in any call, the call is not remembered).
+// Programs with highly nondeterministic coverage waste triage and mutation time and lead
+// to unreproducible crashes, so they are chosen for mutation less often, and programs that
+// reproduce less than quarantineStability of their coverage are quarantined: they are not chosen
+// at all until a later recheck shows that they are stable again.
+func recheckProgram(pid int, env *ipc.Env, idx int, p *prog.Prog) {
+	corpusMu.RLock()
+	cov := corpusCovers[idx]
+	corpusMu.RUnlock()
+	if len(cov) == 0 {
+		return
+	}
+	stable := cov
+	for i := 0; i < recheckRuns; i++ {
+		var runCover cover.Cover
+		for _, inf := range execute1(pid, env, p, &statExecRecheck) {
+			runCover = cover.Union(runCover, inf.cover)
+		}
+		stable = cover.Intersection(stable, runCover)
+	}
+	// Stability is rounded down to 10%, so that weights are recalculated only on significant changes.
+	stability := math.Floor(10*float64(len(stable))/float64(len(cov))) / 10
+
+	corpusMu.Lock()
+	defer corpusMu.Unlock()
+	old := corpusStability[idx]
+	if old == stability {
+		return
+	}
+	corpusStability[idx] = stability
+	if stability < quarantineStability && old >= quarantineStability {
+		Logf(1, "quarantining corpus program %v: reproduced %v of %v PCs", idx, len(stable), len(cov))
+		atomic.AddUint64(&statQuarantined, 1)
+	}
+	updateCorpusWeights()
+}
+
+// executeHintSeed collects comparison operands during execution of p
+// and executes mutants of p that replace arguments with the compared values.
+func executeHintSeed(pid int, env *ipc.Env, p *prog.Prog) {
+	p = p.Clone() // MutateWithHints temporarily modifies the program.
+	info, comps, _ := executeRaw(pid, env, p, true, &statExecHints)
+	if signalComps {
+		checkNewSignal(p, info, true, false, false)
+	}
+	for call := range p.Calls {
+		if call >= len(comps) {
+			break
+		}
+		p.MutateWithHints(call, comps[call], func(p1 *prog.Prog) {
+			Logf(1, "hint mutated: %s", p1)
+			execute(pid, env, p1, &statExecHints)
+		})
+	}
+}
+
+// executeCollide re-executes p with pairs of calls running concurrently to provoke data races.
+// Coverage of collided executions is not stable, so it is not triaged.
+func executeCollide(pid int, env *ipc.Env, rnd *rand.Rand, p *prog.Prog) {
+	if !collideEnabled {
+		return
+	}
+	executeRaw(pid, env, p.Collide(rnd), false, &statExecCollide)
 }
 
 func execute(pid int, env *ipc.Env, p *prog.Prog, stat *uint64) {
-	allCover := execute1(pid, env, p, stat)
+	if executedRecently(p) {
+		atomic.AddUint64(&statDuplicate, 1)
+		return
+	}
+	checkNewSignal(p, execute1(pid, env, p, stat), false, false, false)
+}
+
+// executedRecently says if p is an exact duplicate of one of the last -dedup_window programs
+// passed to it, and remembers p otherwise. Programs are compared after sanitization
+// (mutation and generation sanitize them), so they are compared in the form they are executed.
+// Provenance comments differ between otherwise identical programs, so they are not hashed.
+func executedRecently(p *prog.Prog) bool {
+	window := *flagDedupWindow
+	if window <= 0 {
+		return false
+	}
+	return seenRecently(hash(p.SerializeNoComments()), window)
+}
+
+// seenRecently says if sig is among the last window signatures passed to it,
+// and remembers sig otherwise evicting the oldest one.
+func seenRecently(sig Sig, window int) bool {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	if _, ok := recentHashes[sig]; ok {
+		return true
+	}
+	if len(recentRing) < window {
+		recentRing = append(recentRing, sig)
+	} else {
+		delete(recentHashes, recentRing[recentPos])
+		recentRing[recentPos] = sig
+		recentPos = (recentPos + 1) % window
+	}
+	recentHashes[sig] = struct{}{}
+	return false
+}
+
+// checkNewSignal queues calls of p that produced new signal for triage.
+// comps says that info comes from an execution that collected comparisons,
+// candidate and minimized are propagated to the queued inputs.
+func checkNewSignal(p *prog.Prog, info []CallInfo, comps, candidate, minimized bool) {
 	coverMu.RLock()
 	defer coverMu.RUnlock()
-	for i, cov := range allCover {
-		if len(cov) == 0 {
+	for i, inf := range info {
+		if inf.signal.Empty() {
 			continue
 		}
 		c := p.Calls[i].Meta
-		diff := cover.Difference(cov, maxCover[c.CallID])
-		diff = cover.Difference(diff, flakes)
-		if len(diff) != 0 {
-			coverMu.RUnlock()
-			coverMu.Lock()
-			maxCover[c.CallID] = cover.Union(maxCover[c.CallID], diff)
-			coverMu.Unlock()
-			coverMu.RLock()
+		diff := inf.signal.Diff(maxSignal[c.CallID]).Diff(flakes)
+		if diff.Empty() {
+			continue
+		}
+		coverMu.RUnlock()
+		coverMu.Lock()
+		maxSignal[c.CallID].Merge(diff)
+		if newCover := cover.Difference(inf.cover, maxCover[c.CallID]); len(newCover) != 0 {
+			maxCover[c.CallID] = cover.Union(maxCover[c.CallID], newCover)
+			newMaxCover[c.CallID] = cover.Union(newMaxCover[c.CallID], newCover)
+		}
+		coverMu.Unlock()
+		coverMu.RLock()
 
-			inp := Input{p.Clone(), i, cover.Copy(cov)}
-			triageMu.Lock()
-			triage = append(triage, inp)
-			triageMu.Unlock()
+		inp := Input{
+			p:         corpusClone(p),
+			call:      i,
+			cover:     cover.Copy(inf.cover),
+			signal:    inf.signal.Copy(),
+			prio:      diff.MaxPrio(),
+			comps:     comps,
+			candidate: candidate,
+			minimized: minimized,
 		}
+		triageMu.Lock()
+		triage = append(triage, inp)
+		triageMu.Unlock()
 	}
 }
 
+// corpusClone returns a copy of p to be triaged for corpus,
+// provenance comments are relevant only for the log of the executed program.
+func corpusClone(p *prog.Prog) *prog.Prog {
+	p = p.Clone()
+	if *flagProvenance {
+		for _, c := range p.Calls {
+			c.Comment = ""
+		}
+	}
+	return p
+}
+
 var logMu sync.Mutex
 
-func execute1(pid int, env *ipc.Env, p *prog.Prog, stat *uint64) []cover.Cover {
+func execute1(pid int, env *ipc.Env, p *prog.Prog, stat *uint64) []CallInfo {
+	info, _, _ := executeRaw(pid, env, p, false, stat)
+	return info
+}
+
+// executeRaw executes p and returns per-call coverage and signal (or comparison operands
+// and their signal if comps is set) and whether the fault requested by FailNth attribute
+// of a call was injected.
+func executeRaw(pid int, env *ipc.Env, p *prog.Prog, comps bool, stat *uint64) ([]CallInfo, []prog.CompMap, bool) {
 	if false {
 		// For debugging, this function must not be executed with locks held.
 		corpusMu.Lock()
@@ -495,6 +1376,13 @@ func execute1(pid int, env *ipc.Env, p *prog.Prog, stat *uint64) []cover.Cover {
 	// Limit concurrency window and do leak checking once in a while.
 	idx := gate.Enter()
 	defer gate.Leave(idx)
+	orig := p
+	if len(postProcessors) != 0 {
+		p = postProcess(p)
+	}
+	if *flagLeak {
+		noteLeakProgram(pid, p)
+	}
 
 	// The following output helps to understand what program crashed kernel.
 	// It must not be intermixed.
@@ -504,13 +1392,13 @@ func execute1(pid int, env *ipc.Env, p *prog.Prog, stat *uint64) []cover.Cover {
 	case "stdout":
 		data := p.Serialize()
 		logMu.Lock()
-		Logf(0, "executing program %v:\n%s", pid, data)
+		Logf(0, "%s%s", prog.LogHeader(pid, time.Now()), data)
 		logMu.Unlock()
 	case "dmesg":
 		fd, err := syscall.Open("/dev/kmsg", syscall.O_WRONLY, 0)
 		if err == nil {
 			buf := new(bytes.Buffer)
-			fmt.Fprintf(buf, "syzkaller: executing program %v:\n%s", pid, p.Serialize())
+			fmt.Fprintf(buf, "syzkaller: %s%s", prog.LogHeader(pid, time.Now()), p.Serialize())
 			syscall.Write(fd, buf.Bytes())
 			syscall.Close(fd)
 		}
@@ -522,40 +1410,99 @@ func execute1(pid int, env *ipc.Env, p *prog.Prog, stat *uint64) []cover.Cover {
 		}
 	}
 
-	try := 0
-retry:
 	atomic.AddUint64(stat, 1)
-	output, rawCover, errnos, failed, hanged, err := env.Exec(p)
-	_ = errnos
+	var output []byte
+	var rawCover [][]uint32
+	var rawComps []prog.CompMap
+	var errnos []int
+	var faultInjected, failed, hanged bool
+	var err error
+	if comps {
+		output, rawComps, failed, hanged, err = env.ExecComps(p)
+	} else {
+		output, rawCover, errnos, faultInjected, failed, hanged, err = env.ExecFault(p, -1, 0)
+	}
 	if failed {
 		// BUG in output should be recognized by manager.
 		Logf(0, "BUG: executor-detected bug:\n%s", output)
-		// Don't return any cover so that the input is not added to corpus.
-		return make([]cover.Cover, len(p.Calls))
+		// Don't return any signal so that the input is not added to corpus.
+		return make([]CallInfo, len(orig.Calls)), nil, false
+	}
+	if hanged {
+		execLog.Logf(1, "program hanged: %v", err)
+		return make([]CallInfo, len(orig.Calls)), nil, false
+	}
+	if err == ipc.FaultDisabledErr {
+		// Inputs are stripped of faults on arrival (see stripFaults), but don't crash
+		// the fuzzer on the VM because of a program that slipped through.
+		Logf(0, "dropping program that requests a fault: %v", err)
+		return make([]CallInfo, len(orig.Calls)), nil, false
 	}
 	if err != nil {
-		if _, ok := err.(ipc.ExecutorFailure); ok || try > 10 {
-			panic(err)
+		// Transient errors are already retried by env according to the exec policy.
+		panic(err)
+	}
+	execLog.Logf(2, "result failed=%v hanged=%v:\n%v\n", failed, hanged, string(output))
+	if extraCoverEnabled && !comps {
+		addExtraCover(env, rawCover)
+	}
+	if errnos != nil {
+		noteErrnos(p, errnos)
+	}
+	info := make([]CallInfo, len(p.Calls))
+	if signalComps {
+		for i, c := range rawComps {
+			info[i].signal = signal.FromComps(c)
 		}
-		try++
-		Logf(4, "fuzzer detected executor failure='%v', retrying #%d\n", err, (try + 1))
-		debug.FreeOSMemory()
-		time.Sleep(time.Second)
-		goto retry
 	}
-	Logf(2, "result failed=%v hanged=%v:\n%v\n", failed, hanged, string(output))
-	cov := make([]cover.Cover, len(p.Calls))
 	for i, c := range rawCover {
-		cov[i] = cover.Cover(c)
+		cov := cover.Cover(c)
+		if len(coverFilter) != 0 && coverFilterWeight == 0 {
+			// Coverage outside of the selected code is ignored.
+			cov = filterCover(cov)
+		}
+		// Edges need the execution order, so signal is computed before canonicalization.
+		if signalEdges {
+			info[i].signal = signal.FromEdges(cov)
+		}
+		cov = cover.Canonicalize(cov)
+		if signalPCs {
+			info[i].signal.Merge(signal.FromPCs(cov))
+		}
+		info[i].cover = cov
+	}
+	if p != orig {
+		info, rawComps = mapCallInfo(orig, p, info, rawComps)
+	}
+	return info, rawComps, faultInjected
+}
+
+// addExtraCover attributes coverage of kernel background threads collected during
+// the last execution in env to the last executed call (background work is most likely
+// started by one of the calls, and the last call is the one that is kept during minimization).
+func addExtraCover(env *ipc.Env, rawCover [][]uint32) {
+	last := -1
+	for i, c := range rawCover {
+		if c != nil {
+			last = i
+		}
+	}
+	for sub, extra := range env.ExtraCover {
+		if len(extra) == 0 {
+			continue
+		}
+		atomic.AddUint64(&statExtraCover[sub], 1)
+		if last != -1 {
+			rawCover[last] = append(rawCover[last], extra...)
+		}
 	}
-	return cov
 }
 
 func kmemleakInit() {
 	fd, err := syscall.Open("/sys/kernel/debug/kmemleak", syscall.O_RDWR, 0)
 	if err != nil {
 		if *flagLeak {
-			Fatalf("BUG: /sys/kernel/debug/kmemleak is missing (%v). Enable CONFIG_KMEMLEAK and mount debugfs.", err)
+			Fatalf("BUG: /sys/kernel/debug/kmemleak is missing (%v). Enable CONFIG_DEBUG_KMEMLEAK and mount debugfs.", err)
 		} else {
 			return
 		}
@@ -573,7 +1520,50 @@ func kmemleakInit() {
 	}
 }
 
-var kmemleakBuf []byte
+var (
+	kmemleakBuf  []byte
+	lastLeakScan time.Time
+
+	// Programs executed since the last and the previous leak scans.
+	// kmemleak reports objects only after they stay unreferenced for a while
+	// and across two scans, so a leak can be caused by a program from either batch.
+	leakMu       sync.Mutex
+	leakPrograms [2][][]byte
+)
+
+// maxLeakPrograms is the max number of programs remembered per scan period.
+const maxLeakPrograms = 100
+
+func noteLeakProgram(pid int, p *prog.Prog) {
+	data := []byte(fmt.Sprintf("proc %v:\n%s", pid, p.Serialize()))
+	leakMu.Lock()
+	progs := append(leakPrograms[1], data)
+	if len(progs) > maxLeakPrograms {
+		progs = progs[1:]
+	}
+	leakPrograms[1] = progs
+	leakMu.Unlock()
+}
+
+// reportLeakPrograms prints the programs that could cause the reported leaks.
+func reportLeakPrograms() {
+	leakMu.Lock()
+	defer leakMu.Unlock()
+	progs := append(append([][]byte{}, leakPrograms[0]...), leakPrograms[1]...)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "leak can be caused by one of %v recently executed programs:\n", len(progs))
+	for i, data := range progs {
+		fmt.Fprintf(buf, "recent program #%v %s\n", i, data)
+	}
+	Logf(0, "%s", buf.Bytes())
+}
+
+// rotateLeakPrograms starts a new scan period.
+func rotateLeakPrograms() {
+	leakMu.Lock()
+	leakPrograms[0], leakPrograms[1] = leakPrograms[1], nil
+	leakMu.Unlock()
+}
 
 func kmemleakScan(report bool) {
 	fd, err := syscall.Open("/sys/kernel/debug/kmemleak", syscall.O_RDWR, 0)
@@ -615,11 +1605,13 @@ func kmemleakScan(report bool) {
 			}
 			if n != 0 {
 				// BUG in output should be recognized by manager.
-				Logf(0, "BUG: memory leak:\n%s\n", kmemleakBuf[:n])
+				Logf(0, "BUG: memory leak\n%s\n", kmemleakBuf[:n])
+				reportLeakPrograms()
 			}
 		}
 	}
 	if _, err := syscall.Write(fd, []byte("clear")); err != nil {
 		panic(err)
 	}
+	rotateLeakPrograms()
 }
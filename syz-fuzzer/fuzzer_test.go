@@ -0,0 +1,38 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSeenRecently(t *testing.T) {
+	recentHashes = make(map[Sig]struct{})
+	recentRing = nil
+	recentPos = 0
+	sig := func(v byte) Sig { return Sig{v} }
+	steps := []struct {
+		sig  byte
+		want bool
+	}{
+		{1, false},
+		{2, false},
+		{1, true},
+		{3, false}, // evicts 1
+		{2, true},
+		{1, false}, // evicts 2
+		{3, true},
+		{2, false}, // evicts 3
+		{1, true},
+		{3, false},
+	}
+	for i, step := range steps {
+		if got := seenRecently(sig(step.sig), 2); got != step.want {
+			t.Fatalf("step #%v: seenRecently(%v) = %v, want %v", i, step.sig, got, step.want)
+		}
+	}
+	if len(recentRing) != 2 || len(recentHashes) != 2 {
+		t.Fatalf("ring has %v entries and %v hashes, want 2", len(recentRing), len(recentHashes))
+	}
+}
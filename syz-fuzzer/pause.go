@@ -0,0 +1,61 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/google/syzkaller/ipc"
+	. "github.com/google/syzkaller/log"
+)
+
+// Manager can pause fuzzing (see PollRes.Paused): procs finish the current program
+// (or triage of the current input) and wait until the manager resumes fuzzing,
+// executor processes and the VM are kept.
+var (
+	pauseMu sync.Mutex
+	resumed chan struct{} // closed when fuzzing is resumed, nil if fuzzing is not paused
+)
+
+func setPaused(paused bool) {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	switch {
+	case paused && resumed == nil:
+		Logf(0, "fuzzing paused by manager")
+		resumed = make(chan struct{})
+	case !paused && resumed != nil:
+		Logf(0, "fuzzing resumed by manager")
+		close(resumed)
+		resumed = nil
+	}
+}
+
+func isPaused() bool {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	return resumed != nil
+}
+
+// waitResumed blocks while fuzzing is paused.
+func waitResumed() {
+	pauseMu.Lock()
+	ch := resumed
+	pauseMu.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
+
+// emergencyStop halts all executions right away (see PollRes.Stop): procs are paused,
+// executor processes are killed in the middle of programs and the fuzzer exits.
+func emergencyStop(envs []*ipc.Env) {
+	Logf(0, "emergency stop requested by manager, killing executors")
+	setPaused(true)
+	for _, env := range envs {
+		env.Kill()
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,200 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"plugin"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/prog"
+)
+
+// PostProcessor rewrites programs right before they are executed (see -postproc flag),
+// e.g. injects logging calls or forces sandbox-relevant arguments for an experiment.
+// The returned program is executed and logged instead of p. Calls of p should be kept
+// in the same order: coverage of the executed program is attributed back to calls of p
+// by matching call names (see mapCalls), calls added by a post-processor get no coverage.
+type PostProcessor interface {
+	Process(p *prog.Prog) (*prog.Prog, error)
+}
+
+var postProcessors []PostProcessor
+
+// initPostProcessors parses -postproc flag value: a comma-separated list of
+// plugin:file.so (a Go plugin that exports PostProcess, see pluginPostProcessor)
+// and cmd:binary (a subprocess, see cmdPostProcessor) that are applied in order.
+func initPostProcessors(flag string) error {
+	if flag == "" {
+		return nil
+	}
+	for _, spec := range strings.Split(flag, ",") {
+		colon := strings.IndexByte(spec, ':')
+		if colon == -1 {
+			return fmt.Errorf("bad post-processor %q, want plugin:file or cmd:file", spec)
+		}
+		var pp PostProcessor
+		var err error
+		switch kind, file := spec[:colon], spec[colon+1:]; kind {
+		case "plugin":
+			pp, err = newPluginPostProcessor(file)
+		case "cmd":
+			pp, err = newCmdPostProcessor(file)
+		default:
+			err = fmt.Errorf("unknown post-processor kind %q, want plugin or cmd", kind)
+		}
+		if err != nil {
+			return err
+		}
+		postProcessors = append(postProcessors, pp)
+	}
+	return nil
+}
+
+// postProcess returns p rewritten by all post-processors. A failing post-processor
+// is skipped, so that a buggy experiment does not stop fuzzing.
+func postProcess(p *prog.Prog) *prog.Prog {
+	for _, pp := range postProcessors {
+		p1, err := pp.Process(p)
+		if err != nil {
+			Logf(0, "post-processor failed: %v", err)
+			continue
+		}
+		if p1 != nil {
+			p = p1
+		}
+	}
+	return p
+}
+
+// mapCalls returns indices of calls of p1 that correspond to calls of p0 (-1 if p1 has no such call),
+// p1 is p0 rewritten by post-processors, calls are matched by names in order.
+func mapCalls(p0, p1 *prog.Prog) []int {
+	res := make([]int, len(p0.Calls))
+	j := 0
+	for i, c := range p0.Calls {
+		res[i] = -1
+		for k := j; k < len(p1.Calls); k++ {
+			if p1.Calls[k].Meta == c.Meta {
+				res[i] = k
+				j = k + 1
+				break
+			}
+		}
+	}
+	return res
+}
+
+// pluginPostProcessor calls PostProcess function exported by a Go plugin:
+//
+//	func PostProcess(p *prog.Prog) (*prog.Prog, error)
+//
+// The plugin must be built with the same syzkaller sources as the fuzzer
+// (go build -buildmode=plugin), it is called concurrently by all procs.
+type pluginPostProcessor struct {
+	fn func(p *prog.Prog) (*prog.Prog, error)
+}
+
+func newPluginPostProcessor(file string) (PostProcessor, error) {
+	plug, err := plugin.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load post-processor plugin: %v", err)
+	}
+	sym, err := plug.Lookup("PostProcess")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load post-processor plugin: %v", err)
+	}
+	fn, ok := sym.(func(p *prog.Prog) (*prog.Prog, error))
+	if !ok {
+		return nil, fmt.Errorf("post-processor plugin %v: PostProcess has wrong type %T", file, sym)
+	}
+	return &pluginPostProcessor{fn}, nil
+}
+
+func (pp *pluginPostProcessor) Process(p *prog.Prog) (*prog.Prog, error) {
+	return pp.fn(p.Clone())
+}
+
+// cmdPostProcessor sends programs to a long-running subprocess and reads back rewritten programs.
+// Both requests (on stdin) and replies (on stdout) are a line with the decimal length of
+// the serialized program followed by the program, a reply of length 0 keeps the program unchanged.
+// Stderr of the subprocess goes to the fuzzer output. Requests are sent one at a time.
+type cmdPostProcessor struct {
+	mu  sync.Mutex
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+func newCmdPostProcessor(file string) (PostProcessor, error) {
+	cmd := exec.Command(file)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start post-processor: %v", err)
+	}
+	return &cmdPostProcessor{cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+func (pp *cmdPostProcessor) Process(p *prog.Prog) (*prog.Prog, error) {
+	data := p.Serialize()
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if _, err := fmt.Fprintf(pp.in, "%v\n%s", len(data), data); err != nil {
+		return nil, fmt.Errorf("failed to write to %v: %v", pp.cmd.Path, err)
+	}
+	line, err := pp.out.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from %v: %v", pp.cmd.Path, err)
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(line), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad reply length from %v: %q", pp.cmd.Path, line)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	reply := make([]byte, n)
+	if _, err := io.ReadFull(pp.out, reply); err != nil {
+		return nil, fmt.Errorf("failed to read from %v: %v", pp.cmd.Path, err)
+	}
+	p1, err := prog.Deserialize(reply)
+	if err != nil {
+		return nil, fmt.Errorf("bad program from %v: %v\n%s", pp.cmd.Path, err, reply)
+	}
+	return p1, nil
+}
+
+// mapCallInfo converts results of execution of post-processed program p1 to results of calls of p0.
+func mapCallInfo(p0, p1 *prog.Prog, info []CallInfo, comps []prog.CompMap) ([]CallInfo, []prog.CompMap) {
+	info0 := make([]CallInfo, len(p0.Calls))
+	var comps0 []prog.CompMap
+	if comps != nil {
+		comps0 = make([]prog.CompMap, len(p0.Calls))
+	}
+	for i, j := range mapCalls(p0, p1) {
+		if j == -1 {
+			continue
+		}
+		info0[i] = info[j]
+		if j < len(comps) {
+			comps0[i] = comps[j]
+		}
+	}
+	return info0, comps0
+}
@@ -129,7 +129,9 @@ func (st *State) Connect(name string, fresh bool, calls []string, corpus [][]byt
 	st.seq++
 	mgr := st.Managers[name]
 	if mgr == nil {
-		mgr = new(Manager)
+		mgr = &Manager{
+			name: name,
+		}
 		st.Managers[name] = mgr
 		mgr.dir = filepath.Join(st.dir, "manager", name)
 		os.MkdirAll(mgr.dir, 0700)
@@ -25,3 +25,53 @@ func TestState(t *testing.T) {
 		t.Fatalf("synced with unconnected manager")
 	}
 }
+
+func TestStateCallFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-hub-state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := Make(dir)
+	if err != nil {
+		t.Fatalf("failed to make state: %v", err)
+	}
+	if err := st.Connect("foo", false, []string{"open", "read"}, nil); err != nil {
+		t.Fatalf("failed to connect foo: %v", err)
+	}
+	if err := st.Connect("bar", false, []string{"open"}, nil); err != nil {
+		t.Fatalf("failed to connect bar: %v", err)
+	}
+	progOpen := []byte("open()\n")
+	progRead := []byte("r0 = open()\nread(r0)\n")
+	inputs, err := st.Sync("foo", [][]byte{progOpen, progRead}, nil)
+	if err != nil {
+		t.Fatalf("failed to sync foo: %v", err)
+	}
+	if len(inputs) != 0 {
+		t.Fatalf("foo got its own inputs back: %q", inputs)
+	}
+	inputs, err = st.Sync("bar", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to sync bar: %v", err)
+	}
+	if len(inputs) != 1 || string(inputs[0]) != string(progOpen) {
+		t.Fatalf("bar got wrong inputs: %q, want only %q", inputs, progOpen)
+	}
+	inputs, err = st.Sync("bar", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to sync bar: %v", err)
+	}
+	if len(inputs) != 0 {
+		t.Fatalf("bar got inputs twice: %q", inputs)
+	}
+
+	st, err = Make(dir)
+	if err != nil {
+		t.Fatalf("failed to restore state: %v", err)
+	}
+	if len(st.Corpus) != 2 {
+		t.Fatalf("restored corpus has %v inputs, want 2", len(st.Corpus))
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/google/syzkaller/rpctype"
+)
+
+// httpAPISummary serves stats and crashes of the manager as ManagerSummary JSON
+// for aggregators of several managers (see tools/syz-federation).
+func (mgr *Manager) httpAPISummary(w http.ResponseWriter, r *http.Request) {
+	stats := mgr.collectStats()
+	crashes, err := mgr.collectCrashes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to collect crashes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	res := &ManagerSummary{
+		Name:  mgr.cfg.Name,
+		Tag:   mgr.cfg.Tag,
+		Stats: stats,
+	}
+	for _, ct := range crashes {
+		res.Crashes = append(res.Crashes, CrashSummary{
+			Description: ct.Description,
+			ID:          ct.ID,
+			Type:        ct.Type,
+			Severity:    int(ct.Severity),
+			Count:       ct.Count,
+			First:       ct.first,
+			Last:        ct.last,
+			Triaged:     ct.Triaged,
+			Suppressed:  ct.Suppressed,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode summary: %v", err), http.StatusInternalServerError)
+	}
+}
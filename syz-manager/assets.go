@@ -0,0 +1,114 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/syzkaller/config"
+	"github.com/google/syzkaller/fileutil"
+	. "github.com/google/syzkaller/log"
+)
+
+// Asset is a kernel build artifact the manager runs with.
+type Asset struct {
+	Name string // vmlinux, kernel, initrd, image or config
+	Hash string // sha1 of the contents
+	Path string // archived copy in workdir/assets, or the original file if copies are not requested
+}
+
+// initAssets hashes (and, if requested, archives) kernel build artifacts
+// so that crashes remain symbolizable and reproducible after the kernel tree moves on.
+// This is done on start, because artifacts can be rebuilt while the manager runs.
+// Archived copies are content-addressed, so identical artifacts are stored only once.
+func initAssets(cfg *config.Config) ([]Asset, error) {
+	files := []struct {
+		name     string
+		path     string
+		optional bool
+	}{
+		{"vmlinux", cfg.Vmlinux, false},
+		// These are not necessarily local files (e.g. image is an image name for gce).
+		{"kernel", cfg.Kernel, true},
+		{"initrd", cfg.Initrd, true},
+		{"image", cfg.Image, true},
+		{"config", filepath.Join(filepath.Dir(cfg.Vmlinux), ".config"), true},
+	}
+	var assets []Asset
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		fi, err := os.Stat(f.path)
+		if err != nil {
+			if f.optional {
+				continue
+			}
+			return nil, fmt.Errorf("failed to archive %v: %v", f.name, err)
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		sig, err := hashFile(f.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to archive %v: %v", f.name, err)
+		}
+		asset := Asset{
+			Name: f.name,
+			Hash: sig,
+			Path: f.path,
+		}
+		if cfg.Crash_Assets == "copy" {
+			dir := filepath.Join(cfg.Workdir, "assets", sig)
+			archived := filepath.Join(dir, f.name)
+			if _, err := os.Stat(archived); err != nil {
+				Logf(0, "archiving %v to %v", f.path, dir)
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					return nil, fmt.Errorf("failed to create assets dir: %v", err)
+				}
+				// Copy to a temp file first, so that an interrupted copy is not mistaken for an archived asset.
+				tmp := archived + ".tmp"
+				if err := fileutil.CopyFile(f.path, tmp, false); err != nil {
+					os.Remove(tmp)
+					return nil, fmt.Errorf("failed to archive %v: %v", f.name, err)
+				}
+				if err := os.Rename(tmp, archived); err != nil {
+					return nil, fmt.Errorf("failed to archive %v: %v", f.name, err)
+				}
+			}
+			asset.Path = archived
+		}
+		assets = append(assets, asset)
+	}
+	return assets, nil
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// formatAssets formats assets for assetsN files in crash dirs, one asset per line:
+// "vmlinux 0f3a... /workdir/assets/0f3a.../vmlinux".
+func formatAssets(assets []Asset) []byte {
+	buf := new(bytes.Buffer)
+	for _, a := range assets {
+		fmt.Fprintf(buf, "%v %v %v\n", a.Name, a.Hash, a.Path)
+	}
+	return buf.Bytes()
+}
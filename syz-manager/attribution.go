@@ -0,0 +1,145 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+
+	"github.com/google/syzkaller/sys"
+)
+
+// coverAttribution attributes every covered PC to the syscall whose corpus input covered it first,
+// i.e. the call the input was triaged for. Together with the number of executions of calls
+// (see mgr.errnos) it shows which descriptions pay off and which only burn executions.
+type coverAttribution struct {
+	covered map[uint32]bool // PCs covered by corpus inputs
+	pcs     []int           // call ID -> number of PCs attributed to the call
+	inputs  []int           // call ID -> number of corpus inputs that contributed new PCs
+}
+
+func newCoverAttribution() *coverAttribution {
+	return &coverAttribution{
+		covered: make(map[uint32]bool),
+		pcs:     make([]int, sys.CallCount),
+		inputs:  make([]int, sys.CallCount),
+	}
+}
+
+// add attributes PCs of cov that are not covered yet to call.
+func (ca *coverAttribution) add(call int, cov []uint32) {
+	n := 0
+	for _, pc := range cov {
+		if !ca.covered[pc] {
+			ca.covered[pc] = true
+			n++
+		}
+	}
+	if n != 0 {
+		ca.pcs[call] += n
+		ca.inputs[call]++
+	}
+}
+
+// attributionReport returns all executed or attributed calls, the calls that contributed
+// the most PCs per execution first, calls that were executed but contributed nothing last.
+// Requires mgr.mu.
+func (mgr *Manager) attributionReport() []UIAttributedCall {
+	var res []UIAttributedCall
+	for call, meta := range sys.Calls {
+		c := UIAttributedCall{
+			Name:   meta.Name,
+			Cover:  mgr.attribution.pcs[call],
+			Inputs: mgr.attribution.inputs[call],
+		}
+		for _, n := range mgr.errnos[meta.Name] {
+			c.Execs += n
+		}
+		if c.Cover == 0 && c.Execs == 0 {
+			continue
+		}
+		if c.Execs != 0 {
+			c.PerMillion = float64(c.Cover) * 1e6 / float64(c.Execs)
+		}
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].PerMillion != res[j].PerMillion {
+			return res[i].PerMillion > res[j].PerMillion
+		}
+		if res[i].Cover != res[j].Cover {
+			return res[i].Cover > res[j].Cover
+		}
+		return res[i].Execs < res[j].Execs
+	})
+	return res
+}
+
+// httpAttribution ranks syscalls by coverage they contributed versus executions spent on them.
+func (mgr *Manager) httpAttribution(w http.ResponseWriter, r *http.Request) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	data := &UIAttributionData{
+		Name:    mgr.cfg.Name,
+		Covered: len(mgr.attribution.covered),
+		Calls:   mgr.attributionReport(),
+	}
+	if err := attributionTemplate.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+type UIAttributionData struct {
+	Name    string
+	Covered int
+	Calls   []UIAttributedCall
+}
+
+type UIAttributedCall struct {
+	Name       string
+	Cover      int     // PCs first covered by inputs triaged for the call
+	Inputs     int     // inputs of the call that contributed new PCs
+	Execs      uint64  // executions of the call (without fault injection)
+	PerMillion float64 // Cover per million of Execs
+}
+
+var attributionTemplate = template.Must(template.New("").Parse(addStyle(`
+<!doctype html>
+<html>
+<head>
+	<title>{{.Name }} syzkaller coverage attribution</title>
+	{{STYLE}}
+</head>
+<body>
+<b>{{.Name }} syzkaller coverage attribution</b>
+<br>
+Every covered PC ({{.Covered}} total) is attributed to the call that covered it first.
+Calls that are executed a lot but contribute little coverage are the best candidates for better descriptions.
+<br>
+<br>
+
+<table>
+	<tr>
+		<th>Call</th>
+		<th>Attributed cover</th>
+		<th>Inputs</th>
+		<th>Executed</th>
+		<th>Cover per 1M execs</th>
+	</tr>
+	{{range $c := $.Calls}}
+	<tr>
+		<td><a href="/corpus?call={{$c.Name}}">{{$c.Name}}</a></td>
+		<td>{{$c.Cover}}</td>
+		<td>{{$c.Inputs}}</td>
+		<td>{{$c.Execs}}</td>
+		<td>{{printf "%.1f" $c.PerMillion}}</td>
+	</tr>
+	{{end}}
+</table>
+</body></html>
+`)))
@@ -0,0 +1,101 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/vm"
+)
+
+const (
+	// Boots of VMs started at the same time (e.g. on manager start) are spread this far apart,
+	// so that they don't compete for host CPU, disk and network all at once.
+	bootStagger = 2 * time.Second
+	// VM that failed to boot is retried after this delay.
+	bootRetryDelay = 10 * time.Second
+	// VM that failed to boot this many times in a row is quarantined.
+	quarantineFailures = 3
+	// Quarantine period doubles with every next failure from min to max.
+	quarantineMin = time.Minute
+	quarantineMax = time.Hour
+)
+
+// bootScheduler staggers VM boots and keeps VMs that repeatedly fail to boot (bad host,
+// broken image) from restarting in a hot loop, which would hide the loss of throughput.
+type bootScheduler struct {
+	mu          sync.Mutex
+	next        time.Time         // the next boot can't start earlier
+	failures    map[int]int       // number of consecutive boot failures per VM index
+	quarantined map[int]time.Time // VM indexes in quarantine and when it ends
+}
+
+func newBootScheduler() *bootScheduler {
+	return &bootScheduler{
+		failures:    make(map[int]int),
+		quarantined: make(map[int]time.Time),
+	}
+}
+
+// delay reserves a boot slot and returns how long the boot must be delayed.
+func (s *bootScheduler) delay() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.next.Before(now) {
+		s.next = now
+	}
+	delay := s.next.Sub(now)
+	s.next = s.next.Add(bootStagger)
+	return delay
+}
+
+// result records the outcome of a VM run (err is non-nil if the VM failed to boot)
+// and returns how long the VM must wait before the next boot, and whether it is quarantined.
+func (s *bootScheduler) result(index int, err error) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.quarantined, index)
+	if err == nil {
+		delete(s.failures, index)
+		return 0, false
+	}
+	s.failures[index]++
+	failures := s.failures[index]
+	if failures < quarantineFailures {
+		return bootRetryDelay, false
+	}
+	backoff := quarantineMin
+	for i := quarantineFailures; i < failures && backoff < quarantineMax; i++ {
+		backoff *= 2
+	}
+	if backoff > quarantineMax {
+		backoff = quarantineMax
+	}
+	s.quarantined[index] = time.Now().Add(backoff)
+	return backoff, true
+}
+
+// quarantinedVMs returns the number of VMs in quarantine.
+func (s *bootScheduler) quarantinedVMs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.quarantined)
+}
+
+// waitBoot waits for the delay before a boot, it returns false if the VM is stopped meanwhile.
+func waitBoot(delay time.Duration, stop <-chan bool) bool {
+	if delay == 0 {
+		return true
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-stop:
+		return false
+	case <-vm.Shutdown:
+		return false
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/syzkaller/prog"
+	. "github.com/google/syzkaller/rpctype"
+)
+
+// candidate is a queued RpcCandidate with its calls, so that the queue can be reordered
+// without deserializing the programs again.
+type candidate struct {
+	RpcCandidate
+	calls []string // distinct calls of the program
+	size  int      // number of calls of the program
+}
+
+func newCandidate(inp RpcCandidate, p *prog.Prog) candidate {
+	cand := candidate{RpcCandidate: inp, size: len(p.Calls)}
+	seen := make(map[string]bool)
+	for _, c := range p.Calls {
+		if !seen[c.Meta.Name] {
+			seen[c.Meta.Name] = true
+			cand.calls = append(cand.calls, c.Meta.Name)
+		}
+	}
+	return cand
+}
+
+// prioritizeCandidates orders candidate queues so that candidates that are estimated to give
+// the most new signal are handed out to fuzzers first (Poll takes candidates from the end).
+// It's called when new candidates are queued. Must be called with mgr.mu held.
+func (mgr *Manager) prioritizeCandidates() {
+	counts := make(map[string]int)
+	for call, inputs := range mgr.corpusIdx.byCalls {
+		counts[call] = len(inputs)
+	}
+	sortCandidates(mgr.candidates, counts)
+	if mgr.compare != nil {
+		sortCandidates(mgr.compare.candidates, counts)
+	}
+}
+
+// sortCandidates sorts candidates by increasing candidateScore.
+// counts holds the number of corpus inputs that contain every call,
+// calls of the candidates are added to it.
+func sortCandidates(cands []candidate, counts map[string]int) {
+	for _, cand := range cands {
+		for _, c := range cand.calls {
+			counts[c]++
+		}
+	}
+	scores := make([]float64, len(cands))
+	for i, cand := range cands {
+		scores[i] = candidateScore(cand.calls, cand.size, counts)
+	}
+	sort.Sort(&candidateSorter{cands, scores})
+}
+
+// candidateScore estimates how much new signal triage of a program of size calls
+// with the distinct calls gives: calls that are rare in the corpus and in the queue
+// are more likely to give new signal, smaller programs are cheaper to triage.
+func candidateScore(calls []string, size int, counts map[string]int) float64 {
+	score := 0.0
+	for _, c := range calls {
+		score += 1 / float64(counts[c])
+	}
+	return score / (1 + 0.1*float64(size))
+}
+
+type candidateSorter struct {
+	cands  []candidate
+	scores []float64
+}
+
+func (s *candidateSorter) Len() int           { return len(s.cands) }
+func (s *candidateSorter) Less(i, j int) bool { return s.scores[i] < s.scores[j] }
+func (s *candidateSorter) Swap(i, j int) {
+	s.cands[i], s.cands[j] = s.cands[j], s.cands[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+
+// rateLimiter caps the rate of handed out candidates (see candidate_rate config param).
+// Unused tokens are accumulated for at most rateLimiterBurst, so that fuzzers that poll
+// every few seconds get their share, but an idle period does not let a flood through.
+type rateLimiter struct {
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+const rateLimiterBurst = 10 * time.Second
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate: float64(rate),
+		last: time.Now(),
+	}
+}
+
+// take returns how many of n requested tokens are available at now and consumes them.
+// A nil limiter does not limit anything.
+func (l *rateLimiter) take(n int, now time.Time) int {
+	if l == nil {
+		return n
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+	if max := rateLimiterBurst.Seconds() * l.rate; l.tokens > max {
+		l.tokens = max
+	}
+	if avail := int(l.tokens); n > avail {
+		n = avail
+	}
+	l.tokens -= float64(n)
+	return n
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *rateLimiter
+	if n := nilLimiter.take(100, time.Now()); n != 100 {
+		t.Fatalf("nil limiter limited 100 tokens to %v", n)
+	}
+	now := time.Now()
+	l := &rateLimiter{rate: 10, last: now}
+	steps := []struct {
+		after time.Duration
+		n     int
+		want  int
+	}{
+		{0, 5, 0},                      // no tokens accumulated yet
+		{time.Second, 5, 5},            // 10 tokens accumulated, 5 left
+		{0, 10, 5},                     // the rest
+		{500 * time.Millisecond, 1, 1}, // 5 tokens accumulated, 4 left
+		{time.Hour, 1000, 100},         // accumulated tokens are capped by the burst
+		{time.Second, 1000, 10},
+		{100 * time.Millisecond, 0, 0},
+		{50 * time.Millisecond, 2, 1}, // fractional tokens are kept
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if got := l.take(step.n, now); got != step.want {
+			t.Fatalf("step #%v: take(%v) after %v: got %v, want %v", i, step.n, step.after, got, step.want)
+		}
+	}
+}
+
+func TestCandidateScore(t *testing.T) {
+	counts := map[string]int{
+		"rare":   1,
+		"common": 100,
+	}
+	rare := candidateScore([]string{"rare"}, 1, counts)
+	common := candidateScore([]string{"common"}, 1, counts)
+	both := candidateScore([]string{"rare", "common"}, 2, counts)
+	large := candidateScore([]string{"rare"}, 20, counts)
+	if rare <= common {
+		t.Errorf("rare call scored %v, common call scored %v", rare, common)
+	}
+	if both <= common {
+		t.Errorf("rare and common calls scored %v, common call scored %v", both, common)
+	}
+	if large >= rare {
+		t.Errorf("large program scored %v, small program scored %v", large, rare)
+	}
+	if want := 1 / 1.1; rare != want {
+		t.Errorf("rare call scored %v, want %v", rare, want)
+	}
+	if got := candidateScore(nil, 0, counts); got != 0 {
+		t.Errorf("program without calls scored %v", got)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/syzkaller/config"
+	"github.com/google/syzkaller/cover"
+	"github.com/google/syzkaller/prog"
+	. "github.com/google/syzkaller/rpctype"
+	"github.com/google/syzkaller/sys"
+)
+
+// compareState holds per-kernel results of A/B comparison mode.
+// Index 0 is the main kernel (A), index 1 is the compared kernel (B).
+type compareState struct {
+	tags       [2]string
+	cover      [2][]cover.Cover // per-call corpus coverage
+	inputs     [2]int
+	execs      [2]uint64
+	candidates []candidate // candidates not yet triaged on B, A uses mgr.candidates
+}
+
+func newCompareState(cfg *config.Config) *compareState {
+	cs := &compareState{}
+	cs.tags[0] = cfg.Tag
+	if cs.tags[0] == "" {
+		cs.tags[0] = "A"
+	}
+	cs.tags[1] = cfg.Compare.Tag
+	for i := range cs.cover {
+		cs.cover[i] = make([]cover.Cover, sys.CallCount)
+	}
+	return cs
+}
+
+// newInput accounts coverage of the input triaged on the kernel,
+// returns false if the input does not give new coverage on that kernel.
+// Inputs are admitted to the shared corpus based on per-kernel coverage,
+// because coverage of different builds is not comparable PC-by-PC.
+func (cs *compareState) newInput(kernel, call int, cov []uint32) bool {
+	if len(cover.Difference(cov, cs.cover[kernel][call])) == 0 {
+		return false
+	}
+	cs.cover[kernel][call] = cover.Union(cs.cover[kernel][call], cov)
+	cs.inputs[kernel]++
+	return true
+}
+
+// addCandidate adds an untriaged input (p is the deserialized inp.Prog),
+// in A/B mode it is triaged on both kernels. Must be called with mgr.mu held.
+func (mgr *Manager) addCandidate(inp RpcCandidate, p *prog.Prog) {
+	cand := newCandidate(inp, p)
+	mgr.candidates = append(mgr.candidates, cand)
+	if mgr.compare != nil {
+		mgr.compare.candidates = append(mgr.compare.candidates, cand)
+	}
+}
+
+// candidatesTriaged returns true if all candidates were handed out to fuzzers
+// (on both kernels in A/B mode). Must be called with mgr.mu held.
+func (mgr *Manager) candidatesTriaged() bool {
+	return len(mgr.candidates) == 0 && (mgr.compare == nil || len(mgr.compare.candidates) == 0)
+}
+
+// fuzzersTriaged returns true if all fuzzers reported that they triaged the candidates
+// they were handed out. Must be called with mgr.mu held.
+func (mgr *Manager) fuzzersTriaged() bool {
+	for _, f := range mgr.fuzzers {
+		if !f.triaged {
+			return false
+		}
+	}
+	return true
+}
+
+// fuzzerKernel returns the kernel the fuzzer VM boots in A/B mode.
+func (mgr *Manager) fuzzerKernel(name string) int {
+	if mgr.compare == nil {
+		return 0
+	}
+	// Fuzzer names are VM names that end with the VM index (see config.CreateVMConfig).
+	index, err := strconv.Atoi(name[strings.LastIndexByte(name, '-')+1:])
+	if err != nil {
+		return 0
+	}
+	return config.ComparedKernel(mgr.cfg, index)
+}
+
+// fuzzerCandidates returns the candidate queue the fuzzer takes candidates from.
+// Must be called with mgr.mu held.
+func (mgr *Manager) fuzzerCandidates(f *Fuzzer) *[]candidate {
+	if f.kernel == 1 {
+		return &mgr.compare.candidates
+	}
+	return &mgr.candidates
+}
+
+func (mgr *Manager) httpCompare(w http.ResponseWriter, r *http.Request) {
+	if mgr.compare == nil {
+		http.Error(w, "A/B comparison is not configured", http.StatusNotFound)
+		return
+	}
+	crashes, err := mgr.collectCrashes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to collect crashes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	cs := mgr.compare
+	data := &UICompareData{
+		Name: mgr.cfg.Name,
+		Tags: cs.tags,
+	}
+	for i := range cs.tags {
+		var cov cover.Cover
+		for _, cc := range cs.cover[i] {
+			cov = cover.Union(cov, cc)
+		}
+		data.Kernels[i] = UICompareKernel{
+			Tag:    cs.tags[i],
+			Inputs: cs.inputs[i],
+			Cover:  len(cov),
+			Execs:  cs.execs[i],
+		}
+	}
+	data.Kernels[0].Triage = len(mgr.candidates)
+	data.Kernels[1].Triage = len(cs.candidates)
+
+	for _, c := range crashes {
+		cc := UICompareCrash{
+			ID:          c.ID,
+			Description: c.Description,
+			Counts:      [2]int{c.Count - c.Compared, c.Compared},
+		}
+		switch {
+		case cc.Counts[0] == 0:
+			cc.Only = cs.tags[1]
+		case cc.Counts[1] == 0:
+			cc.Only = cs.tags[0]
+		}
+		data.Crashes = append(data.Crashes, cc)
+	}
+	sort.SliceStable(data.Crashes, func(i, j int) bool {
+		return data.Crashes[i].Only != "" && data.Crashes[j].Only == ""
+	})
+
+	for _, call := range sys.Calls {
+		cc := UICompareCall{
+			Name:   call.Name,
+			Covers: [2]int{len(cs.cover[0][call.ID]), len(cs.cover[1][call.ID])},
+		}
+		if cc.Covers[0] == cc.Covers[1] {
+			continue
+		}
+		switch {
+		case cc.Covers[0] == 0:
+			cc.Only = cs.tags[1]
+		case cc.Covers[1] == 0:
+			cc.Only = cs.tags[0]
+		}
+		data.Calls = append(data.Calls, cc)
+	}
+	// Calls covered on one kernel only go first, then calls with the largest difference.
+	sort.Slice(data.Calls, func(i, j int) bool {
+		ci, cj := data.Calls[i], data.Calls[j]
+		if (ci.Only != "") != (cj.Only != "") {
+			return ci.Only != ""
+		}
+		return abs(ci.Covers[0]-ci.Covers[1]) > abs(cj.Covers[0]-cj.Covers[1])
+	})
+
+	if err := compareTemplate.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+type UICompareData struct {
+	Name    string
+	Tags    [2]string
+	Kernels [2]UICompareKernel
+	Crashes []UICompareCrash
+	Calls   []UICompareCall
+}
+
+type UICompareKernel struct {
+	Tag    string
+	Inputs int
+	Cover  int
+	Execs  uint64
+	Triage int
+}
+
+type UICompareCrash struct {
+	ID          string
+	Description string
+	Counts      [2]int
+	Only        string // tag of the kernel the crash happens on, if it does not happen on the other one
+}
+
+type UICompareCall struct {
+	Name   string
+	Covers [2]int
+	Only   string // tag of the kernel that covers the call, if the other one does not
+}
+
+var compareTemplate = template.Must(template.New("").Parse(addStyle(`
+<!doctype html>
+<html>
+<head>
+	<title>{{.Name }} syzkaller A/B comparison</title>
+	{{STYLE}}
+</head>
+<body>
+<b>{{.Name }} syzkaller A/B comparison</b>
+<br>
+<br>
+
+<table>
+	<caption>Kernels:</caption>
+	<tr>
+		<th>Kernel</th>
+		<th>Inputs</th>
+		<th>Cover</th>
+		<th>Executed</th>
+		<th>Triage queue</th>
+	</tr>
+	{{range $k := $.Kernels}}
+	<tr>
+		<td>{{$k.Tag}}</td>
+		<td>{{$k.Inputs}}</td>
+		<td>{{$k.Cover}}</td>
+		<td>{{$k.Execs}}</td>
+		<td>{{$k.Triage}}</td>
+	</tr>
+	{{end}}
+</table>
+<br>
+
+<table>
+	<caption>Crashes:</caption>
+	<tr>
+		<th>Description</th>
+		<th>{{index $.Tags 0}}</th>
+		<th>{{index $.Tags 1}}</th>
+		<th>Only on</th>
+	</tr>
+	{{range $c := $.Crashes}}
+	<tr>
+		<td><a href="/crash?id={{$c.ID}}">{{$c.Description}}</a></td>
+		<td>{{index $c.Counts 0}}</td>
+		<td>{{index $c.Counts 1}}</td>
+		<td>{{$c.Only}}</td>
+	</tr>
+	{{end}}
+</table>
+<br>
+
+<table>
+	<caption>Calls with different coverage:</caption>
+	<tr>
+		<th>Call</th>
+		<th>{{index $.Tags 0}}</th>
+		<th>{{index $.Tags 1}}</th>
+		<th>Only on</th>
+	</tr>
+	{{range $c := $.Calls}}
+	<tr>
+		<td>{{$c.Name}}</td>
+		<td>{{index $c.Covers 0}}</td>
+		<td>{{index $c.Covers 1}}</td>
+		<td>{{$c.Only}}</td>
+	</tr>
+	{{end}}
+</table>
+</body></html>
+`)))
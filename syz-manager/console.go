@@ -0,0 +1,201 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/google/syzkaller/log"
+)
+
+// consoleLogs saves full output of VMs (kernel console and fuzzer output)
+// in workdir/console/<VM index>/<seq>.log files. Output of a VM run is appended
+// to the last file of the VM, a new file is started when the last one
+// exceeds maxSize, only the last maxFiles files are kept.
+type consoleLogs struct {
+	workdir  string
+	maxSize  int64
+	maxFiles int
+}
+
+// consoleRef refers to output of a VM run in a console log,
+// it is persisted in "consoleN" files in crash dir.
+type consoleRef struct {
+	File  string // relative to workdir
+	Start int64
+	End   int64
+}
+
+// consoleLog is the console log file that receives output of a single VM run.
+type consoleLog struct {
+	f     *os.File
+	file  string // relative to workdir
+	start int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+func newConsoleLogs(workdir string, maxSizeMB, maxFiles int) *consoleLogs {
+	return &consoleLogs{
+		workdir:  workdir,
+		maxSize:  int64(maxSizeMB) << 20,
+		maxFiles: maxFiles,
+	}
+}
+
+// open opens the log file for the next run of VM with the index and removes old files.
+func (cl *consoleLogs) open(index int) (*consoleLog, error) {
+	dir := filepath.Join("console", strconv.Itoa(index))
+	if err := os.MkdirAll(filepath.Join(cl.workdir, dir), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create console log dir: %v", err)
+	}
+	seqs, err := cl.files(dir)
+	if err != nil {
+		return nil, err
+	}
+	seq := 0
+	if len(seqs) != 0 {
+		seq = seqs[len(seqs)-1]
+		info, err := os.Stat(filepath.Join(cl.workdir, dir, fmt.Sprintf("%v.log", seq)))
+		if err == nil && info.Size() >= cl.maxSize {
+			seq++
+			seqs = append(seqs, seq)
+		}
+	}
+	for len(seqs) > cl.maxFiles {
+		os.Remove(filepath.Join(cl.workdir, dir, fmt.Sprintf("%v.log", seqs[0])))
+		seqs = seqs[1:]
+	}
+	file := filepath.Join(dir, fmt.Sprintf("%v.log", seq))
+	f, err := os.OpenFile(filepath.Join(cl.workdir, file), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open console log: %v", err)
+	}
+	start, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open console log: %v", err)
+	}
+	l := &consoleLog{
+		f:     f,
+		file:  file,
+		start: start,
+		size:  start,
+	}
+	return l, nil
+}
+
+// files returns sorted sequence numbers of log files in dir.
+func (cl *consoleLogs) files(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(cl.workdir, dir))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, f := range files {
+		seq, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".log"))
+		if err != nil || !strings.HasSuffix(f.Name(), ".log") {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// tee saves output from outc in the log and forwards it to the returned channel.
+// The log is closed when outc is closed or done is closed.
+func (l *consoleLog) tee(outc <-chan []byte, done <-chan bool) <-chan []byte {
+	teec := make(chan []byte)
+	go func() {
+		defer l.f.Close()
+		for {
+			select {
+			case out, ok := <-outc:
+				if !ok {
+					close(teec)
+					return
+				}
+				l.write(out)
+				select {
+				case teec <- out:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return teec
+}
+
+func (l *consoleLog) write(out []byte) {
+	n, err := l.f.Write(out)
+	if err != nil {
+		Logf(1, "failed to write console log: %v", err)
+	}
+	l.mu.Lock()
+	l.size += int64(n)
+	l.mu.Unlock()
+}
+
+// ref returns reference to the output written so far.
+func (l *consoleLog) ref() *consoleRef {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &consoleRef{
+		File:  l.file,
+		Start: l.start,
+		End:   l.size,
+	}
+}
+
+func saveConsoleRef(file string, ref *consoleRef) error {
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0660)
+}
+
+// httpConsole serves output of the VM run that ended with the crash log index of crash id.
+func (mgr *Manager) httpConsole(w http.ResponseWriter, r *http.Request) {
+	crashID := r.FormValue("id")
+	index, err := strconv.Atoi(r.FormValue("index"))
+	if err != nil || len(crashID) != 40 || strings.ContainsAny(crashID, "./") {
+		http.Error(w, "bad crash id or index", http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(mgr.crashdir, crashID, fmt.Sprintf("console%v", index)))
+	if err != nil {
+		http.Error(w, "no console log for the crash", http.StatusNotFound)
+		return
+	}
+	ref := new(consoleRef)
+	if err := json.Unmarshal(data, ref); err != nil || ref.Start > ref.End ||
+		!strings.HasPrefix(filepath.Clean(ref.File), "console/") {
+		http.Error(w, "bad console log reference", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(filepath.Join(mgr.cfg.Workdir, filepath.Clean(ref.File)))
+	if err != nil {
+		http.Error(w, "console log was already removed by rotation", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, io.NewSectionReader(f, ref.Start, ref.End-ref.Start))
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+
+	"github.com/google/syzkaller/hash"
+	"github.com/google/syzkaller/prog"
+	. "github.com/google/syzkaller/rpctype"
+)
+
+// pcBlockShift is log2 of size of PC blocks that corpusIndex indexes inputs by,
+// PC range queries check coverage only of inputs that cover PCs in blocks of the range.
+const pcBlockShift = 12
+
+// corpusIndex indexes manager corpus for queries of the web UI and of focus areas,
+// that otherwise scan (and deserialize) the whole corpus, which is slow for large corpuses.
+// Inputs are identified by their index in mgr.corpus, the index must be updated
+// whenever the corpus changes (see addCorpusInput and setCorpus).
+type corpusIndex struct {
+	calls    [][]string       // calls of every input
+	bySig    map[hash.Sig]int // hash of the program -> input
+	byCall   map[string][]int // call the input was added to corpus for -> inputs
+	byFamily map[string][]int // family of the call the input was added for -> inputs
+	byCalls  map[string][]int // call -> inputs that contain the call
+	byBlock  map[uint32][]int // PC block -> inputs that cover a PC in the block
+	bySize   map[int][]int    // number of calls -> inputs
+	sizes    []int            // sorted keys of bySize
+}
+
+// corpusQuery selects inputs that match all set conditions.
+type corpusQuery struct {
+	Call     string // inputs added to corpus for the call
+	Family   bool   // Call is a syscall family, inputs added for all variants of the syscall match
+	Contains string // inputs that contain the call
+	PCStart  uint32 // inputs that cover a PC in [PCStart, PCEnd), used if PCEnd != 0
+	PCEnd    uint32
+	MinSize  int // inputs with at least MinSize calls
+	MaxSize  int // inputs with at most MaxSize calls, used if MaxSize != 0
+}
+
+func newCorpusIndex(corpus []RpcInput) *corpusIndex {
+	idx := &corpusIndex{
+		bySig:    make(map[hash.Sig]int),
+		byCall:   make(map[string][]int),
+		byFamily: make(map[string][]int),
+		byCalls:  make(map[string][]int),
+		byBlock:  make(map[uint32][]int),
+		bySize:   make(map[int][]int),
+	}
+	for _, inp := range corpus {
+		idx.add(inp)
+	}
+	return idx
+}
+
+// add indexes inp that is appended to the end of corpus.
+func (idx *corpusIndex) add(inp RpcInput) {
+	n := len(idx.calls)
+	var calls []string
+	if p, err := prog.Deserialize(inp.Prog); err == nil {
+		for _, c := range p.Calls {
+			calls = append(calls, c.Meta.Name)
+		}
+	}
+	idx.calls = append(idx.calls, calls)
+	idx.bySig[hash.Hash(inp.Prog)] = n
+	idx.byCall[inp.Call] = append(idx.byCall[inp.Call], n)
+	family := callFamily(inp.Call)
+	idx.byFamily[family] = append(idx.byFamily[family], n)
+	seen := make(map[string]bool)
+	for _, c := range calls {
+		if !seen[c] {
+			seen[c] = true
+			idx.byCalls[c] = append(idx.byCalls[c], n)
+		}
+	}
+	last := ^uint32(0)
+	for _, pc := range inp.Cover {
+		// Cover is sorted, so PCs of a block are consecutive.
+		if b := pc >> pcBlockShift; b != last {
+			last = b
+			idx.byBlock[b] = append(idx.byBlock[b], n)
+		}
+	}
+	size := len(calls)
+	if _, ok := idx.bySize[size]; !ok {
+		idx.sizes = append(idx.sizes, size)
+		sort.Ints(idx.sizes)
+	}
+	idx.bySize[size] = append(idx.bySize[size], n)
+}
+
+// find returns the input with the program hash.
+func (idx *corpusIndex) find(sig hash.Sig) (int, bool) {
+	n, ok := idx.bySig[sig]
+	return n, ok
+}
+
+// query returns sorted indices of inputs of corpus that match q.
+func (idx *corpusIndex) query(corpus []RpcInput, q corpusQuery) []int {
+	var sets [][]int
+	if q.Call != "" {
+		if q.Family {
+			sets = append(sets, idx.byFamily[q.Call])
+		} else {
+			sets = append(sets, idx.byCall[q.Call])
+		}
+	}
+	if q.Contains != "" {
+		sets = append(sets, idx.byCalls[q.Contains])
+	}
+	if q.MinSize > 0 || q.MaxSize > 0 {
+		var set []int
+		for _, size := range idx.sizes {
+			if size >= q.MinSize && (q.MaxSize == 0 || size <= q.MaxSize) {
+				set = append(set, idx.bySize[size]...)
+			}
+		}
+		sort.Ints(set)
+		sets = append(sets, set)
+	}
+	if q.PCEnd != 0 {
+		sets = append(sets, idx.coverRange(corpus, q.PCStart, q.PCEnd))
+	}
+	if len(sets) == 0 {
+		res := make([]int, len(idx.calls))
+		for i := range res {
+			res[i] = i
+		}
+		return res
+	}
+	// Start with the smallest set, intersection is not larger than it.
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	res := append([]int{}, sets[0]...)
+	for _, set := range sets[1:] {
+		res = intersectSorted(res, set)
+	}
+	return res
+}
+
+// coverRange returns sorted indices of inputs that cover a PC in [start, end).
+func (idx *corpusIndex) coverRange(corpus []RpcInput, start, end uint32) []int {
+	candidates := make(map[int]bool)
+	for b := start >> pcBlockShift; b <= (end-1)>>pcBlockShift; b++ {
+		for _, n := range idx.byBlock[b] {
+			candidates[n] = true
+		}
+		if b == ^uint32(0)>>pcBlockShift {
+			break
+		}
+	}
+	var res []int
+	for n := range candidates {
+		cov := corpus[n].Cover
+		i := sort.Search(len(cov), func(i int) bool { return cov[i] >= start })
+		if i < len(cov) && cov[i] < end {
+			res = append(res, n)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
+
+// accepted returns sorted indices of inputs that contain only calls in enabled.
+func (idx *corpusIndex) accepted(enabled map[string]bool) []int {
+	rejected := make(map[int]bool)
+	for c, inputs := range idx.byCalls {
+		if enabled[c] {
+			continue
+		}
+		for _, n := range inputs {
+			rejected[n] = true
+		}
+	}
+	var res []int
+	for n, calls := range idx.calls {
+		if !rejected[n] && len(calls) != 0 {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func intersectSorted(a, b []int) []int {
+	res := a[:0]
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/syzkaller/config"
+	. "github.com/google/syzkaller/log"
+	. "github.com/google/syzkaller/rpctype"
+	"github.com/google/syzkaller/symbolizer"
+)
+
+type symbol struct {
+	start uint64
+	end   uint64
+	name  string
+}
+
+type symbolArray []symbol
+
+func (a symbolArray) Len() int           { return len(a) }
+func (a symbolArray) Less(i, j int) bool { return a[i].start < a[j].start }
+func (a symbolArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// initCoverFilter resolves functions, files and modules selected in the config
+// to PC ranges of the corresponding functions in vmlinux.
+func initCoverFilter(vmlinux string, filter *config.CoverFilter) ([]PCRange, error) {
+	allSymbols, err := symbolizer.ReadSymbols(vmlinux)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run nm on vmlinux: %v", err)
+	}
+	var symbols symbolArray
+	for name, ss := range allSymbols {
+		for _, s := range ss {
+			if s.Size != 0 {
+				symbols = append(symbols, symbol{s.Addr, s.Addr + uint64(s.Size), name})
+			}
+		}
+	}
+	sort.Sort(symbols)
+
+	selected := make(map[symbol]bool)
+	for _, fn := range filter.Functions {
+		n := 0
+		for _, s := range symbols {
+			if matchFunction(s.name, fn) {
+				selected[s] = true
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("cover filter: function %v is not present in vmlinux", fn)
+		}
+	}
+
+	files := append([]string{}, filter.Files...)
+	for _, mod := range filter.Modules {
+		modFiles, err := moduleFiles(vmlinux, mod)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, modFiles...)
+	}
+	if len(files) != 0 {
+		// Attribute functions to source files by symbolizing their start addresses.
+		pcs := make([]uint64, len(symbols))
+		for i, s := range symbols {
+			pcs[i] = s.start
+		}
+		symb := symbolizer.NewSymbolizer()
+		frames, err := symb.SymbolizeArray(vmlinux, pcs)
+		symb.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to symbolize vmlinux: %v", err)
+		}
+		funcFiles := make(map[uint64]string)
+		for _, frame := range frames {
+			if !frame.Inline {
+				funcFiles[frame.PC] = frame.File
+			}
+		}
+		if len(funcFiles) == 0 {
+			return nil, fmt.Errorf("'%s' does not have debug info (set CONFIG_DEBUG_INFO=y)", vmlinux)
+		}
+		for _, file := range files {
+			n := 0
+			for _, s := range symbols {
+				if f, ok := funcFiles[s.start]; ok && matchFile(f, file) {
+					selected[s] = true
+					n++
+				}
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("cover filter: no functions found in %v", file)
+			}
+		}
+	}
+
+	var ranges []PCRange
+	for _, s := range symbols {
+		if !selected[s] {
+			continue
+		}
+		// Coverage PCs are truncated to 32 bits (see executor).
+		start, end := uint32(s.start), uint32(s.end)
+		if n := len(ranges); n != 0 && ranges[n-1].End >= start {
+			if ranges[n-1].End < end {
+				ranges[n-1].End = end
+			}
+			continue
+		}
+		ranges = append(ranges, PCRange{Start: start, End: end})
+	}
+	Logf(0, "cover filter: selected %v functions (%v PC ranges)", len(selected), len(ranges))
+	return ranges, nil
+}
+
+// matchFunction matches function name against a cover filter entry.
+// Compiler-generated clones (e.g. foo.isra.0) match the original function name.
+func matchFunction(name, pattern string) bool {
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		name = name[:dot]
+	}
+	if len(pattern) > 1 && pattern[len(pattern)-1] == '*' {
+		return strings.HasPrefix(name, pattern[:len(pattern)-1])
+	}
+	return name == pattern
+}
+
+// matchFile matches a source file path from debug info (usually absolute)
+// against a cover filter entry (a file or a directory relative to kernel source root).
+func matchFile(file, pattern string) bool {
+	file = filepath.Clean(file)
+	if strings.HasSuffix(pattern, "/") {
+		dir := filepath.Clean(pattern) + "/"
+		return strings.HasPrefix(file, dir) || strings.Contains(file, "/"+dir)
+	}
+	pattern = filepath.Clean(pattern)
+	return file == pattern || strings.HasSuffix(file, "/"+pattern)
+}
+
+// moduleFiles returns cover filter file entries for built-in module mod
+// based on modules.builtin from the kernel build directory.
+// A module is assumed to consist of the source directory of the same name (e.g. fs/ext4/ for ext4),
+// or otherwise of the single source file of the same name (e.g. drivers/net/tun.c for tun).
+func moduleFiles(vmlinux, mod string) ([]string, error) {
+	builtin := filepath.Join(filepath.Dir(vmlinux), "modules.builtin")
+	f, err := os.Open(builtin)
+	if err != nil {
+		return nil, fmt.Errorf("cover filter: failed to open modules list: %v", err)
+	}
+	defer f.Close()
+	norm := func(name string) string {
+		return strings.Replace(name, "-", "_", -1)
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// A line looks as: "kernel/drivers/net/tun.ko"
+		ln := strings.TrimPrefix(strings.TrimSpace(s.Text()), "kernel/")
+		name := strings.TrimSuffix(filepath.Base(ln), ".ko")
+		if norm(name) != norm(mod) {
+			continue
+		}
+		dir := filepath.Dir(ln)
+		if norm(filepath.Base(dir)) == norm(name) {
+			return []string{dir + "/"}, nil
+		}
+		return []string{filepath.Join(dir, name+".c")}, nil
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("cover filter: failed to read %v: %v", builtin, err)
+	}
+	return nil, fmt.Errorf("cover filter: module %v is not in %v", mod, builtin)
+}
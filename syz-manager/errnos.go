@@ -0,0 +1,179 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+
+	"github.com/google/syzkaller/sys"
+	"github.com/google/syzkaller/sysparser"
+)
+
+// minErrnoExecs is the number of executions of a call after which
+// the call is reported if it has never succeeded.
+const minErrnoExecs = 1000
+
+// errnoHints explain the most likely cause of calls that always fail with the error.
+var errnoHints = map[uint64]string{
+	sysparser.Errnos["ENOSYS"]:          "not implemented: the syscall is missing in the kernel or kernel config",
+	sysparser.Errnos["EINVAL"]:          "arguments are rejected: the description is probably broken",
+	sysparser.Errnos["EFAULT"]:          "bad pointer: the description of a pointer argument is probably broken",
+	sysparser.Errnos["EBADF"]:           "bad fd: the resource is never created or has a wrong type",
+	sysparser.Errnos["ENOTTY"]:          "unknown ioctl: missing kernel config or driver",
+	sysparser.Errnos["EOPNOTSUPP"]:      "unsupported operation: missing kernel config or driver",
+	sysparser.Errnos["ENODEV"]:          "no device: missing kernel config or driver",
+	sysparser.Errnos["ENXIO"]:           "no device: missing kernel config or driver",
+	sysparser.Errnos["ENOENT"]:          "no such file or object: missing kernel config or sandbox setup",
+	sysparser.Errnos["EAFNOSUPPORT"]:    "unsupported address family: missing kernel config",
+	sysparser.Errnos["EPROTONOSUPPORT"]: "unsupported protocol: missing kernel config",
+	sysparser.Errnos["EPERM"]:           "not permitted: the sandbox lacks privileges",
+	sysparser.Errnos["EACCES"]:          "not permitted: the sandbox lacks privileges",
+}
+
+// addErrnos adds results of calls received from a fuzzer (see PollArgs.Errnos).
+func (mgr *Manager) addErrnos(errnos map[string]map[int]uint64) {
+	for call, stats := range errnos {
+		if sys.CallMap[call] == nil {
+			continue // descriptions of the fuzzer differ, the call does not mean anything here
+		}
+		all := mgr.errnos[call]
+		if all == nil {
+			all = make(map[int]uint64)
+			mgr.errnos[call] = all
+		}
+		for errno, n := range stats {
+			all[errno] += n
+		}
+	}
+}
+
+// errnoReport returns results of calls that have never succeeded and never failed with errors
+// expected by their descriptions in at least minErrnoExecs executions, or results of all calls
+// if all is set. Anomalies go first, the most frequently executed calls first.
+// Requires mgr.mu.
+func (mgr *Manager) errnoReport(all bool) []UIErrnoCall {
+	var res []UIErrnoCall
+	for call, stats := range mgr.errnos {
+		expected := make(map[int]bool)
+		for _, errno := range sys.CallMap[call].Errnos {
+			expected[errno] = true
+		}
+		c := UIErrnoCall{Name: call}
+		var expectedFails, top uint64
+		for errno, n := range stats {
+			c.Execs += n
+			switch {
+			case errno == 0:
+				c.Succeeded = n
+			case expected[errno]:
+				expectedFails += n
+			default:
+				c.Errnos = append(c.Errnos, UIErrno{errnoName(errno), n})
+				if n > top {
+					top = n
+					c.Hint = errnoHints[uint64(errno)]
+				}
+			}
+		}
+		c.Anomaly = c.Execs >= minErrnoExecs && c.Succeeded == 0 && expectedFails == 0
+		if !c.Anomaly && !all {
+			continue
+		}
+		sort.Slice(c.Errnos, func(i, j int) bool { return c.Errnos[i].Count > c.Errnos[j].Count })
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Anomaly != res[j].Anomaly {
+			return res[i].Anomaly
+		}
+		return res[i].Execs > res[j].Execs
+	})
+	return res
+}
+
+func errnoName(errno int) string {
+	if sys.OS != "linux" {
+		// Names are known only for Linux errors.
+		return fmt.Sprint(errno)
+	}
+	return sysparser.ErrnoName(uint64(errno))
+}
+
+// httpErrnos shows calls that always fail with unexpected errors (see errnoReport),
+// with all=1 results of all executed calls.
+func (mgr *Manager) httpErrnos(w http.ResponseWriter, r *http.Request) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	data := &UIErrnoData{
+		Name:     mgr.cfg.Name,
+		All:      r.FormValue("all") != "",
+		MinExecs: minErrnoExecs,
+	}
+	data.Calls = mgr.errnoReport(data.All)
+	if err := errnoTemplate.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+type UIErrnoData struct {
+	Name     string
+	All      bool
+	MinExecs int
+	Calls    []UIErrnoCall
+}
+
+type UIErrnoCall struct {
+	Name      string
+	Execs     uint64
+	Succeeded uint64
+	Errnos    []UIErrno // unexpected errors, the most frequent first
+	Hint      string    // likely cause of the most frequent unexpected error
+	Anomaly   bool
+}
+
+type UIErrno struct {
+	Name  string
+	Count uint64
+}
+
+var errnoTemplate = template.Must(template.New("").Parse(addStyle(`
+<!doctype html>
+<html>
+<head>
+	<title>{{.Name }} syzkaller errnos</title>
+	{{STYLE}}
+</head>
+<body>
+<b>{{.Name }} syzkaller errnos</b>
+<br>
+Calls that have not succeeded in {{.MinExecs}} executions and have not failed with errors expected by
+their descriptions (errno attribute). {{if .All}}<a href="/errnos">Show only them</a>{{else}}<a href="/errnos?all=1">Show all calls</a>{{end}}.
+<br>
+<br>
+
+<table>
+	<tr>
+		<th>Call</th>
+		<th>Executed</th>
+		<th>Succeeded</th>
+		<th>Unexpected errors</th>
+		<th>Likely cause</th>
+	</tr>
+	{{range $c := $.Calls}}
+	<tr>
+		<td>{{if $c.Anomaly}}<b>{{$c.Name}}</b>{{else}}{{$c.Name}}{{end}}</td>
+		<td>{{$c.Execs}}</td>
+		<td>{{$c.Succeeded}}</td>
+		<td>{{range $e := $c.Errnos}}{{$e.Name}}:{{$e.Count}} {{end}}</td>
+		<td>{{$c.Hint}}</td>
+	</tr>
+	{{end}}
+</table>
+</body></html>
+`)))
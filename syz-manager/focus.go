@@ -0,0 +1,111 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/syzkaller/config"
+	"github.com/google/syzkaller/cover"
+	. "github.com/google/syzkaller/log"
+	. "github.com/google/syzkaller/rpctype"
+	"github.com/google/syzkaller/sys"
+)
+
+// focusArea is a config focus area with VMs currently assigned to it and its stats.
+type focusArea struct {
+	cfg             *config.FocusArea
+	enabledSyscalls string          // in ConnectRes.EnabledCalls format
+	enabledCalls    map[string]bool // call names
+	coverFilter     []PCRange
+
+	vms     int // VMs currently fuzzing the area
+	inputs  int
+	execs   uint64
+	crashes int
+	cover   cover.Cover
+}
+
+func initFocusAreas(cfg *config.Config) ([]*focusArea, error) {
+	var areas []*focusArea
+	for _, a := range cfg.Focus_Areas {
+		area := &focusArea{
+			cfg:             a,
+			enabledSyscalls: formatSyscalls(a.ParsedSyscalls),
+			enabledCalls:    make(map[string]bool),
+		}
+		for id := range a.ParsedSyscalls {
+			area.enabledCalls[sys.Calls[id].Name] = true
+		}
+		if a.Cover_Filter != nil {
+			ranges, err := initCoverFilter(cfg.Vmlinux, a.Cover_Filter)
+			if err != nil {
+				return nil, fmt.Errorf("focus area %v: %v", a.Name, err)
+			}
+			area.coverFilter = ranges
+		}
+		areas = append(areas, area)
+	}
+	return areas, nil
+}
+
+// formatSyscalls formats syscall IDs as a comma-separated list.
+func formatSyscalls(syscalls map[int]bool) string {
+	if len(syscalls) == 0 {
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	for c := range syscalls {
+		fmt.Fprintf(buf, ",%v", c)
+	}
+	return buf.String()[1:]
+}
+
+// assignFocusArea selects the area that is the most behind its share of VMs.
+// Must be called with mgr.mu held.
+func (mgr *Manager) assignFocusArea(f *Fuzzer) *focusArea {
+	var best *focusArea
+	for _, area := range mgr.areas {
+		// Compare vms/weight of areas without division.
+		if best == nil || area.vms*best.cfg.Weight < best.vms*area.cfg.Weight {
+			best = area
+		}
+	}
+	best.vms++
+	f.area = best
+	Logf(1, "fuzzer %v is assigned to focus area %v", f.name, best.cfg.Name)
+	return best
+}
+
+// releaseFocusArea is called when the VM of the fuzzer stops,
+// it returns the area the fuzzer was assigned to (if any).
+func (mgr *Manager) releaseFocusArea(name string) *focusArea {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	f := mgr.fuzzers[name]
+	if f == nil || f.area == nil {
+		return nil
+	}
+	area := f.area
+	area.vms--
+	f.area = nil
+	return area
+}
+
+// acceptsInput returns true if the fuzzer can use the corpus program with the calls.
+func (f *Fuzzer) acceptsInput(calls []string) bool {
+	if f.area == nil {
+		return true
+	}
+	if len(calls) == 0 {
+		return false // the program does not deserialize
+	}
+	for _, c := range calls {
+		if !f.area.enabledCalls[c] {
+			return false
+		}
+	}
+	return true
+}
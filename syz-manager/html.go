@@ -4,6 +4,9 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -19,10 +22,16 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/syzkaller/bisect"
 	"github.com/google/syzkaller/cover"
+	"github.com/google/syzkaller/db"
+	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/hash"
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/report"
 	"github.com/google/syzkaller/sys"
+	"github.com/google/syzkaller/vm"
 )
 
 const dateFormat = "Jan 02 2006 15:04:05 MST"
@@ -30,52 +39,126 @@ const dateFormat = "Jan 02 2006 15:04:05 MST"
 func (mgr *Manager) initHttp() {
 	http.HandleFunc("/", mgr.httpSummary)
 	http.HandleFunc("/corpus", mgr.httpCorpus)
+	http.HandleFunc("/corpus.db", mgr.httpCorpusDB)
+	http.HandleFunc("/input", mgr.httpInput)
 	http.HandleFunc("/crash", mgr.httpCrash)
 	http.HandleFunc("/cover", mgr.httpCover)
 	http.HandleFunc("/prio", mgr.httpPrio)
+	http.HandleFunc("/errnos", mgr.httpErrnos)
+	http.HandleFunc("/attribution", mgr.httpAttribution)
 	http.HandleFunc("/file", mgr.httpFile)
 	http.HandleFunc("/report", mgr.httpReport)
+	http.HandleFunc("/metrics", mgr.httpMetrics)
+	http.HandleFunc("/api/summary", mgr.httpAPISummary)
+	http.HandleFunc("/admin/vms", mgr.httpAdminVMs)
+	http.HandleFunc("/admin/fuzzing", mgr.httpAdminFuzzing)
+	http.HandleFunc("/compare", mgr.httpCompare)
+	http.HandleFunc("/console", mgr.httpConsole)
+	http.HandleFunc("/debug/log", mgr.httpLog)
 
 	ln, err := net.Listen("tcp4", mgr.cfg.Http)
 	if err != nil {
 		Fatalf("failed to listen on %v: %v", mgr.cfg.Http, err)
 	}
-	Logf(0, "serving http on http://%v", ln.Addr())
+	scheme := "http"
+	if mgr.tlsConfig != nil {
+		ln = tls.NewListener(ln, mgr.tlsConfig)
+		scheme = "https"
+	}
+	var handler http.Handler = http.DefaultServeMux
+	if mgr.cfg.Auth_Token != "" {
+		handler = mgr.httpAuth(handler)
+	}
+	Logf(0, "serving http on %v://%v", scheme, ln.Addr())
 	go func() {
-		err := http.Serve(ln, nil)
+		err := http.Serve(ln, handler)
 		Fatalf("failed to serve http: %v", err)
 	}()
 }
 
+// httpAuth requires clients to present auth_token either as a bearer token
+// (e.g. metrics scrapers) or as a basic auth password with any user name (browsers).
+func (mgr *Manager) httpAuth(h http.Handler) http.Handler {
+	token := []byte(mgr.cfg.Auth_Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := ""
+		if _, password, ok := r.BasicAuth(); ok {
+			got = password
+		} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="syzkaller"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func (mgr *Manager) httpSummary(w http.ResponseWriter, r *http.Request) {
+	crashes, err := mgr.collectCrashes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to collect crashes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
 
 	data := &UISummaryData{
-		Name: mgr.cfg.Name,
+		Name:    mgr.cfg.Name,
+		Crashes: crashes,
 	}
 	data.Stats = append(data.Stats, UIStat{Name: "uptime", Value: fmt.Sprint(time.Since(mgr.startTime) / 1e9 * 1e9)})
-	data.Stats = append(data.Stats, UIStat{Name: "corpus", Value: fmt.Sprint(len(mgr.corpus))})
+	vms := fmt.Sprint(mgr.vmCount)
+	if n := mgr.boot.quarantinedVMs(); n != 0 {
+		vms += fmt.Sprintf(" (%v quarantined)", n)
+	}
+	data.Stats = append(data.Stats, UIStat{Name: "VMs", Value: vms})
+	if mgr.fuzzing != fuzzingRunning {
+		data.Stats = append(data.Stats, UIStat{Name: "fuzzing", Value: mgr.fuzzing.String()})
+	}
+	data.Stats = append(data.Stats, UIStat{Name: "corpus", Value: fmt.Sprint(len(mgr.corpus)), Link: "/corpus"})
 	data.Stats = append(data.Stats, UIStat{Name: "triage queue", Value: fmt.Sprint(len(mgr.candidates))})
+	if mgr.compare != nil {
+		data.Stats = append(data.Stats, UIStat{Name: "A/B comparison",
+			Value: fmt.Sprintf("%v vs %v", mgr.compare.tags[0], mgr.compare.tags[1]), Link: "/compare"})
+	}
 
-	var err error
-	if data.Crashes, err = mgr.collectCrashes(); err != nil {
-		http.Error(w, fmt.Sprintf("failed to collect crashes: %v", err), http.StatusInternalServerError)
-		return
+	for _, area := range mgr.areas {
+		data.Areas = append(data.Areas, UIFocusArea{
+			Name:    area.cfg.Name,
+			Weight:  area.cfg.Weight,
+			VMs:     area.vms,
+			Inputs:  area.inputs,
+			Cover:   len(area.cover),
+			Execs:   area.execs,
+			Crashes: area.crashes,
+		})
 	}
 
 	type CallCov struct {
-		count int
-		cov   cover.Cover
+		count    int
+		cov      cover.Cover
+		variants map[string]bool
 	}
+	// Stats are collected both per syscall variant (foo$bar) and per syscall family (foo).
 	calls := make(map[string]*CallCov)
-	for _, inp := range mgr.corpus {
-		if calls[inp.Call] == nil {
-			calls[inp.Call] = new(CallCov)
+	families := make(map[string]*CallCov)
+	add := func(m map[string]*CallCov, key, call string, cov []uint32) {
+		cc := m[key]
+		if cc == nil {
+			cc = &CallCov{variants: make(map[string]bool)}
+			m[key] = cc
 		}
-		cc := calls[inp.Call]
 		cc.count++
-		cc.cov = cover.Union(cc.cov, cover.Cover(inp.Cover))
+		cc.cov = cover.Union(cc.cov, cover.Cover(cov))
+		cc.variants[call] = true
+	}
+	for _, inp := range mgr.corpus {
+		add(calls, inp.Call, inp.Call, inp.Cover)
+		add(families, callFamily(inp.Call), inp.Call, inp.Cover)
 	}
 
 	secs := uint64(1)
@@ -84,7 +167,7 @@ func (mgr *Manager) httpSummary(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var cov cover.Cover
-	totalUnique := mgr.uniqueCover(true)
+	totalUnique := mgr.uniqueCover(variantKey)
 	for c, cc := range calls {
 		cov = cover.Union(cov, cc.cov)
 		unique := cover.Intersection(cc.cov, totalUnique)
@@ -96,7 +179,24 @@ func (mgr *Manager) httpSummary(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 	sort.Sort(UICallTypeArray(data.Calls))
+	familyUnique := mgr.uniqueCover(callFamily)
+	for c, cc := range families {
+		if len(cc.variants) == 1 && cc.variants[c] {
+			continue // the only variant is the base call itself, no point in aggregating
+		}
+		unique := cover.Intersection(cc.cov, familyUnique)
+		data.Families = append(data.Families, UICallType{
+			Name:        c,
+			Variants:    len(cc.variants),
+			Inputs:      cc.count,
+			Cover:       len(cc.cov),
+			UniqueCover: len(unique),
+		})
+	}
+	sort.Sort(UICallTypeArray(data.Families))
 	data.Stats = append(data.Stats, UIStat{Name: "cover", Value: fmt.Sprint(len(cov)), Link: "/cover"})
+	data.Stats = append(data.Stats, UIStat{Name: "attributed cover", Value: fmt.Sprint(len(mgr.attribution.covered)), Link: "/attribution"})
+	data.Stats = append(data.Stats, UIStat{Name: "errno anomalies", Value: fmt.Sprint(len(mgr.errnoReport(false))), Link: "/errnos"})
 
 	var intStats []UIStat
 	for k, v := range mgr.stats {
@@ -121,10 +221,26 @@ func (mgr *Manager) httpSummary(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (mgr *Manager) httpCrash(w http.ResponseWriter, r *http.Request) {
-	mgr.mu.Lock()
-	defer mgr.mu.Unlock()
+// httpLog returns recent log entries of the manager (optionally of a single component)
+// as text or, with format=json, as JSON objects one per line.
+func (mgr *Manager) httpLog(w http.ResponseWriter, r *http.Request) {
+	component := r.FormValue("component")
+	asJSON := r.FormValue("format") == "json"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, e := range CachedLogEntries() {
+		if component != "" && e.Component != component {
+			continue
+		}
+		if asJSON {
+			data, _ := json.Marshal(e)
+			w.Write(append(data, '\n'))
+			continue
+		}
+		fmt.Fprintf(w, "%v\n", e)
+	}
+}
 
+func (mgr *Manager) httpCrash(w http.ResponseWriter, r *http.Request) {
 	crashID := r.FormValue("id")
 	crashes, err := mgr.collectCrashes()
 	if err != nil {
@@ -142,38 +258,79 @@ func (mgr *Manager) httpCrash(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("can't find crash %v", crashID), http.StatusInternalServerError)
 		return
 	}
+	// Bisections are done by syz-bisect, which saves its progress in the crash dir.
+	for _, kind := range []string{"cause", "fix"} {
+		file := filepath.Join(mgr.crashdir, crashID, "bisect."+kind)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		st, err := bisect.LoadState(file)
+		if err != nil {
+			Logf(0, "%v", err)
+			continue
+		}
+		crash.Bisections = append(crash.Bisections, st)
+	}
 	if err := crashTemplate.Execute(w, crash); err != nil {
 		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
+// httpCorpusDB exports the current corpus as a corpus db file (see -import_corpus flag).
+func (mgr *Manager) httpCorpusDB(w http.ResponseWriter, r *http.Request) {
+	mgr.mu.Lock()
+	progs := make([][]byte, len(mgr.corpus))
+	for i, inp := range mgr.corpus {
+		progs[i] = inp.Prog
+	}
+	mgr.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=corpus.db")
+	if err := db.Write(w, progs); err != nil {
+		Logf(0, "failed to export corpus: %v", err)
+	}
+}
+
 func (mgr *Manager) httpCorpus(w http.ResponseWriter, r *http.Request) {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
 
-	var data []UIInput
-	call := r.FormValue("call")
-	totalUnique := mgr.uniqueCover(false)
-	for i, inp := range mgr.corpus {
-		if call != inp.Call {
-			continue
-		}
-		p, err := prog.Deserialize(inp.Prog)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to deserialize program: %v", err), http.StatusInternalServerError)
+	data := &UICorpusData{
+		Call:     r.FormValue("call"),
+		Family:   r.FormValue("family") != "",
+		Contains: r.FormValue("contains"),
+		PCs:      r.FormValue("pcs"),
+	}
+	q, err := parseCorpusQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data.MinSize, data.MaxSize = q.MinSize, q.MaxSize
+	totalUnique := mgr.uniqueCover(nil)
+	for _, i := range mgr.corpusIdx.query(mgr.corpus, q) {
+		inp := mgr.corpus[i]
+		calls := mgr.corpusIdx.calls[i]
+		if len(calls) == 0 {
+			http.Error(w, "failed to deserialize program", http.StatusInternalServerError)
 			return
 		}
 		unique := cover.Intersection(inp.Cover, totalUnique)
-		data = append(data, UIInput{
-			Short:       p.String(),
+		sig := hash.Hash(inp.Prog)
+		data.Inputs = append(data.Inputs, UIInput{
+			Sig:         sig.String(),
+			Short:       strings.Join(calls, "-"),
 			Full:        string(inp.Prog),
+			Call:        inp.Call,
+			Calls:       calls,
 			Cover:       len(inp.Cover),
 			UniqueCover: len(unique),
 			N:           i,
 		})
 	}
-	sort.Sort(UIInputArray(data))
+	sort.Sort(UIInputArray(data.Inputs))
 
 	if err := corpusTemplate.Execute(w, data); err != nil {
 		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
@@ -181,48 +338,102 @@ func (mgr *Manager) httpCorpus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// httpInput shows a single corpus program, or serves it as a file with download=1.
+func (mgr *Manager) httpInput(w http.ResponseWriter, r *http.Request) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	sig := r.FormValue("sig")
+	h, err := hash.FromString(sig)
+	if err != nil {
+		http.Error(w, "can't find the input", http.StatusNotFound)
+		return
+	}
+	n, ok := mgr.corpusIdx.find(h)
+	if !ok {
+		http.Error(w, "can't find the input", http.StatusNotFound)
+		return
+	}
+	inp := mgr.corpus[n]
+	if r.FormValue("download") != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v", sig))
+		w.Write(inp.Prog)
+		return
+	}
+	p, err := prog.Deserialize(inp.Prog)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to deserialize program: %v", err), http.StatusInternalServerError)
+		return
+	}
+	data := &UIInputData{
+		Sig:         sig,
+		Prog:        string(inp.Prog),
+		Call:        inp.Call,
+		CallIndex:   inp.CallIndex,
+		Cover:       len(inp.Cover),
+		UniqueCover: len(cover.Intersection(inp.Cover, mgr.uniqueCover(nil))),
+		N:           n,
+	}
+	for _, c := range p.Calls {
+		data.Calls = append(data.Calls, c.Meta.Name)
+	}
+	if err := inputTemplate.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
 func (mgr *Manager) httpCover(w http.ResponseWriter, r *http.Request) {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
 
 	var cov cover.Cover
 	call := r.FormValue("call")
+	family := r.FormValue("family") != ""
 	unique := r.FormValue("unique") != "" && call != ""
-	perCall := false
+	var key func(string) string
 	if n, err := strconv.Atoi(call); err == nil && n < len(mgr.corpus) {
 		cov = mgr.corpus[n].Cover
 	} else {
-		perCall = true
-		for _, inp := range mgr.corpus {
-			if call == "" || call == inp.Call {
-				cov = cover.Union(cov, cover.Cover(inp.Cover))
-			}
+		key = variantKey
+		if family {
+			key = callFamily
+		}
+		for _, n := range mgr.corpusIdx.query(mgr.corpus, corpusQuery{Call: call, Family: family}) {
+			cov = cover.Union(cov, cover.Cover(mgr.corpus[n].Cover))
 		}
 	}
 	if unique {
-		cov = cover.Intersection(cov, mgr.uniqueCover(perCall))
+		cov = cover.Intersection(cov, mgr.uniqueCover(key))
 	}
 
-	if err := generateCoverHtml(w, mgr.cfg.Vmlinux, cov); err != nil {
+	if err := cover.GenerateHTML(w, mgr.cfg.Vmlinux, mgr.cfg.Kernel_Src, cov); err != nil {
 		http.Error(w, fmt.Sprintf("failed to generate coverage profile: %v", err), http.StatusInternalServerError)
 		return
 	}
 	runtime.GC()
 }
 
-func (mgr *Manager) uniqueCover(perCall bool) cover.Cover {
+// uniqueCover returns PCs covered by only one group of inputs.
+// Inputs are grouped by key(input call name), or each input is a separate group if key is nil.
+func (mgr *Manager) uniqueCover(key func(call string) string) cover.Cover {
 	totalCover := make(map[uint32]int)
 	callCover := make(map[string]map[uint32]bool)
 	for _, inp := range mgr.corpus {
-		if perCall && callCover[inp.Call] == nil {
-			callCover[inp.Call] = make(map[uint32]bool)
+		var group string
+		if key != nil {
+			group = key(inp.Call)
+			if callCover[group] == nil {
+				callCover[group] = make(map[uint32]bool)
+			}
 		}
 		for _, pc := range inp.Cover {
-			if perCall {
-				if callCover[inp.Call][pc] {
+			if key != nil {
+				if callCover[group][pc] {
 					continue
 				}
-				callCover[inp.Call][pc] = true
+				callCover[group][pc] = true
 			}
 			totalCover[pc]++
 		}
@@ -245,10 +456,13 @@ func (mgr *Manager) httpPrio(w http.ResponseWriter, r *http.Request) {
 	call := r.FormValue("call")
 	idx := -1
 	for i, c := range sys.Calls {
-		if c.CallName == call {
+		if c.Name == call {
 			idx = i
 			break
 		}
+		if idx == -1 && c.CallName == call {
+			idx = i // no exact match so far, use the first variant of the syscall
+		}
 	}
 	if idx == -1 {
 		http.Error(w, fmt.Sprintf("unknown call: %v", call), http.StatusInternalServerError)
@@ -267,6 +481,60 @@ func (mgr *Manager) httpPrio(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// callFamily returns name of the syscall that call is a variant of (e.g. ioctl for ioctl$FOO).
+// parseCorpusQuery parses corpus filters of a web UI request:
+// call, family, contains, pcs (start-end, e.g. 0xffffffff81000000-0xffffffff81001000),
+// min_size and max_size (number of calls).
+func parseCorpusQuery(r *http.Request) (corpusQuery, error) {
+	q := corpusQuery{
+		Call:     r.FormValue("call"),
+		Family:   r.FormValue("family") != "",
+		Contains: r.FormValue("contains"),
+	}
+	if pcs := r.FormValue("pcs"); pcs != "" {
+		dash := strings.IndexByte(pcs, '-')
+		if dash == -1 {
+			return q, fmt.Errorf("bad pcs filter %q, want start-end", pcs)
+		}
+		start, err1 := strconv.ParseUint(pcs[:dash], 0, 64)
+		end, err2 := strconv.ParseUint(pcs[dash+1:], 0, 64)
+		if err1 != nil || err2 != nil || start >= end {
+			return q, fmt.Errorf("bad pcs filter %q, want start-end", pcs)
+		}
+		// Coverage contains lower 32 bits of PCs.
+		q.PCStart, q.PCEnd = uint32(start), uint32(end)
+		if q.PCStart >= q.PCEnd {
+			return q, fmt.Errorf("bad pcs filter %q, the range must not cross a 4GB boundary", pcs)
+		}
+	}
+	var err error
+	for _, v := range []struct {
+		name string
+		val  *int
+	}{{"min_size", &q.MinSize}, {"max_size", &q.MaxSize}} {
+		if str := r.FormValue(v.name); str != "" {
+			if *v.val, err = strconv.Atoi(str); err != nil || *v.val < 0 {
+				return q, fmt.Errorf("bad %v filter %q", v.name, str)
+			}
+		}
+	}
+	return q, nil
+}
+
+func callFamily(call string) string {
+	if c := sys.CallMap[call]; c != nil {
+		return c.CallName
+	}
+	if idx := strings.IndexByte(call, '$'); idx != -1 {
+		return call[:idx]
+	}
+	return call
+}
+
+func variantKey(call string) string {
+	return call
+}
+
 func (mgr *Manager) httpFile(w http.ResponseWriter, r *http.Request) {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
@@ -287,6 +555,42 @@ func (mgr *Manager) httpFile(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, f)
 }
 
+// httpAdminVMs shows the number of VMs, or changes it if count is given in a POST request.
+// New VMs are booted right away, extra VMs are stopped, except for the ones
+// that are reproducing crashes, these are released when reproduction finishes.
+func (mgr *Manager) httpAdminVMs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		mgr.mu.Lock()
+		count := mgr.vmCount
+		mgr.mu.Unlock()
+		fmt.Fprintf(w, "%v\n", count)
+		return
+	}
+	if mgr.cfg.Type == "none" {
+		http.Error(w, "VMs are not managed for type none", http.StatusBadRequest)
+		return
+	}
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count <= 0 || count > 1000 {
+		http.Error(w, fmt.Sprintf("bad VM count %q, want [1, 1000]", r.FormValue("count")), http.StatusBadRequest)
+		return
+	}
+	if len(mgr.cfg.Devices) != 0 && count > len(mgr.cfg.Devices) {
+		http.Error(w, fmt.Sprintf("only %v devices are configured", len(mgr.cfg.Devices)), http.StatusBadRequest)
+		return
+	}
+	if len(mgr.cfg.Targets) != 0 && count > len(mgr.cfg.Targets) {
+		http.Error(w, fmt.Sprintf("only %v targets are configured", len(mgr.cfg.Targets)), http.StatusBadRequest)
+		return
+	}
+	select {
+	case mgr.vmScale <- count:
+		fmt.Fprintf(w, "%v\n", count)
+	case <-vm.Shutdown:
+		http.Error(w, "manager is shutting down", http.StatusServiceUnavailable)
+	}
+}
+
 func (mgr *Manager) httpReport(w http.ResponseWriter, r *http.Request) {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
@@ -316,6 +620,8 @@ func (mgr *Manager) httpReport(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// collectCrashes reads crash types from the crash dir. It only reads the disk,
+// which can be slow with many crashes, so it must be called without mgr.mu held.
 func (mgr *Manager) collectCrashes() ([]UICrashType, error) {
 	dirs, err := ioutil.ReadDir(mgr.crashdir)
 	if err != nil {
@@ -338,7 +644,8 @@ func (mgr *Manager) collectCrashes() ([]UICrashType, error) {
 		var maxTime time.Time
 		var crashes []UICrash
 		for _, f := range files {
-			if !strings.HasPrefix(f.Name(), "log") {
+			// Temp files are left over after the manager was killed in the middle of a write.
+			if !strings.HasPrefix(f.Name(), "log") || strings.Contains(f.Name(), fileutil.TempSuffix) {
 				continue
 			}
 			index, err := strconv.ParseUint(f.Name()[3:], 10, 64)
@@ -356,6 +663,31 @@ func (mgr *Manager) collectCrashes() ([]UICrashType, error) {
 			if _, err := os.Stat(filepath.Join(mgr.cfg.Workdir, reportFile)); err == nil {
 				crash.Report = reportFile
 			}
+			rawReportFile := filepath.Join("crashes", dir.Name(), "rawreport"+strconv.Itoa(int(index)))
+			if _, err := os.Stat(filepath.Join(mgr.cfg.Workdir, rawReportFile)); err == nil {
+				crash.RawReport = rawReportFile
+			}
+			othersFile := filepath.Join("crashes", dir.Name(), "others"+strconv.Itoa(int(index)))
+			if _, err := os.Stat(filepath.Join(mgr.cfg.Workdir, othersFile)); err == nil {
+				crash.Others = othersFile
+			}
+			stateFile := filepath.Join("crashes", dir.Name(), "state"+strconv.Itoa(int(index)))
+			if _, err := os.Stat(filepath.Join(mgr.cfg.Workdir, stateFile)); err == nil {
+				crash.State = stateFile
+			}
+			provenanceFile := filepath.Join("crashes", dir.Name(), "provenance"+strconv.Itoa(int(index)))
+			if _, err := os.Stat(filepath.Join(mgr.cfg.Workdir, provenanceFile)); err == nil {
+				crash.Mutations = provenanceFile
+			}
+			corrupted, _ := ioutil.ReadFile(filepath.Join(mgr.crashdir, dir.Name(), "corrupted"+strconv.Itoa(int(index))))
+			crash.Corrupted = string(corrupted)
+			assetsFile := filepath.Join("crashes", dir.Name(), "assets"+strconv.Itoa(int(index)))
+			if _, err := os.Stat(filepath.Join(mgr.cfg.Workdir, assetsFile)); err == nil {
+				crash.Assets = assetsFile
+			}
+			if _, err := os.Stat(filepath.Join(mgr.crashdir, dir.Name(), "console"+strconv.Itoa(int(index)))); err == nil {
+				crash.Console = true
+			}
 			crashes = append(crashes, crash)
 			if maxTime.Before(f.ModTime()) {
 				maxTime = f.ModTime()
@@ -373,14 +705,39 @@ func (mgr *Manager) collectCrashes() ([]UICrashType, error) {
 		} else if _, err := os.Stat(filepath.Join(mgr.crashdir, dir.Name(), "repro.report")); err == nil && !mgr.needRepro(string(desc)) {
 			triaged = "non-reproducible"
 		}
-		crashTypes = append(crashTypes, UICrashType{
+		// Crash dirs created before stats were introduced have only the logs.
+		stats := readCrashStats(filepath.Join(mgr.crashdir, dir.Name()))
+		if stats.Count == 0 {
+			stats.Count = len(crashes)
+			stats.Last = maxTime
+		}
+		firstTime := ""
+		if !stats.First.IsZero() {
+			firstTime = stats.First.Format(dateFormat)
+		}
+		_, err = os.Stat(filepath.Join(mgr.crashdir, dir.Name(), "suppressed"))
+		class := crashClass(string(desc))
+		ct := UICrashType{
 			Description: string(desc),
-			LastTime:    maxTime.Format(dateFormat),
+			Type:        class.Type,
+			Severity:    class.Severity,
+			FirstTime:   firstTime,
+			LastTime:    stats.Last.Format(dateFormat),
 			ID:          dir.Name(),
-			Count:       len(crashes),
+			Count:       stats.Count,
+			Compared:    stats.Compared,
 			Triaged:     triaged,
+			Suppressed:  err == nil,
 			Crashes:     crashes,
-		})
+			first:       stats.First,
+			last:        stats.Last,
+		}
+		if guilty, err := ioutil.ReadFile(filepath.Join(mgr.crashdir, dir.Name(), "guilty")); err == nil {
+			ct.Guilty = string(guilty)
+			maintainers, _ := ioutil.ReadFile(filepath.Join(mgr.crashdir, dir.Name(), "maintainers"))
+			ct.Maintainers = strings.Fields(string(maintainers))
+		}
+		crashTypes = append(crashTypes, ct)
 	}
 	sort.Sort(UICrashTypeArray(crashTypes))
 	return crashTypes, nil
@@ -394,28 +751,58 @@ func trimNewLines(data []byte) []byte {
 }
 
 type UISummaryData struct {
+	Name     string
+	Stats    []UIStat
+	Areas    []UIFocusArea
+	Calls    []UICallType
+	Families []UICallType
+	Crashes  []UICrashType
+	Log      string
+}
+
+type UIFocusArea struct {
 	Name    string
-	Stats   []UIStat
-	Calls   []UICallType
-	Crashes []UICrashType
-	Log     string
+	Weight  int
+	VMs     int
+	Inputs  int
+	Cover   int
+	Execs   uint64
+	Crashes int
 }
 
 type UICrashType struct {
 	Description string
+	Type        string          // bug type, e.g. "use-after-free"
+	Severity    report.Severity // crashes are sorted by severity
+	FirstTime   string
 	LastTime    string
 	ID          string
 	Count       int
+	Compared    int // occurrences on the compared kernel in A/B mode
 	Triaged     string
+	Suppressed  bool
+	Guilty      string   // guilty source file of the crash (if known)
+	Maintainers []string // suggested CC list for the guilty file
 	Crashes     []UICrash
+	Bisections  []*bisect.State
+
+	first, last time.Time // for /api/summary
 }
 
 type UICrash struct {
-	Index  int
-	Time   string
-	Log    string
-	Report string
-	Tag    string
+	Index     int
+	Time      string
+	Log       string
+	Report    string
+	RawReport string // report before symbolization
+	Corrupted string // why the report looks corrupted (if it does)
+	Others    string // other reports in the log
+	State     string // machine state captured after the crash
+	Mutations string // provenance of args of the last programs (changed since their seeds or inherited)
+	Assets    string
+	Tag       string
+
+	Console bool // full output of the VM run is available
 }
 
 type UIStat struct {
@@ -426,15 +813,39 @@ type UIStat struct {
 
 type UICallType struct {
 	Name        string
+	Variants    int // number of syscall variants with inputs (for syscall families)
 	Inputs      int
 	Cover       int
 	UniqueCover int
 }
 
+type UICorpusData struct {
+	Call     string // call filter, all inputs are shown if empty
+	Family   bool   // filter selects all variants of a syscall
+	Contains string // filter by a call contained in the program
+	PCs      string // filter by covered PC range (start-end)
+	MinSize  int    // filter by number of calls
+	MaxSize  int
+	Inputs   []UIInput
+}
+
 type UIInput struct {
+	Sig         string
 	Short       string
 	Full        string
-	Calls       int
+	Call        string   // call the input was added to corpus for
+	Calls       []string // all calls of the program
+	Cover       int
+	UniqueCover int
+	N           int
+}
+
+type UIInputData struct {
+	Sig         string
+	Prog        string
+	Call        string
+	CallIndex   int
+	Calls       []string
 	Cover       int
 	UniqueCover int
 	N           int
@@ -460,9 +871,16 @@ func (a UIStatArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
 type UICrashTypeArray []UICrashType
 
-func (a UICrashTypeArray) Len() int           { return len(a) }
-func (a UICrashTypeArray) Less(i, j int) bool { return a[i].Description < a[j].Description }
-func (a UICrashTypeArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a UICrashTypeArray) Len() int      { return len(a) }
+func (a UICrashTypeArray) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+
+// Less sorts crashes by severity, so that memory corruptions go first.
+func (a UICrashTypeArray) Less(i, j int) bool {
+	if a[i].Severity != a[j].Severity {
+		return a[i].Severity > a[j].Severity
+	}
+	return a[i].Description < a[j].Description
+}
 
 type UICrashArray []UICrash
 
@@ -497,18 +915,51 @@ var summaryTemplate = template.Must(template.New("").Parse(addStyle(`
 </table>
 <br>
 
+{{if $.Areas}}
+<table>
+	<caption>Focus areas:</caption>
+	<tr>
+		<th>Name</th>
+		<th>Weight</th>
+		<th>VMs</th>
+		<th>Inputs</th>
+		<th>Cover</th>
+		<th>Executed</th>
+		<th>Crashes</th>
+	</tr>
+	{{range $a := $.Areas}}
+	<tr>
+		<td>{{$a.Name}}</td>
+		<td>{{$a.Weight}}</td>
+		<td>{{$a.VMs}}</td>
+		<td>{{$a.Inputs}}</td>
+		<td>{{$a.Cover}}</td>
+		<td>{{$a.Execs}}</td>
+		<td>{{$a.Crashes}}</td>
+	</tr>
+	{{end}}
+</table>
+<br>
+{{end}}
+
 <table>
 	<caption>Crashes:</caption>
 	<tr>
 		<th>Description</th>
+		<th>Type</th>
+		<th>Severity</th>
 		<th>Count</th>
+		<th>First Time</th>
 		<th>Last Time</th>
 		<th>Report</th>
 	</tr>
 	{{range $c := $.Crashes}}
 	<tr>
-		<td><a href="/crash?id={{$c.ID}}">{{$c.Description}}</a></td>
+		<td><a href="/crash?id={{$c.ID}}">{{$c.Description}}</a>{{if $c.Suppressed}} (suppressed){{end}}</td>
+		<td>{{$c.Type}}</td>
+		<td>{{$c.Severity}}</td>
 		<td>{{$c.Count}}</td>
+		<td>{{$c.FirstTime}}</td>
 		<td>{{$c.LastTime}}</td>
 		<td>
 			{{if $c.Triaged}}
@@ -520,7 +971,7 @@ var summaryTemplate = template.Must(template.New("").Parse(addStyle(`
 </table>
 <br>
 
-<b>Log:</b>
+<b>Log:</b> (<a href="/debug/log">text</a>, <a href="/debug/log?format=json">json</a>)
 <br>
 <textarea id="log_textarea" readonly rows="20">
 {{.Log}}
@@ -541,6 +992,16 @@ var summaryTemplate = template.Must(template.New("").Parse(addStyle(`
 		<a href='/cover?call={{$c.Name}}&unique=1'>unique:{{$c.UniqueCover}}</a>
 		<a href='/prio?call={{$c.Name}}'>prio</a> <br>
 {{end}}
+<br>
+
+<b>Per-syscall coverage (all variants):</b>
+<br>
+{{range $c := $.Families}}
+	{{$c.Name}} ({{$c.Variants}} variants)
+		<a href='/corpus?call={{$c.Name}}&family=1'>inputs:{{$c.Inputs}}</a>
+		<a href='/cover?call={{$c.Name}}&family=1'>cover:{{$c.Cover}}</a>
+		<a href='/cover?call={{$c.Name}}&family=1&unique=1'>unique:{{$c.UniqueCover}}</a> <br>
+{{end}}
 </body></html>
 `)))
 
@@ -554,17 +1015,54 @@ var crashTemplate = template.Must(template.New("").Parse(addStyle(`
 <body>
 <b>{{.Description}}</b>
 <br><br>
+Seen {{.Count}} times{{if .FirstTime}}, first at {{.FirstTime}}{{end}}, last at {{.LastTime}}.
+<br>
+Type: {{.Type}}, {{.Severity}} severity.
+<br><br>
 
 {{if .Triaged}}
 Report: <a href="/report?id={{.ID}}">{{.Triaged}}</a>
 {{end}}
+{{if .Guilty}}
+<br>Guilty file: {{.Guilty}}
+{{if .Maintainers}}<br>Suggested CC: {{range $i, $m := .Maintainers}}{{if $i}}, {{end}}{{$m}}{{end}}{{end}}
+{{end}}
 <br><br>
 
+{{range $b := .Bisections}}
+<b>Bisection of the {{$b.Kind}}: {{$b.Status}}</b>
+{{if $b.Commit}}, commit {{$b.Commit}} "{{$b.CommitTitle}}"{{end}}
+{{if $b.Error}}<pre>{{$b.Error}}</pre>{{end}}
+<br>
+Started at {{$b.Started.Format "Jan 02 2006 15:04:05 MST"}}, updated at {{$b.Updated.Format "Jan 02 2006 15:04:05 MST"}}.
+<table>
+	<tr>
+		<th>Commit</th>
+		<th>Title</th>
+		<th>Result</th>
+		<th>Crash</th>
+		<th>Time</th>
+	</tr>
+	{{range $s := $b.Steps}}
+	<tr>
+		<td>{{$s.Commit}}</td>
+		<td>{{$s.CommitTitle}}</td>
+		<td>{{$s.Result}}{{if $s.Error}} <span title="{{$s.Error}}">(error)</span>{{end}}</td>
+		<td>{{$s.Crash}}</td>
+		<td>{{$s.Time.Format "Jan 02 2006 15:04:05 MST"}}</td>
+	</tr>
+	{{end}}
+</table>
+<br><br>
+{{end}}
+
 <table>
 	<tr>
 		<th>#</th>
 		<th>Log</th>
 		<th>Report</th>
+		<th>Assets</th>
+		<th>Console</th>
 		<th>Time</th>
 		<th>Tag</th>
 	</tr>
@@ -573,7 +1071,22 @@ Report: <a href="/report?id={{.ID}}">{{.Triaged}}</a>
 		<td>{{$c.Index}}</td>
 		<td><a href="/file?name={{$c.Log}}">log</a></td>
 		{{if $c.Report}}
-			<td><a href="/file?name={{$c.Report}}">report</a></td>
+			<td><a href="/file?name={{$c.Report}}">report</a>
+			{{if $c.RawReport}}(<a href="/file?name={{$c.RawReport}}">raw</a>){{end}}
+			{{if $c.Others}}<br><a href="/file?name={{$c.Others}}">other reports</a>{{end}}
+			{{if $c.State}}<br><a href="/file?name={{$c.State}}">machine state</a>{{end}}
+			{{if $c.Mutations}}<br><a href="/file?name={{$c.Mutations}}">mutations</a>{{end}}
+			{{if $c.Corrupted}}<br>corrupted: {{$c.Corrupted}}{{end}}</td>
+		{{else}}
+			<td></td>
+		{{end}}
+		{{if $c.Assets}}
+			<td><a href="/file?name={{$c.Assets}}">assets</a></td>
+		{{else}}
+			<td></td>
+		{{end}}
+		{{if $c.Console}}
+			<td><a href="/console?id={{$.ID}}&index={{$c.Index}}">console</a></td>
 		{{else}}
 			<td></td>
 		{{end}}
@@ -593,12 +1106,55 @@ var corpusTemplate = template.Must(template.New("").Parse(addStyle(`
 	{{STYLE}}
 </head>
 <body>
-{{range $c := $}}
-	<span title="{{$c.Full}}">{{$c.Short}}</span>
-		<a href='/cover?call={{$c.N}}'>cover:{{$c.Cover}}</a>
-		<a href='/cover?call={{$c.N}}&unique=1'>unique:{{$c.UniqueCover}}</a>
-		<br>
-{{end}}
+<table>
+	<caption>
+		Corpus{{if $.Call}} inputs for {{$.Call}}{{if $.Family}} (all variants){{end}}{{end}}
+		{{if $.Contains}} containing {{$.Contains}}{{end}}
+		{{if $.PCs}} covering PCs {{$.PCs}}{{end}}
+		{{if or $.MinSize $.MaxSize}} with {{$.MinSize}}-{{if $.MaxSize}}{{$.MaxSize}}{{end}} calls{{end}}: {{len $.Inputs}}
+		{{if not (or $.Call $.Contains $.PCs $.MinSize $.MaxSize)}}(<a href="/corpus.db">download corpus db</a>){{end}}
+	</caption>
+	<tr>
+		<th>Program</th>
+		<th>Call</th>
+		<th>Calls</th>
+		<th>Cover</th>
+		<th>Unique</th>
+		<th></th>
+	</tr>
+	{{range $c := $.Inputs}}
+	<tr>
+		<td><a href="/input?sig={{$c.Sig}}" title="{{$c.Full}}">{{$c.Short}}</a></td>
+		<td><a href="/corpus?call={{$c.Call}}">{{$c.Call}}</a></td>
+		<td>{{range $i, $call := $c.Calls}}{{if $i}}, {{end}}<a href="/corpus?contains={{$call}}">{{$call}}</a>{{end}}</td>
+		<td><a href="/cover?call={{$c.N}}">{{$c.Cover}}</a></td>
+		<td><a href="/cover?call={{$c.N}}&unique=1">{{$c.UniqueCover}}</a></td>
+		<td><a href="/input?sig={{$c.Sig}}&download=1">download</a></td>
+	</tr>
+	{{end}}
+</table>
+</body></html>
+`)))
+
+var inputTemplate = template.Must(template.New("").Parse(addStyle(`
+<!doctype html>
+<html>
+<head>
+	<title>syzkaller corpus input {{$.Sig}}</title>
+	{{STYLE}}
+</head>
+<body>
+<b>Input {{$.Sig}}</b>
+(<a href="/input?sig={{$.Sig}}&download=1">download</a>)
+<br><br>
+Added to corpus for call #{{$.CallIndex}} <a href="/corpus?call={{$.Call}}">{{$.Call}}</a>:
+<a href="/cover?call={{$.N}}">cover:{{$.Cover}}</a>
+<a href="/cover?call={{$.N}}&unique=1">unique:{{$.UniqueCover}}</a>
+<br><br>
+Calls:
+{{range $i, $call := $.Calls}}{{if $i}}, {{end}}<a href="/corpus?call={{$call}}">{{$call}}</a>{{end}}
+<br><br>
+<pre>{{$.Prog}}</pre>
 </body></html>
 `)))
 
@@ -5,8 +5,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/rpc"
@@ -14,6 +20,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -21,24 +28,42 @@ import (
 	"github.com/google/syzkaller/config"
 	"github.com/google/syzkaller/cover"
 	"github.com/google/syzkaller/csource"
+	"github.com/google/syzkaller/dashapi"
+	"github.com/google/syzkaller/db"
+	"github.com/google/syzkaller/fileutil"
 	"github.com/google/syzkaller/hash"
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/prog"
 	"github.com/google/syzkaller/report"
 	"github.com/google/syzkaller/repro"
 	. "github.com/google/syzkaller/rpctype"
+	"github.com/google/syzkaller/symbolizer"
 	"github.com/google/syzkaller/sys"
 	"github.com/google/syzkaller/vm"
 	_ "github.com/google/syzkaller/vm/adb"
+	_ "github.com/google/syzkaller/vm/bhyve"
+	_ "github.com/google/syzkaller/vm/cuttlefish"
 	_ "github.com/google/syzkaller/vm/gce"
+	_ "github.com/google/syzkaller/vm/gvisor"
+	_ "github.com/google/syzkaller/vm/hyperv"
+	_ "github.com/google/syzkaller/vm/isolated"
 	_ "github.com/google/syzkaller/vm/kvm"
 	_ "github.com/google/syzkaller/vm/local"
+	_ "github.com/google/syzkaller/vm/proxy"
 	_ "github.com/google/syzkaller/vm/qemu"
+	_ "github.com/google/syzkaller/vm/vmm"
+	_ "github.com/google/syzkaller/vm/vmware"
 )
 
 var (
 	flagConfig = flag.String("config", "", "configuration file")
 	flagDebug  = flag.Bool("debug", false, "dump all VM output to console")
+	flagBench  = flag.String("bench", "", "append JSON snapshots of stats to this file every minute")
+	flagImport = flag.String("import_corpus", "", "merge programs from corpus db file into corpus on start")
+
+	flagPatch     = flag.String("patch", "", "test whether the patch fixes the -crash and exit")
+	flagCrash     = flag.String("crash", "", "crash id (dir name in workdir/crashes) to test the -patch against")
+	flagPatchTime = flag.Duration("patch_time", time.Hour, "how long to fuzz the patched kernel")
 )
 
 type Manager struct {
@@ -49,28 +74,72 @@ type Manager struct {
 	startTime        time.Time
 	firstConnect     time.Time
 	stats            map[string]uint64
-	vmStop           chan bool
+	vmScale          chan int // requests to change the number of VMs
+	vmCount          int      // target number of VMs, protected by mu
+	boot             *bootScheduler
+	watchdog         *vm.Watchdog
+	symbCache        *symbolizer.Cache // nil if the cache can't be created
 	vmChecked        bool
 	fresh            bool
 
 	mu              sync.Mutex
 	enabledSyscalls string
-	enabledCalls    []string // as determined by fuzzer
+	enabledCalls    []string   // as determined by fuzzer
+	checkResult     *CheckArgs // machine features as determined by fuzzer
 
-	candidates     [][]byte // untriaged inputs
+	candidates     []candidate // untriaged inputs
+	corpusTag      string      // see corpusTag function
+	corpusTagSaved bool
 	disabledHashes []string
 	corpus         []RpcInput
+	corpusIdx      *corpusIndex // changes of corpus must go through addCorpusInput and setCorpus
 	corpusCover    []cover.Cover
+	maxCover       []cover.Cover // union of max cover of all fuzzers
 	prios          [][]float32
+	coverFilter    []PCRange
+	errnos         map[string]map[int]uint64 // syscall name -> errno (0 for success) -> executions
+	attribution    *coverAttribution         // of inputs of the main kernel in A/B comparison mode, like errnos
+
+	candidateLimiter *rateLimiter // nil if candidate rate is not capped
+
+	fuzzing    fuzzingState      // changed only by vmLoop
+	fuzzingCtl chan fuzzingState // requests to pause, resume or stop fuzzing
 
 	fuzzers   map[string]*Fuzzer
 	hub       *rpc.Client
 	hubCorpus map[hash.Sig]bool
+
+	notifier *Notifier  // nil if notifications are not configured
+	patch    *PatchTest // non-nil in patch testing mode
+	assets   []Asset    // kernel build artifacts archived with crashes
+
+	dash       *dashapi.Queue // nil if dashboard is not configured
+	dashCorpus [][]byte       // new corpus programs not yet uploaded to dashboard
+
+	areas []*focusArea // VMs are split between these (if configured)
+
+	compare *compareState // non-nil in A/B comparison mode
+
+	console *consoleLogs // nil if console logs are not saved
+
+	snapshots *snapshotVMs // VMs kept between runs in snapshot mode (nil if not enabled)
+
+	tlsConfig *tls.Config // nil if rpc and http are not served over TLS
+	tokenFile string      // auth_token saved in workdir to be copied to VMs (empty if no auth_token)
 }
 
 type Fuzzer struct {
 	name   string
 	inputs []RpcInput
+
+	newMaxCover  []cover.Cover // max cover discovered by other fuzzers, not yet sent to this fuzzer
+	sentMaxCover []cover.Cover // max cover sent in the last reply, not yet acknowledged
+	maxCoverSeq  uint64
+
+	area   *focusArea // nil if focus areas are not configured
+	kernel int        // 1 if the fuzzer runs on the compared kernel in A/B mode
+
+	triaged bool // all candidates handed out to the fuzzer are triaged (see PollArgs.Triaged)
 }
 
 type Crash struct {
@@ -78,6 +147,40 @@ type Crash struct {
 	desc   string
 	text   []byte
 	output []byte
+	area   *focusArea // focus area of the VM (if configured)
+	kernel int        // 1 if the crash happened on the compared kernel in A/B mode
+	// Why the report looks corrupted (e.g. truncated or interleaved), empty if it looks fine.
+	corrupted string
+	// Other reports in the output, saved as context of the primary report.
+	others []*report.Report
+	// State of the machine captured after the crash (see crash_state config param).
+	state []byte
+
+	console    *consoleRef  // full output of the VM run (if console logs are saved)
+	reproState *repro.State // progress of the reproduction resumed after restart
+}
+
+// kernelBug returns true if the crash is a kernel crash or hang. Other failures
+// (lost connections, silent reboots and crashes of syzkaller itself) are saved,
+// but not reproduced or reported.
+func (crash *Crash) kernelBug() bool {
+	kind := vm.Classify(crash.desc)
+	return kind == vm.KernelCrash || kind == vm.Hang
+}
+
+// crashClass returns the bug type and severity of the crash with title desc.
+// Failures that are not kernel crash reports are classified by vm.Classify.
+func crashClass(desc string) report.Class {
+	switch vm.Classify(desc) {
+	case vm.Hang:
+		return report.Class{Type: "hang", Severity: report.SeverityMedium}
+	case vm.LostConnection, vm.Reboot:
+		return report.Class{Type: "machine failure", Severity: report.SeverityLow}
+	case vm.FuzzerCrash:
+		return report.Class{Type: "syzkaller failure", Severity: report.SeverityLow}
+	default:
+		return report.Classify(desc)
+	}
 }
 
 func main() {
@@ -87,26 +190,59 @@ func main() {
 	if err != nil {
 		Fatalf("%v", err)
 	}
+	// gVisor implements the Linux ABI and is fuzzed with Linux descriptions.
+	if cfg.Target_Os != "linux" && cfg.Target_Os != "gvisor" && sys.OS != cfg.Target_Os {
+		// The managers for Fuchsia and Windows run on a Linux host, Go does not know Fuchsia
+		// and Windows descriptions use a tag different from GOOS.
+		rebuild := "GOOS=" + cfg.Target_Os
+		switch cfg.Target_Os {
+		case "fuchsia":
+			rebuild = "-tags fuchsia"
+		case "windows":
+			rebuild = "-tags windows_nt"
+		}
+		Fatalf("target_os is %v, but syzkaller is built with %v descriptions, rebuild with %v",
+			cfg.Target_Os, sys.OS, rebuild)
+	}
 	if *flagDebug {
 		cfg.Debug = true
 		cfg.Count = 1
 	}
-	initAllCover(cfg.Vmlinux)
-	RunManager(cfg, syscalls)
+	if *flagPatch != "" {
+		testPatch(cfg, syscalls, *flagPatch, *flagCrash, *flagPatchTime)
+		return
+	}
+	cover.InitReport(cfg.Vmlinux)
+	RunManager(cfg, syscalls, nil)
 }
 
-func RunManager(cfg *config.Config, syscalls map[int]bool) {
+var shutdownOnce sync.Once
+
+// shutdown stops all VMs, after that vmLoop returns.
+func shutdown() {
+	shutdownOnce.Do(func() {
+		close(vm.Shutdown)
+		Logf(0, "shutting down...")
+	})
+}
+
+func RunManager(cfg *config.Config, syscalls map[int]bool, patch *PatchTest) {
 	crashdir := filepath.Join(cfg.Workdir, "crashes")
 	os.MkdirAll(crashdir, 0700)
 
-	enabledSyscalls := ""
+	enabledSyscalls := formatSyscalls(syscalls)
 	if len(syscalls) != 0 {
-		buf := new(bytes.Buffer)
+		Logf(1, "enabled syscalls: %v", enabledSyscalls)
+		// Warn about misconfigured enable/disable lists early,
+		// the fuzzer will silently drop these calls.
+		calls := make(map[*sys.Call]bool)
 		for c := range syscalls {
-			fmt.Fprintf(buf, ",%v", c)
+			calls[sys.Calls[c]] = true
+		}
+		_, dead := sys.TransitivelyEnabledCallsReasons(calls)
+		for c, reason := range dead {
+			Logf(0, "enabled syscall %v can't be generated: %v", c.Name, reason)
 		}
-		enabledSyscalls = buf.String()[1:]
-		Logf(1, "enabled syscalls: %v", enabledSyscalls)
 	}
 
 	mgr := &Manager{
@@ -115,21 +251,124 @@ func RunManager(cfg *config.Config, syscalls map[int]bool) {
 		startTime:       time.Now(),
 		stats:           make(map[string]uint64),
 		enabledSyscalls: enabledSyscalls,
+		corpusIdx:       newCorpusIndex(nil),
 		corpusCover:     make([]cover.Cover, sys.CallCount),
+		maxCover:        make([]cover.Cover, sys.CallCount),
+		errnos:          make(map[string]map[int]uint64),
+		attribution:     newCoverAttribution(),
 		fuzzers:         make(map[string]*Fuzzer),
 		fresh:           true,
-		vmStop:          make(chan bool),
+		vmScale:         make(chan int),
+		fuzzingCtl:      make(chan fuzzingState),
+		vmCount:         cfg.Count,
+		boot:            newBootScheduler(),
+		patch:           patch,
+	}
+	if cfg.Candidate_Rate != 0 {
+		mgr.candidateLimiter = newRateLimiter(cfg.Candidate_Rate)
+	}
+	if cache, err := symbolizer.NewCache(filepath.Join(cfg.Workdir, "symbolizer")); err != nil {
+		Logf(0, "%v", err)
+	} else {
+		mgr.symbCache = cache
+	}
+
+	if cfg.Notify != nil {
+		mgr.notifier = newNotifier(cfg)
+	}
+
+	if cfg.Dashboard_Addr != "" {
+		client, err := dashapi.New(cfg.Dashboard_Type, cfg.Dashboard_Client, cfg.Dashboard_Addr, cfg.Dashboard_Key)
+		if err != nil {
+			Fatalf("%v", err)
+		}
+		mgr.dash, err = dashapi.NewQueue(client, filepath.Join(cfg.Workdir, "dashboard"))
+		if err != nil {
+			Fatalf("%v", err)
+		}
+	}
+
+	if cfg.Crash_Assets != "" {
+		Logf(0, "hashing kernel build artifacts...")
+		assets, err := initAssets(cfg)
+		if err != nil {
+			Fatalf("%v", err)
+		}
+		mgr.assets = assets
+	}
+
+	if len(cfg.Focus_Areas) != 0 {
+		areas, err := initFocusAreas(cfg)
+		if err != nil {
+			Fatalf("%v", err)
+		}
+		mgr.areas = areas
+	}
+
+	if cfg.Console_Log_Size != 0 {
+		mgr.console = newConsoleLogs(cfg.Workdir, cfg.Console_Log_Size, cfg.Console_Log_Files)
+	}
+	if cfg.Snapshot {
+		mgr.snapshots = newSnapshotVMs()
+	}
+
+	if cfg.Compare != nil {
+		Logf(0, "A/B comparison mode: odd VMs boot kernel %v (%v)", cfg.Compare.Kernel, cfg.Compare.Tag)
+		mgr.compare = newCompareState(cfg)
+	}
+
+	if cfg.Cover_Filter != nil {
+		Logf(0, "resolving cover filter...")
+		ranges, err := initCoverFilter(cfg.Vmlinux, cfg.Cover_Filter)
+		if err != nil {
+			Fatalf("%v", err)
+		}
+		mgr.coverFilter = ranges
 	}
 
 	Logf(0, "loading corpus...")
+	tag, err := corpusTag(cfg)
+	if err != nil {
+		Fatalf("%v", err)
+	}
+	mgr.corpusTag = tag
+	// Programs were minimized for a different kernel or descriptions,
+	// so fuzzers need to minimize them again.
+	minimized := readCorpusTag(cfg.Workdir) == tag
+	if !minimized {
+		Logf(0, "kernel or descriptions have changed, corpus will be re-minimized")
+	}
+	var broken [][]byte
 	mgr.persistentCorpus = newPersistentSet(filepath.Join(cfg.Workdir, "corpus"), func(data []byte) bool {
 		mgr.fresh = false
 		if _, err := prog.Deserialize(data); err != nil {
-			Logf(0, "deleting broken program: %v\n%s", err, data)
+			Logf(1, "broken program: %v\n%s", err, data)
+			broken = append(broken, data)
 			return false
 		}
 		return true
 	})
+	if len(broken) != 0 {
+		mgr.migrateCorpus(broken, syscalls)
+	}
+	if *flagImport != "" && mgr.patch == nil {
+		progs, err := db.ReadFile(*flagImport)
+		if err != nil {
+			Fatalf("failed to import corpus: %v", err)
+		}
+		imported := 0
+		for _, data := range progs {
+			if _, err := prog.Deserialize(data); err != nil {
+				Logf(0, "skipping broken imported program: %v", err)
+				continue
+			}
+			if mgr.persistentCorpus.add(data) {
+				imported++
+				mgr.fresh = false
+			}
+		}
+		Logf(0, "imported %v new programs (%v in %v)", imported, len(progs), *flagImport)
+	}
 	for _, data := range mgr.persistentCorpus.a {
 		p, err := prog.Deserialize(data)
 		if err != nil {
@@ -152,10 +391,27 @@ func RunManager(cfg *config.Config, syscalls map[int]bool) {
 			mgr.disabledHashes = append(mgr.disabledHashes, sig.String())
 			continue
 		}
-		mgr.candidates = append(mgr.candidates, data)
+		mgr.addCandidate(RpcCandidate{Prog: data, Minimized: minimized}, p)
 	}
+	mgr.prioritizeCandidates()
 	Logf(0, "loaded %v programs (%v total)", len(mgr.candidates), len(mgr.persistentCorpus.m))
 
+	if cfg.Tls_Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Tls_Cert, cfg.Tls_Key)
+		if err != nil {
+			Fatalf("failed to load TLS certificate: %v", err)
+		}
+		mgr.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if cfg.Auth_Token != "" {
+		// The token is passed to fuzzers in a file rather than on the command line,
+		// which is visible to all users of the machine.
+		mgr.tokenFile = filepath.Join(cfg.Workdir, "token")
+		if err := fileutil.WriteFileAtomic(mgr.tokenFile, []byte(cfg.Auth_Token), 0600); err != nil {
+			Fatalf("failed to write auth token: %v", err)
+		}
+	}
+
 	// Create HTTP server.
 	mgr.initHttp()
 
@@ -164,7 +420,7 @@ func RunManager(cfg *config.Config, syscalls map[int]bool) {
 	if err != nil {
 		Fatalf("failed to listen on %v: %v", cfg.Rpc, err)
 	}
-	Logf(0, "serving rpc on tcp://%v", ln.Addr())
+	Logf(0, "serving rpc on tcp://%v (tls=%v, auth=%v)", ln.Addr(), mgr.tlsConfig != nil, cfg.Auth_Token != "")
 	mgr.port = ln.Addr().(*net.TCPAddr).Port
 	s := rpc.NewServer()
 	s.Register(mgr)
@@ -177,10 +433,27 @@ func RunManager(cfg *config.Config, syscalls map[int]bool) {
 			}
 			conn.(*net.TCPConn).SetKeepAlive(true)
 			conn.(*net.TCPConn).SetKeepAlivePeriod(time.Minute)
-			go s.ServeCodec(jsonrpc.NewServerCodec(conn))
+			if mgr.tlsConfig != nil {
+				conn = tls.Server(conn, mgr.tlsConfig)
+			}
+			go func() {
+				if err := RpcAuthenticate(conn, cfg.Auth_Token); err != nil {
+					Logf(0, "rejected rpc connection from %v: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				if cfg.Rpc_Compression {
+					conn = NewCompressedConn(conn)
+				}
+				s.ServeCodec(jsonrpc.NewServerCodec(conn))
+			}()
 		}
 	}()
 
+	if *flagBench != "" {
+		mgr.benchLoop(*flagBench)
+	}
+
 	go func() {
 		for {
 			time.Sleep(10 * time.Second)
@@ -192,6 +465,22 @@ func RunManager(cfg *config.Config, syscalls map[int]bool) {
 		}
 	}()
 
+	go func() {
+		for {
+			time.Sleep(corpusDistillPeriod)
+			mgr.distillCorpus()
+		}
+	}()
+
+	if mgr.dash != nil {
+		go func() {
+			for {
+				time.Sleep(time.Minute)
+				mgr.dashSync()
+			}
+		}()
+	}
+
 	if mgr.cfg.Hub_Addr != "" {
 		go func() {
 			for {
@@ -203,15 +492,36 @@ func RunManager(cfg *config.Config, syscalls map[int]bool) {
 
 	go func() {
 		c := make(chan os.Signal, 2)
-		signal.Notify(c, syscall.SIGINT)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		<-c
-		close(vm.Shutdown)
-		Logf(0, "shutting down...")
+		shutdown()
 		<-c
 		Fatalf("terminating")
 	}()
 
+	mgr.watchdog = vm.NewWatchdog(cfg.Type, cfg.Workdir, func(name string, delta uint64) {
+		mgr.mu.Lock()
+		mgr.stats[name] += delta
+		mgr.mu.Unlock()
+	})
 	mgr.vmLoop()
+	mgr.flushState()
+}
+
+// flushState is called on shutdown after all VMs are stopped, it waits for RPCs
+// that are persisting new inputs and saves state that is kept in memory.
+// All state files are written with fileutil.WriteFileAtomic or WriteFileAtomicNoSync,
+// so a hard kill at any point leaves the previous version of a file rather than a corrupted one.
+// Only files that are expensive to lose (corpus.tag, repro jobs) are synced to disk.
+func (mgr *Manager) flushState() {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.symbCache != nil {
+		if err := mgr.symbCache.Flush(); err != nil {
+			Logf(0, "failed to flush symbolizer cache: %v", err)
+		}
+	}
+	Logf(0, "saved state: %v corpus programs", len(mgr.persistentCorpus.m))
 }
 
 type RunResult struct {
@@ -227,23 +537,71 @@ type ReproResult struct {
 	err       error
 }
 
+// migrateCorpus fixes up corpus programs that don't match the current syscall descriptions
+// (e.g. because calls were renamed or arguments changed) and adds them back to the corpus.
+func (mgr *Manager) migrateCorpus(broken [][]byte, syscalls map[int]bool) {
+	enabled := make(map[*sys.Call]bool)
+	enabledNames := make(map[string]bool)
+	for c := range syscalls {
+		enabled[sys.Calls[c]] = true
+		enabledNames[sys.Calls[c].Name] = true
+	}
+	ct := prog.BuildChoiceTable(prog.CalculatePriorities(nil), enabled)
+	migrated, fixed := 0, 0
+	for _, data := range broken {
+		p, n, err := prog.Migrate(data, ct)
+		if err != nil {
+			Logf(1, "failed to migrate program: %v\n%s", err, data)
+			continue
+		}
+		// A renamed call can be matched to a variant that is disabled in this manager.
+		if !callsEnabled(p, enabledNames) {
+			Logf(1, "migrated program contains disabled calls:\n%s", p.Serialize())
+			continue
+		}
+		if mgr.persistentCorpus.add(p.Serialize()) {
+			migrated++
+			fixed += n
+		}
+	}
+	total := len(mgr.persistentCorpus.a) - migrated + len(broken)
+	lost := len(broken) - migrated
+	Logf(0, "%v programs don't match descriptions: migrated %v (%v calls fixed), lost %v (%.1f%% of corpus)",
+		len(broken), migrated, fixed, lost, float64(lost)*100/float64(total))
+	mgr.stats["corpus migrated"] += uint64(migrated)
+	mgr.stats["corpus lost"] += uint64(lost)
+}
+
 func (mgr *Manager) vmLoop() {
 	Logf(0, "booting test machines...")
-	reproInstances := 4
-	if reproInstances > mgr.cfg.Count {
-		reproInstances = mgr.cfg.Count
-	}
-	instances := make([]int, mgr.cfg.Count)
+	// Reproduction can take away at most Repro_Percent of VMs from fuzzing.
+	target := mgr.cfg.Count
+	reproVMs, reproInstances := mgr.reproVMs(target)
+	reproRunning := 0
+	instances := make([]int, target)
 	for i := range instances {
-		instances[i] = mgr.cfg.Count - i - 1
+		instances[i] = target - i - 1
 	}
+	// Stop channels of running fuzzing instances and indexes of instances used for reproduction.
+	running := make(map[int]chan bool)
+	reproducingOn := make(map[int]bool)
 	runDone := make(chan *RunResult, 1)
 	pendingRepro := make(map[*Crash]bool)
 	reproducing := make(map[string]bool)
 	var reproQueue []*Crash
 	reproDone := make(chan *ReproResult, 1)
+	// Instances that failed to boot and wait before the next boot.
+	backingOff := make(map[int]bool)
+	backoffDone := make(chan int)
 	stopPending := false
+	fuzzing := fuzzingRunning
 	shutdown := vm.Shutdown
+	for _, crash := range mgr.loadReproJobs() {
+		pendingRepro[crash] = true
+		mgr.mu.Lock()
+		mgr.stats["repro resumed"]++
+		mgr.mu.Unlock()
+	}
 	for {
 		for crash := range pendingRepro {
 			if reproducing[crash.desc] {
@@ -256,70 +614,118 @@ func (mgr *Manager) vmLoop() {
 			Logf(1, "loop: add to repro queue '%v'", crash.desc)
 			reproducing[crash.desc] = true
 			reproQueue = append(reproQueue, crash)
+			mgr.saveReproJob(crash, crash.reproState)
 		}
 
-		Logf(1, "loop: shutdown=%v instances=%v/%v %+v repro: pending=%v reproducing=%v queued=%v",
-			shutdown == nil, len(instances), mgr.cfg.Count, instances,
+		Logf(1, "loop: shutdown=%v instances=%v/%v %+v running=%v repro: pending=%v reproducing=%v queued=%v",
+			shutdown == nil, len(instances), target, instances, len(running),
 			len(pendingRepro), len(reproducing), len(reproQueue))
 		if shutdown == nil {
-			if len(instances) == mgr.cfg.Count {
+			if len(running) == 0 && reproRunning == 0 {
+				if mgr.snapshots != nil {
+					mgr.snapshots.dropAll()
+				}
 				return
 			}
 		} else {
-			for len(reproQueue) != 0 && len(instances) >= reproInstances {
+			for fuzzing == fuzzingRunning && len(reproQueue) != 0 && len(instances) >= reproInstances &&
+				reproRunning+reproInstances <= reproVMs {
 				last := len(reproQueue) - 1
 				crash := reproQueue[last]
 				reproQueue[last] = nil
 				reproQueue = reproQueue[:last]
 				vmIndexes := append([]int{}, instances[len(instances)-reproInstances:]...)
 				instances = instances[:len(instances)-reproInstances]
+				reproRunning += reproInstances
+				for _, idx := range vmIndexes {
+					reproducingOn[idx] = true
+					if mgr.snapshots != nil {
+						mgr.snapshots.drop(idx)
+					}
+				}
 				Logf(1, "loop: starting repro of '%v' on instances %+v", crash.desc, vmIndexes)
 				go func() {
-					res, err := repro.Run(crash.output, mgr.cfg, vmIndexes)
+					// All VMs of the repro boot the kernel the crash happened on.
+					res, err := repro.Resume(crash.output, mgr.kernelConfig(crash), vmIndexes, crash.reproState,
+						func(state *repro.State) { mgr.saveReproJob(crash, state) })
 					reproDone <- &ReproResult{vmIndexes, crash, res, err}
 				}()
 			}
-			for len(reproQueue) == 0 && len(instances) != 0 {
+			// Crashes are not reproduced while fuzzing is paused, so the queue does not hold back instances.
+			for (len(reproQueue) == 0 || fuzzing != fuzzingRunning) && fuzzing != fuzzingStopped && len(instances) != 0 {
 				last := len(instances) - 1
 				idx := instances[last]
 				instances = instances[:last]
-				Logf(1, "loop: starting instance %v", idx)
+				// Buffered, so that the stop is not lost if the instance is still booting.
+				stop := make(chan bool, 1)
+				running[idx] = stop
+				delay := mgr.boot.delay()
+				Logf(1, "loop: starting instance %v in %v", idx, delay)
 				go func() {
-					vmCfg, err := config.CreateVMConfig(mgr.cfg, idx)
-					if err != nil {
-						Fatalf("failed to create VM config: %v", err)
+					if !waitBoot(delay, stop) {
+						runDone <- &RunResult{idx, nil, nil}
+						return
 					}
-					crash, err := mgr.runInstance(vmCfg, idx == 0)
+					crash, err := mgr.runInstance(idx, idx == 0, stop)
 					runDone <- &RunResult{idx, crash, err}
 				}()
 			}
-		}
-
-		var stopRequest chan bool
-		if len(reproQueue) != 0 && !stopPending {
-			stopRequest = mgr.vmStop
+			if fuzzing == fuzzingRunning && len(reproQueue) != 0 && !stopPending && reproRunning+reproInstances <= reproVMs {
+				// Free an instance for reproduction.
+				for idx, stop := range running {
+					if idx < target {
+						Logf(1, "loop: issued stop request to instance %v", idx)
+						stopInstance(stop)
+						stopPending = true
+						break
+					}
+				}
+			}
 		}
 
 		select {
-		case stopRequest <- true:
-			Logf(1, "loop: issued stop request")
-			stopPending = true
 		case res := <-runDone:
 			Logf(1, "loop: instance %v finished, crash=%v", res.idx, res.crash != nil)
 			if res.err != nil && shutdown != nil {
 				Logf(0, "%v", res.err)
 			}
 			stopPending = false
-			instances = append(instances, res.idx)
+			var backoff time.Duration
+			if shutdown != nil {
+				backoff = mgr.bootResult(res.idx, res.err, mgr.healthError(res.crash))
+			}
+			if backoff != 0 {
+				backingOff[res.idx] = true
+				idx := res.idx
+				time.AfterFunc(backoff, func() { backoffDone <- idx })
+			} else if res.idx < target {
+				instances = append(instances, res.idx)
+			} else if mgr.snapshots != nil {
+				mgr.snapshots.drop(res.idx)
+			}
+			delete(running, res.idx)
 			// On shutdown qemu crashes with "qemu: terminating on signal 2",
 			// which we detect as "lost connection". Don't save that as crash.
-			if shutdown != nil && res.crash != nil && !mgr.isSuppressed(res.crash) {
-				mgr.saveCrash(res.crash)
-				if mgr.needRepro(res.crash.desc) {
+			if shutdown != nil && res.crash != nil && !mgr.isInternal(res.crash) {
+				// Suppressed crashes are known bugs, they are saved but not reproduced.
+				suppressed := mgr.isSuppressed(res.crash)
+				preferred := mgr.saveCrash(res.crash, suppressed)
+				if res.crash.area != nil {
+					mgr.mu.Lock()
+					res.crash.area.crashes++
+					mgr.mu.Unlock()
+				}
+				if !suppressed && preferred && res.crash.kernelBug() && mgr.needRepro(res.crash.desc) {
 					Logf(1, "loop: add pending repro for '%v'", res.crash.desc)
 					pendingRepro[res.crash] = true
 				}
 			}
+		case idx := <-backoffDone:
+			delete(backingOff, idx)
+			if shutdown != nil && idx < target && running[idx] == nil && !reproducingOn[idx] {
+				Logf(1, "loop: instance %v is back from backoff", idx)
+				instances = append(instances, idx)
+			}
 		case res := <-reproDone:
 			crepro := false
 			if res.res != nil {
@@ -331,8 +737,61 @@ func (mgr *Manager) vmLoop() {
 				Logf(0, "repro failed: %v", res.err)
 			}
 			delete(reproducing, res.crash.desc)
-			instances = append(instances, res.instances...)
+			for _, idx := range res.instances {
+				delete(reproducingOn, idx)
+				if idx < target {
+					instances = append(instances, idx)
+				}
+			}
+			reproRunning -= len(res.instances)
+			if shutdown == nil && res.res == nil {
+				// The repro was most likely interrupted by the shutdown,
+				// its job is kept to be resumed on the next start.
+				break
+			}
 			mgr.saveRepro(res.crash, res.res)
+			mgr.removeReproJob(res.crash.desc)
+		case count := <-mgr.vmScale:
+			Logf(0, "changing number of VMs from %v to %v", target, count)
+			if count > target {
+				mgr.mu.Lock()
+				if count > mgr.cfg.Count {
+					// cfg.Count is the max number of VM indexes used so far,
+					// it is used to validate indexes when VMs are created.
+					mgr.cfg.Count = count
+				}
+				mgr.mu.Unlock()
+				for idx := target; idx < count; idx++ {
+					// Instances that are still draining after a previous decrease
+					// are returned to the pool when they finish.
+					if running[idx] == nil && !reproducingOn[idx] && !backingOff[idx] {
+						instances = append(instances, idx)
+					}
+				}
+			} else {
+				var remain []int
+				for _, idx := range instances {
+					if idx < count {
+						remain = append(remain, idx)
+					} else if mgr.snapshots != nil {
+						mgr.snapshots.drop(idx)
+					}
+				}
+				instances = remain
+				// Running fuzzing instances are stopped, reproduction is allowed to finish.
+				for idx, stop := range running {
+					if idx >= count {
+						stopInstance(stop)
+					}
+				}
+			}
+			target = count
+			reproVMs, reproInstances = mgr.reproVMs(target)
+			mgr.mu.Lock()
+			mgr.vmCount = target
+			mgr.mu.Unlock()
+		case fuzzing = <-mgr.fuzzingCtl:
+			mgr.setFuzzing(fuzzing)
 		case <-shutdown:
 			Logf(1, "loop: shutting down...")
 			shutdown = nil
@@ -340,28 +799,117 @@ func (mgr *Manager) vmLoop() {
 	}
 }
 
-func (mgr *Manager) runInstance(vmCfg *vm.Config, first bool) (*Crash, error) {
-	inst, err := vm.Create(mgr.cfg.Type, vmCfg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create instance: %v", err)
+// reproVMs returns max number of VMs used for reproduction
+// and number of VMs used for a single reproduction.
+func (mgr *Manager) reproVMs(count int) (int, int) {
+	reproVMs := count * mgr.cfg.Repro_Percent / 100
+	if reproVMs == 0 && mgr.cfg.Repro_Percent != 0 && count != 0 {
+		reproVMs = 1
 	}
-	defer inst.Close()
+	reproInstances := 4
+	if reproInstances > reproVMs {
+		reproInstances = reproVMs
+	}
+	return reproVMs, reproInstances
+}
 
-	fwdAddr, err := inst.Forward(mgr.port)
-	if err != nil {
-		return nil, fmt.Errorf("failed to setup port forwarding: %v", err)
+// bootResult records the outcome of an instance run and returns how long
+// the instance must wait before it is booted again.
+func (mgr *Manager) bootResult(index int, bootErr, healthErr error) time.Duration {
+	err := bootErr
+	if err == nil {
+		err = healthErr
 	}
-	fuzzerBin, err := inst.Copy(filepath.Join(mgr.cfg.Syzkaller, "bin", "syz-fuzzer"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to copy binary: %v", err)
+	backoff, quarantined := mgr.boot.result(index, err)
+	if err == nil {
+		return 0
+	}
+	mgr.mu.Lock()
+	if bootErr != nil {
+		mgr.stats["vm boot failures"]++
+	}
+	if quarantined {
+		mgr.stats["vm quarantines"]++
+	}
+	mgr.mu.Unlock()
+	if quarantined {
+		Logf(0, "instance %v repeatedly fails to boot or run (%v), quarantined for %v", index, err, backoff)
+	}
+	return backoff
+}
+
+// healthError returns an error if the crash suggests a problem with the machine rather
+// than a kernel bug: machines that repeatedly lose connection or reboot without
+// a crash report are quarantined as the ones that fail to boot.
+func (mgr *Manager) healthError(crash *Crash) error {
+	if crash == nil {
+		return nil
 	}
-	executorBin, err := inst.Copy(filepath.Join(mgr.cfg.Syzkaller, "bin", "syz-executor"))
+	stat := ""
+	switch vm.Classify(crash.desc) {
+	case vm.LostConnection:
+		stat = "vm lost connections"
+	case vm.Reboot:
+		stat = "vm reboots"
+	default:
+		return nil
+	}
+	mgr.mu.Lock()
+	mgr.stats[stat]++
+	mgr.mu.Unlock()
+	return errors.New(crash.desc)
+}
+
+func stopInstance(stop chan bool) {
+	select {
+	case stop <- true:
+	default:
+	}
+}
+
+func (mgr *Manager) runInstance(index int, first bool, stop chan bool) (*Crash, error) {
+	pvm, err := mgr.prepareInstance(index)
 	if err != nil {
-		return nil, fmt.Errorf("failed to copy binary: %v", err)
+		return nil, err
+	}
+	keep := false
+	defer func() {
+		if keep {
+			mgr.snapshots.put(index, pvm)
+		} else {
+			pvm.inst.Close()
+		}
+	}()
+	inst, vmCfg := pvm.inst, pvm.cfg
+	// The watchdog stops the fuzzer if the VM exceeds host resource limits.
+	watch := mgr.watchdog.Watch(inst, vmCfg, stop)
+	defer watch.Stop()
+	fwdAddr, fuzzerBin, executorBin := pvm.fwdAddr, pvm.fuzzerBin, pvm.executorBin
+	// Optional fuzzer flags that are passed only when set.
+	var extraArgs []string
+	if pvm.certFile != "" {
+		extraArgs = append(extraArgs, "-tls_cert="+pvm.certFile)
+	}
+	if pvm.tokenFile != "" {
+		extraArgs = append(extraArgs, "-token_file="+pvm.tokenFile)
+	}
+	if len(pvm.postprocs) != 0 {
+		extraArgs = append(extraArgs, "-postproc="+strings.Join(pvm.postprocs, ","))
+	}
+	// Per-component verbosity (e.g. of exec) is passed to the fuzzer as is.
+	if vmodule := flag.Lookup("vmodule").Value.String(); vmodule != "" {
+		extraArgs = append(extraArgs, "-vmodule="+vmodule)
 	}
 
+	// Don't request features that are known to not work on the machine.
+	mgr.mu.Lock()
+	check := mgr.checkResult
+	mgr.mu.Unlock()
 	// Leak detection significantly slows down fuzzing, so detect leaks only on the first instance.
-	leak := first && mgr.cfg.Leak
+	leak := first && mgr.cfg.Leak && (check == nil || check.Leak)
+	faultCorpus := mgr.cfg.Fault_Corpus && (check == nil || check.Fault)
+	// Stability of programs is measured by coverage.
+	recheckCorpus := mgr.cfg.Recheck_Corpus && mgr.cfg.Cover
 	fuzzerV := 0
 	procs := mgr.cfg.Procs
 	if *flagDebug {
@@ -371,14 +919,31 @@ func (mgr *Manager) runInstance(vmCfg *vm.Config, first bool) (*Crash, error) {
 
 	// Run the fuzzer binary.
 	start := time.Now()
-	cmd := fmt.Sprintf("%v -executor=%v -name=%v -manager=%v -output=%v -procs=%v -leak=%v -cover=%v -sandbox=%v -debug=%v -v=%d",
-		fuzzerBin, executorBin, vmCfg.Name, fwdAddr, mgr.cfg.Output, procs, leak, mgr.cfg.Cover, mgr.cfg.Sandbox, *flagDebug, fuzzerV)
-	outc, errc, err := inst.Run(time.Hour, mgr.vmStop, cmd)
+	cmd := fmt.Sprintf("%v -executor=%v -name=%v -manager=%v -output=%v -procs=%v -leak=%v -leak_period=%vs -fault_corpus=%v -recheck_corpus=%v -provenance=%v -rotate=%vs -signal=%v -dedup_window=%v -cover=%v -sandbox=%v -seccomp=%v -debug=%v -trace=%v -pin_cpus=%v -low_priority=%v -rpc_compression=%v -rpc_batch=%v -v=%d",
+		fuzzerBin, executorBin, vmCfg.Name, fwdAddr, mgr.cfg.Output, procs, leak, mgr.cfg.Leak_Period, faultCorpus, recheckCorpus, mgr.cfg.Provenance, mgr.cfg.Rotate_Period, mgr.cfg.Signal, mgr.cfg.Dedup_Window, mgr.cfg.Cover, mgr.cfg.Sandbox, mgr.cfg.Seccomp, *flagDebug, mgr.cfg.Trace, mgr.cfg.Pin_Cpus, mgr.cfg.Low_Priority, mgr.cfg.Rpc_Compression, mgr.cfg.Rpc_Batch, fuzzerV)
+	if len(extraArgs) != 0 {
+		cmd += " " + strings.Join(extraArgs, " ")
+	}
+	outc, errc, err := inst.Run(time.Hour, stop, cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run fuzzer: %v", err)
 	}
+	var console *consoleLog
+	if mgr.console != nil {
+		if console, err = mgr.console.open(vmCfg.Index); err != nil {
+			Logf(0, "%v: %v", vmCfg.Name, err)
+		} else {
+			done := make(chan bool)
+			defer close(done)
+			outc = console.tee(outc, done)
+		}
+	}
 
-	desc, text, output, crashed, timedout := vm.MonitorExecution(outc, errc, mgr.cfg.Type == "local", true, mgr.cfg.ParsedIgnores)
+	desc, text, output, crashed, timedout := vm.MonitorExecution(inst, outc, errc, mgr.cfg.Type == "local", true, mgr.cfg.ParsedIgnores)
+	area := mgr.releaseFocusArea(vmCfg.Name)
+	// Whatever happened to the VM, the snapshot brings it back to the state right after boot,
+	// but VMs that exceeded host resource limits are recreated.
+	keep = pvm.snapshot && watch.Exceeded() == ""
 	if timedout {
 		// This is the only "OK" outcome.
 		Logf(0, "%v: running for %v, restarting (%v)", vmCfg.Name, time.Since(start), desc)
@@ -386,14 +951,55 @@ func (mgr *Manager) runInstance(vmCfg *vm.Config, first bool) (*Crash, error) {
 	}
 	if !crashed {
 		// syz-fuzzer exited, but it should not.
-		desc = "lost connection to test machine"
+		desc = vm.LostConnectionTitle
 	}
-	return &Crash{vmCfg.Name, desc, text, output}, nil
+	// The output may contain several reports, the primary one is the first one
+	// that is not suppressed and does not look corrupted.
+	var rep *report.Report
+	if text != nil {
+		if rep = report.ParseReport(output, mgr.cfg.ParsedIgnores); rep != nil {
+			if primary := rep.Select(mgr.cfg.ParsedSuppressions); primary != nil {
+				rep = primary
+			}
+			desc, text = rep.Title, rep.Report
+		}
+	}
+	// Crashes are grouped by normalized description,
+	// otherwise every pid and address produces a separate crash type.
+	if norm := report.NormalizeTitle(desc); norm != desc {
+		Logf(1, "%v: normalized crash '%v' to '%v'", vmCfg.Name, desc, norm)
+		desc = norm
+	}
+	crash := &Crash{
+		vmName: vmCfg.Name,
+		desc:   desc,
+		text:   text,
+		output: output,
+		area:   area,
+		kernel: config.ComparedKernel(mgr.cfg, vmCfg.Index),
+	}
+	if console != nil {
+		crash.console = console.ref()
+	}
+	if rep != nil {
+		crash.corrupted = rep.CorruptedReason
+		crash.others = rep.Others
+	}
+	if mgr.cfg.Crash_State && crash.kernelBug() {
+		crash.state = captureCrashState(inst, output, mgr.cfg.Target_Os, stop)
+	}
+	return crash, nil
 }
 
+// isSuppressed returns true if the crash report (or the output if there is no report)
+// matches a suppression. Other reports in the output don't suppress the crash.
 func (mgr *Manager) isSuppressed(crash *Crash) bool {
+	text := crash.text
+	if len(text) == 0 {
+		text = crash.output
+	}
 	for _, re := range mgr.cfg.ParsedSuppressions {
-		if !re.Match(crash.output) {
+		if !re.Match(text) {
 			continue
 		}
 		Logf(1, "%v: suppressing '%v' with '%v'", crash.vmName, crash.desc, re.String())
@@ -405,19 +1011,70 @@ func (mgr *Manager) isSuppressed(crash *Crash) bool {
 	return false
 }
 
-func (mgr *Manager) saveCrash(crash *Crash) {
-	Logf(0, "%v: crash: %v", crash.vmName, crash.desc)
+// isInternal returns true if the crash is a failure of syzkaller itself, such crashes are not saved.
+func (mgr *Manager) isInternal(crash *Crash) bool {
+	for _, re := range mgr.cfg.ParsedInternalSuppressions {
+		if !re.Match(crash.output) {
+			continue
+		}
+		Logf(1, "%v: dropping '%v' matching '%v'", crash.vmName, crash.desc, re.String())
+		mgr.mu.Lock()
+		mgr.stats["internal crashes"]++
+		mgr.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+// Crashes with corrupted reports are reported and reproduced only if
+// they did not produce a clean report in this many occurrences.
+const corruptedCrashThreshold = 3
+
+// saveCrash saves the crash and reports it. It returns false if the crash report
+// looks corrupted and a clean report of the same crash is preferred for reproduction.
+func (mgr *Manager) saveCrash(crash *Crash, suppressed bool) bool {
+	if crash.corrupted != "" {
+		Logf(0, "%v: crash: %v (corrupted report: %v)", crash.vmName, crash.desc, crash.corrupted)
+	} else {
+		Logf(0, "%v: crash: %v", crash.vmName, crash.desc)
+	}
 	mgr.mu.Lock()
-	mgr.stats["crashes"]++
+	if vm.Classify(crash.desc) == vm.FuzzerCrash {
+		mgr.stats["fuzzer crashes"]++
+	} else {
+		mgr.stats["crashes"]++
+	}
 	mgr.mu.Unlock()
+	reportable := !suppressed && crash.kernelBug()
 
 	sig := hash.Hash([]byte(crash.desc))
 	id := sig.String()
 	dir := filepath.Join(mgr.crashdir, id)
 	os.MkdirAll(dir, 0700)
-	if err := ioutil.WriteFile(filepath.Join(dir, "description"), []byte(crash.desc+"\n"), 0660); err != nil {
+	if err := fileutil.WriteFileAtomicNoSync(filepath.Join(dir, "description"), []byte(crash.desc+"\n"), 0660); err != nil {
 		Logf(0, "failed to write crash: %v", err)
 	}
+	stats := readCrashStats(dir)
+	now := time.Now()
+	if stats.First.IsZero() {
+		stats.First = now
+	}
+	stats.Last = now
+	stats.Count++
+	if crash.kernel == 1 {
+		stats.Compared++
+	}
+	if crash.corrupted != "" {
+		stats.Corrupted++
+	}
+	// A clean report is reported when it is the first clean one, a corrupted one only
+	// when the crash failed to produce a clean report for a while.
+	clean := stats.Count - stats.Corrupted
+	preferred := crash.corrupted == "" || clean == 0 && stats.Count >= corruptedCrashThreshold
+	notify := crash.corrupted == "" && clean == 1 || crash.corrupted != "" && clean == 0 && stats.Count == corruptedCrashThreshold
+	if err := writeCrashStats(dir, stats); err != nil {
+		Logf(0, "failed to write crash stats: %v", err)
+	}
 	// Save up to 100 reports. If we already have 100, overwrite the oldest one.
 	// Newer reports are generally more useful. Overwriting is also needed
 	// to be able to understand if a particular bug still happens or already fixed.
@@ -434,24 +1091,183 @@ func (mgr *Manager) saveCrash(crash *Crash) {
 			oldestTime = info.ModTime()
 		}
 	}
-	ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("log%v", oldestI)), crash.output, 0660)
-	if len(mgr.cfg.Tag) > 0 {
-		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("tag%v", oldestI)), []byte(mgr.cfg.Tag), 0660)
+	kcfg := mgr.kernelConfig(crash)
+	fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("log%v", oldestI)), crash.output, 0660)
+	if len(kcfg.Tag) > 0 {
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("tag%v", oldestI)), []byte(kcfg.Tag), 0660)
+	} else {
+		os.Remove(filepath.Join(dir, fmt.Sprintf("tag%v", oldestI)))
+	}
+	if crash.corrupted != "" {
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("corrupted%v", oldestI)), []byte(crash.corrupted), 0660)
+	} else {
+		os.Remove(filepath.Join(dir, fmt.Sprintf("corrupted%v", oldestI)))
+	}
+	if len(crash.others) != 0 {
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("others%v", oldestI)), formatOtherReports(crash.others), 0660)
+	} else {
+		os.Remove(filepath.Join(dir, fmt.Sprintf("others%v", oldestI)))
+	}
+	if len(crash.state) != 0 {
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("state%v", oldestI)), crash.state, 0660)
+	} else {
+		os.Remove(filepath.Join(dir, fmt.Sprintf("state%v", oldestI)))
+	}
+	if provenance := crashProvenance(crash.output); len(provenance) != 0 {
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("provenance%v", oldestI)), provenance, 0660)
+	} else {
+		os.Remove(filepath.Join(dir, fmt.Sprintf("provenance%v", oldestI)))
+	}
+	os.Remove(filepath.Join(dir, fmt.Sprintf("console%v", oldestI)))
+	if crash.console != nil {
+		if err := saveConsoleRef(filepath.Join(dir, fmt.Sprintf("console%v", oldestI)), crash.console); err != nil {
+			Logf(0, "failed to save console log reference: %v", err)
+		}
+	}
+	// Archived artifacts are the ones of the main kernel.
+	if len(mgr.assets) != 0 && crash.kernel == 0 {
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("assets%v", oldestI)), formatAssets(mgr.assets), 0660)
 	}
+	var rawReport []byte
+	os.Remove(filepath.Join(dir, fmt.Sprintf("rawreport%v", oldestI)))
 	if len(crash.text) > 0 {
-		symbolized, err := report.Symbolize(mgr.cfg.Vmlinux, crash.text)
+		symbolized, err := report.SymbolizeCached(kcfg.Vmlinux, crash.text, mgr.symbCache)
 		if err != nil {
 			Logf(0, "failed to symbolize crash: %v", err)
 		} else {
+			rawReport = crash.text
 			crash.text = symbolized
+			fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("rawreport%v", oldestI)), rawReport, 0660)
+		}
+		if mgr.symbCache != nil {
+			if err := mgr.symbCache.Flush(); err != nil {
+				Logf(0, "%v", err)
+			}
+		}
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, fmt.Sprintf("report%v", oldestI)), []byte(crash.text), 0660)
+	}
+	guilty, maintainers := mgr.saveGuiltyFile(dir, crash.text)
+	if suppressed {
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, "suppressed"), nil, 0660)
+	} else {
+		os.Remove(filepath.Join(dir, "suppressed"))
+	}
+	if notify && reportable && mgr.notifier != nil {
+		mgr.notifier.Crash(crash.desc, string(crash.text), crashClass(crash.desc), guilty, maintainers)
+	}
+	if mgr.dash != nil && reportable {
+		dc := &dashapi.Crash{
+			Manager:     mgr.cfg.Name,
+			Title:       crash.desc,
+			Tag:         kcfg.Tag,
+			Log:         crash.output,
+			Report:      crash.text,
+			RawReport:   rawReport,
+			GuiltyFile:  guilty,
+			Maintainers: maintainers,
+			Corrupted:   crash.corrupted != "",
+			State:       crash.state,
+		}
+		if len(mgr.assets) != 0 && crash.kernel == 0 {
+			dc.Assets = formatAssets(mgr.assets)
+		}
+		if err := mgr.dash.ReportCrash(dc); err != nil {
+			Logf(0, "failed to report crash to dashboard: %v", err)
+		}
+	}
+	if mgr.patch != nil {
+		mgr.patch.crashed(crash.desc)
+	}
+	return preferred
+}
+
+// formatOtherReports formats reports that accompany the primary crash report.
+func formatOtherReports(others []*report.Report) []byte {
+	buf := new(bytes.Buffer)
+	for _, rep := range others {
+		fmt.Fprintf(buf, "%v", rep.Title)
+		if rep.Corrupted {
+			fmt.Fprintf(buf, " (corrupted: %v)", rep.CorruptedReason)
 		}
-		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("report%v", oldestI)), []byte(crash.text), 0660)
+		fmt.Fprintf(buf, "\n\n%s\n", rep.Report)
 	}
+	return buf.Bytes()
+}
+
+// saveGuiltyFile determines the guilty file of the crash report and its maintainers
+// (if get_maintainers is enabled) and saves them in the crash dir.
+// get_maintainer.pl runs only when the guilty file of the crash changes.
+func (mgr *Manager) saveGuiltyFile(dir string, text []byte) (string, []string) {
+	guilty := report.ExtractGuiltyFile(text)
+	if guilty == "" {
+		return "", nil
+	}
+	guiltyFile := filepath.Join(dir, "guilty")
+	maintainersFile := filepath.Join(dir, "maintainers")
+	if old, _ := ioutil.ReadFile(guiltyFile); string(old) == guilty {
+		if data, err := ioutil.ReadFile(maintainersFile); err == nil || !mgr.cfg.Get_Maintainers {
+			return guilty, strings.Fields(string(data))
+		}
+	}
+	fileutil.WriteFileAtomicNoSync(guiltyFile, []byte(guilty), 0660)
+	os.Remove(maintainersFile)
+	if !mgr.cfg.Get_Maintainers {
+		return guilty, nil
+	}
+	maintainers, err := report.GetMaintainers(mgr.cfg.Kernel_Src, guilty)
+	if err != nil {
+		Logf(0, "failed to get maintainers of %v: %v", guilty, err)
+		return guilty, nil
+	}
+	fileutil.WriteFileAtomicNoSync(maintainersFile, []byte(strings.Join(maintainers, "\n")), 0660)
+	return guilty, maintainers
+}
+
+// kernelConfig returns config with kernel params of the kernel the crash happened on.
+func (mgr *Manager) kernelConfig(crash *Crash) *config.Config {
+	if crash.kernel == 1 {
+		return config.CompareConfig(mgr.cfg)
+	}
+	return mgr.cfg
+}
+
+// CrashStats is persisted in "stats" file in crash dir.
+// Unlike the saved logs, which are capped, it accounts for all occurrences of the crash.
+type CrashStats struct {
+	First time.Time
+	Last  time.Time
+	Count int
+
+	Compared  int `json:",omitempty"` // occurrences on the compared kernel in A/B mode
+	Corrupted int `json:",omitempty"` // occurrences with corrupted reports
+}
+
+func readCrashStats(dir string) CrashStats {
+	var stats CrashStats
+	data, err := ioutil.ReadFile(filepath.Join(dir, "stats"))
+	if err != nil {
+		return stats
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		Logf(0, "failed to parse crash stats in %v: %v", dir, err)
+	}
+	return stats
+}
+
+func writeCrashStats(dir string, stats CrashStats) error {
+	data, err := json.MarshalIndent(stats, "", "\t")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomicNoSync(filepath.Join(dir, "stats"), data, 0660)
 }
 
 const maxReproAttempts = 3
 
 func (mgr *Manager) needRepro(desc string) bool {
+	if mgr.cfg.Repro_Percent == 0 {
+		return false
+	}
 	sig := hash.Hash([]byte(desc))
 	dir := filepath.Join(mgr.crashdir, sig.String())
 	if _, err := os.Stat(filepath.Join(dir, "repro.prog")); err == nil {
@@ -472,48 +1288,72 @@ func (mgr *Manager) saveRepro(crash *Crash, res *repro.Result) {
 		for i := 0; i < maxReproAttempts; i++ {
 			name := filepath.Join(dir, fmt.Sprintf("repro%v", i))
 			if _, err := os.Stat(name); err != nil {
-				ioutil.WriteFile(name, nil, 0660)
+				fileutil.WriteFileAtomicNoSync(name, nil, 0660)
 				break
 			}
 		}
 		return
 	}
-	opts := fmt.Sprintf("# %+v\n", res.Opts)
+	// The options header is parsed by replay tools (syz-execprog, syz-prog2c, syz-crush, syz-bisect).
+	reproProg := csource.SerializeRepro(res.Prog, res.Opts)
 	prog := res.Prog.Serialize()
-	ioutil.WriteFile(filepath.Join(dir, "repro.prog"), append([]byte(opts), prog...), 0660)
-	if len(mgr.cfg.Tag) > 0 {
-		ioutil.WriteFile(filepath.Join(dir, "repro.tag"), []byte(mgr.cfg.Tag), 0660)
+	fileutil.WriteFileAtomicNoSync(filepath.Join(dir, "repro.prog"), reproProg, 0660)
+	kcfg := mgr.kernelConfig(crash)
+	if len(kcfg.Tag) > 0 {
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, "repro.tag"), []byte(kcfg.Tag), 0660)
 	}
 	if len(crash.text) > 0 {
-		ioutil.WriteFile(filepath.Join(dir, "repro.report"), []byte(crash.text), 0660)
+		fileutil.WriteFileAtomicNoSync(filepath.Join(dir, "repro.report"), []byte(crash.text), 0660)
 	}
+	var cprog []byte
 	if res.CRepro {
-		cprog, err := csource.Write(res.Prog, res.Opts)
+		var err error
+		cprog, err = csource.Write(res.Prog, res.Opts)
 		if err == nil {
 			formatted, err := csource.Format(cprog)
 			if err == nil {
 				cprog = formatted
 			}
-			ioutil.WriteFile(filepath.Join(dir, "repro.cprog"), cprog, 0660)
+			fileutil.WriteFileAtomicNoSync(filepath.Join(dir, "repro.cprog"), cprog, 0660)
 		} else {
 			Logf(0, "failed to write C source: %v", err)
+			cprog = nil
+		}
+	}
+	if mgr.notifier != nil {
+		mgr.notifier.Repro(crash.desc, string(crash.text), string(reproProg), string(cprog))
+	}
+	if mgr.dash != nil {
+		dr := &dashapi.Repro{
+			Manager: mgr.cfg.Name,
+			Title:   crash.desc,
+			Tag:     kcfg.Tag,
+			Opts:    fmt.Sprintf("%+v", res.Opts),
+			Prog:    prog,
+			CProg:   cprog,
+			Report:  crash.text,
+		}
+		if err := mgr.dash.ReportRepro(dr); err != nil {
+			Logf(0, "failed to report repro to dashboard: %v", err)
 		}
 	}
 }
 
 func (mgr *Manager) minimizeCorpus() {
 	if mgr.cfg.Cover && len(mgr.corpus) != 0 {
-		// First, sort corpus per call.
+		// First, sort corpus per syscall.
 		type Call struct {
 			inputs []RpcInput
 			cov    []cover.Cover
 		}
+		// Variants of the same syscall are minimized together.
 		calls := make(map[string]Call)
 		for _, inp := range mgr.corpus {
-			c := calls[inp.Call]
+			family := callFamily(inp.Call)
+			c := calls[family]
 			c.inputs = append(c.inputs, inp)
 			c.cov = append(c.cov, inp.Cover)
-			calls[inp.Call] = c
+			calls[family] = c
 		}
 		// Now minimize and build new corpus.
 		var newCorpus []RpcInput
@@ -523,7 +1363,7 @@ func (mgr *Manager) minimizeCorpus() {
 			}
 		}
 		Logf(1, "minimized corpus: %v -> %v", len(mgr.corpus), len(newCorpus))
-		mgr.corpus = newCorpus
+		mgr.setCorpus(newCorpus)
 	}
 	var corpus []*prog.Prog
 	for _, inp := range mgr.corpus {
@@ -536,7 +1376,7 @@ func (mgr *Manager) minimizeCorpus() {
 	mgr.prios = prog.CalculatePriorities(corpus)
 
 	// Don't minimize persistent corpus until fuzzers have triaged all inputs from it.
-	if len(mgr.candidates) == 0 {
+	if mgr.candidatesTriaged() {
 		hashes := make(map[string]bool)
 		for _, inp := range mgr.corpus {
 			sig := hash.Hash(inp.Prog)
@@ -549,8 +1389,94 @@ func (mgr *Manager) minimizeCorpus() {
 	}
 }
 
+// corpusDistillPeriod is the period of corpus distillation (see distillCorpus).
+const corpusDistillPeriod = time.Hour
+
+// distillCorpus reduces corpus to a minimal subset of programs that preserves coverage
+// of every syscall (greedy set cover, see cover.MinimizeGreedy). Unlike minimizeCorpus
+// it is more thorough and pruned programs are moved to workdir/corpus.archive
+// instead of being deleted, so they can be used for e.g. seeding other instances.
+func (mgr *Manager) distillCorpus() {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	// Don't distill until fuzzers have triaged all inputs from persistent corpus,
+	// otherwise we would archive programs that are not yet in corpus.
+	if !mgr.cfg.Cover || !mgr.candidatesTriaged() || len(mgr.corpus) == 0 {
+		return
+	}
+	start := time.Now()
+	type Call struct {
+		inputs []RpcInput
+		cov    []cover.Cover
+	}
+	calls := make(map[string]Call)
+	for _, inp := range mgr.corpus {
+		family := callFamily(inp.Call)
+		c := calls[family]
+		c.inputs = append(c.inputs, inp)
+		c.cov = append(c.cov, inp.Cover)
+		calls[family] = c
+	}
+	var newCorpus []RpcInput
+	for _, c := range calls {
+		for _, idx := range cover.MinimizeGreedy(c.cov) {
+			newCorpus = append(newCorpus, c.inputs[idx])
+		}
+	}
+	hashes := make(map[string]bool)
+	for _, inp := range newCorpus {
+		sig := hash.Hash(inp.Prog)
+		hashes[sig.String()] = true
+	}
+	for _, h := range mgr.disabledHashes {
+		hashes[h] = true
+	}
+	archived := mgr.persistentCorpus.archive(hashes, filepath.Join(mgr.cfg.Workdir, "corpus.archive"))
+	pruned := len(mgr.corpus) - len(newCorpus)
+	Logf(0, "distilled corpus: %v -> %v programs (%v archived) in %v",
+		len(mgr.corpus), len(newCorpus), archived, time.Since(start))
+	mgr.setCorpus(newCorpus)
+	mgr.stats["manager distilled inputs"] += uint64(pruned)
+}
+
+// corpusTag identifies the kernel and syscall descriptions corpus programs are minimized with.
+// Coverage shifts across kernel builds and programs change meaning with descriptions,
+// so programs minimized with a different tag need to be minimized again.
+func corpusTag(cfg *config.Config) (string, error) {
+	files, err := filepath.Glob(filepath.Join(cfg.Syzkaller, "sys", "*.txt"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list descriptions: %v", err)
+	}
+	files = append(files, cfg.Vmlinux)
+	h := sha1.New()
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to calculate corpus tag: %v", err)
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to calculate corpus tag: %v", err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func readCorpusTag(workdir string) string {
+	data, _ := ioutil.ReadFile(filepath.Join(workdir, "corpus.tag"))
+	return string(bytes.TrimSpace(data))
+}
+
+func writeCorpusTag(workdir, tag string) error {
+	return fileutil.WriteFileAtomic(filepath.Join(workdir, "corpus.tag"), []byte(tag+"\n"), 0640)
+}
+
+// rpcLog logs RPCs of fuzzers and hub, its verbosity can be set with -vmodule=rpc=N.
+const rpcLog = Component("rpc")
+
 func (mgr *Manager) Connect(a *ConnectArgs, r *ConnectRes) error {
-	Logf(1, "fuzzer %v connected", a.Name)
+	rpcLog.Logf(1, "fuzzer %v connected", a.Name)
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
 
@@ -560,16 +1486,34 @@ func (mgr *Manager) Connect(a *ConnectArgs, r *ConnectRes) error {
 
 	mgr.stats["vm restarts"]++
 	f := &Fuzzer{
-		name: a.Name,
+		name:        a.Name,
+		newMaxCover: make([]cover.Cover, sys.CallCount),
+		kernel:      mgr.fuzzerKernel(a.Name),
 	}
 	mgr.fuzzers[a.Name] = f
+	r.EnabledCalls = mgr.enabledSyscalls
+	if len(mgr.areas) != 0 {
+		area := mgr.assignFocusArea(f)
+		r.EnabledCalls = area.enabledSyscalls
+	}
 	mgr.minimizeCorpus()
-	for _, inp := range mgr.corpus {
-		f.inputs = append(f.inputs, inp)
+	if f.area == nil {
+		f.inputs = append(f.inputs, mgr.corpus...)
+	} else {
+		for _, n := range mgr.corpusIdx.accepted(f.area.enabledCalls) {
+			f.inputs = append(f.inputs, mgr.corpus[n])
+		}
 	}
 	r.Prios = mgr.prios
-	r.EnabledCalls = mgr.enabledSyscalls
 	r.NeedCheck = !mgr.vmChecked
+	if f.area != nil && f.area.cfg.Cover_Filter != nil {
+		r.CoverFilter = f.area.coverFilter
+		r.CoverFilterWeight = f.area.cfg.Cover_Filter.Weight
+	} else if mgr.cfg.Cover_Filter != nil {
+		r.CoverFilter = mgr.coverFilter
+		r.CoverFilterWeight = mgr.cfg.Cover_Filter.Weight
+	}
+	r.MaxCover = serializeMaxCover(mgr.maxCover)
 
 	return nil
 }
@@ -581,49 +1525,116 @@ func (mgr *Manager) Check(a *CheckArgs, r *int) error {
 	if mgr.vmChecked {
 		return nil
 	}
-	Logf(1, "fuzzer %v vm check: %v calls enabled", a.Name, len(a.Calls))
+	Logf(0, "fuzzer %v vm check: %v calls enabled, %v disabled, debugfs=%v kcov=%v comps=%v remote_kcov=%v leak=%v fault=%v net_injection=%v wifi=%v cgroups=%v",
+		a.Name, len(a.Calls), len(a.DisabledCalls), a.Debugfs, a.Kcov, a.KcovComps, a.KcovRemote, a.Leak, a.Fault, a.NetInjection, a.Wifi, a.Cgroups)
+	for name, reason := range a.DisabledCalls {
+		rpcLog.Logf(1, "disabled syscall %v: %v", name, reason)
+	}
 	if len(a.Calls) == 0 {
 		Fatalf("no system calls enabled")
 	}
+	if a.SandboxError != "" {
+		Fatalf("sandbox %v does not work on the machine: %v", mgr.cfg.Sandbox, a.SandboxError)
+	}
+	if mgr.cfg.Cover && mgr.cfg.Target_Os == "linux" && !a.Debugfs {
+		Fatalf("debugfs is not mounted. Mount debugfs at /sys/kernel/debug")
+	}
 	if mgr.cfg.Cover && !a.Kcov {
+		switch mgr.cfg.Target_Os {
+		case "freebsd":
+			Fatalf("/dev/kcov is missing. Build the kernel with options COVERAGE and options KCOV")
+		case "netbsd":
+			Fatalf("/dev/kcov is missing. Build the kernel with options KCOV")
+		case "openbsd":
+			Fatalf("/dev/kcov is missing. Build the kernel with pseudo-device kcov")
+		case "gvisor":
+			Fatalf("/sys/kernel/debug/kcov is missing. Build runsc with coverage instrumentation (bazel build --collect_code_coverage)")
+		}
 		Fatalf("/sys/kernel/debug/kcov is missing. Enable CONFIG_KCOV and mount debugfs")
 	}
+	if mgr.cfg.Leak && !a.Leak {
+		Logf(0, "kmemleak is not supported (enable CONFIG_DEBUG_KMEMLEAK), leak checking is disabled")
+	}
+	if mgr.cfg.Fault_Corpus && !a.Fault {
+		Logf(0, "fault injection is not supported (enable CONFIG_FAULT_INJECTION and CONFIG_FAILSLAB), fault_corpus is disabled")
+	}
 	mgr.vmChecked = true
 	mgr.enabledCalls = a.Calls
+	mgr.checkResult = a
 	return nil
 }
 
-func (mgr *Manager) NewInput(a *NewInputArgs, r *int) error {
-	Logf(2, "new input from %v for syscall %v", a.Name, a.Call)
-	mgr.mu.Lock()
-	defer mgr.mu.Unlock()
-
-	f := mgr.fuzzers[a.Name]
-	if f == nil {
-		Fatalf("fuzzer %v is not connected", a.Name)
+// newInput adds a new corpus input from fuzzer f, mgr.mu must be held.
+func (mgr *Manager) newInput(f *Fuzzer, inp RpcInput) error {
+	rpcLog.Logf(2, "new input from %v for syscall %v", f.name, inp.Call)
+	call, ok := sys.CallID[inp.Call]
+	if !ok {
+		return fmt.Errorf("unknown call %v in new input", inp.Call)
 	}
-
-	call := sys.CallID[a.Call]
-	if len(cover.Difference(a.Cover, mgr.corpusCover[call])) == 0 {
+	if mgr.compare != nil {
+		if !mgr.compare.newInput(f.kernel, call, inp.Cover) {
+			return nil
+		}
+	} else if len(cover.Difference(inp.Cover, mgr.corpusCover[call])) == 0 {
 		return nil
 	}
-	mgr.corpusCover[call] = cover.Union(mgr.corpusCover[call], a.Cover)
-	mgr.corpus = append(mgr.corpus, a.RpcInput)
+	mgr.corpusCover[call] = cover.Union(mgr.corpusCover[call], inp.Cover)
+	if f.kernel == 0 {
+		mgr.attribution.add(call, inp.Cover)
+	}
+	mgr.addCorpusInput(inp)
 	mgr.stats["manager new inputs"]++
-	mgr.persistentCorpus.add(a.RpcInput.Prog)
+	mgr.persistentCorpus.add(inp.Prog)
+	if f.area != nil {
+		f.area.inputs++
+		f.area.cover = cover.Union(f.area.cover, inp.Cover)
+	}
+	if mgr.dash != nil {
+		mgr.dashCorpus = append(mgr.dashCorpus, inp.Prog)
+	}
+	calls := mgr.corpusIdx.calls[len(mgr.corpus)-1]
 	for _, f1 := range mgr.fuzzers {
-		if f1 == f {
+		if f1 == f || !f1.acceptsInput(calls) {
 			continue
 		}
-		f1.inputs = append(f1.inputs, a.RpcInput)
+		f1.inputs = append(f1.inputs, inp)
 	}
 	return nil
 }
 
+// addCorpusInput appends inp to corpus, mgr.mu must be held.
+func (mgr *Manager) addCorpusInput(inp RpcInput) {
+	mgr.corpus = append(mgr.corpus, inp)
+	mgr.corpusIdx.add(inp)
+}
+
+// setCorpus replaces corpus (e.g. with a minimized one), mgr.mu must be held.
+func (mgr *Manager) setCorpus(corpus []RpcInput) {
+	mgr.corpus = corpus
+	mgr.corpusIdx = newCorpusIndex(corpus)
+}
+
+const (
+	// If a poll waits for mgr.mu longer than this, the manager does not keep up with fuzzers
+	// and asks them to poll less often (backoff is proportional to the wait).
+	rpcOverloadWait  = 100 * time.Millisecond
+	rpcBackoffFactor = 10
+	rpcMaxBackoff    = time.Minute
+)
+
 func (mgr *Manager) Poll(a *PollArgs, r *PollRes) error {
-	Logf(2, "poll from %v", a.Name)
+	rpcLog.Logf(2, "poll from %v with %v new inputs", a.Name, len(a.NewInputs))
+	start := time.Now()
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
+	if wait := time.Since(start); wait > rpcOverloadWait {
+		r.Backoff = wait * rpcBackoffFactor
+		if r.Backoff > rpcMaxBackoff {
+			r.Backoff = rpcMaxBackoff
+		}
+		mgr.stats["manager rpc backoffs"]++
+		rpcLog.Logf(1, "poll from %v waited for %v, asking to back off for %v", a.Name, wait, r.Backoff)
+	}
 
 	for k, v := range a.Stats {
 		mgr.stats[k] += v
@@ -633,8 +1644,65 @@ func (mgr *Manager) Poll(a *PollArgs, r *PollRes) error {
 	if f == nil {
 		Fatalf("fuzzer %v is not connected", a.Name)
 	}
+	for _, inp := range a.NewInputs {
+		if err := mgr.newInput(f, inp); err != nil {
+			return err
+		}
+	}
+	f.triaged = a.Triaged
+	if f.area != nil {
+		f.area.execs += a.Stats["exec total"]
+	}
+	if mgr.compare != nil {
+		mgr.compare.execs[f.kernel] += a.Stats["exec total"]
+	}
+	if f.kernel == 0 {
+		// Results on the compared kernel would hide anomalies of the main one.
+		mgr.addErrnos(a.Errnos)
+	}
 
-	for i := 0; i < 100 && len(f.inputs) > 0; i++ {
+	if a.MaxCoverAck != f.maxCoverSeq {
+		// The last reply was lost, resend its max cover.
+		for call, cov := range f.sentMaxCover {
+			f.newMaxCover[call] = cover.Union(f.newMaxCover[call], cov)
+		}
+	}
+	f.sentMaxCover = nil
+	for name, data := range a.MaxCover {
+		call, ok := sys.CallID[name]
+		if !ok {
+			return fmt.Errorf("unknown call %v in max cover", name)
+		}
+		cov, err := cover.Deserialize(data)
+		if err != nil {
+			return fmt.Errorf("bad max cover for call %v: %v", name, err)
+		}
+		diff := cover.Difference(cov, mgr.maxCover[call])
+		if len(diff) == 0 {
+			continue
+		}
+		mgr.maxCover[call] = cover.Union(mgr.maxCover[call], diff)
+		for _, f1 := range mgr.fuzzers {
+			if f1 != f {
+				f1.newMaxCover[call] = cover.Union(f1.newMaxCover[call], diff)
+			}
+		}
+	}
+	if r.MaxCover = serializeMaxCover(f.newMaxCover); len(r.MaxCover) != 0 {
+		f.maxCoverSeq++
+		f.sentMaxCover = f.newMaxCover
+		f.newMaxCover = make([]cover.Cover, sys.CallCount)
+	}
+	r.MaxCoverSeq = f.maxCoverSeq
+
+	if mgr.fuzzing != fuzzingRunning {
+		// Inputs and candidates are handed out when fuzzing is resumed.
+		r.Paused = mgr.fuzzing == fuzzingPaused
+		r.Stop = mgr.fuzzing == fuzzingStopped
+		r.Pending = len(*mgr.fuzzerCandidates(f))
+		return nil
+	}
+	for i := 0; i < mgr.cfg.Rpc_Poll_Inputs && len(f.inputs) > 0; i++ {
 		last := len(f.inputs) - 1
 		r.NewInputs = append(r.NewInputs, f.inputs[last])
 		f.inputs = f.inputs[:last]
@@ -643,18 +1711,74 @@ func (mgr *Manager) Poll(a *PollArgs, r *PollRes) error {
 		f.inputs = nil
 	}
 
-	for i := 0; i < 10 && len(mgr.candidates) > 0; i++ {
-		last := len(mgr.candidates) - 1
-		r.Candidates = append(r.Candidates, mgr.candidates[last])
-		mgr.candidates = mgr.candidates[:last]
+	candidates := mgr.fuzzerCandidates(f)
+	n := mgr.cfg.Rpc_Poll_Candidates
+	if n > len(*candidates) {
+		n = len(*candidates)
+	}
+	if allowed := mgr.candidateLimiter.take(n, time.Now()); allowed < n {
+		mgr.stats["manager throttled candidates"]++
+		n = allowed
+	}
+	for i := 0; i < n; i++ {
+		last := len(*candidates) - 1
+		r.Candidates = append(r.Candidates, (*candidates)[last].RpcCandidate)
+		*candidates = (*candidates)[:last]
+	}
+	r.Pending = len(*candidates)
+	if len(r.Candidates) != 0 {
+		f.triaged = false
 	}
 	if len(mgr.candidates) == 0 {
 		mgr.candidates = nil
 	}
+	if !mgr.corpusTagSaved && mgr.candidatesTriaged() && mgr.fuzzersTriaged() {
+		// All persistent corpus programs are triaged by fuzzers and their inputs are saved,
+		// from now on the corpus contains only programs minimized with the current tag.
+		mgr.corpusTagSaved = true
+		if err := writeCorpusTag(mgr.cfg.Workdir, mgr.corpusTag); err != nil {
+			Logf(0, "failed to write corpus tag: %v", err)
+		}
+	}
 
 	return nil
 }
 
+// serializeMaxCover converts per-call max cover to the rpc form (see PollRes.MaxCover).
+func serializeMaxCover(maxCover []cover.Cover) map[string][]byte {
+	res := make(map[string][]byte)
+	for name, call := range sys.CallID {
+		if cov := maxCover[call]; len(cov) != 0 {
+			res[name] = cover.Serialize(cov)
+		}
+	}
+	return res
+}
+
+// dashSync resends queued dashboard requests and uploads new corpus programs and stats.
+func (mgr *Manager) dashSync() {
+	if err := mgr.dash.Flush(); err != nil {
+		Logf(0, "failed to send queued requests to dashboard: %v", err)
+	}
+	mgr.mu.Lock()
+	progs := mgr.dashCorpus
+	mgr.dashCorpus = nil
+	mgr.mu.Unlock()
+	if len(progs) != 0 {
+		if err := mgr.dash.UploadCorpus(&dashapi.Corpus{Manager: mgr.cfg.Name, Progs: progs}); err != nil {
+			Logf(0, "failed to upload corpus to dashboard: %v", err)
+		}
+	}
+	stats := &dashapi.Stats{
+		Manager: mgr.cfg.Name,
+		Time:    time.Now(),
+		Stats:   mgr.collectStats(),
+	}
+	if err := mgr.dash.UploadStats(stats); err != nil {
+		Logf(0, "failed to upload stats to dashboard: %v", err)
+	}
+}
+
 func (mgr *Manager) hubSync() {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
@@ -666,7 +1790,7 @@ func (mgr *Manager) hubSync() {
 	if mgr.hub == nil {
 		conn, err := rpc.Dial("tcp", mgr.cfg.Hub_Addr)
 		if err != nil {
-			Logf(0, "failed to connect to hub at %v: %v", mgr.cfg.Hub_Addr, err)
+			rpcLog.Errorf("failed to connect to hub at %v: %v", mgr.cfg.Hub_Addr, err)
 			return
 		}
 		mgr.hub = conn
@@ -682,13 +1806,13 @@ func (mgr *Manager) hubSync() {
 			a.Corpus = append(a.Corpus, inp.Prog)
 		}
 		if err := mgr.hub.Call("Hub.Connect", a, nil); err != nil {
-			Logf(0, "Hub.Connect rpc failed: %v", err)
+			rpcLog.Errorf("Hub.Connect rpc failed: %v", err)
 			mgr.hub.Close()
 			mgr.hub = nil
 			return
 		}
 		mgr.fresh = false
-		Logf(0, "connected to hub at %v, corpus %v", mgr.cfg.Hub_Addr, len(mgr.corpus))
+		rpcLog.Logf(0, "connected to hub at %v, corpus %v", mgr.cfg.Hub_Addr, len(mgr.corpus))
 	}
 
 	a := &HubSyncArgs{
@@ -714,23 +1838,43 @@ func (mgr *Manager) hubSync() {
 	}
 	r := new(HubSyncRes)
 	if err := mgr.hub.Call("Hub.Sync", a, r); err != nil {
-		Logf(0, "Hub.Sync rpc failed: %v", err)
+		rpcLog.Errorf("Hub.Sync rpc failed: %v", err)
 		mgr.hub.Close()
 		mgr.hub = nil
 		return
 	}
+	// Hub filters inputs by calls enabled in this manager, but it could have
+	// a stale list of calls, so double check. Inputs are not trusted in other
+	// respects either: they are triaged by fuzzers as candidates and are added
+	// to corpus only if they give new coverage on this kernel.
+	enabled := make(map[string]bool)
+	for _, c := range mgr.enabledCalls {
+		enabled[c] = true
+	}
 	dropped := 0
 	for _, inp := range r.Inputs {
-		_, err := prog.Deserialize(inp)
-		if err != nil {
+		p, err := prog.Deserialize(inp)
+		if err != nil || !callsEnabled(p, enabled) {
 			dropped++
 			continue
 		}
-		mgr.candidates = append(mgr.candidates, inp)
+		mgr.addCandidate(RpcCandidate{Prog: inp}, p)
+	}
+	if len(r.Inputs) != dropped {
+		mgr.prioritizeCandidates()
 	}
 	mgr.stats["hub add"] += uint64(len(a.Add))
 	mgr.stats["hub del"] += uint64(len(a.Del))
 	mgr.stats["hub drop"] += uint64(dropped)
 	mgr.stats["hub new"] += uint64(len(r.Inputs) - dropped)
-	Logf(0, "hub sync: add %v, del %v, drop %v, new %v", len(a.Add), len(a.Del), dropped, len(r.Inputs)-dropped)
+	rpcLog.Logf(0, "hub sync: add %v, del %v, drop %v, new %v", len(a.Add), len(a.Del), dropped, len(r.Inputs)-dropped)
+}
+
+func callsEnabled(p *prog.Prog, enabled map[string]bool) bool {
+	for _, c := range p.Calls {
+		if !enabled[c.Meta.Name] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,141 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/cover"
+	. "github.com/google/syzkaller/log"
+)
+
+// Stats that reflect current state rather than accumulate over time.
+var gaugeStats = map[string]bool{
+	"uptime":       true,
+	"fuzzing":      true,
+	"vms":          true,
+	"corpus":       true,
+	"cover":        true,
+	"max cover":    true,
+	"triage queue": true,
+	"exec per sec": true,
+	"crash types":  true,
+}
+
+// collectStats returns a snapshot of manager statistics.
+// Besides the fixed set of gauges it includes all counters reported by fuzzers
+// (e.g. "exec total") and collected by manager (e.g. "crashes", "vm restarts").
+// Only cheap copies are done under mgr.mu, the crash dir is scanned and coverage
+// is merged without the lock (cover slices are never modified in place).
+func (mgr *Manager) collectStats() map[string]uint64 {
+	crashes, crashesErr := mgr.collectCrashes()
+
+	mgr.mu.Lock()
+	stats := make(map[string]uint64)
+	for k, v := range mgr.stats {
+		stats[k] = v
+	}
+	stats["uptime"] = uint64(time.Since(mgr.startTime) / time.Second)
+	if !mgr.firstConnect.IsZero() {
+		stats["fuzzing"] = uint64(time.Since(mgr.firstConnect) / time.Second)
+	}
+	stats["vms"] = uint64(mgr.vmCount)
+	stats["vms quarantined"] = uint64(mgr.boot.quarantinedVMs())
+	stats["corpus"] = uint64(len(mgr.corpus))
+	stats["triage queue"] = uint64(len(mgr.candidates))
+	for _, area := range mgr.areas {
+		prefix := "area " + area.cfg.Name + " "
+		stats[prefix+"vms"] = uint64(area.vms)
+		stats[prefix+"inputs"] = uint64(area.inputs)
+		stats[prefix+"cover"] = uint64(len(area.cover))
+		stats[prefix+"exec total"] = area.execs
+		stats[prefix+"crashes"] = uint64(area.crashes)
+	}
+	corpusCover := append([]cover.Cover{}, mgr.corpusCover...)
+	maxCover := append([]cover.Cover{}, mgr.maxCover...)
+	mgr.mu.Unlock()
+
+	if secs := stats["fuzzing"]; secs != 0 {
+		stats["exec per sec"] = stats["exec total"] / secs
+	}
+	var cov, maxCov cover.Cover
+	for _, c := range corpusCover {
+		cov = cover.Union(cov, c)
+	}
+	for _, c := range maxCover {
+		maxCov = cover.Union(maxCov, c)
+	}
+	stats["cover"] = uint64(len(cov))
+	stats["max cover"] = uint64(len(maxCov))
+	if crashesErr == nil {
+		stats["crash types"] = uint64(len(crashes))
+	}
+	return stats
+}
+
+// httpMetrics serves stats in Prometheus text exposition format.
+func (mgr *Manager) httpMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := mgr.collectStats()
+	var names []string
+	for k := range stats {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	buf := new(bytes.Buffer)
+	for _, k := range names {
+		name := metricName(k)
+		typ := "counter"
+		isAreaGauge := strings.HasPrefix(k, "area ") &&
+			(strings.HasSuffix(k, " vms") || strings.HasSuffix(k, " cover"))
+		if gaugeStats[k] || isAreaGauge {
+			typ = "gauge"
+		}
+		fmt.Fprintf(buf, "# HELP %v %v\n", name, k)
+		fmt.Fprintf(buf, "# TYPE %v %v\n", name, typ)
+		fmt.Fprintf(buf, "%v{manager=%q} %v\n", name, mgr.cfg.Name, stats[k])
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// metricName converts stat name to a Prometheus metric name (e.g. "exec total" -> "syz_exec_total").
+func metricName(stat string) string {
+	name := []byte("syz_" + strings.ToLower(stat))
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+const benchPeriod = time.Minute
+
+// benchLoop periodically appends JSON snapshots of stats to file for offline analysis.
+func (mgr *Manager) benchLoop(file string) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		Fatalf("failed to open bench file: %v", err)
+	}
+	go func() {
+		defer f.Close()
+		for {
+			time.Sleep(benchPeriod)
+			data, err := json.MarshalIndent(mgr.collectStats(), "", "  ")
+			if err != nil {
+				Fatalf("failed to serialize bench data: %v", err)
+			}
+			if _, err := f.Write(append(data, '\n')); err != nil {
+				Fatalf("failed to write bench data: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/config"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/report"
+)
+
+// Notification is sent to webhook as JSON.
+type Notification struct {
+	Manager  string    `json:"manager"`
+	Tag      string    `json:"tag,omitempty"`
+	Kind     string    `json:"kind"` // "crash" or "repro"
+	Title    string    `json:"title"`
+	Type     string    `json:"type,omitempty"`     // bug type, e.g. "use-after-free"
+	Severity string    `json:"severity,omitempty"` // "low", "medium" or "high"
+	Report   string    `json:"report,omitempty"`
+	Guilty   string    `json:"guilty_file,omitempty"`
+	CC       []string  `json:"maintainers,omitempty"` // suggested CC list for the guilty file
+	Repro    string    `json:"repro,omitempty"`       // syzkaller program
+	CRepro   string    `json:"crepro,omitempty"`      // C program
+	Time     time.Time `json:"time"`
+}
+
+// Notifier sends notifications about new crashes and reproducers.
+// Notifications about the same crash are sent at most once per configured period.
+type Notifier struct {
+	cfg     *config.Notify
+	manager string
+	tag     string
+
+	mu   sync.Mutex
+	last map[string]time.Time // last notification time per kind and crash title
+}
+
+func newNotifier(cfg *config.Config) *Notifier {
+	return &Notifier{
+		cfg:     cfg.Notify,
+		manager: cfg.Name,
+		tag:     cfg.Tag,
+		last:    make(map[string]time.Time),
+	}
+}
+
+// Crash notifies about a new crash title.
+func (n *Notifier) Crash(title, text string, class report.Class, guilty string, maintainers []string) {
+	n.notify(&Notification{
+		Kind:     "crash",
+		Title:    title,
+		Type:     class.Type,
+		Severity: class.Severity.String(),
+		Report:   text,
+		Guilty:   guilty,
+		CC:       maintainers,
+	})
+}
+
+// Repro notifies about a reproducer found for the crash.
+func (n *Notifier) Repro(title, report, repro, crepro string) {
+	n.notify(&Notification{
+		Kind:   "repro",
+		Title:  title,
+		Report: report,
+		Repro:  repro,
+		CRepro: crepro,
+	})
+}
+
+func (n *Notifier) notify(msg *Notification) {
+	now := time.Now()
+	key := msg.Kind + ": " + msg.Title
+	n.mu.Lock()
+	if last, ok := n.last[key]; ok && now.Sub(last) < time.Duration(n.cfg.Period)*time.Second {
+		n.mu.Unlock()
+		Logf(1, "notify: suppressing %v (last notification at %v)", key, last.Format(dateFormat))
+		return
+	}
+	n.last[key] = now
+	n.mu.Unlock()
+
+	msg.Manager = n.manager
+	msg.Tag = n.tag
+	msg.Time = now
+	// Don't block crash processing on slow servers.
+	go func() {
+		if len(n.cfg.Email) != 0 {
+			if err := n.sendEmail(msg); err != nil {
+				Logf(0, "notify: failed to send email: %v", err)
+			}
+		}
+		if n.cfg.Webhook != "" {
+			if err := n.sendWebhook(msg); err != nil {
+				Logf(0, "notify: failed to post to webhook: %v", err)
+			}
+		}
+	}()
+}
+
+func (n *Notifier) sendEmail(msg *Notification) error {
+	what := "new crash"
+	if msg.Kind == "repro" {
+		what = "reproducer"
+	}
+	// Titles come from kernel output, don't let them break the headers.
+	title := strings.NewReplacer("\r", " ", "\n", " ").Replace(msg.Title)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %v\r\n", n.cfg.From)
+	fmt.Fprintf(buf, "To: %v\r\n", strings.Join(n.cfg.Email, ", "))
+	fmt.Fprintf(buf, "Subject: [syzkaller] %v: %v: %v\r\n", msg.Manager, what, title)
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(buf, "\r\n")
+	fmt.Fprintf(buf, "syz-manager %v found %v:\n%v\n\n", msg.Manager, what, msg.Title)
+	if msg.Tag != "" {
+		fmt.Fprintf(buf, "Tag: %v\n\n", msg.Tag)
+	}
+	if msg.Type != "" {
+		fmt.Fprintf(buf, "Type: %v (%v severity)\n\n", msg.Type, msg.Severity)
+	}
+	if msg.Guilty != "" {
+		fmt.Fprintf(buf, "Guilty file: %v\n", msg.Guilty)
+		if len(msg.CC) != 0 {
+			fmt.Fprintf(buf, "Suggested CC: %v\n", strings.Join(msg.CC, ", "))
+		}
+		fmt.Fprintf(buf, "\n")
+	}
+	if msg.Report != "" {
+		fmt.Fprintf(buf, "Report:\n%v\n\n", msg.Report)
+	}
+	if msg.Repro != "" {
+		fmt.Fprintf(buf, "Syzkaller reproducer:\n%v\n\n", msg.Repro)
+	}
+	if msg.CRepro != "" {
+		fmt.Fprintf(buf, "C reproducer:\n%v\n\n", msg.CRepro)
+	}
+	return smtp.SendMail(n.cfg.Smtp, nil, n.cfg.From, n.cfg.Email, buf.Bytes())
+}
+
+func (n *Notifier) sendWebhook(msg *Notification) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Post(n.cfg.Webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v returned %v", n.cfg.Webhook, resp.Status)
+	}
+	return nil
+}
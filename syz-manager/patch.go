@@ -0,0 +1,214 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/bisect"
+	"github.com/google/syzkaller/config"
+	"github.com/google/syzkaller/cover"
+	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/hash"
+	. "github.com/google/syzkaller/log"
+)
+
+const patchReproTime = 10 * time.Minute
+
+// PatchTest is the result of testing of a kernel patch against a crash.
+// It is saved as patch.<patch hash> file in the crash dir.
+type PatchTest struct {
+	Patch   string // patch file name
+	Hash    string // patch hash
+	Title   string // crash title
+	Status  string // bisect.StatusRunning, bisect.StatusDone or bisect.StatusFailed
+	Started time.Time
+	Updated time.Time
+	Repro   string        // bisect.ResultCrash or bisect.ResultOK
+	Fuzzing time.Duration // how long the patched kernel was fuzzed
+	Crash   string        // the crash that happened on the patched kernel
+	Fixed   bool          // neither the reproducer nor fuzzing triggered the crash
+	Error   string
+	file    string
+	mu      sync.Mutex
+}
+
+// testPatch applies patch to Kernel_Src, builds the kernel and checks
+// whether the crash with the given id still happens on the patched kernel.
+// First the crash reproducer is run, if it does not trigger the crash,
+// the patched kernel is fuzzed for the given duration.
+func testPatch(cfg *config.Config, syscalls map[int]bool, patchFile, crashID string, duration time.Duration) {
+	if cfg.Kernel_Src == "" {
+		Fatalf("patch testing requires kernel_src in config")
+	}
+	if crashID == "" {
+		Fatalf("specify crash to test the patch against with -crash")
+	}
+	dir := filepath.Join(cfg.Workdir, "crashes", crashID)
+	desc, err := ioutil.ReadFile(filepath.Join(dir, "description"))
+	if err != nil {
+		Fatalf("failed to read crash description: %v", err)
+	}
+	repro, err := ioutil.ReadFile(filepath.Join(dir, "repro.prog"))
+	if err != nil {
+		Fatalf("failed to read crash reproducer: %v", err)
+	}
+	patch, err := ioutil.ReadFile(patchFile)
+	if err != nil {
+		Fatalf("failed to read patch: %v", err)
+	}
+	kernelConfig, err := ioutil.ReadFile(filepath.Join(filepath.Dir(cfg.Vmlinux), ".config"))
+	if err != nil {
+		Fatalf("failed to read kernel config: %v", err)
+	}
+	sig := hash.Hash(patch)
+	now := time.Now()
+	pt := &PatchTest{
+		Patch:   filepath.Base(patchFile),
+		Hash:    sig.String(),
+		Title:   strings.TrimSpace(string(desc)),
+		Status:  bisect.StatusRunning,
+		Started: now,
+		Updated: now,
+		file:    filepath.Join(dir, "patch."+sig.String()),
+	}
+	pt.save()
+	if err := pt.run(cfg, syscalls, patchFile, repro, kernelConfig, duration); err != nil {
+		pt.Status = bisect.StatusFailed
+		pt.Error = err.Error()
+		pt.save()
+		Fatalf("patch testing failed: %v", err)
+	}
+	pt.Status = bisect.StatusDone
+	pt.save()
+	if pt.Fixed {
+		Logf(0, "patch testing: the crash did not happen (fuzzed for %v)", pt.Fuzzing)
+	} else {
+		Logf(0, "patch testing: the crash still happens: %v", pt.Crash)
+	}
+}
+
+func (pt *PatchTest) run(cfg *config.Config, syscalls map[int]bool, patchFile string,
+	repro, kernelConfig []byte, duration time.Duration) error {
+	src := cfg.Kernel_Src
+	patchFile, err := filepath.Abs(patchFile)
+	if err != nil {
+		return err
+	}
+	if _, err := bisect.Git(src, "apply", "--check", patchFile); err != nil {
+		return fmt.Errorf("patch does not apply: %v", err)
+	}
+	if _, err := bisect.Git(src, "apply", patchFile); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := bisect.Git(src, "apply", "-R", patchFile); err != nil {
+			Logf(0, "patch testing: failed to revert the patch: %v", err)
+		}
+	}()
+
+	// Build the image that the manager boots, but from the patched sources.
+	image := "arch/x86/boot/bzImage"
+	if rel, err := filepath.Rel(src, cfg.Kernel); err == nil && !strings.HasPrefix(rel, "..") {
+		image = rel
+	}
+	Logf(0, "patch testing: building patched kernel...")
+	if err := bisect.BuildKernel(src, image, kernelConfig); err != nil {
+		return err
+	}
+	cfg.Kernel = filepath.Join(src, image)
+	cfg.Vmlinux = filepath.Join(src, "vmlinux")
+
+	Logf(0, "patch testing: running reproducer...")
+	crash, err := bisect.TestRepro(cfg, repro, patchReproTime)
+	if err != nil {
+		return err
+	}
+	if crash != "" {
+		Logf(0, "patch testing: reproducer crashed the kernel: %v", crash)
+		pt.Repro = bisect.ResultCrash
+		pt.Crash = crash
+		return nil
+	}
+	pt.Repro = bisect.ResultOK
+	pt.save()
+
+	// Fuzz the patched kernel in a separate workdir seeded with the main corpus,
+	// so that the main corpus and crashes are not affected.
+	workdir := filepath.Join(cfg.Workdir, "patches", pt.Hash)
+	if err := seedCorpus(filepath.Join(cfg.Workdir, "corpus"), filepath.Join(workdir, "corpus")); err != nil {
+		return err
+	}
+	cfg.Workdir = workdir
+	cfg.Hub_Addr = ""
+	cfg.Dashboard_Addr = ""
+	cfg.Notify = nil
+	cfg.Repro_Percent = 0
+	cfg.Tag = strings.TrimSpace(cfg.Tag + " patch " + pt.Patch)
+	Logf(0, "patch testing: fuzzing patched kernel for %v...", duration)
+	cover.InitReport(cfg.Vmlinux)
+	start := time.Now()
+	timer := time.AfterFunc(duration, shutdown)
+	defer timer.Stop()
+	RunManager(cfg, syscalls, pt)
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.Fuzzing = time.Since(start)
+	pt.Fixed = pt.Crash == ""
+	return nil
+}
+
+// crashed is called by the manager for every crash on the patched kernel.
+func (pt *PatchTest) crashed(desc string) {
+	if desc != pt.Title {
+		return
+	}
+	pt.mu.Lock()
+	pt.Crash = desc
+	pt.mu.Unlock()
+	shutdown()
+}
+
+func (pt *PatchTest) save() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.Updated = time.Now()
+	data, err := json.MarshalIndent(pt, "", "\t")
+	if err != nil {
+		Logf(0, "failed to serialize patch test: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(pt.file, data, 0660); err != nil {
+		Logf(0, "failed to write patch test: %v", err)
+	}
+}
+
+func seedCorpus(from, to string) error {
+	if err := os.MkdirAll(to, 0770); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(from)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err := fileutil.CopyFile(filepath.Join(from, f.Name()), filepath.Join(to, f.Name()), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+// fuzzingState is changed by operators on /admin/fuzzing and is propagated to fuzzers
+// with replies to their polls (see PollRes.Paused and PollRes.Stop).
+type fuzzingState int
+
+const (
+	fuzzingRunning fuzzingState = iota
+	fuzzingPaused               // fuzzers don't execute programs, VMs are kept, crashes are not reproduced
+	fuzzingStopped              // fuzzers kill executors and exit, VMs are not restarted until fuzzing is resumed
+)
+
+var fuzzingActions = map[string]fuzzingState{
+	"resume": fuzzingRunning,
+	"pause":  fuzzingPaused,
+	"stop":   fuzzingStopped,
+}
+
+func (s fuzzingState) String() string {
+	switch s {
+	case fuzzingRunning:
+		return "running"
+	case fuzzingPaused:
+		return "paused"
+	case fuzzingStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("fuzzingState(%d)", int(s))
+	}
+}
+
+// httpAdminFuzzing returns the fuzzing state, POST with action=pause, resume or stop changes it.
+func (mgr *Manager) httpAdminFuzzing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		mgr.mu.Lock()
+		state := mgr.fuzzing
+		mgr.mu.Unlock()
+		fmt.Fprintf(w, "%v\n", state)
+		return
+	}
+	state, ok := fuzzingActions[r.FormValue("action")]
+	if !ok {
+		http.Error(w, fmt.Sprintf("bad action %q, want pause, resume or stop", r.FormValue("action")), http.StatusBadRequest)
+		return
+	}
+	select {
+	case mgr.fuzzingCtl <- state:
+		fmt.Fprintf(w, "%v\n", state)
+	case <-vm.Shutdown:
+		http.Error(w, "manager is shutting down", http.StatusServiceUnavailable)
+	}
+}
+
+// setFuzzing is called by vmLoop when the fuzzing state changes.
+func (mgr *Manager) setFuzzing(state fuzzingState) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.fuzzing != state {
+		Logf(0, "fuzzing state changed from %v to %v", mgr.fuzzing, state)
+		mgr.fuzzing = state
+	}
+}
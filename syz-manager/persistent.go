@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/google/syzkaller/fileutil"
 	"github.com/google/syzkaller/hash"
 	. "github.com/google/syzkaller/log"
 )
@@ -45,6 +47,12 @@ func newPersistentSet(dir string, verify func(data []byte) bool) *PersistentSet
 			return nil
 		}
 		name := info.Name()
+		if strings.Contains(name, fileutil.TempSuffix) {
+			// Write of a new blob was interrupted by a crash or kill.
+			Logf(0, "removing temp file %v", name)
+			os.Remove(path)
+			return nil
+		}
 		if len(data) == 0 {
 			// This can happen is master runs on machine-under-test,
 			// and it has crashed midway.
@@ -62,7 +70,7 @@ func newPersistentSet(dir string, verify func(data []byte) bool) *PersistentSet
 		}
 		if name != sig.String() {
 			Logf(0, "bad hash in persistent dir %v for file %v, expect %v", dir, name, sig.String())
-			if err := ioutil.WriteFile(filepath.Join(ps.dir, sig.String()), data, 0660); err != nil {
+			if err := fileutil.WriteFileAtomicNoSync(filepath.Join(ps.dir, sig.String()), data, 0660); err != nil {
 				Fatalf("failed to write file: %v", err)
 			}
 			os.Remove(path)
@@ -82,12 +90,34 @@ func (ps *PersistentSet) add(data []byte) bool {
 	ps.m[sig] = data
 	ps.a = append(ps.a, data)
 	fname := filepath.Join(ps.dir, sig.String())
-	if err := ioutil.WriteFile(fname, data, 0660); err != nil {
+	if err := fileutil.WriteFileAtomicNoSync(fname, data, 0660); err != nil {
 		Fatalf("failed to write file: %v", err)
 	}
 	return true
 }
 
+// archive moves blobs that are not in set to archiveDir and returns number of moved blobs.
+func (ps *PersistentSet) archive(set map[string]bool, archiveDir string) int {
+	if err := os.MkdirAll(archiveDir, 0770); err != nil {
+		Fatalf("failed to create archive dir: %v", err)
+	}
+	n := 0
+	ps.a = nil
+	for sig, data := range ps.m {
+		s := sig.String()
+		if set[s] {
+			ps.a = append(ps.a, data)
+			continue
+		}
+		delete(ps.m, sig)
+		if err := os.Rename(filepath.Join(ps.dir, s), filepath.Join(archiveDir, s)); err != nil {
+			Logf(0, "failed to archive %v: %v", s, err)
+		}
+		n++
+	}
+	return n
+}
+
 func (ps *PersistentSet) minimize(set map[string]bool) {
 	ps.a = nil
 	for sig, data := range ps.m {
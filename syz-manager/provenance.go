@@ -0,0 +1,54 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/google/syzkaller/prog"
+)
+
+// crashProvenance returns the last programs executed by every proc before the crash
+// with calls annotated by fuzzers with their provenance (see provenance config param):
+// calls that are new or have args mutated since the seed of the program go first,
+// so that it's visible at a glance what change likely triggered the bug.
+// Returns nil if the programs are not annotated.
+func crashProvenance(output []byte) []byte {
+	last := make(map[int]*prog.LogEntry)
+	for _, ent := range prog.ParseLog(output) {
+		last[ent.Proc] = ent
+	}
+	var procs []int
+	for proc := range last {
+		procs = append(procs, proc)
+	}
+	sort.Ints(procs)
+	buf := new(bytes.Buffer)
+	for _, proc := range procs {
+		p := last[proc].P
+		var changed []string
+		annotated := false
+		for i, c := range p.Calls {
+			cp, ok := prog.ParseCallProvenance(c.Comment)
+			if !ok {
+				continue
+			}
+			annotated = true
+			if !cp.Inherited() {
+				changed = append(changed, fmt.Sprintf("  #%v %v: %v", i, c.Meta.Name, cp.String()))
+			}
+		}
+		if !annotated {
+			continue
+		}
+		fmt.Fprintf(buf, "proc %v: %v of %v calls changed since the seed\n", proc, len(changed), len(p.Calls))
+		for _, line := range changed {
+			fmt.Fprintf(buf, "%v\n", line)
+		}
+		fmt.Fprintf(buf, "%s\n", p.Serialize())
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/hash"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/repro"
+)
+
+// reproJob is persisted in "repro.job" file in crash dir while the crash is queued for
+// or being reproduced, so that reproduction is resumed after a manager restart.
+type reproJob struct {
+	Kernel int          // see Crash.kernel
+	Log    []byte       // crash log the reproduction starts from
+	Report []byte       // crash report
+	State  *repro.State // nil until the first reproduction stage is completed
+}
+
+func (mgr *Manager) reproJobFile(desc string) string {
+	sig := hash.Hash([]byte(desc))
+	return filepath.Join(mgr.crashdir, sig.String(), "repro.job")
+}
+
+// saveReproJob persists the reproduction job of the crash with the given progress state.
+func (mgr *Manager) saveReproJob(crash *Crash, state *repro.State) {
+	job := &reproJob{
+		Kernel: crash.kernel,
+		Log:    crash.output,
+		Report: crash.text,
+		State:  state,
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		Logf(0, "failed to marshal repro job: %v", err)
+		return
+	}
+	if err := fileutil.WriteFileAtomic(mgr.reproJobFile(crash.desc), data, 0660); err != nil {
+		Logf(0, "failed to save repro job: %v", err)
+	}
+}
+
+func (mgr *Manager) removeReproJob(desc string) {
+	os.Remove(mgr.reproJobFile(desc))
+}
+
+// loadReproJobs returns crashes with reproduction jobs left unfinished by the previous run.
+func (mgr *Manager) loadReproJobs() []*Crash {
+	dirs, err := ioutil.ReadDir(mgr.crashdir)
+	if err != nil {
+		return nil
+	}
+	var crashes []*Crash
+	for _, dir := range dirs {
+		file := filepath.Join(mgr.crashdir, dir.Name(), "repro.job")
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		desc, err := ioutil.ReadFile(filepath.Join(mgr.crashdir, dir.Name(), "description"))
+		if err != nil || len(trimNewLines(desc)) == 0 {
+			os.Remove(file)
+			continue
+		}
+		job := new(reproJob)
+		if err := json.Unmarshal(data, job); err != nil {
+			Logf(0, "failed to parse repro job %v: %v", file, err)
+			os.Remove(file)
+			continue
+		}
+		crash := &Crash{
+			vmName:     "resumed",
+			desc:       string(trimNewLines(desc)),
+			text:       job.Report,
+			output:     job.Log,
+			kernel:     job.Kernel,
+			reproState: job.State,
+		}
+		if !mgr.needRepro(crash.desc) {
+			os.Remove(file)
+			continue
+		}
+		if crash.kernel == 1 && mgr.compare == nil {
+			// The compared kernel is not configured anymore, start over on the main kernel.
+			crash.kernel = 0
+			crash.reproState = nil
+		}
+		crashes = append(crashes, crash)
+	}
+	if len(crashes) != 0 {
+		Logf(0, "resuming %v reproduction jobs", len(crashes))
+	}
+	return crashes
+}
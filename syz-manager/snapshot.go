@@ -0,0 +1,147 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/syzkaller/config"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+)
+
+// preparedVM is a booted VM with syzkaller binaries copied into it.
+type preparedVM struct {
+	cfg         *vm.Config
+	inst        vm.Instance
+	fwdAddr     string
+	fuzzerBin   string
+	executorBin string
+	certFile    string
+	tokenFile   string
+	postprocs   []string // post-processors with paths of files in the VM (see config postprocessors)
+	snapshot    bool     // the VM state was saved right after preparation
+}
+
+// snapshotVMs keeps VMs between fuzzer runs in snapshot mode: after a crash or a periodic restart
+// the VM is restored from the snapshot taken after boot instead of being rebooted.
+// VMs are keyed by VM index.
+type snapshotVMs struct {
+	mu  sync.Mutex
+	vms map[int]*preparedVM
+}
+
+func newSnapshotVMs() *snapshotVMs {
+	return &snapshotVMs{
+		vms: make(map[int]*preparedVM),
+	}
+}
+
+func (s *snapshotVMs) put(index int, pvm *preparedVM) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.vms[index]; old != nil {
+		old.inst.Close()
+	}
+	s.vms[index] = pvm
+}
+
+func (s *snapshotVMs) take(index int) *preparedVM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pvm := s.vms[index]
+	delete(s.vms, index)
+	return pvm
+}
+
+// drop destroys the VM with the index, e.g. when the index is used for reproduction
+// or is not used anymore after a decrease of the number of VMs.
+func (s *snapshotVMs) drop(index int) {
+	if pvm := s.take(index); pvm != nil {
+		pvm.inst.Close()
+	}
+}
+
+func (s *snapshotVMs) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for index, pvm := range s.vms {
+		pvm.inst.Close()
+		delete(s.vms, index)
+	}
+}
+
+// prepareInstance returns a VM with the index ready to run the fuzzer.
+// In snapshot mode it is the VM of the previous run restored from the snapshot if possible.
+func (mgr *Manager) prepareInstance(index int) (*preparedVM, error) {
+	if mgr.snapshots != nil {
+		if pvm := mgr.snapshots.take(index); pvm != nil {
+			err := pvm.inst.(vm.Snapshotter).Restore()
+			if err == nil {
+				mgr.mu.Lock()
+				mgr.stats["vm restores"]++
+				mgr.mu.Unlock()
+				return pvm, nil
+			}
+			Logf(0, "%v: failed to restore snapshot, rebooting: %v", pvm.cfg.Name, err)
+			pvm.inst.Close()
+		}
+	}
+	vmCfg, err := config.CreateVMConfig(mgr.cfg, index)
+	if err != nil {
+		Fatalf("failed to create VM config: %v", err)
+	}
+	inst, err := vm.Create(mgr.cfg.Type, vmCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create instance: %v", err)
+	}
+	pvm := &preparedVM{cfg: vmCfg, inst: inst}
+	if err := mgr.copyBinaries(pvm); err != nil {
+		inst.Close()
+		return nil, err
+	}
+	if s, ok := inst.(vm.Snapshotter); ok && mgr.snapshots != nil {
+		if err := s.Snapshot(); err != nil {
+			Logf(0, "%v: failed to save snapshot, the VM will be rebooted: %v", vmCfg.Name, err)
+		} else {
+			pvm.snapshot = true
+		}
+	}
+	return pvm, nil
+}
+
+func (mgr *Manager) copyBinaries(pvm *preparedVM) error {
+	var err error
+	if pvm.fwdAddr, err = pvm.inst.Forward(mgr.port); err != nil {
+		return fmt.Errorf("failed to setup port forwarding: %v", err)
+	}
+	if pvm.fuzzerBin, err = pvm.inst.Copy(config.TargetBin(mgr.cfg, "syz-fuzzer")); err != nil {
+		return fmt.Errorf("failed to copy binary: %v", err)
+	}
+	if pvm.executorBin, err = pvm.inst.Copy(config.TargetBin(mgr.cfg, "syz-executor")); err != nil {
+		return fmt.Errorf("failed to copy binary: %v", err)
+	}
+	for _, pp := range mgr.cfg.Postprocessors {
+		colon := strings.IndexByte(pp, ':')
+		file, err := pvm.inst.Copy(pp[colon+1:])
+		if err != nil {
+			return fmt.Errorf("failed to copy post-processor: %v", err)
+		}
+		pvm.postprocs = append(pvm.postprocs, pp[:colon+1]+file)
+	}
+	if mgr.cfg.Tls_Cert != "" {
+		// The fuzzer accepts only this certificate from the manager.
+		if pvm.certFile, err = pvm.inst.Copy(mgr.cfg.Tls_Cert); err != nil {
+			return fmt.Errorf("failed to copy TLS certificate: %v", err)
+		}
+	}
+	if mgr.tokenFile != "" {
+		if pvm.tokenFile, err = pvm.inst.Copy(mgr.tokenFile); err != nil {
+			return fmt.Errorf("failed to copy auth token: %v", err)
+		}
+	}
+	return nil
+}
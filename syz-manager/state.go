@@ -0,0 +1,79 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/vm"
+)
+
+// crashStateTimeout bounds the time the VM is kept after a crash to capture its state.
+// The kernel is often not able to run commands after an oops, then the command times out.
+const crashStateTimeout = 30 * time.Second
+
+// crashStateCommand prints state of a Linux machine that is not present in crash reports,
+// but helps to debug memory corruptions, leaks and crashes in modules.
+const crashStateCommand = "echo '### dmesg'; dmesg | tail -n 300; " +
+	"echo '### slabinfo'; cat /proc/slabinfo; " +
+	"echo '### modules'; cat /proc/modules"
+
+// captureCrashState collects state of a crashed machine (see crash_state config param):
+// the last program executed by every proc (from output of the fuzzer) and, for linux,
+// output of crashStateCommand run in the VM before it is destroyed.
+func captureCrashState(inst vm.Instance, output []byte, targetOS string, stop <-chan bool) []byte {
+	buf := new(bytes.Buffer)
+	last := make(map[int]*prog.LogEntry)
+	for _, ent := range prog.ParseLog(output) {
+		last[ent.Proc] = ent
+	}
+	var procs []int
+	for proc := range last {
+		procs = append(procs, proc)
+	}
+	sort.Ints(procs)
+	fmt.Fprintf(buf, "### last programs\n")
+	for _, proc := range procs {
+		fmt.Fprintf(buf, "proc %v:\n%s\n", proc, last[proc].P.Serialize())
+	}
+	if targetOS != "linux" {
+		return buf.Bytes()
+	}
+	outc, errc, err := inst.Run(crashStateTimeout, stop, crashStateCommand)
+	if err != nil {
+		fmt.Fprintf(buf, "### failed to run state command: %v\n", err)
+		return buf.Bytes()
+	}
+	for {
+		select {
+		case out, ok := <-outc:
+			if !ok {
+				outc = nil
+				continue
+			}
+			buf.Write(out)
+		case err := <-errc:
+			// The tail of the output may arrive after the command exits.
+			for timer := time.After(time.Second); outc != nil; {
+				select {
+				case out, ok := <-outc:
+					if !ok {
+						outc = nil
+					}
+					buf.Write(out)
+				case <-timer:
+					outc = nil
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(buf, "\n### state command failed: %v\n", err)
+			}
+			return buf.Bytes()
+		}
+	}
+}
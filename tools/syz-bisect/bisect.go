@@ -0,0 +1,112 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-bisect finds the kernel commit that introduced (or, with -fix, fixed) a crash
+// found by syz-manager. Usage:
+//   syz-bisect -config=manager.cfg -crash=workdir/crashes/<id> -kernel_src=linux -good=v4.11 -bad=HEAD
+// The crash must have a reproducer (repro.prog). Progress and the result are saved
+// to bisect.cause (or bisect.fix) in the crash dir and are shown on the crash page of syz-manager.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/syzkaller/bisect"
+	"github.com/google/syzkaller/config"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+	_ "github.com/google/syzkaller/vm/adb"
+	_ "github.com/google/syzkaller/vm/bhyve"
+	_ "github.com/google/syzkaller/vm/cuttlefish"
+	_ "github.com/google/syzkaller/vm/gce"
+	_ "github.com/google/syzkaller/vm/gvisor"
+	_ "github.com/google/syzkaller/vm/hyperv"
+	_ "github.com/google/syzkaller/vm/isolated"
+	_ "github.com/google/syzkaller/vm/kvm"
+	_ "github.com/google/syzkaller/vm/proxy"
+	_ "github.com/google/syzkaller/vm/qemu"
+	_ "github.com/google/syzkaller/vm/vmm"
+	_ "github.com/google/syzkaller/vm/vmware"
+)
+
+var (
+	flagConfig       = flag.String("config", "", "manager configuration file")
+	flagCrash        = flag.String("crash", "", "crash dir with repro.prog (workdir/crashes/<id>)")
+	flagKernelSrc    = flag.String("kernel_src", "", "kernel git checkout to build (its working tree is modified)")
+	flagKernelConfig = flag.String("kernel_config", "", "kernel .config (by default .config next to vmlinux from manager config)")
+	flagKernelImage  = flag.String("kernel_image", "arch/x86/boot/bzImage", "kernel image relative to kernel_src")
+	flagGood         = flag.String("good", "", "commit where the crash does not happen")
+	flagBad          = flag.String("bad", "", "commit where the crash happens")
+	flagFix          = flag.Bool("fix", false, "bisect the commit that fixed the crash (good must be newer than bad)")
+	flagDuration     = flag.Duration("duration", 10*time.Minute, "how long to run the reproducer on each commit")
+	flagCount        = flag.Int("count", 0, "number of VMs to use (overrides config count param)")
+)
+
+func main() {
+	flag.Parse()
+	cfg, _, err := config.Parse(*flagConfig)
+	if err != nil {
+		Fatalf("%v", err)
+	}
+	if *flagCount > 0 {
+		cfg.Count = *flagCount
+	}
+	if *flagCrash == "" || *flagKernelSrc == "" || *flagGood == "" || *flagBad == "" {
+		Fatalf("usage: syz-bisect -config=manager.cfg -crash=workdir/crashes/<id> -kernel_src=linux -good=commit -bad=commit [-fix]")
+	}
+	repro, err := ioutil.ReadFile(filepath.Join(*flagCrash, "repro.prog"))
+	if err != nil {
+		Fatalf("failed to read reproducer: %v", err)
+	}
+	title, err := ioutil.ReadFile(filepath.Join(*flagCrash, "description"))
+	if err != nil {
+		Fatalf("failed to read crash description: %v", err)
+	}
+	configFile := *flagKernelConfig
+	if configFile == "" {
+		configFile = filepath.Join(filepath.Dir(cfg.Vmlinux), ".config")
+	}
+	// The file may be in kernel_src, which is rewritten on each build, so read it once.
+	kernelConfig, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		Fatalf("failed to read kernel config: %v", err)
+	}
+	stateFile := filepath.Join(*flagCrash, "bisect.cause")
+	if *flagFix {
+		stateFile = filepath.Join(*flagCrash, "bisect.fix")
+	}
+
+	go func() {
+		c := make(chan os.Signal, 2)
+		signal.Notify(c, syscall.SIGINT)
+		<-c
+		close(vm.Shutdown)
+		Logf(-1, "shutting down...")
+		<-c
+		Fatalf("terminating")
+	}()
+
+	st := bisect.Run(&bisect.Config{
+		Manager:      cfg,
+		KernelSrc:    *flagKernelSrc,
+		KernelConfig: kernelConfig,
+		KernelImage:  *flagKernelImage,
+		Fix:          *flagFix,
+		Good:         *flagGood,
+		Bad:          *flagBad,
+		Repro:        repro,
+		Title:        strings.TrimSpace(string(title)),
+		Duration:     *flagDuration,
+		StateFile:    stateFile,
+	})
+	if st.Status != bisect.StatusDone {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-check cross-checks descriptions against debug info of a kernel build:
+// sizes and field offsets of structs, values of constants that are kernel enums
+// and argument sizes encoded in ioctl commands. Descriptions are compiled for
+// a single arch, so the tool needs to be built for the arch of vmlinux
+// (e.g. GOARCH=arm64 go build ./tools/syz-check). Mismatches are printed prefixed with the arch.
+package main
+
+import (
+	"bufio"
+	"debug/dwarf"
+	"debug/elf"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/syzkaller/sys"
+)
+
+var (
+	flagVmlinux = flag.String("vmlinux", "vmlinux", "path to vmlinux built with CONFIG_DEBUG_INFO=y")
+	flagSys     = flag.String("sys", "sys", "path to sys dir with const files")
+)
+
+var archMachine = map[string]elf.Machine{
+	"amd64":   elf.EM_X86_64,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64le": elf.EM_PPC64,
+}
+
+func main() {
+	flag.Parse()
+	arch := runtime.GOARCH
+	f, err := elf.Open(*flagVmlinux)
+	if err != nil {
+		fatalf("failed to open vmlinux: %v", err)
+	}
+	defer f.Close()
+	if f.Machine != archMachine[arch] {
+		fatalf("vmlinux is built for %v, but the tool for %v (set GOARCH)", f.Machine, arch)
+	}
+	debug, err := f.DWARF()
+	if err != nil {
+		fatalf("failed to read debug info: %v", err)
+	}
+	structs, enums, err := readDWARF(debug)
+	if err != nil {
+		fatalf("failed to parse debug info: %v", err)
+	}
+	var errors []string
+	errors = append(errors, checkStructs(structs)...)
+	errors = append(errors, checkConsts(enums, arch)...)
+	errors = append(errors, checkIoctls(arch)...)
+	for _, e := range errors {
+		fmt.Printf("%v: %v\n", arch, e)
+	}
+	if len(errors) != 0 {
+		os.Exit(1)
+	}
+}
+
+// readDWARF returns complete struct/union types and enumerator values of the kernel.
+func readDWARF(debug *dwarf.Data) (map[string]*dwarf.StructType, map[string]int64, error) {
+	structs := make(map[string]*dwarf.StructType)
+	enums := make(map[string]int64)
+	r := debug.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if e == nil {
+			break
+		}
+		switch e.Tag {
+		case dwarf.TagStructType, dwarf.TagUnionType:
+			r.SkipChildren()
+			name, _ := e.Val(dwarf.AttrName).(string)
+			if name == "" || structs[name] != nil {
+				continue
+			}
+			typ, err := debug.Type(e.Offset)
+			if err != nil {
+				return nil, nil, err
+			}
+			if st := typ.(*dwarf.StructType); !st.Incomplete {
+				structs[name] = st
+			}
+		case dwarf.TagEnumerationType:
+			r.SkipChildren()
+			typ, err := debug.Type(e.Offset)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, v := range typ.(*dwarf.EnumType).Val {
+				enums[v.Name] = v.Val
+			}
+		}
+	}
+	return structs, enums, nil
+}
+
+func checkStructs(structs map[string]*dwarf.StructType) []string {
+	var errors []string
+	checked := make(map[string]bool)
+	for key, typ := range sys.Structs {
+		// Keys look as "{name field dir}".
+		name := strings.Fields(strings.Trim(key, "{}"))[0]
+		kernel := structs[name]
+		if checked[name] || kernel == nil {
+			continue
+		}
+		checked[name] = true
+		switch t := typ.(type) {
+		case *sys.StructType:
+			if kernel.Kind != "struct" {
+				continue
+			}
+			errors = append(errors, checkStruct(name, t, kernel)...)
+		case *sys.UnionType:
+			if kernel.Kind != "union" || sys.IsVarlen(t) {
+				continue
+			}
+			if size := int64(t.Size()); size != kernel.ByteSize {
+				errors = append(errors, fmt.Sprintf("union %v: size %v, kernel %v", name, size, kernel.ByteSize))
+			}
+		}
+	}
+	sort.Strings(errors)
+	return errors
+}
+
+func checkStruct(name string, t *sys.StructType, kernel *dwarf.StructType) []string {
+	var errors []string
+	varlen := sys.IsVarlen(t)
+	if !varlen {
+		if size := int64(t.Size()); size != kernel.ByteSize {
+			errors = append(errors, fmt.Sprintf("struct %v: size %v, kernel %v", name, size, kernel.ByteSize))
+		}
+	}
+	// Kernel fields without storage of their own (flexible arrays)
+	// and bitfields sharing storage with the previous field are skipped.
+	var kernelFields []*dwarf.StructField
+	for i, f := range kernel.Field {
+		if f.Type.Size() <= 0 {
+			continue
+		}
+		if f.BitSize != 0 && i != 0 && kernel.Field[i-1].BitSize != 0 &&
+			kernel.Field[i-1].ByteOffset == f.ByteOffset {
+			continue
+		}
+		kernelFields = append(kernelFields, f)
+	}
+	fields := t.Fields
+	if t.OverlayField != 0 {
+		fields = fields[:t.OverlayField]
+	}
+	var offsets []int64
+	var names []string
+	off := int64(0)
+	for _, f := range fields {
+		if !sys.IsPad(f) {
+			offsets = append(offsets, off)
+			names = append(names, f.Name())
+		}
+		if sys.IsVarlen(f) {
+			break
+		}
+		off += int64(f.Size())
+	}
+	if !varlen && len(offsets) != len(kernelFields) {
+		errors = append(errors, fmt.Sprintf("struct %v: %v fields, kernel %v", name, len(offsets), len(kernelFields)))
+		return errors
+	}
+	for i := range offsets {
+		if i >= len(kernelFields) {
+			break
+		}
+		if offsets[i] != kernelFields[i].ByteOffset {
+			errors = append(errors, fmt.Sprintf("struct %v: field %v at offset %v, kernel %v (%v)",
+				name, names[i], offsets[i], kernelFields[i].ByteOffset, kernelFields[i].Name))
+		}
+	}
+	return errors
+}
+
+// checkConsts compares values in const files with kernel enums of the same name.
+// Constants defined as macros are not present in debug info and are not checked.
+func checkConsts(enums map[string]int64, arch string) []string {
+	files, err := filepath.Glob(filepath.Join(*flagSys, "*_"+arch+".const"))
+	if err != nil || len(files) == 0 {
+		fatalf("failed to find const files in %v: %v", *flagSys, err)
+	}
+	var errors []string
+	for _, fname := range files {
+		f, err := os.Open(fname)
+		if err != nil {
+			fatalf("failed to open const file: %v", err)
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := s.Text()
+			eq := strings.IndexByte(line, '=')
+			if line == "" || line[0] == '#' || eq == -1 {
+				continue
+			}
+			name := strings.TrimSpace(line[:eq])
+			val, err := strconv.ParseUint(strings.TrimSpace(line[eq+1:]), 0, 64)
+			if err != nil {
+				continue
+			}
+			kernel, ok := enums[name]
+			if !ok || val == uint64(kernel) || val == uint64(uint32(kernel)) {
+				continue
+			}
+			errors = append(errors, fmt.Sprintf("const %v (%v): %v, kernel %v",
+				name, filepath.Base(fname), val, kernel))
+		}
+		f.Close()
+	}
+	sort.Strings(errors)
+	return errors
+}
+
+// checkIoctls checks that argument sizes encoded in ioctl commands (_IOR/_IOW/_IOWR)
+// match sizes of described arguments.
+func checkIoctls(arch string) []string {
+	sizeBits := uint(14)
+	if arch == "ppc64le" {
+		sizeBits = 13
+	}
+	var errors []string
+	for _, c := range sys.Calls {
+		if c.CallName != "ioctl" || len(c.Args) < 3 {
+			continue
+		}
+		cmd, ok1 := c.Args[1].(*sys.ConstType)
+		ptr, ok2 := c.Args[2].(*sys.PtrType)
+		if !ok1 || !ok2 || sys.IsVarlen(ptr.Type) {
+			continue
+		}
+		size := (cmd.Val >> 16) & (1<<sizeBits - 1)
+		if size != 0 && size != ptr.Type.Size() {
+			errors = append(errors, fmt.Sprintf("%v: command 0x%x encodes argument size %v, described %v",
+				c.Name, cmd.Val, size, ptr.Type.Size()))
+		}
+	}
+	sort.Strings(errors)
+	return errors
+}
+
+func fatalf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
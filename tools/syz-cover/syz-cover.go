@@ -0,0 +1,91 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-cover generates an HTML coverage report (the same as /cover page of syz-manager)
+// from files with coverage PCs, e.g. produced by syz-execprog -coverfile.
+// Files can be either in sancov format or contain one hex PC per line.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/syzkaller/cover"
+	. "github.com/google/syzkaller/log"
+)
+
+var (
+	flagVmlinux   = flag.String("vmlinux", "vmlinux", "path to vmlinux")
+	flagKernelSrc = flag.String("kernel_src", "", "path to kernel sources (by default source paths from vmlinux debug info are used)")
+	flagOutput    = flag.String("output", "cover.html", "write the report to this file")
+)
+
+// sancovMagic is the header of 64-bit sancov files.
+const sancovMagic = 0xC0BFFFFFFFFFFF64
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: syz-cover [flags] coverfile...\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	var cov cover.Cover
+	for _, fn := range flag.Args() {
+		pcs, err := readPCs(fn)
+		if err != nil {
+			Fatalf("%v", err)
+		}
+		cov = cover.Union(cov, cover.Canonicalize(pcs))
+	}
+	Logf(0, "read %v PCs", len(cov))
+	cover.InitReport(*flagVmlinux)
+	buf := new(bytes.Buffer)
+	if err := cover.GenerateHTML(buf, *flagVmlinux, *flagKernelSrc, cov); err != nil {
+		Fatalf("failed to generate coverage report: %v", err)
+	}
+	if err := ioutil.WriteFile(*flagOutput, buf.Bytes(), 0640); err != nil {
+		Fatalf("failed to write report: %v", err)
+	}
+	Logf(0, "wrote coverage report to %v", *flagOutput)
+}
+
+// readPCs reads PCs from a sancov or text file. PCs are truncated to 32 bits
+// the same way the executor does, the upper part is restored from vmlinux.
+func readPCs(fn string) ([]uint32, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read coverage file: %v", err)
+	}
+	var pcs []uint32
+	if len(data) >= 8 && binary.LittleEndian.Uint64(data) == sancovMagic {
+		data = data[8:]
+		if len(data)%8 != 0 {
+			return nil, fmt.Errorf("%v: truncated sancov file", fn)
+		}
+		for ; len(data) != 0; data = data[8:] {
+			pcs = append(pcs, uint32(binary.LittleEndian.Uint64(data)))
+		}
+		return pcs, nil
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		ln := strings.TrimSpace(s.Text())
+		if ln == "" {
+			continue
+		}
+		pc, err := strconv.ParseUint(strings.TrimPrefix(ln, "0x"), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v: bad PC %q: %v", fn, ln, err)
+		}
+		pcs = append(pcs, uint32(pc))
+	}
+	return pcs, s.Err()
+}
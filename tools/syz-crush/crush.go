@@ -1,36 +1,92 @@
 // Copyright 2016 syzkaller project authors. All rights reserved.
 // Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
 
-// syz-crush replays crash log on multiple VMs. Usage:
+// syz-crush replays crash log or reproducer on multiple VMs. Usage:
 //   syz-crush -config=config.file execution.log
+//   syz-crush -config=config.file repro.prog
+//   syz-crush -config=config.file repro.c
+// repro.prog is executed with the options from its header (procs, sandbox, threaded, etc).
 // Intended for reproduction of particularly elusive crashes.
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/google/syzkaller/config"
+	"github.com/google/syzkaller/csource"
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/vm"
 	_ "github.com/google/syzkaller/vm/adb"
+	_ "github.com/google/syzkaller/vm/bhyve"
+	_ "github.com/google/syzkaller/vm/cuttlefish"
 	_ "github.com/google/syzkaller/vm/gce"
+	_ "github.com/google/syzkaller/vm/gvisor"
+	_ "github.com/google/syzkaller/vm/hyperv"
+	_ "github.com/google/syzkaller/vm/isolated"
 	_ "github.com/google/syzkaller/vm/kvm"
+	_ "github.com/google/syzkaller/vm/proxy"
 	_ "github.com/google/syzkaller/vm/qemu"
+	_ "github.com/google/syzkaller/vm/vmm"
+	_ "github.com/google/syzkaller/vm/vmware"
 )
 
 var (
-	flagConfig = flag.String("config", "", "configuration file")
+	flagConfig  = flag.String("config", "", "configuration file")
+	flagRestart = flag.Duration("restart_time", time.Hour, "restart VMs that did not crash after this time")
 )
 
+// stats counts replays and their outcomes across all VMs.
+type stats struct {
+	mu      sync.Mutex
+	runs    int
+	crashes int
+	titles  map[string]int
+}
+
+func (st *stats) add(desc string, crashed bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.runs++
+	if !crashed {
+		return
+	}
+	if kind := vm.Classify(desc); kind == vm.KernelCrash || kind == vm.Hang {
+		st.crashes++
+	}
+	st.titles[desc]++
+}
+
+func (st *stats) String() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rate := 0.0
+	if st.runs != 0 {
+		rate = float64(st.crashes) * 100 / float64(st.runs)
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%v runs, %v kernel crashes (%.1f%% hit rate)", st.runs, st.crashes, rate)
+	var titles []string
+	for desc := range st.titles {
+		titles = append(titles, desc)
+	}
+	sort.Strings(titles)
+	for _, desc := range titles {
+		fmt.Fprintf(buf, "\n\t%v: %v", desc, st.titles[desc])
+	}
+	return buf.String()
+}
+
 func main() {
 	flag.Parse()
 	cfg, _, err := config.Parse(*flagConfig)
@@ -38,8 +94,31 @@ func main() {
 		Fatalf("%v", err)
 	}
 	if len(flag.Args()) != 1 {
-		Fatalf("usage: syz-crush -config=config.file execution.log")
+		Fatalf("usage: syz-crush -config=config.file execution.log|repro.prog|repro.c")
+	}
+	input := flag.Args()[0]
+	// C reproducers are built on the host once and then copied to VMs,
+	// everything else is treated as a log with programs for syz-execprog.
+	isC := strings.HasSuffix(input, ".c")
+	// Reproducers (repro.prog) carry their own execution options, syz-execprog uses them.
+	reproOpts := false
+	if !isC {
+		data, err := ioutil.ReadFile(input)
+		if err != nil {
+			Fatalf("failed to read input: %v", err)
+		}
+		_, _, err = csource.ParseRepro(data)
+		reproOpts = err == nil
 	}
+	if isC {
+		bin, err := csource.Build("c", input)
+		if err != nil {
+			Fatalf("%v", err)
+		}
+		defer os.Remove(bin)
+		input = bin
+	}
+	st := &stats{titles: make(map[string]int)}
 
 	Logf(0, "booting test machines...")
 	var shutdown uint32
@@ -57,7 +136,16 @@ func main() {
 				if err != nil {
 					Fatalf("failed to create VM config: %v", err)
 				}
-				runInstance(cfg, vmCfg)
+				desc, crashed, err := runInstance(cfg, vmCfg, input, isC, reproOpts)
+				if atomic.LoadUint32(&shutdown) != 0 {
+					break
+				}
+				if err != nil {
+					Logf(0, "%v: %v", vmCfg.Name, err)
+					continue
+				}
+				st.add(desc, crashed)
+				Logf(0, "crushed %v", st)
 				if atomic.LoadUint32(&shutdown) != 0 {
 					break
 				}
@@ -78,58 +166,68 @@ func main() {
 		Fatalf("terminating")
 	}()
 	wg.Wait()
+	Logf(0, "crushed %v", st)
 }
 
-func runInstance(cfg *config.Config, vmCfg *vm.Config) {
+// runInstance replays the input on a new VM until it crashes or restart_time passes,
+// returns the crash title and whether it has crashed.
+func runInstance(cfg *config.Config, vmCfg *vm.Config, input string, isC, reproOpts bool) (string, bool, error) {
 	inst, err := vm.Create(cfg.Type, vmCfg)
 	if err != nil {
-		Logf(0, "failed to create instance: %v", err)
-		return
+		return "", false, fmt.Errorf("failed to create instance: %v", err)
 	}
 	defer inst.Close()
 
-	execprogBin, err := inst.Copy(filepath.Join(cfg.Syzkaller, "bin", "syz-execprog"))
-	if err != nil {
-		Logf(0, "failed to copy execprog: %v", err)
-		return
-	}
-	executorBin, err := inst.Copy(filepath.Join(cfg.Syzkaller, "bin", "syz-executor"))
-	if err != nil {
-		Logf(0, "failed to copy executor: %v", err)
-		return
-	}
-	logFile, err := inst.Copy(flag.Args()[0])
-	if err != nil {
-		Logf(0, "failed to copy log: %v", err)
-		return
+	var cmd string
+	if isC {
+		bin, err := inst.Copy(input)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to copy repro: %v", err)
+		}
+		cmd = bin
+	} else {
+		execprogBin, err := inst.Copy(config.TargetBin(cfg, "syz-execprog"))
+		if err != nil {
+			return "", false, fmt.Errorf("failed to copy execprog: %v", err)
+		}
+		executorBin, err := inst.Copy(config.TargetBin(cfg, "syz-executor"))
+		if err != nil {
+			return "", false, fmt.Errorf("failed to copy executor: %v", err)
+		}
+		logFile, err := inst.Copy(input)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to copy log: %v", err)
+		}
+		opts := fmt.Sprintf("-procs=%v -sandbox=%v", cfg.Procs, cfg.Sandbox)
+		if reproOpts {
+			opts = ""
+		}
+		cmd = fmt.Sprintf("%v -executor=%v -repeat=0 %v -cover=0 -trace=%v -pin_cpus=%v -low_priority=%v %v",
+			execprogBin, executorBin, opts, cfg.Trace, cfg.Pin_Cpus, cfg.Low_Priority, logFile)
 	}
-
-	cmd := fmt.Sprintf("%v -executor=%v -repeat=0 -procs=%v -cover=0 -sandbox=%v %v",
-		execprogBin, executorBin, cfg.Procs, cfg.Sandbox, logFile)
-	outc, errc, err := inst.Run(time.Hour, nil, cmd)
+	outc, errc, err := inst.Run(*flagRestart, nil, cmd)
 	if err != nil {
-		Logf(0, "failed to run execprog: %v", err)
-		return
+		return "", false, fmt.Errorf("failed to run %v: %v", cmd, err)
 	}
 
 	Logf(0, "%v: crushing...", vmCfg.Name)
-	desc, _, output, crashed, timedout := vm.MonitorExecution(outc, errc, cfg.Type == "local", true, cfg.ParsedIgnores)
+	desc, _, output, crashed, timedout := vm.MonitorExecution(inst, outc, errc, cfg.Type == "local", true, cfg.ParsedIgnores)
 	if timedout {
 		// This is the only "OK" outcome.
 		Logf(0, "%v: running long enough, restarting", vmCfg.Name)
-	} else {
-		if !crashed {
-			// syz-execprog exited, but it should not.
-			desc = "lost connection to test machine"
-		}
-		f, err := ioutil.TempFile(".", "syz-crush")
-		if err != nil {
-			Logf(0, "failed to create temp file: %v", err)
-			return
-		}
-		defer f.Close()
-		Logf(0, "%v: crashed: %v, saving to %v", vmCfg.Name, desc, f.Name())
-		f.Write(output)
+		return "", false, nil
+	}
+	if !crashed {
+		// The test program exited, but it should not.
+		desc = vm.LostConnectionTitle
+	}
+	f, err := ioutil.TempFile(".", "syz-crush")
+	if err != nil {
+		Logf(0, "failed to create temp file: %v", err)
+		return desc, true, nil
 	}
-	return
+	defer f.Close()
+	Logf(0, "%v: crashed: %v, saving to %v", vmCfg.Name, desc, f.Name())
+	f.Write(output)
+	return desc, true, nil
 }
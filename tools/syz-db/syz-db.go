@@ -0,0 +1,159 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-db manages packed corpus databases (see package db): packs a directory
+// of programs into a database, unpacks a database into a directory,
+// merges several databases and filters programs by syscalls.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/syzkaller/db"
+	"github.com/google/syzkaller/hash"
+	"github.com/google/syzkaller/prog"
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	switch args[0] {
+	case "pack":
+		if len(args) != 3 {
+			usage()
+		}
+		pack(args[1], args[2])
+	case "unpack":
+		if len(args) != 3 {
+			usage()
+		}
+		unpack(args[1], args[2])
+	case "merge":
+		if len(args) < 3 {
+			usage()
+		}
+		merge(args[1], args[2:])
+	case "filter":
+		if len(args) < 4 {
+			usage()
+		}
+		filter(args[1], args[2], args[3:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "  syz-db pack dir corpus.db\n")
+	fmt.Fprintf(os.Stderr, "  syz-db unpack corpus.db dir\n")
+	fmt.Fprintf(os.Stderr, "  syz-db merge corpus.db input.db...\n")
+	fmt.Fprintf(os.Stderr, "  syz-db filter input.db corpus.db syscall...\n")
+	os.Exit(1)
+}
+
+func pack(dir, file string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fatalf("failed to read dir: %v", err)
+	}
+	var progs [][]byte
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			fatalf("failed to read program: %v", err)
+		}
+		if _, err := prog.Deserialize(data); err != nil {
+			fatalf("failed to deserialize %v: %v", f.Name(), err)
+		}
+		progs = append(progs, data)
+	}
+	writeDB(file, progs)
+}
+
+func unpack(file, dir string) {
+	progs := readDB(file)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		fatalf("failed to create dir: %v", err)
+	}
+	for _, data := range progs {
+		sig := hash.Hash(data)
+		if err := ioutil.WriteFile(filepath.Join(dir, sig.String()), data, 0640); err != nil {
+			fatalf("failed to write program: %v", err)
+		}
+	}
+	fmt.Printf("unpacked %v programs\n", len(progs))
+}
+
+func merge(file string, inputs []string) {
+	var progs [][]byte
+	for _, input := range inputs {
+		progs = append(progs, readDB(input)...)
+	}
+	writeDB(file, progs)
+}
+
+// filter leaves only programs that contain at least one of the syscalls.
+// A syscall matches both by full name (e.g. "open$dir") and by name
+// of the kernel syscall (e.g. "open" matches all open variants).
+func filter(input, file string, syscalls []string) {
+	names := make(map[string]bool)
+	for _, name := range syscalls {
+		for _, name1 := range strings.Split(name, ",") {
+			if name1 != "" {
+				names[name1] = true
+			}
+		}
+	}
+	var progs [][]byte
+	for _, data := range readDB(input) {
+		p, err := prog.Deserialize(data)
+		if err != nil {
+			fatalf("failed to deserialize program: %v\n%s", err, data)
+		}
+		for _, c := range p.Calls {
+			if names[c.Meta.Name] || names[c.Meta.CallName] {
+				progs = append(progs, data)
+				break
+			}
+		}
+	}
+	writeDB(file, progs)
+}
+
+func readDB(file string) [][]byte {
+	progs, err := db.ReadFile(file)
+	if err != nil {
+		fatalf("failed to read corpus db %v: %v", file, err)
+	}
+	return progs
+}
+
+func writeDB(file string, progs [][]byte) {
+	if err := db.WriteFile(file, progs); err != nil {
+		fatalf("failed to write corpus db: %v", err)
+	}
+	// Write skips duplicates, so report the actual number of stored programs.
+	progs, err := db.ReadFile(file)
+	if err != nil {
+		fatalf("failed to read back corpus db: %v", err)
+	}
+	fmt.Printf("wrote %v programs to %v\n", len(progs), file)
+}
+
+func fatalf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,391 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-declextract generates draft syscall descriptions for a kernel subsystem
+// from debug info of a kernel build (vmlinux built with CONFIG_DEBUG_INFO=y).
+// Syscalls defined in the selected source files (SYSCALL_DEFINE) become calls,
+// structs, unions and enums used by their arguments are emitted as well,
+// and signatures of other functions matching -funcs are emitted as comments
+// (e.g. ioctl handlers, to be turned into ioctl$ calls). Pointer directions
+// and resources can't be inferred from debug info and are marked with TODO.
+// Usage:
+//
+//	syz-declextract -vmlinux=vmlinux -subsystem=fs/eventfd.c,fs/timerfd.c > sys/foo.txt
+package main
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	flagVmlinux   = flag.String("vmlinux", "vmlinux", "path to vmlinux built with CONFIG_DEBUG_INFO=y")
+	flagSubsystem = flag.String("subsystem", "", "comma-separated list of source files or dirs of the subsystem (e.g. net/packet/)")
+	flagFuncs     = flag.String("funcs", "", "regexp of names of non-syscall functions to emit signatures of")
+)
+
+// Prefixes of functions generated by SYSCALL_DEFINE that take arguments with their real types
+// (newer and older kernels).
+var syscallPrefixes = []string{"__do_sys_", "SYSC_"}
+
+type Func struct {
+	Name    string
+	Syscall bool
+	Params  []Param
+}
+
+type Param struct {
+	Name string
+	Typ  dwarf.Type
+}
+
+type generator struct {
+	buf     *bytes.Buffer
+	structs map[string]*dwarf.StructType
+	enums   map[string]*dwarf.EnumType
+	todo    bool // current call/struct needs a TODO marker
+}
+
+func main() {
+	flag.Parse()
+	if *flagSubsystem == "" {
+		failf("usage: syz-declextract -vmlinux=vmlinux -subsystem=dir/,file.c [-funcs=regexp]")
+	}
+	var funcsRe *regexp.Regexp
+	if *flagFuncs != "" {
+		var err error
+		if funcsRe, err = regexp.Compile(*flagFuncs); err != nil {
+			failf("bad funcs regexp: %v", err)
+		}
+	}
+	f, err := elf.Open(*flagVmlinux)
+	if err != nil {
+		failf("failed to open vmlinux: %v", err)
+	}
+	defer f.Close()
+	debug, err := f.DWARF()
+	if err != nil {
+		failf("failed to read debug info: %v", err)
+	}
+	funcs, err := readFuncs(debug, strings.Split(*flagSubsystem, ","), funcsRe)
+	if err != nil {
+		failf("failed to parse debug info: %v", err)
+	}
+	if len(funcs) == 0 {
+		failf("no syscalls or functions found in %v", *flagSubsystem)
+	}
+	os.Stdout.Write(generate(funcs))
+}
+
+// readFuncs returns syscalls and functions matching funcsRe defined in compilation units
+// with source files matching any of the prefixes.
+func readFuncs(debug *dwarf.Data, prefixes []string, funcsRe *regexp.Regexp) ([]*Func, error) {
+	var funcs []*Func
+	dups := make(map[string]bool)
+	r := debug.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		if !matchUnit(e, prefixes) {
+			r.SkipChildren()
+			continue
+		}
+		// Top-level entries of the unit.
+		for {
+			e, err := r.Next()
+			if err != nil {
+				return nil, err
+			}
+			if e == nil || e.Tag == 0 {
+				break
+			}
+			if decl, _ := e.Val(dwarf.AttrDeclaration).(bool); e.Tag != dwarf.TagSubprogram || !e.Children || decl {
+				r.SkipChildren()
+				continue
+			}
+			fn := parseFunc(e, funcsRe)
+			if fn == nil || dups[fn.Name] {
+				r.SkipChildren()
+				continue
+			}
+			if fn.Params, err = readParams(debug, r); err != nil {
+				return nil, err
+			}
+			dups[fn.Name] = true
+			funcs = append(funcs, fn)
+		}
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		if funcs[i].Syscall != funcs[j].Syscall {
+			return funcs[i].Syscall
+		}
+		return funcs[i].Name < funcs[j].Name
+	})
+	return funcs, nil
+}
+
+func matchUnit(e *dwarf.Entry, prefixes []string) bool {
+	name, _ := e.Val(dwarf.AttrName).(string)
+	dir, _ := e.Val(dwarf.AttrCompDir).(string)
+	name = strings.TrimPrefix(strings.TrimPrefix(name, dir), "/")
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFunc returns a function for syscall or matching subprogram entries, or nil.
+func parseFunc(e *dwarf.Entry, funcsRe *regexp.Regexp) *Func {
+	name, _ := e.Val(dwarf.AttrName).(string)
+	if name == "" {
+		return nil
+	}
+	for _, prefix := range syscallPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return &Func{Name: strings.TrimPrefix(name, prefix), Syscall: true}
+		}
+	}
+	if funcsRe != nil && funcsRe.MatchString(name) {
+		return &Func{Name: name}
+	}
+	return nil
+}
+
+// readParams reads formal parameters among children of the current subprogram entry.
+func readParams(debug *dwarf.Data, r *dwarf.Reader) ([]Param, error) {
+	var params []Param
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || e.Tag == 0 {
+			return params, nil
+		}
+		if e.Children {
+			r.SkipChildren()
+		}
+		if e.Tag != dwarf.TagFormalParameter {
+			continue
+		}
+		off, ok := e.Val(dwarf.AttrType).(dwarf.Offset)
+		if !ok {
+			continue
+		}
+		typ, err := debug.Type(off)
+		if err != nil {
+			return nil, err
+		}
+		name, _ := e.Val(dwarf.AttrName).(string)
+		if name == "" {
+			name = fmt.Sprintf("a%v", len(params))
+		}
+		params = append(params, Param{name, typ})
+	}
+}
+
+func generate(funcs []*Func) []byte {
+	g := &generator{
+		buf:     new(bytes.Buffer),
+		structs: make(map[string]*dwarf.StructType),
+		enums:   make(map[string]*dwarf.EnumType),
+	}
+	fmt.Fprintf(g.buf, "# Generated by syz-declextract, needs review.\n")
+	fmt.Fprintf(g.buf, "# TODO: add include directives for headers that define the constants.\n\n")
+	for _, fn := range funcs {
+		g.todo = false
+		var args []string
+		for _, p := range fn.Params {
+			args = append(args, fmt.Sprintf("%v %v", p.Name, g.argType(p.Name, p.Typ)))
+		}
+		if g.todo {
+			fmt.Fprintf(g.buf, "# TODO: pointer directions, resources.\n")
+		}
+		prefix := ""
+		if !fn.Syscall {
+			prefix = "# "
+		}
+		fmt.Fprintf(g.buf, "%v%v(%v)\n", prefix, fn.Name, strings.Join(args, ", "))
+	}
+	// Structs are emitted after calls, emitting a struct can add more structs.
+	done := make(map[string]bool)
+	for {
+		var names []string
+		for name := range g.structs {
+			if !done[name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			break
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			done[name] = true
+			g.emitStruct(name, g.structs[name])
+		}
+	}
+	var enums []string
+	for name := range g.enums {
+		enums = append(enums, name)
+	}
+	sort.Strings(enums)
+	for _, name := range enums {
+		var vals []string
+		for _, v := range g.enums[name].Val {
+			vals = append(vals, v.Name)
+		}
+		fmt.Fprintf(g.buf, "\n%v = %v\n", name, strings.Join(vals, ", "))
+	}
+	return g.buf.Bytes()
+}
+
+func (g *generator) emitStruct(name string, typ *dwarf.StructType) {
+	open, close := "{", "}"
+	if typ.Kind == "union" {
+		open, close = "[", "]"
+	}
+	fmt.Fprintf(g.buf, "\n%v %v\n", name, open)
+	for i, f := range typ.Field {
+		if f.BitSize != 0 {
+			// Bitfields sharing storage are emitted as a single field of the storage size.
+			if i != 0 && typ.Field[i-1].BitSize != 0 && typ.Field[i-1].ByteOffset == f.ByteOffset {
+				continue
+			}
+			fmt.Fprintf(g.buf, "# TODO: bitfields starting with %v.\n", f.Name)
+			fmt.Fprintf(g.buf, "\t%v\tint%v\n", f.Name, f.ByteSize*8)
+			continue
+		}
+		fname := f.Name
+		if fname == "" {
+			fname = fmt.Sprintf("f%v", i)
+		}
+		g.todo = false
+		ftyp := g.fieldType(name+"_"+fname, f.Type)
+		if g.todo {
+			fmt.Fprintf(g.buf, "# TODO: pointer direction, resource.\n")
+		}
+		fmt.Fprintf(g.buf, "\t%v\t%v\n", fname, ftyp)
+	}
+	fmt.Fprintf(g.buf, "%v\n", close)
+}
+
+// argType converts type of a syscall argument: integers are intptr, file descriptors are fd.
+func (g *generator) argType(name string, typ dwarf.Type) string {
+	switch t := unqualify(typ).(type) {
+	case *dwarf.PtrType:
+		return g.ptrType(name, t)
+	case *dwarf.EnumType:
+		return g.enumType(t)
+	case *dwarf.StructType:
+		return g.structType(name, t)
+	}
+	if strings.HasSuffix(name, "fd") {
+		g.todo = true
+		return "fd"
+	}
+	return "intptr"
+}
+
+// fieldType converts type of a struct field, integers have the size of the C type.
+func (g *generator) fieldType(name string, typ dwarf.Type) string {
+	switch t := unqualify(typ).(type) {
+	case *dwarf.PtrType:
+		return g.ptrType(name, t)
+	case *dwarf.EnumType:
+		return g.enumType(t)
+	case *dwarf.StructType:
+		return g.structType(name, t)
+	case *dwarf.ArrayType:
+		elem := g.fieldType(name, t.Type)
+		if t.Count <= 0 {
+			return fmt.Sprintf("array[%v]", elem)
+		}
+		return fmt.Sprintf("array[%v, %v]", elem, t.Count)
+	}
+	return intType(typ)
+}
+
+func (g *generator) ptrType(name string, t *dwarf.PtrType) string {
+	g.todo = true
+	dir := "inout"
+	if q, ok := t.Type.(*dwarf.QualType); ok && q.Qual == "const" {
+		dir = "in"
+	}
+	switch elem := unqualify(t.Type).(type) {
+	case *dwarf.VoidType:
+		return fmt.Sprintf("buffer[%v]", dir)
+	case *dwarf.FuncType:
+		return "intptr"
+	case *dwarf.CharType, *dwarf.UcharType:
+		return fmt.Sprintf("ptr[%v, string]", dir)
+	case *dwarf.StructType:
+		return fmt.Sprintf("ptr[%v, %v]", dir, g.structType(name, elem))
+	}
+	return fmt.Sprintf("ptr[%v, %v]", dir, g.fieldType(name, t.Type))
+}
+
+func (g *generator) structType(name string, t *dwarf.StructType) string {
+	if t.StructName != "" {
+		name = t.StructName
+	}
+	if t.Incomplete {
+		g.todo = true
+		return "array[int8]"
+	}
+	g.structs[name] = t
+	return name
+}
+
+func (g *generator) enumType(t *dwarf.EnumType) string {
+	if t.EnumName == "" {
+		return fmt.Sprintf("int%v", t.ByteSize*8)
+	}
+	g.enums[t.EnumName] = t
+	return fmt.Sprintf("flags[%v, int%v]", t.EnumName, t.ByteSize*8)
+}
+
+func intType(typ dwarf.Type) string {
+	switch size := typ.Size(); size {
+	case 1, 2, 4, 8:
+		return fmt.Sprintf("int%v", size*8)
+	}
+	return "array[int8]"
+}
+
+// unqualify strips typedefs, const and volatile.
+func unqualify(typ dwarf.Type) dwarf.Type {
+	for {
+		switch t := typ.(type) {
+		case *dwarf.TypedefType:
+			typ = t.Type
+		case *dwarf.QualType:
+			typ = t.Type
+		default:
+			return typ
+		}
+	}
+}
+
+func failf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
@@ -3,6 +3,8 @@
 
 // execprog executes a single program or a set of programs
 // and optinally prints information about execution.
+// Execution options saved in the header of reproducers (repro.prog) are used
+// unless the corresponding flags are given on the command line.
 package main
 
 import (
@@ -19,6 +21,8 @@ import (
 	"time"
 
 	"github.com/google/syzkaller/cover"
+	"github.com/google/syzkaller/csource"
+	"github.com/google/syzkaller/host"
 	"github.com/google/syzkaller/ipc"
 	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/prog"
@@ -26,10 +30,14 @@ import (
 
 var (
 	flagExecutor  = flag.String("executor", "./syz-executor", "path to executor binary")
-	flagCoverFile = flag.String("coverfile", "", "write coverage to the file")
+	flagCoverFile = flag.String("coverfile", "", "write coverage of each call to file.N")
+	flagCoverFmt  = flag.String("cover_format", "sancov", "format of coverage files: sancov/raw (one hex PC per line)")
 	flagRepeat    = flag.Int("repeat", 1, "repeat execution that many times (0 for infinite loop)")
 	flagProcs     = flag.Int("procs", 1, "number of parallel processes to execute programs")
 	flagOutput    = flag.String("output", "none", "write programs to none/stdout")
+	flagFaultCall = flag.Int("fault_call", -1, "inject fault into this call (0-based)")
+	flagFaultNth  = flag.Int("fault_nth", 0, "inject fault on n-th operation (0-based)")
+	flagErrnos    = flag.Bool("errnos", false, "print errnos of calls of every executed program (used by syz-verifier)")
 )
 
 func main() {
@@ -41,11 +49,19 @@ func main() {
 	}
 
 	var progs []*prog.Prog
+	reproOpts := false
 	for _, fn := range flag.Args() {
 		data, err := ioutil.ReadFile(fn)
 		if err != nil {
 			Fatalf("failed to read log file: %v", err)
 		}
+		if opts, _, err := csource.ParseRepro(data); err == nil && !reproOpts {
+			Logf(0, "using reproducer options of %v: %+v", fn, opts)
+			if err := opts.ApplyRepro(flag.CommandLine); err != nil {
+				Fatalf("%v", err)
+			}
+			reproOpts = true
+		}
 		entries := prog.ParseLog(data)
 		for _, ent := range entries {
 			progs = append(progs, ent.P)
@@ -61,9 +77,37 @@ func main() {
 		Fatalf("%v", err)
 	}
 	if *flagCoverFile != "" {
+		if *flagCoverFmt != "sancov" && *flagCoverFmt != "raw" {
+			Fatalf("flag cover_format must contain one of sancov/raw")
+		}
 		flags |= ipc.FlagCover
 		flags &= ^ipc.FlagDedupCover
 	}
+	faults := *flagFaultCall >= 0
+	for _, p := range progs {
+		if injectsFault(p) {
+			faults = true
+			break
+		}
+	}
+	if faults {
+		if !host.IsFaultInjectionSupported() {
+			Fatalf("programs inject faults, but fault injection is not supported by the kernel")
+		}
+		flags |= ipc.FlagEnableFault
+	}
+
+	// With -seccomp programs are allowed only the calls they use.
+	var seccompCalls []int
+	seen := make(map[int]bool)
+	for _, p := range progs {
+		for _, c := range p.Calls {
+			if !seen[c.Meta.ID] {
+				seen[c.Meta.ID] = true
+				seccompCalls = append(seccompCalls, c.Meta.ID)
+			}
+		}
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(*flagProcs)
@@ -71,15 +115,20 @@ func main() {
 	gate := ipc.NewGate(2**flagProcs, nil)
 	var pos int
 	var lastPrint time.Time
+	// maxCover is coverage of all executed programs,
+	// PCs that are not in it yet are reported as new signal.
+	var maxCover cover.Cover
+	var coverMu sync.Mutex
 	var shutdown uint32
 	for p := 0; p < *flagProcs; p++ {
 		pid := p
 		go func() {
 			defer wg.Done()
-			env, err := ipc.MakeEnv(*flagExecutor, timeout, flags, pid)
+			env, err := ipc.MakeEnv(*flagExecutor, timeout, flags, ipc.DefaultPolicy(), pid)
 			if err != nil {
 				Fatalf("failed to create ipc env: %v", err)
 			}
+			env.SeccompCalls = seccompCalls
 			defer env.Close()
 			for {
 				if !func() bool {
@@ -103,10 +152,14 @@ func main() {
 					case "stdout":
 						data := p.Serialize()
 						logMu.Lock()
-						Logf(0, "executing program %v:\n%s", pid, data)
+						Logf(0, "%s%s", prog.LogHeader(pid, time.Now()), data)
 						logMu.Unlock()
 					}
-					output, cov, _, failed, hanged, err := env.Exec(p)
+					exec := env.ExecFault
+					if *flagErrnos {
+						exec = env.ExecErrnos
+					}
+					output, cov, errnos, faultInjected, failed, hanged, err := exec(p, *flagFaultCall, *flagFaultNth)
 					if atomic.LoadUint32(&shutdown) != 0 {
 						return false
 					}
@@ -116,25 +169,37 @@ func main() {
 					if flags&ipc.FlagDebug != 0 || err != nil {
 						fmt.Printf("result: failed=%v hanged=%v err=%v\n\n%s", failed, hanged, err, output)
 					}
+					if *flagErrnos && err == nil {
+						// The format is parsed by syz-verifier.
+						buf := new(bytes.Buffer)
+						fmt.Fprintf(buf, "errnos: program #%v:", idx%len(progs))
+						for _, errno := range errnos {
+							fmt.Fprintf(buf, " %v", errno)
+						}
+						logMu.Lock()
+						fmt.Printf("%s\n", buf.Bytes())
+						logMu.Unlock()
+					}
+					if *flagFaultCall >= 0 {
+						fmt.Printf("fault injected into call #%v: %v\n", *flagFaultCall, faultInjected)
+					}
 					if *flagCoverFile != "" {
-						// Coverage is dumped in sanitizer format.
-						// github.com/google/sanitizers/tools/sancov command can be used to dump PCs,
-						// then they can be piped via addr2line to symbolize.
+						coverMu.Lock()
 						for i, c := range cov {
-							fmt.Printf("call #%v: coverage %v\n", i, len(c))
+							callCover := cover.Canonicalize(c)
+							signal := cover.Difference(callCover, maxCover)
+							maxCover = cover.Union(maxCover, callCover)
+							errno := 0
+							if i < len(errnos) {
+								errno = errnos[i]
+							}
+							fmt.Printf("call #%v: signal %v, coverage %v, errno %v\n", i, len(signal), len(c), errno)
 							if len(c) == 0 {
 								continue
 							}
-							buf := new(bytes.Buffer)
-							binary.Write(buf, binary.LittleEndian, uint64(0xC0BFFFFFFFFFFF64))
-							for _, pc := range c {
-								binary.Write(buf, binary.LittleEndian, cover.RestorePC(pc, 0xffffffff))
-							}
-							err := ioutil.WriteFile(fmt.Sprintf("%v.%v", *flagCoverFile, i), buf.Bytes(), 0660)
-							if err != nil {
-								Fatalf("failed to write coverage file: %v", err)
-							}
+							writeCoverFile(fmt.Sprintf("%v.%v", *flagCoverFile, i), c)
 						}
+						coverMu.Unlock()
 					}
 					return true
 				}() {
@@ -156,3 +221,33 @@ func main() {
 
 	wg.Wait()
 }
+
+func writeCoverFile(fn string, cov []uint32) {
+	buf := new(bytes.Buffer)
+	switch *flagCoverFmt {
+	case "sancov":
+		// github.com/google/sanitizers/tools/sancov command can be used to dump PCs,
+		// then they can be piped via addr2line to symbolize.
+		binary.Write(buf, binary.LittleEndian, uint64(0xC0BFFFFFFFFFFF64))
+		for _, pc := range cov {
+			binary.Write(buf, binary.LittleEndian, cover.RestorePC(pc, 0xffffffff))
+		}
+	case "raw":
+		// Raw PCs can be piped directly to addr2line.
+		for _, pc := range cov {
+			fmt.Fprintf(buf, "0x%x\n", cover.RestorePC(pc, 0xffffffff))
+		}
+	}
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0660); err != nil {
+		Fatalf("failed to write coverage file: %v", err)
+	}
+}
+
+func injectsFault(p *prog.Prog) bool {
+	for _, c := range p.Calls {
+		if c.FailNth != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-federation polls several syz-manager instances (e.g. one per kernel branch or device type)
+// and serves a combined dashboard: stats of all managers and their totals, crashes deduplicated
+// across managers by description and compared across kernels (managers with the same tag
+// config param fuzz the same kernel, managers without a tag are kernels of their own).
+// Managers are polled on /api/summary of their web UI.
+// Usage:
+//
+//	syz-federation -config=federation.cfg
+//
+// The config is a JSON file:
+//
+//	{
+//		"http": "localhost:56700",
+//		"poll_period": 60,
+//		"managers": [
+//			{"addr": "http://10.0.0.1:56741"},
+//			{"name": "arm64", "addr": "https://10.0.0.2:56741", "tls_cert": "arm64.pem", "auth_token": "secret"}
+//		]
+//	}
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	. "github.com/google/syzkaller/rpctype"
+)
+
+var flagConfig = flag.String("config", "", "config file")
+
+type Config struct {
+	Http        string
+	Poll_Period int // seconds between polls of managers (default: 60)
+	Managers    []ManagerConfig
+}
+
+type ManagerConfig struct {
+	Name       string // name on the dashboard (default: name reported by the manager)
+	Addr       string // base URL of the manager web UI
+	Tls_Cert   string // tls_cert of the manager to pin for https:// addr (e.g. self-signed, optional)
+	Auth_Token string // auth_token of the manager (if set)
+}
+
+type Federation struct {
+	mu       sync.Mutex
+	managers []*managerState
+}
+
+type managerState struct {
+	cfg     ManagerConfig
+	client  *http.Client
+	summary *ManagerSummary // the last polled summary, nil if none was polled yet
+	polled  time.Time       // time of the last successful poll
+	err     error           // error of the last poll, the last summary is still shown
+}
+
+func main() {
+	flag.Parse()
+	cfg := readConfig(*flagConfig)
+	EnableLogCaching(1000, 1<<20)
+	fed := new(Federation)
+	for _, mcfg := range cfg.Managers {
+		mgr, err := newManagerState(mcfg)
+		if err != nil {
+			Fatalf("manager %v: %v", mcfg.Addr, err)
+		}
+		fed.managers = append(fed.managers, mgr)
+	}
+	fed.initHttp(cfg.Http)
+	for {
+		fed.pollAll()
+		time.Sleep(time.Duration(cfg.Poll_Period) * time.Second)
+	}
+}
+
+func readConfig(filename string) *Config {
+	if filename == "" {
+		Fatalf("supply config in -config flag")
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		Fatalf("failed to read config file: %v", err)
+	}
+	cfg := &Config{
+		Poll_Period: 60,
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		Fatalf("failed to parse config file: %v", err)
+	}
+	if cfg.Http == "" {
+		Fatalf("config param http is empty")
+	}
+	if cfg.Poll_Period <= 0 {
+		Fatalf("config param poll_period must be positive")
+	}
+	if len(cfg.Managers) == 0 {
+		Fatalf("no managers in config")
+	}
+	for i, mcfg := range cfg.Managers {
+		if !strings.HasPrefix(mcfg.Addr, "http://") && !strings.HasPrefix(mcfg.Addr, "https://") {
+			Fatalf("bad addr %q of manager #%v, want http://host:port or https://host:port", mcfg.Addr, i)
+		}
+		if mcfg.Tls_Cert != "" && !strings.HasPrefix(mcfg.Addr, "https://") {
+			Fatalf("manager #%v has tls_cert, but its addr %q is not https://", i, mcfg.Addr)
+		}
+		cfg.Managers[i].Addr = strings.TrimSuffix(mcfg.Addr, "/")
+	}
+	return cfg
+}
+
+// newManagerState creates a manager with an http client that pins tls_cert of the manager (if set).
+func newManagerState(cfg ManagerConfig) (*managerState, error) {
+	client := &http.Client{Timeout: time.Minute}
+	if cfg.Tls_Cert != "" {
+		tlsConfig, err := PinnedTLSConfig(cfg.Tls_Cert)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return &managerState{cfg: cfg, client: client}, nil
+}
+
+// pollAll polls all managers concurrently, so that a hanging manager does not delay the others.
+func (fed *Federation) pollAll() {
+	var wg sync.WaitGroup
+	for _, mgr := range fed.managers {
+		wg.Add(1)
+		go func(mgr *managerState) {
+			defer wg.Done()
+			summary, err := mgr.poll()
+			fed.mu.Lock()
+			defer fed.mu.Unlock()
+			mgr.err = err
+			if err != nil {
+				Logf(0, "failed to poll manager %v: %v", mgr.cfg.Addr, err)
+				return
+			}
+			mgr.summary = summary
+			mgr.polled = time.Now()
+		}(mgr)
+	}
+	wg.Wait()
+}
+
+// poll fetches /api/summary of the manager, it does not touch fields protected by fed.mu.
+func (mgr *managerState) poll() (*ManagerSummary, error) {
+	cfg := mgr.cfg
+	req, err := http.NewRequest("GET", cfg.Addr+"/api/summary", nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Auth_Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Auth_Token)
+	}
+	resp, err := mgr.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %v: %s", resp.Status, body)
+	}
+	summary := new(ManagerSummary)
+	if err := json.NewDecoder(resp.Body).Decode(summary); err != nil {
+		return nil, fmt.Errorf("failed to parse summary: %v", err)
+	}
+	return summary, nil
+}
+
+// name returns the name of the manager on the dashboard.
+func (mgr *managerState) name() string {
+	if mgr.cfg.Name != "" {
+		return mgr.cfg.Name
+	}
+	if mgr.summary != nil && mgr.summary.Name != "" {
+		return mgr.summary.Name
+	}
+	return mgr.cfg.Addr
+}
+
+// kernel returns the kernel the manager fuzzes: its tag, or its name if it has no tag.
+func (mgr *managerState) kernel() string {
+	if mgr.summary != nil && mgr.summary.Tag != "" {
+		return mgr.summary.Tag
+	}
+	return mgr.name()
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/google/syzkaller/rpctype"
+)
+
+func TestPollPinnedTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/summary" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&ManagerSummary{Name: "test"})
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "syz-federation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	certData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.TLS.Certificates[0].Certificate[0]})
+	if err := ioutil.WriteFile(certFile, certData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mgr, err := newManagerState(ManagerConfig{Addr: srv.URL, Tls_Cert: certFile, Auth_Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := mgr.poll()
+	if err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if summary.Name != "test" {
+		t.Fatalf("got summary of %q, want %q", summary.Name, "test")
+	}
+
+	mgr, err = newManagerState(ManagerConfig{Addr: srv.URL, Tls_Cert: certFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.poll(); err == nil {
+		t.Fatalf("polled without auth token")
+	}
+
+	// The self-signed certificate is not accepted without pinning.
+	mgr, err = newManagerState(ManagerConfig{Addr: srv.URL, Auth_Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.poll(); err == nil {
+		t.Fatalf("polled with unverified certificate")
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/report"
+)
+
+const dateFormat = "Jan 02 2006 15:04:05 MST"
+
+// triagedRank orders crash triage states of managers, the best one is shown for a crash.
+var triagedRank = map[string]int{
+	"non-reproducible": 1,
+	"has repro":        2,
+	"has C repro":      3,
+}
+
+func (fed *Federation) initHttp(addr string) {
+	http.HandleFunc("/", fed.httpSummary)
+
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		Fatalf("failed to listen on %v: %v", addr, err)
+	}
+	Logf(0, "serving http on http://%v", ln.Addr())
+	go func() {
+		err := http.Serve(ln, nil)
+		Fatalf("failed to serve http: %v", err)
+	}()
+}
+
+func (fed *Federation) httpSummary(w http.ResponseWriter, r *http.Request) {
+	fed.mu.Lock()
+	data := fed.aggregate()
+	fed.mu.Unlock()
+	data.Log = CachedLogOutput()
+	if err := summaryTemplate.Execute(w, data); err != nil {
+		Logf(0, "failed to execute template: %v", err)
+		http.Error(w, fmt.Sprintf("failed to execute template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// aggregate combines the last polled summaries of managers, requires fed.mu.
+func (fed *Federation) aggregate() *UISummaryData {
+	data := new(UISummaryData)
+	total := UIManager{Name: "total", Polled: true}
+	kernels := make(map[string]*UIKernel)
+	crashes := make(map[string]*UICrash)
+	crashKernels := make(map[string]map[string]int) // crash -> kernel -> count
+	for _, mgr := range fed.managers {
+		m := UIManager{
+			Name: mgr.name(),
+			Addr: mgr.cfg.Addr,
+		}
+		switch {
+		case mgr.err != nil && mgr.summary != nil:
+			m.Status = fmt.Sprintf("%v (stats of %v ago)", mgr.err, time.Since(mgr.polled)/time.Second*time.Second)
+		case mgr.err != nil:
+			m.Status = mgr.err.Error()
+		case mgr.summary == nil:
+			m.Status = "not polled yet"
+		default:
+			m.Status = "ok"
+		}
+		if mgr.summary == nil {
+			data.Managers = append(data.Managers, m)
+			continue
+		}
+		m.Tag = mgr.summary.Tag
+		m.Polled = true
+		m.fill(mgr.summary.Stats)
+		total.add(&m)
+		data.Managers = append(data.Managers, m)
+		kernel := kernels[mgr.kernel()]
+		if kernel == nil {
+			kernel = &UIKernel{Name: mgr.kernel()}
+			kernels[kernel.Name] = kernel
+		}
+		kernel.Managers++
+		kernel.ExecTotal += m.ExecTotal
+		kernel.ExecPerSec += m.ExecPerSec
+		for _, c := range mgr.summary.Crashes {
+			crash := crashes[c.Description]
+			if crash == nil {
+				crash = &UICrash{
+					Description: c.Description,
+					Type:        c.Type,
+					severity:    report.Severity(c.Severity),
+					Suppressed:  true,
+				}
+				crashes[c.Description] = crash
+				crashKernels[c.Description] = make(map[string]int)
+			}
+			crash.Count += c.Count
+			if c.Last.After(crash.last) {
+				crash.last = c.Last
+			}
+			if triagedRank[c.Triaged] > triagedRank[crash.Triaged] {
+				crash.Triaged = c.Triaged
+			}
+			crash.Suppressed = crash.Suppressed && c.Suppressed
+			crash.Managers = append(crash.Managers, UICrashManager{
+				Name:  m.Name,
+				Link:  fmt.Sprintf("%v/crash?id=%v", mgr.cfg.Addr, url.QueryEscape(c.ID)),
+				Count: c.Count,
+			})
+			crashKernels[c.Description][kernel.Name] += c.Count
+		}
+	}
+	for _, kernel := range kernels {
+		data.Kernels = append(data.Kernels, *kernel)
+	}
+	sort.Slice(data.Kernels, func(i, j int) bool { return data.Kernels[i].Name < data.Kernels[j].Name })
+	kernelIndex := make(map[string]int)
+	for i, kernel := range data.Kernels {
+		kernelIndex[kernel.Name] = i
+	}
+	for desc, crash := range crashes {
+		crash.Severity = crash.severity.String()
+		crash.LastTime = crash.last.Format(dateFormat)
+		crash.Kernels = make([]int, len(data.Kernels))
+		for kernel, n := range crashKernels[desc] {
+			crash.Kernels[kernelIndex[kernel]] = n
+		}
+		if len(crashKernels[desc]) == 1 {
+			for kernel := range crashKernels[desc] {
+				data.Kernels[kernelIndex[kernel]].Unique++
+			}
+		}
+		for kernel := range crashKernels[desc] {
+			data.Kernels[kernelIndex[kernel]].CrashTypes++
+		}
+		sort.Slice(crash.Managers, func(i, j int) bool { return crash.Managers[i].Name < crash.Managers[j].Name })
+		data.Crashes = append(data.Crashes, *crash)
+	}
+	total.CrashTypes = uint64(len(crashes))
+	data.Managers = append([]UIManager{total}, data.Managers...)
+	sort.Slice(data.Crashes, func(i, j int) bool {
+		ci, cj := &data.Crashes[i], &data.Crashes[j]
+		if ci.severity != cj.severity {
+			return ci.severity > cj.severity
+		}
+		return ci.last.After(cj.last)
+	})
+	return data
+}
+
+type UISummaryData struct {
+	Managers []UIManager // the first one is the total of all managers
+	Kernels  []UIKernel
+	Crashes  []UICrash
+	Log      string
+}
+
+type UIManager struct {
+	Name       string
+	Addr       string
+	Tag        string
+	Status     string
+	Polled     bool // stats are known
+	Uptime     time.Duration
+	VMs        uint64
+	Corpus     uint64
+	Cover      uint64
+	ExecTotal  uint64
+	ExecPerSec uint64
+	CrashTypes uint64
+}
+
+// fill sets stats of the manager from stats of its summary (see collectStats of syz-manager).
+func (m *UIManager) fill(stats map[string]uint64) {
+	m.Uptime = time.Duration(stats["uptime"]) * time.Second
+	m.VMs = stats["vms"]
+	m.Corpus = stats["corpus"]
+	m.Cover = stats["cover"]
+	m.ExecTotal = stats["exec total"]
+	m.ExecPerSec = stats["exec per sec"]
+	m.CrashTypes = stats["crash types"]
+}
+
+// add adds stats of m1 to the total m, crash types are counted separately (they are deduplicated).
+func (m *UIManager) add(m1 *UIManager) {
+	m.VMs += m1.VMs
+	m.ExecTotal += m1.ExecTotal
+	m.ExecPerSec += m1.ExecPerSec
+}
+
+type UIKernel struct {
+	Name       string
+	Managers   int
+	ExecTotal  uint64
+	ExecPerSec uint64
+	CrashTypes int
+	Unique     int // crash types seen only on this kernel
+}
+
+type UICrash struct {
+	Description string
+	Type        string
+	Severity    string
+	Count       int
+	LastTime    string
+	Triaged     string
+	Suppressed  bool  // on all managers
+	Kernels     []int // occurrences on every kernel of UISummaryData.Kernels
+	Managers    []UICrashManager
+
+	severity report.Severity
+	last     time.Time
+}
+
+type UICrashManager struct {
+	Name  string
+	Link  string
+	Count int
+}
+
+var summaryTemplate = template.Must(template.New("").Parse(strings.Replace(`
+<!doctype html>
+<html>
+<head>
+	<title>syz-federation</title>
+	{{STYLE}}
+</head>
+<body>
+<b>syz-federation</b>
+<br><br>
+
+<table>
+	<caption>Managers:</caption>
+	<tr>
+		<th>Name</th>
+		<th>Kernel tag</th>
+		<th>Status</th>
+		<th>Uptime</th>
+		<th>VMs</th>
+		<th>Corpus</th>
+		<th>Cover</th>
+		<th>Executed</th>
+		<th>Exec/sec</th>
+		<th>Crash types</th>
+	</tr>
+	{{range $m := $.Managers}}
+	<tr>
+		<td>{{if $m.Addr}}<a href="{{$m.Addr}}">{{$m.Name}}</a>{{else}}<b>{{$m.Name}}</b>{{end}}</td>
+		<td>{{$m.Tag}}</td>
+		<td>{{$m.Status}}</td>
+		{{if $m.Polled}}
+		<td>{{if $m.Addr}}{{$m.Uptime}}{{end}}</td>
+		<td>{{$m.VMs}}</td>
+		<td>{{if $m.Addr}}{{$m.Corpus}}{{end}}</td>
+		<td>{{if $m.Addr}}{{$m.Cover}}{{end}}</td>
+		<td>{{$m.ExecTotal}}</td>
+		<td>{{$m.ExecPerSec}}</td>
+		<td>{{$m.CrashTypes}}</td>
+		{{else}}
+		<td></td><td></td><td></td><td></td><td></td><td></td><td></td>
+		{{end}}
+	</tr>
+	{{end}}
+</table>
+<br><br>
+
+<table>
+	<caption>Kernels:</caption>
+	<tr>
+		<th>Kernel</th>
+		<th>Managers</th>
+		<th>Executed</th>
+		<th>Exec/sec</th>
+		<th>Crash types</th>
+		<th>Only on this kernel</th>
+	</tr>
+	{{range $k := $.Kernels}}
+	<tr>
+		<td>{{$k.Name}}</td>
+		<td>{{$k.Managers}}</td>
+		<td>{{$k.ExecTotal}}</td>
+		<td>{{$k.ExecPerSec}}</td>
+		<td>{{$k.CrashTypes}}</td>
+		<td>{{$k.Unique}}</td>
+	</tr>
+	{{end}}
+</table>
+<br><br>
+
+<table>
+	<caption>Crashes:</caption>
+	<tr>
+		<th>Description</th>
+		<th>Type</th>
+		<th>Count</th>
+		{{range $k := $.Kernels}}<th>{{$k.Name}}</th>{{end}}
+		<th>Last Time</th>
+		<th>Report</th>
+		<th>Managers</th>
+	</tr>
+	{{range $c := $.Crashes}}
+	<tr>
+		<td>{{$c.Description}}</td>
+		<td>{{$c.Type}} ({{$c.Severity}})</td>
+		<td>{{$c.Count}}</td>
+		{{range $n := $c.Kernels}}<td>{{if $n}}{{$n}}{{end}}</td>{{end}}
+		<td>{{$c.LastTime}}</td>
+		<td>{{$c.Triaged}}{{if $c.Suppressed}} suppressed{{end}}</td>
+		<td>{{range $i, $m := $c.Managers}}{{if $i}}, {{end}}<a href="{{$m.Link}}">{{$m.Name}}</a> ({{$m.Count}}){{end}}</td>
+	</tr>
+	{{end}}
+</table>
+<br><br>
+
+Log:
+<br>
+<textarea id="log_textarea" readonly rows="20">
+{{.Log}}
+</textarea>
+<script>
+	var textarea = document.getElementById("log_textarea");
+	textarea.scrollTop = textarea.scrollHeight;
+</script>
+
+</body></html>
+`, "{{STYLE}}", htmlStyle, -1)))
+
+const htmlStyle = `
+	<style type="text/css" media="screen">
+		table {
+			border-collapse:collapse;
+			border:1px solid;
+		}
+		table caption {
+			font-weight: bold;
+		}
+		table td {
+			border:1px solid;
+			padding: 3px;
+		}
+		table th {
+			border:1px solid;
+			padding: 3px;
+		}
+		textarea {
+			width:100%;
+		}
+	</style>
+`
@@ -0,0 +1,70 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-fmt formats description files (sys/*.txt) in canonical style.
+// By default formatted files are printed to stdout,
+// with -w they are rewritten in place, with -l only names of files
+// that are not formatted are printed (exit status is 1 if there are any).
+// Usage:
+//
+//	syz-fmt -w sys/*.txt
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/syzkaller/sysparser"
+)
+
+var (
+	flagWrite = flag.Bool("w", false, "write result to the source file instead of stdout")
+	flagList  = flag.Bool("l", false, "list files whose formatting differs from canonical")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: syz-fmt [flags] sys/file.txt...\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	unformatted := false
+	for _, file := range flag.Args() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			failf("failed to read file: %v", err)
+		}
+		formatted, err := sysparser.Format(data)
+		if err != nil {
+			failf("%v: %v", file, err)
+		}
+		changed := !bytes.Equal(data, formatted)
+		switch {
+		case *flagList:
+			if changed {
+				fmt.Println(file)
+				unformatted = true
+			}
+		case *flagWrite:
+			if changed {
+				if err := ioutil.WriteFile(file, formatted, 0640); err != nil {
+					failf("failed to write file: %v", err)
+				}
+			}
+		default:
+			os.Stdout.Write(formatted)
+		}
+	}
+	if unformatted {
+		os.Exit(1)
+	}
+}
+
+func failf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,327 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-imagegen builds small valid filesystem images with mkfs utilities
+// (using several sets of mkfs and mount options per filesystem) and emits them
+// as seed programs that mount the images with syz_mount_image, so that filesystem
+// fuzzing starts from valid images rather than from random bytes.
+// Images are passed to syz_mount_image as a sparse list of non-zero segments,
+// so only the few kilobytes of metadata that mkfs writes end up in programs.
+// Filesystems without the corresponding mkfs utility on the host are skipped.
+// Usage:
+//
+//	syz-imagegen -fs=ext4,vfat -corpus=images.db
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/syzkaller/db"
+	"github.com/google/syzkaller/prog"
+)
+
+var (
+	flagFS      = flag.String("fs", "", "comma-separated list of filesystems (all known by default)")
+	flagCorpus  = flag.String("corpus", "", "write programs to this corpus database instead of stdout")
+	flagMaxData = flag.Int("max_data", 256<<10, "skip images with more non-zero data than this")
+)
+
+// Filesystem describes how to create images of a filesystem.
+type Filesystem struct {
+	Name      string
+	Mkfs      string   // mkfs utility, the image file is appended to its arguments
+	Size      int      // image size
+	Variants  []string // sets of mkfs arguments
+	MountOpts []string // sets of mount options, each is used with each mkfs variant
+}
+
+var filesystems = []Filesystem{
+	{
+		Name:      "ext2",
+		Mkfs:      "mkfs.ext2 -F -q",
+		Size:      1 << 20,
+		Variants:  []string{"", "-b 1024 -O ^resize_inode", "-b 4096 -I 128 -N 32"},
+		MountOpts: []string{"", "errors=continue"},
+	},
+	{
+		Name:      "ext3",
+		Mkfs:      "mkfs.ext3 -F -q",
+		Size:      4 << 20,
+		Variants:  []string{"-J size=1", "-b 1024 -J size=1 -O dir_index"},
+		MountOpts: []string{"", "data=journal,errors=continue"},
+	},
+	{
+		Name: "ext4",
+		Mkfs: "mkfs.ext4 -F -q -E lazy_itable_init=1",
+		Size: 4 << 20,
+		Variants: []string{
+			"-O ^has_journal",
+			"-J size=1",
+			"-b 1024 -O ^has_journal,inline_data",
+			"-O ^has_journal,bigalloc -C 16384",
+			"-O ^has_journal,encrypt,quota",
+			"-O ^has_journal,^extent,^flex_bg,^64bit -I 128",
+			"-J size=1 -O metadata_csum,64bit",
+		},
+		MountOpts: []string{"", "errors=continue,nodelalloc", "noload,dioread_nolock"},
+	},
+	{
+		Name:      "vfat",
+		Mkfs:      "mkfs.vfat",
+		Size:      1 << 20,
+		Variants:  []string{"-F 12", "-F 16", "-F 12 -s 1 -S 512 -n SYZKALLER"},
+		MountOpts: []string{"", "utf8,shortname=mixed", "check=strict,uni_xlate"},
+	},
+	{
+		Name:      "msdos",
+		Mkfs:      "mkfs.msdos",
+		Size:      1 << 20,
+		Variants:  []string{"-F 12", "-F 16 -f 1"},
+		MountOpts: []string{"", "dots,nocase"},
+	},
+	{
+		Name:      "btrfs",
+		Mkfs:      "mkfs.btrfs -f -q",
+		Size:      120 << 20,
+		Variants:  []string{"", "--mixed", "-m single -d single -n 4096"},
+		MountOpts: []string{"", "nospace_cache,nodatasum"},
+	},
+	{
+		Name:      "xfs",
+		Mkfs:      "mkfs.xfs -f -q",
+		Size:      16 << 20,
+		Variants:  []string{"", "-m crc=0 -i size=256", "-b size=1024 -l size=2m"},
+		MountOpts: []string{"", "norecovery"},
+	},
+	{
+		Name:      "jfs",
+		Mkfs:      "mkfs.jfs -q",
+		Size:      16 << 20,
+		Variants:  []string{"", "-O"},
+		MountOpts: []string{"", "errors=continue"},
+	},
+	{
+		Name:      "minix",
+		Mkfs:      "mkfs.minix",
+		Size:      1 << 20,
+		Variants:  []string{"-1", "-2", "-3"},
+		MountOpts: []string{""},
+	},
+	{
+		Name:      "hfsplus",
+		Mkfs:      "mkfs.hfsplus",
+		Size:      1 << 20,
+		Variants:  []string{"", "-s"},
+		MountOpts: []string{"", "force"},
+	},
+	{
+		Name:      "f2fs",
+		Mkfs:      "mkfs.f2fs -f -q",
+		Size:      64 << 20,
+		Variants:  []string{"", "-O extra_attr,inode_checksum"},
+		MountOpts: []string{"", "disable_roll_forward"},
+	},
+	{
+		Name:      "ntfs",
+		Mkfs:      "mkntfs -F -Q -q",
+		Size:      4 << 20,
+		Variants:  []string{""},
+		MountOpts: []string{""},
+	},
+	{
+		Name:      "udf",
+		Mkfs:      "mkudffs",
+		Size:      1 << 20,
+		Variants:  []string{"", "--media-type=hd --udfrev=0x201"},
+		MountOpts: []string{"", "novrs"},
+	},
+}
+
+// Segments with fewer zero bytes between them are merged.
+const minZeroGap = 32
+
+// These limits are imposed by the executor (see syz_mount_image in executor/common.h)
+// and by the size of the executor input buffer (see ipc).
+const (
+	maxSegments = 4096
+	maxImage    = 129 << 20
+	execBufSize = 2 << 20
+)
+
+func main() {
+	flag.Parse()
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(*flagFS, ",") {
+		if name != "" {
+			enabled[name] = true
+		}
+	}
+	dir, err := ioutil.TempDir("", "syz-imagegen")
+	if err != nil {
+		fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var progs [][]byte
+	for _, fs := range filesystems {
+		if len(enabled) != 0 && !enabled[fs.Name] {
+			continue
+		}
+		delete(enabled, fs.Name)
+		mkfs := strings.Fields(fs.Mkfs)
+		if _, err := exec.LookPath(mkfs[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: skipping, %v is not found\n", fs.Name, mkfs[0])
+			continue
+		}
+		for _, variant := range fs.Variants {
+			image, err := createImage(dir, fs, variant)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v %q: %v\n", fs.Name, variant, err)
+				continue
+			}
+			segs := splitImage(image)
+			data := 0
+			for _, seg := range segs {
+				data += len(seg.Data)
+			}
+			fmt.Fprintf(os.Stderr, "%v %q: %v segments, %v bytes of data\n", fs.Name, variant, len(segs), data)
+			if data > *flagMaxData {
+				fmt.Fprintf(os.Stderr, "\tskipping, too much data\n")
+				continue
+			}
+			for _, opts := range fs.MountOpts {
+				p, err := imageProg(fs.Name, len(image), segs, opts)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "\t%v\n", err)
+					break
+				}
+				if *flagCorpus == "" {
+					fmt.Printf("# %v %v\n%s\n", fs.Name, variant, p)
+				}
+				progs = append(progs, p)
+			}
+		}
+	}
+	for name := range enabled {
+		fmt.Fprintf(os.Stderr, "unknown filesystem %v\n", name)
+	}
+	if *flagCorpus != "" {
+		if err := db.WriteFile(*flagCorpus, progs); err != nil {
+			fatalf("failed to write corpus db: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "wrote %v programs to %v\n", len(progs), *flagCorpus)
+	}
+}
+
+// createImage formats a sparse file of fs.Size with mkfs and returns its contents.
+func createImage(dir string, fs Filesystem, variant string) ([]byte, error) {
+	file := filepath.Join(dir, fs.Name+".img")
+	os.Remove(file)
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(int64(fs.Size))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	args := append(strings.Fields(fs.Mkfs), strings.Fields(variant)...)
+	args = append(args, file)
+	cmd := exec.Command(args[0], args[1:]...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%v failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// Segment is a non-zero part of an image.
+type Segment struct {
+	Offset int
+	Data   []byte
+}
+
+// splitImage returns non-zero segments of image, short zero gaps are kept inside of segments.
+// The gap is increased until the number of segments fits into the executor limit.
+func splitImage(image []byte) []Segment {
+	for gap := minZeroGap; ; gap *= 2 {
+		var segs []Segment
+		for i := 0; i < len(image); {
+			if image[i] == 0 {
+				i++
+				continue
+			}
+			start, end := i, i
+			for zeros := 0; i < len(image) && zeros < gap; i++ {
+				if image[i] != 0 {
+					end = i + 1
+					zeros = 0
+				} else {
+					zeros++
+				}
+			}
+			segs = append(segs, Segment{start, image[start:end]})
+		}
+		if len(segs) <= maxSegments {
+			return segs
+		}
+	}
+}
+
+// imageProg returns a program that mounts the image with the given mount options.
+// All data is laid out in the program data region: fs name, mount dir and options
+// in the first page, the segments array starting from the second page followed by segment data.
+func imageProg(fs string, size int, segs []Segment, opts string) ([]byte, error) {
+	if size > maxImage {
+		return nil, fmt.Errorf("image size %v exceeds the limit %v", size, maxImage)
+	}
+	const (
+		base     = 0x7f0000000000
+		pageSize = 4 << 10
+		segsAddr = base + pageSize
+		segSize  = 24
+	)
+	dataAddr := (segsAddr + len(segs)*segSize + pageSize - 1) &^ (pageSize - 1)
+	segsText := new(bytes.Buffer)
+	for i, seg := range segs {
+		if i != 0 {
+			segsText.WriteString(", ")
+		}
+		fmt.Fprintf(segsText, "{&%v=\"%x\", 0x%x, 0x%x}", addr(dataAddr), seg.Data, len(seg.Data), seg.Offset)
+		dataAddr = (dataAddr + len(seg.Data) + 7) &^ 7
+	}
+	mapped := (dataAddr - base + pageSize - 1) &^ (pageSize - 1)
+	text := fmt.Sprintf("mmap(&(0x%x/0x%x)=nil, (0x%x), 0x3, 0x32, 0xffffffffffffffff, 0x0)\n"+
+		"syz_mount_image(&%v=\"%x\", &%v=\"%x\", 0x%x, 0x%x, &%v=[%s], 0x0, &%v=\"%x\")\n",
+		base, mapped, mapped,
+		addr(base), fs+"\x00", addr(base+0x100), "./file0\x00", size, len(segs), addr(segsAddr), segsText.Bytes(),
+		addr(base+0x200), opts+"\x00")
+	p, err := prog.Deserialize([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize program: %v", err)
+	}
+	if _, err := p.SerializeForExecBuf(make([]byte, execBufSize), 0); err != nil {
+		return nil, fmt.Errorf("program is too large: %v", err)
+	}
+	return p.Serialize(), nil
+}
+
+// addr formats address as a page-aligned base with an offset, as expected by prog.Deserialize.
+func addr(a int) string {
+	const pageSize = 4 << 10
+	if off := a % pageSize; off != 0 {
+		return fmt.Sprintf("(0x%x+0x%x)", a-off, off)
+	}
+	return fmt.Sprintf("(0x%x)", a)
+}
+
+func fatalf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
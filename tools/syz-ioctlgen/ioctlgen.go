@@ -0,0 +1,294 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-ioctlgen generates skeleton syscall descriptions for a driver
+// from _IO/_IOR/_IOW/_IOWR definitions found in kernel headers.
+// The result is not meant to be used as is: it needs to be reviewed
+// and refined (flags, lengths, resources, proper open calls, etc).
+// Usage:
+//
+//	syz-ioctlgen -linux=$LINUX -name=foo -dev=/dev/foo include/uapi/linux/foo.h > sys/foo.txt
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	flagLinux = flag.String("linux", "", "path to linux kernel source checkout")
+	flagName  = flag.String("name", "", "driver name used for resource and call names")
+	flagDev   = flag.String("dev", "", "device file path (e.g. /dev/foo)")
+)
+
+type Ioctl struct {
+	Name string
+	Dir  string // "", "out", "in" or "inout"
+	Arg  string // C type of the argument
+}
+
+type Field struct {
+	Name    string
+	Typ     string
+	Comment string
+}
+
+type Struct struct {
+	Name   string
+	Union  bool
+	Fields []Field
+}
+
+var (
+	ioctlRe  = regexp.MustCompile(`^#\s*define\s+([A-Za-z0-9_]+)\s+_IO(R|W|WR)?\s*\(\s*[^,)]+(?:,\s*[^,)]+(?:,\s*([^)]+))?)?\)`)
+	structRe = regexp.MustCompile(`^(struct|union)\s+([A-Za-z0-9_]+)\s*{`)
+	fieldRe  = regexp.MustCompile(`^((?:const\s+|unsigned\s+|signed\s+|struct\s+|union\s+)*[A-Za-z0-9_]+)\s*(\*?)\s*([A-Za-z0-9_]+)\s*(?:\[\s*([A-Za-z0-9_]*)\s*\])?\s*;`)
+)
+
+func main() {
+	flag.Parse()
+	if *flagName == "" || len(flag.Args()) == 0 {
+		failf("usage: syz-ioctlgen -linux=/linux/checkout -name=foo [-dev=/dev/foo] header.h|dir...")
+	}
+	var files []string
+	for _, arg := range flag.Args() {
+		files = append(files, headerFiles(filepath.Join(*flagLinux, arg))...)
+	}
+	var ioctls []Ioctl
+	structs := make(map[string]*Struct)
+	var includes []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			failf("failed to read %v: %v", file, err)
+		}
+		ioctls1 := parseIoctls(data)
+		if len(ioctls1) != 0 {
+			includes = append(includes, includePath(file))
+		}
+		ioctls = append(ioctls, ioctls1...)
+		for _, str := range parseStructs(data) {
+			structs[str.Name] = str
+		}
+	}
+	if len(ioctls) == 0 {
+		failf("no ioctl definitions found")
+	}
+	os.Stdout.Write(generate(*flagName, *flagDev, includes, ioctls, structs))
+}
+
+// headerFiles returns path itself if it is a file,
+// or all .h files under path if it is a directory.
+func headerFiles(path string) []string {
+	var files []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == path && !info.IsDir() || !info.IsDir() && strings.HasSuffix(file, ".h") {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		failf("failed to walk %v: %v", path, err)
+	}
+	return files
+}
+
+// includePath returns path suitable for include directive (e.g. uapi/linux/foo.h).
+func includePath(file string) string {
+	rel, err := filepath.Rel(*flagLinux, file)
+	if err != nil {
+		return file
+	}
+	return strings.TrimPrefix(rel, "include/")
+}
+
+func parseIoctls(data []byte) []Ioctl {
+	var ioctls []Ioctl
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		m := ioctlRe.FindStringSubmatch(strings.TrimSpace(s.Text()))
+		if m == nil {
+			continue
+		}
+		ioctl := Ioctl{Name: m[1], Arg: strings.TrimSpace(m[3])}
+		switch m[2] {
+		case "R":
+			ioctl.Dir = "out"
+		case "W":
+			ioctl.Dir = "in"
+		case "WR":
+			ioctl.Dir = "inout"
+		}
+		ioctls = append(ioctls, ioctl)
+	}
+	return ioctls
+}
+
+func parseStructs(data []byte) []*Struct {
+	var structs []*Struct
+	var str *Struct
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		ln := strings.TrimSpace(s.Text())
+		if str == nil {
+			if m := structRe.FindStringSubmatch(ln); m != nil {
+				str = &Struct{Name: m[2], Union: m[1] == "union"}
+			}
+			continue
+		}
+		if strings.HasPrefix(ln, "}") {
+			structs = append(structs, str)
+			str = nil
+			continue
+		}
+		if m := fieldRe.FindStringSubmatch(ln); m != nil {
+			typ, ok := fieldType(m[1], m[2] != "", m[4])
+			fld := Field{Name: m[3], Typ: typ}
+			if !ok {
+				fld.Comment = "TODO: " + ln
+			}
+			str.Fields = append(str.Fields, fld)
+		}
+	}
+	return structs
+}
+
+var intTypes = map[string]string{
+	"char":               "int8",
+	"unsigned char":      "int8",
+	"signed char":        "int8",
+	"__u8":               "int8",
+	"__s8":               "int8",
+	"short":              "int16",
+	"unsigned short":     "int16",
+	"__u16":              "int16",
+	"__s16":              "int16",
+	"__le16":             "int16",
+	"__be16":             "int16",
+	"int":                "int32",
+	"unsigned":           "int32",
+	"unsigned int":       "int32",
+	"__u32":              "int32",
+	"__s32":              "int32",
+	"__le32":             "int32",
+	"__be32":             "int32",
+	"long":               "intptr",
+	"unsigned long":      "intptr",
+	"long long":          "int64",
+	"unsigned long long": "int64",
+	"__u64":              "int64",
+	"__s64":              "int64",
+	"__le64":             "int64",
+	"__be64":             "int64",
+	"__aligned_u64":      "int64",
+}
+
+// fieldType converts C type to syzkaller type. Types that can't be converted
+// are emitted as bytes and ok is set to false.
+func fieldType(ctyp string, ptr bool, arr string) (typ string, ok bool) {
+	ctyp = strings.TrimSpace(strings.TrimPrefix(ctyp, "const "))
+	switch {
+	case ptr:
+		typ = "buffer[inout]"
+	case intTypes[ctyp] != "":
+		typ = intTypes[ctyp]
+	case strings.HasPrefix(ctyp, "struct ") || strings.HasPrefix(ctyp, "union "):
+		typ = strings.Fields(ctyp)[1]
+	default:
+		return "array[int8]", false
+	}
+	if arr != "" {
+		typ = fmt.Sprintf("array[%v, %v]", typ, arr)
+	}
+	return typ, true
+}
+
+func generate(name, dev string, includes []string, ioctls []Ioctl, structs map[string]*Struct) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# Generated by syz-ioctlgen, needs review.\n\n")
+	for _, inc := range includes {
+		fmt.Fprintf(buf, "include <%v>\n", inc)
+	}
+	fd := "fd_" + name
+	fmt.Fprintf(buf, "\nresource %v[fd]\n\n", fd)
+	if dev == "" {
+		dev = "/dev/" + name
+	}
+	fmt.Fprintf(buf, "syz_open_dev$%v(dev ptr[in, string[\"%v\"]], id const[0], flags flags[open_flags]) %v\n\n", name, dev, fd)
+	used := make(map[string]bool)
+	for _, ioctl := range ioctls {
+		arg := ""
+		switch {
+		case ioctl.Dir == "":
+			arg = ", arg intptr"
+		case intTypes[ioctl.Arg] != "":
+			arg = fmt.Sprintf(", arg ptr[%v, %v]", ioctl.Dir, intTypes[ioctl.Arg])
+		case structs[structName(ioctl.Arg)] != nil:
+			str := structName(ioctl.Arg)
+			markUsed(str, structs, used)
+			arg = fmt.Sprintf(", arg ptr[%v, %v]", ioctl.Dir, str)
+		default:
+			arg = fmt.Sprintf(", arg buffer[%v]", ioctl.Dir)
+		}
+		fmt.Fprintf(buf, "ioctl$%v(fd %v, cmd const[%v]%v)\n", ioctl.Name, fd, ioctl.Name, arg)
+	}
+	var names []string
+	for str := range used {
+		names = append(names, str)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		str := structs[n]
+		open, close := "{", "}"
+		if str.Union {
+			open, close = "[", "]"
+		}
+		fmt.Fprintf(buf, "\n%v %v\n", str.Name, open)
+		for _, f := range str.Fields {
+			if f.Comment != "" {
+				fmt.Fprintf(buf, "# %v\n", f.Comment)
+			}
+			fmt.Fprintf(buf, "\t%v\t%v\n", f.Name, f.Typ)
+		}
+		fmt.Fprintf(buf, "%v\n", close)
+	}
+	return buf.Bytes()
+}
+
+// structName returns name of the struct/union for C type "struct foo", or "" for other types.
+func structName(ctyp string) string {
+	f := strings.Fields(ctyp)
+	if len(f) != 2 || f[0] != "struct" && f[0] != "union" {
+		return ""
+	}
+	return f[1]
+}
+
+// markUsed marks struct str and all structs it refers to as used.
+func markUsed(str string, structs map[string]*Struct, used map[string]bool) {
+	if used[str] || structs[str] == nil {
+		return
+	}
+	used[str] = true
+	for _, f := range structs[str].Fields {
+		typ := strings.TrimPrefix(f.Typ, "array[")
+		typ = strings.Split(strings.Split(typ, ",")[0], "]")[0]
+		markUsed(typ, structs, used)
+	}
+}
+
+func failf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testHeader = `
+#ifndef _UAPI_FOO_H
+#define _UAPI_FOO_H
+
+#include <linux/types.h>
+
+struct foo_info {
+	__u32 version;
+	char name[32];
+	struct foo_range range;
+	void *data;
+	float ratio;
+};
+
+struct foo_range {
+	__u64 start;
+	__u64 len;
+};
+
+union foo_unused {
+	__u32 a;
+};
+
+#define FOO_RESET		_IO('F', 0)
+#define FOO_GET_INFO		_IOR('F', 1, struct foo_info)
+#define FOO_SET_FLAGS		_IOW('F', 2, int)
+#define FOO_XFER		_IOWR('F', 3, struct foo_range)
+#define FOO_SET_BUF		_IOW('F', 4, struct foo_unknown)
+#define FOO_MAGIC		0xf00
+
+#endif
+`
+
+func TestParseIoctls(t *testing.T) {
+	got := parseIoctls([]byte(testHeader))
+	want := []Ioctl{
+		{Name: "FOO_RESET"},
+		{Name: "FOO_GET_INFO", Dir: "out", Arg: "struct foo_info"},
+		{Name: "FOO_SET_FLAGS", Dir: "in", Arg: "int"},
+		{Name: "FOO_XFER", Dir: "inout", Arg: "struct foo_range"},
+		{Name: "FOO_SET_BUF", Dir: "in", Arg: "struct foo_unknown"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got ioctls:\n%+v\nwant:\n%+v", got, want)
+	}
+}
+
+func TestParseStructs(t *testing.T) {
+	structs := parseStructs([]byte(testHeader))
+	if len(structs) != 3 {
+		t.Fatalf("got %v structs, want 3", len(structs))
+	}
+	want := &Struct{
+		Name: "foo_info",
+		Fields: []Field{
+			{Name: "version", Typ: "int32"},
+			{Name: "name", Typ: "array[int8, 32]"},
+			{Name: "range", Typ: "foo_range"},
+			{Name: "data", Typ: "buffer[inout]"},
+			{Name: "ratio", Typ: "array[int8]", Comment: "TODO: float ratio;"},
+		},
+	}
+	if !reflect.DeepEqual(structs[0], want) {
+		t.Fatalf("got struct:\n%+v\nwant:\n%+v", structs[0], want)
+	}
+	if !structs[2].Union {
+		t.Fatalf("union %v is parsed as struct", structs[2].Name)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	data := []byte(testHeader)
+	structs := make(map[string]*Struct)
+	for _, str := range parseStructs(data) {
+		structs[str.Name] = str
+	}
+	out := string(generate("foo", "", []string{"uapi/linux/foo.h"}, parseIoctls(data), structs))
+	for _, line := range []string{
+		"include <uapi/linux/foo.h>",
+		"resource fd_foo[fd]",
+		`syz_open_dev$foo(dev ptr[in, string["/dev/foo"]], id const[0], flags flags[open_flags]) fd_foo`,
+		"ioctl$FOO_RESET(fd fd_foo, cmd const[FOO_RESET], arg intptr)",
+		"ioctl$FOO_GET_INFO(fd fd_foo, cmd const[FOO_GET_INFO], arg ptr[out, foo_info])",
+		"ioctl$FOO_SET_FLAGS(fd fd_foo, cmd const[FOO_SET_FLAGS], arg ptr[in, int32])",
+		"ioctl$FOO_XFER(fd fd_foo, cmd const[FOO_XFER], arg ptr[inout, foo_range])",
+		"ioctl$FOO_SET_BUF(fd fd_foo, cmd const[FOO_SET_BUF], arg buffer[in])",
+		"foo_info {",
+		"foo_range {",
+		"# TODO: float ratio;",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("output does not contain %q", line)
+		}
+	}
+	// Structs that are not referenced by ioctls are not emitted.
+	if strings.Contains(out, "foo_unused") {
+		t.Errorf("output contains unused union")
+	}
+	if t.Failed() {
+		t.Logf("output:\n%s", out)
+	}
+}
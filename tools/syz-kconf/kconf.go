@@ -0,0 +1,318 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-kconf generates kernel configs suitable for fuzzing. It merges a base config
+// (e.g. defconfig) with options of the selected profiles (sanitizers, coverage,
+// fault injection, etc) and options required by the selected descriptions
+// (drivers and subsystems that the calls need to be of any use).
+// Options that kconfig can't enable (e.g. because of unmet dependencies) are silently
+// dropped by make olddefconfig, so after the kernel is built the final config should be
+// checked with -verify, which reports requested options that did not take effect.
+// Usage:
+//
+//	syz-kconf -base=defconfig -profiles=kasan,kcov,debug -descriptions=kvm,tun -o=.config
+//	make olddefconfig && make
+//	syz-kconf -verify=.config -profiles=kasan,kcov,debug -descriptions=kvm,tun
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	flagBase         = flag.String("base", "", "base kernel config")
+	flagOut          = flag.String("o", "", "write merged config to this file instead of stdout")
+	flagProfiles     = flag.String("profiles", "kasan,kcov,debug", "comma-separated list of profiles")
+	flagDescriptions = flag.String("descriptions", "", "comma-separated list of descriptions (all in -sys by default)")
+	flagSys          = flag.String("sys", "sys", "path to sys dir with descriptions")
+	flagVerify       = flag.String("verify", "", "check that this config (of a built kernel) contains all requested options")
+)
+
+// Options are CONFIG_ names without the prefix mapped to values, "n" means "is not set".
+type Options map[string]string
+
+// profiles are sets of options for fuzzing.
+var profiles = map[string]Options{
+	"kcov": {
+		"KCOV":                "y",
+		"KCOV_INSTRUMENT_ALL": "y",
+		"DEBUG_FS":            "y",
+	},
+	"kasan": {
+		"KASAN":        "y",
+		"KASAN_INLINE": "y",
+	},
+	"ubsan": {
+		"UBSAN": "y",
+	},
+	// Debug info is needed for symbolization of reports and coverage.
+	"debug": {
+		"DEBUG_INFO":             "y",
+		"KALLSYMS":               "y",
+		"KALLSYMS_ALL":           "y",
+		"PROVE_LOCKING":          "y",
+		"DEBUG_ATOMIC_SLEEP":     "y",
+		"DEBUG_VM":               "y",
+		"DEBUG_LIST":             "y",
+		"DETECT_HUNG_TASK":       "y",
+		"LOCKUP_DETECTOR":        "y",
+		"RANDOMIZE_BASE":         "n",
+		"PANIC_ON_OOPS":          "n",
+		"BUG_ON_DATA_CORRUPTION": "y",
+	},
+	// Fault injection for the fault_call option of the fuzzer.
+	"fault": {
+		"FAULT_INJECTION":          "y",
+		"FAILSLAB":                 "y",
+		"FAIL_PAGE_ALLOC":          "y",
+		"FAULT_INJECTION_DEBUG_FS": "y",
+	},
+	// Namespace sandbox.
+	"namespace": {
+		"NAMESPACES": "y",
+		"UTS_NS":     "y",
+		"USER_NS":    "y",
+		"PID_NS":     "y",
+		"NET_NS":     "y",
+	},
+	"seccomp": {
+		"SECCOMP":        "y",
+		"SECCOMP_FILTER": "y",
+	},
+}
+
+// descriptions maps description files (without .txt) to options they need.
+// Descriptions that are not here don't need anything beyond defconfig.
+var descriptions = map[string]Options{
+	"bpf":        {"BPF_SYSCALL": "y"},
+	"cgroup":     {"CGROUPS": "y", "MEMCG": "y", "CGROUP_PIDS": "y"},
+	"dri":        {"DRM": "y", "DRM_VGEM": "y"},
+	"fuse":       {"FUSE_FS": "y"},
+	"ieee80211":  {"CFG80211": "y", "MAC80211": "y", "MAC80211_HWSIM": "y"},
+	"input":      {"INPUT_EVDEV": "y", "INPUT_MOUSEDEV": "y", "INPUT_UINPUT": "y"},
+	"kcm":        {"AF_KCM": "y"},
+	"key":        {"KEYS": "y", "KEY_DH_OPERATIONS": "y"},
+	"kvm":        {"VIRTUALIZATION": "y", "KVM": "y"},
+	"netrom":     {"HAMRADIO": "y", "AX25": "y", "NETROM": "y"},
+	"nl80211":    {"CFG80211": "y", "MAC80211": "y", "MAC80211_HWSIM": "y"},
+	"perf":       {"PERF_EVENTS": "y"},
+	"sctp":       {"IP_SCTP": "y"},
+	"sndcontrol": {"SOUND": "y", "SND": "y", "SND_DUMMY": "y"},
+	"sndseq":     {"SOUND": "y", "SND": "y", "SND_SEQUENCER": "y", "SND_SEQ_DUMMY": "y"},
+	"sndtimer":   {"SOUND": "y", "SND": "y", "SND_TIMER": "y", "SND_HRTIMER": "y"},
+	"socket":     {"UNIX": "y", "INET": "y", "IPV6": "y", "PACKET": "y"},
+	"tty":        {"VT": "y", "UNIX98_PTYS": "y"},
+	"tun":        {"TUN": "y"},
+	"usb":        {"USB": "y", "USB_MON": "y"},
+	"vnet":       {"VHOST_NET": "y"},
+}
+
+func main() {
+	flag.Parse()
+	required, err := requiredOptions()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *flagVerify != "" {
+		cfg, err := readConfig(*flagVerify)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		missing := verify(cfg, required)
+		for _, m := range missing {
+			fmt.Printf("%v\n", m)
+		}
+		if len(missing) != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	var base *Config
+	if *flagBase != "" {
+		if base, err = readConfig(*flagBase); err != nil {
+			fatalf("%v", err)
+		}
+	} else {
+		base = new(Config)
+	}
+	base.Merge(required)
+	data := base.Serialize()
+	if *flagOut == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := ioutil.WriteFile(*flagOut, data, 0640); err != nil {
+		fatalf("failed to write config: %v", err)
+	}
+}
+
+// requiredOptions returns options of the selected profiles and descriptions.
+func requiredOptions() (Options, error) {
+	required := make(Options)
+	add := func(opts Options, what string) error {
+		for name, val := range opts {
+			if old, ok := required[name]; ok && old != val {
+				return fmt.Errorf("%v: CONFIG_%v=%v conflicts with CONFIG_%v=%v", what, name, val, name, old)
+			}
+			required[name] = val
+		}
+		return nil
+	}
+	for _, name := range splitList(*flagProfiles) {
+		opts, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %v", name)
+		}
+		if err := add(opts, "profile "+name); err != nil {
+			return nil, err
+		}
+	}
+	descs := splitList(*flagDescriptions)
+	if len(descs) == 0 {
+		files, err := filepath.Glob(filepath.Join(*flagSys, "*.txt"))
+		if err != nil || len(files) == 0 {
+			return nil, fmt.Errorf("no descriptions in %v", *flagSys)
+		}
+		for _, f := range files {
+			descs = append(descs, strings.TrimSuffix(filepath.Base(f), ".txt"))
+		}
+	}
+	for _, name := range descs {
+		if _, err := os.Stat(filepath.Join(*flagSys, name+".txt")); err != nil {
+			return nil, fmt.Errorf("unknown description %v", name)
+		}
+		if err := add(descriptions[name], "description "+name); err != nil {
+			return nil, err
+		}
+	}
+	return required, nil
+}
+
+// verify returns requested options that don't have the requested values in cfg.
+func verify(cfg *Config, required Options) []string {
+	var missing []string
+	for name, val := range required {
+		if have := cfg.Value(name); have != val {
+			missing = append(missing, fmt.Sprintf("CONFIG_%v=%v is requested, but is %v", name, val, have))
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Config is a kernel config, the order of options and comments is preserved.
+type Config struct {
+	lines []string
+	index map[string]int // option name -> line
+}
+
+func readConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	cfg := new(Config)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		cfg.lines = append(cfg.lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	return cfg, nil
+}
+
+// parseLine returns option name and value of a config line,
+// both "CONFIG_FOO=y" and "# CONFIG_FOO is not set" lines are recognized.
+func parseLine(ln string) (string, string, bool) {
+	if strings.HasPrefix(ln, "# CONFIG_") && strings.HasSuffix(ln, " is not set") {
+		return strings.TrimSuffix(strings.TrimPrefix(ln, "# CONFIG_"), " is not set"), "n", true
+	}
+	if strings.HasPrefix(ln, "CONFIG_") {
+		if eq := strings.IndexByte(ln, '='); eq != -1 {
+			return ln[len("CONFIG_"):eq], ln[eq+1:], true
+		}
+	}
+	return "", "", false
+}
+
+func formatLine(name, val string) string {
+	if val == "n" {
+		return fmt.Sprintf("# CONFIG_%v is not set", name)
+	}
+	return fmt.Sprintf("CONFIG_%v=%v", name, val)
+}
+
+func (cfg *Config) buildIndex() {
+	cfg.index = make(map[string]int)
+	for i, ln := range cfg.lines {
+		if name, _, ok := parseLine(ln); ok {
+			cfg.index[name] = i
+		}
+	}
+}
+
+// Value returns value of the option, options that are not present are "n".
+func (cfg *Config) Value(name string) string {
+	if cfg.index == nil {
+		cfg.buildIndex()
+	}
+	if i, ok := cfg.index[name]; ok {
+		_, val, _ := parseLine(cfg.lines[i])
+		return val
+	}
+	return "n"
+}
+
+// Merge sets the options, existing options are changed in place, new ones are appended.
+func (cfg *Config) Merge(opts Options) {
+	if cfg.index == nil {
+		cfg.buildIndex()
+	}
+	var names []string
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ln := formatLine(name, opts[name])
+		if i, ok := cfg.index[name]; ok {
+			cfg.lines[i] = ln
+			continue
+		}
+		cfg.index[name] = len(cfg.lines)
+		cfg.lines = append(cfg.lines, ln)
+	}
+}
+
+func (cfg *Config) Serialize() []byte {
+	buf := new(bytes.Buffer)
+	for _, ln := range cfg.lines {
+		buf.WriteString(ln)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func fatalf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-make builds binaries that run on the target (syz-fuzzer, syz-execprog, syz-executor)
+// for the target OS/arch of a manager config, so that a host of one arch can fuzz kernels
+// of another arch. The C++ compiler and sysroot for syz-executor are taken from target_cc
+// and target_sysroot config params. Binaries for a target other than the host are placed
+// into bin/<target_os>_<target_arch>, where syz-manager and tools look for them.
+// Usage:
+//
+//	syz-make -config=manager.cfg [make targets, by default: fuzzer execprog executor]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/syzkaller/config"
+	. "github.com/google/syzkaller/log"
+)
+
+var (
+	flagConfig = flag.String("config", "", "manager config")
+	flagDry    = flag.Bool("n", false, "print commands, but don't run them")
+)
+
+func main() {
+	flag.Parse()
+	if *flagConfig == "" {
+		Fatalf("supply config in -config flag")
+	}
+	cfg, err := config.ParseTarget(*flagConfig)
+	if err != nil {
+		Fatalf("%v", err)
+	}
+	args, err := makeArgs(cfg, flag.Args())
+	if err != nil {
+		Fatalf("%v", err)
+	}
+	if *flagDry {
+		args = append([]string{"-n"}, args...)
+	}
+	Logf(0, "building for %v: make %v", config.TargetDir(cfg), strings.Join(args, " "))
+	cmd := exec.Command("make", args...)
+	cmd.Dir = cfg.Syzkaller
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		Fatalf("make failed: %v", err)
+	}
+}
+
+func makeArgs(cfg *config.Config, targets []string) ([]string, error) {
+	targetOS := cfg.Target_Os
+	switch targetOS {
+	case "gvisor":
+		targetOS = "linux"
+	case "fuchsia", "windows":
+		// Executors of these OSes need their own toolchains and fuzzers are not built for them.
+		return nil, fmt.Errorf("target %v is built with 'make %v'", cfg.Target_Os, cfg.Target_Os)
+	}
+	if len(targets) == 0 {
+		targets = []string{"fuzzer", "execprog", "executor"}
+	}
+	args := append(targets, "TARGETOS="+targetOS, "ARCH="+cfg.Target_Arch)
+	if cfg.Target_Cc != "" {
+		args = append(args, "CC="+cfg.Target_Cc)
+	}
+	if cfg.Target_Sysroot != "" {
+		args = append(args, "SYSROOT="+cfg.Target_Sysroot)
+	}
+	return args, nil
+}
@@ -10,40 +10,118 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/google/syzkaller/db"
 	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/sys"
 )
 
 var (
-	flagSeed = flag.Int("seed", -1, "prng seed")
+	flagSeed   = flag.Int("seed", -1, "prng seed")
+	flagCount  = flag.Int("n", 1, "number of mutations to apply")
+	flagLen    = flag.Int("len", 0, "max number of calls in the program (program length + 10 by default)")
+	flagCalls  = flag.String("calls", "", "comma-separated list of syscalls that can be inserted (all by default)")
+	flagOps    = flag.String("ops", "splice,insert,args,remove", "comma-separated list of mutation operators")
+	flagCorpus = flag.String("corpus", "", "corpus database to splice programs from")
+	flagAll    = flag.Bool("all", false, "print the program after every mutation")
 )
 
 func main() {
 	flag.Parse()
 	if flag.NArg() != 1 {
-		fmt.Fprintf(os.Stderr, "usage: mutate program\n")
+		fmt.Fprintf(os.Stderr, "usage: mutate [flags] program\n")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
 	data, err := ioutil.ReadFile(flag.Arg(0))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to read prog file: %v\n", err)
-		os.Exit(1)
+		fatalf("failed to read prog file: %v", err)
 	}
 	p, err := prog.Deserialize(data)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to deserialize the program: %v\n", err)
-		os.Exit(1)
+		fatalf("failed to deserialize the program: %v", err)
+	}
+	ops := parseOps(*flagOps)
+	var corpus []*prog.Prog
+	if *flagCorpus != "" {
+		progs, err := db.ReadFile(*flagCorpus)
+		if err != nil {
+			fatalf("failed to read corpus db: %v", err)
+		}
+		for _, data := range progs {
+			p1, err := prog.Deserialize(data)
+			if err != nil {
+				continue
+			}
+			corpus = append(corpus, p1)
+		}
+		if len(corpus) == 0 {
+			fatalf("corpus db does not contain any programs")
+		}
 	}
 
-	prios := prog.CalculatePriorities(nil)
-	ct := prog.BuildChoiceTable(prios, nil)
+	prios := prog.CalculatePriorities(corpus)
+	ct := prog.BuildChoiceTable(prios, parseCalls(*flagCalls))
 
 	seed := time.Now().UnixNano()
 	if *flagSeed != -1 {
 		seed = int64(*flagSeed)
 	}
+	ncalls := *flagLen
+	if ncalls <= 0 {
+		ncalls = len(p.Calls) + 10
+	}
 	rs := rand.NewSource(seed)
-	p.Mutate(rs, len(p.Calls)+10, ct, nil)
+	for i := 0; i < *flagCount; i++ {
+		p.MutateWithOps(rs, ncalls, ct, corpus, ops)
+		if *flagAll && i != *flagCount-1 {
+			fmt.Printf("# mutation %v:\n%s\n", i, p.Serialize())
+		}
+	}
 	fmt.Printf("%s\n", p.Serialize())
 }
+
+func parseOps(spec string) prog.MutationOps {
+	var ops prog.MutationOps
+	for _, op := range strings.Split(spec, ",") {
+		switch op {
+		case "splice":
+			ops.Splice = true
+		case "insert":
+			ops.Insert = true
+		case "args":
+			ops.MutateArg = true
+		case "remove":
+			ops.Remove = true
+		case "":
+		default:
+			fatalf("unknown mutation operator %q (splice/insert/args/remove)", op)
+		}
+	}
+	if ops == (prog.MutationOps{}) {
+		fatalf("no mutation operators enabled")
+	}
+	return ops
+}
+
+func parseCalls(spec string) map[*sys.Call]bool {
+	if spec == "" {
+		return nil
+	}
+	enabled := make(map[*sys.Call]bool)
+	for _, name := range strings.Split(spec, ",") {
+		c := sys.CallMap[name]
+		if c == nil {
+			fatalf("unknown syscall %q", name)
+		}
+		enabled[c] = true
+	}
+	return enabled
+}
+
+func fatalf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
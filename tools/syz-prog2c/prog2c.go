@@ -1,6 +1,8 @@
 // Copyright 2015 syzkaller project authors. All rights reserved.
 // Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
 
+// syz-prog2c converts a program into C source. Execution options saved in the header
+// of reproducers (repro.prog) are used unless the corresponding flags are given.
 package main
 
 import (
@@ -14,12 +16,15 @@ import (
 )
 
 var (
-	flagThreaded = flag.Bool("threaded", false, "create threaded program")
-	flagCollide  = flag.Bool("collide", false, "create collide program")
-	flagRepeat   = flag.Bool("repeat", false, "repeat program infinitely or not")
-	flagProcs    = flag.Int("procs", 4, "number of parallel processes")
-	flagSandbox  = flag.String("sandbox", "none", "sandbox to use (none, setuid, namespace)")
-	flagProg     = flag.String("prog", "", "file with program to convert (required)")
+	flagThreaded  = flag.Bool("threaded", false, "create threaded program")
+	flagCollide   = flag.Bool("collide", false, "create collide program")
+	flagRepeat    = flag.Bool("repeat", false, "repeat program infinitely or not")
+	flagProcs     = flag.Int("procs", 4, "number of parallel processes")
+	flagSandbox   = flag.String("sandbox", "none", "sandbox to use (none, setuid, namespace)")
+	flagProg      = flag.String("prog", "", "file with program to convert (required)")
+	flagOutput    = flag.String("output", "", "file to write C source to (stdout by default)")
+	flagFaultCall = flag.Int("fault_call", -1, "inject fault into this call (0-based)")
+	flagFaultNth  = flag.Int("fault_nth", 0, "inject fault on n-th operation (0-based)")
 )
 
 func main() {
@@ -33,11 +38,25 @@ func main() {
 		fmt.Fprintf(os.Stderr, "failed to read prog file: %v\n", err)
 		os.Exit(1)
 	}
+	if opts, _, err := csource.ParseRepro(data); err == nil {
+		if err := opts.ApplyRepro(flag.CommandLine); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
 	p, err := prog.Deserialize(data)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to deserialize the program: %v\n", err)
 		os.Exit(1)
 	}
+	if *flagFaultCall >= 0 {
+		if *flagFaultCall >= len(p.Calls) {
+			fmt.Fprintf(os.Stderr, "fault call %v is out of range, the program has %v calls\n",
+				*flagFaultCall, len(p.Calls))
+			os.Exit(1)
+		}
+		p.Calls[*flagFaultCall].FailNth = *flagFaultNth + 1
+	}
 	opts := csource.Options{
 		Threaded: *flagThreaded,
 		Collide:  *flagCollide,
@@ -48,7 +67,7 @@ func main() {
 	}
 	src, err := csource.Write(p, opts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to generate C spurce: %v\n", err)
+		fmt.Fprintf(os.Stderr, "failed to generate C source: %v\n", err)
 		os.Exit(1)
 	}
 	if formatted, err := csource.Format(src); err != nil {
@@ -56,5 +75,12 @@ func main() {
 	} else {
 		src = formatted
 	}
-	os.Stdout.Write(src)
+	if *flagOutput == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := ioutil.WriteFile(*flagOutput, src, 0640); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write C source: %v\n", err)
+		os.Exit(1)
+	}
 }
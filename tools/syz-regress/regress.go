@@ -0,0 +1,229 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-regress runs saved reproducers (repro.prog files, e.g. in workdir/crashes)
+// against one or more kernel builds and prints a pass/fail matrix,
+// which turns accumulated reproducers into a kernel regression test suite.
+// Each kernel is given as a manager config, its VMs run reproducers in parallel.
+// Exits with status 1 if any reproducer crashed any of the kernels.
+// Usage:
+//
+//	syz-regress -configs=new.cfg[,old.cfg] workdir/crashes
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/syzkaller/bisect"
+	"github.com/google/syzkaller/config"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/vm"
+	_ "github.com/google/syzkaller/vm/adb"
+	_ "github.com/google/syzkaller/vm/bhyve"
+	_ "github.com/google/syzkaller/vm/cuttlefish"
+	_ "github.com/google/syzkaller/vm/gce"
+	_ "github.com/google/syzkaller/vm/gvisor"
+	_ "github.com/google/syzkaller/vm/hyperv"
+	_ "github.com/google/syzkaller/vm/isolated"
+	_ "github.com/google/syzkaller/vm/kvm"
+	_ "github.com/google/syzkaller/vm/proxy"
+	_ "github.com/google/syzkaller/vm/qemu"
+	_ "github.com/google/syzkaller/vm/vmm"
+	_ "github.com/google/syzkaller/vm/vmware"
+)
+
+var (
+	flagConfigs  = flag.String("configs", "", "comma-separated list of manager configs, one per kernel")
+	flagDuration = flag.Duration("duration", 10*time.Minute, "how long to run each reproducer")
+	flagOutput   = flag.String("output", "", "write the matrix to this file")
+)
+
+// Repro is a saved reproducer with the title of the crash it was found for (if known).
+type Repro struct {
+	Name  string
+	Title string
+	Data  []byte
+}
+
+// Result of running a reproducer on a kernel.
+type Result struct {
+	Crash string // crash title, empty if the kernel did not crash
+	Err   error  // the reproducer could not be run
+}
+
+func (res *Result) String() string {
+	switch {
+	case res == nil:
+		return "-"
+	case res.Err != nil:
+		return "ERROR"
+	case res.Crash != "":
+		return "FAIL: " + res.Crash
+	default:
+		return "PASS"
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *flagConfigs == "" || flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: syz-regress -configs=a.cfg[,b.cfg] [flags] dir-or-repro.prog...\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	var cfgs []*config.Config
+	var kernels []string
+	for _, fn := range strings.Split(*flagConfigs, ",") {
+		cfg, _, err := config.Parse(fn)
+		if err != nil {
+			Fatalf("%v", err)
+		}
+		cfgs = append(cfgs, cfg)
+		kernels = append(kernels, strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn)))
+	}
+	var repros []*Repro
+	for _, arg := range flag.Args() {
+		repros = append(repros, loadRepros(arg)...)
+	}
+	Logf(0, "loaded %v reproducers", len(repros))
+	if len(repros) == 0 {
+		return
+	}
+
+	go func() {
+		c := make(chan os.Signal, 2)
+		signal.Notify(c, syscall.SIGINT)
+		<-c
+		close(vm.Shutdown)
+		Logf(-1, "shutting down...")
+		<-c
+		Fatalf("terminating")
+	}()
+
+	// results[repro][kernel]
+	results := make([][]*Result, len(repros))
+	for i := range results {
+		results[i] = make([]*Result, len(cfgs))
+	}
+	var wg sync.WaitGroup
+	for k, cfg := range cfgs {
+		k, cfg := k, cfg
+		queue := make(chan int, len(repros))
+		for i := range repros {
+			queue <- i
+		}
+		close(queue)
+		for index := 0; index < cfg.Count; index++ {
+			index := index
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range queue {
+					select {
+					case <-vm.Shutdown:
+						return
+					default:
+					}
+					repro := repros[i]
+					crash, err := bisect.TestReproInstance(cfg, index, repro.Data, *flagDuration)
+					res := &Result{crash, err}
+					results[i][k] = res
+					if err != nil {
+						Logf(0, "%v: %v: %v", kernels[k], repro.Name, err)
+						continue
+					}
+					Logf(0, "%v: %v: %v", kernels[k], repro.Name, res)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	buf := new(bytes.Buffer)
+	failed := writeMatrix(buf, kernels, repros, results)
+	os.Stdout.Write(buf.Bytes())
+	if *flagOutput != "" {
+		if err := ioutil.WriteFile(*flagOutput, buf.Bytes(), 0640); err != nil {
+			Fatalf("failed to write output file: %v", err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// loadRepros loads path if it is a file, or all repro.prog files under path if it is a dir.
+// Reproducers in crash dirs are named after the dir and titled with its description.
+func loadRepros(path string) []*Repro {
+	var repros []*Repro
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || file != path && info.Name() != "repro.prog" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		repro := &Repro{Name: file, Data: data}
+		if file != path {
+			repro.Name = filepath.Dir(file)
+		}
+		if desc, err := ioutil.ReadFile(filepath.Join(filepath.Dir(file), "description")); err == nil {
+			repro.Title = strings.TrimSpace(string(desc))
+		}
+		repros = append(repros, repro)
+		return nil
+	})
+	if err != nil {
+		Fatalf("failed to load reproducers: %v", err)
+	}
+	sort.Slice(repros, func(i, j int) bool { return repros[i].Name < repros[j].Name })
+	return repros
+}
+
+// writeMatrix writes results table and per-kernel totals, returns true if any reproducer crashed.
+func writeMatrix(w *bytes.Buffer, kernels []string, repros []*Repro, results [][]*Result) bool {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "REPRO\t%v\tORIGINAL CRASH\n", strings.Join(kernels, "\t"))
+	pass := make([]int, len(kernels))
+	fail := make([]int, len(kernels))
+	errs := make([]int, len(kernels))
+	for i, repro := range repros {
+		fmt.Fprintf(tw, "%v", repro.Name)
+		for k, res := range results[i] {
+			fmt.Fprintf(tw, "\t%v", res)
+			switch {
+			case res == nil:
+			case res.Err != nil:
+				errs[k]++
+			case res.Crash != "":
+				fail[k]++
+			default:
+				pass[k]++
+			}
+		}
+		fmt.Fprintf(tw, "\t%v\n", repro.Title)
+	}
+	tw.Flush()
+	failed := false
+	for k, kernel := range kernels {
+		fmt.Fprintf(w, "%v: %v passed, %v failed, %v errors\n", kernel, pass[k], fail[k], errs[k])
+		failed = failed || fail[k] != 0
+	}
+	return failed
+}
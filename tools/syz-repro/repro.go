@@ -1,9 +1,13 @@
 // Copyright 2015 syzkaller project authors. All rights reserved.
 // Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
 
+// syz-repro extracts a reproducer from a crash log: finds the program(s) that crash the kernel,
+// minimizes them and execution options and tries to convert the result to a C program.
+// The program is saved to repro.prog (with execution options in the header) and the C program to repro.c.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -17,14 +21,25 @@ import (
 	"github.com/google/syzkaller/repro"
 	"github.com/google/syzkaller/vm"
 	_ "github.com/google/syzkaller/vm/adb"
+	_ "github.com/google/syzkaller/vm/bhyve"
+	_ "github.com/google/syzkaller/vm/cuttlefish"
 	_ "github.com/google/syzkaller/vm/gce"
+	_ "github.com/google/syzkaller/vm/gvisor"
+	_ "github.com/google/syzkaller/vm/hyperv"
+	_ "github.com/google/syzkaller/vm/isolated"
 	_ "github.com/google/syzkaller/vm/kvm"
+	_ "github.com/google/syzkaller/vm/proxy"
 	_ "github.com/google/syzkaller/vm/qemu"
+	_ "github.com/google/syzkaller/vm/vmm"
+	_ "github.com/google/syzkaller/vm/vmware"
 )
 
 var (
 	flagConfig = flag.String("config", "", "configuration file")
 	flagCount  = flag.Int("count", 0, "number of VMs to use (overrides config count param)")
+	flagOutput = flag.String("output", "repro.prog", "write the reproducer program to this file")
+	flagCRepro = flag.String("crepro", "repro.c", "write the C reproducer to this file")
+	flagState  = flag.String("state", "", "checkpoint progress to this file and resume from it")
 )
 
 func main() {
@@ -41,7 +56,7 @@ func main() {
 		cfg.Count = 4
 	}
 	if len(flag.Args()) != 1 {
-		Fatalf("usage: syz-repro -config=config.file execution.log")
+		Fatalf("usage: syz-repro -config=config.file [-output=repro.prog] [-crepro=repro.c] [-state=file] execution.log")
 	}
 	data, err := ioutil.ReadFile(flag.Args()[0])
 	if err != nil {
@@ -62,7 +77,13 @@ func main() {
 		Fatalf("terminating")
 	}()
 
-	res, err := repro.Run(data, cfg, vmIndexes)
+	var state *repro.State
+	var save func(*repro.State)
+	if *flagState != "" {
+		state = loadState(*flagState)
+		save = func(state *repro.State) { saveState(*flagState, state) }
+	}
+	res, err := repro.Resume(data, cfg, vmIndexes, state, save)
 	if err != nil {
 		Logf(0, "reproduction failed: %v", err)
 	}
@@ -71,7 +92,9 @@ func main() {
 	}
 
 	fmt.Printf("opts: %+v crepro: %v\n\n", res.Opts, res.CRepro)
-	fmt.Printf("%s\n", res.Prog.Serialize())
+	prog := res.Prog.Serialize()
+	fmt.Printf("%s\n", prog)
+	writeFile(*flagOutput, csource.SerializeRepro(res.Prog, res.Opts))
 	if res.CRepro {
 		src, err := csource.Write(res.Prog, res.Opts)
 		if err != nil {
@@ -81,5 +104,48 @@ func main() {
 			src = formatted
 		}
 		fmt.Printf("%s\n", src)
+		writeFile(*flagCRepro, src)
+	}
+}
+
+func writeFile(file string, data []byte) {
+	if file == "" {
+		return
+	}
+	if err := ioutil.WriteFile(file, data, 0640); err != nil {
+		Fatalf("failed to write %v: %v", file, err)
+	}
+	Logf(0, "saved %v", file)
+}
+
+// loadState returns the state saved by a previous run, or nil if there is none.
+func loadState(file string) *repro.State {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Fatalf("failed to read state: %v", err)
+		}
+		return nil
+	}
+	state := new(repro.State)
+	if err := json.Unmarshal(data, state); err != nil {
+		Fatalf("failed to parse state %v: %v", file, err)
+	}
+	Logf(0, "resuming from stage %v", state.Stage)
+	return state
+}
+
+func saveState(file string, state *repro.State) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		Logf(0, "failed to marshal state: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0640); err != nil {
+		Logf(0, "failed to save state: %v", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		Logf(0, "failed to save state: %v", err)
 	}
 }
@@ -1,21 +1,37 @@
 // Copyright 2015 syzkaller project authors. All rights reserved.
 // Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
 
+// syz-stress generates, mutates and executes programs on the local machine
+// without a manager and VMs, which is useful for quick sanity testing of new
+// descriptions and executor changes on a development machine or a test device.
+// Programs can be seeded from a corpus (corpus.db, a legacy zip archive or
+// a directory with programs) and restricted to a subset of syscalls.
+// With -duration the tool stops after the given time and exits with status 1
+// if any program failed the executor, hanged or caused a panic.
+// Usage:
+//
+//	syz-stress -executor=./bin/syz-executor -syscalls=openat,ioctl$KVM_* -duration=10m
 package main
 
 import (
 	"archive/zip"
+	"bytes"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/google/syzkaller/config"
+	"github.com/google/syzkaller/db"
 	"github.com/google/syzkaller/host"
 	"github.com/google/syzkaller/ipc"
 	. "github.com/google/syzkaller/log"
@@ -24,30 +40,45 @@ import (
 )
 
 var (
-	flagCorpus   = flag.String("corpus", "", "zip file with corpus")
+	flagCorpus   = flag.String("corpus", "", "corpus.db, zip file or directory with corpus programs")
 	flagExecutor = flag.String("executor", "./syz-executor", "path to executor binary")
 	flagOutput   = flag.Bool("output", false, "print executor output to console")
 	flagProcs    = flag.Int("procs", 2*runtime.NumCPU(), "number of parallel processes")
 	flagLogProg  = flag.Bool("logprog", false, "print programs before execution")
 	flagGenerate = flag.Bool("generate", true, "generate new programs, otherwise only mutate corpus")
+	flagBench    = flag.Duration("bench", 0, "period of dumping per-syscall execution statistics (0 - disabled)")
+	flagSyscalls = flag.String("syscalls", "", "comma-separated list of enabled syscalls (in enable_syscalls format)")
+	flagDuration = flag.Duration("duration", 0, "stop after this time, exit status is 1 if any program failed (0 - run forever)")
 
 	failedRe = regexp.MustCompile("runtime error: |panic: |Panic: ")
 
-	statExec uint64
-	gate     *ipc.Gate
+	statExec   uint64
+	statFailed uint64
+	gate       *ipc.Gate
+
+	benchMu    sync.Mutex
+	benchStats = make([]callStats, len(sys.Calls)) // indexed by sys.Call.ID
 )
 
+// callStats is per-syscall execution statistics collected in bench mode.
+type callStats struct {
+	execs   uint64
+	errors  uint64 // executions that returned an error
+	blocked uint64 // executions that have not completed in time
+	time    time.Duration
+}
+
 const programLength = 30
 
 func main() {
 	flag.Parse()
-	corpus := readCorpus()
+	calls := buildCallList()
+	corpus := readCorpus(calls)
 	Logf(0, "parsed %v programs", len(corpus))
 	if !*flagGenerate && len(corpus) == 0 {
 		Fatalf("nothing to mutate (-generate=false and no corpus)")
 	}
 
-	calls := buildCallList()
 	prios := prog.CalculatePriorities(corpus)
 	ct := prog.BuildChoiceTable(prios, calls)
 
@@ -55,14 +86,19 @@ func main() {
 	if err != nil {
 		Fatalf("%v", err)
 	}
+	var seccompCalls []int
+	for c := range calls {
+		seccompCalls = append(seccompCalls, c.ID)
+	}
 	gate = ipc.NewGate(2**flagProcs, nil)
 	for pid := 0; pid < *flagProcs; pid++ {
 		pid := pid
 		go func() {
-			env, err := ipc.MakeEnv(*flagExecutor, timeout, flags, pid)
+			env, err := ipc.MakeEnv(*flagExecutor, timeout, flags, ipc.DefaultPolicy(), pid)
 			if err != nil {
 				Fatalf("failed to create execution environment: %v", err)
 			}
+			env.SeccompCalls = seccompCalls
 			rs := rand.NewSource(time.Now().UnixNano() + int64(pid)*1e12)
 			rnd := rand.New(rs)
 			for i := 0; ; i++ {
@@ -82,11 +118,65 @@ func main() {
 			}
 		}()
 	}
+	start := time.Now()
+	lastBench := start
 	for range time.NewTicker(5 * time.Second).C {
 		Logf(0, "executed %v programs", atomic.LoadUint64(&statExec))
+		if *flagBench != 0 && time.Since(lastBench) >= *flagBench {
+			dumpBench(time.Since(start))
+			lastBench = time.Now()
+		}
+		if *flagDuration != 0 && time.Since(start) >= *flagDuration {
+			break
+		}
+	}
+	if *flagBench != 0 {
+		dumpBench(time.Since(start))
+	}
+	failed := atomic.LoadUint64(&statFailed)
+	Logf(0, "executed %v programs in %v, %v failed", atomic.LoadUint64(&statExec), time.Since(start), failed)
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
+
+// dumpBench prints execution statistics of all executed syscalls sorted by total execution time,
+// calls that always fail usually point to wrong descriptions or missing setup.
+func dumpBench(elapsed time.Duration) {
+	var calls benchCallArray
+	benchMu.Lock()
+	for id, stats := range benchStats {
+		if stats.execs != 0 {
+			calls = append(calls, benchCall{sys.Calls[id], stats})
+		}
+	}
+	benchMu.Unlock()
+	sort.Sort(calls)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%-50v %10v %10v %7v %7v %10v\n", "syscall", "execs", "execs/sec", "errors", "blocked", "avg time")
+	for _, c := range calls {
+		avg := time.Duration(0)
+		if completed := c.execs - c.blocked; completed != 0 {
+			avg = c.time / time.Duration(completed)
+		}
+		fmt.Fprintf(buf, "%-50v %10v %10.1f %6.1f%% %6.1f%% %10v\n", c.call.Name, c.execs,
+			float64(c.execs)/elapsed.Seconds(), float64(c.errors)*100/float64(c.execs),
+			float64(c.blocked)*100/float64(c.execs), avg)
 	}
+	Logf(0, "per-syscall statistics after %v:\n%s", elapsed, buf.Bytes())
 }
 
+type benchCall struct {
+	call *sys.Call
+	callStats
+}
+
+type benchCallArray []benchCall
+
+func (a benchCallArray) Len() int           { return len(a) }
+func (a benchCallArray) Less(i, j int) bool { return a[i].time > a[j].time }
+func (a benchCallArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
 var outMu sync.Mutex
 
 func execute(pid int, env *ipc.Env, p *prog.Prog) {
@@ -98,16 +188,45 @@ func execute(pid int, env *ipc.Env, p *prog.Prog) {
 		ticket := gate.Enter()
 		defer gate.Leave(ticket)
 		outMu.Lock()
-		fmt.Printf("executing program %v\n%s\n", pid, p.Serialize())
+		fmt.Printf("%s%s\n", prog.LogHeader(pid, time.Now()), p.Serialize())
 		outMu.Unlock()
 	}
 
-	output, _, _, failed, hanged, err := env.Exec(p)
+	var output []byte
+	var failed, hanged bool
+	var err error
+	if *flagBench != 0 {
+		var errnos []int
+		var durations []time.Duration
+		output, _, errnos, durations, failed, hanged, err = env.ExecBench(p)
+		if err == nil {
+			benchMu.Lock()
+			for i, c := range p.Calls {
+				if errnos[i] == ipc.ErrnoNotExecuted {
+					continue
+				}
+				stats := &benchStats[c.Meta.ID]
+				stats.execs++
+				if errnos[i] == ipc.ErrnoBlocked {
+					stats.blocked++
+					continue // duration is unknown
+				}
+				if errnos[i] != 0 {
+					stats.errors++
+				}
+				stats.time += durations[i]
+			}
+			benchMu.Unlock()
+		}
+	} else {
+		output, _, _, failed, hanged, err = env.Exec(p)
+	}
 	if err != nil {
 		fmt.Printf("failed to execute executor: %v\n", err)
 	}
 	paniced := failedRe.Match(output)
 	if failed || hanged || paniced || err != nil {
+		atomic.AddUint64(&statFailed, 1)
 		fmt.Printf("PROGRAM:\n%s\n", p.Serialize())
 	}
 	if failed || hanged || paniced || err != nil || *flagOutput {
@@ -115,33 +234,87 @@ func execute(pid int, env *ipc.Env, p *prog.Prog) {
 	}
 }
 
-func readCorpus() []*prog.Prog {
+// readCorpus reads programs from a corpus.db, a zip archive or a directory.
+// Programs that do not match the current descriptions or use disabled calls are skipped.
+func readCorpus(calls map[*sys.Call]bool) []*prog.Prog {
 	if *flagCorpus == "" {
 		return nil
 	}
-	zipr, err := zip.OpenReader(*flagCorpus)
+	var data [][]byte
+	var err error
+	if info, err1 := os.Stat(*flagCorpus); err1 == nil && info.IsDir() {
+		data, err = readDir(*flagCorpus)
+	} else if strings.HasSuffix(*flagCorpus, ".zip") {
+		data, err = readZip(*flagCorpus)
+	} else {
+		data, err = db.ReadFile(*flagCorpus)
+	}
 	if err != nil {
-		Fatalf("failed to open bin file: %v", err)
+		Fatalf("failed to read corpus: %v", err)
 	}
 	var progs []*prog.Prog
+	broken, disabled := 0, 0
+nextProg:
+	for _, d := range data {
+		p, err := prog.Deserialize(d)
+		if err != nil {
+			Logf(1, "skipping broken corpus program: %v", err)
+			broken++
+			continue
+		}
+		for _, c := range p.Calls {
+			if !calls[c.Meta] {
+				disabled++
+				continue nextProg
+			}
+		}
+		progs = append(progs, p)
+	}
+	if broken+disabled != 0 {
+		Logf(0, "skipped %v broken corpus programs and %v programs with disabled calls", broken, disabled)
+	}
+	return progs
+}
+
+func readZip(file string) ([][]byte, error) {
+	zipr, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zipr.Close()
+	var progs [][]byte
 	for _, zipf := range zipr.File {
 		r, err := zipf.Open()
 		if err != nil {
-			Fatalf("failed to uzip file from input archive: %v", err)
+			return nil, err
 		}
 		data, err := ioutil.ReadAll(r)
+		r.Close()
 		if err != nil {
-			Fatalf("failed to read corpus file: %v", err)
+			return nil, err
 		}
-		p, err := prog.Deserialize(data)
+		progs = append(progs, data)
+	}
+	return progs, nil
+}
+
+func readDir(dir string) ([][]byte, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var progs [][]byte
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
 		if err != nil {
-			Fatalf("failed to deserialize corpus program: %v", err)
+			return nil, err
 		}
-		progs = append(progs, p)
-		r.Close()
+		progs = append(progs, data)
 	}
-	zipr.Close()
-	return progs
+	return progs, nil
 }
 
 func buildCallList() map[*sys.Call]bool {
@@ -158,12 +331,23 @@ func buildCallList() map[*sys.Call]bool {
 			Logf(0, "disabling unsupported syscall: %v", c.Name)
 		}
 	}
-	trans := sys.TransitivelyEnabledCalls(calls)
-	for c := range calls {
-		if !trans[c] {
-			Logf(0, "disabling transitively unsupported syscall: %v", c.Name)
-			delete(calls, c)
+	if *flagSyscalls != "" {
+		enabled, err := config.MatchSyscalls(strings.Split(*flagSyscalls, ","))
+		if err != nil {
+			Fatalf("%v", err)
 		}
+		// mmap is used to allocate memory.
+		enabled[sys.CallMap["mmap"]] = true
+		for c := range calls {
+			if !enabled[c] {
+				delete(calls, c)
+			}
+		}
+	}
+	_, dead := sys.TransitivelyEnabledCallsReasons(calls)
+	for c, reason := range dead {
+		Logf(0, "disabling transitively unsupported syscall: %v (%v)", c.Name, reason)
+		delete(calls, c)
 	}
 	return calls
 }
@@ -0,0 +1,79 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-trace2syz converts strace output of real workloads into syzkaller programs.
+// Traces are best collected with "strace -f -X raw -s 65500 -o trace workload",
+// so that flags are printed as numbers and strings are not truncated.
+// Programs are printed to stdout or packed into a corpus database
+// that can be imported into a manager with -import_corpus.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/syzkaller/db"
+	"github.com/google/syzkaller/prog"
+)
+
+var (
+	flagCorpus = flag.String("corpus", "", "write programs to this corpus database instead of stdout")
+	flagSeed   = flag.Int("seed", -1, "prng seed for arguments that can't be converted")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: syz-trace2syz [flags] trace...\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	seed := time.Now().UnixNano()
+	if *flagSeed != -1 {
+		seed = int64(*flagSeed)
+	}
+	rs := rand.NewSource(seed)
+	var progs [][]byte
+	for _, fn := range flag.Args() {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			fatalf("failed to read trace: %v", err)
+		}
+		p, skipped, err := prog.ParseStrace(data, rs, nil)
+		if err != nil {
+			fatalf("failed to convert %v: %v", fn, err)
+		}
+		fmt.Fprintf(os.Stderr, "%v: converted %v calls\n", fn, len(p.Calls))
+		var names []string
+		for name := range skipped {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "\tskipped %v: %v\n", name, skipped[name])
+		}
+		if len(p.Calls) == 0 {
+			continue
+		}
+		if *flagCorpus == "" {
+			fmt.Printf("# %v\n%s\n", fn, p.Serialize())
+		}
+		progs = append(progs, p.Serialize())
+	}
+	if *flagCorpus != "" {
+		if err := db.WriteFile(*flagCorpus, progs); err != nil {
+			fatalf("failed to write corpus db: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "wrote %v programs to %v\n", len(progs), *flagCorpus)
+	}
+}
+
+func fatalf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,388 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// syz-verifier executes the same programs on several kernels (or kernel configs)
+// and reports calls that return different errnos, which may point to semantic bugs
+// or regressions. Kernels are given as manager configs, a config with the compare
+// section contributes both of its builds. Every program is executed several times
+// on each kernel, and calls that return different errnos across runs on the same kernel
+// are considered nondeterministic. Comparison of a program stops at the first
+// nondeterministic, divergent or not completed call, because the following calls
+// operate on a kernel state that is not the same anymore.
+// Only errnos are compared, executor does not return output data of calls.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/syzkaller/config"
+	"github.com/google/syzkaller/ipc"
+	. "github.com/google/syzkaller/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/report"
+	"github.com/google/syzkaller/vm"
+	_ "github.com/google/syzkaller/vm/adb"
+	_ "github.com/google/syzkaller/vm/bhyve"
+	_ "github.com/google/syzkaller/vm/cuttlefish"
+	_ "github.com/google/syzkaller/vm/gce"
+	_ "github.com/google/syzkaller/vm/gvisor"
+	_ "github.com/google/syzkaller/vm/hyperv"
+	_ "github.com/google/syzkaller/vm/isolated"
+	_ "github.com/google/syzkaller/vm/kvm"
+	_ "github.com/google/syzkaller/vm/proxy"
+	_ "github.com/google/syzkaller/vm/qemu"
+	_ "github.com/google/syzkaller/vm/vmm"
+	_ "github.com/google/syzkaller/vm/vmware"
+)
+
+var (
+	flagConfigs = flag.String("configs", "", "comma-separated list of manager configs, one per kernel")
+	flagRuns    = flag.Int("runs", 3, "execute every program that many times on every kernel")
+	flagTimeout = flag.Duration("timeout", time.Hour, "time limit for execution of all programs on a kernel")
+	flagOutput  = flag.String("output", "", "write divergent programs to this file")
+)
+
+// kernel is a kernel build to verify programs on: VM index selects the build in A/B configs.
+type kernel struct {
+	name  string
+	cfg   *config.Config
+	index int
+}
+
+// result holds errnos of all runs of all programs on a kernel: errnos[prog][run][call].
+type result struct {
+	errnos [][][]int
+	crash  string
+}
+
+// divergence is the first call of a program that returned different errnos on different kernels.
+type divergence struct {
+	prog   int
+	call   int
+	errnos []int // per-kernel
+}
+
+func main() {
+	flag.Parse()
+	if *flagConfigs == "" || flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: syz-verifier -configs=a.cfg,b.cfg [flags] file-with-programs+\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *flagRuns < 1 {
+		Fatalf("flag runs must be positive")
+	}
+	kernels := loadKernels(strings.Split(*flagConfigs, ","))
+	if len(kernels) < 2 {
+		Fatalf("need at least 2 kernels to compare, got %v", len(kernels))
+	}
+
+	var progs []*prog.Prog
+	for _, fn := range flag.Args() {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			Fatalf("failed to read log file: %v", err)
+		}
+		for _, ent := range prog.ParseLog(data) {
+			progs = append(progs, ent.P)
+		}
+	}
+	Logf(0, "parsed %v programs", len(progs))
+	if len(progs) == 0 {
+		return
+	}
+	// Programs are renumbered so that indexes printed by syz-execprog match progs.
+	buf := new(bytes.Buffer)
+	for i, p := range progs {
+		fmt.Fprintf(buf, "executing program %v:\n%s\n", i, p.Serialize())
+	}
+	logFile, err := ioutil.TempFile("", "syz-verifier")
+	if err != nil {
+		Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(logFile.Name())
+	if _, err := logFile.Write(buf.Bytes()); err != nil {
+		Fatalf("failed to write temp file: %v", err)
+	}
+	logFile.Close()
+
+	go func() {
+		c := make(chan os.Signal, 2)
+		signal.Notify(c, syscall.SIGINT)
+		<-c
+		Logf(-1, "shutting down...")
+		close(vm.Shutdown)
+		<-c
+		Fatalf("terminating")
+	}()
+
+	results := make([]*result, len(kernels))
+	var wg sync.WaitGroup
+	for i, k := range kernels {
+		i, k := i, k
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := runKernel(k, logFile.Name(), len(progs))
+			if err != nil {
+				Fatalf("%v: %v", k.name, err)
+			}
+			results[i] = res
+		}()
+	}
+	wg.Wait()
+
+	for i, res := range results {
+		if res.crash != "" {
+			fmt.Printf("kernel %v crashed: %v\n", kernels[i].name, res.crash)
+		}
+	}
+	divs, flaky := compare(results, len(progs))
+	out := new(bytes.Buffer)
+	for _, d := range divs {
+		p := progs[d.prog]
+		fmt.Fprintf(out, "# program #%v: call #%v %v returned", d.prog, d.call, p.Calls[d.call].Meta.Name)
+		for i, errno := range d.errnos {
+			fmt.Fprintf(out, " %v=%v", kernels[i].name, formatErrno(errno))
+		}
+		fmt.Fprintf(out, "\n%s\n", p.Serialize())
+	}
+	os.Stdout.Write(out.Bytes())
+	fmt.Printf("%v programs, %v divergent, %v with nondeterministic calls\n", len(progs), len(divs), flaky)
+	if *flagOutput != "" && len(divs) != 0 {
+		if err := ioutil.WriteFile(*flagOutput, out.Bytes(), 0640); err != nil {
+			Fatalf("failed to write output file: %v", err)
+		}
+	}
+}
+
+func loadKernels(files []string) []*kernel {
+	var kernels []*kernel
+	for _, fn := range files {
+		cfg, _, err := config.Parse(fn)
+		if err != nil {
+			Fatalf("%v", err)
+		}
+		name := cfg.Tag
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+		}
+		kernels = append(kernels, &kernel{name, cfg, 0})
+		if cfg.Compare != nil {
+			kernels = append(kernels, &kernel{name + "/" + cfg.Compare.Tag, cfg, 1})
+		}
+	}
+	return kernels
+}
+
+var errnosRe = regexp.MustCompile(`errnos: program #([0-9]+):((?: -?[0-9]+)*)`)
+
+// runKernel executes all programs on a new VM with the kernel and collects errnos of all calls.
+func runKernel(k *kernel, logFile string, nprogs int) (*result, error) {
+	vmCfg, err := config.CreateVMConfig(k.cfg, k.index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VM config: %v", err)
+	}
+	Logf(0, "%v: booting %v", k.name, vmCfg.Name)
+	inst, err := vm.Create(k.cfg.Type, vmCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	execprogBin, err := inst.Copy(config.TargetBin(k.cfg, "syz-execprog"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy execprog: %v", err)
+	}
+	executorBin, err := inst.Copy(config.TargetBin(k.cfg, "syz-executor"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy executor: %v", err)
+	}
+	vmLog, err := inst.Copy(logFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy programs: %v", err)
+	}
+	// A single proc without collider, so that programs don't interfere with each other.
+	cmd := fmt.Sprintf("%v -executor=%v -repeat=%v -procs=1 -cover=0 -collide=false -sandbox=%v -errnos %v",
+		execprogBin, executorBin, *flagRuns, k.cfg.Sandbox, vmLog)
+	outc, errc, err := inst.Run(*flagTimeout, nil, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %v: %v", cmd, err)
+	}
+
+	res := &result{errnos: make([][][]int, nprogs)}
+	var output, pending []byte
+	// Only new output (with some overlap) is checked for crashes.
+	matchPos := 0
+	parse := func(out []byte) {
+		matchPos = len(output) - 128
+		if matchPos < 0 {
+			matchPos = 0
+		}
+		output = append(output, out...)
+		pending = append(pending, out...)
+		for {
+			nl := bytes.IndexByte(pending, '\n')
+			if nl == -1 {
+				break
+			}
+			if m := errnosRe.FindSubmatch(pending[:nl]); m != nil {
+				idx, _ := strconv.Atoi(string(m[1]))
+				var errnos []int
+				for _, s := range strings.Fields(string(m[2])) {
+					errno, _ := strconv.Atoi(s)
+					errnos = append(errnos, errno)
+				}
+				if idx < nprogs {
+					res.errnos[idx] = append(res.errnos[idx], errnos)
+				}
+			}
+			pending = pending[nl+1:]
+		}
+	}
+	Logf(0, "%v: executing programs...", k.name)
+	for {
+		select {
+		case out := <-outc:
+			parse(out)
+			if report.ContainsCrash(output[matchPos:], k.cfg.ParsedIgnores) {
+				// Give it some time to finish writing the report.
+				output = append(output, drain(outc, 10*time.Second)...)
+				res.crash, _, _, _ = report.Parse(output[matchPos:], k.cfg.ParsedIgnores)
+				return res, nil
+			}
+		case err := <-errc:
+			parse(drain(outc, time.Second))
+			switch err {
+			case nil:
+				Logf(0, "%v: done", k.name)
+				return res, nil
+			case vm.TimeoutErr:
+				Logf(0, "%v: timed out, results are incomplete", k.name)
+				return res, nil
+			default:
+				if report.ContainsCrash(output, k.cfg.ParsedIgnores) {
+					res.crash, _, _, _ = report.Parse(output, k.cfg.ParsedIgnores)
+				} else {
+					res.crash = vm.LostConnectionTitle
+				}
+				return res, nil
+			}
+		case <-vm.Shutdown:
+			return nil, fmt.Errorf("shutdown")
+		}
+	}
+}
+
+func drain(outc <-chan []byte, timeout time.Duration) []byte {
+	var output []byte
+	timer := time.NewTimer(timeout).C
+	for {
+		select {
+		case out, ok := <-outc:
+			if !ok {
+				return output
+			}
+			output = append(output, out...)
+		case <-timer:
+			return output
+		}
+	}
+}
+
+// compare returns the first divergent call of every program that was executed
+// on all kernels and the number of programs with nondeterministic calls.
+func compare(results []*result, nprogs int) ([]*divergence, int) {
+	var divs []*divergence
+	flaky := 0
+	for p := 0; p < nprogs; p++ {
+		stable := make([][]int, len(results))
+		complete := true
+		ncalls := -1
+		for k, res := range results {
+			runs := res.errnos[p]
+			if len(runs) == 0 {
+				complete = false
+				break
+			}
+			stable[k] = stableErrnos(runs)
+			if ncalls == -1 || len(stable[k]) < ncalls {
+				ncalls = len(stable[k])
+			}
+		}
+		if !complete {
+			continue
+		}
+		for i := 0; i < ncalls; i++ {
+			errnos := make([]int, len(results))
+			nondet := false
+			for k := range results {
+				errnos[k] = stable[k][i]
+				nondet = nondet || stable[k][i] == errnoFlaky
+			}
+			if nondet {
+				flaky++
+				break
+			}
+			if !equalErrnos(errnos) {
+				divs = append(divs, &divergence{p, i, errnos})
+				break
+			}
+			if errnos[0] == ipc.ErrnoNotExecuted || errnos[0] == ipc.ErrnoBlocked {
+				break
+			}
+		}
+	}
+	return divs, flaky
+}
+
+// errnoFlaky marks calls that returned different errnos in different runs on the same kernel.
+const errnoFlaky = -1000
+
+// stableErrnos merges runs of a program on a kernel: errnos of calls up to the first
+// nondeterministic call, which is marked with errnoFlaky.
+func stableErrnos(runs [][]int) []int {
+	var errnos []int
+	for i := range runs[0] {
+		errno := runs[0][i]
+		for _, run := range runs[1:] {
+			if i >= len(run) || run[i] != errno {
+				return append(errnos, errnoFlaky)
+			}
+		}
+		errnos = append(errnos, errno)
+	}
+	return errnos
+}
+
+func equalErrnos(errnos []int) bool {
+	for _, errno := range errnos[1:] {
+		if errno != errnos[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatErrno(errno int) string {
+	switch errno {
+	case 0:
+		return "0"
+	case ipc.ErrnoNotExecuted:
+		return "not executed"
+	case ipc.ErrnoBlocked:
+		return "blocked"
+	}
+	return fmt.Sprintf("%v (%v)", errno, syscall.Errno(errno))
+}
@@ -12,10 +12,11 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/vm"
 )
 
@@ -46,11 +47,18 @@ func ctor(cfg *vm.Config) (vm.Instance, error) {
 	if err := inst.repair(); err != nil {
 		return nil, err
 	}
-	var err error
-	if inst.console, err = findConsole(inst.cfg.Bin, inst.cfg.Device); err != nil {
-		return nil, err
+	if inst.cfg.Console != "" {
+		if _, err := os.Stat(inst.cfg.Console); err != nil {
+			return nil, fmt.Errorf("bad console of device %v: %v", inst.cfg.Device, err)
+		}
+		inst.console = inst.cfg.Console
+	} else {
+		var err error
+		if inst.console, err = findConsole(inst.cfg.Bin, inst.cfg.Device); err != nil {
+			return nil, err
+		}
 	}
-	if err := inst.checkBatteryLevel(); err != nil {
+	if err := inst.waitForSafeState(); err != nil {
 		return nil, err
 	}
 	// Remove temp files from previous runs.
@@ -156,7 +164,7 @@ func findConsole(adb, dev string) (string, error) {
 	}
 	devToConsole[dev] = con
 	consoleToDev[con] = dev
-	Logf(0, "associating adb device %v with console %v", dev, con)
+	vm.Log.Logf(0, "associating adb device %v with console %v", dev, con)
 	return con, nil
 }
 
@@ -171,7 +179,7 @@ func (inst *instance) Forward(port int) (string, error) {
 
 func (inst *instance) adb(args ...string) ([]byte, error) {
 	if inst.cfg.Debug {
-		Logf(0, "executing adb %+v", args)
+		vm.Log.Logf(0, "executing adb %+v", args)
 	}
 	rpipe, wpipe, err := os.Pipe()
 	if err != nil {
@@ -191,7 +199,7 @@ func (inst *instance) adb(args ...string) ([]byte, error) {
 		select {
 		case <-time.After(time.Minute):
 			if inst.cfg.Debug {
-				Logf(0, "adb hanged")
+				vm.Log.Logf(0, "adb hanged")
 			}
 			cmd.Process.Kill()
 		case <-done:
@@ -201,18 +209,27 @@ func (inst *instance) adb(args ...string) ([]byte, error) {
 		close(done)
 		out, _ := ioutil.ReadAll(rpipe)
 		if inst.cfg.Debug {
-			Logf(0, "adb failed: %v\n%s", err, out)
+			vm.Log.Logf(0, "adb failed: %v\n%s", err, out)
 		}
 		return nil, fmt.Errorf("adb %+v failed: %v\n%s", args, err, out)
 	}
 	close(done)
 	if inst.cfg.Debug {
-		Logf(0, "adb returned")
+		vm.Log.Logf(0, "adb returned")
 	}
 	out, _ := ioutil.ReadAll(rpipe)
 	return out, nil
 }
 
+// Diagnose asks the kernel to dump stacks of blocked tasks (SysRq-w)
+// and backtraces of all CPUs (SysRq-l) to the console.
+func (inst *instance) Diagnose() []byte {
+	if _, err := inst.adb("shell", "echo w > /proc/sysrq-trigger; echo l > /proc/sysrq-trigger"); err != nil {
+		vm.Log.Logf(0, "%v: %v", inst.cfg.Name, err)
+	}
+	return nil
+}
+
 func (inst *instance) repair() error {
 	// Assume that the device is in a bad state initially and reboot it.
 	// Ignore errors, maybe we will manage to reboot it anyway.
@@ -252,64 +269,124 @@ func (inst *instance) waitForSsh() error {
 	return fmt.Errorf("instance is dead and unrepairable: %v", err)
 }
 
-func (inst *instance) checkBatteryLevel() error {
-	const (
-		minLevel      = 20
-		requiredLevel = 30
-	)
-	val, err := inst.getBatteryLevel(30)
+// batteryState is the part of 'dumpsys battery' output relevant for device safety.
+type batteryState struct {
+	level int // percent
+	temp  int // Celsius
+}
+
+const (
+	// Fuzzing is resumed after a pause only with these margins from the thresholds,
+	// so that the device does not flip-flop around them.
+	batteryMargin = 10
+	tempMargin    = 5
+	// Period of battery checks while fuzzing and during a pause.
+	batteryCheckPeriod = time.Minute
+)
+
+// waitForSafeState waits until the device is charged and cooled down enough to fuzz.
+func (inst *instance) waitForSafeState() error {
+	st, err := inst.getBatteryState(30)
 	if err != nil {
 		return err
 	}
-	if val >= minLevel {
-		Logf(0, "device %v: battery level %v%%, OK", inst.cfg.Device, val)
+	if reason := inst.unsafe(st, 0, 0); reason == "" {
+		vm.Log.Logf(0, "device %v: battery level %v%%, temperature %vC, OK", inst.cfg.Device, st.level, st.temp)
 		return nil
 	}
 	for {
-		Logf(0, "device %v: battery level %v%%, waiting for %v%%", inst.cfg.Device, val, requiredLevel)
-		if !vm.SleepInterruptible(time.Minute) {
+		vm.Log.Logf(0, "device %v: %v, fuzzing is paused", inst.cfg.Device, inst.unsafe(st, batteryMargin, tempMargin))
+		if !vm.SleepInterruptible(batteryCheckPeriod) {
 			return nil
 		}
-		val, err = inst.getBatteryLevel(0)
+		st, err = inst.getBatteryState(0)
 		if err != nil {
 			return err
 		}
-		if val >= requiredLevel {
+		if inst.unsafe(st, batteryMargin, tempMargin) == "" {
 			break
 		}
 	}
+	vm.Log.Logf(0, "device %v: battery level %v%%, temperature %vC, resuming fuzzing", inst.cfg.Device, st.level, st.temp)
 	return nil
 }
 
-func (inst *instance) getBatteryLevel(numRetry int) (int, error) {
-	out, err := inst.adb("shell", "dumpsys battery | grep level:")
+// unsafe returns the reason why fuzzing on the device must be paused,
+// or an empty string if the battery state is within the thresholds narrowed by the margins.
+func (inst *instance) unsafe(st batteryState, levelMargin, tempMargin int) string {
+	if minLevel := inst.cfg.MinBattery + levelMargin; st.level < minLevel {
+		return fmt.Sprintf("battery level %v%% is below %v%%", st.level, minLevel)
+	}
+	if maxTemp := inst.cfg.MaxTemp - tempMargin; inst.cfg.MaxTemp != 0 && st.temp > maxTemp {
+		return fmt.Sprintf("battery temperature %vC is above %vC", st.temp, maxTemp)
+	}
+	return ""
+}
 
-	// allow for retrying for devices that does not boot up so fast
-	for ; numRetry >= 0 && err != nil; numRetry-- {
-		if numRetry > 0 {
-			// sleep for 5 seconds before retrying
-			time.Sleep(5 * time.Second)
-			out, err = inst.adb("shell", "dumpsys battery | grep level:")
-		} else {
-			if err != nil {
-				return 0, err
-			}
+// monitorBattery periodically checks the battery state while a command runs
+// and sends the reason to unsafe once the device becomes unsafe to fuzz.
+func (inst *instance) monitorBattery(stop <-chan bool, unsafe chan<- string) {
+	ticker := time.NewTicker(batteryCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		st, err := inst.getBatteryState(0)
+		if err != nil {
+			// The device is probably busy or hanged, hangs are detected by the caller.
+			continue
+		}
+		if reason := inst.unsafe(st, 0, 0); reason != "" {
+			unsafe <- reason
+			return
 		}
 	}
-	val := 0
-	for _, c := range out {
-		if c >= '0' && c <= '9' {
-			val = val*10 + int(c) - '0'
+}
+
+func (inst *instance) getBatteryState(numRetry int) (batteryState, error) {
+	out, err := inst.adb("shell", "dumpsys battery")
+	// Allow for retrying for devices that don't boot up so fast.
+	for ; err != nil && numRetry > 0; numRetry-- {
+		time.Sleep(5 * time.Second)
+		out, err = inst.adb("shell", "dumpsys battery")
+	}
+	if err != nil {
+		return batteryState{}, err
+	}
+	return parseBatteryState(out)
+}
+
+// parseBatteryState parses 'dumpsys battery' output, which contains lines like
+// "level: 85" and "temperature: 310" (in tenths of a degree Celsius).
+func parseBatteryState(out []byte) (batteryState, error) {
+	var st batteryState
+	level, temp := -1, -1
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		colon := strings.IndexByte(line, ':')
+		if colon == -1 {
 			continue
 		}
-		if val != 0 {
-			break
+		val, err := strconv.Atoi(strings.TrimSpace(line[colon+1:]))
+		if err != nil {
+			continue
+		}
+		switch line[:colon] {
+		case "level":
+			level = val
+		case "temperature":
+			temp = val
 		}
 	}
-	if val == 0 {
-		return 0, fmt.Errorf("failed to parse 'dumpsys battery' output: %s", out)
+	if level == -1 || temp == -1 {
+		return st, fmt.Errorf("failed to parse 'dumpsys battery' output: %s", out)
 	}
-	return val, nil
+	st.level = level
+	st.temp = temp / 10
+	return st, nil
 }
 
 func (inst *instance) Close() {
@@ -337,7 +414,7 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 		return nil, nil, err
 	}
 	if inst.cfg.Debug {
-		Logf(0, "starting: adb shell %v", command)
+		vm.Log.Logf(0, "starting: adb shell %v", command)
 	}
 	adb := exec.Command(inst.cfg.Bin, "-s", inst.cfg.Device, "shell", "cd /data; "+command)
 	adb.Stdout = adbWpipe
@@ -366,20 +443,29 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 		}
 	}
 
+	unsafe := make(chan string, 1)
+	stopMonitor := make(chan bool)
+	go inst.monitorBattery(stopMonitor, unsafe)
+
 	go func() {
 		select {
 		case <-time.After(timeout):
 			signal(vm.TimeoutErr)
 		case <-stop:
 			signal(vm.TimeoutErr)
+		case reason := <-unsafe:
+			// Stop the run as if it timed out, the device pauses before the next run.
+			vm.Log.Logf(0, "device %v: %v, stopping fuzzing", inst.cfg.Device, reason)
+			signal(vm.TimeoutErr)
 		case <-inst.closed:
 			if inst.cfg.Debug {
-				Logf(0, "instance closed")
+				vm.Log.Logf(0, "instance closed")
 			}
 			signal(fmt.Errorf("instance closed"))
 		case err := <-merger.Err:
 			signal(err)
 		}
+		close(stopMonitor)
 		tty.Close()
 		adb.Process.Kill()
 		merger.Wait()
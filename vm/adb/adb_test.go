@@ -0,0 +1,58 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package adb
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/vm"
+)
+
+func TestParseBatteryState(t *testing.T) {
+	out := []byte(`Current Battery Service state:
+  AC powered: false
+  USB powered: true
+  status: 2
+  health: 2
+  present: true
+  level: 85
+  scale: 100
+  voltage: 4231
+  temperature: 312
+  technology: Li-ion
+`)
+	st, err := parseBatteryState(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.level != 85 || st.temp != 31 {
+		t.Fatalf("got level %v temp %v, want 85 31", st.level, st.temp)
+	}
+	if _, err := parseBatteryState([]byte("level: 85\n")); err == nil {
+		t.Fatalf("parsed output without temperature")
+	}
+}
+
+func TestUnsafe(t *testing.T) {
+	inst := &instance{cfg: &vm.Config{MinBattery: 20, MaxTemp: 45}}
+	tests := []struct {
+		st     batteryState
+		unsafe bool // with no margins
+		resume bool // with margins
+	}{
+		{batteryState{level: 85, temp: 30}, false, true},
+		{batteryState{level: 19, temp: 30}, true, false},
+		{batteryState{level: 25, temp: 30}, false, false},
+		{batteryState{level: 85, temp: 46}, true, false},
+		{batteryState{level: 85, temp: 42}, false, false},
+	}
+	for i, test := range tests {
+		if unsafe := inst.unsafe(test.st, 0, 0) != ""; unsafe != test.unsafe {
+			t.Errorf("#%v: unsafe %v, want %v", i, unsafe, test.unsafe)
+		}
+		if resume := inst.unsafe(test.st, batteryMargin, tempMargin) == ""; resume != test.resume {
+			t.Errorf("#%v: resume %v, want %v", i, resume, test.resume)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package bhyve runs FreeBSD VMs with bhyve on FreeBSD hosts.
+// Every VM boots a ZFS clone of a snapshot of the bhyve_dataset volume (so VMs don't
+// affect each other and the original image), its kernel console is an nmdm(4) device pair
+// and commands are run over ssh. VMs are attached to bhyve_bridge with a tap interface
+// and get their address from a DHCP server on the bridge, the address is found in the console output.
+package bhyve
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("bhyve", ctor)
+	vm.RegisterLeakChecker("bhyve", destroyLeakedTaps)
+}
+
+// Taps are marked with tapOwner followed by the VM workdir in their description,
+// so that taps leaked by crashed managers can be found.
+const tapOwner = "syzkaller:"
+
+var tapOwnerRe = regexp.MustCompile(`description: ` + tapOwner + `(\S+)`)
+
+type instance struct {
+	cfg      *vm.Config
+	name     string // bhyve VM name
+	snapshot string // ZFS snapshot of the dataset the clone is created from
+	clone    string // ZFS clone with the disk of the VM
+	tap      string
+	hostIP   string // address of the bridge, VM connects to the manager on it
+	ip       string // address of the VM
+	console  *exec.Cmd
+	bhyve    *exec.Cmd
+	waiterC  chan error
+	merger   *vm.OutputMerger
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:      cfg,
+		name:     cfg.Name,
+		snapshot: fmt.Sprintf("%v@%v", cfg.Dataset, cfg.Name),
+		clone:    fmt.Sprintf("%v-%v", cfg.Dataset, cfg.Name),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	hostIP, err := bridgeAddr(cfg.Bridge)
+	if err != nil {
+		return nil, err
+	}
+	inst.hostIP = hostIP
+	// Leftovers of a previous manager run.
+	inst.destroy()
+	if err := run("zfs", "snapshot", inst.snapshot); err != nil {
+		return nil, err
+	}
+	if err := run("zfs", "clone", inst.snapshot, inst.clone); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("ifconfig", "tap", "create").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tap: %v\n%s", err, out)
+	}
+	inst.tap = strings.TrimSpace(string(out))
+	if err := run("ifconfig", inst.tap, "description", tapOwner+cfg.Workdir); err != nil {
+		return nil, err
+	}
+	if err := run("ifconfig", cfg.Bridge, "addm", inst.tap); err != nil {
+		return nil, err
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "bhyve"
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 16 {
+		return fmt.Errorf("bad bhyve cpu: %v, want [1-16]", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad bhyve mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+// bridgeAddr returns IPv4 address of the bridge interface.
+func bridgeAddr(bridge string) (string, error) {
+	iface, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return "", fmt.Errorf("failed to find bridge %v: %v", bridge, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to get addresses of %v: %v", bridge, err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("bridge %v does not have an IPv4 address", bridge)
+}
+
+func run(bin string, args ...string) error {
+	if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v %v failed: %v\n%s", bin, strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+func (inst *instance) Close() {
+	if inst.bhyve != nil {
+		inst.bhyve.Process.Kill()
+		err := <-inst.waiterC
+		inst.waiterC <- err // repost it for waiting goroutines
+	}
+	if inst.console != nil {
+		inst.console.Process.Kill()
+		inst.console.Wait()
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+	}
+	inst.destroy()
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+// destroy releases host resources of the VM, errors are ignored as the resources may not exist.
+func (inst *instance) destroy() {
+	exec.Command("bhyvectl", "--destroy", "--vm="+inst.name).Run()
+	if inst.tap != "" {
+		exec.Command("ifconfig", inst.tap, "destroy").Run()
+	}
+	// Destroys the snapshot along with the clone.
+	exec.Command("zfs", "destroy", "-R", inst.snapshot).Run()
+}
+
+// destroyLeakedTaps destroys taps of VMs with workdirs in workdir that were not destroyed
+// (e.g. the manager crashed) and returns the number of destroyed taps.
+func destroyLeakedTaps(workdir string) int {
+	out, err := exec.Command("ifconfig", "-l").Output()
+	if err != nil {
+		return 0
+	}
+	prefix := filepath.Join(workdir, "instance-")
+	destroyed := 0
+	for _, iface := range strings.Fields(string(out)) {
+		if !strings.HasPrefix(iface, "tap") {
+			continue
+		}
+		out, err := exec.Command("ifconfig", iface).Output()
+		if err != nil {
+			continue
+		}
+		m := tapOwnerRe.FindSubmatch(out)
+		if m == nil || !strings.HasPrefix(string(m[1]), prefix) || !fileutil.StaleProcessTempDir(string(m[1])) {
+			continue
+		}
+		vm.Log.Logf(0, "destroying tap %v leaked by %s", iface, m[1])
+		if exec.Command("ifconfig", iface, "destroy").Run() == nil {
+			destroyed++
+		}
+	}
+	return destroyed
+}
+
+func (inst *instance) consoleDev(side string) string {
+	return fmt.Sprintf("/dev/nmdm-%v%v", inst.name, side)
+}
+
+var dhcpRe = regexp.MustCompile(`bound to ([0-9]+\.[0-9]+\.[0-9]+\.[0-9]+)`)
+
+func (inst *instance) boot() error {
+	// bhyve writes to the A side of the nmdm pair, we read the B side (the pair is created on open).
+	// The console must be opened before the VM starts, otherwise early output is lost.
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	inst.console = exec.Command("cu", "-l", inst.consoleDev("B"), "-s", "115200")
+	inst.console.Stdout = conWpipe
+	inst.console.Stderr = conWpipe
+	if _, err := inst.console.StdinPipe(); err != nil { // cu exits on stdin EOF
+		conRpipe.Close()
+		conWpipe.Close()
+		return err
+	}
+	if err := inst.console.Start(); err != nil {
+		conRpipe.Close()
+		conWpipe.Close()
+		inst.console = nil
+		return fmt.Errorf("failed to start cu: %v", err)
+	}
+	conWpipe.Close()
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("console", conRpipe)
+
+	disk := filepath.Join("/dev/zvol", inst.clone)
+	mem := fmt.Sprintf("%vM", inst.cfg.Mem)
+	loader := exec.Command("bhyveload", "-c", inst.consoleDev("A"), "-m", mem, "-d", disk, inst.name)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: bhyveload %#v", loader.Args[1:])
+	}
+	if out, err := loader.CombinedOutput(); err != nil {
+		return fmt.Errorf("bhyveload failed: %v\n%s", err, out)
+	}
+	args := []string{
+		"-H", "-A", "-P",
+		"-c", strconv.Itoa(inst.cfg.Cpu),
+		"-m", mem,
+		"-s", "0:0,hostbridge",
+		"-s", "1:0,lpc",
+		"-s", "2:0,virtio-net," + inst.tap,
+		"-s", "3:0,virtio-blk," + disk,
+		"-l", "com1," + inst.consoleDev("A"),
+	}
+	if inst.cfg.BinArgs != "" {
+		args = append(args, strings.Fields(inst.cfg.BinArgs)...)
+	}
+	args = append(args, inst.name)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: %v %#v", inst.cfg.Bin, args)
+	}
+	bhyve := exec.Command(inst.cfg.Bin, args...)
+	if inst.cfg.Debug {
+		bhyve.Stdout = os.Stdout
+		bhyve.Stderr = os.Stdout
+	}
+	if err := bhyve.Start(); err != nil {
+		return fmt.Errorf("failed to start %v %+v: %v", inst.cfg.Bin, args, err)
+	}
+	inst.bhyve = bhyve
+	inst.waiterC = make(chan error, 1)
+	go func() {
+		err := bhyve.Wait()
+		inst.waiterC <- err
+	}()
+
+	// Wait for the VM to get an address and for ssh server to come up.
+	var bootOutput []byte
+	timeout := time.After(10 * time.Minute)
+	for inst.ip == "" {
+		select {
+		case out := <-inst.merger.Output:
+			bootOutput = append(bootOutput, out...)
+			if m := dhcpRe.FindSubmatch(bootOutput); m != nil {
+				inst.ip = string(m[1])
+			}
+		case err := <-inst.merger.Err:
+			return fmt.Errorf("console failed: %v\n%s", err, bootOutput)
+		case err := <-inst.waiterC:
+			inst.waiterC <- err // repost it for Close
+			return fmt.Errorf("bhyve stopped: %v\n%s", err, bootOutput)
+		case <-timeout:
+			return fmt.Errorf("VM did not get an address:\n%s", bootOutput)
+		case <-vm.Shutdown:
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	start := time.Now()
+	for {
+		if _, err := inst.ssh(time.Minute, "true"); err == nil {
+			break
+		}
+		select {
+		case err := <-inst.waiterC:
+			inst.waiterC <- err // repost it for Close
+			return fmt.Errorf("bhyve stopped: %v", err)
+		default:
+		}
+		if time.Since(start) > 10*time.Minute {
+			return fmt.Errorf("ssh server did not start on %v", inst.ip)
+		}
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	inst.merger.Drain()
+	return nil
+}
+
+func (inst *instance) ssh(timeout time.Duration, command string) ([]byte, error) {
+	return vm.SSH(append(inst.sshArgs("-p"), "root@"+inst.ip), timeout, command)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostIP, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDst := filepath.Join("/root", filepath.Base(hostSrc))
+	args := append(inst.sshArgs("-P"), hostSrc, "root@"+inst.ip+":"+vmDst)
+	cmd := exec.Command("scp", args...)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: scp %#v", args)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stdout
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-time.After(3 * time.Minute):
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil {
+		return "", err
+	}
+	return vmDst, nil
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("ssh", rpipe)
+
+	args := append(inst.sshArgs("-p"), "root@"+inst.ip, command)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: ssh %#v", args)
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	errc := make(chan error, 1)
+	signal := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	go func() {
+		select {
+		case <-time.After(timeout):
+			signal(vm.TimeoutErr)
+		case <-stop:
+			signal(vm.TimeoutErr)
+		case err := <-inst.merger.Err:
+			signal(err)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	return inst.merger.Output, errc, nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		"-i", inst.cfg.Sshkey,
+		portArg, "22",
+		"-F", "/dev/null",
+		"-o", "ConnectionAttempts=10",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package bhyve
+
+import (
+	"testing"
+)
+
+func TestDhcpAddr(t *testing.T) {
+	tests := []struct {
+		output string
+		ip     string
+	}{
+		{"DHCPREQUEST on vtnet0 to 255.255.255.255 port 67\nDHCPACK from 10.0.0.1\nbound to 10.0.0.17 -- renewal in 43200 seconds.\n", "10.0.0.17"},
+		{"DHCPDISCOVER on vtnet0 to 255.255.255.255 port 67 interval 7\n", ""},
+	}
+	for _, test := range tests {
+		ip := ""
+		if m := dhcpRe.FindStringSubmatch(test.output); m != nil {
+			ip = m[1]
+		}
+		if ip != test.ip {
+			t.Errorf("got ip %q, want %q for output:\n%v", ip, test.ip, test.output)
+		}
+	}
+}
+
+func TestTapOwner(t *testing.T) {
+	tests := []struct {
+		output string
+		dir    string
+	}{
+		{"tap3: flags=8943<UP,BROADCAST,RUNNING,PROMISC,SIMPLEX,MULTICAST> metric 0 mtu 1500\n" +
+			"\tdescription: syzkaller:/syz/workdir/instance-3\n\toptions=80000<LINKSTATE>\n", "/syz/workdir/instance-3"},
+		{"tap0: flags=8902<BROADCAST,PROMISC,SIMPLEX,MULTICAST> metric 0 mtu 1500\n" +
+			"\tdescription: vm-public\n", ""},
+	}
+	for _, test := range tests {
+		dir := ""
+		if m := tapOwnerRe.FindStringSubmatch(test.output); m != nil {
+			dir = m[1]
+		}
+		if dir != test.dir {
+			t.Errorf("got dir %q, want %q for output:\n%v", dir, test.dir, test.output)
+		}
+	}
+}
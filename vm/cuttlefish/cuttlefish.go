@@ -0,0 +1,311 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package cuttlefish runs Android Cuttlefish virtual devices (crosvm based) as VMs.
+// bin is the Cuttlefish host package dir (with bin/launch_cvd, bin/stop_cvd and bin/adb),
+// image is the dir with Android images; kernel, initrd and cmdline replace the ones from the images.
+// Every VM is a separate Cuttlefish instance with its runtime files in the VM workdir.
+// Commands are run over adb, the kernel console is read from kernel.log of the instance.
+// When a device reboots because of a kernel crash, its console-ramoops from pstore
+// are appended to the output, so that crashes missed by the console are still reported.
+package cuttlefish
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("cuttlefish", ctor)
+}
+
+const (
+	// adb port of the first instance, instance N listens on adbBasePort+N-1.
+	adbBasePort = 6520
+	// Marks ramoops of a crashed boot in the output.
+	ramoopsHeader = "\nconsole-ramoops of the previous boot:\n"
+)
+
+type instance struct {
+	cfg     *vm.Config
+	num     int    // Cuttlefish instance number
+	serial  string // adb serial of the device
+	bootID  string // changes when the device reboots
+	started bool
+	closed  chan bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:    cfg,
+		num:    cfg.Index + 1,
+		closed: make(chan bool),
+	}
+	inst.serial = fmt.Sprintf("127.0.0.1:%v", adbBasePort+inst.num-1)
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		return fmt.Errorf("bin is not specified (required for cuttlefish, host package dir)")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Bin, "bin", "launch_cvd")); err != nil {
+		return fmt.Errorf("bad cuttlefish host package %v: %v", cfg.Bin, err)
+	}
+	if fi, err := os.Stat(cfg.Image); err != nil || !fi.IsDir() {
+		return fmt.Errorf("image must be a dir with Android images (required for cuttlefish): %v", cfg.Image)
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 64 {
+		return fmt.Errorf("bad cuttlefish cpu: %v, want [1-64]", cfg.Cpu)
+	}
+	if cfg.Mem < 1024 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad cuttlefish mem: %v, want [1024-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+// launchArgs returns arguments of launch_cvd for the instance.
+func launchArgs(cfg *vm.Config, num int) []string {
+	args := []string{
+		"--daemon",
+		"--report_anonymous_usage_stats=n",
+		"--base_instance_num=" + strconv.Itoa(num),
+		"--system_image_dir=" + cfg.Image,
+		"--cpus=" + strconv.Itoa(cfg.Cpu),
+		"--memory_mb=" + strconv.Itoa(cfg.Mem),
+	}
+	if cfg.Kernel != "" {
+		args = append(args, "--kernel_path="+cfg.Kernel)
+	}
+	if cfg.Initrd != "" {
+		args = append(args, "--initramfs_path="+cfg.Initrd)
+	}
+	// Crashes must be reported rather than silently rebooting the device,
+	// the reboot after panic lets us collect ramoops.
+	cmdline := "panic_on_warn=1 oops=panic panic=10 " + cfg.Cmdline
+	args = append(args, "--extra_kernel_cmdline="+strings.TrimSpace(cmdline))
+	return append(args, strings.Fields(cfg.BinArgs)...)
+}
+
+// cvd runs a Cuttlefish host tool with the instance runtime dir as HOME.
+func (inst *instance) cvd(timeout time.Duration, tool string, args ...string) ([]byte, error) {
+	cmd := exec.Command(filepath.Join(inst.cfg.Bin, "bin", tool), args...)
+	cmd.Env = append(os.Environ(), "HOME="+inst.cfg.Workdir)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: %v %#v", tool, args)
+	}
+	out, err := vm.RunTimeout(cmd, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%v %+v failed: %v\n%s", tool, args, err, out)
+	}
+	return out, nil
+}
+
+func (inst *instance) adb(timeout time.Duration, args ...string) ([]byte, error) {
+	return inst.cvd(timeout, "adb", append([]string{"-s", inst.serial}, args...)...)
+}
+
+// boot launches the device and waits until Android finishes booting and adb is root.
+// launch_cvd returns once the device is booted, but adb connection to it is set up separately.
+func (inst *instance) boot() error {
+	// Leftovers of a previous manager run.
+	inst.cvd(time.Minute, "stop_cvd")
+	inst.started = true
+	if _, err := inst.cvd(10*time.Minute, "launch_cvd", launchArgs(inst.cfg, inst.num)...); err != nil {
+		return err
+	}
+	if err := inst.waitForDevice(5 * time.Minute); err != nil {
+		return err
+	}
+	// Switch to root, adbd restarts and the connection needs to be set up again.
+	if _, err := inst.adb(time.Minute, "root"); err != nil {
+		return err
+	}
+	if err := inst.waitForDevice(time.Minute); err != nil {
+		return err
+	}
+	bootID, err := inst.getBootID()
+	if err != nil {
+		return err
+	}
+	inst.bootID = bootID
+	// Remove temp files from previous runs.
+	inst.adb(time.Minute, "shell", "rm -Rf /data/syzkaller*")
+	return nil
+}
+
+func (inst *instance) getBootID() (string, error) {
+	out, err := inst.adb(time.Minute, "shell", "cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// waitForDevice connects adb to the device and waits for sys.boot_completed.
+func (inst *instance) waitForDevice(timeout time.Duration) error {
+	start := time.Now()
+	var err error
+	for time.Since(start) < timeout {
+		inst.cvd(time.Minute, "adb", "connect", inst.serial)
+		var out []byte
+		if out, err = inst.adb(time.Minute, "shell", "getprop sys.boot_completed"); err == nil {
+			if strings.TrimSpace(string(out)) == "1" {
+				return nil
+			}
+			err = fmt.Errorf("boot is not completed")
+		}
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	return fmt.Errorf("device %v did not come up: %v", inst.serial, err)
+}
+
+// readRamoops waits for the device to reboot after a crash and returns ramoops of the crashed boot.
+// It returns nil if the device did not reboot (e.g. the command just exited).
+func (inst *instance) readRamoops() []byte {
+	if inst.waitForDevice(2*time.Minute) != nil {
+		return nil
+	}
+	bootID, err := inst.getBootID()
+	if err != nil || bootID == inst.bootID {
+		return nil
+	}
+	inst.bootID = bootID
+	out, err := inst.adb(time.Minute, "shell", "cat /sys/fs/pstore/console-ramoops*")
+	if err != nil || len(bytes.TrimSpace(out)) == 0 {
+		return nil
+	}
+	return append([]byte(ramoopsHeader), out...)
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	if inst.started {
+		if _, err := inst.cvd(5*time.Minute, "stop_cvd"); err != nil {
+			vm.Log.Logf(0, "%v: %v", inst.cfg.Name, err)
+		}
+	}
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	// Instances have separate adb servers on the device side, so the same port can be used.
+	devicePort := 35099
+	if _, err := inst.adb(time.Minute, "reverse", fmt.Sprintf("tcp:%v", devicePort), fmt.Sprintf("tcp:%v", port)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("127.0.0.1:%v", devicePort), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDst := filepath.Join("/data", filepath.Base(hostSrc))
+	if _, err := inst.adb(3*time.Minute, "push", hostSrc, vmDst); err != nil {
+		return "", err
+	}
+	return vmDst, nil
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	// kernel.log is written by crosvm from the serial console of the device.
+	con := exec.Command("tail", "-n", "0", "-F", filepath.Join(inst.cfg.Workdir, "cuttlefish_runtime", "kernel.log"))
+	con.Stdout = conWpipe
+	con.Stderr = conWpipe
+	if err := con.Start(); err != nil {
+		conRpipe.Close()
+		conWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to start tail: %v", err)
+	}
+	conWpipe.Close()
+
+	adbRpipe, adbWpipe, err := vm.LongPipe()
+	if err != nil {
+		con.Process.Kill()
+		conRpipe.Close()
+		return nil, nil, err
+	}
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "starting: adb shell %v", command)
+	}
+	adb := exec.Command(filepath.Join(inst.cfg.Bin, "bin", "adb"), "-s", inst.serial, "shell", "cd /data; "+command)
+	adb.Stdout = adbWpipe
+	adb.Stderr = adbWpipe
+	if err := adb.Start(); err != nil {
+		con.Process.Kill()
+		conRpipe.Close()
+		adbRpipe.Close()
+		adbWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to start adb: %v", err)
+	}
+	adbWpipe.Close()
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	merger.Add("console", conRpipe)
+	merger.Add("adb", adbRpipe)
+
+	errc := make(chan error, 1)
+	signal := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	go func() {
+		select {
+		case <-time.After(timeout):
+			signal(vm.TimeoutErr)
+		case <-stop:
+			signal(vm.TimeoutErr)
+		case <-inst.closed:
+			signal(fmt.Errorf("instance closed"))
+		case err := <-merger.Err:
+			// adb connection is lost when the device reboots after a crash,
+			// the crash may be only in ramoops if the console did not get it.
+			if ramoops := inst.readRamoops(); ramoops != nil {
+				select {
+				case merger.Output <- ramoops:
+				default:
+				}
+			}
+			signal(err)
+		}
+		con.Process.Kill()
+		adb.Process.Kill()
+		merger.Wait()
+		con.Wait()
+		adb.Wait()
+	}()
+	return merger.Output, errc, nil
+}
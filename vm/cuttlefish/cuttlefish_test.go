@@ -0,0 +1,37 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package cuttlefish
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/syzkaller/vm"
+)
+
+func TestLaunchArgs(t *testing.T) {
+	cfg := &vm.Config{
+		Image:   "/aosp/out/target/product/vsoc_x86_64",
+		Kernel:  "/linux/arch/x86/boot/bzImage",
+		Cmdline: "kasan.fault=panic",
+		Cpu:     2,
+		Mem:     4096,
+		BinArgs: "--gpu_mode=guest_swiftshader  --start_webrtc=false",
+	}
+	want := []string{
+		"--daemon",
+		"--report_anonymous_usage_stats=n",
+		"--base_instance_num=3",
+		"--system_image_dir=/aosp/out/target/product/vsoc_x86_64",
+		"--cpus=2",
+		"--memory_mb=4096",
+		"--kernel_path=/linux/arch/x86/boot/bzImage",
+		"--extra_kernel_cmdline=panic_on_warn=1 oops=panic panic=10 kasan.fault=panic",
+		"--gpu_mode=guest_swiftshader",
+		"--start_webrtc=false",
+	}
+	if got := launchArgs(cfg, 3); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got args:\n%q\nwant:\n%q", got, want)
+	}
+}
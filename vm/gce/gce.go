@@ -52,7 +52,7 @@ func initGCE() {
 	if err != nil {
 		Fatalf("failed to init gce: %v", err)
 	}
-	Logf(0, "gce initialized: running on %v, internal IP %v, project %v, zone %v", GCE.Instance, GCE.InternalIP, GCE.ProjectID, GCE.ZoneID)
+	vm.Log.Logf(0, "gce initialized: running on %v, internal IP %v, project %v, zone %v", GCE.Instance, GCE.InternalIP, GCE.ProjectID, GCE.ZoneID)
 }
 
 func ctor(cfg *vm.Config) (vm.Instance, error) {
@@ -75,11 +75,11 @@ func ctor(cfg *vm.Config) (vm.Instance, error) {
 		return nil, fmt.Errorf("failed to read file: %v", err)
 	}
 
-	Logf(0, "deleting instance: %v", cfg.Name)
+	vm.Log.Logf(0, "deleting instance: %v", cfg.Name)
 	if err := GCE.DeleteInstance(cfg.Name, true); err != nil {
 		return nil, err
 	}
-	Logf(0, "creating instance: %v", cfg.Name)
+	vm.Log.Logf(0, "creating instance: %v", cfg.Name)
 	ip, err := GCE.CreateInstance(cfg.Name, cfg.MachineType, cfg.Image, string(gceKeyPub))
 	if err != nil {
 		return nil, err
@@ -96,7 +96,7 @@ func ctor(cfg *vm.Config) (vm.Instance, error) {
 		sshKey = gceKey
 		sshUser = "syzkaller"
 	}
-	Logf(0, "wait instance to boot: %v (%v)", cfg.Name, ip)
+	vm.Log.Logf(0, "wait instance to boot: %v (%v)", cfg.Name, ip)
 	if err := waitInstanceBoot(ip, sshKey, sshUser); err != nil {
 		return nil, err
 	}
@@ -217,7 +217,7 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 			// Check if the instance was terminated due to preemption or host maintenance.
 			time.Sleep(5 * time.Second) // just to avoid any GCE races
 			if !GCE.IsInstanceRunning(inst.name) {
-				Logf(1, "%v: ssh exited but instance is not running", inst.name)
+				vm.Log.Logf(1, "%v: ssh exited but instance is not running", inst.name)
 				err = vm.TimeoutErr
 			}
 			signal(err)
@@ -0,0 +1,328 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package gvisor runs gVisor sandboxes (runsc containers) as VMs, the tested kernel is the Sentry.
+// kernel is the runsc binary, image is the root file system (a dir) of the sandbox.
+// Every VM is a separate sandbox with its runsc state in the VM workdir, commands are run
+// with runsc exec and the Sentry log (including its panics) is the console.
+// Sandboxes use the host network and start in a fraction of a second,
+// so crashed VMs are recreated instead of being rebooted.
+package gvisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("gvisor", ctor)
+}
+
+const (
+	// Mount point of the shared dir in the sandbox, commands run there.
+	vmDir = "/syzkaller"
+	// The init process of the sandbox only keeps it alive.
+	initCmd = "/bin/sleep 1000000000"
+)
+
+type instance struct {
+	cfg    *vm.Config
+	id     string // container id
+	bundle string // OCI bundle dir
+	share  string // host side of vmDir
+	sentry *exec.Cmd
+	merger *vm.OutputMerger
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:    cfg,
+		id:     cfg.Name,
+		bundle: filepath.Join(cfg.Workdir, "bundle"),
+		share:  filepath.Join(cfg.Workdir, "share"),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if _, err := os.Stat(cfg.Kernel); err != nil {
+		return fmt.Errorf("kernel must be the runsc binary (required for gvisor): %v", err)
+	}
+	if fi, err := os.Stat(cfg.Image); err != nil || !fi.IsDir() {
+		return fmt.Errorf("image must be a dir with the root file system (required for gvisor): %v", cfg.Image)
+	}
+	return nil
+}
+
+// runscArgs returns global flags of runsc for the instance: state of every sandbox is kept
+// in its workdir, stuck tasks panic the Sentry, so that they are reported as crashes,
+// and the Sentry log goes to stderr of runsc run (the console).
+func runscArgs(cfg *vm.Config) []string {
+	args := []string{
+		"-root", filepath.Join(cfg.Workdir, "runsc"),
+		"-network", "host",
+		"-watchdog-action", "panic",
+		"-alsologtostderr",
+	}
+	return append(args, strings.Fields(cfg.BinArgs)...)
+}
+
+type ociSpec struct {
+	Version  string     `json:"ociVersion"`
+	Process  ociProcess `json:"process"`
+	Root     ociRoot    `json:"root"`
+	Hostname string     `json:"hostname"`
+	Mounts   []ociMount `json:"mounts"`
+}
+
+type ociProcess struct {
+	User         ociUser         `json:"user"`
+	Args         []string        `json:"args"`
+	Env          []string        `json:"env"`
+	Cwd          string          `json:"cwd"`
+	Capabilities ociCapabilities `json:"capabilities"`
+}
+
+type ociUser struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+type ociCapabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Inheritable []string `json:"inheritable"`
+	Permitted   []string `json:"permitted"`
+}
+
+type ociRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options"`
+}
+
+// Programs are executed as root with all capabilities, like in VMs.
+var capabilities = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER", "CAP_FSETID",
+	"CAP_KILL", "CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP", "CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST", "CAP_NET_ADMIN", "CAP_NET_RAW",
+	"CAP_IPC_LOCK", "CAP_IPC_OWNER", "CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE", "CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE", "CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD", "CAP_LEASE",
+	"CAP_AUDIT_WRITE", "CAP_AUDIT_CONTROL", "CAP_SETFCAP",
+}
+
+// spec returns the OCI runtime spec of the sandbox. The root file system is shared
+// by all instances, so it is read-only, files are written to the shared dir and /tmp.
+func spec(cfg *vm.Config, share string) *ociSpec {
+	return &ociSpec{
+		Version: "1.0.0",
+		Process: ociProcess{
+			Args: strings.Fields(initCmd),
+			Env:  []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+			Cwd:  vmDir,
+			Capabilities: ociCapabilities{
+				Bounding:    capabilities,
+				Effective:   capabilities,
+				Inheritable: capabilities,
+				Permitted:   capabilities,
+			},
+		},
+		Root: ociRoot{
+			Path:     cfg.Image,
+			Readonly: true,
+		},
+		Hostname: "syzkaller",
+		Mounts: []ociMount{
+			{Destination: vmDir, Type: "bind", Source: share, Options: []string{"rbind", "rw"}},
+			{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw"}},
+		},
+	}
+}
+
+func (inst *instance) runsc(timeout time.Duration, args ...string) ([]byte, error) {
+	args = append(runscArgs(inst.cfg), args...)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: runsc %#v", args)
+	}
+	cmd := exec.Command(inst.cfg.Kernel, args...)
+	out, err := vm.RunTimeout(cmd, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("runsc %+v failed: %v\n%s", args, err, out)
+	}
+	return out, nil
+}
+
+// boot starts the sandbox and waits until its init process is running.
+func (inst *instance) boot() error {
+	for _, dir := range []string{inst.bundle, inst.share} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(spec(inst.cfg, inst.share), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(inst.bundle, "config.json"), data, 0666); err != nil {
+		return err
+	}
+
+	// Leftovers of a previous manager run.
+	inst.runsc(time.Minute, "delete", "-force", inst.id)
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	args := append(runscArgs(inst.cfg), "run", "-bundle", inst.bundle, inst.id)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: runsc %#v", args)
+	}
+	inst.sentry = exec.Command(inst.cfg.Kernel, args...)
+	inst.sentry.Stdout = conWpipe
+	inst.sentry.Stderr = conWpipe
+	if err := inst.sentry.Start(); err != nil {
+		conRpipe.Close()
+		conWpipe.Close()
+		inst.sentry = nil
+		return fmt.Errorf("failed to start runsc: %v", err)
+	}
+	conWpipe.Close()
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("sentry", conRpipe)
+
+	var bootOutput []byte
+	start := time.Now()
+	for {
+		out, err := inst.runsc(time.Minute, "state", inst.id)
+		if err == nil {
+			state := new(struct {
+				Status string `json:"status"`
+			})
+			if err := json.Unmarshal(out, state); err == nil && state.Status == "running" {
+				break
+			}
+		}
+		if bootOutput, err = inst.merger.Collect(bootOutput); err != nil {
+			return fmt.Errorf("sandbox exited: %v\n%s", err, bootOutput)
+		}
+		if time.Since(start) > time.Minute {
+			return fmt.Errorf("sandbox did not start:\n%s", bootOutput)
+		}
+		if !vm.SleepInterruptible(time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	inst.merger.Drain()
+	return nil
+}
+
+func (inst *instance) Close() {
+	if inst.sentry != nil {
+		if _, err := inst.runsc(time.Minute, "delete", "-force", inst.id); err != nil {
+			vm.Log.Logf(0, "%v: %v", inst.id, err)
+		}
+		inst.sentry.Process.Kill()
+		inst.sentry.Wait()
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+	}
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	// The sandbox uses the host network.
+	return fmt.Sprintf("127.0.0.1:%v", port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	base := filepath.Base(hostSrc)
+	if err := fileutil.CopyFile(hostSrc, filepath.Join(inst.share, base), false); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(filepath.Join(inst.share, base), 0777); err != nil {
+		return "", err
+	}
+	return vmDir + "/" + base, nil
+}
+
+func (inst *instance) SharedDir() (string, string) {
+	return inst.share, vmDir
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("exec", rpipe)
+
+	args := append(runscArgs(inst.cfg), "exec", "-cwd", vmDir, inst.id, "/bin/sh", "-c", command)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: runsc %#v", args)
+	}
+	cmd := exec.Command(inst.cfg.Kernel, args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	errc := make(chan error, 1)
+	signal := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	go func() {
+		select {
+		case <-time.After(timeout):
+			signal(vm.TimeoutErr)
+		case <-stop:
+			signal(vm.TimeoutErr)
+		case err := <-inst.merger.Err:
+			// Either the command exited or the Sentry died (e.g. panicked).
+			signal(err)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	return inst.merger.Output, errc, nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package gvisor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/syzkaller/vm"
+)
+
+func TestRunscArgs(t *testing.T) {
+	cfg := &vm.Config{
+		Workdir: "/syzkaller/workdir/instance-0",
+		BinArgs: "-platform kvm  -strace",
+	}
+	want := []string{
+		"-root", "/syzkaller/workdir/instance-0/runsc",
+		"-network", "host",
+		"-watchdog-action", "panic",
+		"-alsologtostderr",
+		"-platform", "kvm",
+		"-strace",
+	}
+	if got := runscArgs(cfg); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got args:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestSpec(t *testing.T) {
+	cfg := &vm.Config{
+		Image: "/rootfs",
+	}
+	s := spec(cfg, "/syzkaller/workdir/instance-0/share")
+	if s.Root.Path != "/rootfs" || !s.Root.Readonly {
+		t.Errorf("bad root: %+v", s.Root)
+	}
+	if !reflect.DeepEqual(s.Process.Args, []string{"/bin/sleep", "1000000000"}) || s.Process.Cwd != vmDir {
+		t.Errorf("bad process: %+v", s.Process)
+	}
+	if len(s.Mounts) == 0 || s.Mounts[0].Destination != vmDir ||
+		s.Mounts[0].Source != "/syzkaller/workdir/instance-0/share" {
+		t.Errorf("bad mounts: %+v", s.Mounts)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package hyperv runs VMs with Hyper-V on Windows hosts.
+// VMs are controlled with PowerShell (powershell.exe, so syz-manager can run either
+// natively or under WSL). Every VM boots a differencing disk of the image (a VHDX file),
+// its kernel console is the COM1 port connected to a named pipe, and commands are
+// run over ssh. The address of a VM is reported by Hyper-V integration services,
+// so the image must run the KVP daemon (hv_kvp_daemon for Linux guests).
+// Windows guests have no text console, the kernel debugger (kd) is attached to COM1 instead
+// and prints analysis of bugchecks, commands are run over ssh as Administrator.
+package hyperv
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("hyperv", ctor)
+}
+
+type instance struct {
+	cfg     *vm.Config
+	name    string // Hyper-V VM name, also name of the console pipe
+	hostIP  string // address of the host on the virtual switch
+	ip      string // address of the VM
+	console *exec.Cmd
+	merger  *vm.OutputMerger
+	created bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:  cfg,
+		name: "syz-" + cfg.Name,
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	// Leftovers of a previous manager run.
+	inst.destroy()
+	inst.created = true
+	script := fmt.Sprintf(createScript, psQuote(inst.name), psQuote(cfg.Image), psQuote(cfg.Switch), cfg.Mem, cfg.Cpu)
+	if _, err := inst.powershell(10*time.Minute, script); err != nil {
+		return nil, err
+	}
+	out, err := inst.powershell(time.Minute, fmt.Sprintf(hostIPScript, psQuote(cfg.Switch)))
+	if err != nil {
+		return nil, err
+	}
+	inst.hostIP = strings.TrimSpace(string(out))
+	if net.ParseIP(inst.hostIP) == nil {
+		return nil, fmt.Errorf("failed to find host address on switch %v: %q", cfg.Switch, out)
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Switch == "" {
+		cfg.Switch = "Default Switch"
+	}
+	if cfg.OS == "windows" && cfg.Bin == "" {
+		cfg.Bin = "kd.exe"
+	}
+	if cfg.Image == "" {
+		return fmt.Errorf("image is not specified (required for hyperv, VHDX file)")
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	if cfg.Cpu <= 0 || cfg.Cpu > 64 {
+		return fmt.Errorf("bad hyperv cpu: %v, want [1-64]", cfg.Cpu)
+	}
+	if cfg.Mem < 512 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad hyperv mem: %v, want [512-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+// psQuote quotes s as a PowerShell string literal.
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+const (
+	createScript = `$ErrorActionPreference = 'Stop'
+$name = %[1]v
+$disk = Join-Path (Split-Path %[2]v) "$name.vhdx"
+New-VHD -Path $disk -ParentPath %[2]v -Differencing | Out-Null
+New-VM -Name $name -Generation 1 -MemoryStartupBytes %[4]vMB -VHDPath $disk -SwitchName %[3]v | Out-Null
+Set-VM -Name $name -ProcessorCount %[5]v -AutomaticStopAction TurnOff -CheckpointType Disabled
+Set-VMComPort -VMName $name -Number 1 -Path "\\.\pipe\$name"
+`
+	hostIPScript = `$ErrorActionPreference = 'Stop'
+(Get-NetIPAddress -InterfaceAlias ("vEthernet (" + %v + ")") -AddressFamily IPv4 | Select-Object -First 1).IPAddress
+`
+	vmIPScript = `$ErrorActionPreference = 'Stop'
+(Get-VMNetworkAdapter -VMName %v).IPAddresses | Where-Object { $_ -match '^[0-9.]+$' } | Select-Object -First 1
+`
+	// Hyper-V creates the pipe server when the VM starts, Connect waits for it.
+	consoleScript = `$ErrorActionPreference = 'Stop'
+$pipe = New-Object System.IO.Pipes.NamedPipeClientStream('.', %v, [System.IO.Pipes.PipeDirection]::In)
+$pipe.Connect(60000)
+$pipe.CopyTo([Console]::OpenStandardOutput())
+`
+	// Commands of kd for Windows guests, they are executed when a bugcheck breaks into the debugger.
+	// kd quits after the analysis, which ends the console output of the hanged VM.
+	kdCommands    = "!analyze -v\nq\n"
+	destroyScript = `$vm = Get-VM -Name %[1]v -ErrorAction SilentlyContinue
+if ($vm) {
+	Stop-VM -VM $vm -TurnOff -Force -ErrorAction SilentlyContinue
+	Remove-VM -VM $vm -Force
+}
+Remove-Item -Path (Join-Path (Split-Path %[2]v) (%[1]v + ".vhdx")) -Force -ErrorAction SilentlyContinue
+`
+)
+
+func (inst *instance) powershell(timeout time.Duration, script string) ([]byte, error) {
+	cmd := psCommand(script)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running powershell:\n%v", script)
+	}
+	out, err := vm.RunTimeout(cmd, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("powershell failed: %v\n%s\n%s", err, script, out)
+	}
+	return out, nil
+}
+
+func psCommand(script string) *exec.Cmd {
+	return exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+}
+
+func (inst *instance) Close() {
+	if inst.console != nil {
+		inst.console.Process.Kill()
+		inst.console.Wait()
+	}
+	if inst.created {
+		// Stops the VM as well, which closes the console pipe.
+		inst.destroy()
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+	}
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+// destroy removes the VM and its disk, if they exist.
+func (inst *instance) destroy() {
+	script := fmt.Sprintf(destroyScript, psQuote(inst.name), psQuote(inst.cfg.Image))
+	if _, err := inst.powershell(5*time.Minute, script); err != nil {
+		vm.Log.Logf(0, "%v: failed to destroy VM: %v", inst.name, err)
+	}
+}
+
+func (inst *instance) boot() error {
+	// The console must be connected before the VM starts, otherwise early output is lost.
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	if inst.cfg.OS == "windows" {
+		// reconnect makes kd wait for the pipe, Hyper-V creates it when the VM starts.
+		inst.console = exec.Command(inst.cfg.Bin, "-k",
+			fmt.Sprintf(`com:pipe,port=\\.\pipe\%v,resets=0,reconnect`, inst.name))
+		inst.console.Stdin = strings.NewReader(kdCommands)
+	} else {
+		inst.console = psCommand(fmt.Sprintf(consoleScript, psQuote(inst.name)))
+	}
+	inst.console.Stdout = conWpipe
+	inst.console.Stderr = conWpipe
+	if err := inst.console.Start(); err != nil {
+		conRpipe.Close()
+		conWpipe.Close()
+		inst.console = nil
+		return fmt.Errorf("failed to start console: %v", err)
+	}
+	conWpipe.Close()
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("console", conRpipe)
+
+	if _, err := inst.powershell(5*time.Minute, "Start-VM -Name "+psQuote(inst.name)); err != nil {
+		return err
+	}
+
+	// Hyper-V reports the address via the KVP daemon, poll it until ssh is up.
+	var bootOutput []byte
+	start := time.Now()
+	for {
+		if inst.ip == "" {
+			out, err := inst.powershell(time.Minute, fmt.Sprintf(vmIPScript, psQuote(inst.name)))
+			if err != nil {
+				return err
+			}
+			if ip := strings.TrimSpace(string(out)); net.ParseIP(ip) != nil {
+				inst.ip = ip
+			}
+		}
+		if inst.ip != "" {
+			// echo works in both sh and cmd.exe.
+			if _, err := inst.ssh(time.Minute, "echo"); err == nil {
+				break
+			}
+		}
+		var err error
+		if bootOutput, err = inst.merger.Collect(bootOutput); err != nil {
+			return fmt.Errorf("console failed: %v\n%s", err, bootOutput)
+		}
+		if time.Since(start) > 10*time.Minute {
+			if inst.ip == "" {
+				return fmt.Errorf("VM did not get an address (is hv_kvp_daemon running?):\n%s", bootOutput)
+			}
+			return fmt.Errorf("ssh server did not start on %v:\n%s", inst.ip, bootOutput)
+		}
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	inst.merger.Drain()
+	return nil
+}
+
+func (inst *instance) ssh(timeout time.Duration, command string) ([]byte, error) {
+	return vm.SSH(append(inst.sshArgs("-p"), inst.user()+"@"+inst.ip), timeout, command)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostIP, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	base := hostSrc
+	if pos := strings.LastIndexAny(base, `/\`); pos != -1 {
+		base = base[pos+1:]
+	}
+	vmDst := "/root/" + base
+	if inst.cfg.OS == "windows" {
+		// Relative to the home dir of the user, commands run there.
+		vmDst = base
+	}
+	args := append(inst.sshArgs("-P"), hostSrc, inst.user()+"@"+inst.ip+":"+vmDst)
+	cmd := exec.Command("scp", args...)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: scp %#v", args)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stdout
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-time.After(3 * time.Minute):
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil {
+		return "", err
+	}
+	return vmDst, nil
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("ssh", rpipe)
+
+	args := append(inst.sshArgs("-p"), inst.user()+"@"+inst.ip, command)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: ssh %#v", args)
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	errc := make(chan error, 1)
+	signal := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	go func() {
+		select {
+		case <-time.After(timeout):
+			signal(vm.TimeoutErr)
+		case <-stop:
+			signal(vm.TimeoutErr)
+		case err := <-inst.merger.Err:
+			signal(err)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	return inst.merger.Output, errc, nil
+}
+
+// user returns the user commands are run as, Windows has no root.
+func (inst *instance) user() string {
+	if inst.cfg.OS == "windows" {
+		return "Administrator"
+	}
+	return "root"
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		"-i", inst.cfg.Sshkey,
+		portArg, "22",
+		"-o", "ConnectionAttempts=10",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package hyperv
+
+import (
+	"testing"
+)
+
+func TestPsQuote(t *testing.T) {
+	tests := []struct {
+		s, quoted string
+	}{
+		{`syz-hyperv-0`, `'syz-hyperv-0'`},
+		{`C:\VMs\linux.vhdx`, `'C:\VMs\linux.vhdx'`},
+		{`Default Switch`, `'Default Switch'`},
+		{`it's`, `'it''s'`},
+		{`'; Remove-Item C:\ -Recurse; '`, `'''; Remove-Item C:\ -Recurse; '''`},
+	}
+	for _, test := range tests {
+		if got := psQuote(test.s); got != test.quoted {
+			t.Errorf("psQuote(%q) = %q, want %q", test.s, got, test.quoted)
+		}
+	}
+}
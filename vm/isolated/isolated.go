@@ -0,0 +1,301 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package isolated allows to use pre-provisioned machines (e.g. physical test machines)
+// reachable over ssh as VMs. Machines are rebooted when an instance is created:
+// over ssh if the machine responds, otherwise with the configured reboot command
+// (e.g. an IPMI or power switch script). Kernel console is read with the configured
+// console command (e.g. reading of a serial console), or with dmesg over ssh.
+package isolated
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("isolated", ctor)
+}
+
+type instance struct {
+	cfg     *vm.Config
+	user    string
+	host    string
+	port    int
+	fwdPort int
+	closed  chan bool
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	user, host, port, err := parseTarget(cfg.Target)
+	if err != nil {
+		os.RemoveAll(cfg.Workdir)
+		return nil, err
+	}
+	inst := &instance{
+		cfg:    cfg,
+		user:   user,
+		host:   host,
+		port:   port,
+		closed: make(chan bool),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+	if err := inst.reboot(); err != nil {
+		return nil, err
+	}
+	// Binaries of the previous run are removed, the dir may be not on tmpfs.
+	dir := inst.cfg.TargetDir
+	if _, err := inst.ssh(time.Minute, fmt.Sprintf("rm -rf %v && mkdir -p %v", dir, dir)); err != nil {
+		return nil, fmt.Errorf("failed to create target dir: %v", err)
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+// parseTarget parses target in [user@]host[:port] form.
+func parseTarget(target string) (user, host string, port int, err error) {
+	user, host, port = "root", target, 22
+	if pos := strings.LastIndexByte(host, '@'); pos != -1 {
+		user, host = host[:pos], host[pos+1:]
+	}
+	if pos := strings.LastIndexByte(host, ':'); pos != -1 && !strings.HasSuffix(host, "]") {
+		if port, err = strconv.Atoi(host[pos+1:]); err != nil || port <= 0 || port >= 64<<10 {
+			return "", "", 0, fmt.Errorf("bad target %q: bad port", target)
+		}
+		host = host[:pos]
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if user == "" || host == "" {
+		return "", "", 0, fmt.Errorf("bad target %q: want [user@]host[:port]", target)
+	}
+	return user, host, port, nil
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+// reboot reboots the machine and waits until it is reachable over ssh.
+// The machine may be still running after a crash in the previous run,
+// so it is rebooted even if it responds to start from a clean state.
+func (inst *instance) reboot() error {
+	if _, err := inst.ssh(time.Minute, "true"); err == nil {
+		vm.Log.Logf(1, "%v: rebooting %v", inst.cfg.Name, inst.host)
+		// ssh may fail or hang because the machine goes down.
+		inst.ssh(10*time.Second, "reboot")
+		if inst.waitForSsh(false, 2*time.Minute) == nil && inst.waitForSsh(true, 10*time.Minute) == nil {
+			return nil
+		}
+	}
+	if inst.cfg.RebootCmd == "" {
+		return fmt.Errorf("failed to reboot %v over ssh and reboot_cmd is not configured", inst.host)
+	}
+	vm.Log.Logf(0, "%v: rebooting %v with reboot_cmd", inst.cfg.Name, inst.host)
+	cmd := exec.Command("sh", "-c", inst.cfg.RebootCmd)
+	cmd.Env = append(os.Environ(),
+		"SYZ_TARGET="+inst.host,
+		"SYZ_INDEX="+strconv.Itoa(inst.cfg.Index),
+	)
+	if out, err := vm.RunTimeout(cmd, 5*time.Minute); err != nil {
+		return fmt.Errorf("reboot_cmd failed: %v\n%s", err, out)
+	}
+	if err := inst.waitForSsh(true, 10*time.Minute); err != nil {
+		return fmt.Errorf("%v after reboot_cmd", err)
+	}
+	return nil
+}
+
+// waitForSsh waits until the machine starts (up) or stops (!up) responding to ssh.
+func (inst *instance) waitForSsh(up bool, timeout time.Duration) error {
+	start := time.Now()
+	for {
+		_, err := inst.ssh(30*time.Second, "true")
+		if (err == nil) == up {
+			return nil
+		}
+		if time.Since(start) > timeout {
+			if up {
+				return fmt.Errorf("%v is not reachable over ssh", inst.host)
+			}
+			return fmt.Errorf("%v did not go down", inst.host)
+		}
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+}
+
+func (inst *instance) ssh(timeout time.Duration, command string) ([]byte, error) {
+	args := append(inst.sshArgs("-p"), inst.user+"@"+inst.host)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: ssh %#v %q", args, command)
+	}
+	return vm.SSH(args, timeout, command)
+}
+
+// Diagnose asks the kernel to dump stacks of blocked tasks and backtraces of all CPUs
+// to the console. ssh usually still works when only some tasks are hung.
+func (inst *instance) Diagnose() []byte {
+	// SysRq-w dumps blocked tasks, SysRq-l dumps backtraces of all CPUs.
+	if _, err := inst.ssh(time.Minute, "echo w > /proc/sysrq-trigger; echo l > /proc/sysrq-trigger"); err != nil {
+		vm.Log.Logf(0, "%v: %v", inst.cfg.Name, err)
+	}
+	return nil
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	// The port is forwarded with ssh -R by Run, so that the manager does not need
+	// to be reachable from the machine.
+	if inst.fwdPort != 0 {
+		return "", fmt.Errorf("only one port can be forwarded")
+	}
+	inst.fwdPort = port
+	return fmt.Sprintf("127.0.0.1:%v", port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDst := filepath.Join(inst.cfg.TargetDir, filepath.Base(hostSrc))
+	args := append(inst.sshArgs("-P"), hostSrc, inst.user+"@"+scpHost(inst.host)+":"+vmDst)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: scp %#v", args)
+	}
+	if out, err := vm.RunTimeout(exec.Command("scp", args...), 3*time.Minute); err != nil {
+		return "", fmt.Errorf("scp failed: %v\n%s", err, out)
+	}
+	return vmDst, nil
+}
+
+func scpHost(host string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]" // IPv6 address
+	}
+	return host
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	var con *exec.Cmd
+	if inst.cfg.Console != "" {
+		con = exec.Command("sh", "-c", inst.cfg.Console)
+		con.Env = append(os.Environ(),
+			"SYZ_TARGET="+inst.host,
+			"SYZ_INDEX="+strconv.Itoa(inst.cfg.Index),
+		)
+	} else {
+		// Kernel messages printed right before a panic are likely lost this way,
+		// a real console is preferable.
+		args := append(inst.sshArgs("-p"), inst.user+"@"+inst.host, "dmesg -w")
+		con = exec.Command("ssh", args...)
+	}
+	con.Stdout = conWpipe
+	con.Stderr = conWpipe
+	if _, err := con.StdinPipe(); err != nil { // SSH would close connection on stdin EOF
+		conRpipe.Close()
+		conWpipe.Close()
+		return nil, nil, err
+	}
+	if err := con.Start(); err != nil {
+		conRpipe.Close()
+		conWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to start console: %v", err)
+	}
+	conWpipe.Close()
+
+	sshRpipe, sshWpipe, err := vm.LongPipe()
+	if err != nil {
+		con.Process.Kill()
+		conRpipe.Close()
+		return nil, nil, err
+	}
+	args := inst.sshArgs("-p")
+	if inst.fwdPort != 0 {
+		args = append(args, "-R", fmt.Sprintf("%v:127.0.0.1:%v", inst.fwdPort, inst.fwdPort))
+	}
+	args = append(args, inst.user+"@"+inst.host, "cd "+inst.cfg.TargetDir+"; "+command)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: ssh %#v", args)
+	}
+	ssh := exec.Command("ssh", args...)
+	ssh.Stdout = sshWpipe
+	ssh.Stderr = sshWpipe
+	if err := ssh.Start(); err != nil {
+		con.Process.Kill()
+		conRpipe.Close()
+		sshRpipe.Close()
+		sshWpipe.Close()
+		return nil, nil, fmt.Errorf("failed to connect to %v: %v", inst.host, err)
+	}
+	sshWpipe.Close()
+
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	merger := vm.NewOutputMerger(tee)
+	merger.Add("console", conRpipe)
+	merger.Add("ssh", sshRpipe)
+
+	errc := make(chan error, 1)
+	signal := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	go func() {
+		select {
+		case <-time.After(timeout):
+			signal(vm.TimeoutErr)
+		case <-stop:
+			signal(vm.TimeoutErr)
+		case <-inst.closed:
+			signal(fmt.Errorf("instance closed"))
+		case err := <-merger.Err:
+			signal(err)
+		}
+		con.Process.Kill()
+		ssh.Process.Kill()
+		merger.Wait()
+		con.Wait()
+		ssh.Wait()
+	}()
+	return merger.Output, errc, nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		portArg, strconv.Itoa(inst.port),
+		"-F", "/dev/null",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "ConnectTimeout=10",
+		// Detect machines that hanged or panicked.
+		"-o", "ServerAliveInterval=5",
+		"-o", "ServerAliveCountMax=6",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Sshkey != "" {
+		args = append(args, "-i", inst.cfg.Sshkey)
+	}
+	return args
+}
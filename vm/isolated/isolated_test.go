@@ -0,0 +1,45 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package isolated
+
+import (
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		user   string
+		host   string
+		port   int
+		err    bool
+	}{
+		{"10.0.0.1", "root", "10.0.0.1", 22, false},
+		{"test-machine:2222", "root", "test-machine", 2222, false},
+		{"syzkaller@test-machine", "syzkaller", "test-machine", 22, false},
+		{"syzkaller@10.0.0.1:2222", "syzkaller", "10.0.0.1", 2222, false},
+		{"[fe80::1]:2222", "root", "fe80::1", 2222, false},
+		{"[fe80::1]", "root", "fe80::1", 22, false},
+		{"test-machine:foo", "", "", 0, true},
+		{"test-machine:0", "", "", 0, true},
+		{"@test-machine", "", "", 0, true},
+		{"root@", "", "", 0, true},
+	}
+	for _, test := range tests {
+		user, host, port, err := parseTarget(test.target)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: no error", test.target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: got error %v", test.target, err)
+			continue
+		}
+		if user != test.user || host != test.host || port != test.port {
+			t.Errorf("%v: got %v@%v:%v, want %v@%v:%v", test.target, user, host, port, test.user, test.host, test.port)
+		}
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/google/syzkaller/fileutil"
@@ -69,12 +68,9 @@ func ctor(cfg *vm.Config) (vm.Instance, error) {
 		return nil, fmt.Errorf("failed to create temp file: %v", err)
 	}
 
-	rpipe, wpipe, err := os.Pipe()
+	rpipe, wpipe, err := vm.LongPipe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pipe: %v", err)
-	}
-	for sz := 128 << 10; sz <= 2<<20; sz *= 2 {
-		syscall.Syscall(syscall.SYS_FCNTL, wpipe.Fd(), syscall.F_SETPIPE_SZ, uintptr(sz))
+		return nil, err
 	}
 
 	inst.lkvm = exec.Command("taskset", "-c", strconv.Itoa(inst.cfg.Index%runtime.NumCPU()),
@@ -181,6 +177,10 @@ func (inst *instance) Close() {
 	os.Remove(inst.sandboxPath + ".sock")
 }
 
+func (inst *instance) HostPids() []int {
+	return []int{inst.lkvm.Process.Pid}
+}
+
 func (inst *instance) Forward(port int) (string, error) {
 	return fmt.Sprintf("%v:%v", hostAddr, port), nil
 }
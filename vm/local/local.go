@@ -64,12 +64,9 @@ func (inst *instance) Copy(hostSrc string) (string, error) {
 }
 
 func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
-	rpipe, wpipe, err := os.Pipe()
+	rpipe, wpipe, err := vm.LongPipe()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create pipe: %v", err)
-	}
-	for sz := 128 << 10; sz <= 2<<20; sz *= 2 {
-		syscall.Syscall(syscall.SYS_FCNTL, wpipe.Fd(), syscall.F_SETPIPE_SZ, uintptr(sz))
+		return nil, nil, err
 	}
 	for strings.Index(command, "  ") != -1 {
 		command = strings.Replace(command, "  ", " ", -1)
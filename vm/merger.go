@@ -74,3 +74,31 @@ func (merger *OutputMerger) Add(name string, r io.ReadCloser) {
 		}
 	}()
 }
+
+// Collect appends output received so far to out.
+// It returns an error if any of the sources has failed.
+func (merger *OutputMerger) Collect(out []byte) ([]byte, error) {
+	for {
+		select {
+		case data := <-merger.Output:
+			out = append(out, data...)
+		case err := <-merger.Err:
+			return out, err
+		default:
+			return out, nil
+		}
+	}
+}
+
+// Drain discards output received so far.
+// Backends call it once the machine has booted, so that boot output
+// is not reported as output of the first command.
+func (merger *OutputMerger) Drain() {
+	for {
+		select {
+		case <-merger.Output:
+		default:
+			return
+		}
+	}
+}
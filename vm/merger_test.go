@@ -5,6 +5,7 @@ package vm
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 	"time"
 )
@@ -75,3 +76,26 @@ func TestMerger(t *testing.T) {
 		t.Fatalf("bad tee: '%s', want '%s'", got, want)
 	}
 }
+
+func TestMergerCollect(t *testing.T) {
+	merger := NewOutputMerger(nil)
+	merger.Output <- []byte("111\n")
+	merger.Output <- []byte("222\n")
+	out, err := merger.Collect([]byte("000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "000\n111\n222\n"; string(out) != want {
+		t.Fatalf("collected '%s', want '%s'", out, want)
+	}
+	merger.Output <- []byte("333\n")
+	merger.Err <- fmt.Errorf("failed")
+	if _, err := merger.Collect(nil); err == nil {
+		t.Fatalf("collect did not return source error")
+	}
+	merger.Output <- []byte("444\n")
+	merger.Drain()
+	if out, err := merger.Collect(nil); err != nil || len(out) != 0 {
+		t.Fatalf("output after drain: '%s' (%v)", out, err)
+	}
+}
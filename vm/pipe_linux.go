@@ -0,0 +1,16 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"os"
+	"syscall"
+)
+
+// setPipeSize increases pipe buffer, so that bursts of kernel output are not lost.
+func setPipeSize(w *os.File) {
+	for sz := 128 << 10; sz <= 2<<20; sz *= 2 {
+		syscall.Syscall(syscall.SYS_FCNTL, w.Fd(), syscall.F_SETPIPE_SZ, uintptr(sz))
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package vm
+
+import (
+	"os"
+)
+
+// setPipeSize is a no-op, pipe size can't be changed on this OS.
+func setPipeSize(w *os.File) {
+}
@@ -0,0 +1,285 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package proxy delegates management of VMs to an external program (plugin),
+// so that proprietary lab managers or exotic hypervisors can be used without
+// changes to syzkaller.
+//
+// A separate plugin process (bin with bin_args from the config) is started for every instance.
+// The plugin serves JSON-RPC 1.0 (as implemented by net/rpc/jsonrpc) on its stdin/stdout,
+// stderr of the plugin is forwarded to stderr of syzkaller. Methods (with the argument
+// and result types below, all of them are called with the "Proxy." prefix):
+//
+//	Create:  create and boot the machine, called once right after the plugin starts
+//	Copy:    copy a host file into the machine
+//	Forward: make a host port reachable from the machine
+//	Run:     start a command on the machine, returns immediately
+//	Poll:    return new output of a running command, combined with the kernel console
+//	Stop:    terminate a running command
+//	Destroy: destroy the machine, the plugin is expected to exit afterwards
+//
+// Poll should wait for new output for up to a few seconds before returning an empty result,
+// so that it is not called in a busy loop.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("proxy", ctor)
+}
+
+type CreateArgs struct {
+	Name     string
+	Index    int
+	Workdir  string // host dir for temp files of the instance
+	Kernel   string
+	Initrd   string
+	Cmdline  string
+	Image    string
+	Sshkey   string
+	Executor string
+	Cpu      int
+	Mem      int
+	Debug    bool
+}
+
+type CreateRes struct {
+}
+
+type CopyArgs struct {
+	HostSrc string
+}
+
+type CopyRes struct {
+	VMDst string // file name in the machine
+}
+
+type ForwardArgs struct {
+	Port int
+}
+
+type ForwardRes struct {
+	Addr string // address to use in the machine
+}
+
+type RunArgs struct {
+	Command string
+	Timeout int // in seconds, the command is stopped by syzkaller after it anyway
+}
+
+type RunRes struct {
+	ID string // identifies the command in Poll and Stop
+}
+
+type PollArgs struct {
+	ID string
+}
+
+type PollRes struct {
+	Output   []byte // combined command and kernel console output since the previous Poll
+	Finished bool   // the command has exited, no more Poll calls follow
+	Error    string // if finished: why the command failed (e.g. non-zero exit status or lost connection)
+}
+
+type StopArgs struct {
+	ID string
+}
+
+type StopRes struct {
+}
+
+type DestroyArgs struct {
+}
+
+type DestroyRes struct {
+}
+
+const callTimeout = 10 * time.Minute // Create and Copy can take a while
+
+type instance struct {
+	cfg    *vm.Config
+	client *rpc.Client
+	kill   func()
+	closed chan bool
+}
+
+type pipeConn struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (c *pipeConn) Close() error {
+	c.WriteCloser.Close()
+	return c.ReadCloser.Close()
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	if cfg.Bin == "" {
+		os.RemoveAll(cfg.Workdir)
+		return nil, fmt.Errorf("plugin binary (bin) is not specified")
+	}
+	cmd := exec.Command(cfg.Bin, strings.Fields(cfg.BinArgs)...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		os.RemoveAll(cfg.Workdir)
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		os.RemoveAll(cfg.Workdir)
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(cfg.Workdir)
+		return nil, fmt.Errorf("failed to start plugin %v: %v", cfg.Bin, err)
+	}
+	exited := make(chan bool)
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	kill := func() {
+		// Give the plugin some time to exit after Destroy.
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}
+	return create(cfg, &pipeConn{stdout, stdin}, kill)
+}
+
+func create(cfg *vm.Config, conn io.ReadWriteCloser, kill func()) (vm.Instance, error) {
+	inst := &instance{
+		cfg:    cfg,
+		client: jsonrpc.NewClient(conn),
+		kill:   kill,
+		closed: make(chan bool),
+	}
+	args := &CreateArgs{
+		Name:     cfg.Name,
+		Index:    cfg.Index,
+		Workdir:  cfg.Workdir,
+		Kernel:   cfg.Kernel,
+		Initrd:   cfg.Initrd,
+		Cmdline:  cfg.Cmdline,
+		Image:    cfg.Image,
+		Sshkey:   cfg.Sshkey,
+		Executor: cfg.Executor,
+		Cpu:      cfg.Cpu,
+		Mem:      cfg.Mem,
+		Debug:    cfg.Debug,
+	}
+	if err := inst.call("Create", args, new(CreateRes)); err != nil {
+		inst.Close()
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (inst *instance) call(method string, args, res interface{}) error {
+	call := inst.client.Go("Proxy."+method, args, res, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return fmt.Errorf("plugin %v failed: %v", method, call.Error)
+		}
+		return nil
+	case <-time.After(callTimeout):
+		return fmt.Errorf("plugin %v timed out after %v", method, callTimeout)
+	}
+}
+
+func (inst *instance) Close() {
+	close(inst.closed)
+	if err := inst.call("Destroy", &DestroyArgs{}, new(DestroyRes)); err != nil {
+		vm.Log.Logf(0, "%v: %v", inst.cfg.Name, err)
+	}
+	inst.client.Close()
+	inst.kill()
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	var res ForwardRes
+	if err := inst.call("Forward", &ForwardArgs{port}, &res); err != nil {
+		return "", err
+	}
+	return res.Addr, nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	var res CopyRes
+	if err := inst.call("Copy", &CopyArgs{hostSrc}, &res); err != nil {
+		return "", err
+	}
+	return res.VMDst, nil
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	var run RunRes
+	if err := inst.call("Run", &RunArgs{command, int(timeout / time.Second)}, &run); err != nil {
+		return nil, nil, err
+	}
+	outc := make(chan []byte, 1000)
+	errc := make(chan error, 1)
+	go func() {
+		// errc is signaled before outc is closed, as other backends do.
+		defer close(outc)
+		deadline := time.After(timeout)
+		for {
+			var err error
+			select {
+			case <-deadline:
+				err = vm.TimeoutErr
+			case <-stop:
+				err = vm.TimeoutErr
+			case <-inst.closed:
+				err = fmt.Errorf("instance closed")
+			default:
+			}
+			if err != nil {
+				inst.call("Stop", &StopArgs{run.ID}, new(StopRes))
+				errc <- err
+				return
+			}
+			var poll PollRes
+			if err := inst.call("Poll", &PollArgs{run.ID}, &poll); err != nil {
+				errc <- err
+				return
+			}
+			if len(poll.Output) != 0 {
+				if inst.cfg.Debug {
+					os.Stdout.Write(poll.Output)
+				}
+				select {
+				case outc <- poll.Output:
+				default:
+				}
+			}
+			if poll.Finished {
+				if poll.Error != "" {
+					errc <- errors.New(poll.Error)
+				} else {
+					errc <- nil
+				}
+				return
+			}
+		}
+	}()
+	return outc, errc, nil
+}
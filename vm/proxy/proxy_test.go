@@ -0,0 +1,139 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/vm"
+)
+
+// Proxy is a fake plugin.
+type Proxy struct {
+	mu        sync.Mutex
+	created   string
+	destroyed bool
+	stopped   map[string]bool
+	polls     int
+}
+
+func (p *Proxy) Create(args *CreateArgs, res *CreateRes) error {
+	p.created = args.Name
+	return nil
+}
+
+func (p *Proxy) Copy(args *CopyArgs, res *CopyRes) error {
+	res.VMDst = "/tmp/" + args.HostSrc
+	return nil
+}
+
+func (p *Proxy) Forward(args *ForwardArgs, res *ForwardRes) error {
+	res.Addr = fmt.Sprintf("10.0.0.1:%v", args.Port)
+	return nil
+}
+
+func (p *Proxy) Run(args *RunArgs, res *RunRes) error {
+	res.ID = args.Command
+	return nil
+}
+
+func (p *Proxy) Poll(args *PollArgs, res *PollRes) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch args.ID {
+	case "ok":
+		p.polls++
+		res.Output = []byte(fmt.Sprintf("line %v\n", p.polls))
+		res.Finished = p.polls == 3
+	case "fail":
+		res.Finished = true
+		res.Error = "exit status 1"
+	case "hang":
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (p *Proxy) Stop(args *StopArgs, res *StopRes) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped[args.ID] = true
+	return nil
+}
+
+func (p *Proxy) Destroy(args *DestroyArgs, res *DestroyRes) error {
+	p.destroyed = true
+	return nil
+}
+
+func TestProxy(t *testing.T) {
+	p := &Proxy{stopped: make(map[string]bool)}
+	srv := rpc.NewServer()
+	if err := srv.Register(p); err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	go srv.ServeCodec(jsonrpc.NewServerCodec(c2))
+	inst, err := create(&vm.Config{Name: "proxy-test-0"}, c1, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.created != "proxy-test-0" {
+		t.Fatalf("Create got name %q", p.created)
+	}
+	if dst, err := inst.Copy("syz-fuzzer"); err != nil || dst != "/tmp/syz-fuzzer" {
+		t.Fatalf("Copy returned %q, %v", dst, err)
+	}
+	if addr, err := inst.Forward(1234); err != nil || addr != "10.0.0.1:1234" {
+		t.Fatalf("Forward returned %q, %v", addr, err)
+	}
+
+	outc, errc, err := inst.Run(time.Minute, nil, "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("ok command failed: %v", err)
+	}
+	var output []byte
+	for out := range outc {
+		output = append(output, out...)
+	}
+	if want := "line 1\nline 2\nline 3\n"; string(output) != want {
+		t.Fatalf("got output %q, want %q", output, want)
+	}
+
+	_, errc, err = inst.Run(time.Minute, nil, "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil || err.Error() != "exit status 1" {
+		t.Fatalf("fail command returned %v", err)
+	}
+
+	_, errc, err = inst.Run(50*time.Millisecond, nil, "hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != vm.TimeoutErr {
+		t.Fatalf("hang command returned %v", err)
+	}
+	p.mu.Lock()
+	stopped := p.stopped["hang"]
+	p.mu.Unlock()
+	if !stopped {
+		t.Fatalf("hang command was not stopped")
+	}
+
+	inst.Close()
+	if !p.destroyed {
+		t.Fatalf("instance was not destroyed")
+	}
+}
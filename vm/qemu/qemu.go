@@ -12,30 +12,91 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
-	. "github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/vm"
 )
 
 const (
-	hostAddr = "10.0.2.10"
+	hostAddr     = "10.0.2.10"
+	snapshotName = "syz"
 )
 
 func init() {
 	vm.Register("qemu", ctor)
+	// i386 binaries are tested on x86_64 kernels (through the compat syscall entry).
+	archConfigs["i386"] = archConfigs["amd64"]
+}
+
+// archConfig describes the qemu machine for a target arch.
+type archConfig struct {
+	Bin     string   // default qemu binary
+	Args    []string // default machine args, replaced by bin_args
+	Console string   // serial console of the kernel
+	Root    string   // root device of the image in the kernel
+	Cmdline string   // arch-specific kernel params
+}
+
+var archConfigs = map[string]*archConfig{
+	"amd64": {
+		Bin: "qemu-system-x86_64",
+		// This is reasonable defaults for x86 kvm-enabled host.
+		Args:    []string{"-enable-kvm", "-usb", "-usbdevice", "mouse", "-usbdevice", "tablet", "-soundhw", "all"},
+		Console: "ttyS0",
+		Root:    "/dev/sda",
+		Cmdline: "vsyscall=native earlyprintk=serial" +
+			" kvm-intel.nested=1 kvm-intel.unrestricted_guest=1 kvm-intel.vmm_exclusive=1 kvm-intel.fasteoi=1" +
+			" kvm-intel.ept=1 kvm-intel.flexpriority=1" +
+			" kvm-intel.vpid=1 kvm-intel.emulate_invalid_guest_state=1 kvm-intel.eptad=1" +
+			" kvm-intel.enable_shadow_vmcs=1 kvm-intel.pml=1 kvm-intel.enable_apicv=1",
+	},
+	"arm64": {
+		Bin: "qemu-system-aarch64",
+		// Emulated on x86 hosts, on arm64 hosts with kvm use bin_args "-machine virt,gic-version=host -cpu host -enable-kvm".
+		// Disks of the virt machine are virtio.
+		Args:    []string{"-machine", "virt", "-cpu", "cortex-a57"},
+		Console: "ttyAMA0",
+		Root:    "/dev/vda",
+		Cmdline: "earlycon",
+	},
+	"ppc64le": {
+		Bin:     "qemu-system-ppc64",
+		Args:    []string{"-machine", "pseries", "-cpu", "POWER8"},
+		Console: "hvc0",
+		Root:    "/dev/sda",
+	},
+	"riscv64": {
+		Bin: "qemu-system-riscv64",
+		// The kernel is started by the OpenSBI firmware bundled with qemu.
+		Args:    []string{"-machine", "virt", "-bios", "default"},
+		Console: "ttyS0",
+		Root:    "/dev/vda",
+		Cmdline: "earlycon",
+	},
+}
+
+func (inst *instance) arch() *archConfig {
+	return archConfigs[inst.cfg.Arch]
 }
 
 type instance struct {
-	cfg     *vm.Config
-	port    int
-	rpipe   io.ReadCloser
-	wpipe   io.WriteCloser
-	qemu    *exec.Cmd
-	waiterC chan error
-	merger  *vm.OutputMerger
+	cfg       *vm.Config
+	port      int
+	rpipe     io.ReadCloser
+	wpipe     io.WriteCloser
+	qemu      *exec.Cmd
+	virtiofsd *exec.Cmd
+	waiterC   chan error
+	merger    *vm.OutputMerger
+	runs      []*run // commands started with Run, terminated on Restore
+}
+
+type run struct {
+	stop chan bool
+	done chan bool
 }
 
 func ctor(cfg *vm.Config) (vm.Instance, error) {
@@ -92,8 +153,15 @@ func ctorImpl(cfg *vm.Config) (vm.Instance, error) {
 }
 
 func validateConfig(cfg *vm.Config) error {
+	if cfg.Arch == "" {
+		cfg.Arch = runtime.GOARCH
+	}
+	arch := archConfigs[cfg.Arch]
+	if arch == nil {
+		return fmt.Errorf("qemu does not support arch %v", cfg.Arch)
+	}
 	if cfg.Bin == "" {
-		cfg.Bin = "qemu-system-x86_64"
+		cfg.Bin = arch.Bin
 	}
 	if cfg.Image == "9p" {
 		if cfg.Kernel == "" {
@@ -126,6 +194,7 @@ func (inst *instance) close(removeWorkDir bool) {
 		err := <-inst.waiterC
 		inst.waiterC <- err // repost it for waiting goroutines
 	}
+	inst.stopSharedDir()
 	if inst.merger != nil {
 		inst.merger.Wait()
 	}
@@ -159,16 +228,11 @@ func (inst *instance) Boot() error {
 		"-display", "none",
 		"-serial", "stdio",
 		"-no-reboot",
-		"-numa", "node,nodeid=0,cpus=0-1", "-numa", "node,nodeid=1,cpus=2-3",
 		"-smp", "sockets=2,cores=2,threads=1",
 	}
+	args = append(args, inst.numaArgs()...)
 	if inst.cfg.BinArgs == "" {
-		// This is reasonable defaults for x86 kvm-enabled host.
-		args = append(args,
-			"-enable-kvm",
-			"-usb", "-usbdevice", "mouse", "-usbdevice", "tablet",
-			"-soundhw", "all",
-		)
+		args = append(args, inst.arch().Args...)
 	} else {
 		args = append(args, strings.Split(inst.cfg.BinArgs, " ")...)
 	}
@@ -183,23 +247,30 @@ func (inst *instance) Boot() error {
 			"-snapshot",
 		)
 	}
+	args = append(args, inst.sharedDirArgs()...)
+	// The monitor is used for snapshots and to diagnose hung VMs.
+	os.Remove(inst.qmpSock())
+	args = append(args, "-qmp", fmt.Sprintf("unix:%v,server,nowait", inst.qmpSock()))
 	if inst.cfg.Initrd != "" {
 		args = append(args,
 			"-initrd", inst.cfg.Initrd,
 		)
 	}
-	if inst.cfg.Kernel != "" {
-		cmdline := "console=ttyS0 vsyscall=native rodata=n oops=panic panic_on_warn=1 panic=86400" +
-			" ftrace_dump_on_oops=orig_cpu earlyprintk=serial slub_debug=UZ net.ifnames=0 biosdevname=0 " +
-			" kvm-intel.nested=1 kvm-intel.unrestricted_guest=1 kvm-intel.vmm_exclusive=1 kvm-intel.fasteoi=1 " +
-			" kvm-intel.ept=1 kvm-intel.flexpriority=1 " +
-			" kvm-intel.vpid=1 kvm-intel.emulate_invalid_guest_state=1 kvm-intel.eptad=1 " +
-			" kvm-intel.enable_shadow_vmcs=1 kvm-intel.pml=1 kvm-intel.enable_apicv=1 "
+	if inst.cfg.Kernel != "" && inst.cfg.OS == "fuchsia" {
+		// Zircon is booted with the Fuchsia ZBI image as initrd, it prints to the legacy serial port.
+		// Halting on panic keeps the report on the console.
+		args = append(args,
+			"-kernel", inst.cfg.Kernel,
+			"-append", "kernel.serial=legacy kernel.halt-on-panic=true "+inst.cfg.Cmdline,
+		)
+	} else if inst.cfg.Kernel != "" {
+		cmdline := "console=" + inst.arch().Console + " rodata=n oops=panic panic_on_warn=1 panic=86400 sysrq_always_enabled" +
+			" ftrace_dump_on_oops=orig_cpu slub_debug=UZ net.ifnames=0 biosdevname=0 " + inst.arch().Cmdline + " "
 		if inst.cfg.Image == "9p" {
 			cmdline += "root=/dev/root rootfstype=9p rootflags=trans=virtio,version=9p2000.L,cache=loose "
 			cmdline += "init=" + filepath.Join(inst.cfg.Workdir, "init.sh") + " "
 		} else {
-			cmdline += "root=/dev/sda "
+			cmdline += "root=" + inst.arch().Root + " "
 		}
 		args = append(args,
 			"-kernel", inst.cfg.Kernel,
@@ -207,7 +278,10 @@ func (inst *instance) Boot() error {
 		)
 	}
 	if inst.cfg.Debug {
-		Logf(0, "running command: %v %#v", inst.cfg.Bin, args)
+		vm.Log.Logf(0, "running command: %v %#v", inst.cfg.Bin, args)
+	}
+	if err := inst.startSharedDir(); err != nil {
+		return err
 	}
 	qemu := exec.Command(inst.cfg.Bin, args...)
 	qemu.Stdout = inst.wpipe
@@ -281,7 +355,7 @@ func (inst *instance) Boot() error {
 		}
 	}
 	bootOutputStop <- true
-	return nil
+	return inst.mountSharedDir()
 }
 
 func (inst *instance) Forward(port int) (string, error) {
@@ -289,15 +363,19 @@ func (inst *instance) Forward(port int) (string, error) {
 }
 
 func (inst *instance) Copy(hostSrc string) (string, error) {
+	if inst.cfg.SharedDir != "" {
+		return inst.copyShared(hostSrc)
+	}
 	basePath := "/"
-	if inst.cfg.Image == "9p" {
+	if inst.cfg.Image == "9p" || inst.cfg.OS == "fuchsia" {
+		// The root file system is read-only.
 		basePath = "/tmp"
 	}
 	vmDst := filepath.Join(basePath, filepath.Base(hostSrc))
 	args := append(inst.sshArgs("-P"), hostSrc, "root@localhost:"+vmDst)
 	cmd := exec.Command("scp", args...)
 	if inst.cfg.Debug {
-		Logf(0, "running command: scp %#v", args)
+		vm.Log.Logf(0, "running command: scp %#v", args)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stdout
 	}
@@ -329,7 +407,7 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 
 	args := append(inst.sshArgs("-p"), "root@localhost", command)
 	if inst.cfg.Debug {
-		Logf(0, "running command: ssh %#v", args)
+		vm.Log.Logf(0, "running command: ssh %#v", args)
 	}
 	cmd := exec.Command("ssh", args...)
 	cmd.Stdout = wpipe
@@ -339,6 +417,11 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 		return nil, nil, err
 	}
 	wpipe.Close()
+	r := &run{
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+	inst.runs = append(inst.runs, r)
 	errc := make(chan error, 1)
 	signal := func(err error) {
 		select {
@@ -355,13 +438,82 @@ func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command strin
 			signal(vm.TimeoutErr)
 		case err := <-inst.merger.Err:
 			signal(err)
+		case <-r.stop:
+			signal(vm.TimeoutErr)
 		}
 		cmd.Process.Kill()
 		cmd.Wait()
+		close(r.done)
 	}()
 	return inst.merger.Output, errc, nil
 }
 
+func (inst *instance) Snapshot() error {
+	if !inst.cfg.Snapshot {
+		return fmt.Errorf("snapshots are not enabled")
+	}
+	return hmp(inst.qmpSock(), "savevm "+snapshotName, 10*time.Minute)
+}
+
+func (inst *instance) Restore() error {
+	if !inst.cfg.Snapshot {
+		return fmt.Errorf("snapshots are not enabled")
+	}
+	// ssh connections don't survive the restore.
+	for _, r := range inst.runs {
+		close(r.stop)
+		<-r.done
+	}
+	inst.runs = nil
+	if err := hmp(inst.qmpSock(), "loadvm "+snapshotName, 10*time.Minute); err != nil {
+		return err
+	}
+	// Discard output of the previous run (otherwise e.g. a crash would be reported again)
+	// and errors of the terminated ssh connections, the latter are reported asynchronously.
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case <-inst.merger.Output:
+		case <-inst.merger.Err:
+		case err := <-inst.waiterC:
+			inst.waiterC <- err // repost it for Close
+			return fmt.Errorf("qemu stopped: %v", err)
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func (inst *instance) HostPids() []int {
+	var pids []int
+	for _, cmd := range []*exec.Cmd{inst.qemu, inst.virtiofsd} {
+		if cmd != nil {
+			pids = append(pids, cmd.Process.Pid)
+		}
+	}
+	return pids
+}
+
+// Diagnose sends SysRq-w (stacks of blocked tasks) and SysRq-l (backtraces of all CPUs)
+// to the kernel with the emulated keyboard and returns registers of all vCPUs.
+func (inst *instance) Diagnose() []byte {
+	for _, key := range []string{"w", "l"} {
+		if err := hmp(inst.qmpSock(), "sendkey alt-sysrq-"+key, time.Minute); err != nil {
+			vm.Log.Logf(0, "%v: %v", inst.cfg.Name, err)
+		}
+	}
+	regs, err := hmpOutput(inst.qmpSock(), "info registers -a", time.Minute)
+	if err != nil {
+		vm.Log.Logf(0, "%v: %v", inst.cfg.Name, err)
+		return nil
+	}
+	return []byte("\nvCPU registers:\n" + regs)
+}
+
+func (inst *instance) qmpSock() string {
+	return filepath.Join(inst.cfg.Workdir, "qmp.sock")
+}
+
 func (inst *instance) sshArgs(portArg string) []string {
 	args := []string{
 		"-i", inst.cfg.Sshkey,
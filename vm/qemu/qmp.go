@@ -0,0 +1,93 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// QMP is the JSON-based qemu monitor protocol, it is used to save and load VM snapshots
+// and to collect state of hung VMs.
+// See qemu docs/qmp-spec.txt for details.
+
+type qmpCommand struct {
+	Execute   string                 `json:"execute"`
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	QMP    json.RawMessage // set only in the greeting
+	Event  string          // set only in asynchronous events
+	Return json.RawMessage
+	Error  *struct {
+		Class string
+		Desc  string
+	}
+}
+
+// hmp executes a human monitor command (e.g. "savevm foo") on the QMP socket sock.
+// The commands we use print nothing on success, so any output is treated as an error.
+func hmp(sock, command string, timeout time.Duration) error {
+	out, err := hmpOutput(sock, command, timeout)
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("%v failed: %v", command, out)
+	}
+	return nil
+}
+
+// hmpOutput executes a human monitor command on the QMP socket sock and returns its output.
+func hmpOutput(sock, command string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("unix", sock, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to qemu monitor: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	if _, err := qmpRead(dec); err != nil {
+		return "", err
+	}
+	cmds := []qmpCommand{
+		{Execute: "qmp_capabilities"},
+		{Execute: "human-monitor-command", Arguments: map[string]interface{}{"command-line": command}},
+	}
+	var resp *qmpResponse
+	for _, cmd := range cmds {
+		if err := enc.Encode(cmd); err != nil {
+			return "", fmt.Errorf("failed to write to qemu monitor: %v", err)
+		}
+		if resp, err = qmpRead(dec); err != nil {
+			return "", err
+		}
+		if resp.Error != nil {
+			return "", fmt.Errorf("qemu monitor command %v failed: %v", cmd.Execute, resp.Error.Desc)
+		}
+	}
+	var out string
+	if err := json.Unmarshal(resp.Return, &out); err != nil {
+		return "", fmt.Errorf("bad qemu monitor response %s: %v", resp.Return, err)
+	}
+	return out, nil
+}
+
+// qmpRead reads the next QMP message skipping asynchronous events.
+func qmpRead(dec *json.Decoder) (*qmpResponse, error) {
+	for {
+		resp := new(qmpResponse)
+		if err := dec.Decode(resp); err != nil {
+			return nil, fmt.Errorf("failed to read from qemu monitor: %v", err)
+		}
+		if resp.Event == "" {
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeMonitor serves a single QMP session, replies to human monitor commands with output.
+func fakeMonitor(t *testing.T, ln net.Listener, output string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, `{"QMP": {"version": {}, "capabilities": []}}`+"\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		cmd := new(qmpCommand)
+		if err := json.Unmarshal(line, cmd); err != nil {
+			t.Errorf("bad command %q: %v", line, err)
+			return
+		}
+		switch cmd.Execute {
+		case "qmp_capabilities":
+			fmt.Fprintf(conn, `{"event": "RESUME", "timestamp": {}}`+"\n")
+			fmt.Fprintf(conn, `{"return": {}}`+"\n")
+		case "human-monitor-command":
+			data, _ := json.Marshal(output)
+			fmt.Fprintf(conn, `{"return": %s}`+"\n", data)
+		default:
+			fmt.Fprintf(conn, `{"error": {"class": "CommandNotFound", "desc": "unknown command"}}`+"\n")
+		}
+	}
+}
+
+func TestHmp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-qemu-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		output string
+		err    string
+	}{
+		{"", ""},
+		{"\r\n", ""},
+		{"Error: No block device can accept snapshots\r\n", "savevm syz failed: Error: No block device can accept snapshots"},
+	}
+	for i, test := range tests {
+		sock := filepath.Join(dir, fmt.Sprintf("qmp%v.sock", i))
+		ln, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go fakeMonitor(t, ln, test.output)
+		err = hmp(sock, "savevm syz", time.Minute)
+		ln.Close()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("#%v: got error %v", i, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("#%v: got error %v, want %v", i, err, test.err)
+		}
+	}
+}
+
+func TestHmpOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syz-qemu-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "qmp.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	const regs = "CPU#0\r\nRAX=0000000000000000\r\n"
+	go fakeMonitor(t, ln, regs)
+	out, err := hmpOutput(sock, "info registers -a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != regs {
+		t.Fatalf("got output %q, want %q", out, regs)
+	}
+}
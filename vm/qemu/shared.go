@@ -0,0 +1,159 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/vm"
+)
+
+// A shared dir is a dir in the VM workdir mounted inside of the VM with virtio-9p or virtio-fs.
+// Copy puts files into it instead of copying them with scp, which is much faster for large files.
+
+const sharedTag = "syzshared"
+
+// SharedDir returns empty paths if the shared dir is not enabled.
+func (inst *instance) SharedDir() (string, string) {
+	if inst.cfg.SharedDir == "" {
+		return "", ""
+	}
+	return inst.hostSharedDir(), inst.vmSharedDir()
+}
+
+func (inst *instance) hostSharedDir() string {
+	return filepath.Join(inst.cfg.Workdir, "shared")
+}
+
+func (inst *instance) vmSharedDir() string {
+	// 9p root is read-only.
+	if inst.cfg.Image == "9p" {
+		return "/tmp/syz-shared"
+	}
+	return "/syz-shared"
+}
+
+func (inst *instance) virtiofsSock() string {
+	return filepath.Join(inst.cfg.Workdir, "virtiofs.sock")
+}
+
+// sharedDirArgs returns qemu args for the shared dir.
+func (inst *instance) sharedDirArgs() []string {
+	switch inst.cfg.SharedDir {
+	case "9p":
+		return []string{
+			"-fsdev", fmt.Sprintf("local,id=fsdev1,path=%v,security_model=none", inst.hostSharedDir()),
+			"-device", "virtio-9p-pci,fsdev=fsdev1,mount_tag=" + sharedTag,
+		}
+	case "virtiofs":
+		return []string{
+			"-chardev", fmt.Sprintf("socket,id=virtiofs,path=%v", inst.virtiofsSock()),
+			"-device", "vhost-user-fs-pci,chardev=virtiofs,tag=" + sharedTag,
+		}
+	}
+	return nil
+}
+
+// numaArgs returns qemu args for the 2 NUMA nodes of the VM.
+// virtiofsd accesses guest memory directly, so for virtio-fs the memory must be shared.
+func (inst *instance) numaArgs() []string {
+	if inst.cfg.SharedDir != "virtiofs" {
+		return []string{"-numa", "node,nodeid=0,cpus=0-1", "-numa", "node,nodeid=1,cpus=2-3"}
+	}
+	sizes := []int{inst.cfg.Mem / 2, inst.cfg.Mem - inst.cfg.Mem/2}
+	var args []string
+	for i, size := range sizes {
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=mem%v,size=%vM,share=on", i, size),
+			"-numa", fmt.Sprintf("node,nodeid=%v,cpus=%v-%v,memdev=mem%v", i, 2*i, 2*i+1, i),
+		)
+	}
+	return args
+}
+
+// startSharedDir creates the shared dir and starts virtiofsd for it if necessary.
+func (inst *instance) startSharedDir() error {
+	if inst.cfg.SharedDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(inst.hostSharedDir(), 0777); err != nil {
+		return fmt.Errorf("failed to create shared dir: %v", err)
+	}
+	if inst.cfg.SharedDir != "virtiofs" {
+		return nil
+	}
+	sock := inst.virtiofsSock()
+	os.Remove(sock)
+	args := []string{"--socket-path=" + sock, "--shared-dir=" + inst.hostSharedDir(),
+		"--cache=never", "--sandbox=none"}
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: virtiofsd %#v", args)
+	}
+	inst.virtiofsd = exec.Command("virtiofsd", args...)
+	out := new(bytes.Buffer)
+	inst.virtiofsd.Stdout = out
+	inst.virtiofsd.Stderr = out
+	if err := inst.virtiofsd.Start(); err != nil {
+		inst.virtiofsd = nil
+		return fmt.Errorf("failed to start virtiofsd: %v", err)
+	}
+	// qemu fails if the socket does not exist yet.
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(100 * time.Millisecond) {
+		if _, err := os.Stat(sock); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("virtiofsd did not create socket:\n%s", out.Bytes())
+}
+
+func (inst *instance) stopSharedDir() {
+	if inst.virtiofsd != nil {
+		inst.virtiofsd.Process.Kill()
+		inst.virtiofsd.Wait()
+		inst.virtiofsd = nil
+	}
+}
+
+// mountSharedDir mounts the shared dir inside of the booted VM.
+func (inst *instance) mountSharedDir() error {
+	if inst.cfg.SharedDir == "" {
+		return nil
+	}
+	mount := "mount -t virtiofs " + sharedTag
+	if inst.cfg.SharedDir == "9p" {
+		mount = "mount -t 9p -o trans=virtio,version=9p2000.L,msize=1048576 " + sharedTag
+	}
+	dir := inst.vmSharedDir()
+	args := append(inst.sshArgs("-p"), "root@localhost", fmt.Sprintf("mkdir -p %v && %v %v", dir, mount, dir))
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: ssh %#v", args)
+	}
+	if out, err := exec.Command("ssh", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount shared dir: %v\n%s", err, out)
+	}
+	return nil
+}
+
+// copyShared puts hostSrc into the shared dir and returns its name in the VM.
+func (inst *instance) copyShared(hostSrc string) (string, error) {
+	fi, err := os.Stat(hostSrc)
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Base(hostSrc)
+	dst := filepath.Join(inst.hostSharedDir(), base)
+	if err := fileutil.CopyFile(hostSrc, dst, false); err != nil {
+		return "", fmt.Errorf("failed to copy to shared dir: %v", err)
+	}
+	if err := os.Chmod(dst, fi.Mode()); err != nil {
+		return "", err
+	}
+	return filepath.Join(inst.vmSharedDir(), base), nil
+}
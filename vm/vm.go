@@ -9,13 +9,18 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"regexp"
-	"syscall"
+	"strings"
 	"time"
 
+	"github.com/google/syzkaller/log"
 	"github.com/google/syzkaller/report"
 )
 
+// Log is the logger of VM backends, its verbosity can be set with -vmodule=vm=N.
+const Log = log.Component("vm")
+
 // Instance represents a Linux VM or a remote physical machine.
 type Instance interface {
 	// Copy copies a hostSrc file into vm and returns file name in vm.
@@ -35,10 +40,41 @@ type Instance interface {
 	Close()
 }
 
+// Snapshotter is implemented by instances that can save their state and return to it later,
+// which is much faster than creating a new instance.
+type Snapshotter interface {
+	// Snapshot saves the current state of the VM, replacing the previous snapshot.
+	Snapshot() error
+
+	// Restore returns the VM to the state saved by Snapshot.
+	// Output of commands started before Restore is discarded, the commands are terminated.
+	Restore() error
+}
+
+// Diagnoser is implemented by instances that can collect debugging information
+// from a VM that stopped producing output (e.g. a hung kernel), before it is destroyed.
+type Diagnoser interface {
+	// Diagnose asks the kernel to dump state (e.g. stacks of blocked tasks with SysRq-w)
+	// to the console, the dump shows up in the output of Run. The returned output
+	// (e.g. vCPU state queried from the hypervisor) is appended to the report.
+	Diagnose() []byte
+}
+
+// SharedDirer is implemented by instances that have a host dir mounted inside of the VM.
+// Files put into the dir are visible in the VM without copying, which is much faster
+// than Copy for large files (images, coverage dumps); files written by the VM can be read on the host.
+type SharedDirer interface {
+	// SharedDir returns path of the shared dir on the host and inside of the VM,
+	// or empty paths if the instance does not have a shared dir.
+	SharedDir() (hostDir, vmDir string)
+}
+
 type Config struct {
 	Name        string
 	Index       int
 	Workdir     string
+	OS          string // OS of the kernel (target_os in the manager config)
+	Arch        string // arch of the kernel (target_arch in the manager config)
 	Bin         string
 	BinArgs     string
 	Initrd      string
@@ -52,6 +88,34 @@ type Config struct {
 	Cpu         int
 	Mem         int
 	Debug       bool
+
+	// Host resource limits enforced by Watchdog, 0 means no limit.
+	HostMemLimit int // MB of memory used by host processes of the VM, see HostProcesser
+	HostCpuLimit int // percent of a host CPU used by host processes of the VM
+	DiskLimit    int // MB of disk used by the VM workdir
+
+	// qemu only.
+	Snapshot  bool   // enable Snapshot/Restore, see Snapshotter
+	SharedDir string // "9p" or "virtiofs" to share a dir with the VM, see SharedDirer
+
+	// isolated only.
+	Target    string // [user@]host[:port] of the machine
+	TargetDir string // dir for syzkaller binaries on the machine
+	RebootCmd string // power-cycles the machine if it does not reboot over ssh
+
+	// bhyve only.
+	Dataset string // ZFS volume with the disk image
+	Bridge  string // bridge interface for the VM tap
+
+	// hyperv only.
+	Switch string // virtual switch the VM is connected to
+
+	// adb and isolated only.
+	Console string // adb: console device of the adb device (detected if empty), isolated: console command
+
+	// adb only.
+	MinBattery int // min battery level in percent to fuzz
+	MaxTemp    int // max battery temperature in Celsius to fuzz
 }
 
 type ctorFunc func(cfg *Config) (Instance, error)
@@ -79,15 +143,79 @@ func LongPipe() (io.ReadCloser, io.WriteCloser, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create pipe: %v", err)
 	}
-	for sz := 128 << 10; sz <= 2<<20; sz *= 2 {
-		syscall.Syscall(syscall.SYS_FCNTL, w.Fd(), syscall.F_SETPIPE_SZ, uintptr(sz))
-	}
+	setPipeSize(w)
 	return r, w, err
 }
 
 var TimeoutErr = errors.New("timeout")
 
-func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput bool, ignores []*regexp.Regexp) (desc string, text, output []byte, crashed, timedout bool) {
+// Titles of failures detected by MonitorExecution that are not kernel crash reports.
+const (
+	NoOutputTitle       = "no output from test machine"
+	NotExecutingTitle   = "test machine is not executing programs"
+	LostConnectionTitle = "lost connection to test machine"
+	RebootTitle         = "unexpected kernel reboot"
+	FuzzerCrashPrefix   = "SYZFAIL: "
+)
+
+// FailureKind is a class of failures detected by MonitorExecution, see Classify.
+type FailureKind int
+
+const (
+	KernelCrash    FailureKind = iota // the kernel printed a crash report
+	Hang                              // the machine stopped printing anything or executing programs
+	LostConnection                    // the machine became unreachable without a crash report
+	Reboot                            // the machine rebooted without a crash report
+	FuzzerCrash                       // syz-fuzzer, syz-execprog or syz-executor crashed
+)
+
+// Classify returns the kind of the failure with title desc returned by MonitorExecution.
+// Kernel crashes and hangs are kernel bugs. Lost connections and silent reboots
+// frequently mean problems with the machine, fuzzer crashes are bugs in syzkaller.
+func Classify(desc string) FailureKind {
+	switch {
+	case desc == NoOutputTitle || desc == NotExecutingTitle:
+		return Hang
+	case desc == LostConnectionTitle:
+		return LostConnection
+	case desc == RebootTitle:
+		return Reboot
+	case strings.HasPrefix(desc, FuzzerCrashPrefix):
+		return FuzzerCrash
+	default:
+		return KernelCrash
+	}
+}
+
+var (
+	// Boot banners of the kernel and firmware. The output is collected after the machine
+	// has booted, so a banner means that it rebooted without printing a crash report.
+	rebootRe = regexp.MustCompile(`(?m)^(?:\[ *[0-9]+\.[0-9]+\] )?(?:Linux version [0-9]|Booting the kernel|SeaBIOS \(version|Copyright \(c\) .*(?:The FreeBSD Project|The NetBSD Foundation|The Regents of the University of California))`)
+	// Go panics and runtime errors of syz-fuzzer and syz-execprog, they are followed
+	// by goroutine stacks. Executor failures make syz-fuzzer panic with "executor failed".
+	fuzzerCrashRe = regexp.MustCompile(`(?m)^(?:panic|fatal error): (.+)$`)
+	goroutineRe   = regexp.MustCompile(`(?m)^goroutine [0-9]+ \[`)
+)
+
+// classifyOutput returns the title of a failure that is not a kernel crash report
+// (a crash of syzkaller binaries or a silent reboot) found in output, or defaultError.
+func classifyOutput(output []byte, defaultError string) string {
+	if match := fuzzerCrashRe.FindSubmatch(output); match != nil && goroutineRe.Match(output) {
+		msg := strings.TrimSpace(string(match[1]))
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return FuzzerCrashPrefix + msg
+	}
+	if rebootRe.Match(output) {
+		return RebootTitle
+	}
+	return defaultError
+}
+
+// MonitorExecution monitors output of a command running in inst, see Instance.Run.
+// It returns when the command exits, the kernel crashes or hangs.
+func MonitorExecution(inst Instance, outc <-chan []byte, errc <-chan error, local, needOutput bool, ignores []*regexp.Regexp) (desc string, text, output []byte, crashed, timedout bool) {
 	waitForOutput := func() {
 		dur := time.Second
 		if needOutput {
@@ -107,6 +235,17 @@ func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput b
 		}
 	}
 
+	// diagnose collects state of a hung machine that does not print anything on its own.
+	diagnose := func() {
+		d, ok := inst.(Diagnoser)
+		if !ok {
+			return
+		}
+		diag := d.Diagnose()
+		waitForOutput()
+		output = append(output, diag...)
+	}
+
 	matchPos := 0
 	const (
 		beforeContext = 256 << 10
@@ -119,7 +258,7 @@ func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput b
 			return "preempted", nil, nil, false, true
 		}
 		if !report.ContainsCrash(output[matchPos:], ignores) {
-			return defaultError, nil, output, true, false
+			return classifyOutput(output, defaultError), nil, output, true, false
 		}
 		desc, text, start, end := report.Parse(output[matchPos:], ignores)
 		start = start + matchPos - beforeContext
@@ -153,7 +292,7 @@ func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput b
 			default:
 				// Note: connection lost can race with a kernel oops message.
 				// In such case we want to return the kernel oops.
-				return extractError("lost connection to test machine")
+				return extractError(LostConnectionTitle)
 			}
 		case out := <-outc:
 			output = append(output, out...)
@@ -163,6 +302,9 @@ func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput b
 			if bytes.Index(output[matchPos:], []byte("executed programs:")) != -1 { // syz-execprog output
 				lastExecuteTime = time.Now()
 			}
+			if bytes.Index(output[matchPos:], []byte("fuzzing paused")) != -1 { // syz-fuzzer paused by manager
+				lastExecuteTime = time.Now()
+			}
 			if report.ContainsCrash(output[matchPos:], ignores) {
 				return extractError("")
 			}
@@ -177,12 +319,13 @@ func MonitorExecution(outc <-chan []byte, errc <-chan error, local, needOutput b
 			// In some cases kernel constantly prints something to console,
 			// but fuzzer is not actually executing programs.
 			if !local && time.Since(lastExecuteTime) > 3*time.Minute {
-				return "test machine is not executing programs", nil, output, true, false
+				return classifyOutput(output, NotExecutingTitle), nil, output, true, false
 			}
 		case <-ticker.C:
 			tickerFired = true
 			if !local {
-				return "no output from test machine", nil, output, true, false
+				diagnose()
+				return classifyOutput(output, NoOutputTitle), nil, output, true, false
 			}
 		case <-Shutdown:
 			return "", nil, nil, false, false
@@ -200,3 +343,36 @@ func SleepInterruptible(d time.Duration) bool {
 		return false
 	}
 }
+
+// RunTimeout runs cmd, kills it after timeout and returns its combined output.
+func RunTimeout(cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	timedout := make(chan bool, 1)
+	timer := time.AfterFunc(timeout, func() {
+		timedout <- true
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	select {
+	case <-timedout:
+		return out.Bytes(), fmt.Errorf("timed out after %v", timeout)
+	default:
+	}
+	return out.Bytes(), err
+}
+
+// SSH runs command on the machine with ssh; args are the ssh options followed by user@host.
+func SSH(args []string, timeout time.Duration, command string) ([]byte, error) {
+	args = append(append([]string{}, args...), command)
+	out, err := RunTimeout(exec.Command("ssh", args...), timeout)
+	if err != nil {
+		return nil, fmt.Errorf("ssh %v failed: %v\n%s", command, err, out)
+	}
+	return out, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		desc   string
+		kind   FailureKind
+	}{
+		{
+			`2017/10/02 12:34:56 executing program 0:
+mmap(&(0x7f0000000000/0x1000)=nil, 0x1000, 0x3, 0x32, 0xffffffffffffffff, 0x0)
+`,
+			LostConnectionTitle,
+			LostConnection,
+		},
+		{
+			`2017/10/02 12:34:56 executing program 0:
+panic: executor failed: failed to mmap shmem (errno 12)
+
+goroutine 25 [running]:
+main.(*Proc).execute(0xc4201a2000, 0xc420106000, 0x0)
+`,
+			"SYZFAIL: executor failed: failed to mmap shmem (errno 12)",
+			FuzzerCrash,
+		},
+		{
+			`fatal error: concurrent map writes
+
+goroutine 12 [running]:
+runtime.throw(0x8c3f28, 0x15)
+`,
+			"SYZFAIL: concurrent map writes",
+			FuzzerCrash,
+		},
+		{
+			// A BSD kernel panic, it is not followed by goroutine stacks.
+			`panic: vrele: negative ref cnt
+`,
+			LostConnectionTitle,
+			LostConnection,
+		},
+		{
+			`2017/10/02 12:34:56 executing program 0:
+mmap(&(0x7f0000000000/0x1000)=nil, 0x1000, 0x3, 0x32, 0xffffffffffffffff, 0x0)
+SeaBIOS (version 1.10.2-1)
+iPXE (http://ipxe.org) 00:03.0 C980 PCI2.10 PnP PMM+BFF8F8A0+BFECF8A0 C980
+[    0.000000] Linux version 4.14.0-rc1+ (user@host) (gcc version 7.1.0) #25 SMP
+`,
+			RebootTitle,
+			Reboot,
+		},
+		{
+			`Copyright (c) 1992-2017 The FreeBSD Project.
+`,
+			RebootTitle,
+			Reboot,
+		},
+	}
+	for i, test := range tests {
+		desc := classifyOutput([]byte(test.output), LostConnectionTitle)
+		if desc != test.desc {
+			t.Errorf("#%v: got desc %q, want %q", i, desc, test.desc)
+			continue
+		}
+		if kind := Classify(desc); kind != test.kind {
+			t.Errorf("#%v: got kind %v, want %v", i, kind, test.kind)
+		}
+	}
+	if kind := Classify(NoOutputTitle); kind != Hang {
+		t.Errorf("got kind %v for %q, want %v", kind, NoOutputTitle, Hang)
+	}
+	if kind := Classify("KASAN: use-after-free Read in tun_detach_all"); kind != KernelCrash {
+		t.Errorf("got kind %v for a kernel crash, want %v", kind, KernelCrash)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	out, err := RunTimeout(exec.Command("sh", "-c", "echo foo; echo bar >&2"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "foo\nbar\n"; string(out) != want {
+		t.Fatalf("got output '%s', want '%s'", out, want)
+	}
+	_, err = RunTimeout(exec.Command("sleep", "100"), 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("command did not time out: %v", err)
+	}
+}
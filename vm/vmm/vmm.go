@@ -0,0 +1,316 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package vmm runs OpenBSD VMs with vmd(8) on OpenBSD hosts.
+// Every VM boots a copy of the image (so VMs don't affect each other and the original image),
+// VMs are started and stopped with vmctl(8), the kernel console is read with vmctl start -c
+// and commands are run over ssh. VMs are started with a local interface (vmctl start -L),
+// so the addresses of the VM and of the host side of the interface follow from the VM id.
+package vmm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/fileutil"
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("vmm", ctor)
+}
+
+type instance struct {
+	cfg     *vm.Config
+	name    string // vmd VM name
+	disk    string // copy of the image the VM boots
+	hostIP  string // host side of the VM local interface, VM connects to the manager on it
+	ip      string // address of the VM
+	console *exec.Cmd
+	waiterC chan error
+	merger  *vm.OutputMerger
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{
+		cfg:  cfg,
+		name: cfg.Name,
+		disk: filepath.Join(cfg.Workdir, "disk.img"),
+	}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	// Leftovers of a previous manager run.
+	inst.stop()
+	if err := fileutil.CopyFile(cfg.Image, inst.disk, true); err != nil {
+		return nil, fmt.Errorf("failed to copy image: %v", err)
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "vmctl"
+	}
+	if cfg.Image == "" {
+		return fmt.Errorf("image is not specified (required for vmm)")
+	}
+	if _, err := os.Stat(cfg.Image); err != nil {
+		return fmt.Errorf("image '%v' does not exist: %v", cfg.Image, err)
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	// vmm(4) supports only 1 CPU per VM.
+	if cfg.Cpu != 1 {
+		return fmt.Errorf("bad vmm cpu: %v, want 1", cfg.Cpu)
+	}
+	if cfg.Mem < 128 || cfg.Mem > 1048576 {
+		return fmt.Errorf("bad vmm mem: %v, want [128-1048576]", cfg.Mem)
+	}
+	return nil
+}
+
+func (inst *instance) Close() {
+	inst.stop()
+	if inst.console != nil {
+		inst.console.Process.Kill()
+		err := <-inst.waiterC
+		inst.waiterC <- err // repost it for waiting goroutines
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+	}
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+// stop stops the VM, errors are ignored as the VM may not exist.
+func (inst *instance) stop() {
+	exec.Command(inst.cfg.Bin, "stop", "-f", inst.name).Run()
+}
+
+// parseVMID returns id of the VM name in vmctl status output or 0 if the VM is not listed.
+func parseVMID(status []byte, name string) int {
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[len(fields)-1] != name {
+			continue
+		}
+		if id, err := strconv.Atoi(fields[0]); err == nil {
+			return id
+		}
+	}
+	return 0
+}
+
+func (inst *instance) boot() error {
+	args := []string{
+		"start", "-c", "-L",
+		"-m", fmt.Sprintf("%vM", inst.cfg.Mem),
+		"-d", inst.disk,
+	}
+	if inst.cfg.Kernel != "" {
+		args = append(args, "-b", inst.cfg.Kernel)
+	}
+	if inst.cfg.BinArgs != "" {
+		args = append(args, strings.Fields(inst.cfg.BinArgs)...)
+	}
+	args = append(args, inst.name)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: %v %#v", inst.cfg.Bin, args)
+	}
+	// With -c vmctl attaches to the VM console with cu, so the console is read from its output.
+	conRpipe, conWpipe, err := vm.LongPipe()
+	if err != nil {
+		return err
+	}
+	console := exec.Command(inst.cfg.Bin, args...)
+	console.Stdout = conWpipe
+	console.Stderr = conWpipe
+	if _, err := console.StdinPipe(); err != nil { // cu exits on stdin EOF
+		conRpipe.Close()
+		conWpipe.Close()
+		return err
+	}
+	if err := console.Start(); err != nil {
+		conRpipe.Close()
+		conWpipe.Close()
+		return fmt.Errorf("failed to start %v %+v: %v", inst.cfg.Bin, args, err)
+	}
+	conWpipe.Close()
+	inst.console = console
+	inst.waiterC = make(chan error, 1)
+	go func() {
+		err := console.Wait()
+		inst.waiterC <- err
+	}()
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("console", conRpipe)
+
+	// Wait for the VM to show up in vmctl status to learn its id.
+	var bootOutput []byte
+	start := time.Now()
+	for inst.ip == "" {
+		if out, err := exec.Command(inst.cfg.Bin, "status", inst.name).Output(); err == nil {
+			if id := parseVMID(out, inst.name); id != 0 {
+				inst.hostIP = fmt.Sprintf("100.64.%v.2", id)
+				inst.ip = fmt.Sprintf("100.64.%v.3", id)
+				break
+			}
+		}
+		select {
+		case out := <-inst.merger.Output:
+			bootOutput = append(bootOutput, out...)
+		case err := <-inst.merger.Err:
+			return fmt.Errorf("console failed: %v\n%s", err, bootOutput)
+		case err := <-inst.waiterC:
+			inst.waiterC <- err // repost it for Close
+			return fmt.Errorf("vmctl stopped: %v\n%s", err, bootOutput)
+		case <-time.After(time.Second):
+		case <-vm.Shutdown:
+			return fmt.Errorf("shutdown in progress")
+		}
+		if time.Since(start) > time.Minute {
+			return fmt.Errorf("VM %v did not start:\n%s", inst.name, bootOutput)
+		}
+	}
+	// Wait for ssh server to come up.
+	start = time.Now()
+	for {
+		if _, err := inst.ssh(time.Minute, "true"); err == nil {
+			break
+		}
+		select {
+		case err := <-inst.waiterC:
+			inst.waiterC <- err // repost it for Close
+			return fmt.Errorf("vmctl stopped: %v", err)
+		default:
+		}
+		if time.Since(start) > 10*time.Minute {
+			return fmt.Errorf("ssh server did not start on %v", inst.ip)
+		}
+		if !vm.SleepInterruptible(5 * time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	inst.merger.Drain()
+	return nil
+}
+
+func (inst *instance) ssh(timeout time.Duration, command string) ([]byte, error) {
+	return vm.SSH(append(inst.sshArgs("-p"), "root@"+inst.ip), timeout, command)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	return fmt.Sprintf("%v:%v", inst.hostIP, port), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDst := filepath.Join("/root", filepath.Base(hostSrc))
+	args := append(inst.sshArgs("-P"), hostSrc, "root@"+inst.ip+":"+vmDst)
+	cmd := exec.Command("scp", args...)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: scp %#v", args)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stdout
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-time.After(3 * time.Minute):
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil {
+		return "", err
+	}
+	return vmDst, nil
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("ssh", rpipe)
+
+	args := append(inst.sshArgs("-p"), "root@"+inst.ip, command)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: ssh %#v", args)
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	errc := make(chan error, 1)
+	signal := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	go func() {
+		select {
+		case <-time.After(timeout):
+			signal(vm.TimeoutErr)
+		case <-stop:
+			signal(vm.TimeoutErr)
+		case err := <-inst.merger.Err:
+			signal(err)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	return inst.merger.Output, errc, nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		"-i", inst.cfg.Sshkey,
+		portArg, "22",
+		"-F", "/dev/null",
+		"-o", "ConnectionAttempts=10",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
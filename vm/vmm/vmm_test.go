@@ -0,0 +1,30 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vmm
+
+import (
+	"testing"
+)
+
+func TestParseVMID(t *testing.T) {
+	status := "   ID   PID VCPUS  MAXMEM  CURMEM     TTY        OWNER NAME\n" +
+		"    3 61520     1    1.0G    120M   ttyp3         root vmm-ci-10\n" +
+		"    1 48712     1    1.0G    301M   ttyp1         root vmm-ci-1\n" +
+		"    2     -     1    512M       -       -         root other\n"
+	tests := []struct {
+		name string
+		id   int
+	}{
+		{"vmm-ci-1", 1},
+		{"vmm-ci-10", 3},
+		{"other", 2},
+		{"vmm-ci-2", 0},
+		{"NAME", 0},
+	}
+	for _, test := range tests {
+		if id := parseVMID([]byte(status), test.name); id != test.id {
+			t.Errorf("got id %v, want %v for VM %v", id, test.id, test.name)
+		}
+	}
+}
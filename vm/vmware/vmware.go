@@ -0,0 +1,467 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package vmware runs VMs with VMware Workstation/Fusion (controlled with vmrun)
+// or VMware ESXi/vCenter (controlled with govc, selected if bin is govc).
+// Every VM is a linked clone of the template VM (image) made from its "syzkaller" snapshot,
+// the kernel console is a serial port (a unix socket for Workstation, network serial port
+// on the ESXi host for ESXi), commands are run over ssh. The address of a VM is reported
+// by VMware Tools, so the image must run them (e.g. open-vm-tools).
+package vmware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/vm"
+)
+
+func init() {
+	vm.Register("vmware", ctor)
+}
+
+const (
+	snapshotName = "syzkaller"
+	// ESXi console of VM N is served on consoleBasePort+N of the ESXi host.
+	consoleBasePort = 54000
+)
+
+// driver abstracts the tool used to control VMs.
+type driver interface {
+	// clone creates the VM from the template with serial console enabled.
+	clone() error
+	start() error
+	// ip waits for VMware Tools to report the address of the VM.
+	ip() (string, error)
+	// console connects to the serial console of the VM.
+	console() (net.Conn, error)
+	// destroy stops and removes the VM if it exists.
+	destroy()
+}
+
+type instance struct {
+	cfg    *vm.Config
+	drv    driver
+	ip     string
+	conn   net.Conn
+	merger *vm.OutputMerger
+}
+
+func ctor(cfg *vm.Config) (vm.Instance, error) {
+	inst := &instance{cfg: cfg}
+	closeInst := inst
+	defer func() {
+		if closeInst != nil {
+			closeInst.Close()
+		}
+	}()
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if filepath.Base(cfg.Bin) == "govc" {
+		drv, err := newGovc(cfg)
+		if err != nil {
+			return nil, err
+		}
+		inst.drv = drv
+	} else {
+		inst.drv = &vmrun{cfg: cfg, vmx: filepath.Join(cfg.Workdir, "vm", "syz.vmx")}
+	}
+	// Leftovers of a previous manager run.
+	inst.drv.destroy()
+	if err := inst.drv.clone(); err != nil {
+		return nil, err
+	}
+	if err := inst.boot(); err != nil {
+		return nil, err
+	}
+	closeInst = nil
+	return inst, nil
+}
+
+func validateConfig(cfg *vm.Config) error {
+	if cfg.Bin == "" {
+		cfg.Bin = "vmrun"
+	}
+	if cfg.Image == "" {
+		return fmt.Errorf("image is not specified (required for vmware, template VM)")
+	}
+	if _, err := os.Stat(cfg.Sshkey); err != nil {
+		return fmt.Errorf("ssh key '%v' does not exist: %v", cfg.Sshkey, err)
+	}
+	return nil
+}
+
+func (inst *instance) boot() error {
+	if err := inst.drv.start(); err != nil {
+		return err
+	}
+	// Connect to the console right after start, so that boot output is not lost.
+	var err error
+	for i := 0; ; i++ {
+		if inst.conn, err = inst.drv.console(); err == nil {
+			break
+		}
+		if i == 30 {
+			return err
+		}
+		if !vm.SleepInterruptible(time.Second) {
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	var tee io.Writer
+	if inst.cfg.Debug {
+		tee = os.Stdout
+	}
+	inst.merger = vm.NewOutputMerger(tee)
+	inst.merger.Add("console", inst.conn)
+
+	bootOutput := new(bytes.Buffer)
+	bootOutputStop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case out := <-inst.merger.Output:
+				bootOutput.Write(out)
+			case <-bootOutputStop:
+				close(bootOutputStop)
+				return
+			}
+		}
+	}()
+	stopBootOutput := func() []byte {
+		bootOutputStop <- true
+		<-bootOutputStop
+		return bootOutput.Bytes()
+	}
+	if inst.ip, err = inst.drv.ip(); err != nil {
+		return fmt.Errorf("%v\n%s", err, stopBootOutput())
+	}
+	start := time.Now()
+	for {
+		if _, err := inst.ssh(time.Minute, "true"); err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Minute {
+			return fmt.Errorf("ssh server did not start on %v:\n%s", inst.ip, stopBootOutput())
+		}
+		if !vm.SleepInterruptible(5 * time.Second) {
+			stopBootOutput()
+			return fmt.Errorf("shutdown in progress")
+		}
+	}
+	stopBootOutput()
+	return nil
+}
+
+func (inst *instance) Close() {
+	if inst.drv != nil {
+		inst.drv.destroy()
+	}
+	if inst.conn != nil {
+		inst.conn.Close()
+	}
+	if inst.merger != nil {
+		inst.merger.Wait()
+	}
+	os.RemoveAll(inst.cfg.Workdir)
+}
+
+// run runs bin with args and returns its combined output.
+func run(debug bool, timeout time.Duration, bin string, args ...string) ([]byte, error) {
+	if debug {
+		vm.Log.Logf(0, "running command: %v %#v", bin, args)
+	}
+	cmd := exec.Command(bin, args...)
+	out, err := vm.RunTimeout(cmd, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%v %v failed: %v\n%s", bin, strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+// vmrun controls VMs of VMware Workstation/Fusion, bin_args are connection flags (default: -T ws).
+type vmrun struct {
+	cfg *vm.Config
+	vmx string
+}
+
+// snapshotMu protects creation of the template snapshot by concurrently booting VMs.
+var snapshotMu sync.Mutex
+
+func (drv *vmrun) run(timeout time.Duration, args ...string) ([]byte, error) {
+	flags := strings.Fields(drv.cfg.BinArgs)
+	if len(flags) == 0 {
+		flags = []string{"-T", "ws"}
+	}
+	return run(drv.cfg.Debug, timeout, drv.cfg.Bin, append(flags, args...)...)
+}
+
+func (drv *vmrun) consoleSock() string {
+	return filepath.Join(drv.cfg.Workdir, "console.sock")
+}
+
+func (drv *vmrun) clone() error {
+	snapshotMu.Lock()
+	out, err := drv.run(time.Minute, "listSnapshots", drv.cfg.Image)
+	if err == nil && !hasLine(out, snapshotName) {
+		_, err = drv.run(10*time.Minute, "snapshot", drv.cfg.Image, snapshotName)
+	}
+	snapshotMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, err := drv.run(10*time.Minute, "clone", drv.cfg.Image, drv.vmx, "linked",
+		"-snapshot="+snapshotName, "-cloneName="+drv.cfg.Name); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(drv.vmx)
+	if err != nil {
+		return fmt.Errorf("failed to read vmx: %v", err)
+	}
+	return ioutil.WriteFile(drv.vmx, setSerialConsole(data, drv.consoleSock()), 0600)
+}
+
+// setSerialConsole replaces serial0 settings in vmx file data with a unix socket console.
+func setSerialConsole(data []byte, sock string) []byte {
+	buf := new(bytes.Buffer)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "serial0.") || line == "" {
+			continue
+		}
+		fmt.Fprintf(buf, "%v\n", line)
+	}
+	fmt.Fprintf(buf, "serial0.present = \"TRUE\"\n")
+	fmt.Fprintf(buf, "serial0.fileType = \"pipe\"\n")
+	fmt.Fprintf(buf, "serial0.fileName = %q\n", sock)
+	fmt.Fprintf(buf, "serial0.pipe.endPoint = \"server\"\n")
+	fmt.Fprintf(buf, "serial0.tryNoRxLoss = \"TRUE\"\n")
+	return buf.Bytes()
+}
+
+func hasLine(out []byte, s string) bool {
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (drv *vmrun) start() error {
+	_, err := drv.run(5*time.Minute, "start", drv.vmx, "nogui")
+	return err
+}
+
+func (drv *vmrun) ip() (string, error) {
+	out, err := drv.run(10*time.Minute, "getGuestIPAddress", drv.vmx, "-wait")
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(out))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("bad VM address: %q", out)
+	}
+	return ip, nil
+}
+
+func (drv *vmrun) console() (net.Conn, error) {
+	return net.Dial("unix", drv.consoleSock())
+}
+
+func (drv *vmrun) destroy() {
+	if _, err := os.Stat(drv.vmx); err != nil {
+		return
+	}
+	drv.run(5*time.Minute, "stop", drv.vmx, "hard")
+	drv.run(5*time.Minute, "deleteVM", drv.vmx)
+}
+
+// govc controls VMs on ESXi/vCenter, the connection is configured with GOVC_URL and other
+// GOVC_* environment variables, bin_args are additional flags for vm.clone (e.g. -ds or -pool).
+type govc struct {
+	cfg  *vm.Config
+	name string
+	host string // ESXi host, serves the console
+	port int
+}
+
+func newGovc(cfg *vm.Config) (*govc, error) {
+	addr := os.Getenv("GOVC_URL")
+	if !strings.Contains(addr, "://") {
+		addr = "https://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("GOVC_URL must be set to URL of the ESXi host for govc")
+	}
+	drv := &govc{
+		cfg:  cfg,
+		name: "syz-" + cfg.Name,
+		host: u.Hostname(),
+		port: consoleBasePort + cfg.Index,
+	}
+	return drv, nil
+}
+
+func (drv *govc) run(timeout time.Duration, args ...string) ([]byte, error) {
+	return run(drv.cfg.Debug, timeout, drv.cfg.Bin, args...)
+}
+
+func (drv *govc) clone() error {
+	args := []string{"vm.clone", "-vm", drv.cfg.Image, "-link", "-snapshot", snapshotName, "-on=false"}
+	args = append(args, strings.Fields(drv.cfg.BinArgs)...)
+	if _, err := drv.run(10*time.Minute, append(args, drv.name)...); err != nil {
+		return err
+	}
+	out, err := drv.run(time.Minute, "device.serial.add", "-vm", drv.name)
+	if err != nil {
+		return err
+	}
+	dev := strings.TrimSpace(string(out)) // e.g. serialport-9000
+	// The ESXi firewall must allow incoming connections to the port (remoteSerialPort rule).
+	_, err = drv.run(time.Minute, "device.serial.connect", "-vm", drv.name, "-device", dev,
+		fmt.Sprintf("telnet://:%v", drv.port))
+	return err
+}
+
+func (drv *govc) start() error {
+	_, err := drv.run(5*time.Minute, "vm.power", "-on", drv.name)
+	return err
+}
+
+func (drv *govc) ip() (string, error) {
+	out, err := drv.run(10*time.Minute, "vm.ip", "-v4", drv.name)
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(out))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("bad VM address: %q", out)
+	}
+	return ip, nil
+}
+
+func (drv *govc) console() (net.Conn, error) {
+	// This is a telnet server, but it does not negotiate anything unless asked to.
+	return net.DialTimeout("tcp", net.JoinHostPort(drv.host, strconv.Itoa(drv.port)), 10*time.Second)
+}
+
+func (drv *govc) destroy() {
+	drv.run(5*time.Minute, "vm.destroy", drv.name)
+}
+
+func (inst *instance) ssh(timeout time.Duration, command string) ([]byte, error) {
+	return vm.SSH(append(inst.sshArgs("-p"), "root@"+inst.ip), timeout, command)
+}
+
+func (inst *instance) Forward(port int) (string, error) {
+	// The VM connects to the address the host is reachable at from the VM.
+	conn, err := net.Dial("udp", net.JoinHostPort(inst.ip, "22"))
+	if err != nil {
+		return "", fmt.Errorf("failed to find route to %v: %v", inst.ip, err)
+	}
+	defer conn.Close()
+	host := conn.LocalAddr().(*net.UDPAddr).IP
+	return net.JoinHostPort(host.String(), strconv.Itoa(port)), nil
+}
+
+func (inst *instance) Copy(hostSrc string) (string, error) {
+	vmDst := filepath.Join("/root", filepath.Base(hostSrc))
+	args := append(inst.sshArgs("-P"), hostSrc, "root@"+inst.ip+":"+vmDst)
+	cmd := exec.Command("scp", args...)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: scp %#v", args)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stdout
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-time.After(3 * time.Minute):
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil {
+		return "", err
+	}
+	return vmDst, nil
+}
+
+func (inst *instance) Run(timeout time.Duration, stop <-chan bool, command string) (<-chan []byte, <-chan error, error) {
+	rpipe, wpipe, err := vm.LongPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	inst.merger.Add("ssh", rpipe)
+
+	args := append(inst.sshArgs("-p"), "root@"+inst.ip, command)
+	if inst.cfg.Debug {
+		vm.Log.Logf(0, "running command: ssh %#v", args)
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = wpipe
+	cmd.Stderr = wpipe
+	if err := cmd.Start(); err != nil {
+		wpipe.Close()
+		return nil, nil, err
+	}
+	wpipe.Close()
+	errc := make(chan error, 1)
+	signal := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	go func() {
+		select {
+		case <-time.After(timeout):
+			signal(vm.TimeoutErr)
+		case <-stop:
+			signal(vm.TimeoutErr)
+		case err := <-inst.merger.Err:
+			signal(err)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	return inst.merger.Output, errc, nil
+}
+
+func (inst *instance) sshArgs(portArg string) []string {
+	args := []string{
+		"-i", inst.cfg.Sshkey,
+		portArg, "22",
+		"-F", "/dev/null",
+		"-o", "ConnectionAttempts=10",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=error",
+	}
+	if inst.cfg.Debug {
+		args = append(args, "-v")
+	}
+	return args
+}
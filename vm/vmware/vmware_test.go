@@ -0,0 +1,40 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vmware
+
+import (
+	"testing"
+)
+
+func TestSetSerialConsole(t *testing.T) {
+	vmx := `.encoding = "UTF-8"
+displayName = "syzkaller"
+serial0.present = "TRUE"
+serial0.fileType = "file"
+Serial0.fileName = "serial.log"
+memsize = "2048"
+`
+	want := `.encoding = "UTF-8"
+displayName = "syzkaller"
+memsize = "2048"
+serial0.present = "TRUE"
+serial0.fileType = "pipe"
+serial0.fileName = "/workdir/instance-0/console.sock"
+serial0.pipe.endPoint = "server"
+serial0.tryNoRxLoss = "TRUE"
+`
+	if got := string(setSerialConsole([]byte(vmx), "/workdir/instance-0/console.sock")); got != want {
+		t.Fatalf("got vmx:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestHasLine(t *testing.T) {
+	out := []byte("Total snapshots: 2\nclean\nsyzkaller\n")
+	if !hasLine(out, "syzkaller") {
+		t.Errorf("snapshot syzkaller is not found in %q", out)
+	}
+	if hasLine(out, "syz") {
+		t.Errorf("snapshot syz is found in %q", out)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HostProcesser is implemented by instances that run processes on the host (e.g. qemu),
+// resources used by these processes are subject to limits enforced by Watchdog.
+type HostProcesser interface {
+	// HostPids returns pids of the host processes of the VM.
+	HostPids() []int
+}
+
+// LeakChecker finds and frees host resources (e.g. tap devices) leaked by VMs
+// with workdirs in workdir (see fileutil.ProcessTempDir), it returns the number of freed resources.
+type LeakChecker func(workdir string) int
+
+var leakCheckers = make(map[string]LeakChecker)
+
+// RegisterLeakChecker registers a checker of resources leaked by VMs of type typ.
+func RegisterLeakChecker(typ string, check LeakChecker) {
+	leakCheckers[typ] = check
+}
+
+const (
+	watchPeriod = 30 * time.Second
+	leakPeriod  = 5 * time.Minute
+)
+
+// Watchdog enforces host resource limits of VMs (Config.HostMemLimit, HostCpuLimit and DiskLimit)
+// and periodically cleans up host resources leaked by VMs of the manager: host processes
+// of VMs that were not properly destroyed and resources found by the registered LeakChecker.
+type Watchdog struct {
+	typ     string
+	workdir string
+	stat    func(name string, delta uint64)
+}
+
+// NewWatchdog creates a watchdog for VMs of type typ with workdirs in workdir.
+// stat is called for every event (e.g. "vm mem limit" or "vm leaks"), it can be used for statistics.
+func NewWatchdog(typ, workdir string, stat func(name string, delta uint64)) *Watchdog {
+	wd := &Watchdog{
+		typ:     typ,
+		workdir: workdir,
+		stat:    stat,
+	}
+	go wd.leakLoop()
+	return wd
+}
+
+func (wd *Watchdog) leakLoop() {
+	for {
+		// Leftovers of a previous manager run are cleaned up right away.
+		leaks := killStaleProcesses(wd.workdir)
+		if check := leakCheckers[wd.typ]; check != nil {
+			leaks += check(wd.workdir)
+		}
+		if leaks != 0 {
+			Log.Logf(0, "watchdog: freed %v host resources leaked by VMs", leaks)
+			wd.stat("vm leaks", uint64(leaks))
+		}
+		if !SleepInterruptible(leakPeriod) {
+			return
+		}
+	}
+}
+
+// Watch is a handle of a VM monitored by Watchdog.
+type Watch struct {
+	wd       *Watchdog
+	inst     Instance
+	cfg      *Config
+	stop     chan<- bool
+	stopped  chan bool
+	mu       sync.Mutex
+	exceeded string
+}
+
+// Watch monitors resources used by inst until Stop is called. When the VM exceeds
+// any of the limits set in cfg, a value is sent to stop (that must be passed to Instance.Run)
+// and the instance must be destroyed (rather than reused) after the command exits.
+func (wd *Watchdog) Watch(inst Instance, cfg *Config, stop chan<- bool) *Watch {
+	w := &Watch{
+		wd:      wd,
+		inst:    inst,
+		cfg:     cfg,
+		stop:    stop,
+		stopped: make(chan bool),
+	}
+	if cfg.HostMemLimit != 0 || cfg.HostCpuLimit != 0 || cfg.DiskLimit != 0 {
+		go w.loop()
+	}
+	return w
+}
+
+// Stop stops monitoring of the VM.
+func (w *Watch) Stop() {
+	close(w.stopped)
+}
+
+// Exceeded returns description of the exceeded limit, or an empty string if the VM is within limits.
+func (w *Watch) Exceeded() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.exceeded
+}
+
+func (w *Watch) loop() {
+	ticker := time.NewTicker(watchPeriod)
+	defer ticker.Stop()
+	var lastCpu time.Duration
+	var lastTime time.Time
+	for {
+		select {
+		case <-w.stopped:
+			return
+		case <-Shutdown:
+			return
+		case <-ticker.C:
+		}
+		stat, reason := "", ""
+		var pids []int
+		if hp, ok := w.inst.(HostProcesser); ok {
+			pids = hp.HostPids()
+		}
+		mem, cpu, err := hostUsage(pids)
+		if err == nil {
+			now := time.Now()
+			if limit := w.cfg.HostMemLimit; limit != 0 && mem > limit {
+				stat, reason = "vm mem limit", fmt.Sprintf("uses %vMB of host memory, limit %vMB", mem, limit)
+			} else if limit := w.cfg.HostCpuLimit; limit != 0 && !lastTime.IsZero() {
+				if usage := int((cpu - lastCpu) * 100 / now.Sub(lastTime)); usage > limit {
+					stat, reason = "vm cpu limit", fmt.Sprintf("uses %v%% of host CPU, limit %v%%", usage, limit)
+				}
+			}
+			lastCpu, lastTime = cpu, now
+		}
+		if limit := w.cfg.DiskLimit; stat == "" && limit != 0 {
+			if disk := dirSize(w.cfg.Workdir) >> 20; disk > int64(limit) {
+				stat, reason = "vm disk limit", fmt.Sprintf("uses %vMB of disk, limit %vMB", disk, limit)
+			}
+		}
+		if stat == "" {
+			continue
+		}
+		Log.Logf(0, "%v: %v, destroying", w.cfg.Name, reason)
+		w.wd.stat(stat, 1)
+		w.mu.Lock()
+		w.exceeded = reason
+		w.mu.Unlock()
+		select {
+		case w.stop <- true:
+		default:
+		}
+		return
+	}
+}
+
+// hostUsage returns memory (in MB) and CPU time used by the processes.
+func hostUsage(pids []int) (int, time.Duration, error) {
+	if len(pids) == 0 {
+		return 0, 0, fmt.Errorf("no host processes")
+	}
+	mem, cpu := 0, time.Duration(0)
+	for _, pid := range pids {
+		m, c, err := processUsage(pid)
+		if err != nil {
+			return 0, 0, err
+		}
+		mem += m
+		cpu += c
+	}
+	return mem, cpu, nil
+}
+
+// dirSize returns the total size of files in dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/syzkaller/fileutil"
+)
+
+// Linux reports CPU times in /proc in USER_HZ ticks, it is 100 on all architectures.
+const userHZ = 100
+
+// processUsage returns memory (resident, in MB) and CPU time used by the process.
+func processUsage(pid int) (int, time.Duration, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseProcStat(data)
+}
+
+func parseProcStat(data []byte) (int, time.Duration, error) {
+	// The command name can contain spaces and parenthesis, fields start after the last ')'.
+	pos := bytes.LastIndexByte(data, ')')
+	if pos == -1 {
+		return 0, 0, fmt.Errorf("bad /proc/pid/stat: %q", data)
+	}
+	// Fields are numbered from the state, which is field 3 in proc(5).
+	fields := strings.Fields(string(data[pos+1:]))
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("bad /proc/pid/stat: %q", data)
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	rss, err3 := strconv.ParseUint(fields[21], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, 0, fmt.Errorf("bad /proc/pid/stat: %q", data)
+	}
+	mem := int(rss * uint64(os.Getpagesize()) >> 20)
+	cpu := time.Duration(utime+stime) * time.Second / userHZ
+	return mem, cpu, nil
+}
+
+// killStaleProcesses kills processes that refer to VM workdirs (e.g. qemu with its monitor socket)
+// that are already removed or belong to dead managers, and returns the number of killed processes.
+func killStaleProcesses(workdir string) int {
+	prefix := filepath.Join(workdir, "instance-")
+	procs, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	killed := 0
+	for _, file := range procs {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(file)))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		dir := instanceDir(string(cmdline), prefix)
+		if dir == "" || !fileutil.StaleProcessTempDir(dir) {
+			continue
+		}
+		Log.Logf(0, "watchdog: killing stale process %v of %v: %q", pid, dir, bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1))
+		if syscall.Kill(pid, syscall.SIGKILL) == nil {
+			killed++
+		}
+	}
+	return killed
+}
+
+// instanceDir returns the VM workdir (prefix followed by the instance number) referred to by cmdline.
+func instanceDir(cmdline, prefix string) string {
+	pos := strings.Index(cmdline, prefix)
+	if pos == -1 {
+		return ""
+	}
+	end := pos + len(prefix)
+	for end < len(cmdline) && cmdline[end] >= '0' && cmdline[end] <= '9' {
+		end++
+	}
+	if end == pos+len(prefix) {
+		return ""
+	}
+	return cmdline[pos:end]
+}
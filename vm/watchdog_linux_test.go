@@ -0,0 +1,46 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package vm
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	// qemu with a space and parenthesis in the command name, utime=1500, stime=500, rss=65536 pages.
+	stat := "4242 (qemu (x86) 64) S 1 4242 4242 0 -1 4194560 100 0 0 0 1500 500 0 0 20 0 5 0 100 " +
+		"1000000000 65536 18446744073709551615 1 1 0 0 0 0 0 4096 16963 0 0 0 17 3 0 0 0 0 0"
+	mem, cpu, err := parseProcStat([]byte(stat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 65536 * os.Getpagesize() >> 20; mem != want {
+		t.Errorf("got mem %v, want %v", mem, want)
+	}
+	if want := 20 * time.Second; cpu != want {
+		t.Errorf("got cpu %v, want %v", cpu, want)
+	}
+	if _, _, err := parseProcStat([]byte("4242 (qemu) S 1")); err == nil {
+		t.Errorf("no error for truncated stat")
+	}
+}
+
+func TestInstanceDir(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		dir     string
+	}{
+		{"qemu-system-x86_64\x00-qmp\x00unix:/syz/workdir/instance-12/qmp.sock,server,nowait\x00", "/syz/workdir/instance-12"},
+		{"ssh\x00-i\x00/syz/workdir/instance-3/key\x00root@localhost\x00", "/syz/workdir/instance-3"},
+		{"qemu-system-x86_64\x00-hda\x00/syz/workdir/instance-lock\x00", ""},
+		{"bash\x00", ""},
+	}
+	for _, test := range tests {
+		if dir := instanceDir(test.cmdline, "/syz/workdir/instance-"); dir != test.dir {
+			t.Errorf("got dir %q, want %q for %q", dir, test.dir, test.cmdline)
+		}
+	}
+}
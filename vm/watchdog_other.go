@@ -0,0 +1,20 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package vm
+
+import (
+	"fmt"
+	"time"
+)
+
+func processUsage(pid int) (int, time.Duration, error) {
+	return 0, 0, fmt.Errorf("host process usage is not supported on this OS")
+}
+
+func killStaleProcesses(workdir string) int {
+	return 0
+}